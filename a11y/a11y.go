@@ -0,0 +1,263 @@
+// Package a11y runs basic accessibility checks on HTML, like missing alt
+// text, skipped heading levels and low contrast in inline styles
+package a11y
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	tagPattern  = regexp.MustCompile(`(?s)<(/?)([a-zA-Z][a-zA-Z0-9]*)(\s[^<>]*?)?/?>|<!--.*?-->`)
+	attrPattern = regexp.MustCompile(`([a-zA-Z_:][-a-zA-Z0-9_:.]*)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+)))?`)
+	rgbPattern  = regexp.MustCompile(`^rgba?\(\s*(\d+)\s*,\s*(\d+)\s*,\s*(\d+)\s*(?:,\s*[\d.]+\s*)?\)$`)
+)
+
+// namedColors are some of the named CSS colors
+var namedColors = map[string][3]float64{
+	"black": {0, 0, 0}, "white": {255, 255, 255}, "red": {255, 0, 0},
+	"green": {0, 128, 0}, "blue": {0, 0, 255}, "yellow": {255, 255, 0},
+	"gray": {128, 128, 128}, "grey": {128, 128, 128}, "silver": {192, 192, 192},
+	"navy": {0, 0, 128}, "maroon": {128, 0, 0}, "purple": {128, 0, 128},
+	"orange": {255, 165, 0}, "lightgray": {211, 211, 211}, "lightgrey": {211, 211, 211},
+	"darkgray": {169, 169, 169}, "darkgrey": {169, 169, 169},
+}
+
+// The lowest contrast ratio for normal text, in WCAG 2 AA
+const minContrast = 4.5
+
+// Finding is a possible accessibility problem
+type Finding struct {
+	Rule    string `json:"rule"`
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+// String returns the finding as "line 12: message (rule)"
+func (f Finding) String() string {
+	return fmt.Sprintf("line %d: %s (%s)", f.Line, f.Message, f.Rule)
+}
+
+// attributes returns the attributes of a tag, by lowercase name
+func attributes(text string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range attrPattern.FindAllStringSubmatch(text, -1) {
+		attrs[strings.ToLower(m[1])] = m[2] + m[3] + m[4]
+	}
+	return attrs
+}
+
+// parseColor parses a color like "#fff", "#1a2b3c", "rgb(1, 2, 3)" or
+// "white"
+func parseColor(s string) ([3]float64, bool) {
+	s = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "!important")))
+	if c, ok := namedColors[s]; ok {
+		return c, true
+	}
+	if strings.HasPrefix(s, "#") {
+		hex := s[1:]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		if len(hex) != 6 {
+			return [3]float64{}, false
+		}
+		var c [3]float64
+		for i := 0; i < 3; i++ {
+			n, err := strconv.ParseUint(hex[i*2:i*2+2], 16, 8)
+			if err != nil {
+				return [3]float64{}, false
+			}
+			c[i] = float64(n)
+		}
+		return c, true
+	}
+	if m := rgbPattern.FindStringSubmatch(s); m != nil {
+		var c [3]float64
+		for i := 0; i < 3; i++ {
+			n, _ := strconv.Atoi(m[i+1])
+			c[i] = math.Min(float64(n), 255)
+		}
+		return c, true
+	}
+	return [3]float64{}, false
+}
+
+// luminance returns the relative luminance of a color, as defined by WCAG
+func luminance(c [3]float64) float64 {
+	var l [3]float64
+	for i, v := range c {
+		v /= 255
+		if v <= 0.03928 {
+			l[i] = v / 12.92
+		} else {
+			l[i] = math.Pow((v+0.055)/1.055, 2.4)
+		}
+	}
+	return 0.2126*l[0] + 0.7152*l[1] + 0.0722*l[2]
+}
+
+// Contrast returns the WCAG contrast ratio between two colors, from 1 to 21
+func Contrast(a, b [3]float64) float64 {
+	la, lb := luminance(a), luminance(b)
+	if la < lb {
+		la, lb = lb, la
+	}
+	return (la + 0.05) / (lb + 0.05)
+}
+
+// styleColors returns the text and background colors in a style
+// attribute, if both are there
+func styleColors(style string) (fg, bg [3]float64, ok bool) {
+	var hasFg, hasBg bool
+	for _, decl := range strings.Split(style, ";") {
+		pos := strings.Index(decl, ":")
+		if pos == -1 {
+			continue
+		}
+		property := strings.ToLower(strings.TrimSpace(decl[:pos]))
+		value := decl[pos+1:]
+		switch property {
+		case "color":
+			fg, hasFg = parseColor(value)
+		case "background-color", "background":
+			bg, hasBg = parseColor(value)
+		}
+	}
+	return fg, bg, hasFg && hasBg
+}
+
+// link is an open <a> element, for checking that it has text
+type link struct {
+	line  int
+	label bool // has an aria-label, a title or an image with alt text
+	text  bool
+}
+
+// Check runs the accessibility checks on an HTML document
+func Check(html []byte) []Finding {
+	var (
+		findings  []Finding
+		links     []*link
+		heading   int
+		labelled  = make(map[string]bool)
+		inputs    []Finding // inputs without a label, until all labels are known
+		inputIDs  []string
+		labels    int
+		lastPos   int
+		lastLine  = 1
+		textStart int
+	)
+	add := func(rule string, line int, format string, args ...interface{}) {
+		findings = append(findings, Finding{rule, line, fmt.Sprintf(format, args...)})
+	}
+	for _, loc := range tagPattern.FindAllSubmatchIndex(html, -1) {
+		// Track the text between the tags, for the text of links
+		if len(links) > 0 && len(bytes.TrimSpace(html[textStart:loc[0]])) > 0 {
+			links[len(links)-1].text = true
+		}
+		textStart = loc[1]
+		lastLine += bytes.Count(html[lastPos:loc[0]], []byte("\n"))
+		lastPos = loc[0]
+		if loc[4] == -1 {
+			// A comment
+			continue
+		}
+		line := lastLine
+		closing := loc[3] > loc[2]
+		name := strings.ToLower(string(html[loc[4]:loc[5]]))
+		var attrs map[string]string
+		if loc[6] != -1 {
+			attrs = attributes(string(html[loc[6]:loc[7]]))
+		} else {
+			attrs = map[string]string{}
+		}
+		if closing {
+			switch name {
+			case "a":
+				if n := len(links); n > 0 {
+					l := links[n-1]
+					links = links[:n-1]
+					if !l.text && !l.label {
+						add("link-text", l.line, "link has no text, aria-label or title")
+					}
+				}
+			case "label":
+				if labels > 0 {
+					labels--
+				}
+			}
+			continue
+		}
+		hidden := attrs["aria-hidden"] == "true" || attrs["role"] == "presentation" || attrs["role"] == "none"
+		if style, ok := attrs["style"]; ok {
+			if fg, bg, ok := styleColors(style); ok {
+				if ratio := Contrast(fg, bg); ratio < minContrast {
+					add("contrast", line, "<%s> has a contrast ratio of %.2f:1, it should be at least %.1f:1", name, ratio, minContrast)
+				}
+			}
+		}
+		switch name {
+		case "html":
+			if strings.TrimSpace(attrs["lang"]) == "" {
+				add("html-lang", line, "<html> has no lang attribute")
+			}
+		case "img", "area":
+			alt, hasAlt := attrs["alt"]
+			if !hasAlt && !hidden {
+				add("img-alt", line, "<%s src=%q> has no alt text", name, attrs["src"]+attrs["href"])
+			}
+			if len(links) > 0 && strings.TrimSpace(alt) != "" {
+				links[len(links)-1].label = true
+			}
+		case "h1", "h2", "h3", "h4", "h5", "h6":
+			level := int(name[1] - '0')
+			if heading > 0 && level > heading+1 {
+				add("heading-order", line, "heading level skipped, from <h%d> to <h%d>", heading, level)
+			}
+			heading = level
+		case "a":
+			// Anchors without href are not checked, but are kept track of
+			// for matching the end tags
+			_, href := attrs["href"]
+			label := !href || strings.TrimSpace(attrs["aria-label"]) != "" || strings.TrimSpace(attrs["title"]) != "" || attrs["aria-labelledby"] != ""
+			links = append(links, &link{line: line, label: label})
+		case "label":
+			if id := attrs["for"]; id != "" {
+				labelled[id] = true
+			}
+			labels++
+		case "input", "select", "textarea":
+			inputType := strings.ToLower(attrs["type"])
+			if inputType == "image" {
+				if _, ok := attrs["alt"]; !ok {
+					add("img-alt", line, "<input type=\"image\"> has no alt text")
+				}
+				continue
+			}
+			if inputType == "hidden" || inputType == "submit" || inputType == "button" || inputType == "reset" || hidden {
+				continue
+			}
+			if labels > 0 || attrs["aria-label"] != "" || attrs["aria-labelledby"] != "" || attrs["title"] != "" {
+				continue
+			}
+			inputs = append(inputs, Finding{"input-label", line, fmt.Sprintf("<%s name=%q> has no label", name, attrs["name"])})
+			inputIDs = append(inputIDs, attrs["id"])
+		}
+	}
+	// Labels can come after the inputs they are for
+	for i, f := range inputs {
+		if id := inputIDs[i]; id == "" || !labelled[id] {
+			findings = append(findings, f)
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Line < findings[j].Line
+	})
+	return findings
+}
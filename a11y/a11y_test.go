@@ -0,0 +1,59 @@
+package a11y
+
+import (
+	"math"
+	"testing"
+)
+
+func TestContrast(t *testing.T) {
+	black, _ := parseColor("#000")
+	white, _ := parseColor("white")
+	if c := Contrast(black, white); math.Abs(c-21) > 0.01 {
+		t.Errorf("got %f, expected 21", c)
+	}
+	gray, ok := parseColor("rgb(119, 119, 119)")
+	if !ok {
+		t.Fatal("could not parse rgb()")
+	}
+	if c := Contrast(gray, white); math.Abs(c-4.48) > 0.01 {
+		t.Errorf("got %f, expected 4.48", c)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	html := []byte(`<!doctype html>
+<html>
+<body>
+<h1>Title</h1>
+<h3>Skipped</h3>
+<img src="logo.png">
+<img src="spacer.gif" alt="">
+<a href="/a"><img src="home.png" alt="Home"></a>
+<a href="/b"><i class="icon"></i></a>
+<a href="/c">Contact</a>
+<p style="color: #777; background-color: #fff">Gray</p>
+<p style="color: black; background: white">Black</p>
+<label for="email">E-mail</label><input id="email" name="email">
+<input name="phone">
+<label>Name <input name="name"></label>
+<input type="submit">
+</body>
+</html>`)
+	expected := []Finding{
+		{"html-lang", 2, ""},
+		{"heading-order", 5, ""},
+		{"img-alt", 6, ""},
+		{"link-text", 9, ""},
+		{"contrast", 11, ""},
+		{"input-label", 14, ""},
+	}
+	findings := Check(html)
+	if len(findings) != len(expected) {
+		t.Fatalf("got %v, expected %d findings", findings, len(expected))
+	}
+	for i, f := range findings {
+		if f.Rule != expected[i].Rule || f.Line != expected[i].Line {
+			t.Errorf("got %s, expected %s on line %d", f, expected[i].Rule, expected[i].Line)
+		}
+	}
+}
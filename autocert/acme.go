@@ -0,0 +1,399 @@
+package autocert
+
+// A small ACME (RFC 8555) client, with support for the HTTP-01, TLS-ALPN-01
+// and DNS-01 challenges
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// LetsEncryptURL is the directory URL for the Let's Encrypt production server
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+// How often, and for how long, to poll for authorizations and orders
+const (
+	pollInterval = 2 * time.Second
+	pollTimeout  = 2 * time.Minute
+)
+
+var (
+	errNoNonce      = errors.New("the ACME server did not return a nonce")
+	errNoChallenge  = errors.New("the ACME server offered no supported challenge")
+	errPollTimeout  = errors.New("timed out while waiting for the ACME server")
+	errNoCertChain  = errors.New("the ACME server returned no certificate")
+	errInvalidOrder = errors.New("the ACME order became invalid")
+)
+
+// The challenge types that are supported
+const (
+	challengeHTTP01    = "http-01"
+	challengeTLSALPN01 = "tls-alpn-01"
+)
+
+// acmeDirectory is the list of endpoints that an ACME server provides
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// acmeProblem is an error returned by the ACME server
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", p.Type, p.Detail)
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type acmeChallenge struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+}
+
+type acmeAuthorization struct {
+	Status     string          `json:"status"`
+	Identifier acmeIdentifier  `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+// Solver makes a challenge response available, so that the ACME server can
+// verify that we control the domain. Remove is called when done.
+type Solver interface {
+	Present(challengeType, domain, token, keyAuth string) error
+	Remove(challengeType, domain, token string)
+}
+
+// client talks to an ACME server, with one account key
+type client struct {
+	directoryURL string
+	key          *ecdsa.PrivateKey
+	email        string
+	httpClient   *http.Client
+	dir          *acmeDirectory
+	kid          string
+	nonce        string
+}
+
+// b64 encodes data as unpadded base64 URL encoding, as used by JWS
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// jwk returns the JSON Web Key for the public part of the account key,
+// with the fields in the order that is needed for the thumbprint
+func (c *client) jwk() string {
+	pub := c.key.PublicKey
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	x := pub.X.FillBytes(make([]byte, size))
+	y := pub.Y.FillBytes(make([]byte, size))
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, b64(x), b64(y))
+}
+
+// keyAuthorization returns the key authorization for a challenge token
+func (c *client) keyAuthorization(token string) string {
+	thumbprint := sha256.Sum256([]byte(c.jwk()))
+	return token + "." + b64(thumbprint[:])
+}
+
+// discover fetches the directory, if it has not been fetched already
+func (c *client) discover(ctx context.Context) error {
+	if c.dir != nil {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodGet, c.directoryURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var dir acmeDirectory
+	if err := json.NewDecoder(resp.Body).Decode(&dir); err != nil {
+		return err
+	}
+	c.dir = &dir
+	return nil
+}
+
+// fetchNonce retrieves a fresh nonce from the ACME server
+func (c *client) fetchNonce(ctx context.Context) (string, error) {
+	req, err := http.NewRequest(http.MethodHead, c.dir.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errNoNonce
+	}
+	return nonce, nil
+}
+
+// sign creates a JWS with the given payload. A nil payload gives a
+// POST-as-GET request.
+func (c *client) sign(url, nonce string, payload interface{}) ([]byte, error) {
+	protected := fmt.Sprintf(`{"alg":"ES256","nonce":%q,"url":%q,`, nonce, url)
+	if c.kid != "" {
+		protected += fmt.Sprintf(`"kid":%q}`, c.kid)
+	} else {
+		protected += `"jwk":` + c.jwk() + `}`
+	}
+	encodedPayload := ""
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		encodedPayload = b64(data)
+	}
+	signingInput := b64([]byte(protected)) + "." + encodedPayload
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return json.Marshal(map[string]string{
+		"protected": b64([]byte(protected)),
+		"payload":   encodedPayload,
+		"signature": b64(signature),
+	})
+}
+
+// post sends a signed request and decodes the JSON response into result,
+// if result is not nil. A fresh nonce is used once if the nonce is rejected.
+func (c *client) post(ctx context.Context, url string, payload, result interface{}) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		nonce := c.nonce
+		c.nonce = ""
+		if nonce == "" {
+			var err error
+			if nonce, err = c.fetchNonce(ctx); err != nil {
+				return nil, nil, err
+			}
+		}
+		body, err := c.sign(url, nonce, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		resp, err := c.httpClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		c.nonce = resp.Header.Get("Replay-Nonce")
+		if resp.StatusCode >= 400 {
+			problem := &acmeProblem{}
+			json.Unmarshal(data, problem)
+			if strings.HasSuffix(problem.Type, ":badNonce") && attempt == 0 {
+				continue
+			}
+			if problem.Type == "" {
+				problem.Type = resp.Status
+			}
+			return nil, nil, problem
+		}
+		if result != nil {
+			if err := json.Unmarshal(data, result); err != nil {
+				return nil, nil, err
+			}
+		}
+		return resp, data, nil
+	}
+}
+
+// register creates an account, or finds the existing account for the key
+func (c *client) register(ctx context.Context) error {
+	if c.kid != "" {
+		return nil
+	}
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if c.email != "" {
+		account["contact"] = []string{"mailto:" + c.email}
+	}
+	resp, _, err := c.post(ctx, c.dir.NewAccount, account, nil)
+	if err != nil {
+		return err
+	}
+	c.kid = resp.Header.Get("Location")
+	return nil
+}
+
+// poll fetches the given URL until the status is no longer pending or processing
+func (c *client) poll(ctx context.Context, url string, result interface{}, status func() string) error {
+	deadline := time.Now().Add(pollTimeout)
+	for {
+		if _, _, err := c.post(ctx, url, nil, result); err != nil {
+			return err
+		}
+		if s := status(); s != "pending" && s != "processing" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errPollTimeout
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// authorize completes the authorization for one domain, using the first of
+// the preferred challenge types that the server offers
+func (c *client) authorize(ctx context.Context, url string, solver Solver, preferred []string) error {
+	var authz acmeAuthorization
+	if _, _, err := c.post(ctx, url, nil, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	var challenge *acmeChallenge
+	for _, challengeType := range preferred {
+		for i := range authz.Challenges {
+			if authz.Challenges[i].Type == challengeType {
+				challenge = &authz.Challenges[i]
+				break
+			}
+		}
+		if challenge != nil {
+			break
+		}
+	}
+	if challenge == nil {
+		return errNoChallenge
+	}
+	domain := authz.Identifier.Value
+	if err := solver.Present(challenge.Type, domain, challenge.Token, c.keyAuthorization(challenge.Token)); err != nil {
+		return err
+	}
+	defer solver.Remove(challenge.Type, domain, challenge.Token)
+
+	// Tell the server that the challenge response is ready
+	if _, _, err := c.post(ctx, challenge.URL, struct{}{}, nil); err != nil {
+		return err
+	}
+	if err := c.poll(ctx, url, &authz, func() string { return authz.Status }); err != nil {
+		return err
+	}
+	if authz.Status != "valid" {
+		return fmt.Errorf("acme: the authorization for %s is %s", domain, authz.Status)
+	}
+	return nil
+}
+
+// obtain orders a certificate for the given domains, and returns the
+// certificate chain as PEM, together with the private key for the certificate
+func (c *client) obtain(ctx context.Context, domains []string, solver Solver, preferred []string) ([]byte, *ecdsa.PrivateKey, error) {
+	if err := c.discover(ctx); err != nil {
+		return nil, nil, err
+	}
+	if err := c.register(ctx); err != nil {
+		return nil, nil, err
+	}
+	var identifiers []acmeIdentifier
+	for _, domain := range domains {
+		identifiers = append(identifiers, acmeIdentifier{Type: "dns", Value: domain})
+	}
+	var order acmeOrder
+	resp, _, err := c.post(ctx, c.dir.NewOrder, map[string]interface{}{"identifiers": identifiers}, &order)
+	if err != nil {
+		return nil, nil, err
+	}
+	orderURL := resp.Header.Get("Location")
+	for _, authzURL := range order.Authorizations {
+		if err := c.authorize(ctx, authzURL, solver, preferred); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Create a key and a certificate signing request
+	certKey, err := newKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, _, err := c.post(ctx, order.Finalize, map[string]string{"csr": b64(csr)}, &order); err != nil {
+		return nil, nil, err
+	}
+	if err := c.poll(ctx, orderURL, &order, func() string { return order.Status }); err != nil {
+		return nil, nil, err
+	}
+	if order.Status != "valid" {
+		return nil, nil, errInvalidOrder
+	}
+	_, chain, err := c.post(ctx, order.Certificate, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if block, _ := pem.Decode(chain); block == nil {
+		return nil, nil, errNoCertChain
+	}
+	return chain, certKey, nil
+}
+
+// newKey generates a new ECDSA P-256 key
+func newKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// serialNumber returns a random serial number for a certificate
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,59 @@
+package autocert
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestSign(t *testing.T) {
+	key, err := newKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{key: key}
+	data, err := c.sign("https://example.com/acme/new-account", "nonce", map[string]bool{"termsOfServiceAgreed": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jws map[string]string
+	if err := json.Unmarshal(data, &jws); err != nil {
+		t.Fatal(err)
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(jws["protected"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header map[string]interface{}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		t.Fatalf("the protected header is not valid JSON: %s", protected)
+	}
+	if header["alg"] != "ES256" || header["nonce"] != "nonce" || header["jwk"] == nil {
+		t.Errorf("unexpected protected header: %s", protected)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(jws["signature"])
+	if err != nil || len(signature) != 64 {
+		t.Fatalf("unexpected signature: %v", signature)
+	}
+	digest := sha256.Sum256([]byte(jws["protected"] + "." + jws["payload"]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Error("the signature could not be verified")
+	}
+}
+
+func TestKeyAuthorization(t *testing.T) {
+	key, err := newKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{key: key}
+	keyAuth := c.keyAuthorization("token")
+	if !strings.HasPrefix(keyAuth, "token.") || len(keyAuth) != len("token.")+43 {
+		t.Errorf("unexpected key authorization: %s", keyAuth)
+	}
+}
@@ -0,0 +1,368 @@
+// Package autocert obtains and renews TLS certificates from Let's Encrypt,
+// or any other ACME server, including wildcard certificates when there is
+// a DNS provider
+package autocert
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The ALPN protocol that is used by the TLS-ALPN-01 challenge
+	acmeALPNProto = "acme-tls/1"
+
+	// The URL path prefix that is used by the HTTP-01 challenge
+	challengePathPrefix = "/.well-known/acme-challenge/"
+
+	// The default amount of time before expiry when certificates are renewed
+	defaultRenewBefore = 30 * 24 * time.Hour
+
+	// How often to check if the certificate needs to be renewed
+	checkInterval = 12 * time.Hour
+
+	// How long to wait before trying again, if obtaining a certificate failed
+	retryInterval = 10 * time.Minute
+)
+
+var (
+	errNoCertificate  = errors.New("autocert: no certificate is available yet")
+	errNoChallengeFor = errors.New("autocert: no TLS-ALPN-01 challenge for this server name")
+	errBadCache       = errors.New("autocert: could not decode the cached data")
+
+	// The id-pe-acmeIdentifier extension, from RFC 8737
+	idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+)
+
+// Cache stores certificates and account keys between restarts
+type Cache interface {
+	Get(name string) ([]byte, error)
+	Put(name string, data []byte) error
+}
+
+// DirCache is a Cache that stores the data as files in a directory
+type DirCache string
+
+// Get reads the data with the given name from the directory
+func (d DirCache) Get(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(string(d), name))
+}
+
+// Put writes the data with the given name to the directory.
+// Only the current user may read the files.
+func (d DirCache) Put(name string, data []byte) error {
+	if err := os.MkdirAll(string(d), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(string(d), name), data, 0600)
+}
+
+// Manager obtains one certificate for all the given domains
+// and renews it before it expires
+type Manager struct {
+	Domains      []string
+	Email        string
+	Cache        Cache
+	DirectoryURL string
+
+	// The challenge types to use, in order of preference
+	Challenges []string
+
+	// How long before expiry a certificate should be renewed
+	RenewBefore time.Duration
+
+	// For the DNS-01 challenge, which is needed for wildcard domains, if
+	// not nil. DNS-01 is then preferred over the other challenges.
+	DNS DNSProvider
+
+	mut        sync.RWMutex
+	cert       *tls.Certificate
+	httpTokens map[string]string           // token -> key authorization
+	alpnCerts  map[string]*tls.Certificate // domain -> challenge certificate
+	dnsValues  map[string]string           // token -> TXT record value
+	client     *client
+}
+
+// NewManager creates a Manager that uses Let's Encrypt, both challenge types
+// and the given cache
+func NewManager(domains []string, email string, cache Cache) *Manager {
+	return &Manager{
+		Domains:      domains,
+		Email:        email,
+		Cache:        cache,
+		DirectoryURL: LetsEncryptURL,
+		Challenges:   []string{challengeHTTP01, challengeTLSALPN01},
+		RenewBefore:  defaultRenewBefore,
+		httpTokens:   make(map[string]string),
+		alpnCerts:    make(map[string]*tls.Certificate),
+		dnsValues:    make(map[string]string),
+	}
+}
+
+// challenges returns the challenge types to use, with DNS-01 first if
+// there is a DNS provider
+func (m *Manager) challenges() []string {
+	if m.DNS == nil {
+		return m.Challenges
+	}
+	challenges := []string{challengeDNS01}
+	for _, challengeType := range m.Challenges {
+		if challengeType != challengeDNS01 {
+			challenges = append(challenges, challengeType)
+		}
+	}
+	return challenges
+}
+
+// certName is the name of the cached certificate
+func (m *Manager) certName() string {
+	return strings.Replace(m.Domains[0], "*", "_", -1) + ".pem"
+}
+
+// Present makes a challenge response available. For DNS-01, this waits
+// until the TXT record can be looked up, for a while.
+func (m *Manager) Present(challengeType, domain, token, keyAuth string) error {
+	if challengeType == challengeDNS01 {
+		if m.DNS == nil {
+			return errNoDNSProvider
+		}
+		value := dnsRecordValue(keyAuth)
+		if err := m.DNS.SetTXT(dnsRecordPrefix+domain, value); err != nil {
+			return err
+		}
+		m.mut.Lock()
+		m.dnsValues[token] = value
+		m.mut.Unlock()
+		waitForTXT(dnsRecordPrefix+domain, value)
+		return nil
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	switch challengeType {
+	case challengeHTTP01:
+		m.httpTokens[token] = keyAuth
+	case challengeTLSALPN01:
+		cert, err := alpnCertificate(domain, keyAuth)
+		if err != nil {
+			return err
+		}
+		m.alpnCerts[domain] = cert
+	}
+	return nil
+}
+
+// Remove removes a challenge response
+func (m *Manager) Remove(challengeType, domain, token string) {
+	m.mut.Lock()
+	value, ok := m.dnsValues[token]
+	delete(m.httpTokens, token)
+	delete(m.alpnCerts, domain)
+	delete(m.dnsValues, token)
+	m.mut.Unlock()
+	if ok && m.DNS != nil {
+		// A leftover record does no harm, so the error is ignored
+		m.DNS.RemoveTXT(dnsRecordPrefix+domain, value)
+	}
+}
+
+// GetCertificate returns the certificate for a TLS handshake,
+// or a challenge certificate if the ACME server is validating the domain
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	for _, proto := range hello.SupportedProtos {
+		if proto == acmeALPNProto {
+			if cert, ok := m.alpnCerts[strings.ToLower(hello.ServerName)]; ok {
+				return cert, nil
+			}
+			return nil, errNoChallengeFor
+		}
+	}
+	if m.cert == nil {
+		return nil, errNoCertificate
+	}
+	return m.cert, nil
+}
+
+// TLSConfig returns a TLS configuration that uses the managed certificate
+// and can answer TLS-ALPN-01 challenges
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acmeALPNProto},
+	}
+}
+
+// HTTPHandler answers HTTP-01 challenges, and passes all other
+// requests on to the given handler
+func (m *Manager) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, challengePathPrefix) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		m.mut.RLock()
+		keyAuth, ok := m.httpTokens[strings.TrimPrefix(req.URL.Path, challengePathPrefix)]
+		m.mut.RUnlock()
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
+
+// accountKey returns the cached account key, or creates a new one
+func (m *Manager) accountKey() (*ecdsa.PrivateKey, error) {
+	if data, err := m.Cache.Get("account.key"); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errBadCache
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, m.Cache.Put("account.key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+// Load uses the cached certificate, if there is one
+func (m *Manager) Load() error {
+	data, err := m.Cache.Get(m.certName())
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	m.mut.Lock()
+	m.cert = &cert
+	m.mut.Unlock()
+	return nil
+}
+
+// Expires returns when the current certificate expires, or the zero time
+// if there is no certificate
+func (m *Manager) Expires() time.Time {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	if m.cert == nil || m.cert.Leaf == nil {
+		return time.Time{}
+	}
+	return m.cert.Leaf.NotAfter
+}
+
+// Renew obtains a new certificate, caches it and starts using it
+func (m *Manager) Renew(ctx context.Context) error {
+	if m.DNS == nil {
+		for _, domain := range m.Domains {
+			if strings.HasPrefix(domain, "*.") {
+				return errWildcardDNS
+			}
+		}
+	}
+	if m.client == nil {
+		key, err := m.accountKey()
+		if err != nil {
+			return err
+		}
+		m.client = &client{directoryURL: m.DirectoryURL, key: key, email: m.Email, httpClient: http.DefaultClient}
+	}
+	chain, certKey, err := m.client.obtain(ctx, m.Domains, m, m.challenges())
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(chain, []byte("\n")) {
+		chain = append(chain, '\n')
+	}
+	data := append(chain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})...)
+	if err := m.Cache.Put(m.certName(), data); err != nil {
+		return err
+	}
+	return m.Load()
+}
+
+// Run loads or obtains a certificate, then keeps renewing it until the
+// context is cancelled. Errors are passed to the given function.
+func (m *Manager) Run(ctx context.Context, logError func(error)) {
+	// There may be no usable certificate in the cache, which is fine the first time
+	m.Load()
+	for {
+		wait := checkInterval
+		if expires := m.Expires(); expires.IsZero() || time.Until(expires) < m.RenewBefore {
+			if err := m.Renew(ctx); err != nil {
+				logError(err)
+				wait = retryInterval
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// alpnCertificate creates a self-signed certificate for answering a
+// TLS-ALPN-01 challenge
+func alpnCertificate(domain, keyAuth string) (*tls.Certificate, error) {
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	extValue, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{domain},
+		ExtraExtensions: []pkix.Extension{
+			{Id: idPeAcmeIdentifier, Critical: true, Value: extValue},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
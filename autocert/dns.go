@@ -0,0 +1,269 @@
+package autocert
+
+// The DNS-01 challenge, for wildcard certificates and for servers that can
+// not be reached from the ACME server, with TXT records that are created
+// through the API of a DNS provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The challenge type for DNS TXT records
+	challengeDNS01 = "dns-01"
+
+	// The TXT records are created for this name below each domain
+	dnsRecordPrefix = "_acme-challenge."
+
+	// How long to wait for new TXT records to show up in DNS, before
+	// telling the ACME server to check them anyway
+	dnsPropagationTimeout = 2 * time.Minute
+
+	// How long the commands for ExecProvider can run
+	dnsCommandTimeout = 2 * time.Minute
+
+	// The time to live for the TXT records, in seconds
+	dnsRecordTTL = 120
+
+	// The API endpoint for Cloudflare
+	cloudflareURL = "https://api.cloudflare.com/client/v4"
+)
+
+var (
+	errNoDNSProvider   = errors.New("autocert: the DNS-01 challenge requires a DNS provider")
+	errWildcardDNS     = errors.New("autocert: wildcard domains require a DNS provider, for the DNS-01 challenge")
+	errUnknownProvider = errors.New("autocert: unknown DNS provider")
+	errNoZone          = errors.New("autocert: found no DNS zone for the domain")
+	errNoRecord        = errors.New("autocert: the TXT record was not created by this provider")
+	errCloudflareToken = errors.New("autocert: the cloudflare DNS provider requires the CLOUDFLARE_API_TOKEN variable")
+)
+
+// DNSProvider creates and removes the TXT records for the DNS-01 challenge.
+// The name is a fully qualified domain name, like
+// "_acme-challenge.example.com", without the trailing dot.
+type DNSProvider interface {
+	SetTXT(name, value string) error
+	RemoveTXT(name, value string) error
+}
+
+var (
+	providerMut sync.Mutex
+	providers   = map[string]func(arg string) (DNSProvider, error){
+		"cloudflare": func(string) (DNSProvider, error) {
+			token := os.Getenv("CLOUDFLARE_API_TOKEN")
+			if token == "" {
+				return nil, errCloudflareToken
+			}
+			return NewCloudflare(token), nil
+		},
+		"exec": func(arg string) (DNSProvider, error) {
+			if arg == "" {
+				return nil, errors.New("autocert: the exec DNS provider requires a command, like exec:/usr/local/bin/dns-hook")
+			}
+			return ExecProvider(arg), nil
+		},
+	}
+)
+
+// RegisterDNSProvider makes a DNS provider available by name, for
+// NewDNSProvider. The argument is what follows "name:", if anything.
+func RegisterDNSProvider(name string, create func(arg string) (DNSProvider, error)) {
+	providerMut.Lock()
+	defer providerMut.Unlock()
+	providers[name] = create
+}
+
+// NewDNSProvider creates a DNS provider from a name and an optional
+// argument, like "cloudflare" or "exec:/usr/local/bin/dns-hook"
+func NewDNSProvider(spec string) (DNSProvider, error) {
+	name, arg := spec, ""
+	if pos := strings.Index(spec, ":"); pos != -1 {
+		name, arg = spec[:pos], spec[pos+1:]
+	}
+	providerMut.Lock()
+	create, ok := providers[strings.ToLower(name)]
+	providerMut.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errUnknownProvider, name)
+	}
+	return create(arg)
+}
+
+// dnsRecordValue returns the contents of the TXT record for a key
+// authorization, from RFC 8555, section 8.4
+func dnsRecordValue(keyAuth string) string {
+	sum := sha256.Sum256([]byte(keyAuth))
+	return b64(sum[:])
+}
+
+// waitForTXT waits until the TXT record can be looked up, or until the
+// propagation timeout. The ACME server may see the record before the local
+// resolver does, so the challenge is tried either way.
+func waitForTXT(name, value string) {
+	deadline := time.Now().Add(dnsPropagationTimeout)
+	for time.Now().Before(deadline) {
+		records, _ := net.LookupTXT(name)
+		for _, record := range records {
+			if record == value {
+				return
+			}
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// ExecProvider is a DNS provider that runs a command, for any DNS service.
+// The command is run as "COMMAND present NAME VALUE" for creating a record
+// and as "COMMAND cleanup NAME VALUE" for removing it.
+type ExecProvider string
+
+func (p ExecProvider) run(action, name, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsCommandTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, string(p), action, name, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("autocert: %s %s: %v: %s", p, action, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// SetTXT runs the command for creating a TXT record
+func (p ExecProvider) SetTXT(name, value string) error {
+	return p.run("present", name, value)
+}
+
+// RemoveTXT runs the command for removing a TXT record
+func (p ExecProvider) RemoveTXT(name, value string) error {
+	return p.run("cleanup", name, value)
+}
+
+// Cloudflare is a DNS provider that uses the Cloudflare API, with an API
+// token that can edit the DNS records of the zone
+type Cloudflare struct {
+	Token  string
+	APIURL string
+	Client *http.Client
+
+	mut     sync.Mutex
+	records map[string][2]string // name and value -> zone ID and record ID
+}
+
+// NewCloudflare creates a DNS provider for Cloudflare, with the given API token
+func NewCloudflare(token string) *Cloudflare {
+	return &Cloudflare{
+		Token:   token,
+		APIURL:  cloudflareURL,
+		Client:  &http.Client{Timeout: 30 * time.Second},
+		records: make(map[string][2]string),
+	}
+}
+
+// cloudflareResponse is the envelope of all the responses from the API
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+// call sends a request to the API and decodes the result into result, if
+// result is not nil
+func (cf *Cloudflare) call(method, path string, body, result interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, cf.APIURL+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cf.Token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cf.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var envelope cloudflareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("autocert: cloudflare: %s", resp.Status)
+	}
+	if !envelope.Success {
+		if len(envelope.Errors) > 0 {
+			return fmt.Errorf("autocert: cloudflare: %s (code %d)", envelope.Errors[0].Message, envelope.Errors[0].Code)
+		}
+		return fmt.Errorf("autocert: cloudflare: %s", resp.Status)
+	}
+	if result != nil {
+		return json.Unmarshal(envelope.Result, result)
+	}
+	return nil
+}
+
+// zoneID finds the zone that the name is in, by trying the parent domains,
+// from the longest to the shortest
+func (cf *Cloudflare) zoneID(name string) (string, error) {
+	labels := strings.Split(name, ".")
+	for i := 1; i < len(labels)-1; i++ {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		if err := cf.call(http.MethodGet, "/zones?name="+strings.Join(labels[i:], "."), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", errNoZone
+}
+
+// SetTXT creates a TXT record
+func (cf *Cloudflare) SetTXT(name, value string) error {
+	zone, err := cf.zoneID(name)
+	if err != nil {
+		return err
+	}
+	var record struct {
+		ID string `json:"id"`
+	}
+	body := map[string]interface{}{"type": "TXT", "name": name, "content": value, "ttl": dnsRecordTTL}
+	if err := cf.call(http.MethodPost, "/zones/"+zone+"/dns_records", body, &record); err != nil {
+		return err
+	}
+	cf.mut.Lock()
+	cf.records[name+" "+value] = [2]string{zone, record.ID}
+	cf.mut.Unlock()
+	return nil
+}
+
+// RemoveTXT removes a TXT record that was created with SetTXT
+func (cf *Cloudflare) RemoveTXT(name, value string) error {
+	cf.mut.Lock()
+	ids, ok := cf.records[name+" "+value]
+	delete(cf.records, name+" "+value)
+	cf.mut.Unlock()
+	if !ok {
+		return errNoRecord
+	}
+	return cf.call(http.MethodDelete, "/zones/"+ids[0]+"/dns_records/"+ids[1], nil, nil)
+}
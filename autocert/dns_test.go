@@ -0,0 +1,91 @@
+package autocert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCloudflare(t *testing.T) {
+	var created, deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"success":false,"errors":[{"code":10000,"message":"Authentication error"}]}`))
+			return
+		}
+		switch {
+		case req.Method == http.MethodGet && req.URL.Path == "/zones":
+			if req.URL.Query().Get("name") == "example.com" {
+				w.Write([]byte(`{"success":true,"result":[{"id":"zone1"}]}`))
+				return
+			}
+			w.Write([]byte(`{"success":true,"result":[]}`))
+		case req.Method == http.MethodPost && req.URL.Path == "/zones/zone1/dns_records":
+			var record map[string]interface{}
+			json.NewDecoder(req.Body).Decode(&record)
+			created = append(created, record["name"].(string)+" "+record["content"].(string))
+			w.Write([]byte(`{"success":true,"result":{"id":"record1"}}`))
+		case req.Method == http.MethodDelete && req.URL.Path == "/zones/zone1/dns_records/record1":
+			deleted = append(deleted, req.URL.Path)
+			w.Write([]byte(`{"success":true,"result":{"id":"record1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"success":false,"errors":[{"code":7003,"message":"Not found"}]}`))
+		}
+	}))
+	defer srv.Close()
+
+	cf := NewCloudflare("token")
+	cf.APIURL = srv.URL
+	if err := cf.SetTXT("_acme-challenge.www.example.com", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 1 || created[0] != "_acme-challenge.www.example.com value" {
+		t.Errorf("unexpected records: %v", created)
+	}
+	if err := cf.RemoveTXT("_acme-challenge.www.example.com", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 {
+		t.Errorf("expected one deleted record, got %v", deleted)
+	}
+	if err := cf.RemoveTXT("_acme-challenge.www.example.com", "value"); err != errNoRecord {
+		t.Errorf("expected %v, got %v", errNoRecord, err)
+	}
+	if err := cf.SetTXT("_acme-challenge.example.org", "value"); err != errNoZone {
+		t.Errorf("expected %v, got %v", errNoZone, err)
+	}
+
+	cf.Token = "wrong"
+	if err := cf.SetTXT("_acme-challenge.example.com", "value"); err == nil {
+		t.Error("expected an authentication error")
+	}
+}
+
+func TestNewDNSProvider(t *testing.T) {
+	p, err := NewDNSProvider("exec:/usr/local/bin/dns-hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != ExecProvider("/usr/local/bin/dns-hook") {
+		t.Errorf("unexpected provider: %#v", p)
+	}
+	if _, err := NewDNSProvider("nosuchprovider"); err == nil {
+		t.Error("expected an error for an unknown provider")
+	}
+}
+
+func TestWildcardRequiresDNS(t *testing.T) {
+	m := NewManager([]string{"*.example.com"}, "", DirCache(t.TempDir()))
+	if err := m.Renew(context.Background()); err != errWildcardDNS {
+		t.Errorf("expected %v, got %v", errWildcardDNS, err)
+	}
+	m.DNS = ExecProvider("true")
+	challenges := m.challenges()
+	if len(challenges) != 3 || challenges[0] != challengeDNS01 {
+		t.Errorf("expected DNS-01 to be preferred, got %v", challenges)
+	}
+}
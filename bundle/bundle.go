@@ -0,0 +1,351 @@
+// Package bundle signs and verifies .alg archives. A signed archive has a
+// manifest with the SHA-256 hash of every file, and an Ed25519 signature of
+// the manifest.
+package bundle
+
+import (
+	"archive/zip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// MetaDir is the directory in the archive with the manifest and the
+	// signature
+	MetaDir = ".algernon/"
+
+	manifestName  = MetaDir + "bundle.json"
+	signatureName = MetaDir + "bundle.sig"
+)
+
+var (
+	// ErrUnsigned is returned when verifying an archive that is not signed
+	ErrUnsigned = errors.New("the archive is not signed")
+
+	// ErrBadSignature is returned when the signature does not match the
+	// manifest, or the signed data
+	ErrBadSignature = errors.New("the signature is not valid")
+
+	// ErrModified is returned when the files do not match the manifest
+	ErrModified = errors.New("the archive has been modified after it was signed")
+
+	// ErrUntrusted is returned when the archive is signed with a key that is
+	// not one of the trusted keys
+	ErrUntrusted = errors.New("the archive is signed with a key that is not trusted")
+
+	// ErrNotEd25519 is returned when a key is not an Ed25519 key
+	ErrNotEd25519 = errors.New("the key is not an Ed25519 key")
+)
+
+// Metadata is the manifest of a signed archive
+type Metadata struct {
+	Version string            `json:"version,omitempty"`
+	Signed  time.Time         `json:"signed"`
+	Key     string            `json:"key"`   // the public key, base64 encoded
+	Files   map[string]string `json:"files"` // SHA-256 hashes, by filename
+}
+
+// Fingerprint returns a short fingerprint of the public key that signed the
+// archive
+func (m *Metadata) Fingerprint() string {
+	key, err := base64.StdEncoding.DecodeString(m.Key)
+	if err != nil {
+		return ""
+	}
+	return Fingerprint(key)
+}
+
+// Fingerprint returns a short fingerprint of a public key, as hex
+func Fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// hashFiles returns the SHA-256 hash of every file in an archive, except
+// for the manifest and the signature
+func hashFiles(zr *zip.Reader) (map[string]string, error) {
+	hashes := make(map[string]string)
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") || strings.HasPrefix(f.Name, MetaDir) {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		hashes[f.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return hashes, nil
+}
+
+// readEntry returns the contents of a file in an archive, or nil if it is
+// not there
+func readEntry(zr *zip.Reader, name string) ([]byte, error) {
+	for _, f := range zr.File {
+		if f.Name != name {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return nil, nil
+}
+
+// Sign adds a manifest and a signature to an archive, replacing any that
+// are already there. The version is stored in the manifest, if given.
+func Sign(filename string, key ed25519.PrivateKey, version string) (*Metadata, error) {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	hashes, err := hashFiles(&zr.Reader)
+	if err != nil {
+		return nil, err
+	}
+	meta := &Metadata{
+		Version: version,
+		Signed:  time.Now().UTC().Truncate(time.Second),
+		Key:     base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		Files:   hashes,
+	}
+	manifest, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, manifest))
+
+	// Write the new archive next to the old one, then replace it
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".sign-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	zw := zip.NewWriter(tmp)
+	for _, f := range zr.File {
+		if strings.HasPrefix(f.Name, MetaDir) {
+			continue
+		}
+		if err := zw.Copy(f); err != nil {
+			tmp.Close()
+			return nil, err
+		}
+	}
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{{manifestName, manifest}, {signatureName, []byte(signature)}} {
+		w, err := zw.Create(entry.name)
+		if err != nil {
+			tmp.Close()
+			return nil, err
+		}
+		if _, err := w.Write(entry.data); err != nil {
+			tmp.Close()
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return nil, err
+	}
+	return meta, os.Rename(tmp.Name(), filename)
+}
+
+// Verify checks that an archive is signed, that the files have not been
+// changed since, and that it is signed with one of the trusted keys, if any
+// are given. The manifest is returned if it could be read, also if the
+// archive could not be verified.
+func Verify(filename string, trusted []ed25519.PublicKey) (*Metadata, error) {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	manifest, err := readEntry(&zr.Reader, manifestName)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := readEntry(&zr.Reader, signatureName)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil || signature == nil {
+		return nil, ErrUnsigned
+	}
+	var meta Metadata
+	if err := json.Unmarshal(manifest, &meta); err != nil {
+		return nil, ErrBadSignature
+	}
+	key, err := base64.StdEncoding.DecodeString(meta.Key)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return &meta, ErrBadSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil || !ed25519.Verify(key, manifest, sig) {
+		return &meta, ErrBadSignature
+	}
+	hashes, err := hashFiles(&zr.Reader)
+	if err != nil {
+		return &meta, err
+	}
+	if len(hashes) != len(meta.Files) {
+		return &meta, ErrModified
+	}
+	for name, hash := range hashes {
+		if meta.Files[name] != hash {
+			return &meta, ErrModified
+		}
+	}
+	if len(trusted) == 0 {
+		return &meta, nil
+	}
+	for _, trustedKey := range trusted {
+		if trustedKey.Equal(ed25519.PublicKey(key)) {
+			return &meta, nil
+		}
+	}
+	return &meta, ErrUntrusted
+}
+
+// SignData returns the Ed25519 signature of the given data, base64 encoded.
+// This is used for signing other files than archives, like executables.
+func SignData(key ed25519.PrivateKey, data []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+}
+
+// VerifyData checks that a base64 encoded signature of the given data is
+// made with one of the trusted keys
+func VerifyData(data []byte, signature string, trusted []ed25519.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil {
+		return ErrBadSignature
+	}
+	for _, key := range trusted {
+		if ed25519.Verify(key, data, sig) {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+// GenerateKey creates a new key pair, and writes the private key and the
+// public key to the given files, as PEM
+func GenerateKey(privateFilename, publicFilename string) (ed25519.PrivateKey, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(privateFilename, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(publicFilename, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644); err != nil {
+		return nil, err
+	}
+	return private, nil
+}
+
+// LoadPrivateKey reads an Ed25519 private key from a PEM file
+func LoadPrivateKey(filename string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrNotEd25519
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, ErrNotEd25519
+	}
+	return private, nil
+}
+
+// LoadPublicKeys reads all the Ed25519 public keys in a PEM file
+func LoadPublicKeys(filename string) ([]ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ed25519.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		public, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, ErrNotEd25519
+		}
+		keys = append(keys, public)
+	}
+	if len(keys) == 0 {
+		return nil, ErrNotEd25519
+	}
+	return keys, nil
+}
+
+// Names returns the filenames in the manifest, sorted
+func (m *Metadata) Names() []string {
+	names := make([]string, 0, len(m.Files))
+	for name := range m.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,129 @@
+package bundle
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeArchive writes an archive with the given files
+func writeArchive(t *testing.T, filename string, files map[string]string) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, contents := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(contents))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "site.alg")
+	files := map[string]string{"site/index.lua": `print("hi")`, "site/style.css": "body{}"}
+	writeArchive(t, archive, files)
+
+	if _, err := Verify(archive, nil); err != ErrUnsigned {
+		t.Fatalf("expected ErrUnsigned, got %v", err)
+	}
+
+	key, err := GenerateKey(filepath.Join(dir, "key.pem"), filepath.Join(dir, "key.pub.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Sign(archive, key, "1.2.0"); err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := LoadPublicKeys(filepath.Join(dir, "key.pub.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := Verify(archive, trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Version != "1.2.0" || len(meta.Names()) != 2 || meta.Fingerprint() != Fingerprint(trusted[0]) {
+		t.Errorf("unexpected manifest: %+v", meta)
+	}
+	loaded, err := LoadPrivateKey(filepath.Join(dir, "key.pem"))
+	if err != nil || !loaded.Equal(key) {
+		t.Errorf("could not load the private key: %v", err)
+	}
+
+	// Signed with another key
+	other, err := GenerateKey(filepath.Join(dir, "other.pem"), filepath.Join(dir, "other.pub.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Sign(archive, other, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(archive, trusted); err != ErrUntrusted {
+		t.Errorf("expected ErrUntrusted, got %v", err)
+	}
+
+	// Re-signed, then modified
+	if _, err := Sign(archive, key, ""); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := filepath.Join(dir, "modified.alg")
+	f, err := os.Create(modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, entry := range zr.File {
+		zw.Copy(entry)
+	}
+	w, _ := zw.Create("site/extra.lua")
+	w.Write([]byte("os.exit()"))
+	zw.Close()
+	f.Close()
+	zr.Close()
+	if _, err := Verify(modified, trusted); err != ErrModified {
+		t.Errorf("expected ErrModified, got %v", err)
+	}
+}
+
+func TestSignData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := GenerateKey(filepath.Join(dir, "key.pem"), filepath.Join(dir, "key.pub.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := LoadPublicKeys(filepath.Join(dir, "key.pub.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("\x7fELF...")
+	signature := SignData(key, data)
+	if err := VerifyData(data, signature, trusted); err != nil {
+		t.Error(err)
+	}
+	if err := VerifyData([]byte("\x7fELF!.."), signature, trusted); err != ErrBadSignature {
+		t.Errorf("expected ErrBadSignature, got %v", err)
+	}
+}
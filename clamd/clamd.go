@@ -0,0 +1,94 @@
+// Package clamd can scan data for viruses by sending it to a ClamAV daemon
+package clamd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// How much data is sent in each chunk
+const chunkSize = 64 * 1024
+
+// Client can send data to a ClamAV daemon for scanning
+type Client struct {
+	Network string // "unix" or "tcp"
+	Address string
+	Timeout time.Duration
+}
+
+// New creates a client for the given address, which is either a path to an
+// Unix socket, or a host and port, like "localhost:3310". The address may
+// also be prefixed with "unix:" or "tcp:".
+func New(address string) *Client {
+	c := &Client{Network: "tcp", Address: address, Timeout: time.Minute}
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		c.Network, c.Address = "unix", strings.TrimPrefix(address, "unix:")
+	case strings.HasPrefix(address, "tcp:"):
+		c.Address = strings.TrimPrefix(address, "tcp:")
+	case strings.HasPrefix(address, "/"):
+		c.Network = "unix"
+	}
+	return c
+}
+
+// Scan sends the data to the daemon. Returns the name of the virus that was
+// found, or an empty string if the data is clean.
+func (c *Client) Scan(data []byte) (string, error) {
+	conn, err := net.DialTimeout(c.Network, c.Address, c.Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	size := make([]byte, 4)
+	for len(data) > 0 {
+		n := len(data)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		binary.BigEndian.PutUint32(size, uint32(n))
+		if _, err := conn.Write(size); err != nil {
+			return "", err
+		}
+		if _, err := conn.Write(data[:n]); err != nil {
+			return "", err
+		}
+		data = data[n:]
+	}
+	// A chunk with a length of 0 ends the stream
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\x00')
+	if err != nil && reply == "" {
+		return "", err
+	}
+	return parseReply(reply)
+}
+
+// parseReply parses replies like "stream: OK" and
+// "stream: Eicar-Signature FOUND"
+func parseReply(reply string) (string, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	case strings.HasSuffix(reply, " ERROR"):
+		return "", errors.New(strings.TrimSuffix(reply, " ERROR"))
+	}
+	return "", errors.New("unexpected reply from clamd: " + reply)
+}
@@ -0,0 +1,80 @@
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeDaemon answers one INSTREAM request, and finds a virus if the data
+// contains "EICAR"
+func fakeDaemon(t *testing.T, l net.Listener) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if command, err := r.ReadString('\x00'); err != nil || command != "zINSTREAM\x00" {
+		t.Errorf("unexpected command: %q", command)
+		return
+	}
+	var data bytes.Buffer
+	size := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, size); err != nil {
+			t.Error(err)
+			return
+		}
+		n := binary.BigEndian.Uint32(size)
+		if n == 0 {
+			break
+		}
+		if _, err := io.CopyN(&data, r, int64(n)); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if bytes.Contains(data.Bytes(), []byte("EICAR")) {
+		conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+		return
+	}
+	conn.Write([]byte("stream: OK\x00"))
+}
+
+func TestScan(t *testing.T) {
+	for _, tc := range []struct {
+		data  []byte
+		virus string
+	}{
+		{[]byte("hello"), ""},
+		{bytes.Repeat([]byte("x"), chunkSize*2+1), ""},
+		{[]byte("X5O!P%@AP EICAR"), "Eicar-Signature"},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go fakeDaemon(t, l)
+		virus, err := New("tcp:" + l.Addr().String()).Scan(tc.data)
+		l.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if virus != tc.virus {
+			t.Errorf("expected %q, got %q", tc.virus, virus)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if c := New("/run/clamav/clamd.ctl"); c.Network != "unix" {
+		t.Errorf("expected an Unix socket, got %s", c.Network)
+	}
+	if c := New("localhost:3310"); c.Network != "tcp" || c.Address != "localhost:3310" {
+		t.Errorf("unexpected client: %v", c)
+	}
+}
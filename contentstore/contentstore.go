@@ -0,0 +1,133 @@
+// Package contentstore stores files by the SHA-256 hash of their contents,
+// so that identical files are only stored once. Each file has a reference
+// count, and is removed when the last reference is released.
+package contentstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The file extension for the files with the reference counts
+const refsExt = ".refs"
+
+// ErrInvalidHash is returned for strings that are not SHA-256 hashes in hex
+var ErrInvalidHash = errors.New("invalid content hash")
+
+// Store is a directory with files that are named by their hash
+type Store struct {
+	mut sync.Mutex
+	dir string
+}
+
+// New returns a store that keeps the files in the given directory
+func New(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// ValidHash checks if the given string is a SHA-256 hash in lowercase hex
+func ValidHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	return strings.Trim(hash, "0123456789abcdef") == ""
+}
+
+// Path returns the filename for the given hash, which is in a subdirectory
+// named by the first two characters of the hash
+func (s *Store) Path(hash string) (string, error) {
+	if !ValidHash(hash) {
+		return "", ErrInvalidHash
+	}
+	return filepath.Join(s.dir, hash[:2], hash), nil
+}
+
+// refs returns the reference count for the file with the given filename
+func refs(filename string) int {
+	data, err := ioutil.ReadFile(filename + refsExt)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return n
+}
+
+// writeAtomically writes a file, so that it is either complete or missing
+func writeAtomically(filename string, data []byte) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	return os.Rename(tempFile.Name(), filename)
+}
+
+// Put stores the data, if there is no identical file already, and adds a
+// reference to it. Returns the hash of the data.
+func (s *Store) Put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	filename, _ := s.Path(hash)
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		if err := writeAtomically(filename, data); err != nil {
+			return "", err
+		}
+	}
+	if err := writeAtomically(filename+refsExt, []byte(strconv.Itoa(refs(filename)+1))); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// Release removes a reference to the file with the given hash, and removes
+// the file when there are no references left. Returns the number of
+// references that are left.
+func (s *Store) Release(hash string) (int, error) {
+	filename, err := s.Path(hash)
+	if err != nil {
+		return 0, err
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, err := os.Stat(filename); err != nil {
+		return 0, err
+	}
+	n := refs(filename) - 1
+	if n <= 0 {
+		os.Remove(filename + refsExt)
+		return 0, os.Remove(filename)
+	}
+	return n, writeAtomically(filename+refsExt, []byte(strconv.Itoa(n)))
+}
+
+// Refs returns the number of references to the file with the given hash
+func (s *Store) Refs(hash string) int {
+	filename, err := s.Path(hash)
+	if err != nil {
+		return 0
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return refs(filename)
+}
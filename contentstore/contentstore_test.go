@@ -0,0 +1,43 @@
+package contentstore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contentstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := New(dir)
+
+	hash, err := s.Put([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := s.Put([]byte("hello")); again != hash {
+		t.Errorf("identical data should have the same hash: %s and %s", hash, again)
+	}
+	if n := s.Refs(hash); n != 2 {
+		t.Errorf("unexpected reference count: %d", n)
+	}
+	filename, _ := s.Path(hash)
+	if data, err := ioutil.ReadFile(filename); err != nil || string(data) != "hello" {
+		t.Errorf("unexpected contents: %q, %v", data, err)
+	}
+	if n, err := s.Release(hash); n != 1 || err != nil {
+		t.Errorf("unexpected result from Release: %d, %v", n, err)
+	}
+	if n, err := s.Release(hash); n != 0 || err != nil {
+		t.Errorf("unexpected result from Release: %d, %v", n, err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Error("the file should be removed when there are no references left")
+	}
+	if _, err := s.Path("../../etc/passwd"); err != ErrInvalidHash {
+		t.Error("only hashes should be accepted")
+	}
+}
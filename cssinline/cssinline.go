@@ -0,0 +1,262 @@
+// Package cssinline moves CSS rules from <style> elements into the style
+// attributes of the elements they apply to, since many e-mail clients
+// ignore <style> elements
+package cssinline
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	styleElement = regexp.MustCompile(`(?is)<style[^>]*>(.*?)</style>`)
+	startTag     = regexp.MustCompile(`<([a-zA-Z][a-zA-Z0-9]*)(\s[^<>]*?)?(/?)>`)
+	attribute    = regexp.MustCompile(`([a-zA-Z_:][-a-zA-Z0-9_:.]*)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+)))?`)
+	comment      = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	compound     = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9]*|\*)?((?:[.#][-_a-zA-Z0-9]+)*)$`)
+	qualifier    = regexp.MustCompile(`[.#][-_a-zA-Z0-9]+`)
+	styleAttr    = regexp.MustCompile(`(?i)\sstyle\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'>]+)`)
+)
+
+// selector is a simple selector, like "td", ".button", "#footer" or
+// "a.button"
+type selector struct {
+	tag     string
+	id      string
+	classes []string
+}
+
+// specificity returns the specificity of the selector, as one number
+func (s *selector) specificity() int {
+	n := len(s.classes) * 100
+	if s.id != "" {
+		n += 10000
+	}
+	if s.tag != "" {
+		n++
+	}
+	return n
+}
+
+// matches checks if the selector matches an element
+func (s *selector) matches(tag, id string, classes map[string]bool) bool {
+	if s.tag != "" && !strings.EqualFold(s.tag, tag) {
+		return false
+	}
+	if s.id != "" && s.id != id {
+		return false
+	}
+	for _, class := range s.classes {
+		if !classes[class] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSelector parses a simple selector, and returns false if the
+// selector can not be inlined, like "p a" or "a:hover"
+func parseSelector(text string) (*selector, bool) {
+	m := compound.FindStringSubmatch(strings.TrimSpace(text))
+	if m == nil || (m[1] == "" && m[2] == "") {
+		return nil, false
+	}
+	s := &selector{}
+	if m[1] != "*" {
+		s.tag = m[1]
+	}
+	for _, q := range qualifier.FindAllString(m[2], -1) {
+		if q[0] == '#' {
+			s.id = q[1:]
+		} else {
+			s.classes = append(s.classes, q[1:])
+		}
+	}
+	return s, true
+}
+
+// declaration is a CSS property and value
+type declaration struct {
+	property, value string
+}
+
+// parseDeclarations parses "color: red; margin: 0"
+func parseDeclarations(text string) []declaration {
+	var decls []declaration
+	for _, part := range strings.Split(text, ";") {
+		pos := strings.Index(part, ":")
+		if pos == -1 {
+			continue
+		}
+		property := strings.ToLower(strings.TrimSpace(part[:pos]))
+		value := strings.TrimSpace(part[pos+1:])
+		if property != "" && value != "" {
+			decls = append(decls, declaration{property, value})
+		}
+	}
+	return decls
+}
+
+// rule is a selector and the declarations it applies
+type rule struct {
+	sel   *selector
+	decls []declaration
+	order int
+}
+
+// parseStylesheet returns the rules that can be inlined, and the CSS that
+// is left, like @media blocks and rules with selectors like "a:hover"
+func parseStylesheet(css string, rules []rule) ([]rule, string) {
+	css = comment.ReplaceAllString(css, "")
+	var rest strings.Builder
+	for {
+		css = strings.TrimSpace(css)
+		open := strings.Index(css, "{")
+		if open == -1 {
+			break
+		}
+		prelude := strings.TrimSpace(css[:open])
+		if strings.HasPrefix(prelude, "@") {
+			// Keep at-rules like @media as they are, including nested blocks
+			depth, end := 0, len(css)
+			for i := open; i < len(css); i++ {
+				if css[i] == '{' {
+					depth++
+				} else if css[i] == '}' {
+					depth--
+					if depth == 0 {
+						end = i + 1
+						break
+					}
+				}
+			}
+			rest.WriteString(css[:end] + "\n")
+			css = css[end:]
+			continue
+		}
+		close := strings.Index(css[open:], "}")
+		if close == -1 {
+			break
+		}
+		body := css[open+1 : open+close]
+		css = css[open+close+1:]
+		var kept []string
+		decls := parseDeclarations(body)
+		for _, text := range strings.Split(prelude, ",") {
+			if sel, ok := parseSelector(text); ok {
+				rules = append(rules, rule{sel, decls, len(rules)})
+			} else {
+				kept = append(kept, strings.TrimSpace(text))
+			}
+		}
+		if len(kept) > 0 {
+			rest.WriteString(strings.Join(kept, ", ") + " {" + body + "}\n")
+		}
+	}
+	return rules, rest.String()
+}
+
+// attributes returns the attributes of a start tag, by lowercase name
+func attributes(text string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range attribute.FindAllStringSubmatch(text, -1) {
+		attrs[strings.ToLower(m[1])] = m[2] + m[3] + m[4]
+	}
+	return attrs
+}
+
+// apply returns the style attribute for an element, with the declarations
+// from the matching rules, ordered by specificity, and then the
+// declarations that already were in the style attribute
+func apply(rules []rule, tag string, attrs map[string]string) string {
+	classes := make(map[string]bool)
+	for _, class := range strings.Fields(attrs["class"]) {
+		classes[class] = true
+	}
+	var matching []rule
+	for _, r := range rules {
+		if r.sel.matches(tag, attrs["id"], classes) {
+			matching = append(matching, r)
+		}
+	}
+	if len(matching) == 0 {
+		return ""
+	}
+	sort.SliceStable(matching, func(i, j int) bool {
+		si, sj := matching[i].sel.specificity(), matching[j].sel.specificity()
+		if si != sj {
+			return si < sj
+		}
+		return matching[i].order < matching[j].order
+	})
+	var (
+		order  []string
+		values = make(map[string]string)
+	)
+	set := func(decls []declaration) {
+		for _, d := range decls {
+			if _, ok := values[d.property]; !ok {
+				order = append(order, d.property)
+			}
+			values[d.property] = d.value
+		}
+	}
+	for _, r := range matching {
+		set(r.decls)
+	}
+	set(parseDeclarations(attrs["style"]))
+	parts := make([]string, len(order))
+	for i, property := range order {
+		parts[i] = property + ": " + values[property]
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Inline moves the CSS rules in the <style> elements of an HTML document to
+// the style attributes of the elements. Rules that can not be inlined, like
+// @media blocks or rules for "a:hover", are kept in a <style> element.
+func Inline(html string) string {
+	var (
+		rules []rule
+		rest  strings.Builder
+	)
+	for _, m := range styleElement.FindAllStringSubmatch(html, -1) {
+		var left string
+		rules, left = parseStylesheet(m[1], rules)
+		rest.WriteString(left)
+	}
+	if len(rules) == 0 {
+		return html
+	}
+	// Keep the first <style> element with what is left, and remove the others
+	first := true
+	html = styleElement.ReplaceAllStringFunc(html, func(string) string {
+		if !first || rest.Len() == 0 {
+			return ""
+		}
+		first = false
+		return "<style>\n" + rest.String() + "</style>"
+	})
+	return startTag.ReplaceAllStringFunc(html, func(tag string) string {
+		m := startTag.FindStringSubmatch(tag)
+		name := strings.ToLower(m[1])
+		switch name {
+		case "html", "head", "title", "meta", "link", "style", "script", "base":
+			return tag
+		}
+		attrs := attributes(m[2])
+		style := apply(rules, name, attrs)
+		if style == "" {
+			return tag
+		}
+		style = `style="` + strings.Replace(style, `"`, "&quot;", -1) + `"`
+		attrText := m[2]
+		if loc := styleAttr.FindStringIndex(attrText); loc != nil {
+			attrText = attrText[:loc[0]] + " " + style + attrText[loc[1]:]
+		} else {
+			attrText = strings.TrimRight(attrText, " ") + " " + style
+		}
+		return "<" + m[1] + attrText + m[3] + ">"
+	})
+}
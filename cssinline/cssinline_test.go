@@ -0,0 +1,42 @@
+package cssinline
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInline(t *testing.T) {
+	html := `<html><head><style>
+/* The colors */
+p { color: #333; margin: 0 }
+.button, td.button { background: blue; color: white }
+#footer { font-size: 12px }
+a:hover { color: red }
+@media (max-width: 600px) { p { margin: 4px } }
+</style></head>
+<body><p>Hi</p><p class="button" style="color: black">Go</p><div id="footer"><br/></div></body></html>`
+	result := Inline(html)
+	for _, expected := range []string{
+		`<p style="color: #333; margin: 0">Hi</p>`,
+		// The style attribute wins over .button, which wins over p
+		`<p class="button" style="color: black; margin: 0; background: blue">Go</p>`,
+		`<div id="footer" style="font-size: 12px">`,
+		`<br/>`,
+		"a:hover { color: red }",
+		"@media (max-width: 600px) { p { margin: 4px } }",
+	} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("missing %s in:\n%s", expected, result)
+		}
+	}
+	if strings.Contains(result, "#footer {") {
+		t.Error("inlined rules should be removed from the style element")
+	}
+}
+
+func TestNoStyle(t *testing.T) {
+	html := `<p class="x">Hi</p>`
+	if result := Inline(html); result != html {
+		t.Errorf("got %s, expected the same HTML", result)
+	}
+}
@@ -0,0 +1,139 @@
+package engine
+
+// Accessibility audit mode, where rendered HTML is checked for basic
+// accessibility problems in debug mode
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/a11y"
+	"github.com/xyproto/algernon/themes"
+)
+
+const (
+	// The page with the findings of the accessibility audit
+	a11yPath = "/debug/a11y"
+
+	// How many URL paths the findings are kept for
+	maxA11yReports = 200
+)
+
+// a11yReport is the findings for one URL path, the last time it was served
+type a11yReport struct {
+	Path     string         `json:"path"`
+	Time     time.Time      `json:"time"`
+	Findings []a11y.Finding `json:"findings"`
+}
+
+// a11yReports keeps the latest findings for each URL path
+type a11yReports struct {
+	mut     sync.RWMutex
+	reports map[string]a11yReport
+}
+
+// Set stores the findings for an URL path. The oldest report is removed if
+// there are too many.
+func (ar *a11yReports) Set(path string, findings []a11y.Finding) {
+	ar.mut.Lock()
+	defer ar.mut.Unlock()
+	if ar.reports == nil {
+		ar.reports = make(map[string]a11yReport)
+	}
+	if _, ok := ar.reports[path]; !ok && len(ar.reports) >= maxA11yReports {
+		oldest := ""
+		for p, r := range ar.reports {
+			if oldest == "" || r.Time.Before(ar.reports[oldest].Time) {
+				oldest = p
+			}
+		}
+		delete(ar.reports, oldest)
+	}
+	ar.reports[path] = a11yReport{path, time.Now(), findings}
+}
+
+// List returns the reports, sorted by URL path
+func (ar *a11yReports) List() []a11yReport {
+	ar.mut.RLock()
+	defer ar.mut.RUnlock()
+	reports := make([]a11yReport, 0, len(ar.reports))
+	for _, r := range ar.reports {
+		reports = append(reports, r)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Path < reports[j].Path
+	})
+	return reports
+}
+
+// a11yEnabled checks if the accessibility audit is enabled, which it can
+// only be in debug mode
+func (ac *Config) a11yEnabled() bool {
+	return ac.a11yAudit && ac.debugMode
+}
+
+// a11yFilter is an output filter that checks HTML responses, stores the
+// findings and logs them, without changing the body
+func (ac *Config) a11yFilter() outputFilter {
+	return outputFilter{
+		contentType: "text/html",
+		run: func(req *http.Request, body []byte) ([]byte, error) {
+			findings := a11y.Check(body)
+			ac.a11y.Set(req.URL.Path, findings)
+			for _, f := range findings {
+				log.Warnf("Accessibility: %s %s", req.URL.Path, f)
+			}
+			return body, nil
+		},
+	}
+}
+
+// serveA11yReport serves the findings of the accessibility audit at
+// /debug/a11y, as HTML or as JSON. Returns true if the request was handled.
+func (ac *Config) serveA11yReport(w http.ResponseWriter, req *http.Request) bool {
+	if req.URL.Path != a11yPath || !ac.a11yEnabled() {
+		return false
+	}
+	reports := ac.a11y.List()
+	if req.URL.Query().Get("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+		data, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return true
+		}
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		w.Write(data)
+		ac.LogAccess(req, http.StatusOK, int64(len(data)))
+		return true
+	}
+	var sb strings.Builder
+	if len(reports) == 0 {
+		sb.WriteString("<p>No pages have been checked yet.</p>")
+	}
+	for _, r := range reports {
+		path := html.EscapeString(r.Path)
+		fmt.Fprintf(&sb, `<h2><a href="%s">%s</a></h2>`, path, path)
+		if len(r.Findings) == 0 {
+			sb.WriteString("<p>No findings.</p>")
+			continue
+		}
+		sb.WriteString("<ul>")
+		for _, f := range r.Findings {
+			fmt.Fprintf(&sb, "<li>Line %d: %s <code>%s</code></li>", f.Line, html.EscapeString(f.Message), f.Rule)
+		}
+		sb.WriteString("</ul>")
+	}
+	sb.WriteString("</body></html>")
+	data := []byte(themes.MessagePage("Accessibility", sb.String(), ac.defaultTheme))
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	w.Write(data)
+	ac.LogAccess(req, http.StatusOK, int64(len(data)))
+	return true
+}
@@ -1,8 +1,8 @@
 package engine
 
 import (
+	"context"
 	"fmt"
-	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -12,6 +12,34 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// startTimeKey is the context key for when the server started serving a
+// request
+type startTimeKey struct{}
+
+// withStartTime stores the current time in the request context, for logging
+// how long it took to serve the request
+func withStartTime(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), startTimeKey{}, time.Now()))
+}
+
+// requestDuration returns how long the server has been serving the request,
+// or 0 if it is not known
+func requestDuration(req *http.Request) time.Duration {
+	if start, ok := req.Context().Value(startTimeKey{}).(time.Time); ok {
+		return time.Since(start)
+	}
+	return 0
+}
+
+// orDash returns the given string, or "-" if it is empty, for fields in the
+// access logs
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
 // CommonLogFormat returns a line with the data that is available at the start
 // of a request handler. The log line is in NCSA format, the same log format
 // used by Apache. Fields where data is not available are indicated by a "-".
@@ -19,13 +47,9 @@ import (
 func (ac *Config) CommonLogFormat(req *http.Request, statusCode int, byteSize int64) string {
 	username := "-"
 	if ac.perm != nil {
-		username = ac.perm.UserState().Username(req)
-	}
-	host, _, err := net.SplitHostPort(req.RemoteAddr)
-	ip := host
-	if err != nil {
-		ip = req.RemoteAddr
+		username = orDash(ac.perm.UserState().Username(req))
 	}
+	ip := orDash(ac.clientIP(req))
 	statusCodeString := "-"
 	if statusCode > 0 {
 		statusCodeString = strconv.Itoa(statusCode)
@@ -45,13 +69,9 @@ func (ac *Config) CommonLogFormat(req *http.Request, statusCode int, byteSize in
 func (ac *Config) CombinedLogFormat(req *http.Request, statusCode int, byteSize int64) string {
 	username := "-"
 	if ac.perm != nil {
-		username = ac.perm.UserState().Username(req)
-	}
-	host, _, err := net.SplitHostPort(req.RemoteAddr)
-	ip := host
-	if err != nil {
-		ip = req.RemoteAddr
+		username = orDash(ac.perm.UserState().Username(req))
 	}
+	ip := orDash(ac.clientIP(req))
 	statusCodeString := "-"
 	if statusCode > 0 {
 		statusCodeString = strconv.Itoa(statusCode)
@@ -61,14 +81,24 @@ func (ac *Config) CombinedLogFormat(req *http.Request, statusCode int, byteSize
 		byteSizeString = fmt.Sprintf("%d", byteSize)
 	}
 	timestamp := strings.Replace(time.Now().Format("02/Jan/2006 15:04:05 -0700"), " ", ":", 1)
-	referer := req.Header.Get("Referer")
-	userAgent := req.Header.Get("User-Agent")
-	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %s %s \"%s\" \"%s\"", ip, username, timestamp, req.Method, req.RequestURI, req.Proto, statusCodeString, byteSizeString, referer, userAgent)
+	referer := orDash(req.Header.Get("Referer"))
+	userAgent := orDash(req.Header.Get("User-Agent"))
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %s %s %q %q", ip, username, timestamp, req.Method, req.RequestURI, req.Proto, statusCodeString, byteSizeString, referer, userAgent)
+	if ac.accessLogTime {
+		// The time it took to serve the request, in microseconds
+		line += " " + strconv.FormatInt(int64(requestDuration(req)/time.Microsecond), 10)
+	}
+	return line
 }
 
 // LogAccess creates one entry in the access log, given a http.Request,
 // a HTTP status code and the amount of bytes that have been transferred.
 func (ac *Config) LogAccess(req *http.Request, statusCode int, byteSize int64) {
+	ac.metrics.count(statusCode, byteSize)
+	ac.logJSON(req, statusCode, byteSize)
+	if vh := requestVirtualHost(req); vh != nil {
+		vh.logAccess(ac, req, statusCode, byteSize)
+	}
 	if ac.commonAccessLogFilename != "" {
 		f, err := os.OpenFile(ac.commonAccessLogFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
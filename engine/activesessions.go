@@ -0,0 +1,187 @@
+package engine
+
+// Keeping track of the browsers and devices that each user is logged in
+// from, and limiting how many there can be at the same time
+
+import (
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/pinterface"
+)
+
+const (
+	// The name of the cookie that identifies a session
+	sessionCookieName = "session"
+
+	// Each session is stored as a field for the user
+	sessionKeyPrefix = "session:"
+
+	// How often the last time a session was seen is updated, in seconds
+	lastSeenInterval = 60
+)
+
+// activeSession is a browser or device that a user is logged in from
+type activeSession struct {
+	ID        string
+	IP        string
+	UserAgent string
+	Created   int64
+	LastSeen  int64
+}
+
+// encode returns the session as it is stored in the database
+func (s *activeSession) encode() string {
+	return strings.Join([]string{strconv.FormatInt(s.Created, 10), strconv.FormatInt(s.LastSeen, 10), s.IP, s.UserAgent}, "|")
+}
+
+// decodeSession parses a session that is stored in the database
+func decodeSession(id, value string) (*activeSession, bool) {
+	fields := strings.SplitN(value, "|", 4)
+	if len(fields) != 4 {
+		return nil, false
+	}
+	created, _ := strconv.ParseInt(fields[0], 10, 64)
+	lastSeen, _ := strconv.ParseInt(fields[1], 10, 64)
+	return &activeSession{ID: id, Created: created, LastSeen: lastSeen, IP: fields[2], UserAgent: fields[3]}, true
+}
+
+// sessionCookie returns the session ID from the session cookie, if it
+// belongs to the given user
+func sessionCookie(req *http.Request, username string) string {
+	c, err := req.Cookie(sessionCookieName)
+	if err != nil {
+		return ""
+	}
+	parts := strings.SplitN(c.Value, ":", 2)
+	if len(parts) != 2 || parts[1] != base64.RawURLEncoding.EncodeToString([]byte(username)) {
+		return ""
+	}
+	return parts[0]
+}
+
+// ActiveSessions returns the sessions of the given user, the most recently
+// seen first
+func (ac *Config) ActiveSessions(username string) ([]*activeSession, error) {
+	users := ac.perm.UserState().Users()
+	keys, err := users.Keys(username)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*activeSession
+	for _, key := range keys {
+		if !strings.HasPrefix(key, sessionKeyPrefix) {
+			continue
+		}
+		value, err := users.Get(username, key)
+		if err != nil {
+			continue
+		}
+		if s, ok := decodeSession(strings.TrimPrefix(key, sessionKeyPrefix), value); ok {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen > sessions[j].LastSeen
+	})
+	return sessions, nil
+}
+
+// EndSession logs out one of the sessions of the given user
+func (ac *Config) EndSession(username, id string) error {
+	return ac.perm.UserState().Users().DelKey(username, sessionKeyPrefix+id)
+}
+
+// endSessions logs out all the sessions of the given user
+func (ac *Config) endSessions(state pinterface.IUserState, username string) {
+	keys, err := state.Users().Keys(username)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, sessionKeyPrefix) {
+			state.Users().DelKey(username, key)
+		}
+	}
+}
+
+// trackSession records that the given user is logged in from the browser
+// that sent the request. Returns false if the session has been ended, by
+// EndSession or because too many sessions were started after it.
+func (ac *Config) trackSession(w http.ResponseWriter, req *http.Request, state pinterface.IUserState, username string, now int64) bool {
+	users := state.Users()
+	if id := sessionCookie(req, username); id != "" {
+		value, err := users.Get(username, sessionKeyPrefix+id)
+		if err != nil {
+			http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+			return false
+		}
+		if s, ok := decodeSession(id, value); ok && now-s.LastSeen >= lastSeenInterval {
+			s.LastSeen, s.IP = now, ac.clientIP(req)
+			users.Set(username, sessionKeyPrefix+id, s.encode())
+		}
+		return true
+	}
+
+	// A new session. End the least recently seen ones, if there are too many.
+	if ac.maxSessions > 0 {
+		if sessions, err := ac.ActiveSessions(username); err == nil {
+			for i := len(sessions) - 1; i >= ac.maxSessions-1 && i >= 0; i-- {
+				users.DelKey(username, sessionKeyPrefix+sessions[i].ID)
+			}
+		}
+	}
+	s := &activeSession{ID: randomToken(), IP: ac.clientIP(req), UserAgent: req.UserAgent(), Created: now, LastSeen: now}
+	if err := users.Set(username, sessionKeyPrefix+s.ID, s.encode()); err != nil {
+		return true
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    s.ID + ":" + base64.RawURLEncoding.EncodeToString([]byte(username)),
+		Path:     "/",
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return true
+}
+
+// LoadActiveSessionFunctions makes functions for listing and ending the
+// sessions of a user available to Lua scripts
+func (ac *Config) LoadActiveSessionFunctions(req *http.Request, L *lua.LState) {
+	// List the browsers and devices that a user is logged in from, the most
+	// recently seen first. Takes a username. Returns a table with tables that
+	// have the fields id, ip, useragent, created, lastseen and current.
+	L.SetGlobal("ActiveSessions", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		t := L.NewTable()
+		sessions, err := ac.ActiveSessions(username)
+		if err == nil {
+			current := sessionCookie(req, username)
+			for _, s := range sessions {
+				st := L.NewTable()
+				st.RawSetString("id", lua.LString(s.ID))
+				st.RawSetString("ip", lua.LString(s.IP))
+				st.RawSetString("useragent", lua.LString(s.UserAgent))
+				st.RawSetString("created", lua.LNumber(s.Created))
+				st.RawSetString("lastseen", lua.LNumber(s.LastSeen))
+				st.RawSetString("current", lua.LBool(s.ID == current))
+				t.Append(st)
+			}
+		}
+		L.Push(t)
+		return 1 // number of results
+	}))
+	// Log out one of the sessions of a user. Takes a username and a session ID.
+	// Returns true if successful.
+	L.SetGlobal("EndSession", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		id := L.ToString(2)
+		L.Push(lua.LBool(nil == ac.EndSession(username, id)))
+		return 1 // number of results
+	}))
+}
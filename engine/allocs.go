@@ -0,0 +1,174 @@
+package engine
+
+// Approximate memory allocations and garbage collections for each Lua page
+// and Lua handler, for finding the heavy pages. The counters are for the
+// whole process, so allocations by requests that are served at the same time
+// are counted for both. Lua values are Go values, so the garbage collections
+// are those of Go.
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"runtime/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xyproto/algernon/themes"
+	"github.com/xyproto/algernon/utils"
+)
+
+const (
+	// The page with the allocations for each handler, in debug mode
+	allocsPath = "/debug/allocs"
+
+	// How many handlers are included in the metrics
+	maxAllocMetrics = 10
+)
+
+// The runtime/metrics that are read before and after each handler
+var allocMetricNames = []string{"/gc/heap/allocs:bytes", "/gc/heap/allocs:objects", "/gc/cycles/total:gc-cycles"}
+
+// allocCounters are the allocations and garbage collections so far, for
+// the whole process
+type allocCounters struct {
+	bytes    uint64
+	objects  uint64
+	gcCycles uint64
+}
+
+// readAllocCounters reads the allocation counters, which is cheap, unlike
+// runtime.ReadMemStats, which stops the world
+func readAllocCounters() allocCounters {
+	samples := make([]metrics.Sample, len(allocMetricNames))
+	for i, name := range allocMetricNames {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+	var values [3]uint64
+	for i, sample := range samples {
+		if sample.Value.Kind() == metrics.KindUint64 {
+			values[i] = sample.Value.Uint64()
+		}
+	}
+	return allocCounters{values[0], values[1], values[2]}
+}
+
+// allocStats is the allocations and garbage collections for a handler
+type allocStats struct {
+	Handler  string `json:"handler"`
+	Calls    uint64 `json:"calls"`
+	Bytes    uint64 `json:"bytes"`
+	Objects  uint64 `json:"objects"`
+	MaxBytes uint64 `json:"max_bytes"`
+	GCCycles uint64 `json:"gc_cycles"`
+}
+
+// allocTable keeps the allocations for each handler, by Lua filename or by
+// the path of the handler
+type allocTable struct {
+	mut   sync.Mutex
+	stats map[string]*allocStats
+}
+
+// Add adds the allocations since the counters were read, for a handler.
+// Meant to be deferred, like "defer ac.allocs.Add(filename, readAllocCounters())".
+func (at *allocTable) Add(handler string, start allocCounters) {
+	end := readAllocCounters()
+	bytes := end.bytes - start.bytes
+	at.mut.Lock()
+	defer at.mut.Unlock()
+	if at.stats == nil {
+		at.stats = make(map[string]*allocStats)
+	}
+	s, ok := at.stats[handler]
+	if !ok {
+		s = &allocStats{Handler: handler}
+		at.stats[handler] = s
+	}
+	s.Calls++
+	s.Bytes += bytes
+	s.Objects += end.objects - start.objects
+	s.GCCycles += end.gcCycles - start.gcCycles
+	if bytes > s.MaxBytes {
+		s.MaxBytes = bytes
+	}
+}
+
+// List returns the allocations for each handler, the most allocating
+// handlers first
+func (at *allocTable) List() []allocStats {
+	at.mut.Lock()
+	defer at.mut.Unlock()
+	list := make([]allocStats, 0, len(at.stats))
+	for _, s := range at.stats {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Bytes != list[j].Bytes {
+			return list[i].Bytes > list[j].Bytes
+		}
+		return list[i].Handler < list[j].Handler
+	})
+	return list
+}
+
+// Lines returns the metrics for the most allocating handlers
+func (at *allocTable) Lines() []string {
+	var lines []string
+	for i, s := range at.List() {
+		if i == maxAllocMetrics {
+			break
+		}
+		label := "{handler=" + strconv.Quote(s.Handler) + "} "
+		lines = append(lines,
+			"handler_calls_total"+label+strconv.FormatUint(s.Calls, 10),
+			"handler_alloc_bytes_total"+label+strconv.FormatUint(s.Bytes, 10),
+			"handler_alloc_objects_total"+label+strconv.FormatUint(s.Objects, 10),
+			"handler_gc_cycles_total"+label+strconv.FormatUint(s.GCCycles, 10),
+		)
+	}
+	return lines
+}
+
+// serveAllocsReport serves the allocations for each handler at
+// /debug/allocs, as HTML or as JSON, in debug mode. Returns true if the
+// request was handled.
+func (ac *Config) serveAllocsReport(w http.ResponseWriter, req *http.Request) bool {
+	if req.URL.Path != allocsPath || !ac.debugMode {
+		return false
+	}
+	list := ac.allocs.List()
+	if req.URL.Query().Get("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+		data, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return true
+		}
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		w.Write(data)
+		ac.LogAccess(req, http.StatusOK, int64(len(data)))
+		return true
+	}
+	var sb strings.Builder
+	if len(list) == 0 {
+		sb.WriteString("<p>No Lua pages or handlers have been run yet.</p>")
+	} else {
+		sb.WriteString("<table><tr><th>Handler</th><th>Calls</th><th>Allocated</th><th>Per call</th><th>Most in one call</th><th>Objects per call</th><th>GC cycles</th></tr>")
+		for _, s := range list {
+			fmt.Fprintf(&sb, "<tr><td>%s</td><td>%d</td><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td>%d</td></tr>",
+				html.EscapeString(s.Handler), s.Calls, utils.DescribeBytes(int64(s.Bytes)), utils.DescribeBytes(int64(s.Bytes/s.Calls)), utils.DescribeBytes(int64(s.MaxBytes)), s.Objects/s.Calls, s.GCCycles)
+		}
+		sb.WriteString("</table>")
+		sb.WriteString("<p>The numbers are approximate, since requests that are served at the same time are counted for each other.</p>")
+	}
+	sb.WriteString("</body></html>")
+	data := []byte(themes.MessagePage("Allocations", sb.String(), ac.defaultTheme))
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	w.Write(data)
+	ac.LogAccess(req, http.StatusOK, int64(len(data)))
+	return true
+}
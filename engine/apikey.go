@@ -0,0 +1,197 @@
+package engine
+
+// API keys, that can be created and revoked from Lua, and that can be
+// required for path prefixes. Only the hashes of the keys are stored.
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/gopher-lua"
+)
+
+const (
+	// The hash map where the API keys are stored, by the hash of the key
+	apiKeyHashMap = "apikeys"
+
+	// Where the API key is found in requests, by default
+	defaultAPIKeyHeader = "X-API-Key"
+	defaultAPIKeyParam  = "api_key"
+)
+
+var errNoOwner = errors.New("an owner is required")
+
+// apiKeyRule requires an API key for paths that start with the prefix
+type apiKeyRule struct {
+	prefix string
+	header string
+	param  string
+}
+
+// pathPrefix returns the path prefix that the rule is for
+func (rule apiKeyRule) pathPrefix() string {
+	return rule.prefix
+}
+
+// apiKeyTable keeps the API key rules for each mux
+type apiKeyTable = prefixTable[apiKeyRule]
+
+// NewAPIKey creates and stores a new API key for the given owner, which can
+// be an username or the name of a service. Returns the key.
+func (ac *Config) NewAPIKey(owner string) (string, error) {
+	if ac.perm == nil {
+		return "", errNoDatabase
+	}
+	if owner == "" {
+		return "", errNoOwner
+	}
+	hash, err := ac.perm.UserState().Creator().NewHashMap(apiKeyHashMap)
+	if err != nil {
+		return "", err
+	}
+	key := randomToken()
+	id := hashToken(key)
+	if err := hash.Set(id, "owner", owner); err != nil {
+		return "", err
+	}
+	if err := hash.Set(id, "created", strconv.FormatInt(time.Now().Unix(), 10)); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// RevokeAPIKey removes the given API key, so that it can no longer be used
+func (ac *Config) RevokeAPIKey(key string) error {
+	if ac.perm == nil {
+		return errNoDatabase
+	}
+	hash, err := ac.perm.UserState().Creator().NewHashMap(apiKeyHashMap)
+	if err != nil {
+		return err
+	}
+	return hash.Del(hashToken(key))
+}
+
+// APIKeyOwner returns the owner of the given API key, if the key is valid
+func (ac *Config) APIKeyOwner(key string) (string, bool) {
+	if ac.perm == nil || key == "" {
+		return "", false
+	}
+	hash, err := ac.perm.UserState().Creator().NewHashMap(apiKeyHashMap)
+	if err != nil {
+		return "", false
+	}
+	owner, err := hash.Get(hashToken(key), "owner")
+	if err != nil || owner == "" {
+		return "", false
+	}
+	return owner, true
+}
+
+// requestAPIKey returns the API key from the given header, or from the
+// given query parameter
+func requestAPIKey(req *http.Request, header, param string) string {
+	if key := req.Header.Get(header); key != "" {
+		return key
+	}
+	return req.URL.Query().Get(param)
+}
+
+// apiKeyRejected checks the API key for requests to protected path
+// prefixes, and responds with "401 Unauthorized" if it is missing or not
+// valid. Returns true if the request has been rejected.
+func (ac *Config) apiKeyRejected(mux *http.ServeMux, w http.ResponseWriter, req *http.Request) bool {
+	rule, ok := ac.apiKeys.Get(mux, req.URL.Path)
+	if !ok {
+		return false
+	}
+	if _, ok := ac.APIKeyOwner(requestAPIKey(req, rule.header, rule.param)); ok {
+		return false
+	}
+	size := ac.ErrorPage(w, req, httperror.New(http.StatusUnauthorized, "A valid API key is required."))
+	ac.LogAccess(req, http.StatusUnauthorized, size)
+	return true
+}
+
+// LoadAPIKeyFunctions makes functions for creating and revoking API keys
+// available to Lua scripts. The request may be nil.
+func (ac *Config) LoadAPIKeyFunctions(req *http.Request, L *lua.LState) {
+	t := L.NewTable()
+
+	// Create a new API key. Takes the owner. Returns the key, which is only
+	// shown this once, or nil and an error message.
+	L.SetField(t, "new", L.NewFunction(func(L *lua.LState) int {
+		key, err := ac.NewAPIKey(L.CheckString(1))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(key))
+		return 1 // number of results
+	}))
+
+	// Revoke an API key. Returns true if successful.
+	L.SetField(t, "revoke", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(ac.RevokeAPIKey(L.CheckString(1)) == nil))
+		return 1 // number of results
+	}))
+
+	// Get the owner of an API key. Returns nil if the key is not valid.
+	L.SetField(t, "owner", L.NewFunction(func(L *lua.LState) int {
+		owner, ok := ac.APIKeyOwner(L.CheckString(1))
+		if !ok {
+			L.Push(lua.LNil)
+			return 1 // number of results
+		}
+		L.Push(lua.LString(owner))
+		return 1 // number of results
+	}))
+
+	L.SetGlobal("apikey", t)
+
+	// Get the owner of the API key in the current request, from the
+	// X-API-Key header or the api_key query parameter. Returns nil if there
+	// is no valid key.
+	L.SetGlobal("APIKeyOwner", L.NewFunction(func(L *lua.LState) int {
+		if req == nil {
+			L.Push(lua.LNil)
+			return 1 // number of results
+		}
+		owner, ok := ac.APIKeyOwner(requestAPIKey(req, L.OptString(1, defaultAPIKeyHeader), L.OptString(2, defaultAPIKeyParam)))
+		if !ok {
+			L.Push(lua.LNil)
+			return 1 // number of results
+		}
+		L.Push(lua.LString(owner))
+		return 1 // number of results
+	}))
+}
+
+// LoadAPIKeyRules makes the RequireAPIKey function available to server
+// configuration scripts
+func (ac *Config) LoadAPIKeyRules(L *lua.LState, mux *http.ServeMux) {
+
+	// Require a valid API key for a path prefix. Takes a path prefix, and
+	// optionally the name of the header and of the query parameter with the
+	// key. Returns true if successful.
+	L.SetGlobal("RequireAPIKey", L.NewFunction(func(L *lua.LState) int {
+		rule := apiKeyRule{
+			prefix: L.CheckString(1),
+			header: L.OptString(2, defaultAPIKeyHeader),
+			param:  L.OptString(3, defaultAPIKeyParam),
+		}
+		if ac.perm == nil {
+			log.Error("RequireAPIKey requires a database backend")
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		ac.apiKeys.Add(mux, rule)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,57 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKey(t *testing.T) {
+	ac := newTestConfig()
+	key, err := ac.NewAPIKey("billing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := ac.NewAPIKey("old-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ac.RevokeAPIKey(revoked); err != nil {
+		t.Fatal(err)
+	}
+	if owner, ok := ac.APIKeyOwner(key); !ok || owner != "billing" {
+		t.Errorf("expected the owner to be billing, got %q", owner)
+	}
+
+	mux := http.NewServeMux()
+	ac.apiKeys.Add(mux, apiKeyRule{prefix: "/api", header: defaultAPIKeyHeader, param: defaultAPIKeyParam})
+	ac.apiKeys.Add(mux, apiKeyRule{prefix: "/api/partner", header: "X-Partner-Key", param: "partner_key"})
+
+	for _, test := range []struct {
+		path, header, value string
+		rejected            bool
+	}{
+		{"/public", "", "", false},
+		{"/api/orders", "", "", true},
+		{"/api/orders", defaultAPIKeyHeader, key, false},
+		{"/api/orders?api_key=" + key, "", "", false},
+		{"/api/orders", defaultAPIKeyHeader, "wrong", true},
+		{"/api/orders", defaultAPIKeyHeader, revoked, true},
+		// The rule with the longest prefix decides where the key is found
+		{"/api/partner/orders", defaultAPIKeyHeader, key, true},
+		{"/api/partner/orders?api_key=" + key, "", "", true},
+		{"/api/partner/orders", "X-Partner-Key", key, false},
+		{"/api/partner/orders?partner_key=" + key, "", "", false},
+	} {
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		w := httptest.NewRecorder()
+		if rejected := ac.apiKeyRejected(mux, w, req); rejected != test.rejected {
+			t.Errorf("%s with %s: expected rejected to be %v", test.path, test.header, test.rejected)
+		} else if rejected && w.Code != http.StatusUnauthorized {
+			t.Errorf("%s with %s: expected 401, got %d", test.path, test.header, w.Code)
+		}
+	}
+}
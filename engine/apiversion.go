@@ -0,0 +1,96 @@
+package engine
+
+// Pinning the Lua API version with APIVersion(n), so that scripts that are
+// written for an older version keep working while the API evolves
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/gopher-lua"
+)
+
+const (
+	// The API version for scripts that do not call APIVersion
+	defaultAPIVersion = 1
+
+	// The newest API version
+	latestAPIVersion = 2
+)
+
+// apiShim is a function that is only available with older API versions,
+// under an old name or with an old signature
+type apiShim struct {
+	name        string // the name of the Lua function
+	removed     int    // the first API version without the shim
+	newFunction lua.LGFunction
+}
+
+// The shims, in the order they were added. A shim without a new function is
+// removed when the given API version is selected, while a shim with a new
+// function is replaced by it.
+var apiShims = []apiShim{
+	// Use json instead
+	{name: "JSON", removed: 2},
+	{name: "toJSON", removed: 2},
+	{name: "ToJSON", removed: 2},
+	// Use CacheInfo instead
+	{name: "CacheStats", removed: 2},
+	// error(number[, string]) sets the HTTP status code. With version 2,
+	// error is the error function from Lua, and Error() or status() can be
+	// used for the HTTP status code instead.
+	{name: "error", removed: 2, newFunction: luaError},
+}
+
+// luaError is the error function from the Lua standard library, which
+// raises an error with the given value and level
+func luaError(L *lua.LState) int {
+	L.Error(L.CheckAny(1), L.OptInt(2, 1))
+	return 0 // number of results
+}
+
+// applyAPIVersion removes or replaces the shims that are not a part of the
+// given API version, in the given Lua state
+func applyAPIVersion(L *lua.LState, version int) {
+	for _, shim := range apiShims {
+		if version < shim.removed {
+			continue
+		}
+		if shim.newFunction != nil {
+			L.SetGlobal(shim.name, L.NewFunction(shim.newFunction))
+		} else {
+			L.SetGlobal(shim.name, lua.LNil)
+		}
+	}
+}
+
+// LoadAPIVersionFunctions makes the APIVersion function available to the
+// given Lua state. Every Lua state starts out with the default API version.
+func (ac *Config) LoadAPIVersionFunctions(L *lua.LState) {
+	version := defaultAPIVersion
+
+	// Select the API version the script is written for, like APIVersion(2),
+	// and return the selected version. Without an argument, the selected
+	// version is just returned.
+	L.SetGlobal("APIVersion", L.NewFunction(func(L *lua.LState) int {
+		if L.GetTop() == 0 {
+			L.Push(lua.LNumber(version))
+			return 1 // number of results
+		}
+		requested := L.CheckInt(1)
+		if requested < defaultAPIVersion || requested > latestAPIVersion {
+			L.RaiseError("API version %d is not supported, use %d to %d", requested, defaultAPIVersion, latestAPIVersion)
+			return 0 // number of results
+		}
+		if requested < version {
+			// The shims have already been removed from this Lua state
+			L.RaiseError("API version %d is already selected", version)
+			return 0 // number of results
+		}
+		if ac.debugMode && requested < latestAPIVersion {
+			log.Infof("Using API version %d, the newest is %d", requested, latestAPIVersion)
+		}
+		version = requested
+		applyAPIVersion(L, version)
+		L.Push(lua.LNumber(version))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,195 @@
+package engine
+
+// A Lua application script that runs once, in a Lua state that lives for as
+// long as the server, and that request handlers can call functions in
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/datastruct"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/algernon/lua/ics"
+	"github.com/xyproto/algernon/lua/jnode"
+	"github.com/xyproto/algernon/lua/jwt"
+	"github.com/xyproto/algernon/lua/protobuf"
+	"github.com/xyproto/algernon/lua/sanitize"
+	"github.com/xyproto/algernon/lua/webhook"
+	"github.com/xyproto/gopher-lua"
+)
+
+var (
+	errNotCopyable = errors.New("values of this type can not be passed to or from the application script")
+	errNoAppFunc   = errors.New("no such function in the application script")
+)
+
+// appCall is a call to a function in the application script
+type appCall struct {
+	name   string
+	args   []interface{}
+	result chan appResult
+}
+
+// appResult is the values returned from a function in the application script
+type appResult struct {
+	values []interface{}
+	err    error
+}
+
+// appScript is the Lua state for the application script. All calls are
+// passed to a single goroutine, so that the state is never used concurrently.
+type appScript struct {
+	filename string
+	L        *lua.LState
+	calls    chan appCall
+}
+
+// call runs a function in the application script. Must only be called from
+// the goroutine that owns the Lua state.
+func (app *appScript) call(c appCall) appResult {
+	L := app.L
+	fn, ok := L.GetGlobal(c.name).(*lua.LFunction)
+	if !ok {
+		return appResult{err: errNoAppFunc}
+	}
+	top := L.GetTop()
+	L.Push(fn)
+	for _, arg := range c.args {
+		L.Push(toLua(L, arg))
+	}
+	if err := L.PCall(len(c.args), lua.MultRet, nil); err != nil {
+		return appResult{err: err}
+	}
+	var values []interface{}
+	for i := top + 1; i <= L.GetTop(); i++ {
+		value, ok := fromLua(L.Get(i), 0)
+		if !ok && L.Get(i) != lua.LNil {
+			L.SetTop(top)
+			return appResult{err: errNotCopyable}
+		}
+		values = append(values, value)
+	}
+	L.SetTop(top)
+	return appResult{values: values}
+}
+
+// serve handles the calls to the application script, one at a time
+func (app *appScript) serve() {
+	for c := range app.calls {
+		c.result <- app.call(c)
+	}
+}
+
+// StartApp runs the application script, if there is one, and then keeps the
+// Lua state around for handling calls from the request handlers
+func (ac *Config) StartApp() error {
+	if ac.appFilename == "" {
+		return nil
+	}
+	filename := ac.appFilename
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(ac.serverDirOrFilename, filename)
+	}
+	if !ac.fs.Exists(filename) || ac.fs.IsDir(filename) {
+		return nil
+	}
+	if ac.verboseMode {
+		log.Info("Running Lua application script: " + filename)
+	}
+
+	// This Lua state is not taken from the pool, since it is never given back
+	L := lua.NewState(lua.Options{
+		CallStackSize: ac.luaCallStackSize,
+		RegistrySize:  ac.luaRegistrySize,
+	})
+
+	// Functions that don't depend on a request
+	ac.LoadBasicSystemFunctions(L)
+	if ac.perm != nil {
+		creator := ac.perm.UserState().Creator()
+		datastruct.LoadList(L, creator)
+		datastruct.LoadSet(L, creator)
+		datastruct.LoadHash(L, creator)
+		datastruct.LoadKeyValue(L, creator)
+	}
+	jnode.LoadJSONFunctions(L)
+	ac.LoadJFile(L, filepath.Dir(filename))
+	jnode.Load(L)
+	httperror.Load(L)
+	jwt.Load(L)
+
+	// For encoding and decoding Protocol Buffers messages
+	protobuf.Load(L, ac.protoRegistry)
+
+	// For checking the signatures of webhook requests
+	webhook.Load(L)
+
+	// For removing scripts and other unsafe HTML from user content
+	sanitize.Load(L)
+
+	// For calendar feeds
+	ics.Load(L)
+	ac.LoadCacheFunctions(L)
+	ac.LoadChannelFunctions(nil, L)
+
+	if err := L.DoFile(filename); err != nil {
+		L.Close()
+		return err
+	}
+
+	app := &appScript{filename: filename, L: L, calls: make(chan appCall)}
+	go app.serve()
+	ac.app = app
+	return nil
+}
+
+// LoadAppFunctions makes the App function available to Lua scripts, for
+// calling functions in the application script. Stops waiting for the
+// result if the client disconnects.
+func (ac *Config) LoadAppFunctions(req *http.Request, L *lua.LState) {
+
+	// Call a function in the application script, given the name of the
+	// function and any number of arguments. Returns the results.
+	L.SetGlobal("App", L.NewFunction(func(L *lua.LState) int {
+		if ac.app == nil {
+			L.RaiseError("there is no application script (%s)", ac.appFilename)
+			return 0 // number of results
+		}
+		c := appCall{name: L.CheckString(1), result: make(chan appResult, 1)}
+		top := L.GetTop()
+		for i := 2; i <= top; i++ {
+			arg, ok := fromLua(L.Get(i), 0)
+			if !ok && L.Get(i) != lua.LNil {
+				L.ArgError(i, errNotCopyable.Error())
+				return 0 // number of results
+			}
+			c.args = append(c.args, arg)
+		}
+		var done <-chan struct{}
+		if req != nil {
+			done = req.Context().Done()
+		}
+		select {
+		case ac.app.calls <- c:
+		case <-done:
+			return 0 // number of results
+		}
+		var result appResult
+		select {
+		case result = <-c.result:
+		case <-done:
+			return 0 // number of results
+		}
+		if result.err != nil {
+			L.RaiseError("%s: %s: %s", filepath.Base(ac.app.filename), c.name, result.err)
+			return 0 // number of results
+		}
+		for _, value := range result.values {
+			L.Push(toLua(L, value))
+		}
+		return len(result.values) // number of results
+	}))
+
+}
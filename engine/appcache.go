@@ -0,0 +1,216 @@
+package engine
+
+// A cache that is shared between all requests and Lua states, within the
+// server process, for caches that don't need a round trip to Redis
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+const (
+	// The default maximum number of entries in the application cache
+	defaultAppCacheEntries = 10000
+
+	// How deeply tables may be nested, also for catching tables that contain themselves
+	maxAppCacheDepth = 32
+)
+
+// appCacheEntry is a key and a value that expires at the given time,
+// unless the time is zero
+type appCacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// appCache is a thread-safe cache where the least recently used entries
+// are evicted when the cache is full
+type appCache struct {
+	mut        sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List // front is the most recently used
+
+	hits, misses, evictions uint64
+}
+
+// newAppCache creates a new application cache with the given maximum number of entries
+func newAppCache(maxEntries int) *appCache {
+	return &appCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// removeElement removes an entry. The mutex must be locked.
+func (c *appCache) removeElement(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*appCacheEntry).key)
+}
+
+// Set stores a value, with an optional time to live
+func (c *appCache) Set(key string, value interface{}, ttl time.Duration) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	entry := &appCacheEntry{key: key, value: value}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		c.removeElement(c.order.Back())
+		c.evictions++
+	}
+}
+
+// Get returns a value, if it is present and has not expired
+func (c *appCache) Get(key string) (interface{}, bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	entry := e.Value.(*appCacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.removeElement(e)
+		c.misses++
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	c.hits++
+	return entry.value, true
+}
+
+// Del removes a value
+func (c *appCache) Del(key string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.removeElement(e)
+	}
+}
+
+// Clear removes all values
+func (c *appCache) Clear() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// Lines returns the statistics for the application cache, as metric lines
+func (c *appCache) Lines() []string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return []string{
+		fmt.Sprintf("appcache_entries %d", c.order.Len()),
+		fmt.Sprintf("appcache_hits_total %d", c.hits),
+		fmt.Sprintf("appcache_misses_total %d", c.misses),
+		fmt.Sprintf("appcache_evictions_total %d", c.evictions),
+	}
+}
+
+// appCacheTable is a copy of a Lua table that does not belong to any Lua state
+type appCacheTable struct {
+	keys, values []interface{}
+}
+
+// fromLua copies a Lua value, so that it can be used from other Lua states.
+// Functions, userdata and other values that can not be copied give false.
+func fromLua(lv lua.LValue, depth int) (interface{}, bool) {
+	if depth > maxAppCacheDepth {
+		return nil, false
+	}
+	switch v := lv.(type) {
+	case lua.LString, lua.LNumber, lua.LBool:
+		return v, true
+	case *lua.LTable:
+		t := &appCacheTable{}
+		ok := true
+		v.ForEach(func(key, value lua.LValue) {
+			k, keyOK := fromLua(key, depth+1)
+			val, valueOK := fromLua(value, depth+1)
+			if !keyOK || !valueOK {
+				ok = false
+				return
+			}
+			t.keys = append(t.keys, k)
+			t.values = append(t.values, val)
+		})
+		return t, ok
+	}
+	return nil, false
+}
+
+// toLua converts a copied value back to a Lua value, for the given Lua state
+func toLua(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case lua.LValue:
+		return v
+	case *appCacheTable:
+		t := L.NewTable()
+		for i, key := range v.keys {
+			t.RawSet(toLua(L, key), toLua(L, v.values[i]))
+		}
+		return t
+	}
+	return lua.LNil
+}
+
+// LoadAppCacheFunctions makes the AppCache table available to Lua scripts
+func (ac *Config) LoadAppCacheFunctions(L *lua.LState) {
+	t := L.NewTable()
+
+	// Store a string, number, boolean or table, with an optional time to
+	// live, in seconds. Returns false if the value can not be stored.
+	L.SetField(t, "set", L.NewFunction(func(L *lua.LState) int {
+		key := L.CheckString(1)
+		value, ok := fromLua(L.Get(2), 0)
+		if !ok {
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		ttl := time.Duration(float64(L.OptNumber(3, 0)) * float64(time.Second))
+		ac.appCache.Set(key, value, ttl)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Retrieve a value, or nil
+	L.SetField(t, "get", L.NewFunction(func(L *lua.LState) int {
+		value, ok := ac.appCache.Get(L.CheckString(1))
+		if !ok {
+			L.Push(lua.LNil)
+			return 1 // number of results
+		}
+		L.Push(toLua(L, value))
+		return 1 // number of results
+	}))
+
+	// Remove a value
+	L.SetField(t, "del", L.NewFunction(func(L *lua.LState) int {
+		ac.appCache.Del(L.CheckString(1))
+		return 0 // number of results
+	}))
+
+	// Remove all values
+	L.SetField(t, "clear", L.NewFunction(func(L *lua.LState) int {
+		ac.appCache.Clear()
+		return 0 // number of results
+	}))
+
+	L.SetGlobal("AppCache", t)
+}
@@ -0,0 +1,88 @@
+package engine
+
+// Automatic TLS certificates, with ACME and Let's Encrypt
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/autocert"
+	"github.com/xyproto/pinterface"
+)
+
+// keyValueCache is an autocert.Cache that stores the certificates and keys
+// in a KeyValue in the database, for instance Redis
+type keyValueCache struct {
+	kv pinterface.IKeyValue
+}
+
+// Get retrieves the data with the given name
+func (c *keyValueCache) Get(name string) ([]byte, error) {
+	value, err := c.kv.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+// Put stores the data with the given name
+func (c *keyValueCache) Put(name string, data []byte) error {
+	return c.kv.Set(name, string(data))
+}
+
+// autocertDomainList returns the domains that are given with --autocert
+func (ac *Config) autocertDomainList() []string {
+	var domains []string
+	for _, domain := range strings.Split(ac.autocertDomains, ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return unique(domains)
+}
+
+// autocertCache returns where certificates should be stored. The directory
+// given with --autocertdir is used, if given. If not, Redis is used if that
+// is the database backend. If not, a directory in the user cache directory is used.
+func (ac *Config) autocertCache() autocert.Cache {
+	if ac.autocertDir == "" && ac.perm != nil && ac.dbName == "Redis" {
+		kv, err := ac.perm.UserState().Creator().NewKeyValue("autocert")
+		if err == nil {
+			return &keyValueCache{kv}
+		}
+		log.Warn("Could not store certificates in Redis: ", err)
+	}
+	dir := ac.autocertDir
+	if dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			cacheDir = ac.serverTempDir
+		}
+		dir = filepath.Join(cacheDir, "algernon", "autocert")
+	}
+	return autocert.DirCache(dir)
+}
+
+// NewAutocertManager creates a certificate manager for the domains given with
+// --autocert, with the DNS provider given with --autocertdns, if any, then
+// starts obtaining and renewing certificates in the background.
+// The background work is stopped at shutdown.
+func (ac *Config) NewAutocertManager() *autocert.Manager {
+	m := autocert.NewManager(ac.autocertDomainList(), ac.autocertEmail, ac.autocertCache())
+	if ac.autocertDNS != "" {
+		provider, err := autocert.NewDNSProvider(ac.autocertDNS)
+		if err != nil {
+			ac.fatalExit(err)
+		}
+		m.DNS = provider
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	AtShutdown(cancel)
+	go m.Run(ctx, func(err error) {
+		log.Error("Could not obtain a certificate: ", err)
+	})
+	return m
+}
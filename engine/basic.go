@@ -15,6 +15,7 @@ import (
 	"github.com/russross/blackfriday"
 	log "github.com/sirupsen/logrus"
 	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/lua/sanitize"
 	"github.com/xyproto/algernon/utils"
 	"github.com/xyproto/gopher-lua"
 )
@@ -29,6 +30,9 @@ type FutureStatus struct {
 // current server directory into the given Lua state
 func (ac *Config) LoadBasicSystemFunctions(L *lua.LState) {
 
+	// Select the version of the Lua API
+	ac.LoadAPIVersionFunctions(L)
+
 	// Return the version string
 	L.SetGlobal("version", L.NewFunction(func(L *lua.LState) int {
 		L.Push(lua.LString(ac.versionString))
@@ -71,7 +75,7 @@ func (ac *Config) LoadBasicSystemFunctions(L *lua.LState) {
 	// Return the current unixtime, with an attempt at nanosecond resolution
 	L.SetGlobal("unixnano", L.NewFunction(func(L *lua.LState) int {
 		// Extract the correct number of nanoseconds
-		L.Push(lua.LNumber(time.Now().UnixNano()))
+		L.Push(lua.LNumber(ac.now().UnixNano()))
 		return 1 // number of results
 	}))
 
@@ -85,6 +89,26 @@ func (ac *Config) LoadBasicSystemFunctions(L *lua.LState) {
 		return 1 // number of results
 	}))
 
+	// Convert Markdown from users to HTML, without raw HTML, and with only
+	// safe links and elements. Takes the text and an optional table with
+	// nofollow (true by default), images (true by default) and imageproxy.
+	L.SetGlobal("markdownSafe", L.NewFunction(func(L *lua.LState) int {
+		text := L.CheckString(1)
+		options := L.OptTable(2, L.NewTable())
+		p := sanitize.UGC()
+		if nofollow := options.RawGetString("nofollow"); nofollow != lua.LNil {
+			p.NoFollow = lua.LVAsBool(nofollow)
+		}
+		if images := options.RawGetString("images"); images != lua.LNil && !lua.LVAsBool(images) {
+			delete(p.Elements, "img")
+		}
+		if proxy, ok := options.RawGetString("imageproxy").(lua.LString); ok {
+			p.ImageProxy = string(proxy)
+		}
+		L.Push(lua.LString(strings.TrimSpace(safeMarkdown(text, p))))
+		return 1 // number of results
+	}))
+
 	// Get the full filename of a given file that is in the directory
 	// where the server is running (root directory for the server).
 	// If no filename is given, the directory where the server is
@@ -175,6 +199,20 @@ func (ac *Config) LoadBasicWeb(w http.ResponseWriter, req *http.Request, L *lua.
 		return 0 // number of results
 	}))
 
+	// Start a stream of Server-Sent Events. Returns a table with the
+	// send, comment, retry, closed and wait functions.
+	L.SetGlobal("sse", L.NewFunction(func(L *lua.LState) int {
+		L.Push(ac.NewSSETable(w, req, L, flushFunc))
+		return 1 // number of results
+	}))
+
+	// Push a resource, like "/style.css", with HTTP/2 server push.
+	// Returns false if the resource could not be pushed, for instance over HTTP/1.1.
+	L.SetGlobal("push", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(Push(w, req, L.ToString(1))))
+		return 1 // number of results
+	}))
+
 	// Set the Content-Type for the page
 	L.SetGlobal("content", L.NewFunction(func(L *lua.LState) int {
 		lv := L.ToString(1)
@@ -188,6 +226,12 @@ func (ac *Config) LoadBasicWeb(w http.ResponseWriter, req *http.Request, L *lua.
 		return 1 // number of results
 	}))
 
+	// Add the base path from --urlprefix to an absolute URL path, for links
+	L.SetGlobal("urlprefix", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(ac.PrefixURL(L.OptString(1, "/"))))
+		return 1 // number of results
+	}))
+
 	// Return the current HTTP method (GET, POST etc)
 	L.SetGlobal("method", L.NewFunction(func(L *lua.LState) int {
 		L.Push(lua.LString(req.Method))
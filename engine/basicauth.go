@@ -0,0 +1,155 @@
+package engine
+
+// Protecting path prefixes, like directories with static files, with HTTP
+// Basic Auth, where the usernames and passwords are checked with the userstate
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/gopher-lua"
+)
+
+// How long a correct username and password is remembered, so that the
+// password hash is not calculated for every file that is requested
+const basicAuthCacheTime = time.Minute
+
+// basicAuthRule requires Basic Auth for paths that start with the prefix
+type basicAuthRule struct {
+	prefix  string
+	realm   string
+	allowed func(username string) bool // nil if all users are allowed
+}
+
+// pathPrefix returns the path prefix that the rule is for
+func (rule basicAuthRule) pathPrefix() string {
+	return rule.prefix
+}
+
+// basicAuthTable keeps the Basic Auth rules for each mux, and the logins
+// that have been checked recently
+type basicAuthTable struct {
+	prefixTable[basicAuthRule]
+	mut     sync.RWMutex
+	checked map[[sha256.Size]byte]time.Time
+}
+
+// Forget removes all the rules for the given mux, and the logins that have
+// been checked
+func (bt *basicAuthTable) Forget(mux *http.ServeMux) {
+	bt.prefixTable.Forget(mux)
+	bt.mut.Lock()
+	defer bt.mut.Unlock()
+	bt.checked = nil
+}
+
+// loginKey returns the key for remembering that a login has been checked
+func loginKey(username, password string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(username + "\x00" + password))
+}
+
+// recentlyChecked checks if the login has been found to be correct recently
+func (bt *basicAuthTable) recentlyChecked(key [sha256.Size]byte) bool {
+	bt.mut.RLock()
+	defer bt.mut.RUnlock()
+	when, ok := bt.checked[key]
+	return ok && time.Since(when) < basicAuthCacheTime
+}
+
+// remember that the login is correct
+func (bt *basicAuthTable) remember(key [sha256.Size]byte) {
+	bt.mut.Lock()
+	defer bt.mut.Unlock()
+	if bt.checked == nil {
+		bt.checked = make(map[[sha256.Size]byte]time.Time)
+	}
+	// Remove the logins that are too old
+	for k, when := range bt.checked {
+		if time.Since(when) >= basicAuthCacheTime {
+			delete(bt.checked, k)
+		}
+	}
+	bt.checked[key] = time.Now()
+}
+
+// basicAuthRejected checks the Basic Auth login for requests to protected
+// path prefixes, and responds with "401 Unauthorized" if it is missing or
+// incorrect. Returns true if the request has been rejected.
+func (ac *Config) basicAuthRejected(mux *http.ServeMux, w http.ResponseWriter, req *http.Request) bool {
+	rule, ok := ac.basicAuth.Get(mux, req.URL.Path)
+	if !ok {
+		return false
+	}
+	if username, password, ok := req.BasicAuth(); ok && ac.perm != nil {
+		key := loginKey(username, password)
+		correct := ac.basicAuth.recentlyChecked(key)
+		if !correct && ac.CorrectPassword(username, password) {
+			ac.basicAuth.remember(key)
+			correct = true
+		}
+		if correct && (rule.allowed == nil || rule.allowed(username)) {
+			return false
+		}
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+strings.Replace(rule.realm, `"`, "'", -1)+`", charset="UTF-8"`)
+	size := ac.ErrorPage(w, req, httperror.New(http.StatusUnauthorized, "A username and password is required."))
+	ac.LogAccess(req, http.StatusUnauthorized, size)
+	return true
+}
+
+// LoadBasicAuthFunctions makes the BasicAuth function available to server
+// configuration scripts
+func (ac *Config) LoadBasicAuthFunctions(L *lua.LState, mux *http.ServeMux) {
+
+	checkmutex := &sync.Mutex{}
+
+	// Require HTTP Basic Auth for a path prefix, with users from the
+	// userstate. Takes a path prefix, an optional realm and either "admin",
+	// for only allowing admins, or a function that is given the username
+	// and returns true if the user is allowed. Returns true if successful.
+	L.SetGlobal("BasicAuth", L.NewFunction(func(L *lua.LState) int {
+		rule := basicAuthRule{prefix: L.CheckString(1), realm: L.OptString(2, "Restricted")}
+		if ac.perm == nil {
+			log.Error("BasicAuth requires a database backend")
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		switch check := L.Get(3).(type) {
+		case lua.LString:
+			if string(check) != "admin" {
+				L.ArgError(3, "\"admin\" or a function expected")
+				return 0 // number of results
+			}
+			rule.allowed = func(username string) bool {
+				return ac.perm.UserState().IsAdmin(username)
+			}
+		case *lua.LFunction:
+			rule.allowed = func(username string) bool {
+				// Each call gets its own Lua thread
+				checkmutex.Lock()
+				co, cancel := L.NewThread()
+				checkmutex.Unlock()
+				if cancel != nil {
+					defer cancel()
+				}
+				co.Push(check)
+				co.Push(lua.LString(username))
+				if err := co.PCall(1, 1, nil); err != nil {
+					log.Error("The BasicAuth function failed: ", err)
+					return false
+				}
+				allowed := lua.LVAsBool(co.Get(-1))
+				co.Pop(1)
+				return allowed
+			}
+		}
+		ac.basicAuth.Add(mux, rule)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBasicAuth(t *testing.T) {
+	ac := newTestConfig()
+	state := ac.perm.UserState()
+	state.AddUser("alice", "secret", "alice@example.com")
+	state.AddUser("bob", "hunter2", "bob@example.com")
+	state.SetAdminStatus("alice")
+
+	mux := http.NewServeMux()
+	ac.basicAuth.Add(mux, basicAuthRule{prefix: "/private", realm: "Private"})
+	ac.basicAuth.Add(mux, basicAuthRule{prefix: "/private/admin", realm: "Admin", allowed: state.IsAdmin})
+
+	for _, test := range []struct {
+		path, username, password string
+		rejected                 bool
+	}{
+		{"/public", "", "", false},
+		{"/private", "", "", true},
+		{"/private", "alice", "wrong", true},
+		{"/private", "bob", "hunter2", false},
+		// Checked recently, and still correct
+		{"/private", "bob", "hunter2", false},
+		{"/private/admin", "bob", "hunter2", true},
+		{"/private/admin", "alice", "secret", false},
+	} {
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.username != "" {
+			req.SetBasicAuth(test.username, test.password)
+		}
+		w := httptest.NewRecorder()
+		if rejected := ac.basicAuthRejected(mux, w, req); rejected != test.rejected {
+			t.Errorf("%s as %q: expected rejected to be %v", test.path, test.username, test.rejected)
+			continue
+		}
+		if !test.rejected {
+			continue
+		}
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s as %q: expected 401, got %d", test.path, test.username, w.Code)
+		}
+		if auth := w.Header().Get("WWW-Authenticate"); auth == "" {
+			t.Errorf("%s as %q: no WWW-Authenticate header", test.path, test.username)
+		}
+	}
+
+	// The realm of the longest prefix is used
+	req := httptest.NewRequest("GET", "/private/admin/users", nil)
+	w := httptest.NewRecorder()
+	ac.basicAuthRejected(mux, w, req)
+	if auth := w.Header().Get("WWW-Authenticate"); auth != `Basic realm="Admin", charset="UTF-8"` {
+		t.Errorf("unexpected WWW-Authenticate header: %q", auth)
+	}
+}
@@ -0,0 +1,280 @@
+package engine
+
+// Scoring how likely it is that a request comes from a bot, from the user
+// agent, the request headers and how many requests the IP address has made,
+// and policies for tagging, challenging or blocking suspected bots
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/gopher-lua"
+)
+
+const (
+	// Requests with this score or above are from suspected bots, by default
+	defaultBotThreshold = 70
+
+	// The header that tells handlers and proxied servers the bot score
+	botScoreHeader = "X-Bot-Score"
+
+	// The cookie that is set by the challenge page
+	botCookieName = "botcheck"
+
+	// How long a solved challenge lasts
+	botCookieAge = 24 * 60 * 60
+)
+
+// Parts of user agents that are only used by bots, crawlers and tools
+var botAgents = []string{
+	"bot", "crawl", "spider", "slurp", "scrape", "curl/", "wget/", "httpie/",
+	"python-requests", "python-urllib", "aiohttp", "go-http-client", "java/",
+	"okhttp", "libwww-perl", "headlesschrome", "phantomjs", "selenium",
+}
+
+// botAction is what is done with requests from suspected bots
+type botAction string
+
+const (
+	botTag       botAction = "tag"       // set the X-Bot-Score header
+	botChallenge botAction = "challenge" // require JavaScript and a cookie
+	botBlock     botAction = "block"     // respond with "403 Forbidden"
+)
+
+// botRule applies an action to requests from suspected bots, for paths that
+// start with the prefix
+type botRule struct {
+	prefix    string
+	action    botAction
+	threshold int
+}
+
+// pathPrefix returns the path prefix that the rule is for
+func (rule botRule) pathPrefix() string {
+	return rule.prefix
+}
+
+// botTable keeps the bot rules for each mux, and how many requests each IP
+// address has made during the current minute
+type botTable struct {
+	prefixTable[botRule]
+	mut    sync.Mutex
+	counts map[string]int
+	minute int64
+}
+
+// count counts a request from the given IP address, and returns how many
+// requests it has made during the current minute
+func (bt *botTable) count(ip string) int {
+	bt.mut.Lock()
+	defer bt.mut.Unlock()
+	minute := time.Now().Unix() / 60
+	if minute != bt.minute || bt.counts == nil {
+		bt.counts = make(map[string]int)
+		bt.minute = minute
+	}
+	bt.counts[ip]++
+	return bt.counts[ip]
+}
+
+// botScore returns a score from 0 to 100 for how likely it is that the
+// request comes from a bot, and the reasons for the score. The order of the
+// headers is not kept by net/http, so only which headers are present is
+// used. recent is the number of requests from the same IP address during the
+// current minute.
+func botScore(req *http.Request, recent int) (int, []string) {
+	var (
+		score   int
+		reasons []string
+	)
+	add := func(points int, reason string) {
+		score += points
+		reasons = append(reasons, reason)
+	}
+	ua := strings.ToLower(req.UserAgent())
+	switch {
+	case ua == "":
+		add(60, "no user agent")
+	default:
+		for _, agent := range botAgents {
+			if strings.Contains(ua, agent) {
+				add(80, "bot user agent")
+				break
+			}
+		}
+	}
+	// Browsers send these headers with every request
+	if req.Header.Get("Accept") == "" {
+		add(15, "no Accept header")
+	}
+	if req.Header.Get("Accept-Language") == "" {
+		add(20, "no Accept-Language header")
+	}
+	if req.Header.Get("Accept-Encoding") == "" {
+		add(15, "no Accept-Encoding header")
+	}
+	// Recent browsers also send Sec-Fetch headers over HTTPS
+	if strings.HasPrefix(ua, "mozilla/") && req.TLS != nil && req.Header.Get("Sec-Fetch-Mode") == "" {
+		add(10, "browser user agent without Sec-Fetch headers")
+	}
+	switch {
+	case recent > 600:
+		add(50, "more than 600 requests per minute")
+	case recent > 120:
+		add(30, "more than 120 requests per minute")
+	}
+	if score > 100 {
+		score = 100
+	}
+	return score, reasons
+}
+
+// botScoreResult is the bot score for a request, and the reasons for it
+type botScoreResult struct {
+	score   int
+	reasons []string
+}
+
+// botScoreKey is the context key for the bot score of a request
+type botScoreKey struct{}
+
+// withBotScore counts the request and stores the bot score in the request
+// context, so that it is only calculated once per request
+func (ac *Config) withBotScore(req *http.Request) *http.Request {
+	score, reasons := botScore(req, ac.bots.count(ac.clientIP(req)))
+	if score >= defaultBotThreshold {
+		ac.metrics.countBot()
+	}
+	return req.WithContext(context.WithValue(req.Context(), botScoreKey{}, botScoreResult{score, reasons}))
+}
+
+// BotScore returns a score from 0 to 100 for how likely it is that the
+// request comes from a bot, and the reasons for the score
+func (ac *Config) BotScore(req *http.Request) (int, []string) {
+	if result, ok := req.Context().Value(botScoreKey{}).(botScoreResult); ok {
+		return result.score, result.reasons
+	}
+	return botScore(req, 0)
+}
+
+// isBot checks if the request comes from a suspected bot
+func (ac *Config) isBot(req *http.Request, threshold int) bool {
+	score, _ := ac.BotScore(req)
+	return score >= threshold
+}
+
+// botToken returns the value of the challenge cookie for the client and the
+// given time, signed with the same secret as the CSRF tokens
+func (ac *Config) botToken(req *http.Request, issued int64) string {
+	stamp := strconv.FormatInt(issued, 10)
+	mac := hmac.New(sha256.New, ac.csrfSecret())
+	mac.Write([]byte(ac.clientIP(req) + "|" + req.UserAgent() + "|" + stamp))
+	return stamp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// solvedChallenge checks if the browser has a valid challenge cookie
+func (ac *Config) solvedChallenge(req *http.Request) bool {
+	c, err := req.Cookie(botCookieName)
+	if err != nil {
+		return false
+	}
+	parts := strings.SplitN(c.Value, ".", 2)
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix()-issued > botCookieAge {
+		return false
+	}
+	return hmac.Equal([]byte(c.Value), []byte(ac.botToken(req, issued)))
+}
+
+// serveBotChallenge responds with a page that sets the challenge cookie with
+// JavaScript and then loads the page again
+func (ac *Config) serveBotChallenge(w http.ResponseWriter, req *http.Request) int64 {
+	cookie := fmt.Sprintf("%s=%s; path=/; max-age=%d; samesite=lax", botCookieName, ac.botToken(req, time.Now().Unix()), botCookieAge)
+	page := "<!doctype html><html><head><meta charset=\"utf-8\"><title>Checking your browser</title></head><body>" +
+		"<p>Checking your browser…</p><noscript><p>Please enable JavaScript to continue.</p></noscript>" +
+		"<script>document.cookie=" + strconv.Quote(cookie) + ";location.reload();</script></body></html>"
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	n, _ := w.Write([]byte(page))
+	return int64(n)
+}
+
+// botRejected applies the bot rule for the path prefix, if any. Suspected
+// bots are tagged with the X-Bot-Score header, challenged or blocked.
+// Returns true if the request has been rejected.
+func (ac *Config) botRejected(mux *http.ServeMux, w http.ResponseWriter, req *http.Request) bool {
+	rule, ok := ac.bots.Get(mux, req.URL.Path)
+	if !ok {
+		return false
+	}
+	score, _ := ac.BotScore(req)
+	if rule.action == botTag {
+		req.Header.Set(botScoreHeader, strconv.Itoa(score))
+		return false
+	}
+	if score < rule.threshold {
+		return false
+	}
+	switch rule.action {
+	case botChallenge:
+		if ac.solvedChallenge(req) {
+			return false
+		}
+		size := ac.serveBotChallenge(w, req)
+		ac.LogAccess(req, http.StatusServiceUnavailable, size)
+	default:
+		size := ac.ErrorPage(w, req, httperror.New(http.StatusForbidden, "Requests from bots are not allowed."))
+		ac.LogAccess(req, http.StatusForbidden, size)
+	}
+	return true
+}
+
+// LoadBotFunctions makes the BotScore function available to Lua scripts
+func (ac *Config) LoadBotFunctions(req *http.Request, L *lua.LState) {
+
+	// Get how likely it is that the request comes from a bot. Returns a
+	// number from 0 to 100 and a table with the reasons.
+	L.SetGlobal("BotScore", L.NewFunction(func(L *lua.LState) int {
+		score, reasons := ac.BotScore(req)
+		L.Push(lua.LNumber(score))
+		L.Push(convert.Strings2table(L, reasons))
+		return 2 // number of results
+	}))
+}
+
+// LoadBotPolicyFunctions makes the BotPolicy function available to server
+// configuration scripts
+func (ac *Config) LoadBotPolicyFunctions(L *lua.LState, mux *http.ServeMux) {
+
+	// Tag, challenge or block suspected bots, for an URL prefix. Takes a
+	// prefix, "tag", "challenge" or "block", and an optional score that
+	// requests must have to be from suspected bots (70 by default).
+	// Returns true if successful.
+	L.SetGlobal("BotPolicy", L.NewFunction(func(L *lua.LState) int {
+		rule := botRule{
+			prefix:    L.CheckString(1),
+			action:    botAction(L.CheckString(2)),
+			threshold: L.OptInt(3, defaultBotThreshold),
+		}
+		switch rule.action {
+		case botTag, botChallenge, botBlock:
+		default:
+			L.ArgError(2, "\"tag\", \"challenge\" or \"block\" expected")
+			return 0 // number of results
+		}
+		ac.bots.Add(mux, rule)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
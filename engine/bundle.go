@@ -0,0 +1,104 @@
+package engine
+
+// Signing .alg archives with --sign, and verifying them when they are served
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/bundle"
+)
+
+var errSignUsage = errors.New("usage: algernon --sign ARCHIVE KEYFILE [VERSION]")
+
+// publicKeyFilename returns the filename for the public key that belongs
+// to a private key, like "key.pub.pem" for "key.pem"
+func publicKeyFilename(privateFilename string) string {
+	return strings.TrimSuffix(privateFilename, filepath.Ext(privateFilename)) + ".pub.pem"
+}
+
+// SignBundle signs an .alg archive with the private key in a PEM file, as
+// given with "algernon --sign ARCHIVE KEYFILE [VERSION]". A new key pair is
+// created if the key file does not exist. Other files than .alg and .zip
+// archives, like executables for --update, get a signature in a .sig file.
+func (ac *Config) SignBundle(args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return errSignUsage
+	}
+	archive, keyFilename := args[0], args[1]
+	version := ""
+	if len(args) == 3 {
+		version = args[2]
+	}
+	var (
+		key ed25519.PrivateKey
+		err error
+	)
+	if _, statErr := os.Stat(keyFilename); os.IsNotExist(statErr) {
+		publicFilename := publicKeyFilename(keyFilename)
+		if key, err = bundle.GenerateKey(keyFilename, publicFilename); err != nil {
+			return err
+		}
+		fmt.Printf("Created a new key pair: %s and %s\n", keyFilename, publicFilename)
+		fmt.Printf("Use --trustkey=%s for only serving archives that are signed with this key.\n", publicFilename)
+	} else if key, err = bundle.LoadPrivateKey(keyFilename); err != nil {
+		return err
+	}
+	if ext := strings.ToLower(filepath.Ext(archive)); ext != ".alg" && ext != ".zip" {
+		data, err := ioutil.ReadFile(archive)
+		if err != nil {
+			return err
+		}
+		signature := bundle.SignData(key, data)
+		if err := ioutil.WriteFile(archive+".sig", []byte(signature+"\n"), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Signed %s with key %s, the signature is in %s:\n%s\n", archive, bundle.Fingerprint(key.Public().(ed25519.PublicKey)), archive+".sig", signature)
+		return nil
+	}
+	meta, err := bundle.Sign(archive, key, version)
+	if err != nil {
+		return err
+	}
+	if meta.Version != "" {
+		fmt.Printf("Signed %s, version %s, with key %s\n", archive, meta.Version, meta.Fingerprint())
+	} else {
+		fmt.Printf("Signed %s with key %s\n", archive, meta.Fingerprint())
+	}
+	return nil
+}
+
+// verifyBundle checks the signature of an .alg archive before it is
+// extracted. Archives that are not signed are only refused if --trustkey
+// is given, but archives with a signature that does not match are always
+// refused.
+func (ac *Config) verifyBundle(filename string) error {
+	var trusted []ed25519.PublicKey
+	if ac.trustKeyFilename != "" {
+		keys, err := bundle.LoadPublicKeys(ac.trustKeyFilename)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %s", ac.trustKeyFilename, err)
+		}
+		trusted = keys
+	}
+	meta, err := bundle.Verify(filename, trusted)
+	switch {
+	case err == bundle.ErrUnsigned && len(trusted) == 0:
+		return nil
+	case err != nil:
+		return fmt.Errorf("refusing to serve %s: %s", filename, err)
+	}
+	ac.bundleInfo = meta
+	if meta.Version != "" {
+		log.Infof("Verified %s, version %s, signed with key %s", filename, meta.Version, meta.Fingerprint())
+	} else {
+		log.Infof("Verified %s, signed with key %s", filename, meta.Fingerprint())
+	}
+	return nil
+}
@@ -1,15 +1,41 @@
 package engine
 
 import (
+	"bytes"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/xyproto/datablock"
 	"github.com/xyproto/gopher-lua"
 )
 
-// DataToClient is a helper function for sending file data (that might be cached) to a HTTP client
+// DataToClient is a helper function for sending file data (that might be cached) to a HTTP client.
+// The ETag is a hash of the data, so that rendered pages that have not changed are not sent again.
 func (ac *Config) DataToClient(w http.ResponseWriter, req *http.Request, filename string, data []byte) {
-	datablock.NewDataBlock(data, true).ToClient(w, req, filename, ac.ClientCanGzip(req), gzipThreshold)
+	canGzip := ac.gzipFile(w, req, filename)
+	if ac.notModified(w, req, gzipETag(contentETag(data), canGzip && len(data) > ac.gzipMinSize), time.Time{}) {
+		return
+	}
+	datablock.NewDataBlock(data, true).ToClient(w, req, filename, canGzip, ac.gzipMinSize)
+}
+
+// BlockToClient sends a static file from a data block (that might be cached) to a HTTP client,
+// with an ETag and Last-Modified, unless the client already has the same file
+func (ac *Config) BlockToClient(w http.ResponseWriter, req *http.Request, filename string, block *datablock.DataBlock) {
+	canGzip := ac.gzipFile(w, req, filename)
+	if info, err := os.Stat(filename); err == nil {
+		gzipped := canGzip && (block.IsCompressed() || block.Length() > ac.gzipMinSize)
+		if ac.notModified(w, req, gzipETag(ac.fileETag(filename, info, block.MustData), gzipped), info.ModTime()) {
+			return
+		}
+		// Serve the ranges with the modification time, for If-Range with a date
+		if req.Header.Get("Range") != "" {
+			http.ServeContent(w, req, filename, info.ModTime(), bytes.NewReader(block.MustData()))
+			return
+		}
+	}
+	block.ToClient(w, req, filename, canGzip, ac.gzipMinSize)
 }
 
 // DataToClientModernBrowsers is a helper function for sending file data (that might be cached) to a HTTP client
@@ -44,11 +70,18 @@ func (ac *Config) LoadCacheFunctions(L *lua.LState) {
 			L.Push(lua.LString(disabledMessage))
 			return 1 // number of results
 		}
-		ac.cache.Clear()
+		ac.clearCaches()
 		L.Push(lua.LString(clearedMessage))
 		return 1 // number of results
 	}))
 
+	// Remove the files that match a pattern, like "*.css" or "/blog/", from
+	// the file cache. Returns the number of files that were removed.
+	L.SetGlobal("PurgeCache", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LNumber(ac.PurgeCache(L.CheckString(1))))
+		return 1 // number of results
+	}))
+
 	// Try to load a file into the file cache, if it isn't already there
 	L.SetGlobal("preload", L.NewFunction(func(L *lua.LState) int {
 		filename := L.ToString(1)
@@ -65,4 +98,6 @@ func (ac *Config) LoadCacheFunctions(L *lua.LState) {
 		return 1                // number of results
 	}))
 
+	// The application cache, shared between all requests
+	ac.LoadAppCacheFunctions(L)
 }
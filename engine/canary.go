@@ -0,0 +1,157 @@
+package engine
+
+// Canary routing, for sending a percentage of the visitors to a new version
+// of a handler and comparing the error rates of the two versions
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/algernon/utils"
+	"github.com/xyproto/sheepcounter"
+)
+
+// canaryStats counts the requests and errors for one handler version
+type canaryStats struct {
+	requests uint64 // atomic
+	errors   uint64 // atomic
+}
+
+// canaryRoute is a path that is split between two handler files
+type canaryRoute struct {
+	handlePath string
+	filenames  [2]string
+	percentage int32           // atomic, the percentage of new visitors that get the second file
+	stats      *[2]canaryStats // shared with the route from before a reload
+}
+
+// canaryKey is a path that is handled by a mux
+type canaryKey struct {
+	mux        *http.ServeMux
+	handlePath string
+}
+
+// canaryTable keeps the canary routes for each mux, so that the routes of
+// one virtual host do not replace the routes of another, and so that the
+// statistics can survive a reload
+type canaryTable struct {
+	mut    sync.Mutex
+	routes map[canaryKey]*canaryRoute
+}
+
+// Get returns the canary route for the given mux, path and files. The
+// statistics are kept if the route was already registered with the same
+// files, also if it was registered for the mux from before a reload.
+func (ct *canaryTable) Get(mux *http.ServeMux, handlePath, stableFilename, canaryFilename string, percentage int) *canaryRoute {
+	ct.mut.Lock()
+	defer ct.mut.Unlock()
+	if ct.routes == nil {
+		ct.routes = make(map[canaryKey]*canaryRoute)
+	}
+	filenames := [2]string{stableFilename, canaryFilename}
+	key := canaryKey{mux, handlePath}
+	cr, ok := ct.routes[key]
+	if !ok || cr.filenames != filenames {
+		cr = &canaryRoute{handlePath: handlePath, filenames: filenames, stats: &[2]canaryStats{}}
+		for other, previous := range ct.routes {
+			if other.handlePath == handlePath && previous.filenames == filenames {
+				cr.stats = previous.stats
+				break
+			}
+		}
+		ct.routes[key] = cr
+	}
+	atomic.StoreInt32(&cr.percentage, int32(percentage))
+	return cr
+}
+
+// Forget removes the canary routes for the given mux
+func (ct *canaryTable) Forget(mux *http.ServeMux) {
+	ct.mut.Lock()
+	defer ct.mut.Unlock()
+	for key := range ct.routes {
+		if key.mux == mux {
+			delete(ct.routes, key)
+		}
+	}
+}
+
+// Lines returns the statistics for all canary routes, as sorted metric lines
+func (ct *canaryTable) Lines() []string {
+	ct.mut.Lock()
+	defer ct.mut.Unlock()
+	var lines []string
+	seen := make(map[*[2]canaryStats]bool)
+	for _, cr := range ct.routes {
+		if seen[cr.stats] {
+			continue
+		}
+		seen[cr.stats] = true
+		for i, filename := range cr.filenames {
+			requests := atomic.LoadUint64(&cr.stats[i].requests)
+			errors := atomic.LoadUint64(&cr.stats[i].errors)
+			labels := fmt.Sprintf("{path=%q,file=%q}", cr.handlePath, filename)
+			lines = append(lines, fmt.Sprintf("canary_requests_total%s %d", labels, requests))
+			lines = append(lines, fmt.Sprintf("canary_errors_total%s %d", labels, errors))
+			if requests > 0 {
+				lines = append(lines, fmt.Sprintf("canary_error_ratio%s %.4f", labels, float64(errors)/float64(requests)))
+			}
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// cookieName returns the name of the cookie that makes the choice of
+// handler version sticky for each visitor
+func (cr *canaryRoute) cookieName() string {
+	h := fnv.New32a()
+	h.Write([]byte(cr.handlePath))
+	return fmt.Sprintf("algernon_canary_%x", h.Sum32())
+}
+
+// choose returns 0 for the stable handler file or 1 for the canary handler
+// file. Visitors that have been here before get the same one as last time.
+func (cr *canaryRoute) choose(w http.ResponseWriter, req *http.Request) int {
+	name := cr.cookieName()
+	if cookie, err := req.Cookie(name); err == nil {
+		switch cookie.Value {
+		case "0":
+			return 0
+		case "1":
+			return 1
+		}
+	}
+	choice := 0
+	if rand.Intn(100) < int(atomic.LoadInt32(&cr.percentage)) {
+		choice = 1
+	}
+	http.SetCookie(w, &http.Cookie{Name: name, Value: fmt.Sprintf("%d", choice), Path: cr.handlePath, HttpOnly: true})
+	return choice
+}
+
+// CanaryHandler returns a handler that serves one of the two given Lua files,
+// depending on the visitor. Errors in the Lua files and responses with a
+// 5xx status code are counted as errors.
+func (ac *Config) CanaryHandler(mux *http.ServeMux, handlePath, stableFilename, canaryFilename string, percentage int) http.HandlerFunc {
+	cr := ac.canaries.Get(mux, handlePath, stableFilename, canaryFilename, percentage)
+	return func(w http.ResponseWriter, req *http.Request) {
+		i := cr.choose(w, req)
+		// Prepare to count bytes written, and to record the status code
+		sc := sheepcounter.New(w)
+		recorder := utils.NewStatusRecorder(sc)
+		err := ac.LuaPage(recorder, req, cr.filenames[i])
+		atomic.AddUint64(&cr.stats[i].requests, 1)
+		// Errors raised with Error() only count if they have a 5xx status code
+		if _, ok := httperror.From(err); (err != nil && !ok) || recorder.StatusCode >= 500 {
+			atomic.AddUint64(&cr.stats[i].errors, 1)
+		}
+		ac.LogAccess(req, recorder.StatusCode, sc.Counter())
+	}
+}
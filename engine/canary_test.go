@@ -0,0 +1,34 @@
+package engine
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCanaryTable(t *testing.T) {
+	var ct canaryTable
+	hostMux, otherMux := http.NewServeMux(), http.NewServeMux()
+	cr := ct.Get(hostMux, "/checkout", "/srv/host/v1.lua", "/srv/host/v2.lua", 10)
+	other := ct.Get(otherMux, "/checkout", "/srv/other/v1.lua", "/srv/other/v2.lua", 50)
+	if cr == other || ct.Get(hostMux, "/checkout", "/srv/host/v1.lua", "/srv/host/v2.lua", 10) != cr {
+		t.Fatal("the route for one host replaced the route for another")
+	}
+	cr.stats[1].requests = 3
+	if len(ct.Lines()) != 9 {
+		t.Errorf("expected the statistics for both hosts, got %v", ct.Lines())
+	}
+
+	// The statistics are kept when the same files are registered after a reload
+	reloadedMux := http.NewServeMux()
+	reloaded := ct.Get(reloadedMux, "/checkout", "/srv/host/v1.lua", "/srv/host/v2.lua", 20)
+	if reloaded.stats != cr.stats {
+		t.Error("the statistics were not kept after reloading")
+	}
+	if cr.percentage != 10 {
+		t.Errorf("the reload changed the percentage for the live mux to %d", cr.percentage)
+	}
+	ct.Forget(hostMux)
+	if len(ct.Lines()) != 9 {
+		t.Errorf("expected the statistics for both hosts, got %v", ct.Lines())
+	}
+}
@@ -0,0 +1,81 @@
+package engine
+
+// Loading the TLS certificates again when the files change, or on SIGHUP,
+// so that renewed certificates are used without restarting
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/platformdep"
+)
+
+// How often to check if the certificate and key files have changed
+const certCheckInterval = 30 * time.Second
+
+// Reload loads the certificates again, from the same files and directories
+// as the last time. If a certificate can not be loaded, all the previous
+// certificates are kept.
+func (cs *certStore) Reload() error {
+	cs.mut.RLock()
+	certFile, keyFile := cs.certFile, cs.keyFile
+	cs.mut.RUnlock()
+	return cs.load(certFile, keyFile, true)
+}
+
+// fingerprint returns the names, sizes and modification times of all the
+// certificate and key files, for noticing when they change
+func (cs *certStore) fingerprint() string {
+	pairs, _ := cs.filePairs()
+	cs.mut.RLock()
+	pairs = append(pairs, certPair{cs.certFile, cs.keyFile})
+	cs.mut.RUnlock()
+	var sb strings.Builder
+	for _, pair := range pairs {
+		for _, filename := range []string{pair.certFile, pair.keyFile} {
+			sb.WriteString(filename)
+			if fi, err := os.Stat(filename); err == nil {
+				sb.WriteString(" " + strconv.FormatInt(fi.Size(), 10) + " " + fi.ModTime().String())
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+// watchCertificates loads the certificates again when the certificate or
+// key files change, or on SIGHUP in server mode, until shutting down.
+// Connections that are already open keep using the previous certificates.
+func (ac *Config) watchCertificates() {
+	ac.certs.watching.Do(func() {
+		signals := make(chan os.Signal, 1)
+		if ac.serverMode {
+			platformdep.NotifyReload(signals)
+		}
+		go func() {
+			previous := ac.certs.fingerprint()
+			ticker := time.NewTicker(certCheckInterval)
+			defer ticker.Stop()
+			for !ac.ShuttingDown() {
+				select {
+				case <-signals:
+				case <-ticker.C:
+					if ac.certs.fingerprint() == previous {
+						continue
+					}
+				}
+				current := ac.certs.fingerprint()
+				if err := ac.certs.Reload(); err != nil {
+					// Keep trying, in case the files were being written
+					log.Error("Could not load the TLS certificates again: ", err)
+					continue
+				}
+				previous = current
+				log.Info("Loaded the TLS certificates again")
+			}
+		}()
+	})
+}
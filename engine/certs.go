@@ -0,0 +1,287 @@
+package engine
+
+// Serving HTTPS for several domains, with a certificate and key for each,
+// selected by the hostname the client asks for (SNI)
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/ocsp"
+)
+
+var (
+	errNoCertificates = errors.New("no TLS certificates could be loaded")
+	errCertPair       = errors.New("a certificate pair must be given as CERTFILE,KEYFILE")
+)
+
+// certPair is the filenames of a certificate and the corresponding key
+type certPair struct {
+	certFile string
+	keyFile  string
+}
+
+// certStore has the certificates for HTTPS, by hostname
+type certStore struct {
+	mut      sync.RWMutex
+	pairs    []certPair
+	dirs     []string
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+
+	// The certificate and key that were given to Load
+	certFile string
+	keyFile  string
+	watching sync.Once
+
+	// OCSP responses, by certificate
+	staples  map[string]*ocsp.Response
+	stapling sync.Once
+	wake     chan struct{}
+}
+
+// newCertStore creates a certStore without any certificates
+func newCertStore() *certStore {
+	return &certStore{
+		staples: make(map[string]*ocsp.Response),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Add adds a certificate and key, in addition to the ones given with --cert
+// and --key
+func (cs *certStore) Add(certFile, keyFile string) {
+	cs.mut.Lock()
+	defer cs.mut.Unlock()
+	cs.pairs = append(cs.pairs, certPair{certFile, keyFile})
+}
+
+// AddDir adds a directory with certificates and keys. The directory can
+// have files like example.com.crt and example.com.key, or example.com.pem
+// and example.com.key, or subdirectories with fullchain.pem and privkey.pem,
+// like the ones from certbot.
+func (cs *certStore) AddDir(dir string) {
+	cs.mut.Lock()
+	defer cs.mut.Unlock()
+	cs.dirs = append(cs.dirs, dir)
+}
+
+// Sources returns the certificate filenames and the directories, for the
+// server information
+func (cs *certStore) Sources() ([]string, []string) {
+	cs.mut.RLock()
+	defer cs.mut.RUnlock()
+	var names []string
+	for _, pair := range cs.pairs {
+		names = append(names, pair.certFile)
+	}
+	return names, append([]string{}, cs.dirs...)
+}
+
+// dirPairs finds the certificates and keys in a directory
+func dirPairs(dir string) ([]certPair, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var pairs []certPair
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			certFile, keyFile := filepath.Join(name, "fullchain.pem"), filepath.Join(name, "privkey.pem")
+			if _, err := os.Stat(keyFile); err == nil {
+				pairs = append(pairs, certPair{certFile, keyFile})
+			}
+			continue
+		}
+		ext := filepath.Ext(entry.Name())
+		if ext != ".crt" && ext != ".pem" {
+			continue
+		}
+		keyFile := strings.TrimSuffix(name, ext) + ".key"
+		if _, err := os.Stat(keyFile); err == nil {
+			pairs = append(pairs, certPair{name, keyFile})
+		}
+	}
+	return pairs, nil
+}
+
+// certNames returns the hostnames a certificate is for
+func certNames(cert *tls.Certificate) []string {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil
+		}
+		cert.Leaf = leaf
+	}
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames
+	}
+	if leaf.Subject.CommonName != "" {
+		return []string{leaf.Subject.CommonName}
+	}
+	return nil
+}
+
+// filePairs returns the certificates and keys from --certpair and from the
+// certificate directories, and the directories that could not be read
+func (cs *certStore) filePairs() ([]certPair, map[string]error) {
+	cs.mut.RLock()
+	pairs := append([]certPair{}, cs.pairs...)
+	dirs := append([]string{}, cs.dirs...)
+	cs.mut.RUnlock()
+	dirErrors := make(map[string]error)
+	for _, dir := range dirs {
+		found, err := dirPairs(dir)
+		if err != nil {
+			dirErrors[dir] = err
+			continue
+		}
+		pairs = append(pairs, found...)
+	}
+	return pairs, dirErrors
+}
+
+// Load loads all the certificates, with the given certificate and key as
+// the one that is used when the client does not ask for a hostname that
+// there is a certificate for. The certificates are replaced all at once.
+// Returns an error if no certificates could be loaded.
+func (cs *certStore) Load(certFile, keyFile string) error {
+	return cs.load(certFile, keyFile, false)
+}
+
+// load loads all the certificates. If strict is true, the certificates are
+// only replaced if all of them could be loaded.
+func (cs *certStore) load(certFile, keyFile string, strict bool) error {
+	pairs, dirErrors := cs.filePairs()
+	for dir, err := range dirErrors {
+		if strict {
+			return err
+		}
+		log.Errorf("Could not read the certificate directory %s: %s", dir, err)
+	}
+
+	byName := make(map[string]*tls.Certificate)
+	var loaded []*tls.Certificate
+	fallback, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		if len(pairs) == 0 || (strict && !os.IsNotExist(err)) {
+			return err
+		}
+		if !os.IsNotExist(err) {
+			log.Errorf("Could not load %s: %s", certFile, err)
+		}
+	} else {
+		loaded = append(loaded, &fallback)
+		for _, name := range certNames(&fallback) {
+			byName[strings.ToLower(name)] = &fallback
+		}
+	}
+	var first *tls.Certificate
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair.certFile, pair.keyFile)
+		if err != nil && strict {
+			return fmt.Errorf("%s: %s", pair.certFile, err)
+		}
+		if err != nil {
+			log.Errorf("Could not load %s: %s", pair.certFile, err)
+			continue
+		}
+		if first == nil {
+			first = &cert
+		}
+		loaded = append(loaded, &cert)
+		for _, name := range certNames(&cert) {
+			// The first certificate for a hostname is used
+			if _, ok := byName[strings.ToLower(name)]; !ok {
+				byName[strings.ToLower(name)] = &cert
+			}
+		}
+	}
+
+	cs.mut.Lock()
+	defer cs.mut.Unlock()
+	switch {
+	case fallback.Certificate != nil:
+		cs.fallback = &fallback
+	case first != nil:
+		cs.fallback = first
+	default:
+		return errNoCertificates
+	}
+	cs.applyStaples(loaded)
+	cs.byName = byName
+	cs.certFile, cs.keyFile = certFile, keyFile
+	// Let the OCSP stapling find any new certificates
+	select {
+	case cs.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// GetCertificate selects the certificate for the hostname the client asks
+// for, or one for a wildcard hostname, like *.example.com. It can be used
+// in a tls.Config.
+func (cs *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mut.RLock()
+	defer cs.mut.RUnlock()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := cs.byName[name]; ok {
+		return cert, nil
+	}
+	if pos := strings.Index(name, "."); pos != -1 {
+		if cert, ok := cs.byName["*"+name[pos:]]; ok {
+			return cert, nil
+		}
+	}
+	if cs.fallback == nil {
+		return nil, errNoCertificates
+	}
+	return cs.fallback, nil
+}
+
+// certFlag collects the certificates and keys that are given with repeated
+// --certpair flags, or the directories that are given with repeated
+// --certdir flags
+type certFlag struct {
+	ac  *Config
+	dir bool
+}
+
+// String returns the certificate filenames or the directories, separated by
+// commas
+func (cf certFlag) String() string {
+	if cf.ac == nil {
+		return ""
+	}
+	names, dirs := cf.ac.certs.Sources()
+	if cf.dir {
+		return strings.Join(dirs, ",")
+	}
+	return strings.Join(names, ",")
+}
+
+// Set adds a directory, or a certificate and key, given as CERTFILE,KEYFILE
+func (cf certFlag) Set(s string) error {
+	if cf.dir {
+		cf.ac.certs.AddDir(s)
+		return nil
+	}
+	fields := strings.Split(s, ",")
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return errCertPair
+	}
+	cf.ac.certs.Add(fields[0], fields[1])
+	return nil
+}
@@ -0,0 +1,99 @@
+package engine
+
+// Named channels, for passing messages between handlers within the server
+// process, without having to use Redis pub/sub
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// How many messages a channel can hold before Send starts failing
+const channelBufferSize = 1024
+
+// channelTable keeps the named channels. Channels are created when first used.
+type channelTable struct {
+	mut      sync.Mutex
+	channels map[string]chan interface{}
+}
+
+// Get returns the channel with the given name, and creates it if needed
+func (ct *channelTable) Get(name string) chan interface{} {
+	ct.mut.Lock()
+	defer ct.mut.Unlock()
+	if ct.channels == nil {
+		ct.channels = make(map[string]chan interface{})
+	}
+	ch, ok := ct.channels[name]
+	if !ok {
+		ch = make(chan interface{}, channelBufferSize)
+		ct.channels[name] = ch
+	}
+	return ch
+}
+
+// Lines returns the number of waiting messages for each channel, as sorted metric lines
+func (ct *channelTable) Lines() []string {
+	ct.mut.Lock()
+	defer ct.mut.Unlock()
+	var lines []string
+	for name, ch := range ct.channels {
+		lines = append(lines, fmt.Sprintf("channel_pending{name=%q} %d", name, len(ch)))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// LoadChannelFunctions makes the Send and Receive functions available to Lua
+// scripts. Receive stops waiting if the client disconnects. req can be nil.
+func (ac *Config) LoadChannelFunctions(req *http.Request, L *lua.LState) {
+
+	// Send a string, number, boolean or table to a named channel.
+	// Returns false if the value can not be sent or if the channel is full.
+	L.SetGlobal("Send", L.NewFunction(func(L *lua.LState) int {
+		ch := ac.channels.Get(L.CheckString(1))
+		value, ok := fromLua(L.Get(2), 0)
+		if !ok {
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		select {
+		case ch <- value:
+			L.Push(lua.LBool(true))
+		default:
+			L.Push(lua.LBool(false))
+		}
+		return 1 // number of results
+	}))
+
+	// Wait for a message on a named channel, for an optional number of
+	// seconds. Returns the message, or nil if no message arrived in time.
+	L.SetGlobal("Receive", L.NewFunction(func(L *lua.LState) int {
+		ch := ac.channels.Get(L.CheckString(1))
+		var timeout <-chan time.Time
+		if seconds := float64(L.OptNumber(2, 0)); seconds > 0 {
+			timer := time.NewTimer(time.Duration(seconds * float64(time.Second)))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		var done <-chan struct{}
+		if req != nil {
+			done = req.Context().Done()
+		}
+		select {
+		case value := <-ch:
+			L.Push(toLua(L, value))
+		case <-timeout:
+			L.Push(lua.LNil)
+		case <-done:
+			L.Push(lua.LNil)
+		}
+		return 1 // number of results
+	}))
+
+}
@@ -0,0 +1,200 @@
+package engine
+
+// Mutual TLS, where clients must present a certificate that is signed by one
+// of the given certificate authorities, for machine-to-machine APIs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+var (
+	errRevoked        = errors.New("the client certificate has been revoked")
+	errClientCertHTTP = errors.New("client certificates can only be verified when serving HTTPS")
+	errClientCertQUIC = errors.New("client certificates are not supported when serving QUIC")
+)
+
+// loadCRL reads a certificate revocation list, in PEM or DER format, and
+// returns the serial numbers of the revoked certificates. The list must be
+// signed by one of the given certificate authorities.
+func loadCRL(filename string, cas []*x509.Certificate) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+	signed := false
+	for _, ca := range cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return nil, fmt.Errorf("%s is not signed by any of the client certificate authorities", filename)
+	}
+	revoked := make(map[string]bool)
+	for _, entry := range crl.RevokedCertificateEntries {
+		revoked[entry.SerialNumber.String()] = true
+	}
+	return revoked, nil
+}
+
+// loadClientCAs reads all the certificates in a PEM file
+func loadClientCAs(filename string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var cas []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		cas = append(cas, ca)
+	}
+	if len(cas) == 0 {
+		return nil, fmt.Errorf("found no certificates in %s", filename)
+	}
+	return cas, nil
+}
+
+// clientCertTLSConfig returns a TLS configuration that verifies client
+// certificates, or nil if no certificate authorities for clients are given
+func (ac *Config) clientCertTLSConfig() (*tls.Config, error) {
+	if ac.clientCA == "" {
+		return nil, nil
+	}
+	cas, err := loadClientCAs(ac.clientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca)
+	}
+	config := &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}
+	if ac.clientCertOptional {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if ac.clientCRL != "" {
+		revoked, err := loadCRL(ac.clientCRL, cas)
+		if err != nil {
+			return nil, err
+		}
+		config.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, chain := range verifiedChains {
+				for _, cert := range chain {
+					if revoked[cert.SerialNumber.String()] {
+						return errRevoked
+					}
+				}
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+// withClientCerts copies the settings for verifying client certificates to
+// the given TLS configuration, if client certificates are used
+func (ac *Config) withClientCerts(config *tls.Config) *tls.Config {
+	if ac.clientTLS == nil {
+		return config
+	}
+	config.ClientCAs = ac.clientTLS.ClientCAs
+	config.ClientAuth = ac.clientTLS.ClientAuth
+	config.VerifyPeerCertificate = ac.clientTLS.VerifyPeerCertificate
+	return config
+}
+
+// plainHTTPHandler returns the given handler, or a handler that redirects to
+// HTTPS if client certificates are used, since they can not be verified
+// for plain HTTP requests, or if --forcehttps is given
+func (ac *Config) plainHTTPHandler(handler http.Handler) http.Handler {
+	if ac.forceHTTPS {
+		return ac.redirectToHTTPS()
+	}
+	if ac.clientTLS == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u := *req.URL
+		u.Scheme = "https"
+		u.Host = req.Host
+		http.Redirect(w, req, u.String(), http.StatusMovedPermanently)
+	})
+}
+
+// clientCert returns the verified client certificate, if any
+func clientCert(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
+
+// LoadClientCertFunctions makes functions for the verified client
+// certificate available to Lua scripts
+func (ac *Config) LoadClientCertFunctions(req *http.Request, L *lua.LState) {
+
+	// Get the subject of the verified client certificate, like
+	// "CN=worker1,O=Example". Returns nil if there is no certificate.
+	L.SetGlobal("ClientCertSubject", L.NewFunction(func(L *lua.LState) int {
+		cert := clientCert(req)
+		if cert == nil {
+			L.Push(lua.LNil)
+			return 1 // number of results
+		}
+		L.Push(lua.LString(cert.Subject.String()))
+		return 1 // number of results
+	}))
+
+	// Get the subject alternative names of the verified client certificate:
+	// DNS names, e-mail addresses, IP addresses and URIs. Returns a table,
+	// which is empty if there is no certificate.
+	L.SetGlobal("ClientCertNames", L.NewFunction(func(L *lua.LState) int {
+		names := L.NewTable()
+		if cert := clientCert(req); cert != nil {
+			for _, name := range cert.DNSNames {
+				names.Append(lua.LString(name))
+			}
+			for _, address := range cert.EmailAddresses {
+				names.Append(lua.LString(address))
+			}
+			for _, ip := range cert.IPAddresses {
+				names.Append(lua.LString(ip.String()))
+			}
+			for _, uri := range cert.URIs {
+				names.Append(lua.LString(uri.String()))
+			}
+		}
+		L.Push(names)
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,130 @@
+package engine
+
+// The address of the client, for banning, rate limiting and allowing or
+// blocking addresses. Behind a reverse proxy, every connection comes from
+// the proxy, so the X-Forwarded-For header is used instead, but only for
+// the proxies that are given with --trustedproxies, since clients can send
+// any header.
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// trustedProxies are the reverse proxies that the X-Forwarded-For header is
+// trusted from
+type trustedProxies struct {
+	nets []*net.IPNet
+	unix bool // connections over the Unix socket are from a proxy
+}
+
+// parseTrustedProxies parses a comma separated list of addresses and CIDR
+// ranges, where "unix" is for connections over the Unix socket
+func parseTrustedProxies(s string) (trustedProxies, error) {
+	var tp trustedProxies
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if entry == "unix" {
+			tp.unix = true
+			continue
+		}
+		ipnet, err := parseIPRange(entry)
+		if err != nil {
+			return tp, err
+		}
+		tp.nets = append(tp.nets, ipnet)
+	}
+	return tp, nil
+}
+
+// Enabled checks if any proxies are trusted
+func (tp trustedProxies) Enabled() bool {
+	return tp.unix || len(tp.nets) > 0
+}
+
+// trusts checks if the given address, or "" for the Unix socket, is a
+// trusted proxy
+func (tp trustedProxies) trusts(addr string) bool {
+	if addr == "" {
+		return tp.unix
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range tp.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadTrustedProxies parses the proxies given with --trustedproxies
+func (ac *Config) loadTrustedProxies() error {
+	tp, err := parseTrustedProxies(ac.trustedProxiesList)
+	if err != nil {
+		return err
+	}
+	ac.trustedProxies = tp
+	if ac.unixSocket != "" && !tp.unix {
+		log.Warn("Requests over the Unix socket have no client address, and are not rate limited per client. Use --trustedproxies=unix if a reverse proxy connects to the socket.")
+	}
+	return nil
+}
+
+// remoteIP returns the IP address that the request was sent from, without
+// the port number, or "" if it was not sent over IP, like over the Unix
+// socket
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+// forwardedIP returns the IP address of an X-Forwarded-For entry, which may
+// have a port number, or "" if it is not valid
+func forwardedIP(entry string) string {
+	entry = strings.TrimSpace(entry)
+	if host, _, err := net.SplitHostPort(entry); err == nil {
+		entry = host
+	}
+	if net.ParseIP(entry) == nil {
+		return ""
+	}
+	return entry
+}
+
+// clientIP returns the IP address of the client. For requests from trusted
+// proxies, the X-Forwarded-For header is read from the right, and the first
+// address that is not a trusted proxy is the client. Returns "" if the
+// client address is not known, like for requests over the Unix socket
+// without a trusted proxy.
+func (ac *Config) clientIP(req *http.Request) string {
+	ip := remoteIP(req)
+	if !ac.trustedProxies.trusts(ip) {
+		return ip
+	}
+	var hops []string
+	for _, value := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip = forwardedIP(hops[i])
+		if ip == "" || !ac.trustedProxies.trusts(ip) {
+			return ip
+		}
+	}
+	return ip
+}
@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tp, err := parseTrustedProxies("unix, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := &Config{trustedProxies: tp}
+
+	for _, test := range []struct {
+		remoteAddr, forwarded, expected string
+	}{
+		// Not from a proxy, so the header is ignored
+		{"192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		// From a proxy, without the header
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		// The client address is added by the proxy, after the one the client sent
+		{"10.0.0.1:1234", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		// Through two trusted proxies
+		{"10.0.0.1:1234", "198.51.100.7, 10.0.0.2", "198.51.100.7"},
+		// Over the trusted Unix socket
+		{"@", "198.51.100.7", "198.51.100.7"},
+		// Not a valid address
+		{"10.0.0.1:1234", "unknown", ""},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if ip := ac.clientIP(req); ip != test.expected {
+			t.Errorf("%s, %q: expected %q, got %q", test.remoteAddr, test.forwarded, test.expected, ip)
+		}
+	}
+
+	// Without trusted proxies, requests over the Unix socket have no address
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = ""
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	if ip := (&Config{}).clientIP(req); ip != "" {
+		t.Errorf("expected no address, got %q", ip)
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/8, proxy.example.com"); err == nil {
+		t.Error("expected an error for a hostname")
+	}
+}
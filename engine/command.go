@@ -0,0 +1,157 @@
+package engine
+
+// Subcommands that are sent to a running Algernon instance, over the control socket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The host part of URLs sent over the control socket. Not used for anything.
+	controlHost = "http://algernon"
+
+	commandUsage = `Available subcommands:
+
+  algernon data get kv NAME KEY            Get a value from a KeyValue
+  algernon data get hash NAME[:OWNER] [KEY] Get owners, keys or a value from a HashMap
+  algernon data get set NAME               Get all members of a Set
+  algernon data get list NAME              Get all elements of a List
+  algernon users list                      List all users
+  algernon users sessions NAME             List the sessions of a user
+  algernon users logout NAME               Log out a user from every browser
+  algernon cache purge [PATTERN]           Clear the file cache, or the files matching PATTERN
+  algernon reload                          Run the server configuration again
+  algernon reload diff                     Show what changed at the last reload
+  algernon maintenance [on|off]            Show or toggle maintenance mode
+  algernon metrics                         Show the server metrics
+  algernon routes                          List the handled paths
+  algernon diff URL URL [FILE]             Compare the responses from two servers, for
+                                           the paths in FILE (or an access log)
+
+Use --ctl=FILENAME (or --ctl=localhost:PORT) to select the control socket of
+the running instance, and --ctltoken=TOKEN if it requires a token.`
+)
+
+var (
+	// Words that are interpreted as subcommands, if given as the first argument
+	controlCommands = []string{"data", "users", "cache", "reload", "maintenance", "metrics", "routes", "diff"}
+
+	errUnknownCommand = errors.New("unknown subcommand")
+)
+
+// isControlCommand checks if the given arguments looks like a subcommand
+func isControlCommand(args []string) bool {
+	return len(args) > 0 && has(controlCommands, args[0])
+}
+
+// commandRequest converts the given subcommand arguments to a HTTP method
+// and an URL path, including the query string
+func commandRequest(args []string) (string, string, error) {
+	// Retrieve a positional argument, or an empty string
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+	q := url.Values{}
+	switch arg(0) + " " + arg(1) {
+	case "data get":
+		q.Set("type", arg(2))
+		q.Set("name", arg(3))
+		q.Set("owner", arg(4))
+		q.Set("key", arg(5))
+		return http.MethodGet, "/data?" + q.Encode(), nil
+	case "users list":
+		return http.MethodGet, "/users", nil
+	case "users sessions":
+		q.Set("username", arg(2))
+		return http.MethodGet, "/users/sessions?" + q.Encode(), nil
+	case "users logout":
+		q.Set("username", arg(2))
+		return http.MethodPost, "/users/logout?" + q.Encode(), nil
+	case "cache purge":
+		q.Set("pattern", arg(2))
+		return http.MethodPost, "/cache/purge?" + q.Encode(), nil
+	case "reload ":
+		return http.MethodPost, "/reload", nil
+	case "reload diff":
+		return http.MethodGet, "/reload/diff", nil
+	case "maintenance ":
+		return http.MethodGet, "/maintenance", nil
+	case "maintenance on", "maintenance off":
+		q.Set("enabled", strconv.FormatBool(arg(1) == "on"))
+		return http.MethodPost, "/maintenance?" + q.Encode(), nil
+	case "metrics ":
+		return http.MethodGet, "/metrics", nil
+	case "routes ":
+		return http.MethodGet, "/routes", nil
+	}
+	return "", "", errUnknownCommand
+}
+
+// controlClient returns a HTTP client that connects to the given Unix socket,
+// or localhost address
+func controlClient(socketFilename string) *http.Client {
+	network, address := controlAddress(socketFilename)
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, address)
+			},
+		},
+	}
+}
+
+// RunCommand sends the given subcommand to the running Algernon instance that
+// serves the control socket, then outputs the result.
+func (ac *Config) RunCommand(args []string) error {
+	// Comparing two servers does not involve the control socket
+	if args[0] == "diff" {
+		return ac.RunDiff(args[1:])
+	}
+	method, requestPath, err := commandRequest(args)
+	if err != nil {
+		fmt.Println(commandUsage)
+		return fmt.Errorf("%s: %s", err, strings.Join(args, " "))
+	}
+	socketFilename := ac.controlFilename
+	if socketFilename == "" {
+		socketFilename = ac.defaultControlFilename
+	}
+	req, err := http.NewRequest(method, controlHost+requestPath, nil)
+	if err != nil {
+		return err
+	}
+	if ac.controlToken != "" {
+		req.Header.Set("Authorization", "Bearer "+ac.controlToken)
+	}
+	resp, err := controlClient(socketFilename).Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach a running instance at %s: %s", socketFilename, err)
+	}
+	defer resp.Body.Close()
+	var result controlResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return errors.New(result.Error)
+	}
+	for _, value := range result.Values {
+		fmt.Println(value)
+	}
+	if result.Message != "" {
+		fmt.Println(result.Message)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package engine
+
+// Transparent brotli or gzip compression of the responses that are not
+// compressed already, like the output of Lua handlers. Static files and
+// rendered pages are compressed with gzip by the datablock package instead,
+// with the same minimum size and MIME types, so that compressed data can be
+// cached.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// The MIME types that are compressed by default, where "*" matches any
+// characters except "/"
+const defaultGzipMIMETypes = "text/*,application/javascript,application/json,application/*+json,application/xml,application/*+xml,application/wasm,image/svg+xml,font/otf,font/ttf"
+
+// The brotli compression level for responses that are compressed on the
+// fly, which compresses better than gzip at about the same speed
+const brotliLevel = 4
+
+// compressor is a brotli or gzip writer
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// compressors are reused for each content encoding, since they allocate a lot
+var compressors = map[string]*sync.Pool{
+	"br": {
+		New: func() interface{} {
+			return brotli.NewWriterLevel(ioutil.Discard, brotliLevel)
+		},
+	},
+	"gzip": {
+		New: func() interface{} {
+			return gzip.NewWriter(ioutil.Discard)
+		},
+	},
+}
+
+// parseGzipMIMETypes splits a comma separated list of MIME types, like
+// "text/*,application/json". Uses the default list if the string is empty.
+func parseGzipMIMETypes(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		s = defaultGzipMIMETypes
+	}
+	var mimeTypes []string
+	for _, mimeType := range strings.Split(s, ",") {
+		if mimeType = strings.ToLower(strings.TrimSpace(mimeType)); mimeType != "" {
+			mimeTypes = append(mimeTypes, mimeType)
+		}
+	}
+	return mimeTypes
+}
+
+// gzipContentType checks if responses with the given content type should be
+// compressed. Event streams are never compressed.
+func (ac *Config) gzipContentType(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if mediaType == "" || mediaType == "text/event-stream" {
+		return false
+	}
+	for _, pattern := range ac.gzipMIMETypes {
+		if ok, _ := path.Match(pattern, mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipFile checks if the client supports gzip, and if the file should be
+// compressed, by the content type that has been set, or else by the
+// extension of the filename
+func (ac *Config) gzipFile(w http.ResponseWriter, req *http.Request, filename string) bool {
+	contentType := w.Header().Get("Content-Type")
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(filename))
+	}
+	return ac.gzipContentType(contentType) && ac.ClientCanGzip(req)
+}
+
+// responseEncoding returns the content encoding for compressing responses
+// on the fly, which is "br" if the client accepts brotli, or else "gzip" if
+// the client accepts gzip, or else ""
+func (ac *Config) responseEncoding(req *http.Request) string {
+	if acceptsEncoding(req.Header.Get("Accept-Encoding"), "br") {
+		return "br"
+	}
+	if ac.ClientCanGzip(req) {
+		return "gzip"
+	}
+	return ""
+}
+
+// addVary adds a value to the Vary header, unless it is there already
+func addVary(header http.Header, value string) {
+	for _, line := range header["Vary"] {
+		for _, existing := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(existing), value) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", value)
+}
+
+// gzipWriter is a ResponseWriter that compresses the response with brotli
+// or gzip, if the content type is in the --gzipmime list and the response is
+// larger than --gzipmin bytes. The start of the response is buffered, until
+// the size is known to be large enough.
+type gzipWriter struct {
+	http.ResponseWriter
+	ac       *Config
+	encoding string // the content encoding that the client accepts, or ""
+	status   int
+	buf      []byte
+	gz       compressor
+	decided  bool
+}
+
+// startGzip wraps the ResponseWriter, for compressing the response. Returns
+// nil for range requests and websocket connections, that are never
+// compressed.
+func (ac *Config) startGzip(w http.ResponseWriter, req *http.Request) *gzipWriter {
+	if req.Header.Get("Range") != "" || strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return nil
+	}
+	return &gzipWriter{ResponseWriter: w, ac: ac, encoding: ac.responseEncoding(req), status: http.StatusOK}
+}
+
+// WriteHeader passes the headers on right away if the response is not going
+// to be compressed, or else waits for the start of the body
+func (gw *gzipWriter) WriteHeader(statusCode int) {
+	if gw.decided {
+		return
+	}
+	gw.status = statusCode
+	header := gw.Header()
+	bodyless := statusCode < http.StatusOK || statusCode == http.StatusNoContent || statusCode == http.StatusNotModified
+	if bodyless || header.Get("Content-Encoding") != "" || (header.Get("Content-Type") != "" && !gw.ac.gzipContentType(header.Get("Content-Type"))) {
+		gw.decide(false)
+	}
+}
+
+// Write buffers the start of the body, and compresses the rest, if the
+// response is going to be compressed
+func (gw *gzipWriter) Write(data []byte) (int, error) {
+	if !gw.decided {
+		if gw.Header().Get("Content-Encoding") != "" {
+			gw.decide(false)
+		} else {
+			gw.buf = append(gw.buf, data...)
+			if len(gw.buf) <= gw.ac.gzipMinSize {
+				return len(data), nil
+			}
+			if err := gw.decideFromBuffer(); err != nil {
+				return 0, err
+			}
+			return len(data), nil
+		}
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(data)
+	}
+	return gw.ResponseWriter.Write(data)
+}
+
+// decideFromBuffer decides if the response is compressed, now that the
+// buffered data is larger than the minimum size, and writes the buffer
+func (gw *gzipWriter) decideFromBuffer() error {
+	header := gw.Header()
+	if header.Get("Content-Type") == "" {
+		// The same content type as net/http would detect
+		header.Set("Content-Type", http.DetectContentType(gw.buf))
+	}
+	compress := gw.ac.gzipContentType(header.Get("Content-Type"))
+	if compress {
+		// The response depends on the Accept-Encoding header
+		addVary(header, "Accept-Encoding")
+	}
+	gw.decide(compress && gw.encoding != "")
+	buf := gw.buf
+	gw.buf = nil
+	var err error
+	if gw.gz != nil {
+		_, err = gw.gz.Write(buf)
+	} else {
+		_, err = gw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// decide writes the headers, for a compressed response or not
+func (gw *gzipWriter) decide(compress bool) {
+	gw.decided = true
+	if compress {
+		header := gw.Header()
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", gw.encoding)
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", encodedETag(etag, gw.encoding))
+		}
+		gw.gz = compressors[gw.encoding].Get().(compressor)
+		gw.gz.Reset(gw.ResponseWriter)
+	}
+	gw.ResponseWriter.WriteHeader(gw.status)
+}
+
+// writeUncompressed writes the headers and the buffered data, without
+// compression
+func (gw *gzipWriter) writeUncompressed() {
+	buf := gw.buf
+	gw.buf = nil
+	gw.decide(false)
+	if len(buf) > 0 {
+		gw.ResponseWriter.Write(buf)
+	}
+}
+
+// Flush sends what has been written so far. Responses that are flushed
+// before they are larger than the minimum size are not compressed.
+func (gw *gzipWriter) Flush() {
+	if !gw.decided {
+		gw.writeUncompressed()
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	if flusher, ok := gw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the wrapped ResponseWriter be hijacked, without compression
+func (gw *gzipWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := gw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer can not be hijacked")
+	}
+	gw.decided = true
+	return hijacker.Hijack()
+}
+
+// finish writes the buffered data, for responses that are too small to be
+// compressed, or else ends the compressed stream
+func (gw *gzipWriter) finish() {
+	if !gw.decided {
+		gw.writeUncompressed()
+		return
+	}
+	if gw.gz != nil {
+		gw.gz.Close()
+		gw.gz.Reset(ioutil.Discard)
+		compressors[gw.encoding].Put(gw.gz)
+		gw.gz = nil
+	}
+}
@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestCompressOnTheFly(t *testing.T) {
+	ac := newTestConfig()
+	body := strings.Repeat("hello brotli world ", 1000)
+	for _, test := range []struct {
+		acceptEncoding, encoding string
+	}{
+		{"gzip, deflate, br", "br"},
+		{"br", "br"},
+		{"gzip", "gzip"},
+		{"gzip, br;q=0", "gzip"},
+		{"", ""},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		rec := httptest.NewRecorder()
+		gw := ac.startGzip(rec, req)
+		gw.Header().Set("Content-Type", "text/plain")
+		gw.Header().Set("ETag", `"abc"`)
+		gw.Write([]byte(body))
+		gw.finish()
+
+		if encoding := rec.Header().Get("Content-Encoding"); encoding != test.encoding {
+			t.Errorf("%q: expected the encoding %q, got %q", test.acceptEncoding, test.encoding, encoding)
+			continue
+		}
+		var r io.Reader = rec.Body
+		etag := `"abc"`
+		switch test.encoding {
+		case "br":
+			r = brotli.NewReader(r)
+			etag = `"abc-br"`
+		case "gzip":
+			gr, err := gzip.NewReader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = gr
+			etag = `"abc-gzip"`
+		}
+		if got := rec.Header().Get("ETag"); got != etag {
+			t.Errorf("%q: expected the ETag %s, got %s", test.acceptEncoding, etag, got)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil || string(data) != body {
+			t.Errorf("%q: the body could not be decompressed: %v", test.acceptEncoding, err)
+		}
+	}
+}
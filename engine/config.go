@@ -3,6 +3,7 @@ package engine
 
 import (
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -20,11 +21,17 @@ import (
 	"github.com/jvatic/goja-babel"
 	"github.com/mitchellh/colorstring"
 	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/bundle"
 	"github.com/xyproto/algernon/cachemode"
+	"github.com/xyproto/algernon/contentstore"
+	"github.com/xyproto/algernon/logrotate"
+	"github.com/xyproto/algernon/lua/payment"
 	"github.com/xyproto/algernon/lua/pool"
+	"github.com/xyproto/algernon/lua/protobuf"
 	"github.com/xyproto/algernon/platformdep"
 	"github.com/xyproto/algernon/utils"
 	"github.com/xyproto/datablock"
+	"github.com/xyproto/gopher-lua"
 	"github.com/xyproto/mime"
 	"github.com/xyproto/pinterface"
 	"github.com/xyproto/recwatch"
@@ -45,6 +52,8 @@ type Config struct {
 	dbName          string
 	refreshDuration time.Duration // for the auto-refresh feature
 	shutdownTimeout time.Duration
+	shuttingDown    int32           // 1 while shutting down (atomic)
+	servers         *sync.WaitGroup // the servers that are serving
 
 	defaultWebColonPort       string
 	defaultRedisColonPort     string
@@ -72,6 +81,9 @@ type Config struct {
 	// Default log file, for some operating systems
 	defaultLogFile string
 
+	// Default control socket, for some operating systems
+	defaultControlFilename string
+
 	// Default filename for a Lua script that provides data to a template
 	defaultLuaDataFilename string
 
@@ -84,6 +96,15 @@ type Config struct {
 	// If only HTTP/2 or HTTP
 	serveJustHTTP2, serveJustHTTP bool
 
+	// Comma separated domains that should get certificates from Let's Encrypt,
+	// an e-mail address for the Let's Encrypt account and where to store the certificates
+	autocertDomains, autocertEmail, autocertDir string
+	autocertDNS                                 string
+
+	// The address of a FastCGI server, and the comma separated filename
+	// extensions that should be passed on to it
+	fastcgiAddress, fastcgiExtensions string
+
 	// If only QUIC
 	serveJustQUIC bool
 
@@ -120,16 +141,44 @@ type Config struct {
 	mariaDatabase      string // database name
 	postgresDSN        string // connection string
 	postgresDatabase   string // database name
+	sqliteFilename     string
 	redisAddr          string
 	redisDBindex       int
 	redisAddrSpecified bool
 
+	// File for keeping the in-memory database that is used if Redis can not be reached
+	fallbackFilename string
+
 	limitRequests       int64 // rate limit to this many requests per client per second
 	disableRateLimiting bool
 
 	// Access logs
 	commonAccessLogFilename   string // NCSA access log
 	combinedAccessLogFilename string // CLF access log
+	accessLogTime             bool   // add the time it took to serve each request to the CLF access log
+
+	// JSON request log, that is rotated when it is too large or too old
+	jsonLogFilename string
+	jsonLogSize     int64 // in megabytes
+	jsonLogAge      time.Duration
+	jsonLogKeep     int
+	jsonLog         *logrotate.File
+
+	// Recording requests and responses with --record, and replaying them
+	// with --replay
+	recordFilename string
+	recorder       *trafficRecorder
+	replayMode     bool
+	replayArgs     []string
+
+	// The locales the site supports, for formatting dates, numbers and money
+	locales []string
+
+	// For logging to syslog or to the systemd journal
+	syslogAddress string // "local" for the local syslog daemon
+	journald      bool
+	logFacility   string
+	logLevel      string
 
 	// For the version flag
 	showVersion bool
@@ -141,11 +190,16 @@ type Config struct {
 	cacheMaxEntitySize    uint64
 	cacheCompressionSpeed bool // Compression speed over compactness
 	cacheMaxGivenDataSize uint64
+	cacheTTL              time.Duration
 	noCache               bool
 
 	// Large file support (threshold for not reading into memory)
 	largeFileSize uint64
 
+	// Lua call stack and data stack (registry) sizes, 0 means the default
+	luaCallStackSize int
+	luaRegistrySize  int
+
 	// Timeout when writing to a client, in seconds
 	writeTimeout uint64
 
@@ -213,6 +267,7 @@ type Config struct {
 	perm    pinterface.IPermissions
 	luapool *pool.LStatePool
 	cache   *datablock.FileCache
+	files   *fileCache
 
 	// Default program for opening files and URLs in the current OS
 	defaultOpenExecutable string
@@ -236,9 +291,257 @@ type Config struct {
 	// Support clients like "curl" that downloads uncompressed by default
 	curlSupport bool
 
+	// Responses larger than this are compressed, if the content type is
+	// one of the MIME types, where "*" can be used, like "text/*"
+	gzipMinSize   int
+	gzipMIMETypes []string
+
 	// Indicate if path prefixes like "/admin" should be cleared,
 	// or if the default settings should be kept.
 	clearDefaultPathPrefixes bool
+
+	// Unix socket (or localhost address) for controlling a running instance
+	controlFilename string
+
+	// For serving the pprof endpoints
+	pprofAddress string
+
+	// Fixed random seeds and timestamps, for reproducible output
+	deterministic bool
+
+	// For serving on more addresses than the main server address
+	listenAddresses []listenAddress
+
+	// For serving HTTP on a Unix socket instead of on a TCP port
+	unixSocket      string
+	unixSocketMode  string
+	unixSocketOwner string
+
+	// Virtual hosts from the hosts tables in the configuration scripts,
+	// until the handlers are set up
+	virtualHosts []virtualHost
+
+	// For publishing files to the server directory over SFTP
+	sftpAddress string
+	sftpKeys    string
+	sftpHostKey string
+
+	// For quarantining Lua handlers that fail too many times in a row
+	quarantineThreshold int
+	quarantineDuration  time.Duration
+
+	// For serving the health and readiness endpoints
+	healthEndpoints bool
+	healthPath      string
+	readyPath       string
+
+	// Token that is required by the control socket, if set
+	controlToken string
+
+	// Subcommand to send to a running instance, like "users list"
+	controlArgs []string
+
+	// For signing .alg archives with --sign, and for only serving archives
+	// that are signed with a trusted key
+	signArgs         []string
+	signBundle       bool
+	trustKeyFilename string
+	bundleInfo       *bundle.Metadata
+
+	// Certificates for HTTPS, by hostname
+	certs *certStore
+
+	// For not stapling OCSP responses to the certificates, with --noocsp
+	noOCSP bool
+
+	// The TLS versions and cipher suites, from --tlsprofile, --tlsmin
+	// and --ciphers
+	tlsProfileName string
+	tlsMinVersion  string
+	tlsCiphers     string
+	tls            *tlsProfile
+	tlsWarning     sync.Once
+
+	// For redirecting plain HTTP to HTTPS, and for the
+	// Strict-Transport-Security header
+	forceHTTPS     bool
+	hstsMaxAge     time.Duration
+	hstsSubdomains bool
+	hstsPreload    bool
+
+	// Limits for the connections, from --maxconns, --maxconnsperip and
+	// --connrate
+	maxConns      int
+	maxConnsPerIP int
+	connRate      float64
+	connLimiter   *connLimiter
+
+	// The reverse proxies that the X-Forwarded-For header is trusted from,
+	// from --trustedproxies
+	trustedProxiesList string
+	trustedProxies     trustedProxies
+
+	// Protocol Buffers message types, from ProtobufDescriptors
+	protoRegistry *protobuf.Registry
+
+	// For updating the executable with --update
+	updateMode        bool
+	updateURL         string
+	updateKeyFilename string
+
+	// For printing the configuration schema with --schema, and the stubs
+	// for the Lua language server with --emit-stubs
+	printSchema bool
+	emitStubs   bool
+
+	// The handler that is given to the HTTP servers, and related state
+	// that can be inspected and changed while the server is running
+	handler     *mainHandler
+	metrics     *serverMetrics
+	routes      *routeTable
+	protections *stringList
+	lastReload  *reloadDiff
+	canaries    *canaryTable
+	quarantine  *quarantineTable
+	listeners   *listenerTable
+	fastcgi     *fastcgiTable
+	renderers   *rendererTable
+
+	// For caching values from Lua, within the server process
+	appCache *appCache
+
+	// For passing messages between Lua handlers
+	channels *channelTable
+
+	// For SQL databases that are opened from Lua
+	dbs *dbTable
+
+	// Output filters, for changing response bodies of given content types
+	filters *filterTable
+
+	// Path prefixes that require HTTP Basic Auth
+	basicAuth *basicAuthTable
+
+	// Path prefixes that require an API key
+	apiKeys *apiKeyTable
+
+	// Path prefixes that require a CSRF token, for requests that change data
+	csrf *csrfTable
+
+	// Path prefixes that other sites may send requests to
+	cors *corsTable
+
+	// Security headers for all responses, and for path prefixes
+	securityHeaders *securityHeaderTable
+
+	// Rate limits for path prefixes
+	rateLimits *rateLimitTable
+
+	// Policies for suspected bots, for path prefixes
+	bots *botTable
+
+	// Trap routes, and the IP addresses that are banned for requesting them
+	traps *trapTable
+
+	// Latency and errors that are injected for paths, in debug mode
+	faults *faultTable
+
+	// How streams are ended when the handler fails, for paths
+	streamFallbacks *streamFallbackTable
+
+	// What to do about risky settings in the configuration: "warn",
+	// "strict" or "off"
+	configCheck string
+
+	// Rules for rewriting the paths, before the handlers see them
+	rewrites *rewriteTable
+
+	// Redirects for moved pages
+	redirects *redirectTable
+
+	// Address ranges that are allowed or blocked for path prefixes, and
+	// named lists of address ranges
+	ipRules *ipRuleTable
+	ipLists *ipListTable
+
+	// Accessibility audit of rendered HTML, in debug mode
+	a11yAudit bool
+	a11y      *a11yReports
+
+	// Approximate allocations for each Lua page and Lua handler
+	allocs *allocTable
+
+	// The Lua application script, that runs once and then serves calls from handlers
+	appFilename string
+	app         *appScript
+
+	// The request headers that are passed on when Lua scripts send requests
+	// to other services, like the request ID
+	forwardHeaders []string
+
+	// The base path that everything is served under, like "/myapp", or empty
+	urlPrefix string
+
+	// How to respond when permission is denied, per path prefix, and the
+	// login page that browsers are redirected to by default
+	denyPolicies *denyPolicyTable
+	loginURL     string
+
+	// How long logins last, in seconds (0 for the default cookie timeout),
+	// if logins are renewed while in use, for how many days "remember me"
+	// tokens last and how many sessions each user can have (0 for no limit)
+	sessionTimeout  int64
+	slidingSessions bool
+	rememberDays    int
+	maxSessions     int
+
+	// Only give visitors an anonymous visitor ID if they agree to it, and
+	// how many days it takes before a visitor gets a new visitor ID
+	visitorConsent bool
+	visitorDays    int
+
+	// For checking passwords with LDAP, if it is configured in server.lua
+	ldap *ldapAuth
+
+	// For checking uploaded files, if it is configured in server.lua
+	uploadScan *uploadScanner
+
+	// For checking comments and form submissions for spam
+	spam *spamFilter
+
+	// Custom error pages for status codes, for the whole server
+	errorPages *errorPageTable
+
+	// How directory listings are generated, the index filenames from
+	// --index and if --nolistings is given
+	dirListing     *dirListingConfig
+	indexFilenames []string
+	noListings     bool
+
+	// The ETags of static files, until the files change
+	etags *etagTable
+
+	// The channels that users can be notified on
+	notify *notifier
+
+	// The VAPID key pair for Web Push, if it is enabled in server.lua
+	webPush *webPushConfig
+
+	// The payment provider API and the secrets for it
+	paymentAPI           string
+	paymentKey           string
+	paymentWebhookSecret string
+	payments             *payment.Client
+
+	// The directory where content is stored by hash, if any
+	contentDir string
+	content    *contentstore.Store
+
+	// For verifying client certificates
+	clientCA           string
+	clientCRL          string
+	clientCertOptional bool
+	clientTLS          *tls.Config
 }
 
 // ErrVersion is returned when the initialization quits because all that is done
@@ -248,12 +551,40 @@ var (
 	ErrDatabase = errors.New("could not find a usable database backend")
 )
 
+// ErrCommand is returned when the initialization quits because a subcommand
+// has been sent to a running instance
+var ErrCommand = errors.New("only running a subcommand")
+
 // New creates a new server configuration based using the default values
 func New(versionString, description string) (*Config, error) {
+	ac := newConfig(versionString, description)
+
+	if err := ac.initFilesAndCache(); err != nil {
+		return nil, err
+	}
+	ac.initializeMime()
+	ac.setupLogging()
+
+	// File stat cache
+	ac.fs = datablock.NewFileStat(ac.cacheFileStat, ac.defaultStatCacheRefresh)
+
+	// JSX rendering pool
+	babel.Init(8)
+
+	return ac, nil
+}
+
+// newConfig creates a server configuration with the default values, without
+// handling the flags
+func newConfig(versionString, description string) *Config {
 	ac := &Config{
 		curlSupport: true,
 
+		gzipMinSize:   gzipThreshold,
+		gzipMIMETypes: parseGzipMIMETypes(defaultGzipMIMETypes),
+
 		shutdownTimeout: 10 * time.Second,
+		servers:         &sync.WaitGroup{},
 
 		defaultWebColonPort:       ":3000",
 		defaultRedisColonPort:     ":6379",
@@ -278,6 +609,9 @@ func New(versionString, description string) (*Config, error) {
 		// Default log file, for some operating systems
 		defaultLogFile: "/tmp/algernon.log",
 
+		// Default control socket, for some operating systems
+		defaultControlFilename: "/tmp/algernon.sock",
+
 		// Default filename for a Lua script that provides data to a template
 		defaultLuaDataFilename: "data.lua",
 
@@ -294,6 +628,51 @@ func New(versionString, description string) (*Config, error) {
 		// Mutex for rendering Pongo2 pages
 		pongomutex: &sync.RWMutex{},
 
+		// For managing the server while it is running
+		metrics:     newServerMetrics(),
+		routes:      newRouteTable(),
+		protections: &stringList{},
+		lastReload:  &reloadDiff{},
+		canaries:    &canaryTable{},
+		quarantine:  &quarantineTable{},
+		certs:       newCertStore(),
+		listeners:   &listenerTable{},
+		fastcgi:     &fastcgiTable{},
+		renderers:   &rendererTable{},
+		appCache:    newAppCache(defaultAppCacheEntries),
+		channels:    &channelTable{},
+		dbs:         &dbTable{},
+		filters:     &filterTable{},
+		basicAuth:   &basicAuthTable{},
+		apiKeys:     &apiKeyTable{},
+		csrf:        &csrfTable{},
+		cors:        &corsTable{},
+
+		securityHeaders: &securityHeaderTable{},
+		rateLimits:      &rateLimitTable{},
+		bots:            &botTable{},
+		traps:           &trapTable{},
+		faults:          &faultTable{},
+		streamFallbacks: &streamFallbackTable{},
+		rewrites:        &rewriteTable{},
+		redirects:       &redirectTable{},
+		ipRules:         &ipRuleTable{},
+		ipLists:         &ipListTable{},
+		a11y:            &a11yReports{},
+		allocs:          &allocTable{},
+
+		denyPolicies: &denyPolicyTable{},
+		ldap:         &ldapAuth{},
+		uploadScan:   &uploadScanner{},
+		spam:         &spamFilter{},
+		errorPages:   &errorPageTable{},
+		dirListing:   &dirListingConfig{options: dirListingOptions{hidden: true, index: indexFilenames}},
+		etags:        &etagTable{},
+		notify:       &notifier{},
+		webPush:      &webPushConfig{},
+
+		protoRegistry: protobuf.NewRegistry(),
+
 		// Program for opening URLs
 		defaultOpenExecutable: platformdep.DefaultOpenExecutable,
 
@@ -309,19 +688,9 @@ func New(versionString, description string) (*Config, error) {
 			},
 		},
 	}
-	if err := ac.initFilesAndCache(); err != nil {
-		return nil, err
-	}
-	ac.initializeMime()
-	ac.setupLogging()
-
-	// File stat cache
-	ac.fs = datablock.NewFileStat(ac.cacheFileStat, ac.defaultStatCacheRefresh)
-
-	// JSX rendering pool
-	babel.Init(8)
-
-	return ac, nil
+	ac.handler = newMainHandler(ac)
+	ac.registerBuiltinRenderers()
+	return ac
 }
 
 // SetFileStatCache can be used to set a different FileStat cache than the default one
@@ -349,6 +718,54 @@ func (ac *Config) initFilesAndCache() error {
 		return ErrVersion
 	}
 
+	// Subcommands, like "algernon users list"
+	if len(ac.controlArgs) > 0 {
+		if err := ac.RunCommand(ac.controlArgs); err != nil {
+			return err
+		}
+		return ErrCommand
+	}
+
+	// Signing an .alg archive, with --sign
+	if ac.signBundle {
+		if err := ac.SignBundle(ac.signArgs); err != nil {
+			return err
+		}
+		return ErrCommand
+	}
+
+	// Replaying recorded requests against a server, with --replay
+	if ac.replayMode {
+		if err := ac.RunReplay(ac.replayArgs); err != nil {
+			return err
+		}
+		return ErrCommand
+	}
+
+	// Updating the executable, with --update
+	if ac.updateMode {
+		if err := ac.Update(); err != nil {
+			return err
+		}
+		return ErrCommand
+	}
+
+	// Printing the configuration schema, with --schema
+	if ac.printSchema {
+		if err := ac.PrintSchema(os.Stdout); err != nil {
+			return err
+		}
+		return ErrCommand
+	}
+
+	// Printing the stubs for the Lua language server, with --emit-stubs
+	if ac.emitStubs {
+		if err := ac.EmitStubs(os.Stdout); err != nil {
+			return err
+		}
+		return ErrCommand
+	}
+
 	// CPU profiling
 	if ac.profileCPU != "" {
 		f, errProfile := os.Create(ac.profileCPU)
@@ -419,11 +836,37 @@ func (ac *Config) initFilesAndCache() error {
 		}
 		f.Close()
 	}
+	// Open the JSON request log, if specified
+	if ac.jsonLogFilename != "" {
+		ac.jsonLog, err = logrotate.Open(ac.jsonLogFilename, ac.jsonLogSize*1024*1024, ac.jsonLogAge, ac.jsonLogKeep)
+		if err != nil {
+			return err
+		}
+		AtShutdown(func() {
+			ac.jsonLog.Close()
+		})
+	}
+	// Open the file for recording requests and responses, if specified
+	if ac.recordFilename != "" {
+		ac.recorder, err = openTrafficRecorder(ac.recordFilename)
+		if err != nil {
+			return err
+		}
+		AtShutdown(func() {
+			ac.recorder.Close()
+		})
+	}
 
 	// Create a cache struct for reading files (contains functions that can
 	// be used for reading files, also when caching is disabled).
 	// The final argument is for compressing with "fast" instead of "best".
 	ac.cache = datablock.NewFileCache(ac.cacheSize, ac.cacheCompression, ac.cacheMaxEntitySize, ac.cacheCompressionSpeed, ac.cacheMaxGivenDataSize)
+
+	// Static files and rendered Markdown are kept in a cache where the least
+	// recently used entries are evicted, and files that change are read again
+	if ac.cacheMode != cachemode.Off && ac.cacheSize > 0 {
+		ac.files = newFileCache(ac.cacheSize, ac.cacheMaxEntitySize, ac.cacheTTL)
+	}
 	return nil
 }
 
@@ -442,6 +885,7 @@ func (ac *Config) setupLogging() {
 		// If quiet mode is enabled and no log file has been specified, disable logging
 		log.SetOutput(ioutil.Discard)
 	}
+	ac.setupSyslog()
 	// Close stdout and stderr if quite mode has been enabled
 	if ac.quietMode {
 		os.Stdout.Close()
@@ -522,10 +966,10 @@ func (ac *Config) shouldCache(ext string) bool {
 	}
 }
 
-// hasHandlers checks if the given filename contains "handle(" or "handle ("
+// hasHandlers checks if the given filename contains "handle(", "handle (", "websocket(" or "proxy("
 func hasHandlers(fn string) bool {
 	data, err := ioutil.ReadFile(fn)
-	return err == nil && (bytes.Contains(data, []byte("handle(")) || bytes.Contains(data, []byte("handle (")))
+	return err == nil && (bytes.Contains(data, []byte("handle(")) || bytes.Contains(data, []byte("handle (")) || bytes.Contains(data, []byte("websocket(")) || bytes.Contains(data, []byte("proxy(")))
 }
 
 // has checks if a given slice of strings contains a given string
@@ -593,10 +1037,16 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 				}
 				return nil
 			case ".zip", ".alg":
+				// Check the signature, if there is one
+				if verifyErr := ac.verifyBundle(serverFile); verifyErr != nil {
+					return verifyErr
+				}
 				// Assume this to be a compressed Algernon application
 				if extractErr := unzip.Extract(serverFile, ac.serverTempDir); extractErr != nil {
 					return extractErr
 				}
+				// The manifest and signature are not to be served
+				os.RemoveAll(filepath.Join(ac.serverTempDir, bundle.MetaDir))
 				// Use the directory where the file was extracted as the server directory
 				ac.serverDirOrFilename = ac.serverTempDir
 				// If there is only one directory there, assume it's the
@@ -658,17 +1108,45 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 		if err != nil {
 			return ErrDatabase
 		}
+		ac.perm.SetDenyFunction(ac.PermissionDenied)
+		if ac.sessionTimeout > 0 {
+			ac.perm.UserState().SetCookieTimeout(ac.sessionTimeout)
+		}
 	}
 
 	// Lua LState pool
-	ac.luapool = pool.New()
+	ac.luapool = pool.NewWithOptions(lua.Options{
+		CallStackSize: ac.luaCallStackSize,
+		RegistrySize:  ac.luaRegistrySize,
+	})
 	AtShutdown(func() {
 		// TODO: Why not defer?
 		ac.luapool.Shutdown()
 	})
 
+	// Close the databases that have been opened from Lua
+	AtShutdown(ac.dbs.Close)
+
 	// TODO: save repl history + close luapool + close logs ++ at shutdown
 
+	// Serve the control socket, for the admin subcommands
+	if ac.controlFilename != "" {
+		go func() {
+			if err := ac.ServeControl(); err != nil {
+				log.Error("Could not serve the control socket: ", err)
+			}
+		}()
+	}
+
+	// Serve the pprof endpoints, for profiling
+	if ac.pprofAddress != "" {
+		go func() {
+			if err := ac.ServePprof(); err != nil {
+				log.Error("Could not serve pprof: ", err)
+			}
+		}()
+	}
+
 	if ac.singleFileMode && filepath.Ext(ac.serverDirOrFilename) == ".lua" {
 		ac.luaServerFilename = ac.serverDirOrFilename
 		if ac.luaServerFilename == "index.lua" || ac.luaServerFilename == "data.lua" {
@@ -699,6 +1177,13 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 		fmt.Println(colorstring.Color(dashLineColor + repeat("-", 49) + "[reset]"))
 	}
 
+	// Run the application script, if present, so that the configuration
+	// scripts and handlers can call its functions
+	if err := ac.StartApp(); err != nil {
+		log.Errorf("Error in %s (interpreted as an application script):\n%s\n", ac.appFilename, err)
+		return err
+	}
+
 	// Read server configuration script, if present.
 	// The scripts may change global variables.
 	var ranConfigurationFilenames []string
@@ -754,6 +1239,20 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 		ac.RegisterHandlers(mux, "/", ac.serverDirOrFilename, ac.serverAddDomain)
 	}
 
+	// Set up the virtual hosts, if the configuration has a hosts table
+	hosts, err := ac.virtualHostMuxes()
+	if err != nil {
+		log.Errorf("Could not set up the virtual hosts:\n%s\n", err)
+		return err
+	}
+	ac.handler.SwapHosts(hosts)
+
+	// Check the configuration for risky settings
+	if err := ac.checkConfigurationFor(mux); err != nil {
+		log.Error(err)
+		return err
+	}
+
 	// Set the values that has not been set by flags nor scripts
 	// (and can be set by both)
 	ranServerReadyFunction := ac.finalConfiguration(ac.serverHost)
@@ -0,0 +1,19 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/xyproto/algernon/memdb"
+	"github.com/xyproto/datablock"
+)
+
+// newTestConfig returns a configuration with the default values and an
+// in-memory database backend, without handling the flags
+func newTestConfig() *Config {
+	ac := newConfig("Algernon", "Just a test")
+	ac.fs = datablock.NewFileStat(false, time.Minute)
+	ac.perm = memdb.NewPermissions(memdb.New())
+	ac.serverConfigurationFilenames = nil
+	ac.configCheck = configCheckOff
+	return ac
+}
@@ -0,0 +1,192 @@
+package engine
+
+// Checking the configuration for risky settings after the configuration
+// scripts have run, like admin pages that anyone can access, CORS that
+// allows all origins with credentials and serving the database file
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The modes for --configcheck
+const (
+	configCheckWarn   = "warn"   // log the risky settings
+	configCheckStrict = "strict" // refuse to start or reload
+	configCheckOff    = "off"    // do not check
+)
+
+// Parts of URL paths that are usually for administrators
+var adminPathParts = []string{"admin", "administrator", "dashboard", "manage", "management", "console", "wp-admin"}
+
+var (
+	errConfigCheck        = errors.New("--configcheck must be warn, strict or off")
+	errRiskyConfiguration = errors.New("the configuration has risky settings, and --configcheck=strict is given")
+)
+
+// isAdminPath checks if one of the parts of the URL path is usually for
+// administrators
+func isAdminPath(urlpath string) bool {
+	for _, part := range strings.Split(strings.ToLower(urlpath), "/") {
+		for _, adminPart := range adminPathParts {
+			if part == adminPart {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Routes returns the paths and descriptions of the routes for the given mux
+func (rt *routeTable) Routes(mux *http.ServeMux) map[string]string {
+	rt.mut.RLock()
+	defer rt.mut.RUnlock()
+	routes := make(map[string]string, len(rt.routes[mux]))
+	for handlePath, description := range rt.routes[mux] {
+		routes[handlePath] = description
+	}
+	return routes
+}
+
+// permissionPrefixes returns the path prefixes that require a user or an
+// administrator to be logged in, from the defaults and the protections that
+// have been added by the configuration scripts
+func (ac *Config) permissionPrefixes() []string {
+	if ac.perm == nil {
+		return nil
+	}
+	var prefixes []string
+	if !ac.clearDefaultPathPrefixes {
+		prefixes = append(append(prefixes, defaultAdminPathPrefixes...), defaultUserPathPrefixes...)
+	}
+	for _, protection := range ac.protections.Items() {
+		fields := strings.SplitN(protection, " ", 2)
+		switch {
+		case fields[0] == "clear":
+			prefixes = nil
+		case (fields[0] == "admin" || fields[0] == "user") && len(fields) == 2:
+			prefixes = append(prefixes, fields[1])
+		}
+	}
+	return prefixes
+}
+
+// protected checks if the URL path requires a login, a password, an API
+// key or an address that is allowed
+func (ac *Config) protected(mux *http.ServeMux, urlpath string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(urlpath, prefix) {
+			return true
+		}
+	}
+	if _, ok := ac.basicAuth.Get(mux, urlpath); ok {
+		return true
+	}
+	if _, ok := ac.apiKeys.Get(mux, urlpath); ok {
+		return true
+	}
+	for _, rule := range ac.ipRules.Matching(mux, urlpath) {
+		if rule.allow {
+			return true
+		}
+	}
+	return false
+}
+
+// inDirectory checks if the file is in the directory, or in a directory below
+func inDirectory(dir, filename string) bool {
+	if dir == "" || filename == "" {
+		return false
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	absFilename, err := filepath.Abs(filename)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absFilename)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkConfiguration returns the risky settings for the given mux, as
+// sorted lines
+func (ac *Config) checkConfiguration(mux *http.ServeMux) []string {
+	var (
+		findings []string
+		prefixes = ac.permissionPrefixes()
+		routes   = ac.routes.Routes(mux)
+	)
+
+	// The files that must not be served
+	secrets := map[string]string{}
+	if ac.useBolt && ac.fs.Exists(ac.boltFilename) {
+		secrets[ac.boltFilename] = "the database file"
+	}
+	if ac.fs.Exists(ac.serverKey) {
+		secrets[ac.serverKey] = "the TLS key"
+	}
+
+	for handlePath, description := range routes {
+		paths := []string{handlePath}
+		if strings.HasPrefix(description, "directory ") {
+			servedir := strings.TrimPrefix(description, "directory ")
+			// Directories in the served directory are routes too
+			if infos, err := ioutil.ReadDir(servedir); err == nil {
+				for _, info := range infos {
+					if info.IsDir() {
+						paths = append(paths, path.Join(handlePath, info.Name())+"/")
+					}
+				}
+			}
+			for filename, what := range secrets {
+				if inDirectory(servedir, filename) {
+					findings = append(findings, handlePath+" serves "+what+", "+filename)
+				}
+			}
+		}
+		for _, urlpath := range paths {
+			if isAdminPath(urlpath) && !ac.protected(mux, urlpath, prefixes) {
+				findings = append(findings, urlpath+" looks like an admin page, but anyone can access it")
+			}
+		}
+	}
+
+	for _, rule := range ac.cors.Rules(mux) {
+		if rule.wildcardCredentials || (rule.credentials && rule.origins["null"]) {
+			findings = append(findings, "CORS for "+rule.prefix+" allows all origins with credentials")
+		}
+	}
+
+	sort.Strings(findings)
+	return unique(findings)
+}
+
+// checkConfigurationFor checks the configuration for the given mux, and
+// logs the risky settings. Returns an error if there are risky settings and
+// --configcheck=strict is given.
+func (ac *Config) checkConfigurationFor(mux *http.ServeMux) error {
+	switch ac.configCheck {
+	case configCheckOff:
+		return nil
+	case configCheckWarn, configCheckStrict:
+	default:
+		return errConfigCheck
+	}
+	findings := ac.checkConfiguration(mux)
+	for _, finding := range findings {
+		log.Warn("Risky configuration: " + finding)
+	}
+	if len(findings) > 0 && ac.configCheck == configCheckStrict {
+		return errRiskyConfiguration
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package engine
+
+// Limits for the connections to the HTTP servers, per IP address and in
+// total, with --maxconns, --maxconnsperip and --connrate. The limits are
+// checked when accepting connections, before any request is read, so the
+// client behind a reverse proxy is not known. Connections from the trusted
+// proxies, and over the Unix socket, are only counted in the total.
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How many IP addresses to keep track of, before the idle ones are removed
+const maxConnClients = 10000
+
+// connClient is the number of open connections from an IP address, and a
+// token bucket for new connections
+type connClient struct {
+	open   int
+	tokens float64
+	last   time.Time
+}
+
+// connLimiter keeps track of the connections, for all the listeners
+type connLimiter struct {
+	max      int            // the largest number of open connections in total, or 0
+	maxPerIP int            // the largest number of open connections per IP address, or 0
+	rate     float64        // new connections per second per IP address, or 0
+	trusted  trustedProxies // not limited per IP address
+
+	slots chan struct{} // one element per open connection, if max > 0
+
+	mut     sync.Mutex
+	clients map[string]*connClient
+
+	open     int64  // atomic
+	rejected uint64 // atomic
+}
+
+// newConnLimiter returns a connLimiter, or nil if there are no limits
+func newConnLimiter(max, maxPerIP int, rate float64, trusted trustedProxies) *connLimiter {
+	if max <= 0 && maxPerIP <= 0 && rate <= 0 {
+		return nil
+	}
+	cl := &connLimiter{max: max, maxPerIP: maxPerIP, rate: rate, trusted: trusted, clients: make(map[string]*connClient)}
+	if max > 0 {
+		cl.slots = make(chan struct{}, max)
+	}
+	return cl
+}
+
+// allow checks if a new connection from the given IP address is allowed,
+// and counts it if it is. Connections without an IP address, like over the
+// Unix socket, and from trusted proxies, are always allowed, since they are
+// for many clients.
+func (cl *connLimiter) allow(ip string, now time.Time) bool {
+	if (cl.maxPerIP <= 0 && cl.rate <= 0) || ip == "" || cl.trusted.trusts(ip) {
+		return true
+	}
+	cl.mut.Lock()
+	defer cl.mut.Unlock()
+	c, ok := cl.clients[ip]
+	if !ok {
+		if len(cl.clients) >= maxConnClients {
+			cl.removeIdle(now)
+		}
+		c = &connClient{tokens: cl.rate, last: now}
+		cl.clients[ip] = c
+	}
+	if cl.maxPerIP > 0 && c.open >= cl.maxPerIP {
+		return false
+	}
+	if cl.rate > 0 {
+		// Up to one second of new connections can be made at once
+		c.tokens += now.Sub(c.last).Seconds() * cl.rate
+		if c.tokens > cl.rate {
+			c.tokens = cl.rate
+		}
+		c.last = now
+		if c.tokens < 1 {
+			return false
+		}
+		c.tokens--
+	}
+	c.open++
+	return true
+}
+
+// removeIdle removes the IP addresses that have no open connections and
+// that have refilled their token buckets
+func (cl *connLimiter) removeIdle(now time.Time) {
+	for ip, c := range cl.clients {
+		if c.open == 0 && (cl.rate <= 0 || c.tokens+now.Sub(c.last).Seconds()*cl.rate >= cl.rate) {
+			delete(cl.clients, ip)
+		}
+	}
+}
+
+// done is called when a connection from the given IP address is closed
+func (cl *connLimiter) done(ip string) {
+	atomic.AddInt64(&cl.open, -1)
+	if cl.maxPerIP > 0 || cl.rate > 0 {
+		cl.mut.Lock()
+		if c, ok := cl.clients[ip]; ok && c.open > 0 {
+			c.open--
+		}
+		cl.mut.Unlock()
+	}
+	if cl.slots != nil {
+		<-cl.slots
+	}
+}
+
+// Lines returns the metrics for the connections
+func (cl *connLimiter) Lines() []string {
+	if cl == nil {
+		return nil
+	}
+	return []string{
+		"connections_open " + strconv.FormatInt(atomic.LoadInt64(&cl.open), 10),
+		"connections_rejected_total " + strconv.FormatUint(atomic.LoadUint64(&cl.rejected), 10),
+	}
+}
+
+// limitListener is a listener where the connections are limited
+type limitListener struct {
+	net.Listener
+	cl *connLimiter
+}
+
+// Accept waits until there is room for another connection, if the total
+// number is limited, and closes the connections from IP addresses that
+// are over the limits right away
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		if l.cl.slots != nil {
+			l.cl.slots <- struct{}{}
+		}
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if l.cl.slots != nil {
+				<-l.cl.slots
+			}
+			return nil, err
+		}
+		ip, _, splitErr := net.SplitHostPort(conn.RemoteAddr().String())
+		if splitErr != nil || net.ParseIP(ip) == nil {
+			ip = ""
+		}
+		if l.cl.allow(ip, time.Now()) {
+			atomic.AddInt64(&l.cl.open, 1)
+			return &limitConn{Conn: conn, cl: l.cl, ip: ip}, nil
+		}
+		if atomic.AddUint64(&l.cl.rejected, 1)%1000 == 1 {
+			log.Warn("Rejecting connections from " + ip + ", that is over the connection limits")
+		}
+		conn.Close()
+		if l.cl.slots != nil {
+			<-l.cl.slots
+		}
+	}
+}
+
+// limitConn is a connection that is counted until it is closed
+type limitConn struct {
+	net.Conn
+	cl   *connLimiter
+	ip   string
+	once sync.Once
+}
+
+// Close closes the connection, and makes room for another one
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.cl.done(c.ip)
+	})
+	return err
+}
+
+// limitConnections returns a listener with the connection limits, if any
+func (ac *Config) limitConnections(l net.Listener) net.Listener {
+	if ac.connLimiter == nil {
+		return l
+	}
+	return &limitListener{Listener: l, cl: ac.connLimiter}
+}
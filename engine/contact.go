@@ -0,0 +1,119 @@
+package engine
+
+// QR codes and vCards, for contact pages, tickets and setting up two-factor
+// authentication
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/xyproto/algernon/qrcode"
+	"github.com/xyproto/algernon/vcard"
+	"github.com/xyproto/gopher-lua"
+)
+
+// The default width and height of QR codes, in pixels
+const defaultQRCodeSize = 256
+
+// qrLevels are the names of the error correction levels
+var qrLevels = map[string]qrcode.Level{
+	"low":      qrcode.Low,
+	"medium":   qrcode.Medium,
+	"quartile": qrcode.Quartile,
+	"high":     qrcode.High,
+}
+
+// checkQRCode makes a PNG image with a QR code from the Lua arguments: the
+// text, an optional size in pixels and an optional error correction level
+func checkQRCode(L *lua.LState) ([]byte, error) {
+	text := L.CheckString(1)
+	size := L.OptInt(2, defaultQRCodeSize)
+	level, ok := qrLevels[strings.ToLower(L.OptString(3, "medium"))]
+	if !ok {
+		L.ArgError(3, "low, medium, quartile or high expected")
+	}
+	c, err := qrcode.Encode([]byte(text), level)
+	if err != nil {
+		return nil, err
+	}
+	return c.PNG(size)
+}
+
+// checkVCard makes a vCard from the fields in a Lua table
+func checkVCard(L *lua.LState, n int) []byte {
+	fields := tableToHeaders(L.CheckTable(n))
+	c := &vcard.Card{
+		Name:       fields["name"],
+		FirstName:  fields["firstname"],
+		LastName:   fields["lastname"],
+		Org:        fields["org"],
+		Title:      fields["title"],
+		Phone:      fields["phone"],
+		Mobile:     fields["mobile"],
+		Email:      fields["email"],
+		URL:        fields["url"],
+		Street:     fields["street"],
+		City:       fields["city"],
+		Region:     fields["region"],
+		PostalCode: fields["postalcode"],
+		Country:    fields["country"],
+		Birthday:   fields["birthday"],
+		Note:       fields["note"],
+	}
+	return c.Bytes()
+}
+
+// LoadContactFunctions makes functions for QR codes and vCards available
+// to Lua scripts
+func (ac *Config) LoadContactFunctions(w http.ResponseWriter, L *lua.LState) {
+
+	// Make a QR code. Takes a text, an optional size in pixels and an
+	// optional error correction level ("low", "medium", "quartile" or
+	// "high"). Returns a PNG image, or nil and an error message.
+	L.SetGlobal("QRCodePNG", L.NewFunction(func(L *lua.LState) int {
+		data, err := checkQRCode(L)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(data))
+		return 1 // number of results
+	}))
+
+	// Make a QR code and write it to the response, as a PNG image. Takes
+	// the same arguments as QRCodePNG. Returns true if successful.
+	L.SetGlobal("ServeQRCode", L.NewFunction(func(L *lua.LState) int {
+		data, err := checkQRCode(L)
+		if err != nil {
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, err = w.Write(data)
+		L.Push(lua.LBool(err == nil))
+		return 1 // number of results
+	}))
+
+	// Make a vCard. Takes a table with name, firstname, lastname, org,
+	// title, phone, mobile, email, url, street, city, region, postalcode,
+	// country, birthday and note. Returns the vCard as a string.
+	L.SetGlobal("VCard", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(checkVCard(L, 1)))
+		return 1 // number of results
+	}))
+
+	// Make a vCard and write it to the response, as a file that can be
+	// imported. Takes the same table as VCard and an optional filename.
+	// Returns true if successful.
+	L.SetGlobal("ServeVCard", L.NewFunction(func(L *lua.LState) int {
+		data := checkVCard(L, 1)
+		filename := strings.Replace(L.OptString(2, "contact.vcf"), `"`, "", -1)
+		w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+		_, err := w.Write(data)
+		L.Push(lua.LBool(err == nil))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,134 @@
+package engine
+
+// Content-addressable storage for uploaded files, where each file is stored
+// once, by the hash of the contents, and served from an URL that never
+// changes, so that it can be cached forever
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/xyproto/algernon/contentstore"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/algernon/lua/upload"
+	"github.com/xyproto/gopher-lua"
+)
+
+// The path that stored content is served from
+const contentPath = "/_content/"
+
+var errNoContentDir = errors.New("no directory for stored content, use --contentdir")
+
+// ContentURL returns the URL for stored content with the given hash
+func (ac *Config) ContentURL(hash string) string {
+	return ac.PrefixURL(contentPath + hash)
+}
+
+// serveContent serves stored content, if the request is for it. The content
+// is served so that scripts in uploaded HTML can not run on this site.
+// Returns true if the request has been handled.
+func (ac *Config) serveContent(w http.ResponseWriter, req *http.Request) bool {
+	if ac.content == nil || !strings.HasPrefix(req.URL.Path, contentPath) {
+		return false
+	}
+	hash := strings.TrimPrefix(req.URL.Path, contentPath)
+	filename, err := ac.content.Path(hash)
+	if err == nil {
+		var f *os.File
+		if f, err = os.Open(filename); err == nil {
+			defer f.Close()
+			var fi os.FileInfo
+			if fi, err = f.Stat(); err == nil {
+				header := w.Header()
+				header.Set("Cache-Control", "public, max-age=31536000, immutable")
+				header.Set("ETag", `"`+hash+`"`)
+				header.Set("X-Content-Type-Options", "nosniff")
+				header.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+				http.ServeContent(w, req, "", fi.ModTime(), f)
+				ac.LogAccess(req, http.StatusOK, fi.Size())
+				return true
+			}
+		}
+	}
+	size := ac.ErrorPage(w, req, httperror.New(http.StatusNotFound, "No such content."))
+	ac.LogAccess(req, http.StatusNotFound, size)
+	return true
+}
+
+// pushStored pushes the hash of stored content, or nil and an error message
+func pushStored(L *lua.LState, hash string, err error) int {
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(lua.LString(hash))
+	return 1 // number of results
+}
+
+// LoadContentFunctions makes functions for storing content by hash available
+// to Lua scripts. Must be loaded after the UploadedFile class.
+func (ac *Config) LoadContentFunctions(L *lua.LState) {
+
+	store := func(data []byte) (string, error) {
+		if ac.content == nil {
+			return "", errNoContentDir
+		}
+		return ac.content.Put(data)
+	}
+
+	// Store the given string, if it is not already stored, and add a
+	// reference to it. Returns the hash, or nil and an error message.
+	L.SetGlobal("StoreContent", L.NewFunction(func(L *lua.LState) int {
+		data := []byte(L.CheckString(1))
+		// Uploaded files have already been scanned, but this data may not be
+		if err := ac.ScanUpload("content", data); err != nil {
+			return pushStored(L, "", err)
+		}
+		hash, err := store(data)
+		return pushStored(L, hash, err)
+	}))
+
+	// Remove a reference to stored content. The content is removed when
+	// there are no references left. Takes a hash. Returns the number of
+	// references that are left, or nil and an error message.
+	L.SetGlobal("ReleaseContent", L.NewFunction(func(L *lua.LState) int {
+		if ac.content == nil {
+			return pushStored(L, "", errNoContentDir)
+		}
+		n, err := ac.content.Release(L.CheckString(1))
+		if err != nil {
+			return pushStored(L, "", err)
+		}
+		L.Push(lua.LNumber(n))
+		return 1 // number of results
+	}))
+
+	// Get the URL for stored content. Takes a hash. Returns an URL that
+	// always serves the same content, or nil and an error message.
+	L.SetGlobal("ContentURL", L.NewFunction(func(L *lua.LState) int {
+		hash := L.CheckString(1)
+		if !contentstore.ValidHash(hash) {
+			return pushStored(L, "", contentstore.ErrInvalidHash)
+		}
+		L.Push(lua.LString(ac.ContentURL(hash)))
+		return 1 // number of results
+	}))
+
+	// Store an uploaded file, without writing it to a file. Returns the
+	// hash, or nil and an error message.
+	if mt, ok := L.GetTypeMetatable(upload.Class).(*lua.LTable); ok {
+		mt.RawSetString("store", L.NewFunction(func(L *lua.LState) int {
+			ud := L.CheckUserData(1)
+			ulf, ok := ud.Value.(*upload.UploadedFile)
+			if !ok {
+				L.ArgError(1, "UploadedFile expected")
+				return 0 // number of results
+			}
+			hash, err := store(ulf.Bytes())
+			return pushStored(L, hash, err)
+		}))
+	}
+}
@@ -0,0 +1,381 @@
+package engine
+
+// The control socket makes it possible to inspect and manage a running
+// Algernon instance from the command line, without using the web interface.
+// It can also be used by admin pages and orchestration tools, since all
+// responses are JSON.
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/platformdep"
+	"github.com/xyproto/pinterface"
+)
+
+var (
+	errNoDatabase   = errors.New("no database backend is in use")
+	errUnknownType  = errors.New("unknown data structure type, use one of: kv, hash, set, list")
+	errMissingName  = errors.New("missing data structure name")
+	errMissingKey   = errors.New("missing key")
+	errNoUsername   = errors.New("missing username")
+	errCacheMissing = errors.New("caching is disabled")
+	errUnauthorized = errors.New("invalid or missing control token")
+	errPostRequired = errors.New("this action requires a POST request")
+	errNotLoopback  = errors.New("the control API can only listen on a loopback address")
+	errNeedToken    = errors.New("a control token is required when the control API listens on a TCP port, use --ctltoken")
+	errNotSocket    = errors.New("the control socket filename is in use by a file that is not a socket")
+)
+
+// controlAddress returns the network and address for the control socket.
+// "localhost:PORT" or ":PORT" listens on TCP, on the loopback interface.
+// Anything else is interpreted as a Unix socket filename.
+func controlAddress(s string) (string, string) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || strings.ContainsAny(s, `/\`) {
+		return "unix", s
+	}
+	if host == "" || host == "localhost" {
+		host = "127.0.0.1"
+	}
+	return "tcp", net.JoinHostPort(host, port)
+}
+
+// controlResponse is the JSON structure that is returned by the control socket
+type controlResponse struct {
+	Values  []string `json:"values,omitempty"`
+	Message string   `json:"message,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// writeControlResponse writes a control response as JSON, with a status code
+// that depends on if an error is given or not
+func writeControlResponse(w http.ResponseWriter, values []string, message string, err error) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	resp := controlResponse{Values: values, Message: message}
+	if err != nil {
+		resp.Error = err.Error()
+		switch err {
+		case errUnauthorized:
+			w.WriteHeader(http.StatusUnauthorized)
+		case errPostRequired:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}
+	if encodeErr := json.NewEncoder(w).Encode(resp); encodeErr != nil {
+		log.Error(encodeErr)
+	}
+}
+
+// dataValues retrieves values from one of the database-backed data structures.
+// kind is "kv", "hash", "set" or "list". For hash maps, the name can be given
+// on the form NAME:OWNER.
+func (ac *Config) dataValues(kind, name, owner, key string) ([]string, error) {
+	if ac.perm == nil {
+		return nil, errNoDatabase
+	}
+	if name == "" {
+		return nil, errMissingName
+	}
+	creator := ac.perm.UserState().Creator()
+	switch kind {
+	case "kv", "keyvalue":
+		if owner == "" {
+			return nil, errMissingKey
+		}
+		kv, err := creator.NewKeyValue(name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := kv.Get(owner)
+		if err != nil {
+			return nil, err
+		}
+		return []string{value}, nil
+	case "hash", "hashmap":
+		if owner == "" && strings.Contains(name, ":") {
+			fields := strings.SplitN(name, ":", 2)
+			name, owner = fields[0], fields[1]
+		}
+		hash, err := creator.NewHashMap(name)
+		if err != nil {
+			return nil, err
+		}
+		return hashValues(hash, owner, key)
+	case "set":
+		set, err := creator.NewSet(name)
+		if err != nil {
+			return nil, err
+		}
+		return set.All()
+	case "list":
+		list, err := creator.NewList(name)
+		if err != nil {
+			return nil, err
+		}
+		return list.All()
+	}
+	return nil, errUnknownType
+}
+
+// hashValues returns all owners if no owner is given, all "key=value" pairs
+// if no key is given, or else the value for the given owner and key.
+func hashValues(hash pinterface.IHashMap, owner, key string) ([]string, error) {
+	if owner == "" {
+		return hash.All()
+	}
+	if key != "" {
+		value, err := hash.Get(owner, key)
+		if err != nil {
+			return nil, err
+		}
+		return []string{value}, nil
+	}
+	keys, err := hash.Keys(owner)
+	if err != nil {
+		return nil, err
+	}
+	var pairs []string
+	for _, k := range keys {
+		value, err := hash.Get(owner, k)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, k+"="+value)
+	}
+	return pairs, nil
+}
+
+// reloadMessage summarizes a reload that happened at the given time
+func reloadMessage(diff []string, when time.Time) string {
+	if len(diff) == 0 {
+		return "Reloaded at " + when.Format(time.RFC3339) + ", with no changes"
+	}
+	return "Reloaded at " + when.Format(time.RFC3339) + ", with " + strconv.Itoa(len(diff)) + " change(s)"
+}
+
+// controlMux returns a mux with the handlers for the control socket
+func (ac *Config) controlMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Retrieve values from a data structure
+	mux.HandleFunc("/data", func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		values, err := ac.dataValues(q.Get("type"), q.Get("name"), q.Get("owner"), q.Get("key"))
+		writeControlResponse(w, values, "", err)
+	})
+
+	// List all users
+	mux.HandleFunc("/users", func(w http.ResponseWriter, req *http.Request) {
+		if ac.perm == nil {
+			writeControlResponse(w, nil, "", errNoDatabase)
+			return
+		}
+		usernames, err := ac.perm.UserState().AllUsernames()
+		writeControlResponse(w, usernames, "", err)
+	})
+
+	// List the sessions of a user, one line per session
+	mux.HandleFunc("/users/sessions", func(w http.ResponseWriter, req *http.Request) {
+		username := req.URL.Query().Get("username")
+		if ac.perm == nil {
+			writeControlResponse(w, nil, "", errNoDatabase)
+			return
+		} else if username == "" {
+			writeControlResponse(w, nil, "", errNoUsername)
+			return
+		}
+		sessions, err := ac.ActiveSessions(username)
+		var values []string
+		for _, s := range sessions {
+			values = append(values, s.ID+" "+s.IP+" "+time.Unix(s.LastSeen, 0).Format(time.RFC3339)+" "+s.UserAgent)
+		}
+		writeControlResponse(w, values, "", err)
+	})
+
+	// Log out a user from every browser
+	mux.HandleFunc("/users/logout", func(w http.ResponseWriter, req *http.Request) {
+		username := req.URL.Query().Get("username")
+		if req.Method != http.MethodPost {
+			writeControlResponse(w, nil, "", errPostRequired)
+			return
+		} else if ac.perm == nil {
+			writeControlResponse(w, nil, "", errNoDatabase)
+			return
+		} else if username == "" {
+			writeControlResponse(w, nil, "", errNoUsername)
+			return
+		}
+		err := ac.LogoutEverywhere(username)
+		writeControlResponse(w, nil, "Logged out "+username+" everywhere", err)
+	})
+
+	// Purge the file cache
+	mux.HandleFunc("/cache/purge", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			writeControlResponse(w, nil, "", errPostRequired)
+			return
+		}
+		if ac.cache == nil || ac.cacheSize == 0 {
+			writeControlResponse(w, nil, "", errCacheMissing)
+			return
+		}
+		pattern := req.URL.Query().Get("pattern")
+		if pattern == "" {
+			ac.clearCaches()
+			writeControlResponse(w, nil, "Cache cleared", nil)
+			return
+		}
+		purged := ac.PurgeCache(pattern)
+		writeControlResponse(w, nil, "Purged "+strconv.Itoa(purged)+" files matching "+pattern+" from the cache", nil)
+	})
+
+	// Run the server configuration again and replace all handlers
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			writeControlResponse(w, nil, "", errPostRequired)
+			return
+		}
+		diff, err := ac.Reload()
+		if err != nil {
+			writeControlResponse(w, nil, "", err)
+			return
+		}
+		log.Info("Reloaded the server configuration")
+		for _, line := range diff {
+			log.Info("Reload: " + line)
+		}
+		writeControlResponse(w, diff, reloadMessage(diff, time.Now()), nil)
+	})
+
+	// Show what changed at the last reload
+	mux.HandleFunc("/reload/diff", func(w http.ResponseWriter, req *http.Request) {
+		diff, when := ac.lastReload.Get()
+		if when.IsZero() {
+			writeControlResponse(w, nil, "The server has not been reloaded", nil)
+			return
+		}
+		writeControlResponse(w, diff, reloadMessage(diff, when), nil)
+	})
+
+	// Show or toggle maintenance mode
+	mux.HandleFunc("/maintenance", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			enabled, err := strconv.ParseBool(req.URL.Query().Get("enabled"))
+			if err != nil {
+				writeControlResponse(w, nil, "", err)
+				return
+			}
+			ac.handler.SetMaintenance(enabled)
+			log.Info("Maintenance mode: " + strconv.FormatBool(enabled))
+		}
+		if ac.handler.Maintenance() {
+			writeControlResponse(w, nil, "Maintenance mode is on", nil)
+			return
+		}
+		writeControlResponse(w, nil, "Maintenance mode is off", nil)
+	})
+
+	// Dump the server metrics
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		writeControlResponse(w, ac.metricLines(), "", nil)
+	})
+
+	// List the routes of the current handlers
+	mux.HandleFunc("/routes", func(w http.ResponseWriter, req *http.Request) {
+		lines := ac.routes.Lines(ac.handler.Mux())
+		hosts := ac.handler.Hosts()
+		for _, name := range hosts.names() {
+			for _, line := range ac.routes.Lines(hosts[name].mux) {
+				lines = append(lines, name+" "+line)
+			}
+		}
+		writeControlResponse(w, lines, "", nil)
+	})
+
+	return mux
+}
+
+// controlAuth wraps the given handler, and only lets requests through if
+// they have the configured control token as a bearer token
+func (ac *Config) controlAuth(next http.Handler) http.Handler {
+	if ac.controlToken == "" {
+		return next
+	}
+	expected := []byte("Bearer " + ac.controlToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		given := []byte(req.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(given, expected) != 1 {
+			writeControlResponse(w, nil, "", errUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// ServeControl serves the control socket at the configured filename, or at
+// the configured localhost address. A Unix socket is removed when the
+// server shuts down.
+func (ac *Config) ServeControl() error {
+	network, address := controlAddress(ac.controlFilename)
+	if network == "tcp" {
+		host, _, _ := net.SplitHostPort(address)
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return errNotLoopback
+		}
+		if ac.controlToken == "" {
+			return errNeedToken
+		}
+	} else if fi, err := os.Lstat(address); err == nil {
+		// Remove any leftover socket from a previous run, but nothing else
+		if fi.Mode()&os.ModeSocket == 0 {
+			return errNotSocket
+		}
+		if err := os.Remove(address); err != nil {
+			return err
+		}
+	}
+	var (
+		listener net.Listener
+		err      error
+	)
+	if network == "unix" {
+		// Only the current user should be able to control the server, also
+		// before the permissions of the socket are set below
+		mask := platformdep.Umask(0077)
+		listener, err = net.Listen(network, address)
+		platformdep.Umask(mask)
+	} else {
+		listener, err = net.Listen(network, address)
+	}
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		if err := os.Chmod(address, 0600); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	AtShutdown(func() {
+		listener.Close()
+		// The socket is in use by the new process, if restarted
+		if network == "unix" && !ac.listeners.HandedOver() {
+			os.Remove(address)
+		}
+	})
+	if ac.verboseMode {
+		log.Info("Serving the control API at " + address)
+	}
+	return http.Serve(listener, ac.controlAuth(ac.controlMux()))
+}
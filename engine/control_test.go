@@ -0,0 +1,21 @@
+package engine
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeControlNotSocket(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "algernon.sock")
+	if err := ioutil.WriteFile(filename, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ac := &Config{controlFilename: filename}
+	if err := ac.ServeControl(); err != errNotSocket {
+		t.Errorf("expected %q, got %v", errNotSocket, err)
+	}
+	if data, err := ioutil.ReadFile(filename); err != nil || string(data) != "data" {
+		t.Errorf("the file was changed: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,146 @@
+package engine
+
+// Cross-origin resource sharing, where the server configuration decides
+// which other sites may send requests to a path prefix
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/gopher-lua"
+)
+
+// The methods that are allowed by default
+const defaultCORSMethods = "GET, HEAD, POST"
+
+// corsRule sets the CORS headers for paths that start with the prefix
+type corsRule struct {
+	prefix      string
+	origins     map[string]bool // nil if all origins are allowed
+	methods     string
+	headers     string
+	expose      string
+	credentials bool
+	maxAge      int
+
+	// Credentials were asked for, but all origins are allowed
+	wildcardCredentials bool
+}
+
+// pathPrefix returns the path prefix that the rule is for
+func (rule corsRule) pathPrefix() string {
+	return rule.prefix
+}
+
+// corsTable keeps the CORS rules for each mux
+type corsTable = prefixTable[corsRule]
+
+// handleCORS sets the CORS headers for requests from allowed origins, and
+// responds to preflight requests. Returns true if the request has been
+// handled.
+func (ac *Config) handleCORS(mux *http.ServeMux, w http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	rule, ok := ac.cors.Get(mux, req.URL.Path)
+	if !ok {
+		return false
+	}
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	if rule.origins != nil && !rule.origins[origin] {
+		// Not allowed. The browser blocks the response, since the headers are missing.
+		return false
+	}
+	if rule.origins == nil {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if rule.credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	requestedMethod := req.Header.Get("Access-Control-Request-Method")
+	if req.Method != http.MethodOptions || requestedMethod == "" {
+		if rule.expose != "" {
+			header.Set("Access-Control-Expose-Headers", rule.expose)
+		}
+		return false
+	}
+	// Respond to the preflight request
+	header.Set("Access-Control-Allow-Methods", rule.methods)
+	if rule.headers != "" {
+		header.Set("Access-Control-Allow-Headers", rule.headers)
+	} else if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		header.Set("Access-Control-Allow-Headers", requested)
+	}
+	if rule.maxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(rule.maxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	ac.LogAccess(req, http.StatusNoContent, 0)
+	return true
+}
+
+// corsList returns a string or a list of strings from a Lua table field,
+// joined with ", "
+func corsList(t *lua.LTable, field string) string {
+	switch v := t.RawGetString(field).(type) {
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		var values []string
+		v.ForEach(func(_, value lua.LValue) {
+			values = append(values, value.String())
+		})
+		return strings.Join(values, ", ")
+	}
+	return ""
+}
+
+// LoadCORSFunctions makes the CORS function available to server
+// configuration scripts
+func (ac *Config) LoadCORSFunctions(L *lua.LState, mux *http.ServeMux) {
+
+	// Allow requests from other sites to a path prefix. Takes a path prefix
+	// and a table with origins ("*" or a list), methods, headers, expose,
+	// credentials (a boolean) and maxage (in seconds). Also responds to
+	// preflight requests. Returns true.
+	L.SetGlobal("CORS", L.NewFunction(func(L *lua.LState) int {
+		rule := corsRule{prefix: L.CheckString(1), methods: defaultCORSMethods}
+		options := L.OptTable(2, L.NewTable())
+		if origins, ok := options.RawGetString("origins").(*lua.LTable); ok {
+			rule.origins = make(map[string]bool)
+			origins.ForEach(func(_, value lua.LValue) {
+				rule.origins[strings.TrimSuffix(value.String(), "/")] = true
+			})
+			if rule.origins["*"] {
+				// A list with "*" allows all origins, just like "*"
+				rule.origins = nil
+			}
+		} else if origin, ok := options.RawGetString("origins").(lua.LString); ok && string(origin) != "*" {
+			rule.origins = map[string]bool{strings.TrimSuffix(string(origin), "/"): true}
+		}
+		if methods := corsList(options, "methods"); methods != "" {
+			rule.methods = strings.ToUpper(methods)
+		}
+		rule.headers = corsList(options, "headers")
+		rule.expose = corsList(options, "expose")
+		rule.credentials = lua.LVAsBool(options.RawGetString("credentials"))
+		if maxAge, ok := options.RawGetString("maxage").(lua.LNumber); ok {
+			rule.maxAge = int(maxAge)
+		}
+		if rule.credentials && rule.origins == nil {
+			// Browsers do not send cookies to sites that allow all origins
+			log.Warn("CORS for " + rule.prefix + ": credentials are only allowed for a list of origins")
+			rule.credentials = false
+			rule.wildcardCredentials = true
+		}
+		ac.cors.Add(mux, rule)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,39 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestCORSWildcardList(t *testing.T) {
+	ac := newTestConfig()
+	mux := http.NewServeMux()
+	L := lua.NewState()
+	defer L.Close()
+	ac.LoadCORSFunctions(L, mux)
+	if err := L.DoString(`CORS("/api/", { origins = { "*" }, credentials = true })`); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/users", nil)
+	req.Header.Set("Origin", "https://example.com")
+	rec := httptest.NewRecorder()
+	ac.handleCORS(mux, rec, req)
+	if origin := rec.Header().Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("expected all origins to be allowed, got %q", origin)
+	}
+	if rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Error("credentials were allowed for all origins")
+	}
+
+	found := false
+	for _, finding := range ac.checkConfiguration(mux) {
+		found = found || finding == "CORS for /api/ allows all origins with credentials"
+	}
+	if !found {
+		t.Error("expected the configuration check to find the credentials for all origins")
+	}
+}
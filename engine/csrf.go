@@ -0,0 +1,217 @@
+package engine
+
+// Tokens for protecting forms against cross-site request forgery. A token is
+// tied to a random cookie and to the session cookie, if the user is logged in,
+// and is checked for POST, PUT, PATCH and DELETE requests to protected paths.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"html"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/gopher-lua"
+)
+
+const (
+	// The name of the cookie that CSRF tokens are tied to
+	csrfCookieName = "csrf"
+
+	// Where the CSRF token is found in requests
+	csrfFieldName  = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+
+	// Where the secret for the CSRF tokens is stored, in the database backend
+	csrfKeyValue = "csrf"
+)
+
+// csrfRule requires a CSRF token for paths that start with the prefix. The
+// handler is used for responding to requests that are rejected, if not nil.
+type csrfRule struct {
+	prefix  string
+	handler http.Handler
+}
+
+// pathPrefix returns the path prefix that the rule is for
+func (rule csrfRule) pathPrefix() string {
+	return rule.prefix
+}
+
+// csrfTable keeps the CSRF rules for each mux, and the secret that the
+// tokens are signed with
+type csrfTable struct {
+	prefixTable[csrfRule]
+	once   sync.Once
+	secret []byte
+}
+
+// csrfSecret returns the secret that the CSRF tokens are signed with. The
+// secret is kept in the database backend, if there is one, so that tokens
+// are still valid after a restart and across servers.
+func (ac *Config) csrfSecret() []byte {
+	ac.csrf.once.Do(func() {
+		secret := randomToken()
+		if ac.perm != nil {
+			if kv, err := ac.perm.UserState().Creator().NewKeyValue(csrfKeyValue); err == nil {
+				if stored, err := kv.Get("secret"); err == nil && stored != "" {
+					secret = stored
+				} else if err := kv.Set("secret", secret); err != nil {
+					log.Error("Could not store the CSRF secret: ", err)
+				}
+			}
+		}
+		ac.csrf.secret = []byte(secret)
+	})
+	return ac.csrf.secret
+}
+
+// csrfTokenFor returns the CSRF token for the given value of the CSRF
+// cookie, for the current session
+func (ac *Config) csrfTokenFor(req *http.Request, cookieValue string) string {
+	session := ""
+	if c, err := req.Cookie(sessionCookieName); err == nil {
+		session = c.Value
+	}
+	mac := hmac.New(sha256.New, ac.csrfSecret())
+	mac.Write([]byte(cookieValue + "|" + session))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CSRFToken returns the CSRF token for the current browser, and sets the
+// CSRF cookie if it is missing
+func (ac *Config) CSRFToken(w http.ResponseWriter, req *http.Request) string {
+	if c, err := req.Cookie(csrfCookieName); err == nil && c.Value != "" {
+		return ac.csrfTokenFor(req, c.Value)
+	}
+	value := randomToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    value,
+		Path:     "/",
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return ac.csrfTokenFor(req, value)
+}
+
+// validCSRFToken checks the token in the X-CSRF-Token header or in the
+// csrf_token form field
+func (ac *Config) validCSRFToken(req *http.Request) bool {
+	c, err := req.Cookie(csrfCookieName)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	token := req.Header.Get(csrfHeaderName)
+	if token == "" {
+		token = req.FormValue(csrfFieldName)
+	}
+	return token != "" && hmac.Equal([]byte(token), []byte(ac.csrfTokenFor(req, c.Value)))
+}
+
+// forbiddenWriter responds with "403 Forbidden" instead of "200 OK"
+type forbiddenWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+// WriteHeader writes the status code, where 200 is replaced with 403
+func (fw *forbiddenWriter) WriteHeader(statusCode int) {
+	if fw.wroteHeader {
+		return
+	}
+	fw.wroteHeader = true
+	if statusCode == http.StatusOK {
+		statusCode = http.StatusForbidden
+	}
+	fw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write writes the body, after writing the status code if needed
+func (fw *forbiddenWriter) Write(b []byte) (int, error) {
+	if !fw.wroteHeader {
+		fw.WriteHeader(http.StatusForbidden)
+	}
+	return fw.ResponseWriter.Write(b)
+}
+
+// csrfRejected checks the CSRF token for requests that change data, for
+// protected path prefixes, and responds with "403 Forbidden" if it is missing
+// or not valid. Returns true if the request has been rejected.
+func (ac *Config) csrfRejected(mux *http.ServeMux, w http.ResponseWriter, req *http.Request) bool {
+	switch req.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return false
+	}
+	rule, ok := ac.csrf.Get(mux, req.URL.Path)
+	if !ok || ac.validCSRFToken(req) {
+		return false
+	}
+	if rule.handler != nil {
+		rule.handler.ServeHTTP(&forbiddenWriter{ResponseWriter: w}, req)
+		ac.LogAccess(req, http.StatusForbidden, 0)
+		return true
+	}
+	size := ac.ErrorPage(w, req, httperror.New(http.StatusForbidden, "The form has expired. Please go back, reload the page and try again."))
+	ac.LogAccess(req, http.StatusForbidden, size)
+	return true
+}
+
+// LoadCSRFFunctions makes functions for CSRF tokens available to Lua scripts
+func (ac *Config) LoadCSRFFunctions(w http.ResponseWriter, req *http.Request, L *lua.LState) {
+	// The cookie is only set once per request
+	token := ""
+	getToken := func() string {
+		if token == "" {
+			token = ac.CSRFToken(w, req)
+		}
+		return token
+	}
+
+	// Get the CSRF token for the current browser and session, for sending
+	// with forms or in the X-CSRF-Token header
+	L.SetGlobal("csrf_token", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(getToken()))
+		return 1 // number of results
+	}))
+
+	// Get a hidden form field with the CSRF token
+	L.SetGlobal("csrf_field", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(`<input type="hidden" name="` + csrfFieldName + `" value="` + html.EscapeString(getToken()) + `">`))
+		return 1 // number of results
+	}))
+}
+
+// LoadCSRFRules makes the CSRF function available to server configuration
+// scripts
+func (ac *Config) LoadCSRFRules(L *lua.LState, filename string, mux *http.ServeMux) {
+
+	csrfmutex := &sync.Mutex{}
+
+	// Require a valid CSRF token for POST, PUT, PATCH and DELETE requests to
+	// a path prefix. Takes a path prefix and an optional handler function
+	// for responding to requests that are rejected, with "403 Forbidden" as
+	// the default status code. Returns true.
+	L.SetGlobal("CSRF", L.NewFunction(func(L *lua.LState) int {
+		rule := csrfRule{prefix: L.CheckString(1)}
+		if handleFunc := L.OptFunction(2, nil); handleFunc != nil {
+			rule.handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				csrfmutex.Lock()
+				defer csrfmutex.Unlock()
+				ac.LoadCommonFunctions(w, req, filename, L, nil, nil)
+				L.Push(handleFunc)
+				if err := L.PCall(0, lua.MultRet, nil); err != nil {
+					log.Error("The CSRF handler for "+rule.prefix+" failed: ", err)
+				}
+			})
+		}
+		ac.csrf.Add(mux, rule)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	ac := newTestConfig()
+	mux := http.NewServeMux()
+	ac.csrf.Add(mux, csrfRule{prefix: "/account"})
+
+	// Get a token and the cookie that it belongs to
+	w := httptest.NewRecorder()
+	token := ac.CSRFToken(w, httptest.NewRequest("GET", "/account", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookieName {
+		t.Fatalf("expected the CSRF cookie, got %v", cookies)
+	}
+	cookie := cookies[0]
+
+	for _, test := range []struct {
+		name, method, path, header, field string
+		cookie                            bool
+		rejected                          bool
+	}{
+		{"not protected", "POST", "/public", "", "", false, false},
+		{"not changing data", "GET", "/account", "", "", false, false},
+		{"missing token", "POST", "/account", "", "", true, true},
+		{"missing cookie", "POST", "/account", token, "", false, true},
+		{"forged token", "DELETE", "/account", strings.Repeat("0", len(token)), "", true, true},
+		{"valid header", "POST", "/account/email", token, "", true, false},
+		{"valid form field", "POST", "/account/email", "", token, true, false},
+	} {
+		var req *http.Request
+		if test.field != "" {
+			req = httptest.NewRequest(test.method, test.path, strings.NewReader(url.Values{csrfFieldName: {test.field}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(test.method, test.path, nil)
+		}
+		if test.header != "" {
+			req.Header.Set(csrfHeaderName, test.header)
+		}
+		if test.cookie {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		if rejected := ac.csrfRejected(mux, w, req); rejected != test.rejected {
+			t.Errorf("%s: expected rejected to be %v", test.name, test.rejected)
+		} else if rejected && w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d", test.name, w.Code)
+		}
+	}
+
+	// The token is for one cookie
+	req := httptest.NewRequest("POST", "/account", nil)
+	req.Header.Set(csrfHeaderName, token)
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: randomToken()})
+	if !ac.csrfRejected(mux, httptest.NewRecorder(), req) {
+		t.Error("a token for another cookie was accepted")
+	}
+}
@@ -0,0 +1,141 @@
+package engine
+
+// Responding to requests that are rejected by the permission system, with
+// "401 Unauthorized" for API clients, a redirect to a login page for
+// browsers, or "403 Forbidden", depending on the path
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/xyproto/algernon/lua/httperror"
+)
+
+// The ways of responding when permission is denied
+const (
+	denyAuto         = "auto"  // 401 for API clients, login redirect for browsers, 403 for logged in users
+	denyUnauthorized = "401"   // 401 Unauthorized with a WWW-Authenticate header
+	denyForbidden    = "403"   // 403 Forbidden
+	denyLogin        = "login" // redirect to the login page, unless logged in
+)
+
+// The WWW-Authenticate header for 401 responses. Logging in is done with a
+// session cookie, so this does not make browsers show a login dialog.
+const denyAuthenticate = `Cookie realm="Restricted"`
+
+// The query parameter that the login page is given, for returning to the
+// page that was requested
+const denyReturnParameter = "return"
+
+// denyPolicy is how to respond when permission is denied for paths that
+// start with the prefix
+type denyPolicy struct {
+	prefix   string
+	mode     string
+	loginURL string
+}
+
+// validDenyMode checks if the given string is one of the ways of responding
+func validDenyMode(mode string) bool {
+	return mode == denyAuto || mode == denyUnauthorized || mode == denyForbidden || mode == denyLogin
+}
+
+// denyPolicyTable keeps the deny policies for the path prefixes
+type denyPolicyTable struct {
+	mut      sync.RWMutex
+	policies []denyPolicy
+}
+
+// Set adds or replaces the deny policy for a path prefix
+func (dt *denyPolicyTable) Set(policy denyPolicy) {
+	dt.mut.Lock()
+	defer dt.mut.Unlock()
+	for i, p := range dt.policies {
+		if p.prefix == policy.prefix {
+			dt.policies[i] = policy
+			return
+		}
+	}
+	dt.policies = append(dt.policies, policy)
+}
+
+// Reset removes all deny policies
+func (dt *denyPolicyTable) Reset() {
+	dt.mut.Lock()
+	defer dt.mut.Unlock()
+	dt.policies = nil
+}
+
+// Get returns the policy with the longest prefix that matches the URL path,
+// and false if there is none
+func (dt *denyPolicyTable) Get(urlPath string) (denyPolicy, bool) {
+	dt.mut.RLock()
+	defer dt.mut.RUnlock()
+	var (
+		found denyPolicy
+		ok    bool
+	)
+	for _, p := range dt.policies {
+		if strings.HasPrefix(urlPath, p.prefix) && (!ok || len(p.prefix) > len(found.prefix)) {
+			found, ok = p, true
+		}
+	}
+	return found, ok
+}
+
+// acceptsHTML checks if the request is likely to come from a browser
+func acceptsHTML(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/html") && req.Header.Get("X-Requested-With") == ""
+}
+
+// loginRedirect returns the login URL with the requested URL as a parameter
+func (ac *Config) loginRedirect(loginURL string, req *http.Request) string {
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return loginURL
+	}
+	query := u.Query()
+	query.Set(denyReturnParameter, ac.PrefixURL(req.URL.RequestURI()))
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// PermissionDenied responds to a request that has been rejected by the
+// permission system, according to the deny policy for the requested path
+func (ac *Config) PermissionDenied(w http.ResponseWriter, req *http.Request) {
+	policy, ok := ac.denyPolicies.Get(req.URL.Path)
+	if !ok {
+		policy = denyPolicy{mode: denyAuto, loginURL: ac.loginURL}
+	}
+	loggedIn := ac.perm.UserState().UserRights(req)
+
+	mode := policy.mode
+	if mode == denyAuto {
+		switch {
+		case loggedIn:
+			mode = denyForbidden
+		case acceptsHTML(req) && policy.loginURL != "":
+			mode = denyLogin
+		default:
+			mode = denyUnauthorized
+		}
+	}
+	if mode == denyLogin && loggedIn {
+		// Logging in again would not help
+		mode = denyForbidden
+	} else if mode == denyLogin && policy.loginURL == "" {
+		mode = denyUnauthorized
+	}
+
+	switch mode {
+	case denyLogin:
+		http.Redirect(w, req, ac.loginRedirect(policy.loginURL, req), http.StatusFound)
+	case denyUnauthorized:
+		w.Header().Set("WWW-Authenticate", denyAuthenticate)
+		ac.ErrorPage(w, req, httperror.New(http.StatusUnauthorized, "Please log in to access this page."))
+	default:
+		ac.ErrorPage(w, req, httperror.New(http.StatusForbidden, "Permission denied."))
+	}
+}
@@ -0,0 +1,159 @@
+package engine
+
+// Comparing the configuration before and after a reload
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default path prefixes of the permission packages
+var (
+	defaultAdminPathPrefixes = []string{"/admin"}
+	defaultUserPathPrefixes  = []string{"/repo", "/data"}
+)
+
+// stringList is a list of strings that can be used concurrently
+type stringList struct {
+	mut   sync.RWMutex
+	items []string
+}
+
+// Add appends a string to the list
+func (sl *stringList) Add(s string) {
+	sl.mut.Lock()
+	defer sl.mut.Unlock()
+	sl.items = append(sl.items, s)
+}
+
+// Reset removes all strings from the list
+func (sl *stringList) Reset() {
+	sl.mut.Lock()
+	defer sl.mut.Unlock()
+	sl.items = []string{}
+}
+
+// Items returns a copy of the strings in the list
+func (sl *stringList) Items() []string {
+	sl.mut.RLock()
+	defer sl.mut.RUnlock()
+	return append([]string{}, sl.items...)
+}
+
+// applyProtections sets the permission path prefixes to the defaults, then
+// applies the given list of "admin PREFIX", "user PREFIX", "deny PREFIX MODE [URL]" or "clear" lines,
+// in order. This is used when reloading, so that removed prefixes are removed.
+func (ac *Config) applyProtections(protections []string) {
+	if ac.perm == nil {
+		return
+	}
+	ac.denyPolicies.Reset()
+	if ac.clearDefaultPathPrefixes {
+		ac.perm.Clear()
+	} else {
+		ac.perm.SetAdminPath(append([]string{}, defaultAdminPathPrefixes...))
+		ac.perm.SetUserPath(append([]string{}, defaultUserPathPrefixes...))
+	}
+	for _, protection := range protections {
+		fields := strings.SplitN(protection, " ", 2)
+		switch {
+		case fields[0] == "clear":
+			ac.perm.Clear()
+		case fields[0] == "admin" && len(fields) == 2:
+			ac.perm.AddAdminPath(fields[1])
+		case fields[0] == "user" && len(fields) == 2:
+			ac.perm.AddUserPath(fields[1])
+		case fields[0] == "deny" && len(fields) == 2:
+			policy := strings.Fields(fields[1])
+			if len(policy) == 2 {
+				policy = append(policy, "")
+			}
+			if len(policy) == 3 {
+				ac.denyPolicies.Set(denyPolicy{prefix: policy[0], mode: policy[1], loginURL: policy[2]})
+			}
+		}
+	}
+}
+
+// configSnapshot is what the server looked like at one point in time,
+// as sorted lines for each category
+type configSnapshot map[string][]string
+
+// snapshot records the routes and redirects of the given mux, the permission
+// path prefixes that have been added by configuration scripts and the server
+// settings
+func (ac *Config) snapshot(mux *http.ServeMux) configSnapshot {
+	protections := ac.protections.Items()
+	sort.Strings(protections)
+	var settings []string
+	for _, line := range strings.Split(ac.Info(), "\n") {
+		// Replace the tabs that are used for aligning the output
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			settings = append(settings, line)
+		}
+	}
+	sort.Strings(settings)
+	return configSnapshot{
+		"route":      ac.routes.Lines(mux),
+		"redirect":   ac.redirects.Lines(mux),
+		"protection": unique(protections),
+		"setting":    settings,
+	}
+}
+
+// diffLines returns the lines that are only in a and only in b
+func diffLines(a, b []string) (removed, added []string) {
+	for _, line := range a {
+		if !has(b, line) {
+			removed = append(removed, line)
+		}
+	}
+	for _, line := range b {
+		if !has(a, line) {
+			added = append(added, line)
+		}
+	}
+	return
+}
+
+// Diff returns what has changed from this snapshot to the given snapshot,
+// as lines prefixed with "-" or "+" and the category
+func (before configSnapshot) Diff(after configSnapshot) []string {
+	var lines []string
+	for _, category := range []string{"route", "redirect", "protection", "setting"} {
+		removed, added := diffLines(before[category], after[category])
+		for _, line := range removed {
+			lines = append(lines, "- "+category+" "+line)
+		}
+		for _, line := range added {
+			lines = append(lines, "+ "+category+" "+line)
+		}
+	}
+	return lines
+}
+
+// reloadDiff is what changed at the last reload
+type reloadDiff struct {
+	mut   sync.RWMutex
+	when  time.Time
+	lines []string
+}
+
+// Set stores the diff of a reload that just happened
+func (rd *reloadDiff) Set(lines []string) {
+	rd.mut.Lock()
+	defer rd.mut.Unlock()
+	rd.when = time.Now()
+	rd.lines = lines
+}
+
+// Get returns the diff of the last reload, and when it happened.
+// The time is zero if the server has not been reloaded.
+func (rd *reloadDiff) Get() ([]string, time.Time) {
+	rd.mut.RLock()
+	defer rd.mut.RUnlock()
+	return rd.lines, rd.when
+}
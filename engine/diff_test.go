@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/xyproto/algernon/lua/pool"
+)
+
+func TestReloadRedirects(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "serverconf.lua")
+	write := func(script string) {
+		if err := ioutil.WriteFile(filename, []byte(script), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ac := newTestConfig()
+	ac.luaServerFilename = filename
+	ac.luapool = pool.New()
+	defer ac.luapool.Shutdown()
+	ac.handler.Swap(http.NewServeMux())
+
+	write(`redirects = { ["/old.html"] = "/new.html" }`)
+	if _, err := ac.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	write(`redirects = { ["/old.html"] = { "/newer.html", 302 } }`)
+	diff, err := ac.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"- redirect /old.html -> /new.html 301",
+		"+ redirect /old.html -> /newer.html 302",
+	}
+	if len(diff) != len(expected) {
+		t.Fatalf("unexpected diff: %q", diff)
+	}
+	for i := range expected {
+		if diff[i] != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], diff[i])
+		}
+	}
+}
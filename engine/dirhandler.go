@@ -10,6 +10,7 @@ import (
 
 	"github.com/go-gcfg/gcfg"
 	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/httperror"
 	"github.com/xyproto/algernon/themes"
 	"github.com/xyproto/algernon/utils"
 )
@@ -29,57 +30,49 @@ const (
 // DirConfig keeps a directory listing configuration
 type DirConfig struct {
 	Main struct {
-		Title string
-		Theme string
+		Title    string
+		Theme    string
+		Template string // an Amber or Lua template, relative to the directory
+		Sort     string // "name", "size" or "mtime"
+		Order    string // "asc" or "desc"
+		Hidden   string // "show" or "hide"
+		Index    string // comma separated index filenames, in order
+		Listing  string // "on" or "off"
 	}
 }
 
-// DirectoryListing serves the given directory as a web page with links the the contents
+// readDirConfig reads the directory configuration in the given directory,
+// if there is one
+func (ac *Config) readDirConfig(dirname string) (*DirConfig, bool) {
+	fullDirConfFilename := filepath.Join(dirname, dirconfFilename)
+	if !ac.fs.Exists(fullDirConfFilename) {
+		return nil, false
+	}
+	var dirConf DirConfig
+	if err := gcfg.ReadFileInto(&dirConf, fullDirConfFilename); err != nil {
+		log.Errorf("Could not read %s: %s", fullDirConfFilename, err)
+		return nil, false
+	}
+	return &dirConf, true
+}
+
+// DirectoryListing serves the given directory as a web page with links the the contents,
+// or as JSON if the client asks for JSON or for ?format=json
 func (ac *Config) DirectoryListing(w http.ResponseWriter, req *http.Request, rootdir, dirname, theme string) {
 	var (
-		buf          bytes.Buffer
-		fullFilename string
-		URLpath      string
-		title        = dirname
+		buf   bytes.Buffer
+		title = dirname
 	)
 
-	// Fill the coming HTML body with a list of all the filenames in `dirname`
-	for _, filename := range utils.GetFilenames(dirname) {
-
-		if filename == dirconfFilename {
-			// Skip
-			continue
-		}
-
-		// Find the full name
-		fullFilename = dirname
-
-		// Add a "/" after the directory name, if missing
-		if !strings.HasSuffix(fullFilename, utils.Pathsep) {
-			fullFilename += utils.Pathsep
-		}
-
-		// Add the filename at the end
-		fullFilename += filename
-
-		// Remove the root directory from the link path
-		URLpath = fullFilename[len(rootdir)+1:]
-
-		// Output different entries for files and directories
-		buf.WriteString(themes.HTMLLink(filename, URLpath, ac.fs.IsDir(fullFilename)))
-	}
-
 	// Read directory configuration, if present
-	fullDirConfFilename := filepath.Join(dirname, dirconfFilename)
-	if ac.fs.Exists(fullDirConfFilename) {
-		var dirConf DirConfig
-		if err := gcfg.ReadFileInto(&dirConf, fullDirConfFilename); err == nil { // if no error
-			if dirConf.Main.Title != "" {
-				title = dirConf.Main.Title
-			}
-			if dirConf.Main.Theme != "" {
-				theme = dirConf.Main.Theme
-			}
+	dirConf, hasDirConf := ac.readDirConfig(dirname)
+	options := ac.dirListingOptionsFor(dirname, dirConf)
+	if hasDirConf {
+		if dirConf.Main.Title != "" {
+			title = dirConf.Main.Title
+		}
+		if dirConf.Main.Theme != "" {
+			theme = dirConf.Main.Theme
 		}
 	} else {
 		// Strip the leading "./" from the current directory
@@ -92,6 +85,26 @@ func (ac *Config) DirectoryListing(w http.ResponseWriter, req *http.Request, roo
 		}
 	}
 
+	listing := dirListing{Title: title, Path: req.URL.Path, Entries: ac.dirEntries(rootdir, dirname, options)}
+
+	// Serve the listing as JSON, for API clients
+	if wantsJSON(w, req) || req.URL.Query().Get("format") == "json" {
+		ac.serveDirListingJSON(w, listing)
+		return
+	}
+
+	// Render the listing with a template, if one is configured
+	if options.template != "" {
+		ac.serveDirListingTemplate(w, req, options.template, listing)
+		return
+	}
+
+	// Fill the coming HTML body with a list of all the entries
+	for _, entry := range listing.Entries {
+		// Output different entries for files and directories
+		buf.WriteString(themes.HTMLLink(entry.Name, strings.TrimSuffix(entry.URL[1:], "/"), entry.IsDir))
+	}
+
 	// Check if the current page contents are empty
 	if buf.Len() == 0 {
 		buf.WriteString("Empty directory")
@@ -131,9 +144,13 @@ func (ac *Config) DirPage(w http.ResponseWriter, req *http.Request, rootdir, dir
 		return
 	}
 
+	// The index filenames and if listings are disabled can be configured
+	dirConf, _ := ac.readDirConfig(dirname)
+	options := ac.dirListingOptionsFor(dirname, dirConf)
+
 	// Handle the serving of index files, if needed
 	var filename string
-	for _, indexfile := range indexFilenames {
+	for _, indexfile := range options.index {
 		filename = filepath.Join(dirname, indexfile)
 		if ac.fs.Exists(filename) {
 			ac.FilePage(w, req, filename, ac.defaultLuaDataFilename)
@@ -141,6 +158,21 @@ func (ac *Config) DirPage(w http.ResponseWriter, req *http.Request, rootdir, dir
 		}
 	}
 
+	// Also look for index.php, if .php files are passed on to a FastCGI server
+	if ac.fastcgi.Get(ac.requestMux(req), ".php") != nil {
+		filename = filepath.Join(dirname, "index.php")
+		if ac.fs.Exists(filename) {
+			ac.FilePage(w, req, filename, ac.defaultLuaDataFilename)
+			return
+		}
+	}
+
+	// Respond with "403 Forbidden" if directory listings are disabled
+	if options.disabled {
+		ac.ErrorPage(w, req, httperror.New(http.StatusForbidden, "Directory listings are disabled."))
+		return
+	}
+
 	// Serve a directory listing if no index file is found
 	ac.DirectoryListing(w, req, rootdir, dirname, theme)
 }
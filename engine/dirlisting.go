@@ -0,0 +1,344 @@
+package engine
+
+// Options for the generated directory listings, like the sort order and
+// hidden files, and rendering them with an Amber or Lua template, or as JSON
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/gopher-lua"
+)
+
+// The extensions of archives, and of source code, for the icons of the
+// entries in directory listings
+var (
+	archiveExtensions = []string{".zip", ".tar", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".7z", ".rar"}
+	codeExtensions    = []string{".lua", ".go", ".js", ".jsx", ".ts", ".py", ".rb", ".c", ".h", ".cpp", ".rs", ".sh", ".json", ".xml", ".yml", ".yaml", ".toml", ".css", ".gcss", ".scss"}
+)
+
+// dirListingOptions is how directory listings are generated
+type dirListingOptions struct {
+	template string // an Amber or Lua template, or empty
+	sortBy   string // "name", "size" or "mtime"
+	reverse  bool   // sort in descending order
+	hidden   bool   // list files that start with "."
+	index    []string
+	disabled bool // respond with "403 Forbidden" instead of listing
+}
+
+// dirListingConfig keeps the options for directory listings that are set in
+// the server configuration
+type dirListingConfig struct {
+	mut     sync.RWMutex
+	options dirListingOptions
+}
+
+// Set starts using the given options
+func (dc *dirListingConfig) Set(options dirListingOptions) {
+	dc.mut.Lock()
+	defer dc.mut.Unlock()
+	dc.options = options
+}
+
+// Get returns the options
+func (dc *dirListingConfig) Get() dirListingOptions {
+	dc.mut.RLock()
+	defer dc.mut.RUnlock()
+	return dc.options
+}
+
+// apply changes the options with the sort order, the order and the hidden
+// files policy from a .algernon file, if they are given
+func (options *dirListingOptions) apply(sortBy, order, hidden string) {
+	if sortBy != "" {
+		options.sortBy = strings.ToLower(sortBy)
+	}
+	switch strings.ToLower(order) {
+	case "asc":
+		options.reverse = false
+	case "desc":
+		options.reverse = true
+	}
+	switch strings.ToLower(hidden) {
+	case "show":
+		options.hidden = true
+	case "hide":
+		options.hidden = false
+	}
+}
+
+// defaultDirListingOptions returns the options that are given with flags,
+// like --index and --nolistings
+func (ac *Config) defaultDirListingOptions() dirListingOptions {
+	index := indexFilenames
+	if len(ac.indexFilenames) > 0 {
+		index = ac.indexFilenames
+	}
+	return dirListingOptions{hidden: true, index: index, disabled: ac.noListings}
+}
+
+// dirListingOptionsFor returns the options for the given directory, which
+// can be changed with a .algernon file in the directory
+func (ac *Config) dirListingOptionsFor(dirname string, dirConf *DirConfig) dirListingOptions {
+	options := ac.dirListing.Get()
+	if dirConf == nil {
+		return options
+	}
+	if dirConf.Main.Template != "" {
+		options.template = filepath.Join(dirname, dirConf.Main.Template)
+	}
+	if index := splitFilenames(dirConf.Main.Index); len(index) > 0 {
+		options.index = index
+	}
+	switch strings.ToLower(dirConf.Main.Listing) {
+	case "on":
+		options.disabled = false
+	case "off":
+		options.disabled = true
+	}
+	options.apply(dirConf.Main.Sort, dirConf.Main.Order, dirConf.Main.Hidden)
+	return options
+}
+
+// splitFilenames splits a comma separated list of filenames
+func splitFilenames(s string) []string {
+	var filenames []string
+	for _, filename := range strings.Split(s, ",") {
+		if filename = strings.TrimSpace(filename); filename != "" {
+			filenames = append(filenames, filename)
+		}
+	}
+	return filenames
+}
+
+// dirEntry is a file or directory in a directory listing
+type dirEntry struct {
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	IsDir   bool      `json:"dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Icon    string    `json:"icon"`
+}
+
+// dirListing is the data that directory listing templates are given
+type dirListing struct {
+	Title   string     `json:"title"`
+	Path    string     `json:"path"`
+	Entries []dirEntry `json:"entries"`
+}
+
+// hasExtension checks if the filename has one of the given extensions
+func hasExtension(filename string, extensions []string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, e := range extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// entryIcon returns the name of an icon for a directory listing entry, like
+// "folder", "image", "video", "audio", "archive", "code", "text" or "file"
+func entryIcon(name string, isDir bool) string {
+	if isDir {
+		return "folder"
+	}
+	switch {
+	case hasExtension(name, archiveExtensions):
+		return "archive"
+	case hasExtension(name, codeExtensions):
+		return "code"
+	}
+	mimeType := mime.TypeByExtension(filepath.Ext(name))
+	for _, kind := range []string{"image", "video", "audio", "text"} {
+		if strings.HasPrefix(mimeType, kind+"/") {
+			return kind
+		}
+	}
+	return "file"
+}
+
+// dirEntries returns the entries for a directory listing, sorted. rootdir is
+// the served directory, for the URLs of the entries.
+func (ac *Config) dirEntries(rootdir, dirname string, options dirListingOptions) []dirEntry {
+	f, err := os.Open(dirname)
+	if err != nil {
+		log.Errorf("Could not open directory %s: %s", dirname, err)
+		return nil
+	}
+	defer f.Close()
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		log.Errorf("Could not read directory %s: %s", dirname, err)
+		return nil
+	}
+	dirpath := dirname
+	if !strings.HasSuffix(dirpath, string(filepath.Separator)) {
+		dirpath += string(filepath.Separator)
+	}
+	var entries []dirEntry
+	for _, info := range infos {
+		name := info.Name()
+		if name == dirconfFilename || (!options.hidden && strings.HasPrefix(name, ".")) {
+			continue
+		}
+		if options.template != "" && filepath.Join(dirname, name) == filepath.Clean(options.template) {
+			continue
+		}
+		// Remove the root directory from the link path
+		linkPath := (dirpath + name)[len(rootdir)+1:]
+		if ac.urlPrefix != "" {
+			linkPath = ac.urlPrefix[1:] + "/" + linkPath
+		}
+		entry := dirEntry{
+			Name:    name,
+			URL:     "/" + filepath.ToSlash(linkPath),
+			IsDir:   info.IsDir(),
+			ModTime: info.ModTime().UTC(),
+			Icon:    entryIcon(name, info.IsDir()),
+		}
+		if entry.IsDir {
+			entry.URL += "/"
+		} else {
+			entry.Size = info.Size()
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if options.reverse {
+			a, b = b, a
+		}
+		switch options.sortBy {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "mtime":
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		}
+		return a.Name < b.Name
+	})
+	return entries
+}
+
+// serveDirListingJSON serves a directory listing as JSON
+func (ac *Config) serveDirListingJSON(w http.ResponseWriter, listing dirListing) {
+	if listing.Entries == nil {
+		listing.Entries = []dirEntry{}
+	}
+	data, err := json.Marshal(listing)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.Write(data)
+}
+
+// dirListingKey is the context key for the directory listing that a Lua
+// template renders
+type dirListingKey struct{}
+
+// serveDirListingTemplate renders a directory listing with an Amber or Lua
+// template
+func (ac *Config) serveDirListingTemplate(w http.ResponseWriter, req *http.Request, filename string, listing dirListing) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".amber", ".amb":
+		amberblock, err := ac.ReadAndLogErrors(w, filename, ".amber")
+		if err != nil {
+			return
+		}
+		w.Header().Add("Content-Type", "text/html;charset=utf-8")
+		funcs := map[string]interface{}{"Title": listing.Title, "Path": listing.Path, "Entries": listing.Entries}
+		ac.AmberPage(w, req, filename, amberblock.MustData(), funcs)
+	case ".lua":
+		req = req.WithContext(context.WithValue(req.Context(), dirListingKey{}, listing))
+		ac.LuaPage(w, req, filename)
+	default:
+		log.Errorf("%s: directory listing templates must be Amber or Lua", filename)
+	}
+}
+
+// LoadDirListingFunctions sets the listing table for Lua templates that
+// render directory listings, with title, path and entries, where each
+// entry has name, url, dir, size, mtime (as a timestamp) and icon. The
+// listing is nil for other Lua scripts.
+func (ac *Config) LoadDirListingFunctions(req *http.Request, L *lua.LState) {
+	var (
+		listing dirListing
+		ok      bool
+	)
+	if req != nil {
+		listing, ok = req.Context().Value(dirListingKey{}).(dirListing)
+	}
+	if !ok {
+		L.SetGlobal("listing", lua.LNil)
+		return
+	}
+	entries := L.NewTable()
+	for _, entry := range listing.Entries {
+		t := L.NewTable()
+		L.SetField(t, "name", lua.LString(entry.Name))
+		L.SetField(t, "url", lua.LString(entry.URL))
+		L.SetField(t, "dir", lua.LBool(entry.IsDir))
+		L.SetField(t, "size", lua.LNumber(entry.Size))
+		L.SetField(t, "mtime", lua.LNumber(entry.ModTime.Unix()))
+		L.SetField(t, "icon", lua.LString(entry.Icon))
+		entries.Append(t)
+	}
+	t := L.NewTable()
+	L.SetField(t, "title", lua.LString(listing.Title))
+	L.SetField(t, "path", lua.LString(listing.Path))
+	L.SetField(t, "entries", entries)
+	L.SetGlobal("listing", t)
+}
+
+// LoadDirListingConfigFunctions makes the DirectoryListings function
+// available to server configuration scripts
+func (ac *Config) LoadDirListingConfigFunctions(L *lua.LState, filename string) {
+
+	// Configure the generated directory listings. Takes a table with
+	// template (an Amber or Lua file, relative to the configuration script),
+	// sort ("name", "size" or "mtime"), order ("asc" or "desc"), hidden
+	// ("show" or "hide"), index (a list of index filenames, in order) and
+	// listings (false for "403 Forbidden" instead of listings). Returns true.
+	L.SetGlobal("DirectoryListings", L.NewFunction(func(L *lua.LState) int {
+		table := L.CheckTable(1)
+		fields := tableToHeaders(table)
+		options := ac.defaultDirListingOptions()
+		if index, ok := table.RawGetString("index").(*lua.LTable); ok {
+			options.index = nil
+			index.ForEach(func(_, value lua.LValue) {
+				options.index = append(options.index, value.String())
+			})
+		}
+		if listings, ok := table.RawGetString("listings").(lua.LBool); ok {
+			options.disabled = !bool(listings)
+		}
+		if template := fields["template"]; template != "" {
+			if !filepath.IsAbs(template) {
+				template = filepath.Join(filepath.Dir(filename), template)
+			}
+			options.template = template
+		}
+		options.apply(fields["sort"], fields["order"], fields["hidden"])
+		ac.dirListing.Set(options)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,84 @@
+package engine
+
+// Shutting down gracefully, by letting the requests that are being served
+// finish before the database connection is closed and the logs are flushed
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errShuttingDown = errors.New("the server is shutting down")
+
+// ShuttingDown checks if the server is shutting down
+func (ac *Config) ShuttingDown() bool {
+	return atomic.LoadInt32(&ac.shuttingDown) == 1
+}
+
+// waitForRequests waits until the servers have stopped and there are no
+// more requests being served, or until the timeout. Returns the number of
+// requests that did not finish in time.
+func (ac *Config) waitForRequests(timeout time.Duration) int64 {
+	stopped := make(chan struct{})
+	go func() {
+		ac.servers.Wait()
+		close(stopped)
+	}()
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-deadline:
+			return atomic.LoadInt64(&ac.metrics.inFlight)
+		case <-ticker.C:
+			if atomic.LoadInt64(&ac.metrics.inFlight) > 0 {
+				continue
+			}
+			select {
+			case <-stopped:
+				return 0
+			default:
+			}
+		}
+	}
+}
+
+// beginShutdown is called when a server receives SIGINT or SIGTERM, after
+// it has stopped accepting connections. The requests that are being served,
+// including Lua handlers and streams, can finish for up to --grace before
+// the database connection is closed, the shutdown functions are run and the
+// process exits.
+func (ac *Config) beginShutdown() {
+	if !atomic.CompareAndSwapInt32(&ac.shuttingDown, 0, 1) {
+		return
+	}
+	sdNotify("STOPPING=1")
+	inFlight := atomic.LoadInt64(&ac.metrics.inFlight)
+	if inFlight > 0 {
+		log.Infof("Shutting down, waiting up to %s for %d requests to finish", ac.shutdownTimeout, inFlight)
+	} else {
+		log.Info("Shutting down")
+	}
+	go func() {
+		// The servers close the remaining connections after the same
+		// timeout, so give them a moment to do so
+		if left := ac.waitForRequests(ac.shutdownTimeout + time.Second); left > 0 {
+			log.Warnf("%d requests did not finish in time", left)
+		}
+		if ac.perm != nil {
+			ac.perm.UserState().Host().Close()
+		}
+		ac.GenerateShutdownFunction(nil, nil)()
+		// Flush the server log, if it is a file
+		if f, ok := log.StandardLogger().Out.(*os.File); ok {
+			f.Sync()
+		}
+		ac.Close()
+		os.Exit(0)
+	}()
+}
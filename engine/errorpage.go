@@ -0,0 +1,263 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/algernon/themes"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/sheepcounter"
+)
+
+// The extensions of custom error pages, like 404.md, in the order they are tried
+var errorPageExtensions = []string{".lua", ".html", ".md", ".pongo2", ".tmpl", ".po2", ".amber"}
+
+// errorPageTable keeps the custom error pages that are configured in the
+// server configuration, for each status code
+type errorPageTable struct {
+	mut   sync.RWMutex
+	files map[int]string
+}
+
+// Set starts using the given error pages, instead of the previous ones
+func (et *errorPageTable) Set(files map[int]string) {
+	et.mut.Lock()
+	defer et.mut.Unlock()
+	et.files = files
+}
+
+// Get returns the error page for the given status code, if there is one
+func (et *errorPageTable) Get(code int) (string, bool) {
+	et.mut.RLock()
+	defer et.mut.RUnlock()
+	filename, ok := et.files[code]
+	return filename, ok
+}
+
+// serveDirKey is the context key for the directory that a request is
+// served from
+type serveDirKey struct{}
+
+// withServeDir stores the directory that the request is served from in the
+// request context, for finding custom error pages and for FastCGI
+func withServeDir(req *http.Request, servedir string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), serveDirKey{}, servedir))
+}
+
+// requestServeDir returns the directory that the request is served from,
+// which is the directory of the virtual host or the server directory, unless
+// another directory has been stored in the request context. Returns "" if
+// the server is not serving a directory.
+func (ac *Config) requestServeDir(req *http.Request) string {
+	if servedir, ok := req.Context().Value(serveDirKey{}).(string); ok {
+		return servedir
+	}
+	if vh := requestVirtualHost(req); vh != nil {
+		return vh.dir
+	}
+	if ac.fs.IsDir(ac.serverDirOrFilename) {
+		return ac.serverDirOrFilename
+	}
+	return ""
+}
+
+// errorPageKey is the context key that marks requests where a custom error
+// page is being served, so that errors in the error page are not served
+// with the same error page
+type errorPageKey struct{}
+
+// customErrorPage returns the custom error page for the status code. This
+// is the first file named like 404.md or 500.lua in the directory of the
+// requested path, or in the directories above it, up to the served
+// directory. If there is none, the error page from the server configuration
+// is used, if any.
+func (ac *Config) customErrorPage(req *http.Request, code int) (string, bool) {
+	if req.Context().Value(errorPageKey{}) != nil {
+		return "", false
+	}
+	if servedir := ac.requestServeDir(req); servedir != "" {
+		name := strconv.Itoa(code)
+		for dir := path.Dir(req.URL.Path); ; dir = path.Dir(dir) {
+			for _, ext := range errorPageExtensions {
+				filename := filepath.Join(servedir, filepath.FromSlash(dir), name+ext)
+				if ac.fs.Exists(filename) && !ac.fs.IsDir(filename) {
+					return filename, true
+				}
+			}
+			if dir == "/" || dir == "." {
+				break
+			}
+		}
+	}
+	return ac.errorPages.Get(code)
+}
+
+// errorStatusWriter is a ResponseWriter that always responds with the
+// given status code
+type errorStatusWriter struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+}
+
+// WriteHeader writes the status code of the error, once
+func (ew *errorStatusWriter) WriteHeader(int) {
+	if !ew.wroteHeader {
+		ew.wroteHeader = true
+		ew.ResponseWriter.WriteHeader(ew.code)
+	}
+}
+
+// Write writes the status code of the error, if needed, and then the data
+func (ew *errorStatusWriter) Write(data []byte) (int, error) {
+	ew.WriteHeader(ew.code)
+	return ew.ResponseWriter.Write(data)
+}
+
+// Flush writes the status code of the error, if needed, and then flushes
+func (ew *errorStatusWriter) Flush() {
+	ew.WriteHeader(ew.code)
+	if flusher, ok := ew.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// serveCustomErrorPage serves the custom error page for the status code, if
+// there is one, the same way as other pages are served, but with the status
+// code of the error. Returns the number of bytes written and true if a
+// custom error page was served.
+func (ac *Config) serveCustomErrorPage(w http.ResponseWriter, req *http.Request, code int) (int64, bool) {
+	filename, ok := ac.customErrorPage(req, code)
+	if !ok {
+		return 0, false
+	}
+	req = req.WithContext(context.WithValue(req.Context(), errorPageKey{}, code))
+	w.Header().Del("Content-Type")
+	sc := sheepcounter.New(&errorStatusWriter{ResponseWriter: w, code: code})
+	ac.FilePage(sc, req, filename, ac.defaultLuaDataFilename)
+	return sc.Counter(), true
+}
+
+// isStackOverflow checks if the given error from a Lua script is caused by
+// too deep recursion. Running out of call stack results in a "stack overflow"
+// error, while running out of data stack (registry) results in a panic.
+func isStackOverflow(err error) bool {
+	apiErr, ok := err.(*lua.ApiError)
+	if !ok || apiErr.Object == nil {
+		return false
+	}
+	message := apiErr.Object.String()
+	return strings.HasSuffix(message, "stack overflow") ||
+		(apiErr.Type == lua.ApiErrorPanic && strings.Contains(message, "index out of range"))
+}
+
+// stackOverflowError converts a stack overflow in a Lua script to a
+// "500 Internal Server Error". The traceback is only included in debug mode.
+func (ac *Config) stackOverflowError(err error) *httperror.Error {
+	e := httperror.New(http.StatusInternalServerError, "Stack overflow")
+	if apiErr, ok := err.(*lua.ApiError); ok && ac.debugMode {
+		e.Details = map[string]interface{}{"traceback": apiErr.StackTrace}
+	}
+	return e
+}
+
+// wantsJSON checks if an error response should be JSON instead of HTML.
+// This is the case if the handler has already set a JSON content type,
+// or if the client asks for JSON and not for HTML.
+func wantsJSON(w http.ResponseWriter, req *http.Request) bool {
+	if strings.Contains(w.Header().Get("Content-Type"), "json") {
+		return true
+	}
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "json") && !strings.Contains(accept, "html")
+}
+
+// detailsHTML lists the details of an error as a HTML description list
+func detailsHTML(details map[string]interface{}) string {
+	if len(details) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(details))
+	for k := range details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	sb.WriteString("<dl>")
+	for _, k := range keys {
+		value := html.EscapeString(fmt.Sprint(details[k]))
+		if strings.Contains(value, "\n") {
+			// Keep the lines of multi-line values, like tracebacks
+			value = "<pre>" + value + "</pre>"
+		}
+		sb.WriteString("<dt>" + html.EscapeString(k) + "</dt><dd>" + value + "</dd>")
+	}
+	sb.WriteString("</dl>")
+	return sb.String()
+}
+
+// ErrorPage writes a structured error as a JSON or HTML response, with the
+// status code of the error. HTML responses use the custom error page for the
+// status code, if there is one. Returns the number of bytes written.
+func (ac *Config) ErrorPage(w http.ResponseWriter, req *http.Request, e *httperror.Error) int64 {
+	var data []byte
+	if wantsJSON(w, req) {
+		body := map[string]interface{}{"code": e.Code, "message": e.Message}
+		if len(e.Details) > 0 {
+			body["details"] = e.Details
+		}
+		var err error
+		data, err = json.Marshal(map[string]interface{}{"error": body})
+		if err != nil {
+			// The details could not be converted to JSON
+			data, _ = json.Marshal(map[string]interface{}{"error": map[string]interface{}{"code": e.Code, "message": e.Message}})
+		}
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	} else if size, ok := ac.serveCustomErrorPage(w, req, e.Code); ok {
+		return size
+	} else {
+		body := "<p>" + html.EscapeString(e.Message) + "</p>" + detailsHTML(e.Details)
+		data = []byte(themes.MessagePage(e.Title(), body, ac.defaultTheme))
+		w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	}
+	w.WriteHeader(e.Code)
+	w.Write(data)
+	return int64(len(data))
+}
+
+// LoadErrorPageFunctions makes the ErrorPages function available to server
+// configuration scripts
+func (ac *Config) LoadErrorPageFunctions(L *lua.LState, filename string) {
+
+	// Use custom error pages for status codes, for the whole server. Takes a
+	// table with status codes and filenames, like {[404] = "404.md"}. The
+	// filenames are relative to the configuration script. Returns true.
+	L.SetGlobal("ErrorPages", L.NewFunction(func(L *lua.LState) int {
+		files := make(map[int]string)
+		L.CheckTable(1).ForEach(func(key, value lua.LValue) {
+			code, ok := key.(lua.LNumber)
+			if !ok {
+				L.ArgError(1, "status codes expected as keys")
+				return
+			}
+			pageFilename := value.String()
+			if !filepath.IsAbs(pageFilename) {
+				pageFilename = filepath.Join(filepath.Dir(filename), pageFilename)
+			}
+			files[int(code)] = pageFilename
+		})
+		ac.errorPages.Set(files)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,135 @@
+package engine
+
+// ETag and Last-Modified headers for static files and rendered pages, and
+// "304 Not Modified" responses for requests with If-None-Match or
+// If-Modified-Since, so that browsers do not download the same data again
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// etagEntry is the ETag of a file, for a given size and modification time
+type etagEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// etagTable keeps the ETags of static files, so that the contents only are
+// hashed again when the files change
+type etagTable struct {
+	mut   sync.RWMutex
+	etags map[string]etagEntry
+}
+
+// Get returns the ETag for the file, if the file has not changed
+func (et *etagTable) Get(filename string, info os.FileInfo) (string, bool) {
+	et.mut.RLock()
+	defer et.mut.RUnlock()
+	entry, ok := et.etags[filename]
+	if !ok || entry.size != info.Size() || !entry.modTime.Equal(info.ModTime()) {
+		return "", false
+	}
+	return entry.etag, true
+}
+
+// Set stores the ETag for the file
+func (et *etagTable) Set(filename string, info os.FileInfo, etag string) {
+	et.mut.Lock()
+	defer et.mut.Unlock()
+	if et.etags == nil {
+		et.etags = make(map[string]etagEntry)
+	}
+	et.etags[filename] = etagEntry{info.Size(), info.ModTime(), etag}
+}
+
+// contentETag returns a strong ETag, from a hash of the data
+func contentETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// gzipETag returns a different ETag for the gzipped data, since strong
+// ETags must be different for different content encodings
+func gzipETag(etag string, gzipped bool) string {
+	if !gzipped {
+		return etag
+	}
+	return encodedETag(etag, "gzip")
+}
+
+// encodedETag returns the ETag for the data with the given content encoding,
+// like "gzip" or "br"
+func encodedETag(etag, encoding string) string {
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// fileETag returns a strong ETag for a static file, from a hash of the
+// contents that are returned by read. Files that are larger than the
+// --largesize get a weak ETag from the size and the modification time, so
+// that they are not read just for hashing them.
+func (ac *Config) fileETag(filename string, info os.FileInfo, read func() []byte) string {
+	if uint64(info.Size()) > ac.largeFileSize {
+		return `W/"` + strconv.FormatInt(info.Size(), 36) + "-" + strconv.FormatInt(info.ModTime().UnixNano(), 36) + `"`
+	}
+	if etag, ok := ac.etags.Get(filename, info); ok {
+		return etag
+	}
+	etag := contentETag(read())
+	ac.etags.Set(filename, info, etag)
+	return etag
+}
+
+// etagMatches checks if the ETag is in the If-None-Match header value.
+// ETags are compared with the weak comparison, as for GET requests.
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag header, and the Last-Modified header if modTime
+// is given, and responds with "304 Not Modified" if the client already has
+// the same data. Error pages are left as they are. Returns true if the
+// request has been handled.
+func (ac *Config) notModified(w http.ResponseWriter, req *http.Request, etag string, modTime time.Time) bool {
+	if req.Context().Value(errorPageKey{}) != nil {
+		return false
+	}
+	header := w.Header()
+	header.Set("ETag", etag)
+	if !modTime.IsZero() {
+		header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	// If-Modified-Since is only used when there is no If-None-Match
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if !etagMatches(ifNoneMatch, etag) {
+			return false
+		}
+	} else {
+		since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+		if err != nil || modTime.IsZero() || modTime.Truncate(time.Second).After(since) {
+			return false
+		}
+	}
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
@@ -0,0 +1,151 @@
+package engine
+
+// Falling back to an in-memory database when Redis can not be reached, at
+// startup or while the server is running, instead of failing every request
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/memdb"
+	"github.com/xyproto/pinterface"
+)
+
+// How often the Redis connection is checked
+const redisCheckInterval = 5 * time.Second
+
+// fallbackPermissions passes all calls on to the current database backend,
+// which can be replaced while the server is running
+type fallbackPermissions struct {
+	current atomic.Value // pinterface.IPermissions
+}
+
+// newFallbackPermissions wraps the given database backend
+func newFallbackPermissions(perm pinterface.IPermissions) *fallbackPermissions {
+	fp := &fallbackPermissions{}
+	fp.current.Store(perm)
+	return fp
+}
+
+// Current returns the database backend that is currently in use
+func (fp *fallbackPermissions) Current() pinterface.IPermissions {
+	return fp.current.Load().(pinterface.IPermissions)
+}
+
+// Swap starts using the given database backend
+func (fp *fallbackPermissions) Swap(perm pinterface.IPermissions) {
+	fp.current.Store(perm)
+}
+
+// SetDenyFunction sets the handler for when permission is denied
+func (fp *fallbackPermissions) SetDenyFunction(f http.HandlerFunc) {
+	fp.Current().SetDenyFunction(f)
+}
+
+// DenyFunction returns the handler for when permission is denied
+func (fp *fallbackPermissions) DenyFunction() http.HandlerFunc {
+	return fp.Current().DenyFunction()
+}
+
+// UserState returns the user state of the current database backend
+func (fp *fallbackPermissions) UserState() pinterface.IUserState {
+	return fp.Current().UserState()
+}
+
+// Clear makes every path public
+func (fp *fallbackPermissions) Clear() {
+	fp.Current().Clear()
+}
+
+// AddAdminPath adds a path prefix that requires admin rights
+func (fp *fallbackPermissions) AddAdminPath(prefix string) {
+	fp.Current().AddAdminPath(prefix)
+}
+
+// AddUserPath adds a path prefix that requires user rights
+func (fp *fallbackPermissions) AddUserPath(prefix string) {
+	fp.Current().AddUserPath(prefix)
+}
+
+// AddPublicPath adds a path prefix that is public
+func (fp *fallbackPermissions) AddPublicPath(prefix string) {
+	fp.Current().AddPublicPath(prefix)
+}
+
+// SetAdminPath sets the path prefixes that require admin rights
+func (fp *fallbackPermissions) SetAdminPath(pathPrefixes []string) {
+	fp.Current().SetAdminPath(pathPrefixes)
+}
+
+// SetUserPath sets the path prefixes that require user rights
+func (fp *fallbackPermissions) SetUserPath(pathPrefixes []string) {
+	fp.Current().SetUserPath(pathPrefixes)
+}
+
+// SetPublicPath sets the path prefixes that are public
+func (fp *fallbackPermissions) SetPublicPath(pathPrefixes []string) {
+	fp.Current().SetPublicPath(pathPrefixes)
+}
+
+// Rejected checks if the request should be rejected
+func (fp *fallbackPermissions) Rejected(w http.ResponseWriter, req *http.Request) bool {
+	return fp.Current().Rejected(w, req)
+}
+
+// ServeHTTP is a middleware handler that rejects requests without the right permissions
+func (fp *fallbackPermissions) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	fp.Current().ServeHTTP(w, req, next)
+}
+
+// MemoryBackend returns an in-memory database backend. If --fallbackfile
+// is given, the contents are loaded from that file, and saved at shutdown.
+func (ac *Config) MemoryBackend() (pinterface.IPermissions, error) {
+	if ac.fallbackFilename == "" {
+		return memdb.NewPermissions(memdb.New()), nil
+	}
+	db, err := memdb.Load(ac.fallbackFilename)
+	if err != nil {
+		return nil, err
+	}
+	AtShutdown(func() {
+		if err := db.Save(ac.fallbackFilename); err != nil {
+			log.Error("Could not save the in-memory database: ", err)
+		}
+	})
+	return memdb.NewPermissions(db), nil
+}
+
+// watchRedis checks the Redis connection at regular intervals. If Redis can
+// not be reached, the in-memory database is used from then on.
+func (ac *Config) watchRedis(fp *fallbackPermissions) {
+	ticker := time.NewTicker(redisCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		redisPerm := fp.Current()
+		err := redisPerm.UserState().Host().Ping()
+		if err == nil {
+			continue
+		}
+		perm, memErr := ac.MemoryBackend()
+		if memErr != nil {
+			log.Error("Redis can not be reached, and the in-memory database could not be used: ", memErr)
+			continue
+		}
+
+		// Keep the settings, so that logins can be checked in the same way
+		redisState, state := redisPerm.UserState(), perm.UserState()
+		state.SetCookieSecret(redisState.CookieSecret())
+		state.SetCookieTimeout(redisState.CookieTimeout(""))
+		state.SetPasswordAlgo(redisState.PasswordAlgo())
+		perm.SetDenyFunction(redisPerm.DenyFunction())
+		fp.Swap(perm)
+
+		// Set up the path prefixes again, for the new backend
+		ac.applyProtections(ac.protections.Items())
+
+		log.Errorf("LOST THE CONNECTION TO REDIS (%s). USING AN IN-MEMORY DATABASE UNTIL THE SERVER IS RESTARTED. Users and data that are stored in Redis are not available.", err)
+		return
+	}
+}
@@ -0,0 +1,133 @@
+package engine
+
+// Passing requests on to FastCGI servers, like php-fpm
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/fastcgi"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/gopher-lua"
+)
+
+// fastcgiRule passes the files with the given filename extension on to a
+// FastCGI server
+type fastcgiRule struct {
+	ext    string
+	client *fastcgi.Client
+}
+
+// fastcgiTable keeps the FastCGI servers for filename extensions, for each
+// mux. The servers that are given with --fastcgi are kept for the nil mux,
+// and are used for all muxes.
+type fastcgiTable struct {
+	ruleTable[fastcgiRule]
+}
+
+// newFastCGIClient creates a FastCGI client that logs the error output
+func newFastCGIClient(address string) *fastcgi.Client {
+	client := fastcgi.NewClient(address)
+	client.Stderr = log.StandardLogger().WriterLevel(log.WarnLevel)
+	return client
+}
+
+// Set makes the FastCGI server handle files with the given extension, for
+// the requests to the given mux, or to all muxes if mux is nil
+func (ft *fastcgiTable) Set(mux *http.ServeMux, ext string, client *fastcgi.Client) {
+	ft.Add(mux, fastcgiRule{strings.ToLower(ext), client})
+}
+
+// Get returns the FastCGI client for the given extension, for the requests
+// to the given mux, or nil. The last server that was set for the mux is
+// used before the ones for all muxes.
+func (ft *fastcgiTable) Get(mux *http.ServeMux, ext string) *fastcgi.Client {
+	for _, m := range []*http.ServeMux{mux, nil} {
+		rules := ft.Rules(m)
+		for i := len(rules) - 1; i >= 0; i-- {
+			if rules[i].ext == ext {
+				return rules[i].client
+			}
+		}
+	}
+	return nil
+}
+
+// FastCGIPage passes the request for the given script on to a FastCGI
+// server. documentRoot is the directory that is served for the request.
+func (ac *Config) FastCGIPage(w http.ResponseWriter, req *http.Request, documentRoot, filename, scriptName, pathInfo string, client *fastcgi.Client) {
+	if abs, err := filepath.Abs(documentRoot); err == nil {
+		documentRoot = abs
+	}
+	scriptFilename, err := filepath.Abs(filename)
+	if err != nil {
+		scriptFilename = filename
+	}
+	env := fastcgi.Env(req, documentRoot, scriptFilename, scriptName, pathInfo)
+	if err := client.Serve(w, req, env); err != nil {
+		log.Error("FastCGI request for "+filename+" failed: ", err)
+		ac.ErrorPage(w, req, httperror.New(http.StatusBadGateway, ""))
+	}
+}
+
+// fastcgiServeDir returns the directory that is served for the request, for
+// the FastCGI server
+func (ac *Config) fastcgiServeDir(req *http.Request) string {
+	if servedir := ac.requestServeDir(req); servedir != "" {
+		return servedir
+	}
+	return filepath.Dir(ac.serverDirOrFilename)
+}
+
+// FastCGIHandler returns a handler that passes all requests for the given
+// URL prefix on to a FastCGI server. Requests for files that don't exist
+// are handled by index.php in the prefix directory. The files are looked up
+// in the directory that is served for the request, like the directory of a
+// virtual host.
+func (ac *Config) FastCGIHandler(handlePath string, client *fastcgi.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		servedir := ac.fastcgiServeDir(req)
+		urlpath := path.Clean("/" + req.URL.Path)
+		filename := filepath.Join(servedir, filepath.FromSlash(urlpath))
+		scriptName, pathInfo := urlpath, ""
+		if !ac.fs.Exists(filename) || ac.fs.IsDir(filename) {
+			// Let index.php handle the request, like a front controller
+			scriptName = path.Join(handlePath, "index.php")
+			filename = filepath.Join(servedir, filepath.FromSlash(scriptName))
+			pathInfo = "/" + strings.TrimPrefix(strings.TrimPrefix(urlpath, handlePath), "/")
+		}
+		recorder := &proxyResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		ac.FastCGIPage(recorder, req, servedir, filename, scriptName, pathInfo, client)
+		ac.LogAccess(req, recorder.statusCode, recorder.written)
+	}
+}
+
+// LoadFastCGIFunctions makes functions for passing requests on to FastCGI
+// servers available to Lua scripts
+func (ac *Config) LoadFastCGIFunctions(L *lua.LState, mux *http.ServeMux) {
+
+	// Pass requests for filename extensions (like ".php") or URL prefixes
+	// (like "/legacy/") on to a FastCGI server, for example:
+	// FastCGI("/run/php/php-fpm.sock", ".php")
+	L.SetGlobal("FastCGI", L.NewFunction(func(L *lua.LState) int {
+		client := newFastCGIClient(L.ToString(1))
+		top := L.GetTop()
+		for i := 2; i <= top; i++ {
+			pattern := L.ToString(i)
+			switch {
+			case strings.HasPrefix(pattern, "."):
+				ac.fastcgi.Set(mux, pattern, client)
+			case strings.HasPrefix(pattern, "/"):
+				ac.routes.Add(mux, pattern, "FastCGI server at "+client.Address)
+				ac.handleRateLimited(mux, pattern, ac.FastCGIHandler(pattern, client), ac.defaultTheme)
+			default:
+				log.Error("FastCGI: expected a filename extension or an URL prefix, got: ", pattern)
+			}
+		}
+		return 0 // number of results
+	}))
+
+}
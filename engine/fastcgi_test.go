@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/xyproto/algernon/fastcgi"
+)
+
+func TestFastCGITable(t *testing.T) {
+	var ft fastcgiTable
+	fromFlags, fromHost := fastcgi.NewClient("/run/php/flags.sock"), fastcgi.NewClient("/run/php/host.sock")
+	hostMux, otherMux := http.NewServeMux(), http.NewServeMux()
+	ft.Set(nil, ".php", fromFlags)
+	ft.Set(hostMux, ".PHP", fromHost)
+	ft.Set(hostMux, ".php5", fromHost)
+
+	if client := ft.Get(hostMux, ".php"); client != fromHost {
+		t.Errorf("expected the server for the host, got %v", client)
+	}
+	if client := ft.Get(otherMux, ".php"); client != fromFlags {
+		t.Errorf("expected the server from the flags, got %v", client)
+	}
+	if client := ft.Get(otherMux, ".php5"); client != nil {
+		t.Errorf("the server for another host was used: %v", client)
+	}
+
+	// The servers from a server configuration are removed when reloading
+	ft.Forget(hostMux)
+	if client := ft.Get(hostMux, ".php5"); client != nil {
+		t.Errorf("expected no server after forgetting the mux, got %v", client)
+	}
+	if client := ft.Get(hostMux, ".php"); client != fromFlags {
+		t.Errorf("expected the server from the flags, got %v", client)
+	}
+}
+
+func TestFastCGIDocumentRoot(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		env := fcgi.ProcessEnv(req)
+		w.Write([]byte(env["DOCUMENT_ROOT"] + " " + env["SCRIPT_FILENAME"]))
+	}))
+
+	ac := newTestConfig()
+	ac.serverDirOrFilename = t.TempDir()
+	hostDir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(hostDir, "index.php"), []byte("<?php"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler := ac.FastCGIHandler("/", fastcgi.NewClient(l.Addr().String()))
+
+	// The files of a virtual host are in the directory of the virtual host
+	req := withVirtualHost(httptest.NewRequest("GET", "/index.php", nil), &virtualHost{dir: hostDir})
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if expected := hostDir + " " + filepath.Join(hostDir, "index.php"); rec.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, rec.Body.String())
+	}
+
+	// A directory that is served with ServeDir
+	mounted := t.TempDir()
+	req = withServeDir(httptest.NewRequest("GET", "/index.php", nil), mounted)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if expected := mounted + " " + filepath.Join(mounted, "index.php"); rec.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, rec.Body.String())
+	}
+}
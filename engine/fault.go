@@ -0,0 +1,152 @@
+package engine
+
+// Fault injection, for testing how Lua frontends and clients handle slow or
+// failing backends. Requests to some paths can be delayed, or fail with an
+// error for a share of the requests. Faults are only injected in debug mode.
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/gopher-lua"
+)
+
+// faultRule delays the requests for a path, or for paths that start with a
+// prefix, or makes a share of them fail
+type faultRule struct {
+	pathPattern
+	latency     time.Duration
+	probability float64
+	status      int
+}
+
+// newFaultRule creates a fault for a path like "/pay", or for paths that
+// start with a prefix, like "/api/*"
+func newFaultRule(pattern string) faultRule {
+	return faultRule{pathPattern: newPathPattern(pattern)}
+}
+
+// faultTable keeps the faults for each mux
+type faultTable struct {
+	ruleTable[faultRule]
+}
+
+// Get returns the faults for the path
+func (ft *faultTable) Get(mux *http.ServeMux, urlpath string) []faultRule {
+	var rules []faultRule
+	for _, rule := range ft.Rules(mux) {
+		if rule.match(urlpath) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// faultInjected delays the request, if there are latency faults for the
+// path, and responds with an error page if an error fault happens. Returns
+// true if the request has been handled.
+func (ac *Config) faultInjected(mux *http.ServeMux, w http.ResponseWriter, req *http.Request) bool {
+	if !ac.debugMode {
+		return false
+	}
+	for _, rule := range ac.faults.Get(mux, req.URL.Path) {
+		if rule.latency > 0 {
+			timer := time.NewTimer(rule.latency)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return true
+			}
+		}
+		if rule.probability > 0 && rand.Float64() < rule.probability {
+			log.Debugf("Injected %d for %s", rule.status, req.URL.Path)
+			size := ac.ErrorPage(w, req, httperror.New(rule.status, "Injected fault for "+req.URL.Path+"."))
+			ac.LogAccess(req, rule.status, size)
+			return true
+		}
+	}
+	return false
+}
+
+// LoadFaultFunctions makes the InjectLatency and InjectError functions
+// available to server configuration scripts. Outside of debug mode, the
+// functions only log a warning.
+func (ac *Config) LoadFaultFunctions(L *lua.LState, mux *http.ServeMux) {
+
+	// checkPattern checks that the first argument is a path that starts
+	// with /, and warns if faults are not injected
+	checkPattern := func(L *lua.LState, name string) (string, bool) {
+		pattern := L.CheckString(1)
+		if !strings.HasPrefix(pattern, "/") {
+			L.ArgError(1, "a path that starts with / expected")
+			return "", false
+		}
+		if !ac.debugMode {
+			log.Warnf("%s(%q) is ignored, faults are only injected in debug mode", name, pattern)
+			return "", false
+		}
+		return pattern, true
+	}
+
+	// Delay the requests for a path, or for paths that start with a prefix,
+	// like "/api/*". Takes a path and a duration like "200ms" or a number of
+	// seconds. Returns true if successful.
+	L.SetGlobal("InjectLatency", L.NewFunction(func(L *lua.LState) int {
+		var latency time.Duration
+		switch d := L.Get(2).(type) {
+		case lua.LNumber:
+			latency = time.Duration(float64(d) * float64(time.Second))
+		case lua.LString:
+			var err error
+			if latency, err = time.ParseDuration(string(d)); err != nil {
+				L.ArgError(2, err.Error())
+				return 0 // number of results
+			}
+		default:
+			L.ArgError(2, "a duration like \"200ms\" or a number of seconds expected")
+			return 0 // number of results
+		}
+		if latency <= 0 {
+			L.ArgError(2, "a duration above 0 expected")
+			return 0 // number of results
+		}
+		pattern, ok := checkPattern(L, "InjectLatency")
+		if ok {
+			rule := newFaultRule(pattern)
+			rule.latency = latency
+			ac.faults.Add(mux, rule)
+		}
+		L.Push(lua.LBool(ok))
+		return 1 // number of results
+	}))
+
+	// Make a share of the requests for a path, or for paths that start with
+	// a prefix, fail. Takes a path, a probability from 0 to 1 and an optional
+	// status code (500 by default). Returns true if successful.
+	L.SetGlobal("InjectError", L.NewFunction(func(L *lua.LState) int {
+		probability := float64(L.CheckNumber(2))
+		if probability < 0 || probability > 1 {
+			L.ArgError(2, "a probability from 0 to 1 expected")
+			return 0 // number of results
+		}
+		status := L.OptInt(3, http.StatusInternalServerError)
+		if status < 400 || status > 599 {
+			L.ArgError(3, "an error status code from 400 to 599 expected")
+			return 0 // number of results
+		}
+		pattern, ok := checkPattern(L, "InjectError")
+		if ok {
+			rule := newFaultRule(pattern)
+			rule.probability = probability
+			rule.status = status
+			ac.faults.Add(mux, rule)
+		}
+		L.Push(lua.LBool(ok))
+		return 1 // number of results
+	}))
+}
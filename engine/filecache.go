@@ -0,0 +1,317 @@
+package engine
+
+// A cache for the contents of files and for rendered Markdown pages, where
+// the least recently used entries are removed when the cache is full. The
+// entries are for the modification time and the size of the file, and of
+// any other files that were used, like the style sheets of a Markdown page,
+// so that files that have changed are read again.
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xyproto/datablock"
+)
+
+// What is cached for a file
+const (
+	fileContents     = "file"
+	renderedMarkdown = "markdown"
+)
+
+// fileCacheEntry is the contents of a file, or the page that was rendered
+// from it, for the given modification time and size of the file
+type fileCacheEntry struct {
+	key      string
+	filename string
+	modTime  time.Time
+	size     int64
+	data     []byte
+	expires  time.Time
+	deps     map[string]time.Time // other files that were used, and their modification times, or the zero time if they did not exist
+}
+
+// fileModTime returns the modification time of a file, or the zero time if
+// it does not exist
+func fileModTime(filename string) time.Time {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// depsChanged checks if any of the other files that were used for the entry
+// have been changed, created or removed since it was stored
+func (entry *fileCacheEntry) depsChanged() bool {
+	for filename, modTime := range entry.deps {
+		if !fileModTime(filename).Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileCache is a thread-safe cache where the least recently used entries
+// are evicted when the total size is above maxBytes
+type fileCache struct {
+	mut         sync.Mutex
+	maxBytes    uint64
+	maxDataSize uint64 // 0 for no limit
+	ttl         time.Duration
+	entries     map[string]*list.Element
+	order       *list.List // front is the most recently used
+	bytes       uint64
+
+	hits, misses, evictions uint64
+}
+
+// newFileCache creates a file cache with the given total size, the largest
+// entry that is stored (0 for no limit) and an optional time to live
+func newFileCache(maxBytes, maxDataSize uint64, ttl time.Duration) *fileCache {
+	return &fileCache{
+		maxBytes:    maxBytes,
+		maxDataSize: maxDataSize,
+		ttl:         ttl,
+		entries:     make(map[string]*list.Element),
+		order:       list.New(),
+	}
+}
+
+// removeElement removes an entry. The mutex must be locked.
+func (c *fileCache) removeElement(e *list.Element) {
+	entry := e.Value.(*fileCacheEntry)
+	c.order.Remove(e)
+	delete(c.entries, entry.key)
+	c.bytes -= uint64(len(entry.data))
+}
+
+// fits checks if data of the given size can be stored
+func (c *fileCache) fits(size uint64) bool {
+	return size <= c.maxBytes && (c.maxDataSize == 0 || size <= c.maxDataSize)
+}
+
+// Get returns a copy of the cached data for the file, if neither the file
+// nor the other files it was stored with have changed, and the entry has not
+// expired
+func (c *fileCache) Get(kind, filename string, info os.FileInfo) ([]byte, bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	e, ok := c.entries[kind+":"+filename]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	entry := e.Value.(*fileCacheEntry)
+	if entry.size != info.Size() || !entry.modTime.Equal(info.ModTime()) || (!entry.expires.IsZero() && time.Now().After(entry.expires)) || entry.depsChanged() {
+		c.removeElement(e)
+		c.misses++
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	c.hits++
+	return append([]byte(nil), entry.data...), true
+}
+
+// Set stores the data for the file, unless it is larger than the largest
+// entry or the whole cache. The data is also for the current state of the
+// given other files, where files that do not exist can be given too.
+func (c *fileCache) Set(kind, filename string, info os.FileInfo, data []byte, deps ...string) {
+	size := uint64(len(data))
+	if !c.fits(size) {
+		return
+	}
+	var depTimes map[string]time.Time
+	if len(deps) > 0 {
+		depTimes = make(map[string]time.Time, len(deps))
+		for _, dep := range deps {
+			depTimes[dep] = fileModTime(dep)
+		}
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	key := kind + ":" + filename
+	if e, ok := c.entries[key]; ok {
+		c.removeElement(e)
+	}
+	entry := &fileCacheEntry{
+		key:      key,
+		filename: filename,
+		modTime:  info.ModTime(),
+		size:     info.Size(),
+		data:     append([]byte(nil), data...),
+		deps:     depTimes,
+	}
+	if c.ttl > 0 {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.removeElement(c.order.Back())
+		c.evictions++
+	}
+}
+
+// Purge removes the entries for the files that match, and returns how many
+// entries were removed
+func (c *fileCache) Purge(match func(filename string) bool) int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	removed := 0
+	for e := c.order.Front(); e != nil; {
+		next := e.Next()
+		if match(e.Value.(*fileCacheEntry).filename) {
+			c.removeElement(e)
+			removed++
+		}
+		e = next
+	}
+	return removed
+}
+
+// Clear removes all entries
+func (c *fileCache) Clear() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.bytes = 0
+}
+
+// Lines returns the statistics for the file cache, as metric lines
+func (c *fileCache) Lines() []string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return []string{
+		fmt.Sprintf("filecache_entries %d", c.order.Len()),
+		fmt.Sprintf("filecache_bytes %d", c.bytes),
+		fmt.Sprintf("filecache_hits_total %d", c.hits),
+		fmt.Sprintf("filecache_misses_total %d", c.misses),
+		fmt.Sprintf("filecache_evictions_total %d", c.evictions),
+	}
+}
+
+// cachePattern returns a function that checks if a filename matches a
+// pattern for purging the file cache. Patterns with wildcards, like "*.css"
+// or "/blog/*.md", are matched with the base name and with the path relative
+// to the served directory. Other patterns, like "/blog/", match the files
+// that start with them. An empty pattern matches all files.
+func (ac *Config) cachePattern(pattern string) func(filename string) bool {
+	pattern = filepath.ToSlash(pattern)
+	wildcard := strings.ContainsAny(pattern, "*?[")
+	return func(filename string) bool {
+		if pattern == "" {
+			return true
+		}
+		rel, err := filepath.Rel(ac.serverDirOrFilename, filename)
+		if err != nil {
+			rel = filename
+		}
+		rel = "/" + filepath.ToSlash(rel)
+		if wildcard {
+			if ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), path.Base(rel)); ok {
+				return true
+			}
+			ok, _ := path.Match("/"+strings.TrimPrefix(pattern, "/"), rel)
+			return ok
+		}
+		return strings.HasPrefix(rel, "/"+strings.TrimPrefix(pattern, "/")) || strings.HasPrefix(filepath.ToSlash(filename), pattern)
+	}
+}
+
+// PurgeCache removes the files that match the pattern from the file cache,
+// and clears the cache for scripts and templates, which can only be cleared
+// as a whole. Returns the number of files that were removed.
+func (ac *Config) PurgeCache(pattern string) int {
+	if ac.cache != nil {
+		ac.cache.Clear()
+	}
+	if ac.files == nil {
+		return 0
+	}
+	return ac.files.Purge(ac.cachePattern(pattern))
+}
+
+// clearCaches clears the file cache and the cache for scripts and templates
+func (ac *Config) clearCaches() {
+	if ac.cache != nil {
+		ac.cache.Clear()
+	}
+	if ac.files != nil {
+		ac.files.Clear()
+	}
+}
+
+// readFile reads a file from the file cache, if it has not changed since it
+// was cached, or else from disk. Files that are too large for the file cache
+// are read without it.
+func (ac *Config) readFile(filename, ext string) (*datablock.DataBlock, error) {
+	if ac.files == nil || !ac.shouldCache(ext) {
+		return ac.cache.Read(filename, false)
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < 0 || !ac.files.fits(uint64(info.Size())) {
+		return ac.cache.Read(filename, false)
+	}
+	if data, ok := ac.files.Get(fileContents, filename, info); ok {
+		return datablock.NewDataBlock(data, ac.cacheCompressionSpeed), nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	ac.files.Set(fileContents, filename, info, data)
+	return datablock.NewDataBlock(data, ac.cacheCompressionSpeed), nil
+}
+
+// markdownCached checks if rendered Markdown pages are cached. In debug
+// mode, GCSS is rendered into the pages, and the pages are not cached.
+func (ac *Config) markdownCached() bool {
+	return ac.files != nil && ac.shouldCache(".md") && !ac.debugMode
+}
+
+// cacheMarkdownPage stores a rendered Markdown page in the file cache, for
+// the current state of the Markdown file and of the style sheets that were
+// used for the page
+func (ac *Config) cacheMarkdownPage(filename string, htmldata []byte, styleFilenames ...string) {
+	if !ac.markdownCached() {
+		return
+	}
+	if info, err := os.Stat(filename); err == nil {
+		ac.files.Set(renderedMarkdown, filename, info, htmldata, styleFilenames...)
+	}
+}
+
+// serveCachedMarkdownPage serves a rendered Markdown page from the file
+// cache, if neither the Markdown file nor the style sheets have changed.
+// Returns true if the page was served.
+func (ac *Config) serveCachedMarkdownPage(w http.ResponseWriter, req *http.Request, filename string) bool {
+	if !ac.markdownCached() {
+		return false
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+	htmldata, ok := ac.files.Get(renderedMarkdown, filename, info)
+	if !ok {
+		return false
+	}
+	if ac.autoRefresh {
+		htmldata = ac.InsertAutoRefresh(req, htmldata)
+	}
+	ac.DataToClient(w, req, filename, htmldata)
+	return true
+}
@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xyproto/algernon/cachemode"
+	"github.com/xyproto/datablock"
+)
+
+func TestFileCacheDeps(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "index.md")
+	styleFilename := filepath.Join(dir, "style.css")
+	if err := ioutil.WriteFile(filename, []byte("# Hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newFileCache(1024, 0, 0)
+	c.Set(renderedMarkdown, filename, info, []byte("<h1>Hello</h1>"), styleFilename)
+	if _, ok := c.Get(renderedMarkdown, filename, info); !ok {
+		t.Fatal("expected the page to be cached")
+	}
+
+	// Adding a style sheet changes how the page is rendered
+	if err := ioutil.WriteFile(styleFilename, []byte("h1 { color: red; }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get(renderedMarkdown, filename, info); ok {
+		t.Error("the page was cached from before the style sheet was added")
+	}
+
+	c.Set(renderedMarkdown, filename, info, []byte("<h1>Hello</h1>"), styleFilename)
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(styleFilename, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get(renderedMarkdown, filename, info); ok {
+		t.Error("the page was cached from before the style sheet was changed")
+	}
+}
+
+func TestReadFileTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "large.txt")
+	if err := ioutil.WriteFile(filename, make([]byte, 2048), 0644); err != nil {
+		t.Fatal(err)
+	}
+	smallFilename := filepath.Join(dir, "small.txt")
+	if err := ioutil.WriteFile(smallFilename, make([]byte, 512), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ac := newTestConfig()
+	ac.cacheMode = cachemode.On
+	ac.cache = datablock.NewFileCache(20000000, false, 0, false, 0)
+	ac.files = newFileCache(20000000, 1024, 0)
+
+	block, err := ac.readFile(filename, ".txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.MustData()) != 2048 {
+		t.Errorf("read %d bytes, expected 2048", len(block.MustData()))
+	}
+	if ac.files.order.Len() != 0 || ac.files.misses != 0 {
+		t.Error("a file that is too large went through the file cache")
+	}
+
+	if _, err := ac.readFile(smallFilename, ".txt"); err != nil {
+		t.Fatal(err)
+	}
+	if ac.files.order.Len() != 1 {
+		t.Error("expected the small file to be cached")
+	}
+}
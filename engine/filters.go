@@ -0,0 +1,229 @@
+package engine
+
+// Output filters, for changing the body of responses with a given content
+// type, for both static files and dynamic pages
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/gopher-lua"
+)
+
+// outputFilter is a function that changes the body of responses with
+// content types that match the given pattern, like "text/html" or "text/*"
+type outputFilter struct {
+	contentType string
+	run         func(req *http.Request, body []byte) ([]byte, error)
+}
+
+// Matches checks if the filter applies to the given Content-Type header value
+func (f outputFilter) Matches(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	pattern := strings.ToLower(f.contentType)
+	switch {
+	case mediaType == "":
+		return false
+	case pattern == "*", pattern == "*/*", pattern == mediaType:
+		return true
+	case strings.HasSuffix(pattern, "/*"):
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
+
+// filterTable keeps track of which output filters are used by which mux
+type filterTable struct {
+	mut     sync.RWMutex
+	filters map[*http.ServeMux][]outputFilter
+}
+
+// Add registers an output filter for the given mux. Filters are applied in
+// the order they are added.
+func (ft *filterTable) Add(mux *http.ServeMux, f outputFilter) {
+	ft.mut.Lock()
+	defer ft.mut.Unlock()
+	if ft.filters == nil {
+		ft.filters = make(map[*http.ServeMux][]outputFilter)
+	}
+	ft.filters[mux] = append(ft.filters[mux], f)
+}
+
+// Get returns the output filters for the given mux
+func (ft *filterTable) Get(mux *http.ServeMux) []outputFilter {
+	ft.mut.RLock()
+	defer ft.mut.RUnlock()
+	return ft.filters[mux]
+}
+
+// Forget removes all output filters for the given mux
+func (ft *filterTable) Forget(mux *http.ServeMux) {
+	ft.mut.Lock()
+	defer ft.mut.Unlock()
+	delete(ft.filters, mux)
+}
+
+// filterWriter is a ResponseWriter that buffers the response if an output
+// filter applies to the content type, and otherwise writes it directly.
+// Compressed responses and partial content are not filtered.
+type filterWriter struct {
+	w           http.ResponseWriter
+	filters     []outputFilter
+	matched     []outputFilter
+	statusCode  int
+	wroteHeader bool
+	decided     bool
+	buf         bytes.Buffer
+}
+
+// newFilterWriter wraps the given ResponseWriter
+func newFilterWriter(w http.ResponseWriter, filters []outputFilter) *filterWriter {
+	return &filterWriter{w: w, filters: filters, statusCode: http.StatusOK}
+}
+
+// Header returns the headers of the wrapped ResponseWriter
+func (fw *filterWriter) Header() http.Header {
+	return fw.w.Header()
+}
+
+// decide finds the filters that apply, once the content type is known.
+// The content type is detected from the given data if it is not set.
+func (fw *filterWriter) decide(data []byte) {
+	if fw.decided {
+		return
+	}
+	fw.decided = true
+	contentType := fw.Header().Get("Content-Type")
+	if contentType == "" && len(data) > 0 {
+		contentType = http.DetectContentType(data)
+		fw.Header().Set("Content-Type", contentType)
+	}
+	// Partial content is only a part of the body, which can not be filtered
+	if fw.Header().Get("Content-Encoding") == "" && fw.statusCode != http.StatusPartialContent {
+		for _, f := range fw.filters {
+			if f.Matches(contentType) {
+				fw.matched = append(fw.matched, f)
+			}
+		}
+	}
+	if len(fw.matched) == 0 && fw.wroteHeader {
+		fw.w.WriteHeader(fw.statusCode)
+	}
+}
+
+// WriteHeader records the status code. It is written when it is known if
+// the response is going to be filtered.
+func (fw *filterWriter) WriteHeader(statusCode int) {
+	if fw.wroteHeader {
+		return
+	}
+	fw.statusCode = statusCode
+	fw.wroteHeader = true
+	if fw.Header().Get("Content-Type") != "" || statusCode == http.StatusNoContent || statusCode == http.StatusNotModified {
+		fw.decide(nil)
+	}
+}
+
+// Write buffers the data if the response is going to be filtered
+func (fw *filterWriter) Write(data []byte) (int, error) {
+	if !fw.wroteHeader {
+		fw.WriteHeader(http.StatusOK)
+	}
+	fw.decide(data)
+	if len(fw.matched) == 0 {
+		return fw.w.Write(data)
+	}
+	return fw.buf.Write(data)
+}
+
+// Flush flushes the wrapped ResponseWriter, unless the response is buffered
+func (fw *filterWriter) Flush() {
+	if fw.wroteHeader {
+		fw.decide(nil)
+	}
+	if len(fw.matched) > 0 {
+		return
+	}
+	if flusher, ok := fw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the wrapped ResponseWriter be hijacked, for WebSockets
+func (fw *filterWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := fw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer can not be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// Finish runs the output filters on the buffered body, if any, and writes it
+func (fw *filterWriter) Finish(req *http.Request) {
+	if len(fw.matched) == 0 {
+		return
+	}
+	body := fw.buf.Bytes()
+	for _, f := range fw.matched {
+		filtered, err := f.run(req, body)
+		if err != nil {
+			log.Error("Output filter for "+f.contentType+" failed: ", err)
+			continue
+		}
+		body = filtered
+	}
+	fw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	// The ETag and Last-Modified were for the body before it was filtered
+	fw.Header().Del("ETag")
+	fw.Header().Del("Last-Modified")
+	fw.w.WriteHeader(fw.statusCode)
+	fw.w.Write(body)
+}
+
+// LoadFilterFunctions makes the OutputFilter function available to Lua
+// scripts, for changing the body of responses served by the given mux
+func (ac *Config) LoadFilterFunctions(L *lua.LState, mux *http.ServeMux) {
+
+	filtermutex := &sync.Mutex{}
+
+	// Register a function that is given the response body and the URL path,
+	// for responses with a content type like "text/html" or "text/*".
+	// The function returns the new body, or nil to leave it as it is.
+	L.SetGlobal("OutputFilter", L.NewFunction(func(L *lua.LState) int {
+		contentType := L.CheckString(1)
+		filterFunc := L.CheckFunction(2)
+
+		run := func(req *http.Request, body []byte) ([]byte, error) {
+			// Each call gets its own Lua thread
+			filtermutex.Lock()
+			co, cancel := L.NewThread()
+			filtermutex.Unlock()
+			if cancel != nil {
+				defer cancel()
+			}
+			co.Push(filterFunc)
+			co.Push(lua.LString(string(body)))
+			co.Push(lua.LString(req.URL.Path))
+			if err := co.PCall(2, 1, nil); err != nil {
+				return body, err
+			}
+			result := co.Get(-1)
+			co.Pop(1)
+			if result == lua.LNil {
+				return body, nil
+			}
+			return []byte(result.String()), nil
+		}
+
+		ac.filters.Add(mux, outputFilter{contentType: contentType, run: run})
+		return 0 // number of results
+	}))
+
+}
@@ -8,10 +8,14 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/xyproto/algernon/cachemode"
+	"github.com/xyproto/algernon/contentstore"
+	"github.com/xyproto/algernon/lua/payment"
 	"github.com/xyproto/algernon/themes"
 	"github.com/xyproto/datablock"
+	"github.com/xyproto/gopher-lua"
 )
 
 func generateUsageFunction(ac *Config) func() {
@@ -24,6 +28,7 @@ func generateUsageFunction(ac *Config) func() {
 
 Syntax:
   algernon [flags] [file or directory to serve] [host][:port]
+  algernon [--ctl=FILENAME] [--ctltoken=TOKEN] SUBCOMMAND [arguments]
 
 Available flags:
   -h, --help                   This help text
@@ -47,22 +52,84 @@ Available flags:
                                "images"  - Only images (png, jpg, gif, svg).
                                "off"     - Disable caching.
   --cachesize=N                Set the total cache size, in bytes.
+  --cachettl=DURATION          Read cached static files and Markdown pages
+                               again after this long, like "10m". Files that
+                               change are always read again.
   --nocache                    Another way to disable the caching.
   --noheaders                  Don't use the security-related HTTP headers.
   --stricter                   Stricter HTTP headers (same origin policy).
+  --configcheck=MODE           What to do about risky configuration, like admin
+                               pages that anyone can access: "warn" (the
+                               default), "strict" (refuse to start) or "off".
+  --index=FILENAMES            Comma separated index filenames, in the order
+                               they are looked for (the default is index.lua,
+                               index.html, index.md and then the others).
+  --nolistings                 Respond with "403 Forbidden" instead of listing
+                               directories without an index file.
   -n, --nobanner               Don't display a colorful banner at start.
   --ctrld                      Press ctrl-d twice to exit the REPL.
   --rawcache                   Disable cache compression.
   --watchdir=DIRECTORY         Enables auto-refresh for only this directory.
   --cert=FILENAME              TLS certificate, if using HTTPS.
   --key=FILENAME               TLS key, if using HTTPS.
+  --certpair=CERTFILE,KEYFILE  Another TLS certificate and key. The certificate
+                               is selected by the hostname the client asks
+                               for. Can be given several times.
+  --certdir=DIRECTORY          Directory with NAME.crt or NAME.pem files and
+                               NAME.key files, or subdirectories with
+                               fullchain.pem and privkey.pem, as from certbot.
+  --noocsp                     Don't fetch and staple OCSP responses for the
+                               TLS certificates.
+  --tlsprofile=PROFILE         The TLS versions and cipher suites to allow:
+                               modern (TLS 1.3 only), intermediate (the
+                               default) or old (for very old clients).
+  --tlsmin=VERSION             The lowest TLS version to allow, like 1.2.
+  --ciphers=CIPHERS            Comma separated cipher suites to allow, for
+                               TLS 1.2 and lower, like
+                               TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+  --forcehttps                 Only redirect plain HTTP requests to HTTPS, and
+                               set the Strict-Transport-Security header.
+  --hsts=DURATION              The max-age of the Strict-Transport-Security
+                               header. The default with --forcehttps is 8760h.
+  --hstssubdomains             Include subdomains in the HSTS header.
+  --hstspreload                Allow the domain to be added to the HSTS preload
+                               lists of browsers.
+  --maxconns=N                 The largest number of open connections. More
+                               connections wait until one is closed.
+  --maxconnsperip=N            The largest number of open connections from one
+                               IP address. More connections are closed.
+  --connrate=N                 How many new connections one IP address can
+                               make per second. More connections are closed.
+                               Trusted proxies and the Unix socket are not
+                               limited per IP address.
+  --trustedproxies=LIST        Comma separated addresses and CIDR ranges of
+                               reverse proxies, and "unix" for the Unix socket.
+                               For requests from them, the client address is
+                               read from the X-Forwarded-For header.
   -d, --debug                  Enable debug mode (show errors in the browser).
+  --a11y                       In debug mode, check rendered HTML for missing alt
+                               text, skipped heading levels, low contrast and
+                               more. Findings are logged and shown at /debug/a11y.
   -b, --bolt                   Use "` + ac.defaultBoltFilename + `" for the Bolt database.
   --boltdb=FILENAME            Use a specific file for the Bolt database
   --redis=[HOST][:PORT]        Use "` + ac.defaultRedisColonPort + `" for the Redis database.
   --dbindex=INDEX              Redis database index (0 is default).
+  --fallbackfile=FILENAME      If Redis can not be reached, an in-memory
+                               database is used instead. Load it from and
+                               save it to this JSON file.
   --conf=FILENAME              Lua script with additional configuration.
+  --app=FILENAME               Lua script that runs once at startup and keeps
+                               its state. Handlers can call its functions with
+                               App(). The default is app.lua in the server dir.
   --log=FILENAME               Log to a file instead of to the console.
+  --syslog=ADDRESS             Log to syslog instead of to the console. The address
+                               can be "local", host:port, udp://host:port or
+                               tcp://host:port.
+  --journald                   Log to the systemd journal instead of to the console.
+  --logfacility=NAME           Syslog facility, like daemon or local0 (default daemon).
+  --loglevel=LEVEL             The lowest level that is logged to syslog or the
+                               journal: trace, debug, info, warning or error
+                               (default info).
   --internal=FILENAME          Internal log file (can be a bit verbose).
   -t, --httponly               Serve regular HTTP.
   --http2only                  Serve HTTP/2, without HTTPS.
@@ -70,6 +137,7 @@ Available flags:
   --mariadb=NAME               Use the given MariaDB or MySQL database name.
   --postgres=DSN               Use the given PostgreSQL host/database.
   --postgresdb=NAME            Use the given PostgreSQL database name.
+  --sqlite=FILENAME            Use the given SQLite database file.
   --clear                      Clear the default URI prefixes that are used
                                when handling permissions.
   -V, --verbose                Slightly more verbose logging.
@@ -81,7 +149,15 @@ Available flags:
   --nolimit                    Disable rate limiting.
   --nodb                       No database backend. (same as --boltdb=` + os.DevNull + `).
   --largesize=N                Threshold for not reading static files into memory, in bytes.
+  --gzipmin=N                  Compress responses larger than N bytes, for
+                               clients that support gzip (default ` + strconv.Itoa(gzipThreshold) + `).
+  --gzipmime=TYPES             Comma separated MIME types that are compressed,
+                               like "text/*,application/json".
   --timeout=N                  Timeout when serving files, in seconds.
+  --appcachesize=N             Maximum number of entries in AppCache
+                               (default ` + strconv.Itoa(defaultAppCacheEntries) + `).
+  --luastack=N                 Maximum depth of Lua function calls (default 256).
+  --luaregistry=N              Size of the Lua data stack (default 5120).
   -l, --lua                    Don't serve anything, just present the Lua REPL.
   -s, --server                 Server mode (disable debug + interactive mode).
   -q, --quiet                  Don't output anything to stdout or stderr.
@@ -99,12 +175,170 @@ Available flags:
   -c, --statcache              Speed up responses by caching os.Stat.
                                Only use if served files will not be removed.
   --accesslog=FILENAME         Access log filename. Logged in Combined Log Format (CLF).
+  --accesslogtime              Add the time it took to serve each request to the
+                               access log, in microseconds, like %D in Apache.
   --ncsa=FILENAME              Alternative access log filename. Logged in Common Log Format (NCSA).
+  --jsonlog=FILENAME           Request log filename. Logged as one JSON object per line.
+  --jsonlogsize=MB             Rotate the request log when it is larger (default 100).
+  --jsonlogage=DURATION        Rotate the request log when it is older (default 24h).
+  --jsonlogkeep=N              How many rotated request logs to keep (default 7).
+  --record=FILENAME            Record requests and responses to a file, as one
+                               JSON object per line. Passwords, tokens, keys
+                               and cookies are not recorded.
+  --replay FILE URL            Send the requests that were recorded with
+                               --record to the server at the given URL, and
+                               output the differences between the recorded
+                               responses and the new ones.
   -x, --simple                 Serve as regular HTTP, enable server mode and
                                disable all features that requires a database.
   --domain                     Serve files from the subdirectory with the same
                                name as the requested domain.
   -u                           Serve over QUIC.
+  --autocert=DOMAINS           Obtain and renew certificates for the given
+                               comma separated domains from Let's Encrypt.
+                               Serves HTTPS on port 443 and HTTP on port 80.
+  --autocertemail=EMAIL        E-mail address for the Let's Encrypt account.
+  --autocertdir=DIR            Directory for storing the certificates. If not
+                               given, Redis is used if it is the database
+                               backend, or else a directory in the user
+                               cache directory.
+  --autocertdns=PROVIDER       Use the DNS-01 challenge, which is needed for
+                               wildcard domains like *.example.com. The
+                               provider is "cloudflare", with a token in
+                               CLOUDFLARE_API_TOKEN, or "exec:COMMAND".
+  --forwardheaders=HEADERS     Comma separated request headers that are passed
+                               on when Lua scripts send requests to other
+                               services (the default is ` + strings.Join(defaultForwardHeaders, ",") + `).
+                               Every request gets an X-Request-ID. Use "none"
+                               for not passing on any headers.
+  --loginurl=URL               Redirect browsers to this login page when
+                               permission is denied and they are not logged in.
+                               The requested URL is added as the "return"
+                               parameter. API clients get 401 Unauthorized.
+  --sessiontimeout=SECONDS     How long logins last. Older logins are rejected
+                               by the server, not only by the browser.
+  --slidingsessions            Renew logins while they are in use, so that
+                               --sessiontimeout is counted from the last visit.
+  --rememberdays=DAYS          How long "remember me" tokens last (the default
+                               is 30 days).
+  --maxsessions=N              How many browsers or devices each user can be
+                               logged in from at the same time. Logging in from
+                               one more ends the least recently used session.
+  --visitorconsent             Only give visitors an anonymous visitor ID after
+                               SetVisitorConsent(true) has been called.
+  --visitordays=DAYS           How many days before visitors get a new visitor
+                               ID (the default is 30 days).
+  --urlprefix=PATH             Serve everything under the given base path, like
+                               /myapp, for when behind a reverse proxy that
+                               passes on a sub-path. Redirects and generated
+                               links include the base path.
+  --fastcgi=ADDRESS            Pass requests for .php files on to a FastCGI
+                               server, like php-fpm. Takes a unix socket or
+                               HOST:PORT.
+  --fastcgiext=EXTENSIONS      Comma separated filename extensions for the
+                               FastCGI server (the default is ".php").
+  --ctl=FILENAME               Serve a control socket with a JSON API, for
+                               the data, users, cache, reload, maintenance,
+                               metrics and routes subcommands. Can also be
+                               localhost:PORT. When running a subcommand,
+                               select the socket to connect to
+                               (the default is ` + ac.defaultControlFilename + `).
+  --ctltoken=TOKEN             Require a bearer token for the control socket.
+                               Required if listening on a port. Can also be
+                               set with the ALGERNON_CTL_TOKEN variable.
+  --pprof=ADDRESS              Serve the net/http/pprof endpoints at
+                               localhost:PORT or at a Unix socket, for
+                               profiling. Requires the --ctltoken, if given.
+  --deterministic              Seed the random numbers in Lua with the URL
+                               instead of with a random seed, and use a fixed
+                               time for os.time, os.date and unixnano, for
+                               reproducible tests and static sites. The time
+                               is SOURCE_DATE_EPOCH, if set.
+  --listen=[SCHEME://][HOST]:PORT
+                               Also serve on the given address. The scheme is
+                               http (the default), https or redirect, which
+                               redirects to HTTPS. Can be given several times.
+  --unixsocket=FILENAME        Serve regular HTTP on a Unix socket instead of
+                               on a TCP port, for when behind a reverse proxy
+                               on the same host.
+  --unixsocketmode=MODE        Permissions of the Unix socket, in octal
+                               (the default is ` + defaultUnixSocketMode + `).
+  --unixsocketowner=USER:GROUP Owner and group of the Unix socket.
+  --sftp=[HOST]:PORT           Serve SFTP on the given address, for publishing
+                               files to the server directory with sftp or scp.
+                               The file cache is cleared when files change.
+  --sftpkeys=FILE              The authorized_keys file with the public keys
+                               that can log in with SFTP. Required by --sftp.
+  --sftphostkey=FILE           The host key for SFTP, in PEM format. An Ed25519
+                               key is created if it does not exist (the default
+                               is in the user cache directory).
+  --sign ARCHIVE KEYFILE [VERSION]
+                               Sign an .alg archive with an Ed25519 private key
+                               in a PEM file, and optionally store a version
+                               number in it. A new key pair is created if the
+                               key file does not exist.
+  --trustkey=FILE              Only serve .alg archives that are signed with
+                               one of the public keys in the given PEM file.
+                               Archives with a signature that does not match
+                               their contents are always refused.
+  --update                     Update the executable to the latest release from
+                               the --updateurl endpoint, if it is newer. The
+                               release must be signed with one of the keys in
+                               --updatekey. The previous executable is put
+                               back if the new one does not pass a health
+                               check.
+  --updateurl=URL              Release endpoint that returns JSON with the
+                               version and a URL and a SHA-256 hash for each
+                               platform, signed in the same URL with .sig
+                               added. Can also be set with the
+                               ALGERNON_UPDATE_URL variable.
+  --updatekey=FILE             PEM file with the public keys that releases can
+                               be signed with. Can also be set with the
+                               ALGERNON_UPDATE_KEY variable.
+  --schema                     Output a JSON schema of the flags, the server
+                               configuration functions and the Lua functions
+                               that are available to handlers, for editors
+                               and linters.
+  --emit-stubs                 Output EmmyLua/LuaLS annotation stubs of the Lua
+                               functions, with the parameters and the return
+                               values, for completion and type hints in
+                               editors.
+  --grace=DURATION             When shutting down, how long the requests that
+                               are being served can take to finish, before the
+                               connections are closed (the default is 10s).
+  --quarantine=N               Stop running a Lua handler for a while when it
+                               has failed N times in a row. The last good
+                               response for the URL is served instead, or a
+                               "503 Service Unavailable" page. The admin users
+                               are notified. Not used in debug mode.
+  --quarantinetime=DURATION    How long Lua handlers are kept in quarantine
+                               (the default is 1m).
+  --health                     Serve JSON health and readiness endpoints, for
+                               load balancers and Kubernetes probes. The
+                               health endpoint checks the Lua state pool. The
+                               readiness endpoint also checks the database
+                               and maintenance mode.
+  --healthpath=PATH            Path of the health endpoint
+                               (the default is ` + defaultHealthPath + `).
+  --readypath=PATH             Path of the readiness endpoint
+                               (the default is ` + defaultReadyPath + `).
+  --paymentkey=KEY             Secret key for a Stripe-compatible payment
+                               provider. Can also be set with the
+                               ALGERNON_PAYMENT_KEY variable.
+  --paymentwebhooksecret=KEY   Secret for checking payment webhook events.
+                               Can also be set with the
+                               ALGERNON_PAYMENT_WEBHOOK_SECRET variable.
+  --paymentapi=URL             API of the payment provider
+                               (the default is ` + payment.DefaultAPIURL + `).
+  --contentdir=DIR             Directory for uploaded files that are stored
+                               by hash, and served from /_content/.
+  --clientca=FILE              Require client certificates that are signed
+                               by one of the certificate authorities in the
+                               given PEM file.
+  --clientcrl=FILE             Reject client certificates that are in the
+                               given certificate revocation list.
+  --clientcertoptional         Only verify client certificates if they are
+                               given, instead of requiring them.
 
 
 Example usage:
@@ -121,6 +355,10 @@ Example usage:
   Serve the current directory over HTTP, port 3000. No limits, cache,
   permissions or database connections:
     algernon -x
+
+  Serve the current directory with a control socket, then list all users:
+    algernon --ctl=/tmp/algernon.sock -e
+    algernon --ctl=/tmp/algernon.sock users list
 `)
 	}
 }
@@ -140,6 +378,12 @@ func (ac *Config) handleFlags(serverTempDir string) {
 		rawCache bool
 		// Used if disabling the database backend
 		noDatabase bool
+		// Comma separated request headers to pass on to other services
+		forwardHeadersString string
+		// Comma separated index filenames
+		indexString string
+		// Comma separated MIME types that are compressed
+		gzipMIMEString string
 	)
 
 	// The usage function that provides more help (for --help or -h)
@@ -154,6 +398,8 @@ func (ac *Config) handleFlags(serverTempDir string) {
 		ac.defaultBoltFilename = filepath.Join(serverTempDir, "algernon.db")
 		// Default log file
 		ac.defaultLogFile = filepath.Join(serverTempDir, "algernon.log")
+		// Default control socket
+		ac.defaultControlFilename = filepath.Join(serverTempDir, "algernon.sock")
 	}
 
 	// Commandline flag configuration
@@ -162,15 +408,36 @@ func (ac *Config) handleFlags(serverTempDir string) {
 	flag.StringVar(&ac.serverAddr, "addr", "", "Server [host][:port] (ie \":443\")")
 	flag.StringVar(&ac.serverCert, "cert", "cert.pem", "Server certificate")
 	flag.StringVar(&ac.serverKey, "key", "key.pem", "Server key")
+	flag.Var(certFlag{ac: ac}, "certpair", "Another TLS certificate and key, as CERTFILE,KEYFILE")
+	flag.Var(certFlag{ac: ac, dir: true}, "certdir", "Directory with TLS certificates and keys")
+	flag.BoolVar(&ac.noOCSP, "noocsp", false, "Don't staple OCSP responses")
+	flag.StringVar(&ac.tlsProfileName, "tlsprofile", defaultTLSProfile, "TLS profile: modern, intermediate or old")
+	flag.StringVar(&ac.tlsMinVersion, "tlsmin", "", "The lowest TLS version to allow")
+	flag.StringVar(&ac.tlsCiphers, "ciphers", "", "Cipher suites to allow for TLS 1.2 and lower")
+	flag.BoolVar(&ac.forceHTTPS, "forcehttps", false, "Redirect plain HTTP to HTTPS and use HSTS")
+	flag.DurationVar(&ac.hstsMaxAge, "hsts", 0, "The max-age of the Strict-Transport-Security header")
+	flag.BoolVar(&ac.hstsSubdomains, "hstssubdomains", false, "Include subdomains in the HSTS header")
+	flag.BoolVar(&ac.hstsPreload, "hstspreload", false, "Allow HSTS preloading")
+	flag.IntVar(&ac.maxConns, "maxconns", 0, "The largest number of open connections")
+	flag.IntVar(&ac.maxConnsPerIP, "maxconnsperip", 0, "The largest number of open connections per IP address")
+	flag.Float64Var(&ac.connRate, "connrate", 0, "New connections per second per IP address")
+	flag.StringVar(&ac.trustedProxiesList, "trustedproxies", "", "Reverse proxies that X-Forwarded-For is trusted from")
+	flag.StringVar(&ac.fallbackFilename, "fallbackfile", "", "JSON file for the in-memory database that is used if Redis is unreachable")
 	flag.StringVar(&ac.redisAddr, "redis", "", "Redis [host][:port] (ie \""+ac.defaultRedisColonPort+"\")")
 	flag.IntVar(&ac.redisDBindex, "dbindex", 0, "Redis database index")
 	flag.StringVar(&ac.serverConfScript, "conf", "serverconf.lua", "Server configuration")
+	flag.StringVar(&ac.appFilename, "app", "app.lua", "Lua application script")
 	flag.StringVar(&ac.serverLogFile, "log", "", "Server log file")
+	flag.StringVar(&ac.syslogAddress, "syslog", "", "Log to syslog (\"local\" or an address)")
+	flag.BoolVar(&ac.journald, "journald", false, "Log to the systemd journal")
+	flag.StringVar(&ac.logFacility, "logfacility", "daemon", "Syslog facility")
+	flag.StringVar(&ac.logLevel, "loglevel", "info", "Lowest level to log to syslog or the journal")
 	flag.StringVar(&ac.internalLogFilename, "internal", os.DevNull, "Internal log file")
 	flag.BoolVar(&ac.serveJustHTTP2, "http2only", false, "Serve HTTP/2, not HTTPS + HTTP/2")
 	flag.BoolVar(&ac.serveJustHTTP, "httponly", false, "Serve plain old HTTP")
 	flag.BoolVar(&ac.productionMode, "prod", false, "Production mode")
 	flag.BoolVar(&ac.debugMode, "debug", false, "Debug mode")
+	flag.BoolVar(&ac.a11yAudit, "a11y", false, "Check rendered HTML for accessibility problems, in debug mode")
 	flag.BoolVar(&ac.verboseMode, "verbose", false, "Verbose logging")
 	flag.BoolVar(&ac.autoRefresh, "autorefresh", false, "Enable the auto-refresh feature")
 	flag.StringVar(&ac.autoRefreshDir, "watchdir", "", "Directory to watch (also enables auto-refresh)")
@@ -181,6 +448,7 @@ func (ac *Config) handleFlags(serverTempDir string) {
 	flag.StringVar(&ac.mariaDatabase, "mariadb", "", "MariaDB/MySQL database name")
 	flag.StringVar(&ac.postgresDSN, "postgres", "", "PostgreSQL connection string (DSN)")
 	flag.StringVar(&ac.postgresDatabase, "postgresdb", "", "PostgreSQL database name")
+	flag.StringVar(&ac.sqliteFilename, "sqlite", "", "SQLite database filename")
 	flag.BoolVar(&ac.useBolt, "bolt", false, "Use the default Bolt filename")
 	flag.StringVar(&ac.boltFilename, "boltdb", "", "Bolt database filename")
 	flag.Int64Var(&ac.limitRequests, "limit", ac.defaultLimit, "Limit clients to a number of requests per second")
@@ -189,8 +457,14 @@ func (ac *Config) handleFlags(serverTempDir string) {
 	flag.BoolVar(&ac.showVersion, "version", false, "Version")
 	flag.StringVar(&cacheModeString, "cache", "", "Cache everything but Amber, Lua, GCSS and Markdown")
 	flag.Uint64Var(&ac.cacheSize, "cachesize", ac.defaultCacheSize, "Cache size, in bytes")
+	flag.DurationVar(&ac.cacheTTL, "cachettl", 0, "How long static files are cached, like 10m (0 for no limit)")
 	flag.Uint64Var(&ac.largeFileSize, "largesize", ac.defaultLargeFileSize, "Threshold for not reading static files into memory, in bytes")
+	flag.IntVar(&ac.gzipMinSize, "gzipmin", gzipThreshold, "Compress responses larger than this, in bytes")
+	flag.StringVar(&gzipMIMEString, "gzipmime", defaultGzipMIMETypes, "Comma separated MIME types that are compressed")
 	flag.Uint64Var(&ac.writeTimeout, "timeout", 10, "Timeout when writing to a client, in seconds")
+	flag.IntVar(&ac.appCache.maxEntries, "appcachesize", defaultAppCacheEntries, "Maximum number of entries in AppCache")
+	flag.IntVar(&ac.luaCallStackSize, "luastack", lua.CallStackSize, "Maximum depth of Lua function calls")
+	flag.IntVar(&ac.luaRegistrySize, "luaregistry", lua.RegistrySize, "Size of the Lua data stack")
 	flag.BoolVar(&ac.quietMode, "quiet", false, "Quiet")
 	flag.BoolVar(&rawCache, "rawcache", false, "Disable cache compression")
 	flag.StringVar(&ac.serverHeaderName, "servername", ac.versionString, "Server header name")
@@ -205,6 +479,9 @@ func (ac *Config) handleFlags(serverTempDir string) {
 	flag.BoolVar(&ac.noCache, "nocache", false, "Disable caching")
 	flag.BoolVar(&ac.noHeaders, "noheaders", false, "Don't set any HTTP headers by default")
 	flag.BoolVar(&ac.stricterHeaders, "stricter", false, "Stricter HTTP headers")
+	flag.StringVar(&indexString, "index", "", "Comma separated index filenames, in order")
+	flag.BoolVar(&ac.noListings, "nolistings", false, "Respond with 403 instead of directory listings")
+	flag.StringVar(&ac.configCheck, "configcheck", configCheckWarn, "What to do about risky configuration: warn, strict or off")
 	flag.StringVar(&ac.defaultTheme, "theme", themes.DefaultTheme, "Theme for Markdown and directory listings")
 	flag.BoolVar(&ac.noBanner, "nobanner", false, "Don't show a banner at start")
 	flag.BoolVar(&ac.ctrldTwice, "ctrld", false, "Press ctrl-d twice to exit")
@@ -212,8 +489,61 @@ func (ac *Config) handleFlags(serverTempDir string) {
 	flag.BoolVar(&noDatabase, "nodb", false, "No database backend")
 	flag.BoolVar(&ac.serveNothing, "lua", false, "Only present the Lua REPL")
 	flag.StringVar(&ac.combinedAccessLogFilename, "accesslog", "", "Combined access log filename")
+	flag.BoolVar(&ac.accessLogTime, "accesslogtime", false, "Add the time it took to serve each request to the access log")
 	flag.StringVar(&ac.commonAccessLogFilename, "ncsa", "", "NCSA access log filename")
+	flag.StringVar(&ac.jsonLogFilename, "jsonlog", "", "JSON request log filename")
+	flag.Int64Var(&ac.jsonLogSize, "jsonlogsize", 100, "Rotate the JSON request log when it is larger, in megabytes")
+	flag.DurationVar(&ac.jsonLogAge, "jsonlogage", 24*time.Hour, "Rotate the JSON request log when it is older")
+	flag.IntVar(&ac.jsonLogKeep, "jsonlogkeep", 7, "How many rotated JSON request logs to keep")
+	flag.StringVar(&ac.recordFilename, "record", "", "Record requests and responses to this file, without secrets")
+	flag.BoolVar(&ac.replayMode, "replay", false, "Replay recorded requests against a server and compare the responses")
 	flag.BoolVar(&ac.clearDefaultPathPrefixes, "clear", false, "Clear the default URI prefixes for handling permissions")
+	flag.StringVar(&ac.controlFilename, "ctl", "", "Control socket filename")
+	flag.StringVar(&ac.pprofAddress, "pprof", "", "Serve pprof at a localhost address or a Unix socket")
+	flag.BoolVar(&ac.deterministic, "deterministic", false, "Use fixed random seeds and timestamps in Lua")
+	flag.Var(listenFlag{ac}, "listen", "Also serve on this address, can be given several times")
+	flag.StringVar(&ac.unixSocket, "unixsocket", "", "Serve HTTP on a Unix socket instead of on a TCP port")
+	flag.StringVar(&ac.unixSocketMode, "unixsocketmode", defaultUnixSocketMode, "Permissions of the Unix socket, in octal")
+	flag.StringVar(&ac.unixSocketOwner, "unixsocketowner", "", "Owner of the Unix socket, as USER[:GROUP]")
+	flag.StringVar(&ac.sftpAddress, "sftp", "", "Serve SFTP for publishing files at this address")
+	flag.StringVar(&ac.sftpKeys, "sftpkeys", "", "Public keys that can log in with SFTP")
+	flag.StringVar(&ac.sftpHostKey, "sftphostkey", "", "The host key for SFTP")
+	flag.BoolVar(&ac.signBundle, "sign", false, "Sign an .alg archive with a private key")
+	flag.StringVar(&ac.trustKeyFilename, "trustkey", "", "Only serve .alg archives that are signed with one of these public keys")
+	flag.BoolVar(&ac.updateMode, "update", false, "Update the executable to the latest release")
+	flag.StringVar(&ac.updateURL, "updateurl", os.Getenv("ALGERNON_UPDATE_URL"), "Release endpoint for --update")
+	flag.StringVar(&ac.updateKeyFilename, "updatekey", os.Getenv("ALGERNON_UPDATE_KEY"), "Public keys for verifying releases")
+	flag.BoolVar(&ac.printSchema, "schema", false, "Output a JSON schema of the flags and the Lua functions")
+	flag.BoolVar(&ac.emitStubs, "emit-stubs", false, "Output annotation stubs of the Lua functions, for the Lua language server")
+	flag.IntVar(&ac.quarantineThreshold, "quarantine", 0, "Quarantine Lua handlers that fail this many times in a row")
+	flag.DurationVar(&ac.quarantineDuration, "quarantinetime", time.Minute, "How long Lua handlers are kept in quarantine")
+	flag.DurationVar(&ac.shutdownTimeout, "grace", ac.shutdownTimeout, "How long requests can take to finish when shutting down")
+	flag.BoolVar(&ac.healthEndpoints, "health", false, "Serve health and readiness endpoints")
+	flag.StringVar(&ac.healthPath, "healthpath", defaultHealthPath, "Path of the health endpoint")
+	flag.StringVar(&ac.readyPath, "readypath", defaultReadyPath, "Path of the readiness endpoint")
+	flag.StringVar(&ac.autocertDomains, "autocert", "", "Domains for obtaining certificates from Let's Encrypt")
+	flag.StringVar(&ac.autocertEmail, "autocertemail", "", "E-mail address for the Let's Encrypt account")
+	flag.StringVar(&ac.autocertDir, "autocertdir", "", "Directory for storing certificates from Let's Encrypt")
+	flag.StringVar(&ac.autocertDNS, "autocertdns", "", "DNS provider for the DNS-01 challenge")
+	flag.StringVar(&forwardHeadersString, "forwardheaders", strings.Join(defaultForwardHeaders, ","), "Request headers to pass on to other services")
+	flag.StringVar(&ac.loginURL, "loginurl", "", "Login page for when permission is denied")
+	flag.Int64Var(&ac.sessionTimeout, "sessiontimeout", 0, "How long logins last, in seconds")
+	flag.BoolVar(&ac.slidingSessions, "slidingsessions", false, "Renew logins while they are in use")
+	flag.IntVar(&ac.rememberDays, "rememberdays", defaultRememberDays, "How many days remember me tokens last")
+	flag.IntVar(&ac.maxSessions, "maxsessions", 0, "Maximum number of sessions per user")
+	flag.BoolVar(&ac.visitorConsent, "visitorconsent", false, "Only give visitors a visitor ID after SetVisitorConsent(true)")
+	flag.IntVar(&ac.visitorDays, "visitordays", defaultVisitorDays, "How many days before visitors get a new visitor ID")
+	flag.StringVar(&ac.urlPrefix, "urlprefix", "", "Base path to serve everything under")
+	flag.StringVar(&ac.fastcgiAddress, "fastcgi", "", "FastCGI server for .php files")
+	flag.StringVar(&ac.fastcgiExtensions, "fastcgiext", ".php", "Filename extensions for the FastCGI server")
+	flag.StringVar(&ac.controlToken, "ctltoken", os.Getenv("ALGERNON_CTL_TOKEN"), "Token for the control socket")
+	flag.StringVar(&ac.paymentAPI, "paymentapi", payment.DefaultAPIURL, "API of the payment provider")
+	flag.StringVar(&ac.paymentKey, "paymentkey", os.Getenv("ALGERNON_PAYMENT_KEY"), "Secret key for the payment provider")
+	flag.StringVar(&ac.paymentWebhookSecret, "paymentwebhooksecret", os.Getenv("ALGERNON_PAYMENT_WEBHOOK_SECRET"), "Secret for payment provider webhooks")
+	flag.StringVar(&ac.contentDir, "contentdir", "", "Directory for content that is stored by hash")
+	flag.StringVar(&ac.clientCA, "clientca", "", "Certificate authorities for client certificates")
+	flag.StringVar(&ac.clientCRL, "clientcrl", "", "Revocation list for client certificates")
+	flag.BoolVar(&ac.clientCertOptional, "clientcertoptional", false, "Only verify client certificates if they are given")
 
 	// The short versions of some flags
 	flag.BoolVar(&serveJustHTTPShort, "t", false, "Serve plain old HTTP")
@@ -349,6 +679,42 @@ func (ac *Config) handleFlags(serverTempDir string) {
 		ac.cacheFileStat = false
 	}
 
+	// The request headers that are passed on to other services
+	ac.forwardHeaders = parseForwardHeaders(forwardHeadersString)
+
+	// The MIME types of the responses that are compressed
+	ac.gzipMIMETypes = parseGzipMIMETypes(gzipMIMEString)
+
+	// The index filenames, and if directories without one are listed
+	ac.indexFilenames = splitFilenames(indexString)
+	ac.dirListing.Set(ac.defaultDirListingOptions())
+
+	// The base path that everything is served under
+	ac.urlPrefix = cleanURLPrefix(ac.urlPrefix)
+
+	// For checkout sessions, webhook events and subscriptions
+	ac.payments = payment.NewClient(ac.paymentAPI, ac.paymentKey, ac.paymentWebhookSecret)
+
+	// For files that are stored by hash, with StoreContent
+	if ac.contentDir != "" {
+		ac.content = contentstore.New(ac.contentDir)
+	}
+
+	// Pass requests for the given filename extensions on to a FastCGI server
+	if ac.fastcgiAddress != "" {
+		client := newFastCGIClient(ac.fastcgiAddress)
+		for _, ext := range strings.Split(ac.fastcgiExtensions, ",") {
+			ext = strings.TrimSpace(ext)
+			if ext == "" {
+				continue
+			}
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			ac.fastcgi.Set(nil, ext, client)
+		}
+	}
+
 	// Convert the request limit to a string
 	ac.limitRequestsString = strconv.FormatInt(ac.limitRequests, 10)
 
@@ -385,6 +751,28 @@ func (ac *Config) handleFlags(serverTempDir string) {
 		ac.cacheMaxEntitySize = ac.defaultCacheMaxEntitySize
 	}
 
+	// Signing an archive, as "algernon --sign ARCHIVE KEYFILE [VERSION]"
+	if ac.signBundle {
+		ac.signArgs = flag.Args()
+		return
+	}
+
+	// Replaying recorded requests, as "algernon --replay FILE URL"
+	if ac.replayMode {
+		ac.replayArgs = flag.Args()
+		return
+	}
+
+	// Subcommands are sent to a running instance, unless a file or directory
+	// with the same name exists
+	if isControlCommand(flag.Args()) {
+		fs := datablock.NewFileStat(false, ac.defaultStatCacheRefresh)
+		if !fs.Exists(flag.Args()[0]) {
+			ac.controlArgs = flag.Args()
+			return
+		}
+	}
+
 	// For backward compatibility with previous versions of Algernon
 	// TODO: Remove, in favor of a better config/flag system
 	serverAddrChanged := false
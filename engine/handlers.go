@@ -14,6 +14,7 @@ import (
 	"github.com/didip/tollbooth"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/xyproto/algernon/lua/httperror"
 	"github.com/xyproto/algernon/themes"
 	"github.com/xyproto/algernon/utils"
 	"github.com/xyproto/datablock"
@@ -23,7 +24,7 @@ import (
 )
 
 const (
-	// Gzip content over this size
+	// Gzip content over this size, by default
 	gzipThreshold = 4096
 
 	// Used for deciding how long to wait before quitting when only serving a single file and starting a browser
@@ -32,6 +33,11 @@ const (
 
 // ClientCanGzip checks if the client supports gzip compressed responses
 func (ac *Config) ClientCanGzip(req *http.Request) bool {
+	// Ranges are for the bytes of the file, so partial responses are not
+	// compressed, or else seeking in audio and video would not work
+	if req.Header.Get("Range") != "" {
+		return false
+	}
 	// Curl does not use --compressed by default. This causes problems when
 	// serving gzipped contents when curl is run without --compressed!
 	// The wrong data, of the same size, will be downloaded. Beware!
@@ -108,7 +114,7 @@ func (ac *Config) PongoHandler(w http.ResponseWriter, req *http.Request, filenam
 
 // ReadAndLogErrors tries to read a file, and logs an error if it could not be read
 func (ac *Config) ReadAndLogErrors(w http.ResponseWriter, filename, ext string) (*datablock.DataBlock, error) {
-	byteblock, err := ac.cache.Read(filename, ac.shouldCache(ext))
+	byteblock, err := ac.readFile(filename, ext)
 	if err != nil {
 		if ac.debugMode {
 			fmt.Fprintf(w, "Unable to read %s: %s", filename, err)
@@ -137,6 +143,18 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 		ext = ".hyper.jsx"
 	}
 
+	// Pass the request on to a FastCGI server, if one is set up for this extension
+	if client := ac.fastcgi.Get(ac.requestMux(req), ext); client != nil {
+		ac.FastCGIPage(w, req, ac.fastcgiServeDir(req), filename, req.URL.Path, "", client)
+		return
+	}
+
+	// Render the file, if there is a renderer for this extension, like ".md"
+	if renderer := ac.renderers.Get(ac.requestMux(req), ext); renderer != nil {
+		renderer.Render(w, req, filename, ext)
+		return
+	}
+
 	// Serve the file in different ways based on the filename extension
 	switch ext {
 
@@ -144,6 +162,11 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 	case ".html", ".htm":
 		w.Header().Add("Content-Type", "text/html;charset=utf-8")
 
+		// Serve a precompressed file, like index.html.br, if the page is not changed
+		if !ac.autoRefresh && ac.servePrecompressed(w, req, filename) {
+			return
+		}
+
 		// Read the file (possibly in compressed format, straight from the cache)
 		htmlblock, err := ac.ReadAndLogErrors(w, filename, ext)
 		if err != nil {
@@ -160,74 +183,11 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 			ac.DataToClient(w, req, filename, htmldata)
 		} else {
 			// Serve the file
-			htmlblock.ToClient(w, req, filename, ac.ClientCanGzip(req), gzipThreshold)
+			ac.BlockToClient(w, req, filename, htmlblock)
 		}
 
 		return
 
-	case ".md", ".markdown":
-		w.Header().Add("Content-Type", "text/html;charset=utf-8")
-		if markdownblock, err := ac.ReadAndLogErrors(w, filename, ext); err == nil { // if no error
-			// Render the markdown page
-			ac.MarkdownPage(w, req, markdownblock.MustData(), filename)
-		}
-		return
-
-	case ".amber", ".amb":
-		w.Header().Add("Content-Type", "text/html;charset=utf-8")
-		amberblock, err := ac.ReadAndLogErrors(w, filename, ext)
-		if err != nil {
-			return
-		}
-
-		// Try reading luaDataFilename as well, if possible
-		luafilename := filepath.Join(filepath.Dir(filename), ac.defaultLuaDataFilename)
-		luablock, err := ac.cache.Read(luafilename, ac.shouldCache(ext))
-		if err != nil {
-			// Could not find and/or read luaDataFilename
-			luablock = datablock.EmptyDataBlock
-		}
-		// Make functions from the given Lua data available
-		funcs := make(template.FuncMap)
-		// luablock can be empty if there was an error or if the file was empty
-		if luablock.HasData() {
-			// There was Lua code available. Now make the functions and
-			// variables available for the template.
-			funcs, err = ac.LuaFunctionMap(w, req, luablock.MustData(), luafilename)
-			if err != nil {
-				if ac.debugMode {
-					// Use the Lua filename as the title
-					ac.PrettyError(w, req, luafilename, luablock.MustData(), err.Error(), "lua")
-				} else {
-					log.Error(err)
-				}
-				return
-			}
-			if ac.debugMode && ac.verboseMode {
-				s := "These functions from " + luafilename
-				s += " are useable for " + filename + ": "
-				// Create a comma separated list of the available functions
-				for key := range funcs {
-					s += key + ", "
-				}
-				// Remove the final comma
-				if strings.HasSuffix(s, ", ") {
-					s = s[:len(s)-2]
-				}
-				// Output the message
-				log.Info(s)
-			}
-		}
-
-		// Render the Amber page, using functions from luaDataFilename, if available
-		ac.AmberPage(w, req, filename, amberblock.MustData(), funcs)
-
-		return
-
-	case ".po2", ".pongo2", ".tpl", ".tmpl":
-		ac.PongoHandler(w, req, filename, ext)
-		return
-
 	case ".alg":
 		// Assume this to be a compressed Algernon application
 		tempdir := ac.serverTempDir
@@ -243,91 +203,7 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 		return
 
 	case ".lua":
-		// If in debug mode, let the Lua script print to a buffer first, in
-		// case there are errors that should be displayed instead.
-
-		// If debug mode is enabled
-		if ac.debugMode {
-			// Use a buffered ResponseWriter for delaying the output
-			recorder := httptest.NewRecorder()
-			// Create a new struct for keeping an optional http header status
-			httpStatus := &FutureStatus{}
-			// The flush function writes the ResponseRecorder to the ResponseWriter
-			flushFunc := func() {
-				utils.WriteRecorder(w, recorder)
-				recwatch.Flush(w)
-			}
-			// Run the lua script, without the possibility to flush
-			if err := ac.RunLua(recorder, req, filename, flushFunc, httpStatus); err != nil {
-				errortext := err.Error()
-				fileblock, err := ac.cache.Read(filename, ac.shouldCache(ext))
-				if err != nil {
-					// If the file could not be read, use the error message as the data
-					// Use the error as the file contents when displaying the error message
-					// if reading the file failed.
-					fileblock = datablock.NewDataBlock([]byte(err.Error()), true)
-				}
-				// If there were errors, display an error page
-				ac.PrettyError(w, req, filename, fileblock.MustData(), errortext, "lua")
-			} else {
-				// If things went well, check if there is a status code we should write first
-				// (especially for the case of a redirect)
-				if httpStatus.code != 0 {
-					w.WriteHeader(httpStatus.code)
-				}
-				// Then write to the ResponseWriter
-				utils.WriteRecorder(w, recorder)
-			}
-		} else {
-			// The flush function just flushes the ResponseWriter
-			flushFunc := func() {
-				recwatch.Flush(w)
-			}
-			// Run the lua script, with the flush feature
-			if err := ac.RunLua(w, req, filename, flushFunc, nil); err != nil {
-				// Output the non-fatal error message to the log
-				if strings.HasPrefix(err.Error(), filename) {
-					log.Error("Error at " + err.Error())
-				} else {
-					log.Error("Error in " + filename + ": " + err.Error())
-				}
-			}
-		}
-		return
-
-	case ".gcss":
-		if gcssblock, err := ac.ReadAndLogErrors(w, filename, ext); err == nil { // if no error
-			w.Header().Add("Content-Type", "text/css;charset=utf-8")
-			// Render the GCSS page as CSS
-			ac.GCSSPage(w, req, filename, gcssblock.MustData())
-		}
-		return
-
-	case ".scss":
-		if scssblock, err := ac.ReadAndLogErrors(w, filename, ext); err == nil { // if no error
-			// Render the SASS page (with .scss extension) as CSS
-			w.Header().Add("Content-Type", "text/css;charset=utf-8")
-			ac.SCSSPage(w, req, filename, scssblock.MustData())
-		}
-		return
-
-	case ".happ", ".hyper", ".hyper.jsx", ".hyper.js": // hyperApp JSX -> JS, wrapped in HTML
-		if jsxblock, err := ac.ReadAndLogErrors(w, filename, ext); err == nil { // if no error
-			// Render the JSX page as HTML with embedded JavaScript
-			w.Header().Add("Content-Type", "text/html;charset=utf-8")
-			ac.HyperAppPage(w, req, filename, jsxblock.MustData())
-		} else {
-			log.Error("Error when serving " + filename + ":" + err.Error())
-		}
-		return
-
-	// This case must come after the .hyper.jsx case
-	case ".jsx":
-		if jsxblock, err := ac.ReadAndLogErrors(w, filename, ext); err == nil { // if no error
-			// Render the JSX page as JavaScript
-			w.Header().Add("Content-Type", "text/javascript;charset=utf-8")
-			ac.JSXPage(w, req, filename, jsxblock.MustData())
-		}
+		ac.QuarantinedLuaPage(w, req, filename)
 		return
 
 	// --- End of special handlers that returns early ---
@@ -371,6 +247,11 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 
 	// TODO: Modify ac.fs to also cache .Size(), .Name() and .ModTime()
 
+	// Serve a precompressed file, like app.js.br or app.js.gz, if there is one
+	if ac.servePrecompressed(w, req, filename) {
+		return
+	}
+
 	// Check the size of the file
 	f, err := os.Open(filename)
 	if err != nil {
@@ -393,6 +274,9 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 		// http.ServeContent will first seek to the end of the file, then
 		// serve the file. The alternative here is to use io.Copy(w, f),
 		// but io.Copy does not support ranges.
+		if ac.notModified(w, req, ac.fileETag(filename, fInfo, nil), fInfo.ModTime()) {
+			return
+		}
 		http.ServeContent(w, req, fInfo.Name(), fInfo.ModTime(), f)
 
 		return
@@ -401,23 +285,109 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, d
 	// Read the file (possibly in compressed format, straight from the cache)
 	if dataBlock, err := ac.ReadAndLogErrors(w, filename, ext); err == nil { // if no error
 		// Serve the file
-		dataBlock.ToClient(w, req, filename, ac.ClientCanGzip(req), gzipThreshold)
+		ac.BlockToClient(w, req, filename, dataBlock)
 	} else {
 		log.Error("Could not serve " + filename + " with datablock.ToClient: " + err.Error())
 		return
 	}
 }
 
+// LuaPage runs the given Lua file as a handler. In debug mode, errors are
+// displayed as a pretty error page. Returns the error from the Lua script, if any.
+func (ac *Config) LuaPage(w http.ResponseWriter, req *http.Request, filename string) error {
+	// If in debug mode, let the Lua script print to a buffer first, in
+	// case there are errors that should be displayed instead.
+
+	// If debug mode is enabled
+	if ac.debugMode {
+		// Use a buffered ResponseWriter for delaying the output
+		recorder := httptest.NewRecorder()
+		// Create a new struct for keeping an optional http header status
+		httpStatus := &FutureStatus{}
+		// The flush function writes the ResponseRecorder to the ResponseWriter
+		flushFunc := func() {
+			utils.WriteRecorder(w, recorder)
+			recwatch.Flush(w)
+		}
+		// Run the lua script, without the possibility to flush
+		if err := ac.RunLua(recorder, req, filename, flushFunc, httpStatus); err != nil {
+			// An error page can not be sent in the middle of an event stream
+			if ac.endEventStream(ac.requestMux(req), w, req, err) {
+				return err
+			}
+			if isStackOverflow(err) {
+				log.Error("Stack overflow in " + filename + ": " + err.Error())
+				ac.ErrorPage(w, req, ac.stackOverflowError(err))
+				return err
+			}
+			// Errors raised with Error() are meant for the client
+			if e, ok := httperror.From(err); ok {
+				utils.CopyHeaders(w, recorder)
+				ac.ErrorPage(w, req, e)
+				return err
+			}
+			errortext := err.Error()
+			fileblock, readErr := ac.cache.Read(filename, ac.shouldCache(".lua"))
+			if readErr != nil {
+				// If the file could not be read, use the error message as the data
+				// Use the error as the file contents when displaying the error message
+				// if reading the file failed.
+				fileblock = datablock.NewDataBlock([]byte(readErr.Error()), true)
+			}
+			// If there were errors, display an error page
+			ac.PrettyError(w, req, filename, fileblock.MustData(), errortext, "lua")
+			return err
+		}
+		// If things went well, check if there is a status code we should write first
+		// (especially for the case of a redirect)
+		if httpStatus.code != 0 {
+			w.WriteHeader(httpStatus.code)
+		}
+		// Then write to the ResponseWriter
+		utils.WriteRecorder(w, recorder)
+		return nil
+	}
+	// The flush function just flushes the ResponseWriter
+	flushFunc := func() {
+		recwatch.Flush(w)
+	}
+	// Run the lua script, with the flush feature
+	if err := ac.RunLua(w, req, filename, flushFunc, nil); err != nil {
+		// An error page can not be sent in the middle of an event stream
+		if ac.endEventStream(ac.requestMux(req), w, req, err) {
+			return err
+		}
+		if isStackOverflow(err) {
+			log.Error("Stack overflow in " + filename + ": " + err.Error())
+			ac.ErrorPage(w, req, ac.stackOverflowError(err))
+			return err
+		}
+		// Errors raised with Error() are meant for the client
+		if e, ok := httperror.From(err); ok {
+			ac.ErrorPage(w, req, e)
+			return err
+		}
+		// Output the non-fatal error message to the log
+		if strings.HasPrefix(err.Error(), filename) {
+			log.Error("Error at " + err.Error())
+		} else {
+			log.Error("Error in " + filename + ": " + err.Error())
+		}
+		return err
+	}
+	return nil
+}
+
 // ServerHeaders sets the HTTP headers that are set before anything else
 func (ac *Config) ServerHeaders(w http.ResponseWriter) {
 	w.Header().Set("Server", ac.serverHeaderName)
 	if !ac.autoRefresh {
-		w.Header().Set("X-XSS-Protection", "1; mode=block")
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		setDefaultHeader(w.Header(), "X-XSS-Protection", "1; mode=block")
+		setDefaultHeader(w.Header(), "X-Content-Type-Options", "nosniff")
+		setDefaultHeader(w.Header(), "X-Frame-Options", "SAMEORIGIN")
 	}
 	if !ac.autoRefresh && ac.stricterHeaders {
-		w.Header().Set("Content-Security-Policy",
+		setDefaultHeader(w.Header(), "Content-Security-Policy",
 			"connect-src 'self'; object-src 'self'; form-action 'self'")
 	}
 	// w.Header().Set("X-Powered-By", name+"/"+version)
@@ -443,10 +413,12 @@ func (ac *Config) RegisterHandlers(mux *http.ServeMux, handlePath, servedir stri
 			if ac.perm.Rejected(w, req) {
 				// Prepare to count bytes written
 				sc := sheepcounter.New(w)
+				// Keep track of the status code
+				sr := utils.NewStatusRecorder(sc)
 				// Get and call the Permission Denied function
-				ac.perm.DenyFunction()(sc, req)
+				ac.perm.DenyFunction()(sr, req)
 				// Log the response
-				ac.LogAccess(req, http.StatusForbidden, sc.Counter())
+				ac.LogAccess(req, sr.StatusCode, sc.Counter())
 				// Reject the request by just returning
 				return
 			}
@@ -459,6 +431,7 @@ func (ac *Config) RegisterHandlers(mux *http.ServeMux, handlePath, servedir stri
 		if addDomain {
 			servedir = filepath.Join(servedir, utils.GetDomain(req))
 		}
+		req = withServeDir(req, servedir)
 
 		urlpath := req.URL.Path
 		filename := utils.URL2filename(servedir, urlpath)
@@ -469,7 +442,7 @@ func (ac *Config) RegisterHandlers(mux *http.ServeMux, handlePath, servedir stri
 		}
 		hasdir := ac.fs.Exists(filename) && ac.fs.IsDir(filename)
 		dirname := filename
-		hasfile := ac.fs.Exists(noslash)
+		hasfile := ac.fs.Exists(noslash) && filepath.Base(noslash) != redirectsFilename
 
 		// Set the server headers, if not disabled
 		if !ac.noHeaders {
@@ -480,34 +453,55 @@ func (ac *Config) RegisterHandlers(mux *http.ServeMux, handlePath, servedir stri
 		if hasdir {
 			// Prepare to count bytes written
 			sc := sheepcounter.New(w)
+			// Keep track of the status code
+			sr := utils.NewStatusRecorder(sc)
 			// Get the directory page
-			ac.DirPage(sc, req, servedir, dirname, theme)
+			ac.DirPage(sr, req, servedir, dirname, theme)
 			// Log the access
-			ac.LogAccess(req, http.StatusOK, sc.Counter())
+			ac.LogAccess(req, sr.StatusCode, sc.Counter())
 			return
 		} else if !hasdir && hasfile {
 			// Prepare to count bytes written
 			sc := sheepcounter.New(w)
+			// Keep track of the status code, like 206 for partial content
+			sr := utils.NewStatusRecorder(sc)
 			// Share a single file instead of a directory
-			ac.FilePage(sc, req, noslash, ac.defaultLuaDataFilename)
+			ac.FilePage(sr, req, noslash, ac.defaultLuaDataFilename)
 			// Log the access
-			ac.LogAccess(req, http.StatusOK, sc.Counter())
+			ac.LogAccess(req, sr.StatusCode, sc.Counter())
+			return
+		}
+		// Not found, with a custom error page if there is one
+		if size, ok := ac.serveCustomErrorPage(w, req, http.StatusNotFound); ok {
+			ac.LogAccess(req, http.StatusNotFound, size)
 			return
 		}
-		// Not found
 		w.WriteHeader(http.StatusNotFound)
 		data := themes.NoPage(filename, theme)
 		ac.LogAccess(req, http.StatusNotFound, int64(len(data)))
 		w.Write(data)
 	}
 
-	// Handle requests differently depending on rate limiting being enabled or not
+	// Keep track of the route, for the management API
+	ac.routes.Add(mux, handlePath, "directory "+servedir)
+
+	// Redirects for moved pages, from a _redirects file
+	ac.loadRedirectsFile(mux, handlePath, servedir)
+
+	// With rate limiting, unless it has been disabled
+	ac.handleRateLimited(mux, handlePath, allRequests, theme)
+}
+
+// handleRateLimited registers a handler for the given path, with rate limiting
+// unless it has been disabled. The theme is used for the page that is shown
+// when the limit is reached.
+func (ac *Config) handleRateLimited(mux *http.ServeMux, handlePath string, handler http.HandlerFunc, theme string) {
 	if ac.disableRateLimiting {
-		mux.HandleFunc(handlePath, allRequests)
-	} else {
-		limiter := tollbooth.NewLimiter(float64(ac.limitRequests), nil)
-		limiter.SetMessage(themes.MessagePage("Rate-limit exceeded", "<div style='color:red'>You have reached the maximum request limit.</div>", theme))
-		limiter.SetMessageContentType("text/html;charset=utf-8")
-		mux.Handle(handlePath, tollbooth.LimitFuncHandler(limiter, allRequests))
+		mux.HandleFunc(handlePath, handler)
+		return
 	}
+	limiter := tollbooth.NewLimiter(float64(ac.limitRequests), nil)
+	limiter.SetMessage(themes.MessagePage("Rate-limit exceeded", "<div style='color:red'>You have reached the maximum request limit.</div>", theme))
+	limiter.SetMessageContentType("text/html;charset=utf-8")
+	mux.Handle(handlePath, tollbooth.LimitFuncHandler(limiter, handler))
 }
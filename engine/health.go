@@ -0,0 +1,139 @@
+package engine
+
+// Health and readiness endpoints, for load balancers and for the liveness
+// and readiness probes of Kubernetes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/xyproto/algernon/memdb"
+)
+
+const (
+	// The default paths of the health and readiness endpoints
+	defaultHealthPath = "/healthz"
+	defaultReadyPath  = "/readyz"
+
+	// How long each check can take before it counts as failed
+	healthCheckTimeout = 2 * time.Second
+)
+
+var (
+	errHealthTimeout  = errors.New("timed out")
+	errRedisFallback  = errors.New("Redis can not be reached, the in-memory database is used instead")
+	errInMaintenance  = errors.New("the server is in maintenance mode")
+	errLuaUnavailable = errors.New("the Lua state pool is not ready")
+)
+
+// healthCheck is the result of one check
+type healthCheck struct {
+	OK    bool   `json:"ok"`
+	Info  string `json:"info,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// healthStatus is the JSON that is returned by the endpoints
+type healthStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// withTimeout runs a check, but gives up after healthCheckTimeout
+func withTimeout(check func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(healthCheckTimeout):
+		return errHealthTimeout
+	}
+}
+
+// checkLua borrows a Lua state from the pool and runs a small script with it
+func (ac *Config) checkLua() error {
+	if ac.luapool == nil {
+		return errLuaUnavailable
+	}
+	return withTimeout(func() error {
+		L := ac.luapool.Get()
+		if err := L.DoString("return 1"); err != nil {
+			ac.luapool.Discard(L)
+			return err
+		}
+		L.SetTop(0)
+		ac.luapool.Put(L)
+		return nil
+	})
+}
+
+// checkDatabase pings the database backend. It fails if Redis has been
+// replaced by the in-memory database.
+func (ac *Config) checkDatabase() error {
+	if fp, ok := ac.perm.(*fallbackPermissions); ok {
+		if _, isMemory := fp.Current().(*memdb.Permissions); isMemory {
+			return errRedisFallback
+		}
+	}
+	return withTimeout(func() error {
+		return ac.perm.UserState().Host().Ping()
+	})
+}
+
+// serveHealth serves the health endpoint, which only checks that requests
+// can be served and that Lua works, and the readiness endpoint, which also
+// checks the database, maintenance mode and if the server is shutting down.
+// Both respond with JSON, and with "503 Service Unavailable" if a check
+// fails. Returns true if the request was handled.
+func (ac *Config) serveHealth(w http.ResponseWriter, req *http.Request) bool {
+	if !ac.healthEndpoints || (req.URL.Path != ac.healthPath && req.URL.Path != ac.readyPath) {
+		return false
+	}
+	status := healthStatus{Status: "ok", Checks: make(map[string]healthCheck)}
+	add := func(name, info string, err error) {
+		check := healthCheck{OK: err == nil, Info: info}
+		if err != nil {
+			check.Error = err.Error()
+			status.Status = "fail"
+		}
+		status.Checks[name] = check
+	}
+	add("lua", "", ac.checkLua())
+	if req.URL.Path == ac.readyPath {
+		if ac.perm != nil {
+			add("database", ac.dbName, ac.checkDatabase())
+		}
+		var err error
+		if ac.handler != nil && ac.handler.Maintenance() {
+			err = errInMaintenance
+		}
+		add("maintenance", "", err)
+		err = nil
+		if ac.ShuttingDown() {
+			err = errShuttingDown
+		}
+		add("shutdown", "", err)
+	}
+	code := http.StatusOK
+	if status.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if req.Method != http.MethodHead {
+		w.Write(data)
+	}
+	ac.LogAccess(req, code, int64(len(data)))
+	return true
+}
@@ -0,0 +1,301 @@
+package engine
+
+// Users for virtual hosts, that are stored together with the users of the
+// main server, but with a prefix for each host, so that one host can not
+// see or log in as the users of another host
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/xyproto/pinterface"
+)
+
+var errHostUser = errors.New("the user does not belong to this host")
+
+// hostUserState is a userstate where all the usernames have a prefix
+type hostUserState struct {
+	pinterface.IUserState
+	prefix string
+}
+
+// newHostUserState returns a userstate where all the usernames are
+// prefixed with the given prefix
+func newHostUserState(state pinterface.IUserState, prefix string) *hostUserState {
+	return &hostUserState{state, prefix}
+}
+
+// strip removes the prefix from a username. Returns false if the username
+// does not have the prefix.
+func (hs *hostUserState) strip(username string) (string, bool) {
+	if !strings.HasPrefix(username, hs.prefix) || len(username) == len(hs.prefix) {
+		return "", false
+	}
+	return username[len(hs.prefix):], true
+}
+
+// stripAll removes the prefix from the usernames that have it, and leaves
+// out the others
+func (hs *hostUserState) stripAll(usernames []string, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	var stripped []string
+	for _, username := range usernames {
+		if name, ok := hs.strip(username); ok {
+			stripped = append(stripped, name)
+		}
+	}
+	return stripped, nil
+}
+
+func (hs *hostUserState) UserRights(req *http.Request) bool {
+	username, err := hs.UsernameCookie(req)
+	return err == nil && hs.IsLoggedIn(username)
+}
+
+func (hs *hostUserState) AdminRights(req *http.Request) bool {
+	username, err := hs.UsernameCookie(req)
+	return err == nil && hs.IsLoggedIn(username) && hs.IsAdmin(username)
+}
+
+func (hs *hostUserState) UsernameCookie(req *http.Request) (string, error) {
+	username, err := hs.IUserState.UsernameCookie(req)
+	if err != nil {
+		return "", err
+	}
+	name, ok := hs.strip(username)
+	if !ok {
+		return "", errHostUser
+	}
+	return name, nil
+}
+
+func (hs *hostUserState) Username(req *http.Request) string {
+	username, _ := hs.UsernameCookie(req)
+	return username
+}
+
+func (hs *hostUserState) SetUsernameCookie(w http.ResponseWriter, username string) error {
+	return hs.IUserState.SetUsernameCookie(w, hs.prefix+username)
+}
+
+func (hs *hostUserState) Login(w http.ResponseWriter, username string) error {
+	return hs.IUserState.Login(w, hs.prefix+username)
+}
+
+func (hs *hostUserState) AllUsernames() ([]string, error) {
+	return hs.stripAll(hs.IUserState.AllUsernames())
+}
+
+func (hs *hostUserState) AllUnconfirmedUsernames() ([]string, error) {
+	return hs.stripAll(hs.IUserState.AllUnconfirmedUsernames())
+}
+
+func (hs *hostUserState) FindUserByConfirmationCode(confirmationCode string) (string, error) {
+	username, err := hs.IUserState.FindUserByConfirmationCode(confirmationCode)
+	if err != nil {
+		return "", err
+	}
+	name, ok := hs.strip(username)
+	if !ok {
+		return "", errHostUser
+	}
+	return name, nil
+}
+
+func (hs *hostUserState) ConfirmUserByConfirmationCode(confirmationCode string) error {
+	username, err := hs.FindUserByConfirmationCode(confirmationCode)
+	if err != nil {
+		return err
+	}
+	hs.Confirm(username)
+	return nil
+}
+
+func (hs *hostUserState) HasUser(username string) bool {
+	return hs.IUserState.HasUser(hs.prefix + username)
+}
+
+func (hs *hostUserState) BooleanField(username, fieldname string) bool {
+	return hs.IUserState.BooleanField(hs.prefix+username, fieldname)
+}
+
+func (hs *hostUserState) SetBooleanField(username, fieldname string, val bool) {
+	hs.IUserState.SetBooleanField(hs.prefix+username, fieldname, val)
+}
+
+func (hs *hostUserState) IsConfirmed(username string) bool {
+	return hs.IUserState.IsConfirmed(hs.prefix + username)
+}
+
+func (hs *hostUserState) IsLoggedIn(username string) bool {
+	return hs.IUserState.IsLoggedIn(hs.prefix + username)
+}
+
+func (hs *hostUserState) IsAdmin(username string) bool {
+	return hs.IUserState.IsAdmin(hs.prefix + username)
+}
+
+func (hs *hostUserState) Email(username string) (string, error) {
+	return hs.IUserState.Email(hs.prefix + username)
+}
+
+func (hs *hostUserState) PasswordHash(username string) (string, error) {
+	return hs.IUserState.PasswordHash(hs.prefix + username)
+}
+
+func (hs *hostUserState) ConfirmationCode(username string) (string, error) {
+	return hs.IUserState.ConfirmationCode(hs.prefix + username)
+}
+
+func (hs *hostUserState) AddUnconfirmed(username, confirmationCode string) {
+	hs.IUserState.AddUnconfirmed(hs.prefix+username, confirmationCode)
+}
+
+func (hs *hostUserState) RemoveUnconfirmed(username string) {
+	hs.IUserState.RemoveUnconfirmed(hs.prefix + username)
+}
+
+func (hs *hostUserState) MarkConfirmed(username string) {
+	hs.IUserState.MarkConfirmed(hs.prefix + username)
+}
+
+func (hs *hostUserState) RemoveUser(username string) {
+	hs.IUserState.RemoveUser(hs.prefix + username)
+}
+
+func (hs *hostUserState) SetAdminStatus(username string) {
+	hs.IUserState.SetAdminStatus(hs.prefix + username)
+}
+
+func (hs *hostUserState) RemoveAdminStatus(username string) {
+	hs.IUserState.RemoveAdminStatus(hs.prefix + username)
+}
+
+func (hs *hostUserState) AddUser(username, password, email string) {
+	hs.IUserState.AddUser(hs.prefix+username, password, email)
+}
+
+func (hs *hostUserState) SetLoggedIn(username string) {
+	hs.IUserState.SetLoggedIn(hs.prefix + username)
+}
+
+func (hs *hostUserState) SetLoggedOut(username string) {
+	hs.IUserState.SetLoggedOut(hs.prefix + username)
+}
+
+func (hs *hostUserState) Logout(username string) {
+	hs.IUserState.Logout(hs.prefix + username)
+}
+
+func (hs *hostUserState) CookieTimeout(username string) int64 {
+	return hs.IUserState.CookieTimeout(hs.prefix + username)
+}
+
+func (hs *hostUserState) HashPassword(username, password string) string {
+	return hs.IUserState.HashPassword(hs.prefix+username, password)
+}
+
+func (hs *hostUserState) SetPassword(username, password string) {
+	hs.IUserState.SetPassword(hs.prefix+username, password)
+}
+
+func (hs *hostUserState) CorrectPassword(username, password string) bool {
+	return hs.IUserState.CorrectPassword(hs.prefix+username, password)
+}
+
+func (hs *hostUserState) Confirm(username string) {
+	hs.IUserState.Confirm(hs.prefix + username)
+}
+
+// Users returns the user data, with the prefix added to the owners
+func (hs *hostUserState) Users() pinterface.IHashMap {
+	return &hostHashMap{hs.IUserState.Users(), hs}
+}
+
+// Creator returns a creator for data structures, with the prefix added to
+// the IDs, so that each host has its own lists, sets and maps
+func (hs *hostUserState) Creator() pinterface.ICreator {
+	return &hostCreator{hs.IUserState.Creator(), hs.prefix}
+}
+
+// hostHashMap is a hash map where the owners are prefixed
+type hostHashMap struct {
+	pinterface.IHashMap
+	hs *hostUserState
+}
+
+func (hm *hostHashMap) Set(owner, key, value string) error {
+	return hm.IHashMap.Set(hm.hs.prefix+owner, key, value)
+}
+
+func (hm *hostHashMap) Get(owner, key string) (string, error) {
+	return hm.IHashMap.Get(hm.hs.prefix+owner, key)
+}
+
+func (hm *hostHashMap) Has(owner, key string) (bool, error) {
+	return hm.IHashMap.Has(hm.hs.prefix+owner, key)
+}
+
+func (hm *hostHashMap) Exists(owner string) (bool, error) {
+	return hm.IHashMap.Exists(hm.hs.prefix + owner)
+}
+
+func (hm *hostHashMap) All() ([]string, error) {
+	return hm.hs.stripAll(hm.IHashMap.All())
+}
+
+func (hm *hostHashMap) Keys(owner string) ([]string, error) {
+	return hm.IHashMap.Keys(hm.hs.prefix + owner)
+}
+
+func (hm *hostHashMap) DelKey(owner, key string) error {
+	return hm.IHashMap.DelKey(hm.hs.prefix+owner, key)
+}
+
+func (hm *hostHashMap) Del(owner string) error {
+	return hm.IHashMap.Del(hm.hs.prefix + owner)
+}
+
+// Remove only removes the owners of this host
+func (hm *hostHashMap) Remove() error {
+	return hm.Clear()
+}
+
+// Clear only removes the owners of this host
+func (hm *hostHashMap) Clear() error {
+	owners, err := hm.All()
+	if err != nil {
+		return err
+	}
+	for _, owner := range owners {
+		if err := hm.Del(owner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hostCreator creates data structures with prefixed IDs
+type hostCreator struct {
+	pinterface.ICreator
+	prefix string
+}
+
+func (c *hostCreator) NewList(id string) (pinterface.IList, error) {
+	return c.ICreator.NewList(c.prefix + id)
+}
+
+func (c *hostCreator) NewSet(id string) (pinterface.ISet, error) {
+	return c.ICreator.NewSet(c.prefix + id)
+}
+
+func (c *hostCreator) NewHashMap(id string) (pinterface.IHashMap, error) {
+	return c.ICreator.NewHashMap(c.prefix + id)
+}
+
+func (c *hostCreator) NewKeyValue(id string) (pinterface.IKeyValue, error) {
+	return c.ICreator.NewKeyValue(c.prefix + id)
+}
@@ -0,0 +1,49 @@
+package engine
+
+// HTTP Strict Transport Security, and redirecting all plain HTTP requests
+// to HTTPS with --forcehttps
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The HSTS max-age that is used with --forcehttps, if --hsts is not given
+const defaultHSTSMaxAge = 365 * 24 * time.Hour
+
+// hstsValue returns the Strict-Transport-Security header value, or an empty
+// string if HSTS is not enabled
+func (ac *Config) hstsValue() string {
+	maxAge := ac.hstsMaxAge
+	if maxAge == 0 && ac.forceHTTPS {
+		maxAge = defaultHSTSMaxAge
+	}
+	if maxAge <= 0 {
+		return ""
+	}
+	value := "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	if ac.hstsSubdomains {
+		value += "; includeSubDomains"
+	}
+	if ac.hstsPreload {
+		value += "; preload"
+	}
+	return value
+}
+
+// hstsHandler sets the Strict-Transport-Security header for all requests
+// over TLS, if HSTS is enabled. The header can be changed or removed for
+// path prefixes with SecurityHeaders in the server configuration.
+func (ac *Config) hstsHandler(handler http.Handler) http.Handler {
+	value := ac.hstsValue()
+	if value == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,232 @@
+package engine
+
+// Allowing or blocking IP address ranges, for all requests or for path
+// prefixes, before the handlers run, and named lists of address ranges
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/gopher-lua"
+)
+
+// ipRanges is a list of address ranges, and names of lists of ranges
+type ipRanges struct {
+	nets  []*net.IPNet
+	names []string
+}
+
+// parseIPRange parses an address range like "10.0.0.0/8", or a single
+// address like "192.168.0.1" or "::1"
+func parseIPRange(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		return ipnet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("not an IP address or CIDR range: %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// ipListTable keeps the named lists of address ranges
+type ipListTable struct {
+	mut   sync.RWMutex
+	lists map[string][]*net.IPNet
+}
+
+// Add adds address ranges to the list with the given name
+func (it *ipListTable) Add(name string, nets []*net.IPNet) {
+	it.mut.Lock()
+	defer it.mut.Unlock()
+	if it.lists == nil {
+		it.lists = make(map[string][]*net.IPNet)
+	}
+	it.lists[name] = append(it.lists[name], nets...)
+}
+
+// Has checks if there is a list with the given name
+func (it *ipListTable) Has(name string) bool {
+	it.mut.RLock()
+	defer it.mut.RUnlock()
+	_, ok := it.lists[name]
+	return ok
+}
+
+// Contains checks if the named list contains the IP address
+func (it *ipListTable) Contains(name string, ip net.IP) bool {
+	it.mut.RLock()
+	defer it.mut.RUnlock()
+	for _, ipnet := range it.lists[name] {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains checks if the address is in one of the ranges or named lists
+func (ac *Config) contains(ranges ipRanges, ip net.IP) bool {
+	for _, ipnet := range ranges.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	for _, name := range ranges.names {
+		if ac.ipLists.Contains(name, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipRule allows or blocks address ranges for paths that start with the prefix
+type ipRule struct {
+	prefix string
+	allow  bool
+	ranges ipRanges
+}
+
+// pathPrefix returns the path prefix that the rule is for
+func (rule ipRule) pathPrefix() string {
+	return rule.prefix
+}
+
+// ipRuleTable keeps the allow and block rules for each mux
+type ipRuleTable = prefixTable[ipRule]
+
+// ipAllowed checks if the client address is allowed for the path. The
+// address is rejected if it is in any of the matching block rules, or if it
+// is not in the allow rule with the longest matching prefix, if there is one.
+func (ac *Config) ipAllowed(mux *http.ServeMux, req *http.Request) bool {
+	rules := ac.ipRules.Matching(mux, req.URL.Path)
+	if len(rules) == 0 {
+		return true
+	}
+	ip := net.ParseIP(ac.clientIP(req))
+	if ip == nil {
+		return false
+	}
+	var allow *ipRule
+	for i, rule := range rules {
+		if !rule.allow {
+			if ac.contains(rule.ranges, ip) {
+				return false
+			}
+			continue
+		}
+		if allow == nil || len(rule.prefix) >= len(allow.prefix) {
+			allow = &rules[i]
+		}
+	}
+	return allow == nil || ac.contains(allow.ranges, ip)
+}
+
+// ipRejected responds with "403 Forbidden" if the client address is not
+// allowed for the path. Returns true if the request has been rejected.
+func (ac *Config) ipRejected(mux *http.ServeMux, w http.ResponseWriter, req *http.Request) bool {
+	if ac.ipAllowed(mux, req) {
+		return false
+	}
+	size := ac.ErrorPage(w, req, httperror.New(http.StatusForbidden, "Access from this address is not allowed."))
+	ac.LogAccess(req, http.StatusForbidden, size)
+	return true
+}
+
+// checkIPRanges reads address ranges and list names from a Lua string or a
+// table with strings. Strings that are not addresses or ranges must be the
+// names of lists.
+func (ac *Config) checkIPRanges(L *lua.LState, n int) ipRanges {
+	var (
+		ranges  ipRanges
+		entries []string
+	)
+	switch v := L.Get(n).(type) {
+	case lua.LString:
+		entries = append(entries, string(v))
+	case *lua.LTable:
+		v.ForEach(func(_, value lua.LValue) {
+			entries = append(entries, value.String())
+		})
+	default:
+		L.TypeError(n, lua.LTTable)
+	}
+	for _, entry := range entries {
+		if ipnet, err := parseIPRange(entry); err == nil {
+			ranges.nets = append(ranges.nets, ipnet)
+		} else if ac.ipLists.Has(entry) {
+			ranges.names = append(ranges.names, entry)
+		} else {
+			L.ArgError(n, err.Error())
+		}
+	}
+	return ranges
+}
+
+// LoadIPListFunctions makes the InIPList function available to Lua scripts
+func (ac *Config) LoadIPListFunctions(req *http.Request, L *lua.LState) {
+
+	// Check if the client is in a named list of address ranges. Takes the
+	// name of a list and an optional IP address. Returns true or false.
+	L.SetGlobal("InIPList", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		ip := net.ParseIP(L.OptString(2, ac.clientIP(req)))
+		L.Push(lua.LBool(ip != nil && ac.ipLists.Contains(name, ip)))
+		return 1 // number of results
+	}))
+}
+
+// LoadIPListConfigFunctions makes the IPList function available to server
+// configuration scripts
+func (ac *Config) LoadIPListConfigFunctions(L *lua.LState) {
+
+	// Add address ranges to a named list, that can be used with AllowIPs,
+	// BlockIPs and InIPList. Takes a name and a table with addresses and
+	// CIDR ranges. Returns true.
+	L.SetGlobal("IPList", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		var nets []*net.IPNet
+		L.CheckTable(2).ForEach(func(_, value lua.LValue) {
+			ipnet, err := parseIPRange(value.String())
+			if err != nil {
+				L.ArgError(2, err.Error())
+			}
+			nets = append(nets, ipnet)
+		})
+		ac.ipLists.Add(name, nets)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
+
+// LoadIPRuleFunctions makes the AllowIPs and BlockIPs functions available
+// to server configuration scripts
+func (ac *Config) LoadIPRuleFunctions(L *lua.LState, mux *http.ServeMux) {
+
+	// Only allow the given address ranges, for all paths or for a path
+	// prefix. Takes an address, a range, the name of a list or a table with
+	// those, and an optional prefix. Returns true.
+	L.SetGlobal("AllowIPs", L.NewFunction(func(L *lua.LState) int {
+		ac.ipRules.Add(mux, ipRule{prefix: L.OptString(2, "/"), allow: true, ranges: ac.checkIPRanges(L, 1)})
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Block the given address ranges, for all paths or for a path prefix.
+	// Takes an address, a range, the name of a list or a table with those,
+	// and an optional prefix. Returns true.
+	L.SetGlobal("BlockIPs", L.NewFunction(func(L *lua.LState) int {
+		ac.ipRules.Add(mux, ipRule{prefix: L.OptString(2, "/"), ranges: ac.checkIPRanges(L, 1)})
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,65 @@
+package engine
+
+// Logging one JSON object per request, for log collectors like Logstash and
+// Loki, to a file that is rotated when it gets too large or too old
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// jsonLogEntry is one line in the JSON request log
+type jsonLogEntry struct {
+	Time      string  `json:"time"`
+	RequestID string  `json:"request_id,omitempty"`
+	IP        string  `json:"ip"`
+	User      string  `json:"user,omitempty"`
+	Method    string  `json:"method"`
+	Host      string  `json:"host"`
+	Path      string  `json:"path"`
+	Query     string  `json:"query,omitempty"`
+	Proto     string  `json:"proto"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	Duration  float64 `json:"duration_ms"`
+	Referer   string  `json:"referer,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"`
+	BotScore  int     `json:"bot_score"`
+}
+
+// logJSON writes one entry to the JSON request log, if there is one
+func (ac *Config) logJSON(req *http.Request, statusCode int, byteSize int64) {
+	if ac.jsonLog == nil {
+		return
+	}
+	entry := jsonLogEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		RequestID: req.Header.Get(requestIDHeader),
+		IP:        ac.clientIP(req),
+		Method:    req.Method,
+		Host:      req.Host,
+		Path:      req.URL.Path,
+		Query:     req.URL.RawQuery,
+		Proto:     req.Proto,
+		Status:    statusCode,
+		Bytes:     byteSize,
+		Duration:  float64(requestDuration(req)) / float64(time.Millisecond),
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	}
+	entry.BotScore, _ = ac.BotScore(req)
+	if ac.perm != nil {
+		entry.User = ac.perm.UserState().Username(req)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+	if _, err := ac.jsonLog.Write(append(data, '\n')); err != nil {
+		log.Warnf("Can not write to %s: %s", ac.jsonLogFilename, err)
+	}
+}
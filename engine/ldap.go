@@ -0,0 +1,105 @@
+package engine
+
+// Checking passwords against an LDAP server or Active Directory, while the
+// database backend is still used for logins and admin rights
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/ldap"
+	"github.com/xyproto/gopher-lua"
+)
+
+// ldapAuth keeps the LDAP configuration, if passwords are checked with LDAP
+type ldapAuth struct {
+	mut    sync.RWMutex
+	config *ldap.Config
+}
+
+// Set starts checking passwords with the given LDAP configuration, or with
+// the database backend if nil
+func (la *ldapAuth) Set(config *ldap.Config) {
+	la.mut.Lock()
+	defer la.mut.Unlock()
+	la.config = config
+}
+
+// Get returns the LDAP configuration, or nil
+func (la *ldapAuth) Get() *ldap.Config {
+	la.mut.RLock()
+	defer la.mut.RUnlock()
+	return la.config
+}
+
+// CorrectPassword checks if the password is correct for the given user, with
+// LDAP if it is configured, or else with the database backend. Users that
+// are found with LDAP are also added to the database backend, so that they
+// can be logged in and given admin rights.
+func (ac *Config) CorrectPassword(username, password string) bool {
+	if ac.perm == nil {
+		return false
+	}
+	state := ac.perm.UserState()
+	config := ac.ldap.Get()
+	if config == nil {
+		return state.CorrectPassword(username, password)
+	}
+	entry, err := config.Authenticate(username, password)
+	if err != nil {
+		if err != ldap.ErrInvalidCredentials {
+			log.Warn(err)
+		}
+		return false
+	}
+	if !state.HasUser(username) {
+		// The password in the database backend is never used
+		state.AddUser(username, randomToken(), entry.Get("mail"))
+		state.MarkConfirmed(username)
+	}
+	return true
+}
+
+// LoadLDAPFunctions makes the LDAP function available to server
+// configuration scripts
+func (ac *Config) LoadLDAPFunctions(L *lua.LState) {
+	// Check passwords with an LDAP server. Takes a table with url, base, and
+	// optionally userfilter, groupfilter, binddn, bindpassword and timeout
+	// (in seconds). Returns true if the configuration is complete.
+	L.SetGlobal("LDAP", L.NewFunction(func(L *lua.LState) int {
+		t := L.CheckTable(1)
+		field := func(name string) string {
+			return lua.LVAsString(t.RawGetString(name))
+		}
+		config := &ldap.Config{
+			URL:          field("url"),
+			BaseDN:       field("base"),
+			UserFilter:   field("userfilter"),
+			GroupFilter:  field("groupfilter"),
+			BindDN:       field("binddn"),
+			BindPassword: field("bindpassword"),
+			Timeout:      time.Duration(lua.LVAsNumber(t.RawGetString("timeout"))) * time.Second,
+		}
+		if config.URL == "" || config.BaseDN == "" || ac.perm == nil {
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		ac.ldap.Set(config)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
+
+// LoadCorrectPassword replaces the CorrectPassword function, so that
+// passwords are checked with LDAP if it is configured
+func (ac *Config) LoadCorrectPassword(L *lua.LState) {
+	// Check if a given username and password is correct, returns a bool
+	// Takes a username and password
+	L.SetGlobal("CorrectPassword", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		password := L.ToString(2)
+		L.Push(lua.LBool(ac.CorrectPassword(username, password)))
+		return 1 // number of results
+	}))
+}
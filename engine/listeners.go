@@ -0,0 +1,148 @@
+package engine
+
+// Serving the same site on several addresses at once, with --listen or with
+// Listen() in the server configuration
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errListenScheme = errors.New("the scheme of a listen address must be http, https or redirect")
+
+// listenAddress is an additional address to serve on. The scheme is "http",
+// "https" or "redirect", where "redirect" redirects all requests to HTTPS.
+type listenAddress struct {
+	scheme string
+	addr   string
+}
+
+// String returns the listen address on the same form as it is given
+func (la listenAddress) String() string {
+	return la.scheme + "://" + la.addr
+}
+
+// parseListenAddress parses "[SCHEME://][HOST]:PORT", where the scheme is
+// "http" if it is not given
+func parseListenAddress(s string) (listenAddress, error) {
+	la := listenAddress{scheme: "http", addr: s}
+	if pos := strings.Index(s, "://"); pos != -1 {
+		la.scheme, la.addr = strings.ToLower(s[:pos]), s[pos+3:]
+	}
+	switch la.scheme {
+	case "http", "https", "redirect":
+	default:
+		return la, errListenScheme
+	}
+	if _, _, err := net.SplitHostPort(la.addr); err != nil {
+		return la, err
+	}
+	return la, nil
+}
+
+// listenFlag collects the addresses that are given with repeated --listen
+// flags
+type listenFlag struct {
+	ac *Config
+}
+
+// String returns the addresses, separated by commas
+func (lf listenFlag) String() string {
+	if lf.ac == nil {
+		return ""
+	}
+	var sb strings.Builder
+	for i, la := range lf.ac.listenAddresses {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(la.String())
+	}
+	return sb.String()
+}
+
+// Set adds an address
+func (lf listenFlag) Set(s string) error {
+	return lf.ac.AddListenAddress(s)
+}
+
+// AddListenAddress adds an address to serve on, in addition to the main
+// server address, like "https://:8443"
+func (ac *Config) AddListenAddress(s string) error {
+	la, err := parseListenAddress(s)
+	if err != nil {
+		return err
+	}
+	ac.listenAddresses = append(ac.listenAddresses, la)
+	return nil
+}
+
+// httpsPort returns the port that "redirect" listeners redirect to. This is
+// the port of the first "https" listener, or of the main server address if
+// it serves HTTPS, or 443.
+func (ac *Config) httpsPort() string {
+	for _, la := range ac.listenAddresses {
+		if la.scheme == "https" {
+			_, port, _ := net.SplitHostPort(la.addr)
+			return port
+		}
+	}
+	if ac.productionMode || ac.autocertDomains != "" || ac.serveJustHTTP || ac.serveJustHTTP2 || ac.unixSocket != "" {
+		return "443"
+	}
+	if _, port, err := net.SplitHostPort(ac.serverAddr); err == nil {
+		return port
+	}
+	return "443"
+}
+
+// redirectToHTTPS redirects all requests to the same URL, with HTTPS
+func (ac *Config) redirectToHTTPS() http.Handler {
+	port := ac.httpsPort()
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		u := *req.URL
+		u.Scheme = "https"
+		u.Host = host
+		http.Redirect(w, req, u.String(), http.StatusMovedPermanently)
+	})
+}
+
+// serveListenAddresses starts serving on the addresses that are given with
+// --listen or Listen(), in addition to the main server address. Errors are
+// logged, but do not stop the main server.
+func (ac *Config) serveListenAddresses(handler http.Handler) {
+	for _, la := range ac.listenAddresses {
+		la := la
+		go func() {
+			var err error
+			switch la.scheme {
+			case "https":
+				log.Info("Also serving HTTP/2 on https://" + la.addr + "/")
+				srv := ac.NewGracefulServer(handler, true, la.addr)
+				err = ac.listenAndServeTLS(srv, ac.serverCert, ac.serverKey)
+			case "redirect":
+				log.Info("Also redirecting http://" + la.addr + "/ to HTTPS")
+				srv := ac.NewGracefulServer(ac.redirectToHTTPS(), false, la.addr)
+				err = ac.listenAndServe(srv)
+			default:
+				log.Info("Also serving HTTP on http://" + la.addr + "/")
+				srv := ac.NewGracefulServer(ac.plainHTTPHandler(handler), false, la.addr)
+				err = ac.listenAndServe(srv)
+			}
+			if err != nil {
+				log.Errorf("Could not serve %s: %s", la, err)
+			}
+		}()
+	}
+}
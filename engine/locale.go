@@ -0,0 +1,216 @@
+package engine
+
+// Formatting dates, numbers and amounts of money for the locale of the
+// request, in templates and in Lua
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xyproto/algernon/locale"
+	"github.com/xyproto/gopher-lua"
+)
+
+// The cookie that can be used for choosing a locale, instead of
+// Accept-Language
+const localeCookieName = "lang"
+
+// dateLayouts are the layouts that dates given as strings can have
+var dateLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"}
+
+// requestLocale returns the locale of a request, from the lang cookie or
+// from Accept-Language, of the locales that are set with Locales
+func (ac *Config) requestLocale(req *http.Request) *locale.Locale {
+	fallback := "en"
+	if len(ac.locales) > 0 {
+		fallback = ac.locales[0]
+	}
+	if c, err := req.Cookie(localeCookieName); err == nil && c.Value != "" {
+		if tag := locale.Negotiate(c.Value, ac.locales, ""); tag != "" {
+			return locale.Get(tag)
+		}
+	}
+	return locale.Get(locale.Negotiate(req.Header.Get("Accept-Language"), ac.locales, fallback))
+}
+
+// toTime converts a time, a number of seconds since 1970 or a string like
+// "2024-03-05" to a time. Returns false if this is not possible.
+func toTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		for _, layout := range dateLayouts {
+			if t, err := time.Parse(layout, strings.TrimSpace(v)); err == nil {
+				return t, true
+			}
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return time.Unix(int64(f), 0), true
+		}
+		return time.Time{}, false
+	}
+	if f, ok := toFloat(value); ok {
+		return time.Unix(int64(f), 0), true
+	}
+	return time.Time{}, false
+}
+
+// toFloat converts a number or a string to a float64
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case lua.LNumber:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// optString returns the argument at the given position as a string, or
+// the default value
+func optString(args []interface{}, i int, defaultValue string) string {
+	if i < len(args) && args[i] != nil {
+		return fmt.Sprint(args[i])
+	}
+	return defaultValue
+}
+
+// localDate formats a date with a style for a locale, or returns the value
+// as it is if it is not a date
+func localDate(l *locale.Locale, value interface{}, style string) string {
+	t, ok := toTime(value)
+	if !ok {
+		return fmt.Sprint(value)
+	}
+	return l.FormatDate(t, style)
+}
+
+// localNumber formats a number with a number of decimals for a locale, or
+// returns the value as it is if it is not a number
+func localNumber(l *locale.Locale, value interface{}, decimals int) string {
+	f, ok := toFloat(value)
+	if !ok {
+		return fmt.Sprint(value)
+	}
+	return l.FormatNumber(f, decimals)
+}
+
+// localMoney formats an amount in a currency for a locale, or returns the
+// value as it is if it is not a number
+func localMoney(l *locale.Locale, value interface{}, currency string) string {
+	f, ok := toFloat(value)
+	if !ok {
+		return fmt.Sprint(value)
+	}
+	return l.FormatMoney(f, currency)
+}
+
+// LocaleFuncs returns the localdate, number and money functions for
+// templates, for the locale of the request
+func (ac *Config) LocaleFuncs(req *http.Request) template.FuncMap {
+	l := ac.requestLocale(req)
+	return template.FuncMap{
+		// localdate(date[, style]), where the style is "short", "medium" or "long"
+		"localdate": func(value interface{}, args ...interface{}) string {
+			return localDate(l, value, optString(args, 0, "medium"))
+		},
+		// number(n[, decimals])
+		"number": func(value interface{}, args ...interface{}) string {
+			decimals := -1
+			if len(args) > 0 {
+				if f, ok := toFloat(args[0]); ok {
+					decimals = int(f)
+				}
+			}
+			return localNumber(l, value, decimals)
+		},
+		// money(amount, currency)
+		"money": func(value interface{}, args ...interface{}) string {
+			return localMoney(l, value, optString(args, 0, "USD"))
+		},
+		// locale(), for the lang attribute
+		"locale": func() string {
+			return l.Tag
+		},
+	}
+}
+
+// addLocaleFuncs adds the functions from LocaleFuncs to the functions for
+// a template, unless functions with the same names are already there
+func (ac *Config) addLocaleFuncs(req *http.Request, funcs template.FuncMap) {
+	for name, f := range ac.LocaleFuncs(req) {
+		if _, ok := funcs[name]; !ok {
+			funcs[name] = f
+		}
+	}
+}
+
+// LoadLocaleFunctions makes functions for formatting dates, numbers and
+// amounts of money for the locale of the request available to Lua scripts
+func (ac *Config) LoadLocaleFunctions(req *http.Request, L *lua.LState) {
+	l := ac.requestLocale(req)
+
+	// Get the tag of the locale of the request, like "en" or "pt-BR"
+	L.SetGlobal("Locale", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(l.Tag))
+		return 1 // number of results
+	}))
+
+	// Format a date for the locale of the request. Takes a number of
+	// seconds since 1970 or a string like "2024-03-05", and an optional
+	// style ("short", "medium" or "long"). Returns a string.
+	L.SetGlobal("LocalDate", L.NewFunction(func(L *lua.LState) int {
+		var value interface{} = L.CheckAny(1).String()
+		if n, ok := L.Get(1).(lua.LNumber); ok {
+			value = n
+		}
+		L.Push(lua.LString(localDate(l, value, L.OptString(2, "medium"))))
+		return 1 // number of results
+	}))
+
+	// Format a number for the locale of the request. Takes a number and an
+	// optional number of decimals. Returns a string.
+	L.SetGlobal("Number", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(l.FormatNumber(float64(L.CheckNumber(1)), L.OptInt(2, -1))))
+		return 1 // number of results
+	}))
+
+	// Format an amount of money for the locale of the request. Takes a
+	// number and a currency code, like "EUR". Returns a string.
+	L.SetGlobal("Money", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(l.FormatMoney(float64(L.CheckNumber(1)), L.CheckString(2))))
+		return 1 // number of results
+	}))
+}
+
+// LoadLocaleConfigFunctions makes the Locales function available to server
+// configuration scripts
+func (ac *Config) LoadLocaleConfigFunctions(L *lua.LState) {
+
+	// Set the locales the site supports, like "en", "de" and "pt-BR". The
+	// first one is used when none of the languages of the browser match.
+	// Takes a table with tags. Returns true.
+	L.SetGlobal("Locales", L.NewFunction(func(L *lua.LState) int {
+		var tags []string
+		L.CheckTable(1).ForEach(func(_, value lua.LValue) {
+			tags = append(tags, value.String())
+		})
+		ac.locales = tags
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
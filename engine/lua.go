@@ -10,11 +10,19 @@ import (
 	"github.com/xyproto/algernon/lua/codelib"
 	"github.com/xyproto/algernon/lua/convert"
 	"github.com/xyproto/algernon/lua/datastruct"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/algernon/lua/ics"
 	"github.com/xyproto/algernon/lua/jnode"
+	"github.com/xyproto/algernon/lua/jwt"
 	"github.com/xyproto/algernon/lua/onthefly"
+	"github.com/xyproto/algernon/lua/payment"
+	"github.com/xyproto/algernon/lua/protobuf"
 	"github.com/xyproto/algernon/lua/pure"
+	"github.com/xyproto/algernon/lua/sanitize"
 	"github.com/xyproto/algernon/lua/upload"
+	"github.com/xyproto/algernon/lua/upstream"
 	"github.com/xyproto/algernon/lua/users"
+	"github.com/xyproto/algernon/lua/webhook"
 	"github.com/xyproto/algernon/utils"
 	"github.com/xyproto/gopher-lua"
 )
@@ -29,25 +37,73 @@ func (ac *Config) LoadCommonFunctions(w http.ResponseWriter, req *http.Request,
 
 	// Make other basic functions available
 	ac.LoadBasicSystemFunctions(L)
+	vh := requestVirtualHost(req)
+	vh.loadLogFunctions(L)
+
+	// Random numbers that are seeded for this request
+	ac.LoadRandomFunctions(req, L)
 
 	// Functions for rendering markdown or amber
 	ac.LoadRenderFunctions(w, req, L)
 
+	// Named channels, for passing messages between handlers
+	ac.LoadChannelFunctions(req, L)
+
+	// For calling functions in the application script
+	ac.LoadAppFunctions(req, L)
+
+	// The anonymous visitor ID, and data for visitors that are not logged in
+	ac.LoadVisitorFunctions(w, req, L)
+
+	// Tokens for protecting forms against cross-site request forgery
+	ac.LoadCSRFFunctions(w, req, L)
+
+	// For checking for spam and bots, and for the moderation queue
+	ac.LoadSpamFunctions(req, L)
+	ac.LoadBotFunctions(req, L)
+	ac.LoadIPListFunctions(req, L)
+
+	// The subject and names of the verified client certificate, if any
+	ac.LoadClientCertFunctions(req, L)
+	ac.LoadContactFunctions(w, L)
+	ac.LoadSpreadsheetFunctions(w, L)
+	ac.LoadLocaleFunctions(req, L)
+	ac.LoadDirListingFunctions(req, L)
+
+	// Pass on the request ID and trace headers when sending requests
+	upstream.SetHeaders(L, ac.upstreamHeaders(req))
+
 	// If there is a database backend
 	if ac.perm != nil {
 
 		// Retrieve the userstate
-		userstate := ac.perm.UserState()
+		userstate := ac.userStateFor(req)
 
 		// Functions for serving files in the same directory as a script
 		ac.LoadServeFile(w, req, L, filename)
 
-		// Functions mainly for adding admin prefixes and configuring permissions
-		ac.LoadServerConfigFunctions(L, filename)
+		// Functions mainly for adding admin prefixes and configuring
+		// permissions, which virtual hosts can not change
+		if vh == nil {
+			ac.LoadServerConfigFunctions(L, filename)
+		}
 
 		// Make the functions related to userstate available to the Lua script
 		users.Load(w, req, L, userstate)
 
+		// Functions for "remember me" tokens and for logging out everywhere
+		ac.LoadSessionFunctions(w, req, L)
+		ac.LoadActiveSessionFunctions(req, L)
+
+		// For creating, revoking and checking API keys
+		ac.LoadAPIKeyFunctions(req, L)
+		ac.LoadNotifyFunctions(L)
+		ac.LoadMailFunctions(L)
+		ac.LoadWebPushFunctions(L)
+
+		// Check passwords with LDAP, if it is configured
+		ac.LoadCorrectPassword(L)
+
 		creator := userstate.Creator()
 
 		// Simpleredis data structures
@@ -65,6 +121,33 @@ func (ac *Config) LoadCommonFunctions(w http.ResponseWriter, req *http.Request,
 	ac.LoadJFile(L, filepath.Dir(filename))
 	jnode.Load(L)
 
+	// For raising structured errors
+	httperror.Load(L)
+
+	// For creating and validating JSON Web Tokens
+	jwt.Load(L)
+
+	// For encoding and decoding Protocol Buffers messages
+	protobuf.Load(L, ac.protoRegistry)
+	ac.LoadProtobufFunctions(w, L)
+
+	// For checking the signatures of webhook requests
+	webhook.Load(L)
+
+	// For removing scripts and other unsafe HTML from user content
+	sanitize.Load(L)
+
+	// For calendar feeds
+	ics.Load(L)
+
+	// For SQL databases
+	ac.LoadSQLFunctions(L, filepath.Dir(filename))
+
+	// For checkout sessions, webhook events and subscriptions
+	if ac.payments != nil {
+		payment.Load(L, ac.payments)
+	}
+
 	// Extras
 	pure.Load(L)
 
@@ -81,7 +164,10 @@ func (ac *Config) LoadCommonFunctions(w http.ResponseWriter, req *http.Request,
 	onthefly.Load(L)
 
 	// File uploads
-	upload.Load(L, w, req, filepath.Dir(filename))
+	upload.Load(L, w, req, filepath.Dir(filename), ac.ScanUpload)
+
+	// Storing uploaded files by hash
+	ac.LoadContentFunctions(L)
 }
 
 // RunLua uses a Lua file as the HTTP handler. Also has access to the userstate
@@ -90,8 +176,8 @@ func (ac *Config) LoadCommonFunctions(w http.ResponseWriter, req *http.Request,
 func (ac *Config) RunLua(w http.ResponseWriter, req *http.Request, filename string, flushFunc func(), fust *FutureStatus) error {
 
 	// Retrieve a Lua state
-	L := ac.luapool.Get()
-	defer ac.luapool.Put(L)
+	luapool := ac.luaPoolFor(req)
+	L := luapool.Get()
 
 	// Warn if the connection is closed before the script has finished.
 	// Requires that the requestWriter has CloseNotify.
@@ -136,7 +222,17 @@ func (ac *Config) RunLua(w http.ResponseWriter, req *http.Request, filename stri
 
 	// Run the script and return the error value.
 	// Logging and/or HTTP response is handled elsewhere.
-	return L.DoFile(filename)
+	start := readAllocCounters()
+	err := L.DoFile(filename)
+	ac.allocs.Add(filename, start)
+
+	// Don't reuse a Lua state that may have been left in a bad state
+	if isStackOverflow(err) {
+		luapool.Discard(L)
+	} else {
+		luapool.Put(L)
+	}
+	return err
 }
 
 // RunConfiguration runs a Lua file as a configuration script. Also has access
@@ -149,21 +245,37 @@ func (ac *Config) RunLua(w http.ResponseWriter, req *http.Request, filename stri
 //
 // luaHandler is a flag that lets Lua functions like "handle" and "servedir" be available or not.
 func (ac *Config) RunConfiguration(filename string, mux *http.ServeMux, withHandlerFunctions bool) error {
+	return ac.runConfiguration(filename, mux, withHandlerFunctions, nil)
+}
 
-	// Retrieve a Lua state
-	L := ac.luapool.Get()
+// loadConfigurationFunctions adds the functions that are available to
+// server configuration scripts, or to virtual host configuration scripts if
+// vh is not nil, to the given Lua state
+func (ac *Config) loadConfigurationFunctions(L *lua.LState, filename string, mux *http.ServeMux, withHandlerFunctions bool, vh *virtualHost) {
 
 	// Basic system functions, like log()
 	ac.LoadBasicSystemFunctions(L)
+	vh.loadLogFunctions(L)
 
 	// If there is a database backend
 	if ac.perm != nil {
 
 		// Retrieve the userstate
 		userstate := ac.perm.UserState()
+		if vh != nil && vh.userstate != nil {
+			userstate = vh.userstate
+		}
 
 		// Server configuration functions
-		ac.LoadServerConfigFunctions(L, filename)
+		if vh == nil {
+			ac.LoadServerConfigFunctions(L, filename)
+		}
+
+		// For creating and revoking API keys
+		ac.LoadAPIKeyFunctions(nil, L)
+		ac.LoadNotifyFunctions(L)
+		ac.LoadMailFunctions(L)
+		ac.LoadWebPushFunctions(L)
 
 		creator := userstate.Creator()
 
@@ -182,6 +294,21 @@ func (ac *Config) RunConfiguration(filename string, mux *http.ServeMux, withHand
 	ac.LoadJFile(L, filepath.Dir(filename))
 	jnode.Load(L)
 
+	// For raising structured errors
+	httperror.Load(L)
+
+	// For creating and validating JSON Web Tokens
+	jwt.Load(L)
+
+	// For encoding and decoding Protocol Buffers messages
+	protobuf.Load(L, ac.protoRegistry)
+
+	// For checking the signatures of webhook requests
+	webhook.Load(L)
+
+	// For SQL databases
+	ac.LoadSQLFunctions(L, filepath.Dir(filename))
+
 	// Extras
 	pure.Load(L)
 
@@ -191,25 +318,89 @@ func (ac *Config) RunConfiguration(filename string, mux *http.ServeMux, withHand
 	// Cache
 	ac.LoadCacheFunctions(L)
 
+	// For calling functions in the application script
+	ac.LoadAppFunctions(nil, L)
+
+	// There is no request, so there are no headers to pass on
+	upstream.SetHeaders(L, nil)
+
 	// Pages and Tags
 	onthefly.Load(L)
 
 	if withHandlerFunctions {
 		// Lua HTTP handlers
 		ac.LoadLuaHandlerFunctions(L, filename, mux, false, nil, ac.defaultTheme)
+
+		// Reverse proxy routes
+		ac.LoadProxyFunctions(L, mux)
+
+		// FastCGI extensions and routes
+		ac.LoadFastCGIFunctions(L, mux)
+
+		// Renderers for filename extensions
+		ac.LoadRendererFunctions(L, mux)
+
+		// Output filters for the responses
+		ac.LoadFilterFunctions(L, mux)
+		ac.LoadBasicAuthFunctions(L, mux)
+		ac.LoadAPIKeyRules(L, mux)
+		ac.LoadCSRFRules(L, filename, mux)
+		ac.LoadCORSFunctions(L, mux)
+		ac.LoadSecurityHeaderFunctions(L, mux)
+		ac.LoadRateLimitFunctions(L, mux)
+		ac.LoadBotPolicyFunctions(L, mux)
+		ac.LoadTrapFunctions(L, mux)
+		ac.LoadFaultFunctions(L, mux)
+		ac.LoadStreamFallbackFunctions(L, mux)
+		ac.LoadRewriteFunctions(L, mux)
+		ac.LoadIPRuleFunctions(L, mux)
 	}
+}
+
+// runConfiguration runs a configuration script, for the main server if vh
+// is nil, or else for a virtual host. Virtual hosts use their own Lua
+// states and users, and can not change the server configuration.
+func (ac *Config) runConfiguration(filename string, mux *http.ServeMux, withHandlerFunctions bool, vh *virtualHost) error {
+
+	// Retrieve a Lua state
+	luapool := ac.luapool
+	if vh != nil {
+		luapool = vh.pool
+	}
+	L := luapool.Get()
+
+	// The functions that are available to configuration scripts
+	ac.loadConfigurationFunctions(L, filename, mux, withHandlerFunctions, vh)
 
 	// Run the script
 	if err := L.DoFile(filename); err != nil {
 		// Close the Lua state
-		L.Close()
+		luapool.Discard(L)
 
 		// Logging and/or HTTP response is handled elsewhere
 		return err
 	}
 
+	// Redirects, if the script has a redirects table
+	if redirects, ok := L.GetGlobal("redirects").(*lua.LTable); ok {
+		L.SetGlobal("redirects", lua.LNil)
+		if err := ac.addRedirects(mux, redirects); err != nil {
+			luapool.Discard(L)
+			return err
+		}
+	}
+
+	// Virtual hosts, if the script has a hosts table
+	if hosts, ok := L.GetGlobal("hosts").(*lua.LTable); ok {
+		L.SetGlobal("hosts", lua.LNil)
+		if err := ac.addVirtualHosts(hosts, filename); err != nil {
+			luapool.Discard(L)
+			return err
+		}
+	}
+
 	// Only put the Lua state back if there were no errors
-	ac.luapool.Put(L)
+	luapool.Put(L)
 
 	return nil
 }
@@ -226,8 +417,9 @@ func (ac *Config) LuaFunctionMap(w http.ResponseWriter, req *http.Request, luada
 	defer ac.pongomutex.Unlock()
 
 	// Retrieve a Lua state
-	L := ac.luapool.Get()
-	defer ac.luapool.Put(L)
+	luapool := ac.luaPoolFor(req)
+	L := luapool.Get()
+	defer luapool.Put(L)
 
 	// Prepare an empty map of functions (and variables)
 	funcs := make(template.FuncMap)
@@ -1,13 +1,14 @@
 package engine
 
 import (
+	"fmt"
 	"net/http"
 	"path/filepath"
 	"sync"
 
-	"github.com/didip/tollbooth"
 	log "github.com/sirupsen/logrus"
-	"github.com/xyproto/algernon/themes"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/algernon/lua/websocket"
 	"github.com/xyproto/gopher-lua"
 )
 
@@ -33,10 +34,20 @@ func (ac *Config) LoadLuaHandlerFunctions(L *lua.LState, filename string, mux *h
 			luahandlermutex.Unlock()
 
 			// Then run the given Lua function
+			defer ac.allocs.Add(handlePath, readAllocCounters())
 			L.Push(handleFunc)
-			if err := L.PCall(0, lua.MultRet, nil); err != nil {
-				// Non-fatal error
-				log.Error("Handler for "+handlePath+" failed:", err)
+			// An event stream that has started is ended with an event instead of an error page
+			if err := L.PCall(0, lua.MultRet, nil); err != nil && !ac.endEventStream(mux, w, req, err) {
+				if isStackOverflow(err) {
+					log.Error("Stack overflow in handler for "+handlePath+":", err)
+					ac.ErrorPage(w, req, ac.stackOverflowError(err))
+				} else if e, ok := httperror.From(err); ok {
+					// An error raised with Error(), meant for the client
+					ac.ErrorPage(w, req, e)
+				} else {
+					// Non-fatal error
+					log.Error("Handler for "+handlePath+" failed:", err)
+				}
 			}
 
 			// Then exit after the first request, if specified
@@ -45,19 +56,88 @@ func (ac *Config) LoadLuaHandlerFunctions(L *lua.LState, filename string, mux *h
 			}
 		}
 
-		// Handle requests differently depending on if rate limiting is enabled or not
-		if ac.disableRateLimiting {
-			mux.HandleFunc(handlePath, wrappedHandleFunc)
-		} else {
-			limiter := tollbooth.NewLimiter(float64(ac.limitRequests), nil)
-			limiter.SetMessage(themes.MessagePage("Rate-limit exceeded", "<div style='color:red'>You have reached the maximum request limit.</div>", theme))
-			limiter.SetMessageContentType("text/html;charset=utf-8")
-			mux.Handle(handlePath, tollbooth.LimitFuncHandler(limiter, wrappedHandleFunc))
+		// Keep track of the route, for the management API
+		ac.routes.Add(mux, handlePath, "handler in "+filename)
+
+		ac.handleRateLimited(mux, handlePath, wrappedHandleFunc, theme)
+
+		return 0 // number of results
+	}))
+
+	L.SetGlobal("websocket", L.NewFunction(func(L *lua.LState) int {
+
+		handlePath := L.ToString(1)
+		handleFunc := L.ToFunction(2)
+
+		wrappedHandleFunc := func(w http.ResponseWriter, req *http.Request) {
+			conn, err := websocket.Upgrade(w, req)
+			if err != nil {
+				log.Error("WebSocket handshake for "+handlePath+" failed: ", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				ac.LogAccess(req, http.StatusBadRequest, 0)
+				return
+			}
+			defer conn.Close()
+			ac.LogAccess(req, http.StatusSwitchingProtocols, 0)
+
+			// Each connection gets its own Lua thread, since connections are long-lived
+			luahandlermutex.Lock()
+			co, cancel := L.NewThread()
+			luahandlermutex.Unlock()
+			if cancel != nil {
+				defer cancel()
+			}
+
+			// Then run the given Lua function, with the send, receive and close functions
+			co.Push(handleFunc)
+			co.Push(websocket.NewTable(co, conn))
+			if err := co.PCall(1, lua.MultRet, nil); err != nil {
+				// Non-fatal error
+				log.Error("WebSocket handler for "+handlePath+" failed:", err)
+				ac.closeWebSocket(mux, req, conn, err)
+			}
 		}
 
+		// Keep track of the route, for the management API
+		ac.routes.Add(mux, handlePath, "websocket handler in "+filename)
+
+		ac.handleRateLimited(mux, handlePath, wrappedHandleFunc, theme)
+
 		return 0 // number of results
 	}))
 
+	// Split the traffic for a path between two Lua handler files,
+	// for example: Canary("/checkout", "v1.lua", "v2.lua", 10)
+	L.SetGlobal("Canary", L.NewFunction(func(L *lua.LState) int {
+		handlePath := L.ToString(1)
+		scriptdir := filepath.Dir(filename)
+		stableFilename := filepath.Join(scriptdir, L.ToString(2))
+		canaryFilename := filepath.Join(scriptdir, L.ToString(3))
+		percentage := L.ToInt(4)
+		for _, handlerFilename := range []string{stableFilename, canaryFilename} {
+			if !ac.fs.Exists(handlerFilename) {
+				log.Error("Could not find ", handlerFilename)
+				L.Push(lua.LBool(false))
+				return 1 // number of results
+			}
+		}
+		if percentage < 0 {
+			percentage = 0
+		} else if percentage > 100 {
+			percentage = 100
+		}
+
+		canaryHandleFunc := ac.CanaryHandler(mux, handlePath, stableFilename, canaryFilename, percentage)
+
+		// Keep track of the route, for the management API
+		ac.routes.Add(mux, handlePath, fmt.Sprintf("canary %s (%d%%: %s)", stableFilename, percentage, canaryFilename))
+
+		ac.handleRateLimited(mux, handlePath, canaryHandleFunc, theme)
+
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
 	L.SetGlobal("servedir", L.NewFunction(func(L *lua.LState) int {
 		handlePath := L.ToString(1) // serve as (ie. "/")
 		rootdir := L.ToString(2)    // filesystem directory (ie. "./public")
@@ -0,0 +1,305 @@
+package engine
+
+// Sending e-mail, and rendering e-mail from Amber and Go templates, with
+// HTML and text alternatives and the CSS inlined
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/eknkc/amber"
+	"github.com/xyproto/algernon/cssinline"
+	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/themes"
+	"github.com/xyproto/gopher-lua"
+	"github.com/yosssi/gcss"
+)
+
+var (
+	errNoMailer      = errors.New("no SMTP server is configured, use Notifications in the server configuration")
+	errNoMailSubject = errors.New("no subject, add one to the data or as a <title>")
+
+	// For finding the title, and for converting HTML to text
+	titleElement  = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	hiddenElement = regexp.MustCompile(`(?is)<(head|style|script)[^>]*>.*?</(head|style|script)>`)
+	linkElement   = regexp.MustCompile(`(?is)<a\s[^>]*href\s*=\s*["']([^"']*)["'][^>]*>(.*?)</a>`)
+	breakTag      = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|h[1-6]|li|tr|table|blockquote)>`)
+	anyTag        = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLines    = regexp.MustCompile(`\n{3,}`)
+)
+
+// mailer sends e-mail through an SMTP server
+type mailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// newMailer returns a mailer for the SMTP server at the given host:port.
+// The username and password can be empty.
+func newMailer(addr, from, username, password string) *mailer {
+	m := &mailer{addr: addr, from: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// quotedPrintable returns the text with CRLF line endings, as
+// quoted-printable
+func quotedPrintable(text string) []byte {
+	var buf bytes.Buffer
+	qw := quotedprintable.NewWriter(&buf)
+	qw.Write([]byte(strings.Replace(text, "\n", "\r\n", -1)))
+	qw.Close()
+	return buf.Bytes()
+}
+
+// Send sends an e-mail, with both a text and an HTML alternative if html
+// is not empty
+func (m *mailer) Send(to, subject, text, html string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", m.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	if html == "" {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		buf.Write(quotedPrintable(text))
+		return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, buf.Bytes())
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	for _, part := range []struct{ contentType, data string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		pw.Write(quotedPrintable(part.data))
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	buf.Write(body.Bytes())
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, buf.Bytes())
+}
+
+// htmlToText converts an HTML e-mail to text, for the text alternative
+func htmlToText(htmlData string) string {
+	text := hiddenElement.ReplaceAllString(htmlData, "")
+	text = linkElement.ReplaceAllString(text, "$2 ($1)")
+	text = breakTag.ReplaceAllString(text, "\n")
+	text = html.UnescapeString(anyTag.ReplaceAllString(text, ""))
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	text = blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(text) + "\n"
+}
+
+// mailStyle returns the CSS for e-mail templates in the same directory as
+// the given template: name.css, style.css or style.gcss
+func (ac *Config) mailStyle(base string) (string, error) {
+	dir := filepath.Dir(base)
+	for _, filename := range []string{base + ".css", filepath.Join(dir, themes.DefaultCSSFilename)} {
+		if ac.fs.Exists(filename) {
+			data, err := ioutil.ReadFile(filename)
+			return string(data), err
+		}
+	}
+	if filename := filepath.Join(dir, themes.DefaultGCSSFilename); ac.fs.Exists(filename) {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		if _, err := gcss.Compile(&buf, bytes.NewReader(data)); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+	return "", nil
+}
+
+// renderMailHTML renders name.amber, name.html or name.tmpl, if one of them
+// exists. Returns an empty string if there is no HTML template.
+func (ac *Config) renderMailHTML(base string, data map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	if filename := base + ".amber"; ac.fs.Exists(filename) {
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", err
+		}
+		tpl, err := amber.CompileData(src, filename, amber.Options{})
+		if err != nil {
+			return "", err
+		}
+		if err := tpl.Execute(&buf, data); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+	for _, filename := range []string{base + ".html", base + ".tmpl"} {
+		if !ac.fs.Exists(filename) {
+			continue
+		}
+		tpl, err := htmltemplate.ParseFiles(filename)
+		if err != nil {
+			return "", err
+		}
+		if err := tpl.Execute(&buf, data); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+	return "", nil
+}
+
+// RenderMail renders an e-mail from the templates with the given name,
+// relative to the server directory. "emails/welcome" uses
+// emails/welcome.amber, .html or .tmpl for HTML and emails/welcome.txt for
+// text. The CSS in emails/welcome.css, emails/style.css or emails/style.gcss
+// is inlined in the HTML. If there is no text template, the text is made
+// from the HTML. The subject is taken from data["subject"], or from the
+// <title> of the HTML.
+func (ac *Config) RenderMail(name string, data map[string]interface{}) (subject, text, htmlData string, err error) {
+	base := filepath.Join(ac.serverDirOrFilename, filepath.FromSlash(path.Clean("/"+name)))
+	htmlData, err = ac.renderMailHTML(base, data)
+	if err != nil {
+		return "", "", "", err
+	}
+	if htmlData != "" {
+		css, err := ac.mailStyle(base)
+		if err != nil {
+			return "", "", "", err
+		}
+		if css != "" {
+			style := "<style>\n" + css + "\n</style>"
+			if pos := strings.Index(strings.ToLower(htmlData), "</head>"); pos != -1 {
+				htmlData = htmlData[:pos] + style + htmlData[pos:]
+			} else {
+				htmlData = style + htmlData
+			}
+		}
+		htmlData = string(themes.InsertDoctype([]byte(cssinline.Inline(htmlData))))
+	}
+	if filename := base + ".txt"; ac.fs.Exists(filename) {
+		tpl, err := template.ParseFiles(filename)
+		if err != nil {
+			return "", "", "", err
+		}
+		var buf bytes.Buffer
+		if err := tpl.Execute(&buf, data); err != nil {
+			return "", "", "", err
+		}
+		text = buf.String()
+	} else if htmlData != "" {
+		text = htmlToText(htmlData)
+	} else {
+		return "", "", "", fmt.Errorf("no e-mail template found for %s", name)
+	}
+	if s, ok := data["subject"].(string); ok && s != "" {
+		subject = s
+	} else if m := titleElement.FindStringSubmatch(htmlData); m != nil {
+		subject = strings.TrimSpace(html.UnescapeString(m[1]))
+	}
+	if subject == "" {
+		return "", "", "", errNoMailSubject
+	}
+	return subject, text, htmlData, nil
+}
+
+// LoadMailFunctions makes functions for rendering and sending e-mail from
+// templates available to Lua scripts
+func (ac *Config) LoadMailFunctions(L *lua.LState) {
+
+	// Render an e-mail from templates. Takes the name of the templates,
+	// like "emails/welcome", and an optional table with data. Returns the
+	// subject, the text and the HTML, or nil and an error message.
+	L.SetGlobal("RenderMail", L.NewFunction(func(L *lua.LState) int {
+		data := make(map[string]interface{})
+		if L.GetTop() >= 2 {
+			data = convert.Table2interfaceMap(L.CheckTable(2))
+		}
+		subject, text, htmlData, err := ac.RenderMail(L.CheckString(1), data)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(subject))
+		L.Push(lua.LString(text))
+		L.Push(lua.LString(htmlData))
+		return 3 // number of results
+	}))
+
+	// Render an e-mail from templates and send it. Takes an e-mail address
+	// or a username, the name of the templates and an optional table with
+	// data. Returns true, or false and an error message.
+	L.SetGlobal("SendTemplatedMail", L.NewFunction(func(L *lua.LState) int {
+		to := L.CheckString(1)
+		name := L.CheckString(2)
+		data := make(map[string]interface{})
+		if L.GetTop() >= 3 {
+			data = convert.Table2interfaceMap(L.CheckTable(3))
+		}
+		err := errNoMailer
+		if ac.notify.mail != nil {
+			err = ac.sendTemplatedMail(to, name, data)
+		}
+		if err != nil {
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LTrue)
+		return 1 // number of results
+	}))
+}
+
+// sendTemplatedMail renders and sends an e-mail to an address, or to the
+// address of a user
+func (ac *Config) sendTemplatedMail(to, name string, data map[string]interface{}) error {
+	if !strings.Contains(to, "@") {
+		if ac.perm == nil {
+			return errNoDatabase
+		}
+		email, err := ac.perm.UserState().Email(to)
+		if err != nil || email == "" {
+			return errNoEmail
+		}
+		to = email
+	}
+	subject, text, htmlData, err := ac.RenderMail(name, data)
+	if err != nil {
+		return err
+	}
+	return ac.notify.mail.Send(to, subject, text, htmlData)
+}
@@ -0,0 +1,342 @@
+package engine
+
+// Functionality for managing a running server: swapping in a freshly
+// configured mux when reloading, maintenance mode, metrics and routes.
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xyproto/algernon/lua/httperror"
+)
+
+// mainHandler is the handler that is given to the HTTP servers. It passes
+// requests on to the current mux, which can be replaced when reloading.
+type mainHandler struct {
+	ac          *Config
+	mux         atomic.Value // *http.ServeMux
+	hosts       atomic.Value // hostMuxes
+	maintenance int32        // 1 if in maintenance mode
+}
+
+// newMainHandler creates a new mainHandler for the given configuration
+func newMainHandler(ac *Config) *mainHandler {
+	return &mainHandler{ac: ac}
+}
+
+// ServeHTTP serves a request with the current mux, or with a
+// "503 Service Unavailable" page if the server is in maintenance mode
+func (mh *mainHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddUint64(&mh.ac.metrics.requests, 1)
+	atomic.AddInt64(&mh.ac.metrics.inFlight, 1)
+	defer atomic.AddInt64(&mh.ac.metrics.inFlight, -1)
+
+	mh.ac.assignRequestID(w, req)
+	req = withStartTime(req)
+	req = mh.ac.withBotScore(req)
+
+	// The health endpoints are served in maintenance mode too, so that
+	// the readiness endpoint can tell load balancers about it
+	if mh.ac.serveHealth(w, req) {
+		return
+	}
+	if mh.Maintenance() {
+		w.Header().Set("Retry-After", "60")
+		size := mh.ac.ErrorPage(w, req, httperror.New(http.StatusServiceUnavailable, "The server is down for maintenance. Please try again later."))
+		mh.ac.LogAccess(req, http.StatusServiceUnavailable, size)
+		return
+	}
+	if rw := mh.ac.startRecording(w, req); rw != nil {
+		defer rw.finish()
+		// Keep HTTP/2 server push, which the recording writer can not do
+		w, req = rw, withPusher(w, rw.req)
+	}
+	if gw := mh.ac.startGzip(w, req); gw != nil {
+		defer gw.finish()
+		req = withPusher(w, req)
+		w = gw
+	}
+	mux, ok := mh.mux.Load().(*http.ServeMux)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if vh := mh.Hosts().lookup(req); vh != nil {
+		mux = vh.mux
+		req = withVirtualHost(req, vh)
+	}
+	serve := func(w http.ResponseWriter, req *http.Request) {
+		if mh.ac.ipRejected(mux, w, req) || mh.ac.trapped(mux, w, req) || mh.ac.redirected(mux, w, req) {
+			return
+		}
+		req = mh.ac.rewrite(mux, req)
+		mh.ac.setSecurityHeaders(mux, w, req)
+		if mh.ac.handleCORS(mux, w, req) || mh.ac.botRejected(mux, w, req) || mh.ac.rateLimited(mux, w, req) {
+			return
+		}
+		req = mh.ac.checkSession(w, req)
+		if mh.ac.basicAuthRejected(mux, w, req) || mh.ac.apiKeyRejected(mux, w, req) || mh.ac.csrfRejected(mux, w, req) {
+			return
+		}
+		if mh.ac.faultInjected(mux, w, req) {
+			return
+		}
+		if mh.ac.serveRewrite(w, req) || mh.ac.serveContent(w, req) || mh.ac.serveWebPush(w, req) || mh.ac.serveA11yReport(w, req) || mh.ac.serveAllocsReport(w, req) {
+			return
+		}
+		filters := mh.ac.filters.Get(mux)
+		if mh.ac.a11yEnabled() {
+			filters = append(filters[:len(filters):len(filters)], mh.ac.a11yFilter())
+		}
+		if len(filters) > 0 && req.Method != http.MethodHead {
+			fw := newFilterWriter(w, filters)
+			mux.ServeHTTP(fw, req)
+			fw.Finish(req)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	}
+	req = withPusher(w, req)
+	if mh.ac.urlPrefix != "" {
+		mh.ac.serveURLPrefix(w, req, http.HandlerFunc(serve))
+		return
+	}
+	serve(w, req)
+}
+
+// Mux returns the mux that is currently in use, or nil
+func (mh *mainHandler) Mux() *http.ServeMux {
+	mux, _ := mh.mux.Load().(*http.ServeMux)
+	return mux
+}
+
+// Swap starts using the given mux. The previous mux is returned, or nil.
+func (mh *mainHandler) Swap(mux *http.ServeMux) *http.ServeMux {
+	previous := mh.Mux()
+	mh.mux.Store(mux)
+	return previous
+}
+
+// Hosts returns the muxes for the virtual hosts that are currently in use
+func (mh *mainHandler) Hosts() hostMuxes {
+	hosts, _ := mh.hosts.Load().(hostMuxes)
+	return hosts
+}
+
+// SwapHosts starts using the given muxes for the virtual hosts. The
+// previous ones are returned.
+func (mh *mainHandler) SwapHosts(hosts hostMuxes) hostMuxes {
+	previous := mh.Hosts()
+	mh.hosts.Store(hosts)
+	return previous
+}
+
+// SetMaintenance turns maintenance mode on or off
+func (mh *mainHandler) SetMaintenance(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&mh.maintenance, value)
+}
+
+// Maintenance checks if maintenance mode is enabled
+func (mh *mainHandler) Maintenance() bool {
+	return atomic.LoadInt32(&mh.maintenance) == 1
+}
+
+// serverMetrics keeps track of requests, for the management API
+type serverMetrics struct {
+	started     time.Time
+	requests    uint64 // atomic
+	inFlight    int64  // atomic
+	bots        uint64 // atomic, requests from suspected bots
+	mut         sync.Mutex
+	statusCodes map[int]uint64 // responses that were logged
+	bytes       uint64
+}
+
+// newServerMetrics creates a new serverMetrics struct
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{started: time.Now(), statusCodes: make(map[int]uint64)}
+}
+
+// count registers a response with the given status code and size
+func (m *serverMetrics) count(statusCode int, byteSize int64) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.statusCodes[statusCode]++
+	if byteSize > 0 {
+		m.bytes += uint64(byteSize)
+	}
+}
+
+// countBot registers a request from a suspected bot
+func (m *serverMetrics) countBot() {
+	atomic.AddUint64(&m.bots, 1)
+}
+
+// Lines returns the metrics as sorted "name value" lines
+func (m *serverMetrics) Lines() []string {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	lines := []string{
+		"uptime_seconds " + strconv.FormatInt(int64(time.Since(m.started).Seconds()), 10),
+		"requests_total " + strconv.FormatUint(atomic.LoadUint64(&m.requests), 10),
+		"bot_requests_total " + strconv.FormatUint(atomic.LoadUint64(&m.bots), 10),
+		"requests_in_flight " + strconv.FormatInt(atomic.LoadInt64(&m.inFlight), 10),
+		"goroutines " + strconv.Itoa(runtime.NumGoroutine()),
+		"memory_alloc_bytes " + strconv.FormatUint(memStats.Alloc, 10),
+	}
+	m.mut.Lock()
+	lines = append(lines, "response_bytes_total "+strconv.FormatUint(m.bytes, 10))
+	for statusCode, n := range m.statusCodes {
+		lines = append(lines, fmt.Sprintf("responses_total{code=\"%d\"} %d", statusCode, n))
+	}
+	m.mut.Unlock()
+	sort.Strings(lines)
+	return lines
+}
+
+// metricLines returns the server metrics, followed by the metrics for the
+// connection limits, the canary routes, the application cache, the named
+// channels and the most allocating handlers
+func (ac *Config) metricLines() []string {
+	lines := ac.metrics.Lines()
+	lines = append(lines, ac.connLimiter.Lines()...)
+	lines = append(lines, ac.canaries.Lines()...)
+	lines = append(lines, ac.appCache.Lines()...)
+	if ac.files != nil {
+		lines = append(lines, ac.files.Lines()...)
+	}
+	lines = append(lines, ac.channels.Lines()...)
+	return append(lines, ac.allocs.Lines()...)
+}
+
+// routeTable keeps track of which paths are handled by which mux
+type routeTable struct {
+	mut    sync.RWMutex
+	routes map[*http.ServeMux]map[string]string
+}
+
+// newRouteTable creates a new and empty routeTable
+func newRouteTable() *routeTable {
+	return &routeTable{routes: make(map[*http.ServeMux]map[string]string)}
+}
+
+// Add registers that the given mux handles the given path.
+// The description is typically a directory or a Lua filename.
+func (rt *routeTable) Add(mux *http.ServeMux, handlePath, description string) {
+	rt.mut.Lock()
+	defer rt.mut.Unlock()
+	if _, ok := rt.routes[mux]; !ok {
+		rt.routes[mux] = make(map[string]string)
+	}
+	rt.routes[mux][handlePath] = description
+}
+
+// Forget removes all routes for the given mux
+func (rt *routeTable) Forget(mux *http.ServeMux) {
+	rt.mut.Lock()
+	defer rt.mut.Unlock()
+	delete(rt.routes, mux)
+}
+
+// Lines returns the routes for the given mux, as sorted "path -> description" lines
+func (rt *routeTable) Lines(mux *http.ServeMux) []string {
+	rt.mut.RLock()
+	defer rt.mut.RUnlock()
+	var lines []string
+	for handlePath, description := range rt.routes[mux] {
+		lines = append(lines, handlePath+" -> "+description)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// forgetMux removes everything that has been registered for a mux that is
+// no longer in use
+func (ac *Config) forgetMux(mux *http.ServeMux) {
+	ac.routes.Forget(mux)
+	ac.filters.Forget(mux)
+	ac.basicAuth.Forget(mux)
+	ac.apiKeys.Forget(mux)
+	ac.csrf.Forget(mux)
+	ac.cors.Forget(mux)
+	ac.securityHeaders.Forget(mux)
+	ac.rateLimits.Forget(mux)
+	ac.bots.Forget(mux)
+	ac.traps.Forget(mux)
+	ac.faults.Forget(mux)
+	ac.streamFallbacks.Forget(mux)
+	ac.rewrites.Forget(mux)
+	ac.redirects.Forget(mux)
+	ac.ipRules.Forget(mux)
+	ac.renderers.Forget(mux)
+	ac.fastcgi.Forget(mux)
+	ac.canaries.Forget(mux)
+}
+
+// Reload runs the server configuration scripts again and sets up the
+// handlers from scratch, using a new mux. If anything fails, the current
+// handlers are kept. The file cache is cleared after a successful reload.
+// Returns what changed, as lines prefixed with "-" or "+".
+func (ac *Config) Reload() ([]string, error) {
+	before := ac.snapshot(ac.handler.Mux())
+
+	// Let the configuration scripts add the permission path prefixes again
+	previousProtections := ac.protections.Items()
+	ac.protections.Reset()
+	ac.applyProtections(nil)
+
+	// Restore the permission path prefixes if the reload fails
+	ac.virtualHosts = nil
+	fail := func(mux *http.ServeMux, filename string, err error) ([]string, error) {
+		ac.forgetMux(mux)
+		ac.virtualHosts = nil
+		ac.protections.Reset()
+		for _, protection := range previousProtections {
+			ac.protections.Add(protection)
+		}
+		ac.applyProtections(previousProtections)
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	mux := http.NewServeMux()
+	for _, filename := range ac.serverConfigurationFilenames {
+		if err := ac.RunConfiguration(filename, mux, true); err != nil {
+			return fail(mux, filename, err)
+		}
+	}
+	if ac.luaServerFilename != "" {
+		if err := ac.RunConfiguration(ac.luaServerFilename, mux, true); err != nil {
+			return fail(mux, ac.luaServerFilename, err)
+		}
+	} else {
+		ac.RegisterHandlers(mux, "/", ac.serverDirOrFilename, ac.serverAddDomain)
+	}
+	hosts, err := ac.virtualHostMuxes()
+	if err != nil {
+		ac.forgetHosts(hosts)
+		return fail(mux, "hosts", err)
+	}
+	if err := ac.checkConfigurationFor(mux); err != nil {
+		ac.forgetHosts(hosts)
+		return fail(mux, "configuration check", err)
+	}
+
+	diff := before.Diff(ac.snapshot(mux))
+	if previous := ac.handler.Swap(mux); previous != nil {
+		ac.forgetMux(previous)
+	}
+	ac.forgetHosts(ac.handler.SwapHosts(hosts))
+	ac.clearCaches()
+	ac.lastReload.Set(diff)
+	return diff, nil
+}
@@ -0,0 +1,349 @@
+package engine
+
+// Notifying users by e-mail, webhook and other channels, where each user
+// can choose the channels and if the notifications should be collected into
+// digests that are sent now and then
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/lua/webhook"
+	"github.com/xyproto/gopher-lua"
+)
+
+const (
+	// The hash map where notifications that wait for the next digest are
+	// stored, for each user
+	digestHashMap = "notificationdigest"
+
+	// The user properties where the notification preferences are stored
+	notifyChannelsProperty = "notify_channels"
+	notifyDigestProperty   = "notify_digest"
+)
+
+var (
+	errNoChannels   = errors.New("no notification channels are configured")
+	errNoEmail      = errors.New("the user has no e-mail address")
+	errNotifyStatus = errors.New("the webhook did not respond with 2xx")
+)
+
+// notifyChannel sends a notification to a user
+type notifyChannel func(username, subject, message string) error
+
+// notification is a notification that waits for the next digest
+type notification struct {
+	Subject  string   `json:"subject"`
+	Message  string   `json:"message"`
+	Channels []string `json:"channels"`
+}
+
+// notifier keeps the notification channels and how often digests are sent
+type notifier struct {
+	mut      sync.RWMutex
+	channels map[string]notifyChannel
+	mail     *mailer // for sending e-mail, if an SMTP server is configured
+	digest   time.Duration
+	once     sync.Once
+}
+
+// AddChannel starts using a notification channel with the given name
+func (n *notifier) AddChannel(name string, channel notifyChannel) {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	if n.channels == nil {
+		n.channels = make(map[string]notifyChannel)
+	}
+	n.channels[name] = channel
+}
+
+// Channel returns the notification channel with the given name, if any
+func (n *notifier) Channel(name string) (notifyChannel, bool) {
+	n.mut.RLock()
+	defer n.mut.RUnlock()
+	channel, ok := n.channels[name]
+	return channel, ok
+}
+
+// Names returns the names of all the notification channels, sorted
+func (n *notifier) Names() []string {
+	n.mut.RLock()
+	defer n.mut.RUnlock()
+	names := make([]string, 0, len(n.channels))
+	for name := range n.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// emailChannel sends notifications by e-mail, to the address of the user
+func (ac *Config) emailChannel(m *mailer) notifyChannel {
+	return func(user, subject, message string) error {
+		to, err := ac.perm.UserState().Email(user)
+		if err != nil || to == "" {
+			return errNoEmail
+		}
+		return m.Send(to, subject, message, "")
+	}
+}
+
+// webhookChannel sends notifications as JSON to an URL. The body is signed
+// with the secret, if it is not empty.
+func webhookChannel(url, secret string) notifyChannel {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(username, subject, message string) error {
+		body, err := json.Marshal(map[string]string{
+			"username": username,
+			"subject":  subject,
+			"message":  message,
+			"time":     time.Now().UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if secret != "" {
+			req.Header.Set("X-Signature", "sha256="+webhook.Sign(secret, string(body)))
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return errNotifyStatus
+		}
+		return nil
+	}
+}
+
+// notifyPreferences returns the channels that the user wants notifications
+// on, or nil for all of them, and if the user wants digests
+func (ac *Config) notifyPreferences(username string) ([]string, bool) {
+	users := ac.perm.UserState().Users()
+	var channels []string
+	if value, err := users.Get(username, notifyChannelsProperty); err == nil && value != "" {
+		channels = strings.Split(value, ",")
+	}
+	digest, _ := users.Get(username, notifyDigestProperty)
+	return channels, digest == "true"
+}
+
+// Notify sends a notification to a user, on the given channels, or on the
+// channels the user has chosen if none are given. The notification is
+// stored for the next digest instead, if digest is true and digests are
+// configured.
+func (ac *Config) Notify(username, subject, message string, channels []string, digest bool) error {
+	if len(channels) == 0 {
+		channels = ac.notify.Names()
+	}
+	if len(channels) == 0 {
+		return errNoChannels
+	}
+	if digest && ac.notify.digest > 0 {
+		hash, err := ac.perm.UserState().Creator().NewHashMap(digestHashMap)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(notification{subject, message, channels})
+		if err != nil {
+			return err
+		}
+		return hash.Set(username, fmt.Sprintf("%020d", time.Now().UnixNano()), string(data))
+	}
+	var errs []string
+	for _, name := range channels {
+		channel, ok := ac.notify.Channel(name)
+		if !ok {
+			errs = append(errs, "unknown channel: "+name)
+			continue
+		}
+		if err := channel(username, subject, message); err != nil {
+			errs = append(errs, name+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// sendDigests sends the notifications that have been stored for each user,
+// one digest per channel, and removes them
+func (ac *Config) sendDigests() {
+	hash, err := ac.perm.UserState().Creator().NewHashMap(digestHashMap)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	usernames, err := hash.All()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, username := range usernames {
+		keys, err := hash.Keys(username)
+		if err != nil || len(keys) == 0 {
+			continue
+		}
+		sort.Strings(keys)
+		messages := make(map[string][]string)
+		for _, key := range keys {
+			data, err := hash.Get(username, key)
+			if err != nil {
+				continue
+			}
+			var n notification
+			if json.Unmarshal([]byte(data), &n) != nil {
+				continue
+			}
+			text := n.Message
+			if n.Subject != "" {
+				text = n.Subject + "\n\n" + text
+			}
+			for _, name := range n.Channels {
+				messages[name] = append(messages[name], text)
+			}
+		}
+		if err := hash.Del(username); err != nil {
+			log.Error(err)
+			continue
+		}
+		for name, texts := range messages {
+			channel, ok := ac.notify.Channel(name)
+			if !ok {
+				continue
+			}
+			subject := strconv.Itoa(len(texts)) + " new notifications"
+			if len(texts) == 1 {
+				subject = "1 new notification"
+			}
+			if err := channel(username, subject, strings.Join(texts, "\n\n---\n\n")); err != nil {
+				log.Error("Could not send the notification digest to ", username, ": ", err)
+			}
+		}
+	}
+}
+
+// LoadNotifyFunctions makes the Notify and NotifyPreferences functions
+// available to Lua scripts
+func (ac *Config) LoadNotifyFunctions(L *lua.LState) {
+
+	// Notify a user. Takes a username, a message and an optional table with
+	// subject, channels (a list of channel names) and digest (true or false).
+	// The preferences of the user are used for the channels and digest that
+	// are not given. Returns true, or false and an error message.
+	L.SetGlobal("Notify", L.NewFunction(func(L *lua.LState) int {
+		username := L.CheckString(1)
+		message := L.CheckString(2)
+		options := L.OptTable(3, L.NewTable())
+		channels, digest := ac.notifyPreferences(username)
+		if list, ok := options.RawGetString("channels").(*lua.LTable); ok {
+			channels = nil
+			list.ForEach(func(_, value lua.LValue) {
+				channels = append(channels, value.String())
+			})
+		}
+		if value, ok := options.RawGetString("digest").(lua.LBool); ok {
+			digest = bool(value)
+		}
+		subject := lua.LVAsString(options.RawGetString("subject"))
+		if err := ac.Notify(username, subject, message, channels, digest); err != nil {
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LTrue)
+		return 1 // number of results
+	}))
+
+	// Get or set the notification preferences of a user. Takes a username
+	// and an optional table with channels (a list of channel names) and
+	// digest (true or false). Returns a table with the preferences.
+	L.SetGlobal("NotifyPreferences", L.NewFunction(func(L *lua.LState) int {
+		username := L.CheckString(1)
+		if options, ok := L.Get(2).(*lua.LTable); ok {
+			users := ac.perm.UserState().Users()
+			if list, ok := options.RawGetString("channels").(*lua.LTable); ok {
+				var channels []string
+				list.ForEach(func(_, value lua.LValue) {
+					channels = append(channels, value.String())
+				})
+				users.Set(username, notifyChannelsProperty, strings.Join(channels, ","))
+			}
+			if value, ok := options.RawGetString("digest").(lua.LBool); ok {
+				users.Set(username, notifyDigestProperty, strconv.FormatBool(bool(value)))
+			}
+		}
+		channels, digest := ac.notifyPreferences(username)
+		if channels == nil {
+			channels = ac.notify.Names()
+		}
+		t := L.NewTable()
+		L.SetField(t, "channels", convert.Strings2table(L, channels))
+		L.SetField(t, "digest", lua.LBool(digest))
+		L.Push(t)
+		return 1 // number of results
+	}))
+}
+
+// LoadNotificationsFunctions makes the Notifications function available to
+// server configuration scripts
+func (ac *Config) LoadNotificationsFunctions(L *lua.LState) {
+
+	// Configure the notification channels. Takes a table with smtp (a
+	// host:port), from, smtpuser and smtppassword for e-mail, webhook (an
+	// URL) and secret for webhooks, and digest (a period like "1h") for how
+	// often digests are sent. Returns true, or false and an error message.
+	L.SetGlobal("Notifications", L.NewFunction(func(L *lua.LState) int {
+		if ac.perm == nil {
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(errNoDatabase.Error()))
+			return 2 // number of results
+		}
+		options := L.CheckTable(1)
+		if addr := lua.LVAsString(options.RawGetString("smtp")); addr != "" {
+			from := lua.LVAsString(options.RawGetString("from"))
+			username := lua.LVAsString(options.RawGetString("smtpuser"))
+			password := lua.LVAsString(options.RawGetString("smtppassword"))
+			ac.notify.mail = newMailer(addr, from, username, password)
+			ac.notify.AddChannel("email", ac.emailChannel(ac.notify.mail))
+		}
+		if url := lua.LVAsString(options.RawGetString("webhook")); url != "" {
+			ac.notify.AddChannel("webhook", webhookChannel(url, lua.LVAsString(options.RawGetString("secret"))))
+		}
+		if period := lua.LVAsString(options.RawGetString("digest")); period != "" {
+			d, err := time.ParseDuration(period)
+			if err != nil || d <= 0 {
+				L.Push(lua.LFalse)
+				L.Push(lua.LString("invalid digest period: " + period))
+				return 2 // number of results
+			}
+			ac.notify.digest = d
+			ac.notify.once.Do(func() {
+				go func() {
+					for range time.Tick(ac.notify.digest) {
+						ac.sendDigests()
+					}
+				}()
+			})
+		}
+		L.Push(lua.LTrue)
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,232 @@
+package engine
+
+// OCSP stapling: the OCSP responses for the certificates are fetched, cached
+// and sent along with the certificates, so that clients do not have to ask
+// the certificate authority if a certificate has been revoked
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/autocert"
+	"github.com/xyproto/algernon/ocsp"
+)
+
+const (
+	// How long to wait for an OCSP server
+	ocspTimeout = 30 * time.Second
+
+	// How long to wait before trying again, if fetching a response failed
+	ocspRetryInterval = 10 * time.Minute
+
+	// How often to check the responses, at the most
+	ocspCheckInterval = time.Hour
+)
+
+// certKey returns a name for a certificate, for the cached OCSP responses
+func certKey(cert *tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// ocspChain returns the certificate and the issuer, if the certificate has
+// an OCSP server and the issuer is in the certificate chain
+func ocspChain(cert *tls.Certificate) (*x509.Certificate, *x509.Certificate) {
+	if cert.Leaf == nil || len(cert.Leaf.OCSPServer) == 0 || len(cert.Certificate) < 2 {
+		return nil, nil
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil
+	}
+	return cert.Leaf, issuer
+}
+
+// refreshTime returns when a new response should be fetched, which is
+// halfway to when the response expires
+func refreshTime(r *ocsp.Response) time.Time {
+	if r.NextUpdate.IsZero() {
+		return r.ThisUpdate.Add(ocspCheckInterval)
+	}
+	return r.ThisUpdate.Add(r.NextUpdate.Sub(r.ThisUpdate) / 2)
+}
+
+// applyStaples staples the OCSP responses that are already fetched to
+// certificates that are loaded, but not in use yet. cs.mut must be locked.
+func (cs *certStore) applyStaples(certs []*tls.Certificate) {
+	now := time.Now()
+	for _, cert := range certs {
+		if r, ok := cs.staples[certKey(cert)]; ok && r.Valid(now) {
+			cert.OCSPStaple = r.Raw
+		}
+	}
+}
+
+// certificates returns all the certificates that are in use
+func (cs *certStore) certificates() []*tls.Certificate {
+	cs.mut.RLock()
+	defer cs.mut.RUnlock()
+	var certs []*tls.Certificate
+	if cs.fallback != nil {
+		certs = append(certs, cs.fallback)
+	}
+	seen := map[*tls.Certificate]bool{cs.fallback: true}
+	for _, cert := range cs.byName {
+		if !seen[cert] {
+			seen[cert] = true
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+// setStaple staples an OCSP response to a certificate, or removes the
+// stapled response if r is nil. The certificate is replaced by a copy,
+// since it may be in use by handshakes that are in progress.
+func (cs *certStore) setStaple(cert *tls.Certificate, r *ocsp.Response) {
+	cs.mut.Lock()
+	defer cs.mut.Unlock()
+	stapled := *cert
+	stapled.OCSPStaple = nil
+	if r != nil {
+		cs.staples[certKey(cert)] = r
+		stapled.OCSPStaple = r.Raw
+	} else {
+		delete(cs.staples, certKey(cert))
+	}
+	for name, c := range cs.byName {
+		if c == cert {
+			cs.byName[name] = &stapled
+		}
+	}
+	if cs.fallback == cert {
+		cs.fallback = &stapled
+	}
+}
+
+// refreshStaple staples an OCSP response to a certificate, from memory,
+// from the cache or from the OCSP server, and returns when the response
+// should be refreshed. Returns the zero time if the certificate can not
+// have a response stapled.
+func (cs *certStore) refreshStaple(ctx context.Context, client *http.Client, cache autocert.Cache, cert *tls.Certificate, retry map[string]time.Time) time.Time {
+	leaf, issuer := ocspChain(cert)
+	if leaf == nil {
+		return time.Time{}
+	}
+	key := certKey(cert)
+	names := strings.Join(certNames(cert), ", ")
+	now := time.Now()
+
+	cs.mut.RLock()
+	r := cs.staples[key]
+	cs.mut.RUnlock()
+	if r == nil {
+		if der, err := cache.Get(key); err == nil {
+			if cached, err := ocsp.ParseResponse(der, leaf, issuer); err == nil && cached.Valid(now) {
+				r = cached
+			}
+		}
+	}
+	if r != nil && r.Valid(now) && now.Before(refreshTime(r)) {
+		if !bytes.Equal(cert.OCSPStaple, r.Raw) {
+			cs.setStaple(cert, r)
+		}
+		return refreshTime(r)
+	}
+	if t, ok := retry[key]; ok && now.Before(t) {
+		return t
+	}
+
+	fetched, err := ocsp.Fetch(ctx, client, leaf, issuer)
+	if err != nil {
+		log.Warnf("Could not fetch the OCSP response for %s: %s", names, err)
+		retry[key] = now.Add(ocspRetryInterval)
+		// Keep stapling the previous response until it expires
+		switch {
+		case r != nil && r.Valid(now):
+			if !bytes.Equal(cert.OCSPStaple, r.Raw) {
+				cs.setStaple(cert, r)
+			}
+		case cert.OCSPStaple != nil:
+			cs.setStaple(cert, nil)
+		}
+		return retry[key]
+	}
+	delete(retry, key)
+	switch fetched.Status {
+	case ocsp.Revoked:
+		log.Errorf("The certificate for %s was revoked at %s", names, fetched.RevokedAt)
+	case ocsp.Unknown:
+		log.Warnf("The OCSP server does not know the certificate for %s", names)
+	}
+	if !fetched.Valid(now) {
+		if cert.OCSPStaple != nil {
+			cs.setStaple(cert, nil)
+		}
+		return now.Add(ocspCheckInterval)
+	}
+	cs.setStaple(cert, fetched)
+	if err := cache.Put(key, fetched.Raw); err != nil {
+		log.Warn("Could not cache the OCSP response: ", err)
+	}
+	return refreshTime(fetched)
+}
+
+// staple keeps the OCSP responses for all the certificates up to date,
+// until the context is cancelled
+func (cs *certStore) staple(ctx context.Context, cache autocert.Cache) {
+	client := &http.Client{Timeout: ocspTimeout}
+	retry := make(map[string]time.Time)
+	for {
+		wait := ocspCheckInterval
+		for _, cert := range cs.certificates() {
+			if next := cs.refreshStaple(ctx, client, cache, cert, retry); !next.IsZero() && time.Until(next) < wait {
+				wait = time.Until(next)
+			}
+		}
+		if wait < time.Minute {
+			wait = time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-cs.wake:
+			// The certificates were loaded again
+		case <-time.After(wait):
+		}
+	}
+}
+
+// ocspCache returns the directory where OCSP responses are stored between
+// restarts, in the user cache directory
+func (ac *Config) ocspCache() autocert.Cache {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = ac.serverTempDir
+	}
+	return autocert.DirCache(filepath.Join(cacheDir, "algernon", "ocsp"))
+}
+
+// startStapling starts keeping the OCSP responses for the certificates up
+// to date in the background, unless --noocsp is given. The background work
+// is stopped at shutdown.
+func (ac *Config) startStapling() {
+	if ac.noOCSP {
+		return
+	}
+	ac.certs.stapling.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		AtShutdown(cancel)
+		go ac.certs.staple(ctx, ac.ocspCache())
+	})
+}
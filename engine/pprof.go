@@ -0,0 +1,78 @@
+package engine
+
+// Serving the pprof endpoints on a private listener, for profiling a
+// running server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	httppprof "net/http/pprof"
+	"os"
+	"runtime/pprof"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errPprofNotLoopback = errors.New("the pprof endpoints can only be served on a loopback address or a Unix socket")
+
+// pprofMux returns a mux with the pprof endpoints, under /debug/pprof/
+func pprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+	return mux
+}
+
+// profileLabels labels the profile samples of each request with the URL
+// path and method, so that the time spent in a Lua handler can be found
+// with "go tool pprof -tagfocus path=/api".
+func profileLabels(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		labels := pprof.Labels("path", req.URL.Path, "method", req.Method)
+		pprof.Do(req.Context(), labels, func(ctx context.Context) {
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	})
+}
+
+// ServePprof serves the pprof endpoints at the address given with --pprof,
+// which must be a loopback address or a Unix socket. The token given with
+// --ctltoken is required, if there is one.
+func (ac *Config) ServePprof() error {
+	network, address := controlAddress(ac.pprofAddress)
+	if network == "tcp" {
+		host, _, _ := net.SplitHostPort(address)
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return errPprofNotLoopback
+		}
+	} else if _, err := os.Stat(address); err == nil {
+		// Remove any leftover socket from a previous run
+		if err := os.Remove(address); err != nil {
+			return err
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		if err := os.Chmod(address, 0600); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	AtShutdown(func() {
+		listener.Close()
+		// The socket is in use by the new process, if restarted
+		if network == "unix" && !ac.listeners.HandedOver() {
+			os.Remove(address)
+		}
+	})
+	log.Info("Serving pprof at " + address + "/debug/pprof/")
+	return http.Serve(listener, ac.controlAuth(pprofMux()))
+}
@@ -0,0 +1,101 @@
+package engine
+
+// Precompressed static files, like "app.js.br" and "app.js.gz" next to
+// "app.js", as created by build pipelines, are served instead of the file
+// to clients that accept brotli or gzip
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// precompressedFile is a content encoding, and the extension of the files
+// that are compressed with it
+type precompressedFile struct {
+	encoding string
+	ext      string
+}
+
+// precompressedFiles are the precompressed files that are looked for, in the
+// order they are preferred
+var precompressedFiles = []precompressedFile{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// acceptsEncoding checks if an Accept-Encoding header value, like
+// "gzip, deflate, br;q=0.5", allows the content encoding. Encodings with a
+// q-value of 0 are not allowed.
+func acceptsEncoding(acceptEncoding, encoding string) bool {
+	accepted := false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name != encoding && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+				if x, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = x
+				}
+			}
+		}
+		if name == encoding {
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
+
+// servePrecompressed serves a precompressed sibling of the file, if there
+// is one that the client accepts, and if it is not older than the file.
+// The content type must be set already. Returns true if the request has
+// been handled.
+func (ac *Config) servePrecompressed(w http.ResponseWriter, req *http.Request, filename string) bool {
+	// Ranges are for the bytes of the uncompressed file
+	if req.Header.Get("Range") != "" {
+		return false
+	}
+	acceptEncoding := req.Header.Get("Accept-Encoding")
+	for _, pf := range precompressedFiles {
+		compressedFilename := filename + pf.ext
+		if !ac.fs.Exists(compressedFilename) {
+			continue
+		}
+		// The response depends on the Accept-Encoding header
+		addVary(w.Header(), "Accept-Encoding")
+		if !acceptsEncoding(acceptEncoding, pf.encoding) {
+			continue
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			return false
+		}
+		compressedInfo, err := os.Stat(compressedFilename)
+		if err != nil || !compressedInfo.Mode().IsRegular() || compressedInfo.ModTime().Before(info.ModTime()) {
+			continue
+		}
+		f, err := os.Open(compressedFilename)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		w.Header().Set("Content-Encoding", pf.encoding)
+		etag := ac.fileETag(compressedFilename, compressedInfo, func() []byte {
+			data, _ := ioutil.ReadFile(compressedFilename)
+			return data
+		})
+		if ac.notModified(w, req, etag, info.ModTime()) {
+			return true
+		}
+		http.ServeContent(w, req, filename, info.ModTime(), f)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"net/http"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/gopher-lua"
+)
+
+// LoadProtobufFunctions adds protobuf.respond to the protobuf table, for
+// responding with a Protocol Buffers message. print can not be used, since
+// it adds a newline.
+func (ac *Config) LoadProtobufFunctions(w http.ResponseWriter, L *lua.LState) {
+	t, ok := L.GetGlobal("protobuf").(*lua.LTable)
+	if !ok {
+		return
+	}
+
+	// Encode a table as a message of the given type, and write it to the
+	// client, as application/x-protobuf if no content type is set. Returns
+	// true, or false and an error message.
+	L.SetField(t, "respond", L.NewFunction(func(L *lua.LState) int {
+		L.Push(L.GetField(t, "encode"))
+		L.Push(L.Get(1))
+		L.Push(L.Get(2))
+		L.Call(2, 2)
+		data, err := L.Get(-2), L.Get(-1)
+		L.Pop(2)
+		if data == lua.LNil {
+			L.Push(lua.LBool(false))
+			L.Push(err)
+			return 2 // number of results
+		}
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "application/x-protobuf")
+		}
+		w.Write([]byte(data.String()))
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
+
+// LoadProtobufConfigFunctions makes the function for loading Protocol
+// Buffers descriptor sets available to the server configuration
+func (ac *Config) LoadProtobufConfigFunctions(L *lua.LState, filename string) {
+
+	// Load the message types from a descriptor set, as created with
+	// "protoc --include_imports --descriptor_set_out=FILE". The filename is
+	// relative to the configuration script. Returns true if successful.
+	L.SetGlobal("ProtobufDescriptors", L.NewFunction(func(L *lua.LState) int {
+		descriptorFilename := L.CheckString(1)
+		if !filepath.IsAbs(descriptorFilename) {
+			descriptorFilename = filepath.Join(filepath.Dir(filename), descriptorFilename)
+		}
+		if err := ac.protoRegistry.AddFile(descriptorFilename); err != nil {
+			log.Errorf("Could not load %s: %s", descriptorFilename, err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,194 @@
+package engine
+
+// Reverse proxy routes, for serving a backend API next to the Lua handlers
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/gopher-lua"
+)
+
+// proxyOptions are the optional settings for a reverse proxy route
+type proxyOptions struct {
+	headers         map[string]string // request headers to set, or remove if the value is empty
+	responseHeaders map[string]string // response headers to set, or remove if the value is empty
+	stripPrefix     bool              // remove the route path from the request path
+	preserveHost    bool              // pass on the Host header from the client
+	timeout         time.Duration     // for connecting and for waiting for the response headers
+}
+
+// proxyResponseWriter records the status code and the number of bytes
+// written, while still supporting flushing and WebSocket connections
+type proxyResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	written    int64
+}
+
+// WriteHeader records the status code before writing it
+func (pw *proxyResponseWriter) WriteHeader(statusCode int) {
+	pw.statusCode = statusCode
+	pw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write counts the bytes that are written
+func (pw *proxyResponseWriter) Write(b []byte) (int, error) {
+	n, err := pw.ResponseWriter.Write(b)
+	pw.written += int64(n)
+	return n, err
+}
+
+// Flush passes on flushing, for streaming responses
+func (pw *proxyResponseWriter) Flush() {
+	if flusher, ok := pw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack takes over the connection, for passing WebSocket connections through
+func (pw *proxyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := pw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		// The server timeouts are meant for regular requests, not for long-lived connections
+		conn.SetDeadline(time.Time{})
+	}
+	return conn, rw, err
+}
+
+// setHeaders sets the given headers, or removes them if the value is empty
+func setHeaders(header http.Header, headers map[string]string) {
+	for key, value := range headers {
+		if value == "" {
+			header.Del(key)
+		} else {
+			header.Set(key, value)
+		}
+	}
+}
+
+// isTimeout checks if an error from the proxy transport is a timeout
+func isTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// ProxyHandler returns a handler that passes requests for the given path on
+// to the given backend URL. Errors are served as "502 Bad Gateway" or
+// "504 Gateway Timeout".
+func (ac *Config) ProxyHandler(handlePath string, target *url.URL, options proxyOptions) http.HandlerFunc {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		clientHost := req.Host
+		if options.stripPrefix {
+			req.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, handlePath), "/")
+			req.URL.RawPath = ""
+		}
+		director(req)
+		if !options.preserveHost {
+			req.Host = target.Host
+		}
+		req.Header.Set("X-Forwarded-Host", clientHost)
+		if req.TLS != nil {
+			req.Header.Set("X-Forwarded-Proto", "https")
+		} else {
+			req.Header.Set("X-Forwarded-Proto", "http")
+		}
+		setHeaders(req.Header, options.headers)
+	}
+	if len(options.responseHeaders) > 0 {
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			setHeaders(resp.Header, options.responseHeaders)
+			return nil
+		}
+	}
+	if options.timeout > 0 {
+		proxy.Transport = &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: options.timeout}).DialContext,
+			ResponseHeaderTimeout: options.timeout,
+			MaxIdleConnsPerHost:   16,
+		}
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		log.Error("Proxy for "+handlePath+" failed: ", err)
+		if isTimeout(err) {
+			ac.ErrorPage(w, req, httperror.New(http.StatusGatewayTimeout, ""))
+			return
+		}
+		ac.ErrorPage(w, req, httperror.New(http.StatusBadGateway, ""))
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		pw := &proxyResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		proxy.ServeHTTP(pw, req)
+		ac.LogAccess(req, pw.statusCode, pw.written)
+	}
+}
+
+// tableToHeaders converts a Lua table with header names and values to a map
+func tableToHeaders(t *lua.LTable) map[string]string {
+	headers := make(map[string]string)
+	t.ForEach(func(key, value lua.LValue) {
+		headers[key.String()] = value.String()
+	})
+	return headers
+}
+
+// LoadProxyFunctions makes functions for setting up reverse proxy routes
+// available to Lua scripts
+func (ac *Config) LoadProxyFunctions(L *lua.LState, mux *http.ServeMux) {
+
+	// Pass requests for an URL prefix on to a backend server, for example:
+	// proxy("/api/", "http://localhost:8081", {stripprefix = true})
+	L.SetGlobal("proxy", L.NewFunction(func(L *lua.LState) int {
+		handlePath := L.ToString(1)
+		target, err := url.Parse(L.ToString(2))
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			log.Error("Invalid proxy URL: ", L.ToString(2))
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+
+		var options proxyOptions
+		if t, ok := L.Get(3).(*lua.LTable); ok {
+			if headers, ok := L.GetField(t, "headers").(*lua.LTable); ok {
+				options.headers = tableToHeaders(headers)
+			}
+			if headers, ok := L.GetField(t, "responseheaders").(*lua.LTable); ok {
+				options.responseHeaders = tableToHeaders(headers)
+			}
+			options.stripPrefix = lua.LVAsBool(L.GetField(t, "stripprefix"))
+			options.preserveHost = lua.LVAsBool(L.GetField(t, "preservehost"))
+			if seconds, ok := L.GetField(t, "timeout").(lua.LNumber); ok {
+				options.timeout = time.Duration(float64(seconds) * float64(time.Second))
+			}
+		}
+
+		proxyHandler := ac.ProxyHandler(handlePath, target, options)
+
+		// Keep track of the route, for the management API
+		ac.routes.Add(mux, handlePath, "proxy to "+target.String())
+
+		ac.handleRateLimited(mux, handlePath, proxyHandler, ac.defaultTheme)
+
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+}
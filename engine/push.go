@@ -0,0 +1,41 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// pusherKey is the context key for the http.Pusher of the original
+// ResponseWriter, which may be wrapped before reaching the handlers
+type pusherKey struct{}
+
+// withPusher stores the http.Pusher of the given ResponseWriter in the
+// request context, if the connection supports HTTP/2 server push
+func withPusher(w http.ResponseWriter, req *http.Request) *http.Request {
+	if pusher, ok := w.(http.Pusher); ok {
+		return req.WithContext(context.WithValue(req.Context(), pusherKey{}, pusher))
+	}
+	return req
+}
+
+// Push initiates a HTTP/2 server push of the given resource. Relative paths
+// are relative to the requested URL path. Returns false if the resource could
+// not be pushed, for instance over HTTP/1.1.
+func Push(w http.ResponseWriter, req *http.Request, resource string) bool {
+	pusher, ok := w.(http.Pusher)
+	if !ok {
+		if pusher, ok = req.Context().Value(pusherKey{}).(http.Pusher); !ok {
+			return false
+		}
+	}
+	if !strings.HasPrefix(resource, "/") {
+		dir := req.URL.Path
+		if !strings.HasSuffix(dir, "/") {
+			dir = path.Dir(dir)
+		}
+		resource = path.Join(dir, resource)
+	}
+	return pusher.Push(resource, nil) == nil
+}
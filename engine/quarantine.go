@@ -0,0 +1,253 @@
+package engine
+
+// Quarantining Lua handlers that fail repeatedly, by serving the last good
+// response or an error page for a while, instead of running the broken
+// script for every request
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/httperror"
+)
+
+const (
+	// How many last good responses are kept for each handler
+	maxQuarantineResponses = 100
+
+	// Larger responses are not kept
+	maxQuarantineBody = 1 << 20
+)
+
+// goodResponse is a response from a handler, for serving while it is in
+// quarantine
+type goodResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+// quarantineState is the state of one handler
+type quarantineState struct {
+	failures  int                      // failures in a row
+	until     time.Time                // in quarantine until this time
+	responses map[string]*goodResponse // by URL
+}
+
+// quarantineTable keeps the state of the handlers, by filename
+type quarantineTable struct {
+	mut      sync.Mutex
+	handlers map[string]*quarantineState
+}
+
+// get returns the state of a handler. The table must be locked.
+func (qt *quarantineTable) get(filename string) *quarantineState {
+	if qt.handlers == nil {
+		qt.handlers = make(map[string]*quarantineState)
+	}
+	qs, ok := qt.handlers[filename]
+	if !ok {
+		qs = &quarantineState{responses: make(map[string]*goodResponse)}
+		qt.handlers[filename] = qs
+	}
+	return qs
+}
+
+// Quarantined checks if a handler is in quarantine, and returns the last
+// good response for the URL, if there is one
+func (qt *quarantineTable) Quarantined(filename, url string) (bool, *goodResponse) {
+	qt.mut.Lock()
+	defer qt.mut.Unlock()
+	qs, ok := qt.handlers[filename]
+	if !ok || time.Now().After(qs.until) {
+		return false, nil
+	}
+	return true, qs.responses[url]
+}
+
+// Fail counts a failure, and puts the handler in quarantine if it has failed
+// too many times in a row. Returns the number of failures in a row.
+func (qt *quarantineTable) Fail(filename string, threshold int, duration time.Duration) int {
+	qt.mut.Lock()
+	defer qt.mut.Unlock()
+	qs := qt.get(filename)
+	qs.failures++
+	if qs.failures >= threshold {
+		qs.until = time.Now().Add(duration)
+	}
+	return qs.failures
+}
+
+// Succeed resets the failures and keeps the response, if given. Returns
+// true if the handler had been in quarantine.
+func (qt *quarantineTable) Succeed(filename, url string, response *goodResponse) bool {
+	qt.mut.Lock()
+	defer qt.mut.Unlock()
+	qs, ok := qt.handlers[filename]
+	if !ok {
+		if response == nil {
+			return false
+		}
+		qs = qt.get(filename)
+	}
+	recovered := !qs.until.IsZero()
+	qs.failures = 0
+	qs.until = time.Time{}
+	if response != nil {
+		if _, ok := qs.responses[url]; !ok && len(qs.responses) >= maxQuarantineResponses {
+			// Make room by removing any one of the responses
+			for key := range qs.responses {
+				delete(qs.responses, key)
+				break
+			}
+		}
+		qs.responses[url] = response
+	}
+	return recovered
+}
+
+// responseKeeper passes a response on, while keeping a copy of it
+type responseKeeper struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+	tooLarge   bool
+}
+
+// WriteHeader records the status code before writing it
+func (rk *responseKeeper) WriteHeader(statusCode int) {
+	if rk.statusCode == 0 {
+		rk.statusCode = statusCode
+	}
+	rk.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write keeps a copy of the body, unless it is too large
+func (rk *responseKeeper) Write(b []byte) (int, error) {
+	if rk.statusCode == 0 {
+		rk.statusCode = http.StatusOK
+	}
+	if !rk.tooLarge {
+		if rk.body.Len()+len(b) > maxQuarantineBody {
+			rk.tooLarge = true
+			rk.body.Reset()
+		} else {
+			rk.body.Write(b)
+		}
+	}
+	return rk.ResponseWriter.Write(b)
+}
+
+// Flush passes on flushing, for streaming responses
+func (rk *responseKeeper) Flush() {
+	if flusher, ok := rk.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the wrapped ResponseWriter be hijacked, for WebSockets
+func (rk *responseKeeper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rk.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	rk.tooLarge = true
+	return hijacker.Hijack()
+}
+
+// goodResponse returns the response, if it can be served to others later.
+// Only complete, successful responses to GET requests from visitors that are
+// not logged in, without cookies and that are not private, are kept.
+func (ac *Config) goodResponse(req *http.Request, rk *responseKeeper) *goodResponse {
+	if req.Method != http.MethodGet || rk.tooLarge || rk.statusCode < 200 || rk.statusCode > 299 {
+		return nil
+	}
+	header := rk.Header()
+	cacheControl := strings.ToLower(header.Get("Cache-Control"))
+	if header.Get("Set-Cookie") != "" || strings.Contains(cacheControl, "private") || strings.Contains(cacheControl, "no-store") {
+		return nil
+	}
+	if req.Header.Get("Authorization") != "" {
+		return nil
+	}
+	if ac.perm != nil {
+		if username, err := ac.perm.UserState().UsernameCookie(req); err == nil && username != "" {
+			return nil
+		}
+	}
+	return &goodResponse{statusCode: rk.statusCode, header: header.Clone(), body: append([]byte{}, rk.body.Bytes()...)}
+}
+
+// alertQuarantine logs that a handler has been put in quarantine, and
+// notifies the admin users, if notification channels are configured
+func (ac *Config) alertQuarantine(filename string, err error) {
+	log.Errorf("%s failed %d times in a row, and is in quarantine for %s: %s", filename, ac.quarantineThreshold, ac.quarantineDuration, err)
+	if ac.perm == nil || len(ac.notify.Names()) == 0 {
+		return
+	}
+	go func() {
+		usernames, listErr := ac.perm.UserState().AllUsernames()
+		if listErr != nil {
+			log.Error(listErr)
+			return
+		}
+		subject := "Handler in quarantine: " + filename
+		message := fmt.Sprintf("%s failed %d times in a row, and is in quarantine for %s.\n\nThe last error was:\n%s\n", filename, ac.quarantineThreshold, ac.quarantineDuration, err)
+		for _, username := range usernames {
+			if !ac.perm.UserState().IsAdmin(username) {
+				continue
+			}
+			if err := ac.Notify(username, subject, message, nil, false); err != nil {
+				log.Error("Could not notify " + username + ": " + err.Error())
+			}
+		}
+	}()
+}
+
+// QuarantinedLuaPage serves a Lua handler with LuaPage, unless it has failed
+// too many times in a row. Then the last good response for the URL, or a
+// "503 Service Unavailable" page, is served instead until the quarantine is
+// over. Quarantining is disabled in debug mode.
+func (ac *Config) QuarantinedLuaPage(w http.ResponseWriter, req *http.Request, filename string) {
+	if ac.quarantineThreshold <= 0 || ac.debugMode {
+		ac.LuaPage(w, req, filename)
+		return
+	}
+	url := req.URL.RequestURI()
+	if quarantined, response := ac.quarantine.Quarantined(filename, url); quarantined {
+		if response != nil && req.Method == http.MethodGet {
+			for key, values := range response.header {
+				w.Header()[key] = values
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(response.statusCode)
+			w.Write(response.body)
+			return
+		}
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(ac.quarantineDuration.Seconds())))
+		ac.ErrorPage(w, req, httperror.New(http.StatusServiceUnavailable, "This page is temporarily unavailable. Please try again later."))
+		return
+	}
+	rk := &responseKeeper{ResponseWriter: w}
+	err := ac.LuaPage(rk, req, filename)
+	// Errors raised with Error() are meant for the client, and do not count
+	if _, ok := httperror.From(err); err != nil && !ok {
+		failures := ac.quarantine.Fail(filename, ac.quarantineThreshold, ac.quarantineDuration)
+		if failures == ac.quarantineThreshold {
+			ac.alertQuarantine(filename, err)
+		} else if failures > ac.quarantineThreshold {
+			log.Warnf("%s is still failing, and is in quarantine for another %s", filename, ac.quarantineDuration)
+		}
+		return
+	}
+	if ac.quarantine.Succeed(filename, url, ac.goodResponse(req, rk)) {
+		log.Info(filename + " works again, and is no longer in quarantine")
+	}
+}
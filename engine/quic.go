@@ -0,0 +1,18 @@
+//go:build quic
+// +build quic
+
+package engine
+
+import (
+	"net/http"
+
+	"github.com/lucas-clemente/quic-go/h2quic"
+)
+
+// quicServer is a server for HTTP over QUIC
+type quicServer = h2quic.Server
+
+// listenAndServeQUIC serves HTTP over QUIC on the given address
+func listenAndServeQUIC(addr, certFile, keyFile string, handler http.Handler) error {
+	return h2quic.ListenAndServe(addr, certFile, keyFile, handler)
+}
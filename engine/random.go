@@ -0,0 +1,125 @@
+package engine
+
+// Random numbers that are seeded for each request, and a deterministic mode
+// with fixed seeds and timestamps, for reproducible test output and exported
+// static sites
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// The seed in deterministic mode, combined with the requested URL
+const deterministicSeed = 1
+
+// now returns the current time, or a fixed time in deterministic mode. The
+// fixed time is SOURCE_DATE_EPOCH, if set, as for reproducible builds.
+func (ac *Config) now() time.Time {
+	if !ac.deterministic {
+		return time.Now()
+	}
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return time.Unix(epoch, 0)
+	}
+	return time.Unix(0, 0)
+}
+
+// requestSeed returns a seed for the random numbers for a request. The seed
+// is random, or depends only on the method and the URL in deterministic mode.
+func (ac *Config) requestSeed(req *http.Request) int64 {
+	if ac.deterministic {
+		h := fnv.New64a()
+		if req != nil {
+			h.Write([]byte(req.Method + " " + req.URL.String()))
+		}
+		return int64(h.Sum64()) + deterministicSeed
+	}
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+// originalFunction returns a function from a Lua library table, as it was
+// before it was replaced, since the Lua states are reused
+func originalFunction(L *lua.LState, table *lua.LTable, library, name string) *lua.LFunction {
+	key := "algernon.original." + library + "." + name
+	if f, ok := L.G.Registry.RawGetString(key).(*lua.LFunction); ok {
+		return f
+	}
+	f, _ := table.RawGetString(name).(*lua.LFunction)
+	L.G.Registry.RawSetString(key, f)
+	return f
+}
+
+// LoadRandomFunctions replaces math.random and math.randomseed with
+// functions that use a random number generator for only this request. In
+// deterministic mode, os.time and os.date also use a fixed time.
+func (ac *Config) LoadRandomFunctions(req *http.Request, L *lua.LState) {
+	r := rand.New(rand.NewSource(ac.requestSeed(req)))
+
+	if mathTable, ok := L.GetGlobal("math").(*lua.LTable); ok {
+		// The same as math.random from Lua, but with the random number
+		// generator for this request
+		mathTable.RawSetString("random", L.NewFunction(func(L *lua.LState) int {
+			switch L.GetTop() {
+			case 0:
+				L.Push(lua.LNumber(r.Float64()))
+			case 1:
+				n := L.CheckInt(1)
+				L.Push(lua.LNumber(r.Intn(n) + 1))
+			default:
+				min := L.CheckInt(1)
+				max := L.CheckInt(2) + 1
+				L.Push(lua.LNumber(r.Intn(max-min) + min))
+			}
+			return 1 // number of results
+		}))
+		// Only seeds the random number generator for this request
+		mathTable.RawSetString("randomseed", L.NewFunction(func(L *lua.LState) int {
+			r.Seed(L.CheckInt64(1))
+			return 0 // number of results
+		}))
+	}
+
+	if !ac.deterministic {
+		return
+	}
+	osTable, ok := L.GetGlobal("os").(*lua.LTable)
+	if !ok {
+		return
+	}
+	osTime := originalFunction(L, osTable, "os", "time")
+	osDate := originalFunction(L, osTable, "os", "date")
+	if osTime == nil || osDate == nil {
+		return
+	}
+	// The fixed time if no table is given, or else the same as os.time
+	osTable.RawSetString("time", L.NewFunction(func(L *lua.LState) int {
+		if L.GetTop() == 0 {
+			L.Push(lua.LNumber(ac.now().Unix()))
+			return 1 // number of results
+		}
+		L.CallByParam(lua.P{Fn: osTime, NRet: 1, Protect: false}, L.Get(1))
+		return 1 // number of results
+	}))
+	// The fixed time if no time is given, or else the same as os.date
+	osTable.RawSetString("date", L.NewFunction(func(L *lua.LState) int {
+		format := L.OptString(1, "%c")
+		t := lua.LNumber(ac.now().Unix())
+		if L.GetTop() >= 2 {
+			t = L.CheckNumber(2)
+		}
+		L.CallByParam(lua.P{Fn: osDate, NRet: 1, Protect: false}, lua.LString(format), t)
+		return 1 // number of results
+	}))
+}
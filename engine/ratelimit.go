@@ -0,0 +1,267 @@
+package engine
+
+// Rate limits for path prefixes, per IP address, that are configured in the
+// server configuration. The counters can be shared between servers that use
+// the same Redis database.
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/simpleredis"
+)
+
+const (
+	// The prefix of the keys for the shared counters in Redis
+	rateLimitKeyValue = "ratelimit"
+
+	// How many buckets there can be before the full ones are removed
+	maxRateBuckets = 10000
+
+	// Increases a counter, and makes it expire after the given number of
+	// milliseconds if it does not expire already. Scripts are run
+	// atomically, so a counter can not be left without an expiry by
+	// servers that count at the same time.
+	incrExpireScript = `local n = redis.call("INCR", KEYS[1])
+if redis.call("PTTL", KEYS[1]) < 0 then
+  redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return n`
+)
+
+var errCounterReply = errors.New("unexpected reply from Redis when counting the request")
+
+// sharedCounter counts requests in counters that are shared between
+// servers, and that expire by themselves
+type sharedCounter interface {
+	// Inc increases the counter for the key, and returns the new count.
+	// New counters expire after the given duration.
+	Inc(key string, expire time.Duration) (int64, error)
+}
+
+// redisUserState is the user state for Redis, which has the connection pool
+type redisUserState interface {
+	Pool() *simpleredis.ConnectionPool
+	DatabaseIndex() int
+}
+
+// redisCounter keeps shared counters in Redis
+type redisCounter struct {
+	pool    *simpleredis.ConnectionPool
+	dbindex int
+}
+
+// Inc increases the counter for the key, and sets the expiry in the same
+// script, if the counter does not expire already
+func (rc *redisCounter) Inc(key string, expire time.Duration) (int64, error) {
+	conn := rc.pool.Get(rc.dbindex)
+	defer conn.Close()
+	reply, err := conn.Do("EVAL", incrExpireScript, 1, rateLimitKeyValue+":"+key, int64(expire/time.Millisecond))
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, errCounterReply
+	}
+	return n, nil
+}
+
+// tokenBucket has room for a number of requests, and is refilled over time
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimitRule allows a number of requests per period for each IP address,
+// for paths that start with the prefix. If bots is above 0, the rule is only
+// for requests from suspected bots, with a bot score of at least bots.
+type rateLimitRule struct {
+	prefix string
+	n      int
+	period time.Duration
+	shared sharedCounter // nil if the counters are local
+	bots   int
+
+	mut     *sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// allow checks if a request from the given IP address is allowed. If not,
+// the time until the next request is allowed is also returned.
+func (rule *rateLimitRule) allow(ip string, now time.Time) (bool, time.Duration) {
+	if rule.shared != nil {
+		// Count the requests in fixed windows, which expire by themselves
+		window := now.UnixNano() / int64(rule.period)
+		key := rule.prefix + "|" + ip + "|" + strconv.FormatInt(window, 10)
+		count, err := rule.shared.Inc(key, 2*rule.period)
+		if err != nil {
+			log.Error("Could not count the request: ", err)
+			return true, 0
+		}
+		if count > int64(rule.n) {
+			return false, time.Duration((window+1)*int64(rule.period) - now.UnixNano())
+		}
+		return true, 0
+	}
+
+	rule.mut.Lock()
+	defer rule.mut.Unlock()
+	rate := float64(rule.n) / float64(rule.period)
+	bucket, ok := rule.buckets[ip]
+	if !ok {
+		if len(rule.buckets) >= maxRateBuckets {
+			// Remove the buckets that have been refilled
+			for ip, b := range rule.buckets {
+				if b.tokens+float64(now.Sub(b.last))*rate >= float64(rule.n) {
+					delete(rule.buckets, ip)
+				}
+			}
+		}
+		bucket = &tokenBucket{tokens: float64(rule.n), last: now}
+		rule.buckets[ip] = bucket
+	}
+	bucket.tokens = math.Min(float64(rule.n), bucket.tokens+float64(now.Sub(bucket.last))*rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / rate)
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// rateLimitTable keeps the rate limit rules for each mux
+type rateLimitTable struct {
+	ruleTable[*rateLimitRule]
+}
+
+// Get returns the rule with the longest prefix that matches the path, if
+// any, either among the rules for all requests or among the rules for bots
+func (rt *rateLimitTable) Get(mux *http.ServeMux, urlpath string, bots bool) (*rateLimitRule, bool) {
+	var found *rateLimitRule
+	for _, rule := range rt.Rules(mux) {
+		if (rule.bots > 0) != bots {
+			continue
+		}
+		if strings.HasPrefix(urlpath, rule.prefix) && (found == nil || len(rule.prefix) >= len(found.prefix)) {
+			found = rule
+		}
+	}
+	return found, found != nil
+}
+
+// rateLimited checks the rate limit for the path prefix, if any, and the
+// rate limit for suspected bots, and responds with "429 Too Many Requests"
+// if a limit has been reached. Requests without a client address, like over
+// the Unix socket without a trusted proxy, are not limited, instead of all
+// of them sharing one limit. Returns true if the request has been rejected.
+func (ac *Config) rateLimited(mux *http.ServeMux, w http.ResponseWriter, req *http.Request) bool {
+	var (
+		allowed = true
+		wait    time.Duration
+		now     = time.Now()
+		ip      = ac.clientIP(req)
+	)
+	if ip == "" {
+		return false
+	}
+	if rule, ok := ac.rateLimits.Get(mux, req.URL.Path, false); ok {
+		allowed, wait = rule.allow(ip, now)
+	}
+	if rule, ok := ac.rateLimits.Get(mux, req.URL.Path, true); ok && allowed && ac.isBot(req, rule.bots) {
+		allowed, wait = rule.allow(ip, now)
+	}
+	if allowed {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	size := ac.ErrorPage(w, req, httperror.New(http.StatusTooManyRequests, "Too many requests. Please try again later."))
+	ac.LogAccess(req, http.StatusTooManyRequests, size)
+	return true
+}
+
+// checkRateLimitRule creates a rate limit rule from a path prefix, a number
+// of requests and a period like "1m" or a number of seconds, that are given
+// to a Lua function. Returns nil if the arguments are not valid.
+func checkRateLimitRule(L *lua.LState) *rateLimitRule {
+	rule := &rateLimitRule{
+		prefix:  L.CheckString(1),
+		n:       L.CheckInt(2),
+		mut:     &sync.Mutex{},
+		buckets: make(map[string]*tokenBucket),
+	}
+	switch period := L.Get(3).(type) {
+	case lua.LNumber:
+		rule.period = time.Duration(float64(period) * float64(time.Second))
+	case lua.LString:
+		d, err := time.ParseDuration(string(period))
+		if err != nil {
+			L.ArgError(3, err.Error())
+			return nil
+		}
+		rule.period = d
+	default:
+		rule.period = time.Minute
+	}
+	if rule.n <= 0 || rule.period <= 0 {
+		L.ArgError(2, "a number of requests and a period above 0 expected")
+		return nil
+	}
+	return rule
+}
+
+// LoadRateLimitFunctions makes the RateLimit and BotRateLimit functions
+// available to server configuration scripts
+func (ac *Config) LoadRateLimitFunctions(L *lua.LState, mux *http.ServeMux) {
+
+	// Limit how many requests each IP address can make to a path prefix.
+	// Takes a path prefix, a number of requests, a period like "1m" or a
+	// number of seconds, and optionally true for sharing the counters with
+	// other servers that use the same Redis database. Returns true if
+	// successful.
+	L.SetGlobal("RateLimit", L.NewFunction(func(L *lua.LState) int {
+		rule := checkRateLimitRule(L)
+		if rule == nil {
+			return 0 // number of results
+		}
+		if L.OptBool(4, false) {
+			if ac.perm == nil {
+				log.Warn("RateLimit: there is no database backend for sharing the counters")
+			} else if state, ok := ac.perm.UserState().(redisUserState); ok {
+				rule.shared = &redisCounter{state.Pool(), state.DatabaseIndex()}
+			} else {
+				log.Warn("RateLimit: the counters can only be shared when using Redis")
+			}
+		}
+		ac.rateLimits.Add(mux, rule)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+	// Limit how many requests each IP address can make to a path prefix, for
+	// requests from suspected bots only. Takes a path prefix, a number of
+	// requests, a period like "1m" or a number of seconds, and optionally
+	// the bot score that requests must have (70 by default). Returns true if
+	// successful.
+	L.SetGlobal("BotRateLimit", L.NewFunction(func(L *lua.LState) int {
+		rule := checkRateLimitRule(L)
+		if rule == nil {
+			return 0 // number of results
+		}
+		rule.bots = L.OptInt(4, defaultBotThreshold)
+		if rule.bots <= 0 {
+			L.ArgError(4, "a bot score above 0 expected")
+			return 0 // number of results
+		}
+		ac.rateLimits.Add(mux, rule)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
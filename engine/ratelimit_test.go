@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+// memoryCounter is a shared counter that expires the counters like Redis
+type memoryCounter struct {
+	now     *time.Time
+	counts  map[string]int64
+	expires map[string]time.Time
+}
+
+func (mc *memoryCounter) Inc(key string, expire time.Duration) (int64, error) {
+	if until, ok := mc.expires[key]; ok && !mc.now.Before(until) {
+		delete(mc.counts, key)
+		delete(mc.expires, key)
+	}
+	mc.counts[key]++
+	if _, ok := mc.expires[key]; !ok {
+		mc.expires[key] = mc.now.Add(expire)
+	}
+	return mc.counts[key], nil
+}
+
+func TestSharedRateLimitWindows(t *testing.T) {
+	now := time.Unix(1699999980, 0).Add(50 * time.Second)
+	counter := &memoryCounter{&now, make(map[string]int64), make(map[string]time.Time)}
+	rule := &rateLimitRule{prefix: "/api", n: 2, period: time.Minute, shared: counter}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := rule.allow("192.0.2.1", now); !ok {
+			t.Fatalf("request %d was limited", i+1)
+		}
+	}
+	ok, wait := rule.allow("192.0.2.1", now)
+	if ok {
+		t.Fatal("expected the third request to be limited")
+	}
+	// The window started 50 seconds ago, on a whole minute
+	if wait != 10*time.Second {
+		t.Errorf("expected to wait until the next window, got %s", wait)
+	}
+	if ok, _ := rule.allow("192.0.2.2", now); !ok {
+		t.Error("another client was limited")
+	}
+
+	// A new window starts with a new counter
+	now = now.Add(wait)
+	if ok, _ := rule.allow("192.0.2.1", now); !ok {
+		t.Error("the limit was not reset in the next window")
+	}
+
+	// Every counter expires by itself, two periods after it was created
+	if len(counter.expires) != 3 {
+		t.Errorf("expected 3 counters with an expiry, got %d", len(counter.expires))
+	}
+	for key, until := range counter.expires {
+		if !until.Equal(now.Add(2*time.Minute)) && !until.Equal(now.Add(-wait+2*time.Minute)) {
+			t.Errorf("%s: unexpected expiry %s", key, until)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package engine
+
+// Recording requests and responses from live traffic with --record, and
+// replaying them against another server with --replay, for checking that a
+// new version of Algernon, or of an application, responds in the same way.
+// Passwords, tokens, cookies and keys are not recorded.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// The largest request and response bodies that are recorded, larger
+	// ones are only compared by status code and content type
+	maxRecordedBody = 1 << 20
+
+	// The value that replaces passwords, tokens and keys
+	redacted = "REDACTED"
+)
+
+var (
+	errReplayUsage = errors.New("usage: algernon --replay FILE URL")
+	errReplayEmpty = errors.New("found no recorded requests")
+)
+
+// Parts of the names of headers, query parameters, form fields and JSON
+// keys that are for secrets
+var secretNameParts = []string{"password", "passwd", "secret", "token", "session", "auth", "key", "cookie", "csrf"}
+
+// Request headers that are not recorded, since they are for the
+// connection, for caching or for identifying the client
+var unrecordedHeaders = []string{
+	"Accept-Encoding", "Connection", "Content-Length", "If-Modified-Since", "If-None-Match",
+	"Forwarded", "Keep-Alive", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+	"X-Forwarded-For", "X-Real-Ip", "Traceparent", "Tracestate", requestIDHeader,
+}
+
+// recordedRequest is a request, without secrets
+type recordedRequest struct {
+	Method string            `json:"method"`
+	Path   string            `json:"path"`
+	Header map[string]string `json:"header,omitempty"`
+	Body   []byte            `json:"body,omitempty"`
+}
+
+// recordedResponse is the part of a response that is compared when replaying
+type recordedResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+	Truncated   bool   `json:"truncated,omitempty"`
+}
+
+// recording is one line in the file that is written with --record
+type recording struct {
+	Time     string           `json:"time"`
+	Request  recordedRequest  `json:"request"`
+	Response recordedResponse `json:"response"`
+}
+
+// trafficRecorder writes recordings to a file, one JSON object per line
+type trafficRecorder struct {
+	mut sync.Mutex
+	f   *os.File
+}
+
+// openTrafficRecorder opens the file for recordings, for appending
+func openTrafficRecorder(filename string) (*trafficRecorder, error) {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &trafficRecorder{f: f}, nil
+}
+
+// Write writes a recording
+func (tr *trafficRecorder) Write(r recording) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	tr.mut.Lock()
+	defer tr.mut.Unlock()
+	_, err = tr.f.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the file
+func (tr *trafficRecorder) Close() error {
+	tr.mut.Lock()
+	defer tr.mut.Unlock()
+	return tr.f.Close()
+}
+
+// secretName checks if the name of a header, parameter or key is for a secret
+func secretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range secretNameParts {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeValues redacts the values of parameters with secret names
+func sanitizeValues(values url.Values) url.Values {
+	for name := range values {
+		if secretName(name) {
+			values[name] = []string{redacted}
+		}
+	}
+	return values
+}
+
+// sanitizeJSON redacts the values of keys with secret names, recursively
+func sanitizeJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if secretName(key) {
+				v[key] = redacted
+			} else {
+				v[key] = sanitizeJSON(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = sanitizeJSON(value)
+		}
+	}
+	return v
+}
+
+// sanitizeBody redacts secrets in form data and JSON. Returns nil for other
+// content types that can not be sanitized, like uploaded files.
+func sanitizeBody(contentType string, body []byte) []byte {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch {
+	case len(body) == 0:
+		return nil
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil
+		}
+		return []byte(sanitizeValues(values).Encode())
+	case strings.Contains(mediaType, "json"):
+		var v interface{}
+		if json.Unmarshal(body, &v) != nil {
+			return nil
+		}
+		data, err := json.Marshal(sanitizeJSON(v))
+		if err != nil {
+			return nil
+		}
+		return data
+	case strings.HasPrefix(mediaType, "text/"):
+		return body
+	}
+	return nil
+}
+
+// sanitizeRequest returns the request without secrets, with the given body
+func sanitizeRequest(req *http.Request, body []byte) recordedRequest {
+	u := *req.URL
+	u.RawQuery = sanitizeValues(u.Query()).Encode()
+	r := recordedRequest{Method: req.Method, Path: u.RequestURI(), Header: make(map[string]string)}
+	unrecorded := make(map[string]bool, len(unrecordedHeaders))
+	for _, name := range unrecordedHeaders {
+		unrecorded[http.CanonicalHeaderKey(name)] = true
+	}
+	for name := range req.Header {
+		if secretName(name) || unrecorded[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		r.Header[name] = req.Header.Get(name)
+	}
+	r.Body = sanitizeBody(req.Header.Get("Content-Type"), body)
+	return r
+}
+
+// recordingWriter is a ResponseWriter that records the status code, the
+// content type and the start of the body, while writing the response
+type recordingWriter struct {
+	http.ResponseWriter
+	ac        *Config
+	req       *http.Request
+	reqBody   []byte
+	status    int
+	buf       bytes.Buffer
+	truncated bool
+	hijacked  bool
+	start     time.Time
+}
+
+// startRecording wraps the ResponseWriter and the request body, if
+// recording is enabled. Returns nil if not.
+func (ac *Config) startRecording(w http.ResponseWriter, req *http.Request) *recordingWriter {
+	if ac.recorder == nil || strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return nil
+	}
+	rw := &recordingWriter{ResponseWriter: w, ac: ac, status: http.StatusOK, start: time.Now()}
+	if req.Body != nil && req.Body != http.NoBody {
+		// Read the start of the body, and leave the rest for the handler
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxRecordedBody+1))
+		if err != nil {
+			log.Warn("Could not record the request body: ", err)
+		}
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		if len(body) <= maxRecordedBody {
+			rw.reqBody = body
+		}
+	}
+	rw.req = req
+	return rw
+}
+
+// WriteHeader records the status code
+func (rw *recordingWriter) WriteHeader(statusCode int) {
+	rw.status = statusCode
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write records the start of the body
+func (rw *recordingWriter) Write(data []byte) (int, error) {
+	if !rw.truncated {
+		if rw.buf.Len()+len(data) > maxRecordedBody {
+			rw.truncated = true
+			rw.buf.Reset()
+		} else {
+			rw.buf.Write(data)
+		}
+	}
+	return rw.ResponseWriter.Write(data)
+}
+
+// Flush flushes the wrapped ResponseWriter, if possible
+func (rw *recordingWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the wrapped ResponseWriter be hijacked. Hijacked connections
+// are not recorded.
+func (rw *recordingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer can not be hijacked")
+	}
+	rw.hijacked = true
+	return hijacker.Hijack()
+}
+
+// finish writes the recording, unless the connection was hijacked or the
+// response was a stream of events
+func (rw *recordingWriter) finish() {
+	header := rw.Header()
+	contentType := header.Get("Content-Type")
+	if rw.hijacked || strings.HasPrefix(contentType, "text/event-stream") {
+		return
+	}
+	body := rw.buf.Bytes()
+	if !rw.truncated && header.Get("Content-Encoding") == "gzip" {
+		gzr, err := gzip.NewReader(bytes.NewReader(body))
+		if err == nil {
+			body, err = ioutil.ReadAll(io.LimitReader(gzr, maxRecordedBody+1))
+		}
+		if err != nil || len(body) > maxRecordedBody {
+			body, rw.truncated = nil, true
+		}
+	}
+	if encoding := header.Get("Content-Encoding"); encoding != "" && encoding != "gzip" && encoding != "identity" {
+		// Like brotli, which can not be decompressed
+		rw.truncated = true
+	}
+	if rw.truncated {
+		body = nil
+	}
+	if contentType == "" && len(body) > 0 && header.Get("Content-Encoding") == "" {
+		// The content type that net/http detects is not in the header map
+		contentType = http.DetectContentType(body)
+	}
+	r := recording{
+		Time:    rw.start.UTC().Format(time.RFC3339Nano),
+		Request: sanitizeRequest(rw.req, rw.reqBody),
+		Response: recordedResponse{
+			Status:      rw.status,
+			ContentType: contentType,
+			Body:        sanitizeResponseBody(contentType, body),
+			Truncated:   rw.truncated,
+		},
+	}
+	if err := rw.ac.recorder.Write(r); err != nil {
+		log.Warnf("Can not write to %s: %s", rw.ac.recordFilename, err)
+	}
+}
+
+// sanitizeResponseBody redacts secrets in JSON response bodies. Other
+// response bodies are recorded as they are.
+func sanitizeResponseBody(contentType string, body []byte) []byte {
+	if strings.Contains(strings.ToLower(contentType), "json") {
+		if sanitized := sanitizeBody(contentType, body); sanitized != nil {
+			return sanitized
+		}
+	}
+	return body
+}
+
+// readRecordings reads the recordings from a file that was written with
+// --record
+func readRecordings(filename string) ([]recording, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var recordings []recording
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*maxRecordedBody)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var r recording
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		recordings = append(recordings, r)
+	}
+	return recordings, scanner.Err()
+}
+
+// replayRequest sends a recorded request to the server at the base URL,
+// and returns the response with secrets redacted
+func replayRequest(client *http.Client, baseURL string, r recordedRequest) (*diffResponse, error) {
+	req, err := http.NewRequest(r.Method, baseURL+r.Path, bytes.NewReader(r.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range r.Header {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	contentType := resp.Header.Get("Content-Type")
+	return &diffResponse{resp.StatusCode, contentType, sanitizeResponseBody(contentType, body)}, nil
+}
+
+// RunReplay sends the requests that were recorded with --record to the
+// server at the given URL, and outputs the differences between the recorded
+// responses and the new ones. Bodies that were too large to be recorded are
+// not compared.
+func (ac *Config) RunReplay(args []string) error {
+	if len(args) < 2 {
+		return errReplayUsage
+	}
+	recordings, err := readRecordings(args[0])
+	if err != nil {
+		return err
+	}
+	if len(recordings) == 0 {
+		return errReplayEmpty
+	}
+	baseURL := strings.TrimSuffix(args[1], "/")
+	client := newDiffClient()
+	var report diffReport
+	for _, r := range recordings {
+		name := r.Request.Method + " " + r.Request.Path
+		b, err := replayRequest(client, baseURL, r.Request)
+		if err != nil {
+			return err
+		}
+		a := &diffResponse{r.Response.Status, r.Response.ContentType, r.Response.Body}
+		if r.Response.Truncated {
+			a.body = b.body
+		}
+		report.Add(name, compareResponses(a, b))
+	}
+	return report.Done("requests")
+}
@@ -0,0 +1,237 @@
+package engine
+
+// Redirects for moved pages, from a redirects table in the server
+// configuration, or from a _redirects file in the served directory, with
+// lines like "/old/*  /new/:splat  301"
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/gopher-lua"
+)
+
+// The file with redirects, in a served directory
+const redirectsFilename = "_redirects"
+
+var (
+	errRedirect       = errors.New("a redirect needs a path that starts with / and a target")
+	errRedirectStatus = errors.New("the status code for a redirect must be 301, 302, 303, 307 or 308")
+)
+
+// redirectRule redirects requests for a path to a target. The path can
+// have placeholders like ":id", for one part of the path, and end with
+// "*", for the rest of the path, that is given to the target as ":splat".
+type redirectRule struct {
+	from   []string // the parts of the path
+	to     string
+	status int
+}
+
+// redirectStatus checks if the status code can be used for redirecting
+func redirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// newRedirectRule creates a rule. The status is 301 if it is 0.
+func newRedirectRule(from, to string, status int) (*redirectRule, error) {
+	if status == 0 {
+		status = http.StatusMovedPermanently
+	}
+	if !redirectStatus(status) {
+		return nil, errRedirectStatus
+	}
+	if !strings.HasPrefix(from, "/") || to == "" {
+		return nil, errRedirect
+	}
+	return &redirectRule{from: strings.Split(from, "/"), to: to, status: status}, nil
+}
+
+// match returns the target for the path, if the rule matches it
+func (rule *redirectRule) match(urlpath string) (string, bool) {
+	parts := strings.Split(urlpath, "/")
+	var replacements []string
+	for i, part := range rule.from {
+		switch {
+		case part == "*" && i == len(rule.from)-1:
+			if i < len(parts) {
+				replacements = append(replacements, ":splat", strings.Join(parts[i:], "/"))
+			} else {
+				replacements = append(replacements, ":splat", "")
+			}
+			return strings.NewReplacer(replacements...).Replace(rule.to), true
+		case i >= len(parts):
+			return "", false
+		case strings.HasPrefix(part, ":") && len(part) > 1:
+			if parts[i] == "" {
+				return "", false
+			}
+			replacements = append(replacements, part, parts[i])
+		case part != parts[i]:
+			return "", false
+		}
+	}
+	if len(parts) != len(rule.from) {
+		return "", false
+	}
+	if len(replacements) == 0 {
+		return rule.to, true
+	}
+	return strings.NewReplacer(replacements...).Replace(rule.to), true
+}
+
+// redirectTable keeps the redirect rules for each mux, in order
+type redirectTable struct {
+	ruleTable[*redirectRule]
+}
+
+// Lookup returns the target and the status code of the first rule that
+// matches the path, if any
+func (rt *redirectTable) Lookup(mux *http.ServeMux, urlpath string) (string, int, bool) {
+	for _, rule := range rt.Rules(mux) {
+		if target, ok := rule.match(urlpath); ok {
+			return target, rule.status, true
+		}
+	}
+	return "", 0, false
+}
+
+// Lines returns the redirect rules for the given mux, as sorted lines like
+// "/old/* -> /new/:splat 301"
+func (rt *redirectTable) Lines(mux *http.ServeMux) []string {
+	var lines []string
+	for _, rule := range rt.Rules(mux) {
+		lines = append(lines, strings.Join(rule.from, "/")+" -> "+rule.to+" "+strconv.Itoa(rule.status))
+	}
+	sort.Strings(lines)
+	return unique(lines)
+}
+
+// redirected redirects the request if there is a redirect rule for the
+// path. The query string is passed on if the target has none. Returns true
+// if the request has been redirected.
+func (ac *Config) redirected(mux *http.ServeMux, w http.ResponseWriter, req *http.Request) bool {
+	target, status, ok := ac.redirects.Lookup(mux, req.URL.Path)
+	if !ok {
+		return false
+	}
+	if req.URL.RawQuery != "" && !strings.Contains(target, "?") {
+		target += "?" + req.URL.RawQuery
+	}
+	http.Redirect(w, req, target, status)
+	ac.LogAccess(req, status, 0)
+	return true
+}
+
+// parseRedirects parses the lines of a _redirects file, with a path, a
+// target and an optional status code on each line. Empty lines and lines
+// starting with "#" are skipped.
+func parseRedirects(data []byte, prefix string) ([]*redirectRule, error) {
+	var rules []*redirectRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, errRedirect)
+		}
+		status := 0
+		if len(fields) == 3 {
+			var err error
+			if status, err = strconv.Atoi(strings.TrimSuffix(fields[2], "!")); err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNumber, errRedirectStatus)
+			}
+		}
+		rule, err := newRedirectRule(prefix+fields[0], fields[1], status)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// loadRedirectsFile adds the redirects from the _redirects file in the
+// served directory, if there is one. The paths are relative to the path
+// the directory is served at.
+func (ac *Config) loadRedirectsFile(mux *http.ServeMux, handlePath, servedir string) {
+	filename := filepath.Join(servedir, redirectsFilename)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	rules, err := parseRedirects(data, strings.TrimSuffix(handlePath, "/"))
+	if err != nil {
+		log.Errorf("%s: %s", filename, err)
+		return
+	}
+	ac.redirects.Add(mux, rules...)
+}
+
+// addRedirects adds the redirects from a redirects table in a
+// configuration script, like:
+//
+//	redirects = {
+//	  ["/old.html"] = "/new.html",
+//	  ["/blog/*"] = { "/news/:splat", 302 },
+//	}
+//
+// The longest paths are tried first. The status code is 301 if it is not
+// given.
+func (ac *Config) addRedirects(mux *http.ServeMux, redirects *lua.LTable) error {
+	var (
+		rules []*redirectRule
+		err   error
+	)
+	redirects.ForEach(func(key, value lua.LValue) {
+		if err != nil {
+			return
+		}
+		var (
+			to     string
+			status int
+		)
+		switch v := value.(type) {
+		case lua.LString:
+			to = string(v)
+		case *lua.LTable:
+			to = lua.LVAsString(v.RawGetInt(1))
+			if n, ok := v.RawGetInt(2).(lua.LNumber); ok {
+				status = int(n)
+			}
+		}
+		rule, ruleErr := newRedirectRule(key.String(), to, status)
+		if ruleErr != nil {
+			err = fmt.Errorf("redirects: %s: %s", key.String(), ruleErr)
+			return
+		}
+		rules = append(rules, rule)
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := strings.Join(rules[i].from, "/"), strings.Join(rules[j].from, "/")
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	ac.redirects.Add(mux, rules...)
+	return nil
+}
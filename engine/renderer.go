@@ -0,0 +1,314 @@
+package engine
+
+// Template engines and other renderers, by filename extension. The built-in
+// renderers, like Markdown, Amber and Pongo2, are registered the same way
+// as renderers from Go code that uses the engine, and from Lua, so that new
+// engines can be added without changing FilePage.
+
+import (
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/datablock"
+	"github.com/xyproto/gopher-lua"
+)
+
+// Renderer serves a file that needs to be rendered, like a Markdown page or
+// a template. ext is the lowercase extension of the filename, like ".md".
+type Renderer interface {
+	Render(w http.ResponseWriter, req *http.Request, filename, ext string)
+}
+
+// RendererFunc lets an ordinary function be used as a Renderer
+type RendererFunc func(w http.ResponseWriter, req *http.Request, filename, ext string)
+
+// Render calls f(w, req, filename, ext)
+func (f RendererFunc) Render(w http.ResponseWriter, req *http.Request, filename, ext string) {
+	f(w, req, filename, ext)
+}
+
+// rendererKey is the key for a renderer that was registered by a server
+// configuration script, for the given mux and extension
+type rendererKey struct {
+	mux *http.ServeMux
+	ext string
+}
+
+// rendererTable keeps the renderers for the filename extensions. Renderers
+// from the server configuration are only used for the requests to the mux
+// they were registered for, before the ones from Go, and are forgotten
+// together with the mux.
+type rendererTable struct {
+	mut       sync.RWMutex
+	renderers map[string]Renderer
+	scripts   map[rendererKey]Renderer
+}
+
+// Set registers a renderer for the given extension, like ".md"
+func (rt *rendererTable) Set(ext string, r Renderer) {
+	rt.mut.Lock()
+	defer rt.mut.Unlock()
+	if rt.renderers == nil {
+		rt.renderers = make(map[string]Renderer)
+	}
+	rt.renderers[strings.ToLower(ext)] = r
+}
+
+// SetForMux registers a renderer for the given extension, from the server
+// configuration for the given mux
+func (rt *rendererTable) SetForMux(mux *http.ServeMux, ext string, r Renderer) {
+	rt.mut.Lock()
+	defer rt.mut.Unlock()
+	if rt.scripts == nil {
+		rt.scripts = make(map[rendererKey]Renderer)
+	}
+	rt.scripts[rendererKey{mux, strings.ToLower(ext)}] = r
+}
+
+// Get returns the renderer for the given extension, for the requests to the
+// given mux, or nil
+func (rt *rendererTable) Get(mux *http.ServeMux, ext string) Renderer {
+	rt.mut.RLock()
+	defer rt.mut.RUnlock()
+	if r, ok := rt.scripts[rendererKey{mux, ext}]; ok {
+		return r
+	}
+	return rt.renderers[ext]
+}
+
+// Extensions returns the extensions that have a renderer for the given mux,
+// sorted
+func (rt *rendererTable) Extensions(mux *http.ServeMux) []string {
+	rt.mut.RLock()
+	defer rt.mut.RUnlock()
+	extensions := make([]string, 0, len(rt.renderers))
+	for ext := range rt.renderers {
+		extensions = append(extensions, ext)
+	}
+	for key := range rt.scripts {
+		if _, ok := rt.renderers[key.ext]; !ok && key.mux == mux {
+			extensions = append(extensions, key.ext)
+		}
+	}
+	sort.Strings(extensions)
+	return extensions
+}
+
+// Forget removes the renderers that were registered for the given mux
+func (rt *rendererTable) Forget(mux *http.ServeMux) {
+	rt.mut.Lock()
+	defer rt.mut.Unlock()
+	for key := range rt.scripts {
+		if key.mux == mux {
+			delete(rt.scripts, key)
+		}
+	}
+}
+
+// RegisterRenderer makes the renderer serve the files with the given
+// extensions, like ".mustache", instead of the built-in renderer or
+// serving them as static files. Must be called before serving.
+func (ac *Config) RegisterRenderer(r Renderer, extensions ...string) {
+	for _, ext := range extensions {
+		ac.renderers.Set(ext, r)
+	}
+}
+
+// registerBuiltinRenderers registers the renderers that come with Algernon
+func (ac *Config) registerBuiltinRenderers() {
+	ac.RegisterRenderer(RendererFunc(ac.renderMarkdown), ".md", ".markdown")
+	ac.RegisterRenderer(RendererFunc(ac.renderAmber), ".amber", ".amb")
+	ac.RegisterRenderer(RendererFunc(ac.PongoHandler), ".po2", ".pongo2", ".tpl", ".tmpl")
+	ac.RegisterRenderer(RendererFunc(ac.renderGCSS), ".gcss")
+	ac.RegisterRenderer(RendererFunc(ac.renderSCSS), ".scss")
+	ac.RegisterRenderer(RendererFunc(ac.renderHyperApp), ".happ", ".hyper", ".hyper.jsx", ".hyper.js")
+	ac.RegisterRenderer(RendererFunc(ac.renderJSX), ".jsx")
+}
+
+// renderMarkdown renders a Markdown page as HTML
+func (ac *Config) renderMarkdown(w http.ResponseWriter, req *http.Request, filename, ext string) {
+	w.Header().Add("Content-Type", "text/html;charset=utf-8")
+	if ac.serveCachedMarkdownPage(w, req, filename) {
+		return
+	}
+	if markdownblock, err := ac.ReadAndLogErrors(w, filename, ext); err == nil { // if no error
+		// Render the markdown page
+		ac.MarkdownPage(w, req, markdownblock.MustData(), filename)
+	}
+}
+
+// renderAmber renders an Amber template as HTML, with the functions from
+// the Lua data file in the same directory, if there is one
+func (ac *Config) renderAmber(w http.ResponseWriter, req *http.Request, filename, ext string) {
+	w.Header().Add("Content-Type", "text/html;charset=utf-8")
+	amberblock, err := ac.ReadAndLogErrors(w, filename, ext)
+	if err != nil {
+		return
+	}
+
+	// Try reading luaDataFilename as well, if possible
+	luafilename := filepath.Join(filepath.Dir(filename), ac.defaultLuaDataFilename)
+	luablock, err := ac.cache.Read(luafilename, ac.shouldCache(ext))
+	if err != nil {
+		// Could not find and/or read luaDataFilename
+		luablock = datablock.EmptyDataBlock
+	}
+	// Make functions from the given Lua data available
+	funcs := make(template.FuncMap)
+	// luablock can be empty if there was an error or if the file was empty
+	if luablock.HasData() {
+		// There was Lua code available. Now make the functions and
+		// variables available for the template.
+		funcs, err = ac.LuaFunctionMap(w, req, luablock.MustData(), luafilename)
+		if err != nil {
+			if ac.debugMode {
+				// Use the Lua filename as the title
+				ac.PrettyError(w, req, luafilename, luablock.MustData(), err.Error(), "lua")
+			} else {
+				log.Error(err)
+			}
+			return
+		}
+		if ac.debugMode && ac.verboseMode {
+			s := "These functions from " + luafilename
+			s += " are useable for " + filename + ": "
+			// Create a comma separated list of the available functions
+			for key := range funcs {
+				s += key + ", "
+			}
+			// Remove the final comma
+			if strings.HasSuffix(s, ", ") {
+				s = s[:len(s)-2]
+			}
+			// Output the message
+			log.Info(s)
+		}
+	}
+
+	// Render the Amber page, using functions from luaDataFilename, if available
+	ac.AmberPage(w, req, filename, amberblock.MustData(), funcs)
+}
+
+// renderGCSS renders a GCSS file as CSS
+func (ac *Config) renderGCSS(w http.ResponseWriter, req *http.Request, filename, ext string) {
+	if gcssblock, err := ac.ReadAndLogErrors(w, filename, ext); err == nil { // if no error
+		w.Header().Add("Content-Type", "text/css;charset=utf-8")
+		// Render the GCSS page as CSS
+		ac.GCSSPage(w, req, filename, gcssblock.MustData())
+	}
+}
+
+// renderSCSS renders a SASS file (with the .scss extension) as CSS
+func (ac *Config) renderSCSS(w http.ResponseWriter, req *http.Request, filename, ext string) {
+	if scssblock, err := ac.ReadAndLogErrors(w, filename, ext); err == nil { // if no error
+		// Render the SASS page (with .scss extension) as CSS
+		w.Header().Add("Content-Type", "text/css;charset=utf-8")
+		ac.SCSSPage(w, req, filename, scssblock.MustData())
+	}
+}
+
+// renderHyperApp renders hyperApp JSX as JavaScript, wrapped in HTML
+func (ac *Config) renderHyperApp(w http.ResponseWriter, req *http.Request, filename, ext string) {
+	if jsxblock, err := ac.ReadAndLogErrors(w, filename, ext); err == nil { // if no error
+		// Render the JSX page as HTML with embedded JavaScript
+		w.Header().Add("Content-Type", "text/html;charset=utf-8")
+		ac.HyperAppPage(w, req, filename, jsxblock.MustData())
+	} else {
+		log.Error("Error when serving " + filename + ":" + err.Error())
+	}
+}
+
+// renderJSX renders JSX as JavaScript
+func (ac *Config) renderJSX(w http.ResponseWriter, req *http.Request, filename, ext string) {
+	if jsxblock, err := ac.ReadAndLogErrors(w, filename, ext); err == nil { // if no error
+		// Render the JSX page as JavaScript
+		w.Header().Add("Content-Type", "text/javascript;charset=utf-8")
+		ac.JSXPage(w, req, filename, jsxblock.MustData())
+	}
+}
+
+// luaRenderer renders files with a Lua function from the server
+// configuration, that is given the contents and the filename, and that
+// returns the rendered page and optionally the content type
+type luaRenderer struct {
+	ac  *Config
+	mut sync.Mutex // the Lua state is shared with the server configuration
+	L   *lua.LState
+	fn  *lua.LFunction
+}
+
+// Render calls the Lua function and serves the result
+func (lr *luaRenderer) Render(w http.ResponseWriter, req *http.Request, filename, ext string) {
+	ac := lr.ac
+	block, err := ac.ReadAndLogErrors(w, filename, ext)
+	if err != nil {
+		return
+	}
+	source := block.MustData()
+
+	lr.mut.Lock()
+	lr.L.Push(lr.fn)
+	lr.L.Push(lua.LString(source))
+	lr.L.Push(lua.LString(filename))
+	err = lr.L.PCall(2, 2, nil)
+	var output, contentType string
+	if err == nil {
+		output = lr.L.ToString(-2)
+		contentType = lr.L.ToString(-1)
+		lr.L.Pop(2)
+	}
+	lr.mut.Unlock()
+
+	if err != nil {
+		if e, ok := httperror.From(err); ok {
+			// An error raised with Error(), meant for the client
+			ac.ErrorPage(w, req, e)
+		} else if ac.debugMode {
+			ac.PrettyError(w, req, filename, source, err.Error(), "lua")
+		} else {
+			log.Error("Renderer for "+ext+" failed: ", err)
+			ac.ErrorPage(w, req, httperror.New(http.StatusInternalServerError, ""))
+		}
+		return
+	}
+	if contentType == "" {
+		contentType = "text/html;charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	ac.DataToClient(w, req, filename, []byte(output))
+}
+
+// LoadRendererFunctions makes it possible to add renderers for filename
+// extensions from the server configuration
+func (ac *Config) LoadRendererFunctions(L *lua.LState, mux *http.ServeMux) {
+
+	// Render the files with the given extensions with a Lua function, that
+	// is given the contents and the filename, and returns the rendered page
+	// and optionally the content type, for example:
+	// Renderer(".mustache", function(source, filename) return CallPlugin("mustache", "Render", source) end)
+	L.SetGlobal("Renderer", L.NewFunction(func(L *lua.LState) int {
+		top := L.GetTop()
+		fn := L.CheckFunction(top)
+		if top < 2 {
+			L.ArgError(1, "expected a filename extension, like \".mustache\"")
+			return 0 // number of results
+		}
+		r := &luaRenderer{ac: ac, L: L, fn: fn}
+		for i := 1; i < top; i++ {
+			ext := L.CheckString(i)
+			if !strings.HasPrefix(ext, ".") {
+				log.Error("Renderer: expected a filename extension, like \".mustache\", got: ", ext)
+				continue
+			}
+			ac.renderers.SetForMux(mux, ext, r)
+		}
+		return 0 // number of results
+	}))
+
+}
@@ -0,0 +1,51 @@
+package engine
+
+import (
+	"net/http"
+	"testing"
+)
+
+// namedRenderer is a renderer that can be told apart from the others
+type namedRenderer string
+
+func (namedRenderer) Render(w http.ResponseWriter, req *http.Request, filename, ext string) {}
+
+func TestRendererTable(t *testing.T) {
+	var rt rendererTable
+	builtin, live, reloaded := namedRenderer("builtin"), namedRenderer("live"), namedRenderer("reloaded")
+	rt.Set(".foo", builtin)
+
+	liveMux, reloadedMux, otherMux := http.NewServeMux(), http.NewServeMux(), http.NewServeMux()
+	rt.SetForMux(liveMux, ".FOO", live)
+	rt.SetForMux(liveMux, ".bar", live)
+	rt.SetForMux(reloadedMux, ".foo", reloaded)
+
+	for _, test := range []struct {
+		mux      *http.ServeMux
+		ext      string
+		expected Renderer
+	}{
+		{liveMux, ".foo", live},
+		{reloadedMux, ".foo", reloaded},
+		{otherMux, ".foo", builtin},
+		{otherMux, ".bar", nil},
+	} {
+		if r := rt.Get(test.mux, test.ext); r != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.ext, test.expected, r)
+		}
+	}
+
+	// Forgetting the mux of a failed reload keeps the renderers of the live one
+	rt.Forget(reloadedMux)
+	if r := rt.Get(liveMux, ".foo"); r != live {
+		t.Errorf("expected the live renderer, got %v", r)
+	}
+
+	rt.Forget(liveMux)
+	if r := rt.Get(liveMux, ".foo"); r != builtin {
+		t.Errorf("expected the built-in renderer, got %v", r)
+	}
+	if r := rt.Get(liveMux, ".bar"); r != nil {
+		t.Errorf("expected no renderer, got %v", r)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/wellington/sass/compiler"
 	"github.com/xyproto/algernon/console"
 	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/lua/sanitize"
 	"github.com/xyproto/algernon/themes"
 	"github.com/xyproto/algernon/utils"
 	"github.com/xyproto/gopher-lua"
@@ -25,6 +26,15 @@ import (
 	"github.com/yosssi/gcss"
 )
 
+// safeMarkdown converts Markdown from users to HTML. Raw HTML is skipped,
+// and the result is sanitized with the given policy.
+func safeMarkdown(text string, p *sanitize.Policy) string {
+	renderer := blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+		Flags: blackfriday.SkipHTML | blackfriday.Safelink,
+	})
+	return p.Sanitize(string(blackfriday.Run([]byte(text), blackfriday.WithRenderer(renderer))))
+}
+
 // ValidGCSS checks if the given data is valid GCSS.
 // The error value is returned on the channel.
 func ValidGCSS(gcssdata []byte, errorReturn chan error) {
@@ -344,11 +354,15 @@ func (ac *Config) MarkdownPage(w http.ResponseWriter, req *http.Request, data []
 		head.Write(themes.StyleHead(string(theme)))
 	}
 
+	// The style sheets that decide how the page is rendered, for the cache
+	styleFilenames := []string{CSSFilename, GCSSFilename}
+
 	// Additional CSS file
 	additionalCSSfile := string(kwmap["css"])
 	if additionalCSSfile != "" {
 		// If serving a single Markdown file, include the CSS file inline in a style tag
 		if ac.markdownMode && ac.fs.Exists(additionalCSSfile) {
+			styleFilenames = append(styleFilenames, additionalCSSfile)
 			// Cache the CSS only if Markdown should be cached
 			cssblock, err := ac.cache.Read(additionalCSSfile, ac.shouldCache(".md"))
 			if err != nil {
@@ -405,6 +419,9 @@ func (ac *Config) MarkdownPage(w http.ResponseWriter, req *http.Request, data []
 		}
 	}
 
+	// Keep the rendered page, until the Markdown file or the style sheets change
+	ac.cacheMarkdownPage(filename, htmldata, styleFilenames...)
+
 	// If the auto-refresh feature has been enabled
 	if ac.autoRefresh {
 		// Insert JavaScript for refreshing the page into the generated HTML
@@ -418,6 +435,7 @@ func (ac *Config) MarkdownPage(w http.ResponseWriter, req *http.Request, data []
 // PongoPage write the given source bytes (ina Pongo2) converted to HTML, to a writer.
 // The filename is only used in error messages, if any.
 func (ac *Config) PongoPage(w http.ResponseWriter, req *http.Request, filename string, pongodata []byte, funcs template.FuncMap) {
+	ac.addLocaleFuncs(req, funcs)
 	var (
 		buf                   bytes.Buffer
 		linkInGCSS, linkInCSS bool
@@ -588,6 +606,7 @@ func (ac *Config) PongoPage(w http.ResponseWriter, req *http.Request, filename s
 // AmberPage the given source bytes (in Amber) converted to HTML, to a writer.
 // The filename is only used in error messages, if any.
 func (ac *Config) AmberPage(w http.ResponseWriter, req *http.Request, filename string, amberdata []byte, funcs template.FuncMap) {
+	ac.addLocaleFuncs(req, funcs)
 
 	var buf bytes.Buffer
 
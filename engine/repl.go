@@ -15,8 +15,14 @@ import (
 	"github.com/xyproto/algernon/lua/codelib"
 	"github.com/xyproto/algernon/lua/convert"
 	"github.com/xyproto/algernon/lua/datastruct"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/algernon/lua/ics"
 	"github.com/xyproto/algernon/lua/jnode"
+	"github.com/xyproto/algernon/lua/jwt"
+	"github.com/xyproto/algernon/lua/protobuf"
 	"github.com/xyproto/algernon/lua/pure"
+	"github.com/xyproto/algernon/lua/sanitize"
+	"github.com/xyproto/algernon/lua/webhook"
 	"github.com/xyproto/gopher-lua"
 	"github.com/xyproto/term"
 )
@@ -110,9 +116,86 @@ AddAdminPrefix(string)
 AddUserPrefix(string)
 // Provide a lua function that will be used as the permission denied handler.
 DenyHandler(function)
+// Set how to respond when permission is denied for an URL prefix:
+// "auto", "401", "403" or "login", with an optional login page URL.
+DenyPolicy(string, string[, string]) -> bool
+// Check passwords with LDAP. Takes a table with url, base, and optionally
+// userfilter, groupfilter, binddn, bindpassword and timeout.
+LDAP(table) -> bool
+// Check uploaded files with a ClamAV daemon, given an address, or with a
+// function that returns a reason for rejecting a file. Takes an optional
+// directory where rejected files are kept.
+ScanUploads(string|function[, string]) -> bool
+// Configure IsSpam. Takes a table with maxlinks, blacklist, rate,
+// akismetkey, akismeturl and site.
+SpamFilter(table) -> bool
+// Configure the channels for Notify. Takes a table with smtp, from,
+// smtpuser, smtppassword, webhook, secret and digest (like "1h").
+Notifications(table) -> bool
+// Enable Web Push, with the endpoints under /_push/. Takes a mailto: URL
+// and an optional VAPID private key.
+WebPush(string[, string]) -> bool
+// Require HTTP Basic Auth for an URL prefix. Takes a prefix, an optional realm
+// and optionally "admin" or a function that checks the username.
+BasicAuth(string[, string[, string|function]]) -> bool
+// Require a valid API key for an URL prefix. Takes a prefix, and optionally
+// the name of the header and of the query parameter with the key.
+RequireAPIKey(string[, string[, string]]) -> bool
+// Require a valid CSRF token for requests that change data, for an URL
+// prefix. Takes a prefix and an optional handler for rejected requests.
+CSRF(string[, function]) -> bool
+// Allow requests from other sites to an URL prefix. Takes a prefix and a
+// table with origins, methods, headers, expose, credentials and maxage.
+CORS(string[, table]) -> bool
+// Set security headers for all responses, or for an URL prefix. Takes a
+// table with header names and values, where false removes a header.
+SecurityHeaders(table[, string]) -> bool
+// Limit how many requests each IP address can make to an URL prefix. Takes
+// a prefix, a number, a period like "1m" and optionally true for sharing
+// the counters with servers that use the same Redis database.
+RateLimit(string, number[, string|number[, bool]]) -> bool
+// Rewrite the paths that match a pattern, like "^/old/(.*)$", to "/new/$1".
+// Takes an optional table with last, redirect and proxy.
+Rewrite(string, string[, table]) -> bool
+// Add addresses and CIDR ranges to a named list.
+IPList(string, table) -> bool
+// Allow or block addresses, ranges or named lists, for all paths or for a prefix.
+AllowIPs(string|table[, string]) -> bool
+BlockIPs(string|table[, string]) -> bool
+// Set the locales the site supports, where the first one is the default.
+Locales(table) -> bool
 // Direct the logging to the given filename. If the filename is an empty
 // string, direct logging to stderr. Returns true if successful.
 LogTo(string) -> bool
+// Also serve on the given address, like "https://:8443" or "redirect://:80".
+// Returns true if the address is valid.
+Listen(string) -> bool
+// Limit requests from suspected bots to an URL prefix, like RateLimit.
+// Takes an optional bot score that requests must have (70 by default).
+BotRateLimit(string, number[, string|number[, number]]) -> bool
+// Tag, challenge or block suspected bots, for an URL prefix. Takes a prefix,
+// "tag", "challenge" or "block", and an optional bot score (70 by default).
+BotPolicy(string, string[, number]) -> bool
+// Ban the IP addresses that request a path, or paths that start with a
+// prefix, like "/wp-admin/*". Takes an optional period, like "1h".
+Trap(string[, string|number]) -> bool
+// Lift the ban for an IP address.
+Unban(string) -> bool
+// In debug mode, delay the requests for a path, or for paths that start
+// with a prefix, like "/api/*". Takes a duration like "200ms".
+InjectLatency(string, string|number) -> bool
+// In debug mode, make a share of the requests for a path fail. Takes a
+// probability from 0 to 1 and an optional status code (500 by default).
+InjectError(string, number[, number]) -> bool
+// Change how event streams and WebSockets for a path are ended when the
+// handler fails. Takes a table with event, data, retry, code and reason,
+// or false for just closing the connection.
+StreamFallback(string, table|bool) -> bool
+// Use custom error pages for status codes, like {[404] = "404.md"}.
+ErrorPages(table) -> bool
+// Configure the generated directory listings. Takes a table with template,
+// sort, order, hidden, index and listings.
+DirectoryListings(table) -> bool
 
 Output
 
@@ -143,7 +226,97 @@ Cache
 
 CacheInfo() -> string // Return information about the file cache.
 ClearCache() // Clear the file cache.
+PurgeCache(string) -> number // Remove the files matching a pattern, like "*.css", from the file cache.
 preload(string) -> bool // Load a file into the cache, returns true on success.
+AppCache.set(string, value[, number]) -> bool // Store a value in the shared application cache, with an optional TTL in seconds.
+AppCache.get(string) -> value // Retrieve a value from the application cache, or nil.
+AppCache.del(string) // Remove a value from the application cache.
+AppCache.clear() // Remove all values from the application cache.
+
+Channels
+
+Send(string, value) -> bool // Send a value to a named channel, returns false if the channel is full.
+Receive(string[, number]) -> value // Wait for a value on a named channel, with an optional timeout in seconds.
+App(string[, ...]) -> ... // Call a function in the application script (app.lua).
+
+Visitors
+
+VisitorID() -> string // Get the anonymous ID of the visitor, or an empty string.
+SetVisitorConsent(bool) -> string // Give or remove the visitor ID, returns the ID.
+VisitorGet(string) -> string // Get a value that is stored for the visitor, or for the user if logged in.
+VisitorSet(string, string) -> bool // Store a value for the visitor, or for the user if logged in.
+Cart() -> userdata // Get the shopping cart of the visitor or user, or nil and an error message.
+cart:add(string[, number[, number]]) -> number // Add to an item, given a SKU, quantity and price.
+cart:set(string, number[, number]) -> bool // Set the quantity and price of an item.
+cart:remove(string) -> bool // Remove an item.
+cart:get(string) -> table // Get an item, with sku, qty, price and subtotal.
+cart:items() -> table // Get all items.
+cart:count() -> number // Get the total quantity of all items.
+cart:total() -> number // Get the total price of all items.
+cart:clear() -> bool // Remove all items.
+VerifyWebhook(string, string, string) -> bool // Check the HMAC-SHA256 signature of a webhook body.
+SignWebhook(string, string) -> string // Sign a webhook body with HMAC-SHA256.
+
+Client certificates
+
+ClientCertSubject() -> string // Get the subject of the verified client certificate, or nil.
+ClientCertNames() -> table // Get the DNS names, e-mail addresses, IPs and URIs of the client certificate.
+
+IP lists
+
+InIPList(string[, string]) -> bool // Check if the client, or the given IP address, is in a named list.
+
+Spam
+
+IsSpam(table) -> bool, table // Check author, email, url and content for spam, returns the reasons.
+BotScore() -> number, table // Get how likely it is that the request comes from a bot, from 0 to 100, and the reasons.
+moderation.add(table) -> string // Add a submission to the moderation queue, returns an ID.
+moderation.list() -> table // List the submissions in the moderation queue, the oldest first.
+moderation.remove(string) -> bool // Remove a submission from the moderation queue.
+
+Notifications
+
+Notify(string, string[, table]) -> bool // Notify a user, on the channels the user has chosen.
+NotifyPreferences(string[, table]) -> table // Get or set the channels and digest preference of a user.
+
+E-mail templates
+
+SendTemplatedMail(string, string[, table]) -> bool // Render an e-mail from templates, like "emails/welcome", and send it.
+RenderMail(string[, table]) -> string, string, string // Render an e-mail, returns the subject, text and HTML.
+
+Dates, numbers and money
+
+Locale() -> string // Get the locale of the request, like "en" or "pt-BR".
+LocalDate(number|string[, string]) -> string // Format a date for the locale, in the "short", "medium" or "long" style.
+Number(number[, number]) -> string // Format a number for the locale, with an optional number of decimals.
+Money(number, string) -> string // Format an amount in a currency, like "EUR", for the locale.
+
+Web Push
+
+WebPushKey() -> string // Get the public VAPID key, or nil if Web Push is not enabled.
+PushSubscribe(string|table[, string]) -> string // Store a push subscription for a user, returns an ID.
+PushUnsubscribe(string) -> bool // Remove the push subscription with the given endpoint.
+SendPush(string|nil, string|table[, number]) -> number // Send a push notification to a user, or to everyone.
+
+Payments
+
+CreateCheckoutSession(table) -> table // Create a checkout session, or return nil and an error message.
+VerifyPaymentWebhook(string, string) -> table // Check a Stripe-Signature header and a body, returns the event.
+SubscriptionStatus(string) -> string // Get the status of a subscription, given an ID.
+Subscriptions(string) -> table // Get the subscriptions of a customer, given a customer ID.
+
+SQL
+
+db.open(string, string) -> userdata // Open a pooled database connection, given a driver and a DSN.
+db.drivers() -> table // Return the names of the available database drivers.
+sqlite(string) -> userdata // Open an SQLite database, or return nil and an error message.
+db:query(string[, ...]) -> table // Run a query with parameters, returns a table of rows.
+db:exec(string[, ...]) -> number, number // Run a statement, returns affected rows and the last ID.
+db:prepare(string) -> userdata // Create a prepared statement.
+db:begin() -> userdata // Start a transaction, with query, exec, prepare, commit and rollback.
+statement:query([...]) -> table // Run a prepared statement as a query.
+statement:exec([...]) -> number, number // Run a prepared statement.
+statement:close() // Close a prepared statement.
 
 JSON
 
@@ -200,6 +373,19 @@ jnode:send(string[, string]) -> string
 jnode:GET(string) -> string
 // Alias for jnode:GET
 jnode:receive(string) -> string
+// Create a JSON Web Token from a table with claims and a key, with "HS256" (default) or "RS256".
+jwt.sign(table, string[, string]) -> string
+// Check a JSON Web Token with a secret or an RSA public key. Returns the claims, or nil and an error.
+jwt.verify(string, string) -> table
+// Encode a table as a Protocol Buffers message of the given type, like "shop.Order".
+// Returns a string, or nil and an error. The types are loaded with ProtobufDescriptors.
+protobuf.encode(string, table) -> string
+// Decode a Protocol Buffers message of the given type. Returns a table, or nil and an error.
+protobuf.decode(string, string) -> table
+// Return a list of the Protocol Buffers message types that are loaded.
+protobuf.types() -> table
+// Encode a table as a Protocol Buffers message and write it to the client. Returns true, or false and an error.
+protobuf.respond(string, table) -> bool
 
 Plugins
 
@@ -237,6 +423,10 @@ Various
 ServerInfo() -> string
 // Return the version string for the server
 version() -> string
+// Select the version of the Lua API the script is written for, like 2.
+// Functions with old names or signatures are removed from newer versions.
+// Returns the selected version.
+APIVersion([number]) -> number
 // Tries to extract and print the contents of the given Lua values
 pprint(...)
 // Sleep the given number of seconds (can be a float)
@@ -245,6 +435,35 @@ sleep(number)
 unixnano() -> number
 // Convert Markdown to HTML
 markdown(string) -> string
+// Convert Markdown from users to HTML, without raw HTML. Takes an optional
+// table with nofollow, images and imageproxy.
+markdownSafe(string[, table]) -> string
+// Remove unsafe HTML, given HTML and an optional policy: "strict", "ugc" or
+// a table with elements, attributes and nofollow.
+SanitizeHTML(string[, string|table]) -> string
+// Make a QR code as a PNG image. Takes a text, an optional size in pixels
+// and an optional level ("low", "medium", "quartile" or "high").
+QRCodePNG(string[, number[, string]]) -> string
+// Write a QR code to the response, as a PNG image.
+ServeQRCode(string[, number[, string]]) -> bool
+// Make a vCard from a table with name, firstname, lastname, org, title,
+// phone, mobile, email, url, street, city, region, postalcode, country,
+// birthday and note.
+VCard(table) -> string
+// Write a vCard to the response, as a file. Takes an optional filename.
+ServeVCard(table[, string]) -> bool
+// Convert a table with rows (lists, or tables with keys) to CSV.
+CSV(table) -> string
+// Write rows to the response as a CSV file. Takes an optional filename.
+ServeCSV(table[, string]) -> bool
+// Convert a table with rows to an XLSX file. Takes an optional sheet name.
+XLSX(table[, string]) -> string
+// Write rows to the response as an XLSX file. Takes an optional filename
+// and sheet name.
+ServeXLSX(table[, string[, string]]) -> bool
+// Make an iCalendar feed from a table with events (summary, start, end,
+// description, location, url, uid) and an optional table with name and timezone.
+ICSFeed(table[, table]) -> string
 
 Extra
 
@@ -331,6 +550,27 @@ Login(string)
 CookieLogin(string) -> bool
 // Log out a user, on the server (which is enough). Takes a username.
 Logout(string)
+// Log out a user from every browser, and remove all "remember me" tokens.
+// Takes a username. Returns true if successful.
+LogoutEverywhere(string) -> bool
+// Give the browser a long-lived "remember me" token. Takes a username.
+// Returns true if successful.
+RememberMe(string) -> bool
+// Remove the "remember me" token of the current browser
+ForgetMe()
+// List the sessions of a user, the most recently seen first. Takes a username.
+// The tables have the fields id, ip, useragent, created, lastseen and current.
+ActiveSessions(string) -> table
+// Log out one of the sessions of a user. Takes a username and a session ID.
+EndSession(string, string) -> bool
+// Create an API key. Takes the owner. Returns the key, or nil and an error.
+apikey.new(string) -> string
+// Revoke an API key. Returns true if successful.
+apikey.revoke(string) -> bool
+// Get the owner of an API key, or nil if the key is not valid.
+apikey.owner(string) -> string
+// Get the owner of the API key in the current request, or nil.
+APIKeyOwner([string[, string]]) -> string
 // Get the current username, from the cookie
 Username() -> string
 // Get the current cookie timeout. Takes a username.
@@ -386,6 +626,16 @@ uploadedfile:save([string]) -> bool
 // Save the uploaded data as the client-provided filename, in the specified
 // directory. Takes a relative or absolute path. Returns true on success.
 uploadedfile:savein(string)  -> bool
+// Store the uploaded data by hash, in the directory given with --contentdir.
+// Returns the hash, or nil and an error message.
+uploadedfile:store() -> string
+// Store the given data by hash. Returns the hash, or nil and an error message.
+StoreContent(string) -> string
+// Remove a reference to stored content. Returns the number of references
+// that are left, or nil and an error message.
+ReleaseContent(string) -> number
+// Return an URL that always serves the stored content with the given hash.
+ContentURL(string) -> string
 
 Handling requests
 
@@ -397,6 +647,8 @@ method() -> string
 print(...)
 // Return the requested URL path.
 urlpath() -> string
+// Add the base path from --urlprefix to an absolute URL path.
+urlprefix([string]) -> string
 // Return the HTTP header in the request, for a given key, or an empty string.
 header(string) -> string
 // Set an HTTP header given a key and a value.
@@ -411,6 +663,10 @@ body() -> string
 status(number)
 // Set a HTTP status code and output a message (optional).
 error(number[, string])
+// Stop the script with a structured error, given a HTTP status code,
+// a message (optional) and a table with details (optional). Results in a
+// JSON or HTML error page, with the given status code.
+Error(number[, string][, table])
 // Return the directory where the script is running. If a filename (optional)
 // is given, then the path to where the script is running, joined with a path
 // separator and the given filename, is returned.
@@ -435,6 +691,17 @@ redirect(string[, number])
 permanent_redirect(string)
 // Transmit what has been outputted so far, to the client.
 flush()
+// Push a resource, like "/style.css", with HTTP/2 server push.
+// Returns false if not possible, for instance over HTTP/1.1.
+push(string) -> bool
+// Start a stream of Server-Sent Events. Returns a table with functions for
+// sending events: send(data[, event[, id]]) -> bool, comment(string) -> bool,
+// retry(ms) -> bool, closed() -> bool and wait(seconds) -> bool.
+sse() -> table
+// Get the CSRF token for the current browser and session.
+csrf_token() -> string
+// Get a hidden form field with the CSRF token.
+csrf_field() -> string
 `
 	configHelpText = `Available functions:
 
@@ -450,6 +717,80 @@ AddAdminPrefix(string)
 AddUserPrefix(string)
 // Provide a lua function that will be used as the permission denied handler.
 DenyHandler(function)
+// Set how to respond when permission is denied for an URL prefix:
+// "auto", "401", "403" or "login", with an optional login page URL.
+DenyPolicy(string, string[, string]) -> bool
+// Check passwords with LDAP. Takes a table with url, base, and optionally
+// userfilter, groupfilter, binddn, bindpassword and timeout.
+LDAP(table) -> bool
+// Check uploaded files with a ClamAV daemon, given an address, or with a
+// function that returns a reason for rejecting a file. Takes an optional
+// directory where rejected files are kept.
+ScanUploads(string|function[, string]) -> bool
+// Configure IsSpam. Takes a table with maxlinks, blacklist, rate,
+// akismetkey, akismeturl and site.
+SpamFilter(table) -> bool
+// Configure the channels for Notify. Takes a table with smtp, from,
+// smtpuser, smtppassword, webhook, secret and digest (like "1h").
+Notifications(table) -> bool
+// Enable Web Push, with the endpoints under /_push/. Takes a mailto: URL
+// and an optional VAPID private key.
+WebPush(string[, string]) -> bool
+// Require HTTP Basic Auth for an URL prefix. Takes a prefix, an optional realm
+// and optionally "admin" or a function that checks the username.
+BasicAuth(string[, string[, string|function]]) -> bool
+// Require a valid API key for an URL prefix. Takes a prefix, and optionally
+// the name of the header and of the query parameter with the key.
+RequireAPIKey(string[, string[, string]]) -> bool
+// Require a valid CSRF token for requests that change data, for an URL
+// prefix. Takes a prefix and an optional handler for rejected requests.
+CSRF(string[, function]) -> bool
+// Allow requests from other sites to an URL prefix. Takes a prefix and a
+// table with origins, methods, headers, expose, credentials and maxage.
+CORS(string[, table]) -> bool
+// Set security headers for all responses, or for an URL prefix. Takes a
+// table with header names and values, where false removes a header.
+SecurityHeaders(table[, string]) -> bool
+// Limit how many requests each IP address can make to an URL prefix. Takes
+// a prefix, a number, a period like "1m" and optionally true for sharing
+// the counters with servers that use the same Redis database.
+RateLimit(string, number[, string|number[, bool]]) -> bool
+// Rewrite the paths that match a pattern, like "^/old/(.*)$", to "/new/$1".
+// Takes an optional table with last, redirect and proxy.
+Rewrite(string, string[, table]) -> bool
+// Add addresses and CIDR ranges to a named list.
+IPList(string, table) -> bool
+// Allow or block addresses, ranges or named lists, for all paths or for a prefix.
+AllowIPs(string|table[, string]) -> bool
+BlockIPs(string|table[, string]) -> bool
+// Set the locales the site supports, where the first one is the default.
+Locales(table) -> bool
+// Limit requests from suspected bots to an URL prefix, like RateLimit.
+// Takes an optional bot score that requests must have (70 by default).
+BotRateLimit(string, number[, string|number[, number]]) -> bool
+// Tag, challenge or block suspected bots, for an URL prefix. Takes a prefix,
+// "tag", "challenge" or "block", and an optional bot score (70 by default).
+BotPolicy(string, string[, number]) -> bool
+// Ban the IP addresses that request a path, or paths that start with a
+// prefix, like "/wp-admin/*". Takes an optional period, like "1h".
+Trap(string[, string|number]) -> bool
+// Lift the ban for an IP address.
+Unban(string) -> bool
+// In debug mode, delay the requests for a path, or for paths that start
+// with a prefix, like "/api/*". Takes a duration like "200ms".
+InjectLatency(string, string|number) -> bool
+// In debug mode, make a share of the requests for a path fail. Takes a
+// probability from 0 to 1 and an optional status code (500 by default).
+InjectError(string, number[, number]) -> bool
+// Change how event streams and WebSockets for a path are ended when the
+// handler fails. Takes a table with event, data, retry, code and reason,
+// or false for just closing the connection.
+StreamFallback(string, table|bool) -> bool
+// Use custom error pages for status codes, like {[404] = "404.md"}.
+ErrorPages(table) -> bool
+// Configure the generated directory listings. Takes a table with template,
+// sort, order, hidden, index and listings.
+DirectoryListings(table) -> bool
 // Provide a lua function that will be run once,
 // when the server is ready to start serving.
 OnReady(function)
@@ -632,6 +973,27 @@ func (ac *Config) LoadLuaFunctionsForREPL(L *lua.LState, o *term.TextOutput) {
 	ac.LoadJFile(L, ac.serverDirOrFilename)
 	jnode.Load(L)
 
+	// For raising structured errors
+	httperror.Load(L)
+
+	// For creating and validating JSON Web Tokens
+	jwt.Load(L)
+
+	// For encoding and decoding Protocol Buffers messages
+	protobuf.Load(L, ac.protoRegistry)
+
+	// For checking the signatures of webhook requests
+	webhook.Load(L)
+
+	// For removing scripts and other unsafe HTML from user content
+	sanitize.Load(L)
+
+	// For calendar feeds
+	ics.Load(L)
+
+	// For SQL databases
+	ac.LoadSQLFunctions(L, ac.serverDirOrFilename)
+
 	// Extras
 	pure.Load(L)
 
@@ -0,0 +1,92 @@
+package engine
+
+// Request IDs and trace headers, for following a request from the client,
+// through the server and on to the services that the server calls
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const (
+	// The header for the request ID, both for requests and responses
+	requestIDHeader = "X-Request-ID"
+
+	// The W3C Trace Context header
+	traceparentHeader = "Traceparent"
+
+	// The longest request ID from a client that will be used
+	maxRequestIDLength = 128
+)
+
+// The headers that are passed on to other services, by default
+var defaultForwardHeaders = []string{requestIDHeader, "traceparent", "tracestate"}
+
+// randomHex returns n random bytes, as a hex string
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID checks if a request ID from a client is short and only
+// contains letters, digits and a few safe characters
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// assignRequestID makes sure that the request has a request ID, using the
+// one from the client if it is valid. The ID is also set on the response.
+// If traceparent is passed on to other services, a trace is started if the
+// client did not send one.
+func (ac *Config) assignRequestID(w http.ResponseWriter, req *http.Request) {
+	id := req.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = randomHex(16)
+		req.Header.Set(requestIDHeader, id)
+	}
+	w.Header().Set(requestIDHeader, id)
+	if req.Header.Get(traceparentHeader) == "" && has(ac.forwardHeaders, traceparentHeader) {
+		// version, trace ID, parent ID and the "sampled" flag
+		req.Header.Set(traceparentHeader, "00-"+randomHex(16)+"-"+randomHex(8)+"-01")
+	}
+}
+
+// upstreamHeaders returns the headers of the given request that should be
+// passed on when requests are sent to other services
+func (ac *Config) upstreamHeaders(req *http.Request) http.Header {
+	if req == nil || len(ac.forwardHeaders) == 0 {
+		return nil
+	}
+	header := make(http.Header)
+	for _, name := range ac.forwardHeaders {
+		if values, ok := req.Header[name]; ok {
+			header[name] = values
+		}
+	}
+	return header
+}
+
+// parseForwardHeaders parses a comma separated list of header names
+func parseForwardHeaders(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" && name != "none" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return unique(names)
+}
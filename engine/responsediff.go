@@ -0,0 +1,189 @@
+package engine
+
+// Comparing the responses from two running servers, for validating
+// changes to Lua handlers and templates
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/xyproto/algernon/utils"
+)
+
+const (
+	// How long to wait for each response
+	diffTimeout = 30 * time.Second
+
+	// The maximum number of differences to output for each path
+	maxDiffOutput = 20
+)
+
+var (
+	errDiffUsage   = errors.New("usage: algernon diff URL URL [FILE]")
+	errDiffsFound  = errors.New("the responses differ")
+	errDiffNoPaths = errors.New("found no paths to request")
+)
+
+// diffResponse is the part of a response that is compared
+type diffResponse struct {
+	statusCode  int
+	contentType string
+	body        []byte
+}
+
+// readDiffPaths reads URL paths from the given file. Each line can be a path,
+// or a line from an access log, where only GET requests are used.
+func readDiffPaths(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Lines in the Common Log Format or the Combined Log Format
+		if pos := strings.Index(line, "\"GET "); pos >= 0 {
+			fields := strings.Fields(line[pos+len("\"GET "):])
+			if len(fields) > 0 {
+				paths = append(paths, fields[0])
+			}
+			continue
+		} else if strings.Contains(line, "\"") {
+			// Another HTTP method
+			continue
+		}
+		paths = append(paths, line)
+	}
+	return unique(paths), scanner.Err()
+}
+
+// fetchForDiff retrieves the given URL, without following redirects
+func fetchForDiff(client *http.Client, url string) (*diffResponse, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &diffResponse{resp.StatusCode, resp.Header.Get("Content-Type"), body}, nil
+}
+
+// compareResponses returns the differences between two responses
+func compareResponses(a, b *diffResponse) []string {
+	var diff []string
+	if a.statusCode != b.statusCode {
+		diff = append(diff, fmt.Sprintf("status: %d != %d", a.statusCode, b.statusCode))
+	}
+	if a.contentType != b.contentType {
+		diff = append(diff, fmt.Sprintf("content type: %q != %q", a.contentType, b.contentType))
+	}
+	if string(a.body) == string(b.body) {
+		return diff
+	}
+	if strings.Contains(a.contentType, "json") && strings.Contains(b.contentType, "json") {
+		var aValue, bValue interface{}
+		if json.Unmarshal(a.body, &aValue) == nil && json.Unmarshal(b.body, &bValue) == nil {
+			return append(diff, utils.DiffJSON(aValue, bValue)...)
+		}
+	}
+	return append(diff, utils.DiffLines(strings.Split(string(a.body), "\n"), strings.Split(string(b.body), "\n"))...)
+}
+
+// newDiffClient returns a client for requesting the responses to compare
+func newDiffClient() *http.Client {
+	return &http.Client{
+		Timeout: diffTimeout,
+		// Compare the redirects instead of following them
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// diffReport outputs the differences between the compared responses, and
+// counts the responses that differ
+type diffReport struct {
+	compared int
+	differ   int
+}
+
+// Add outputs "same NAME", or "diff NAME" followed by the differences
+func (dr *diffReport) Add(name string, diff []string) {
+	dr.compared++
+	if len(diff) == 0 {
+		fmt.Println("same " + name)
+		return
+	}
+	dr.differ++
+	fmt.Println("diff " + name)
+	for i, line := range diff {
+		if i == maxDiffOutput {
+			fmt.Printf("     ... and %d more\n", len(diff)-maxDiffOutput)
+			break
+		}
+		fmt.Println("     " + line)
+	}
+}
+
+// Done outputs how many of the compared things, like "paths", differ.
+// Returns errDiffsFound if any of them differ.
+func (dr *diffReport) Done(things string) error {
+	fmt.Printf("%d of %d %s differ\n", dr.differ, dr.compared, things)
+	if dr.differ > 0 {
+		return errDiffsFound
+	}
+	return nil
+}
+
+// RunDiff requests the same paths from two running servers and outputs the
+// differences between the responses. The paths are read from the given file,
+// which can also be an access log. If no file is given, only "/" is requested.
+func (ac *Config) RunDiff(args []string) error {
+	if len(args) < 2 {
+		return errDiffUsage
+	}
+	baseA := strings.TrimSuffix(args[0], "/")
+	baseB := strings.TrimSuffix(args[1], "/")
+	paths := []string{"/"}
+	if len(args) > 2 {
+		var err error
+		if paths, err = readDiffPaths(args[2]); err != nil {
+			return err
+		}
+		if len(paths) == 0 {
+			return errDiffNoPaths
+		}
+	}
+	client := newDiffClient()
+	var report diffReport
+	for _, urlpath := range paths {
+		if !strings.HasPrefix(urlpath, "/") {
+			urlpath = "/" + urlpath
+		}
+		a, err := fetchForDiff(client, baseA+urlpath)
+		if err != nil {
+			return err
+		}
+		b, err := fetchForDiff(client, baseB+urlpath)
+		if err != nil {
+			return err
+		}
+		report.Add(urlpath, compareResponses(a, b))
+	}
+	return report.Done("paths")
+}
@@ -0,0 +1,323 @@
+package engine
+
+// Restarting without downtime, by passing the listening sockets on to a new
+// process on SIGUSR2, and letting the old process finish its requests
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tylerb/graceful"
+	"github.com/xyproto/algernon/platformdep"
+)
+
+const (
+	// The addresses of the listening sockets that are passed on to the new
+	// process, in the order of the file descriptors, starting with 3
+	listenFDsVariable = "ALGERNON_LISTEN_FDS"
+
+	// The file descriptor the new process writes to when it is serving
+	readyFDVariable = "ALGERNON_READY_FD"
+
+	// How long the new process can take to start serving
+	restartTimeout = 30 * time.Second
+)
+
+var (
+	errRestartTimeout = errors.New("the new process did not start serving in time")
+	errRestartFailed  = errors.New("the new process exited before it started serving")
+	errRestartBolt    = errors.New("can not restart without downtime while a Bolt database is in use, since the database file is locked by this process")
+	errNoListenerFile = errors.New("the listener can not be passed on to a new process")
+)
+
+// fileListener is a listener with a file descriptor that can be passed on
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+// listenerTable keeps the listening sockets and the servers, so that they
+// can be passed on to a new process when restarting
+type listenerTable struct {
+	mut        sync.Mutex
+	inherited  map[string]net.Listener // listeners from the previous process
+	activated  map[string]net.Listener // listeners from systemd
+	addresses  []string
+	listeners  map[string]net.Listener
+	servers    []*graceful.Server
+	handedOver bool
+}
+
+// Inherit takes over the listening sockets that were passed on by the
+// previous process or by systemd, if any
+func (lt *listenerTable) Inherit() {
+	lt.mut.Lock()
+	defer lt.mut.Unlock()
+	lt.activated = activatedListeners()
+	value := os.Getenv(listenFDsVariable)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(listenFDsVariable)
+	lt.inherited = make(map[string]net.Listener)
+	for i, address := range strings.Split(value, ",") {
+		f := os.NewFile(uintptr(3+i), address)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Errorf("Could not use the listener for %s from the previous process: %s", address, err)
+			continue
+		}
+		lt.inherited[address] = l
+	}
+}
+
+// Listen returns the listener that was passed on for the given address, or
+// starts listening. Sockets from systemd are used if they have the address
+// as the name, or if they have the same port.
+func (lt *listenerTable) Listen(network, address string) (net.Listener, error) {
+	lt.mut.Lock()
+	defer lt.mut.Unlock()
+	if lt.listeners == nil {
+		lt.listeners = make(map[string]net.Listener)
+	}
+	l, ok := lt.inherited[address]
+	if ok {
+		delete(lt.inherited, address)
+	} else if l, ok = lt.activated[address]; ok {
+		delete(lt.activated, address)
+	}
+	if !ok {
+		for name, activated := range lt.activated {
+			if samePort(activated.Addr().String(), address) {
+				l, ok = activated, true
+				delete(lt.activated, name)
+				break
+			}
+		}
+	}
+	if !ok {
+		if network == "unix" {
+			// Remove any leftover socket from a previous run
+			if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+				os.Remove(address)
+			}
+		}
+		var err error
+		if l, err = net.Listen(network, address); err != nil {
+			return nil, err
+		}
+	}
+	if ul, ok := l.(*net.UnixListener); ok {
+		// The socket file may be in use by a new process, if restarted
+		ul.SetUnlinkOnClose(false)
+	}
+	if _, ok := lt.listeners[address]; !ok {
+		lt.addresses = append(lt.addresses, address)
+	}
+	lt.listeners[address] = l
+	return l, nil
+}
+
+// AddServer keeps track of a server, for stopping it after restarting
+func (lt *listenerTable) AddServer(srv *graceful.Server) {
+	lt.mut.Lock()
+	defer lt.mut.Unlock()
+	lt.servers = append(lt.servers, srv)
+}
+
+// HandedOver checks if the listening sockets have been passed on to a new
+// process, that is now serving
+func (lt *listenerTable) HandedOver() bool {
+	lt.mut.Lock()
+	defer lt.mut.Unlock()
+	return lt.handedOver
+}
+
+// listenAndServe serves HTTP with the given server, on a listener that can
+// be passed on when restarting
+func (ac *Config) listenAndServe(srv *graceful.Server) error {
+	l, err := ac.listeners.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	// Keep track of the server, so that it can be waited for when shutting down
+	ac.servers.Add(1)
+	defer ac.servers.Done()
+	return srv.Serve(ac.limitConnections(l))
+}
+
+// listenAndServeTLSConfig serves HTTPS with the given server and TLS
+// configuration, with the TLS profile, on a listener that can be passed on
+// when restarting
+func (ac *Config) listenAndServeTLSConfig(srv *graceful.Server, config *tls.Config) error {
+	ac.applyTLSProfile(config)
+	if !graceful.TLSConfigHasHTTP2Enabled(config) {
+		config.NextProtos = append(config.NextProtos, "h2")
+	}
+	l, err := ac.listeners.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = config
+	ac.servers.Add(1)
+	defer ac.servers.Done()
+	return srv.Serve(tls.NewListener(ac.limitConnections(l), config))
+}
+
+// listenAndServeTLS serves HTTPS with the given server, certificate and
+// key, and the certificates from --certpair and --certdir, on a listener
+// that can be passed on when restarting. OCSP responses are stapled to the
+// certificates, and the certificates are loaded again when they change.
+func (ac *Config) listenAndServeTLS(srv *graceful.Server, certFile, keyFile string) error {
+	config := &tls.Config{}
+	if srv.TLSConfig != nil {
+		config = srv.TLSConfig.Clone()
+	}
+	// The certificate is selected by the hostname the client asks for
+	if err := ac.certs.Load(certFile, keyFile); err != nil {
+		return err
+	}
+	config.GetCertificate = ac.certs.GetCertificate
+	ac.startStapling()
+	ac.watchCertificates()
+	return ac.listenAndServeTLSConfig(srv, config)
+}
+
+// restart starts a new process with the same executable and arguments, and
+// passes the listening sockets on to it. When the new process is serving,
+// this process stops accepting connections, and shuts down gracefully.
+func (ac *Config) restart() error {
+	if strings.HasPrefix(ac.dbName, "Bolt (") {
+		return errRestartBolt
+	}
+	if strings.HasPrefix(ac.dbName, "In-memory") {
+		log.Warn("The data in the in-memory database is not passed on to the new process")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	ac.listeners.mut.Lock()
+	var files []*os.File
+	for _, address := range ac.listeners.addresses {
+		fl, ok := ac.listeners.listeners[address].(fileListener)
+		if !ok {
+			ac.listeners.mut.Unlock()
+			return errNoListenerFile
+		}
+		f, err := fl.File()
+		if err != nil {
+			ac.listeners.mut.Unlock()
+			return err
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	addresses := strings.Join(ac.listeners.addresses, ",")
+	ac.listeners.mut.Unlock()
+
+	// The new process writes to this pipe when it is serving
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	env := make([]string, 0, len(os.Environ())+2)
+	for _, keyValue := range os.Environ() {
+		// The watchdog of systemd is for the process ID of this process
+		if !strings.HasPrefix(keyValue, listenFDsVariable+"=") && !strings.HasPrefix(keyValue, readyFDVariable+"=") && !strings.HasPrefix(keyValue, "WATCHDOG_PID=") {
+			env = append(env, keyValue)
+		}
+	}
+	env = append(env, listenFDsVariable+"="+addresses, readyFDVariable+"="+strconv.Itoa(3+len(files)))
+	attr := &os.ProcAttr{
+		Env:   env,
+		Files: append(append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...), w),
+	}
+	process, err := os.StartProcess(executable, os.Args, attr)
+	w.Close()
+	if err != nil {
+		return err
+	}
+	log.Infof("Started a new process (%d), waiting for it to serve", process.Pid)
+
+	// Wait for the new process to start serving, or to exit
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := r.Read(buf); err != nil {
+			ready <- errRestartFailed
+			return
+		}
+		ready <- nil
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			return err
+		}
+	case <-time.After(restartTimeout):
+		process.Kill()
+		return errRestartTimeout
+	}
+	go process.Wait()
+
+	ac.listeners.mut.Lock()
+	ac.listeners.handedOver = true
+	servers := ac.listeners.servers
+	ac.listeners.mut.Unlock()
+
+	log.Infof("The new process (%d) is serving, shutting down this one", process.Pid)
+	sdNotify("MAINPID=" + strconv.Itoa(process.Pid))
+	for _, srv := range servers {
+		srv.Stop(ac.shutdownTimeout)
+	}
+	ac.beginShutdown()
+	return nil
+}
+
+// handleRestarts restarts without downtime on SIGUSR2. This is only done
+// in server mode, since the new process can not take over the REPL.
+func (ac *Config) handleRestarts() {
+	signals := make(chan os.Signal, 1)
+	if !platformdep.NotifyRestart(signals) {
+		return
+	}
+	for range signals {
+		if !ac.serverMode {
+			log.Warn("Restarting on SIGUSR2 is only supported in server mode")
+			continue
+		}
+		if ac.ShuttingDown() {
+			continue
+		}
+		if err := ac.restart(); err != nil {
+			log.Error("Could not restart: ", err)
+		}
+	}
+}
+
+// notifyPreviousProcess tells the previous process that this process is
+// serving, if it was started by restarting
+func (ac *Config) notifyPreviousProcess() {
+	value := os.Getenv(readyFDVariable)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(readyFDVariable)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
@@ -0,0 +1,193 @@
+package engine
+
+// URL rewriting, with Rewrite in the server configuration, for keeping old
+// URLs working without a Lua handler for each of them
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/gopher-lua"
+)
+
+// rewriteRule replaces the paths that match the pattern. The replacement
+// can use the groups from the pattern, like "$1" or "${name}".
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+	last        bool // don't try the rules after this one
+	redirect    int  // the status code for redirecting, or 0
+	proxy       bool // pass the request on to the replacement URL
+}
+
+// rewriteTable keeps the rewrite rules for each mux, in order
+type rewriteTable = ruleTable[*rewriteRule]
+
+// rewritePath runs the path through the rules, in order. Returns the new
+// path, which may include a query string or be an URL, and the rule that
+// redirects or proxies the request, if any. When a replacement has a query
+// string, the rules after it only see the path.
+func rewritePath(rules []*rewriteRule, urlpath string) (string, *rewriteRule) {
+	query := ""
+	for _, rule := range rules {
+		match := rule.pattern.FindStringSubmatchIndex(urlpath)
+		if match == nil {
+			continue
+		}
+		urlpath = string(rule.pattern.ExpandString(nil, rule.replacement, urlpath, match))
+		if pos := strings.IndexByte(urlpath, '?'); pos != -1 {
+			urlpath, query = urlpath[:pos], urlpath[pos:]
+		}
+		if rule.redirect != 0 || rule.proxy {
+			return urlpath + query, rule
+		}
+		if rule.last {
+			break
+		}
+	}
+	return urlpath + query, nil
+}
+
+// rewriteKey is the context key for a request that should be redirected
+// or passed on by a rewrite rule
+type rewriteKey struct{}
+
+// rewriteTarget is where a request is redirected or passed on to
+type rewriteTarget struct {
+	rule   *rewriteRule
+	target string
+}
+
+// rewrite applies the rewrite rules of the mux to the request. Rewritten
+// requests are served as if the new path had been requested. Requests
+// that should be redirected or passed on keep their path, so that the
+// rules for the original path still apply, until serveRewrite is called.
+func (ac *Config) rewrite(mux *http.ServeMux, req *http.Request) *http.Request {
+	rules := ac.rewrites.Rules(mux)
+	if len(rules) == 0 {
+		return req
+	}
+	newpath, rule := rewritePath(rules, req.URL.Path)
+	if rule != nil {
+		if req.URL.RawQuery != "" && !strings.Contains(newpath, "?") {
+			newpath += "?" + req.URL.RawQuery
+		}
+		return req.WithContext(context.WithValue(req.Context(), rewriteKey{}, &rewriteTarget{rule, newpath}))
+	}
+	if newpath == req.URL.Path {
+		return req
+	}
+	u, err := url.Parse(newpath)
+	if err != nil {
+		log.Errorf("Rewrite: %s is not a valid path: %s", newpath, err)
+		return req
+	}
+	rewritten := new(http.Request)
+	*rewritten = *req
+	newURL := *req.URL
+	newURL.Path, newURL.RawPath = u.Path, ""
+	if u.RawQuery != "" || strings.Contains(newpath, "?") {
+		newURL.RawQuery = u.RawQuery
+	}
+	rewritten.URL = &newURL
+	rewritten.RequestURI = newURL.RequestURI()
+	return rewritten
+}
+
+// serveRewrite redirects the request, or passes it on, if a rewrite rule
+// says so. Returns true if the request has been served.
+func (ac *Config) serveRewrite(w http.ResponseWriter, req *http.Request) bool {
+	rt, ok := req.Context().Value(rewriteKey{}).(*rewriteTarget)
+	if !ok {
+		return false
+	}
+	if rt.rule.redirect != 0 {
+		http.Redirect(w, req, rt.target, rt.rule.redirect)
+		ac.LogAccess(req, rt.rule.redirect, 0)
+		return true
+	}
+	target, err := url.Parse(rt.target)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		log.Errorf("Rewrite: %s is not a valid URL for passing the request on to", rt.target)
+		size := ac.ErrorPage(w, req, httperror.New(http.StatusBadGateway, ""))
+		ac.LogAccess(req, http.StatusBadGateway, size)
+		return true
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			clientHost := out.Host
+			out.URL = target
+			out.Host = target.Host
+			out.Header.Set("X-Forwarded-Host", clientHost)
+			if out.TLS != nil {
+				out.Header.Set("X-Forwarded-Proto", "https")
+			} else {
+				out.Header.Set("X-Forwarded-Proto", "http")
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Error("Proxy for "+rt.target+" failed: ", err)
+			if isTimeout(err) {
+				ac.ErrorPage(w, req, httperror.New(http.StatusGatewayTimeout, ""))
+				return
+			}
+			ac.ErrorPage(w, req, httperror.New(http.StatusBadGateway, ""))
+		},
+	}
+	pw := &proxyResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+	proxy.ServeHTTP(pw, req)
+	ac.LogAccess(req, pw.statusCode, pw.written)
+	return true
+}
+
+// LoadRewriteFunctions makes the Rewrite function available to server
+// configuration scripts
+func (ac *Config) LoadRewriteFunctions(L *lua.LState, mux *http.ServeMux) {
+
+	// Rewrite the paths that match a regular expression, before the
+	// handlers see them. Takes a pattern, a replacement with "$1" or
+	// "${name}" for the groups, and optionally a table with last = true,
+	// redirect = true or a status code, and proxy = true. Returns true if
+	// successful.
+	L.SetGlobal("Rewrite", L.NewFunction(func(L *lua.LState) int {
+		pattern, err := regexp.Compile(L.CheckString(1))
+		if err != nil {
+			L.ArgError(1, err.Error())
+			return 0 // number of results
+		}
+		rule := &rewriteRule{pattern: pattern, replacement: L.CheckString(2)}
+		if t, ok := L.Get(3).(*lua.LTable); ok {
+			rule.last = lua.LVAsBool(t.RawGetString("last"))
+			rule.proxy = lua.LVAsBool(t.RawGetString("proxy"))
+			switch redirect := t.RawGetString("redirect").(type) {
+			case lua.LBool:
+				if redirect {
+					rule.redirect = http.StatusFound
+				}
+			case lua.LNumber:
+				rule.redirect = int(redirect)
+				if rule.redirect < 300 || rule.redirect > 399 {
+					L.ArgError(3, "the status code for redirecting must be between 300 and 399")
+					return 0 // number of results
+				}
+			}
+		}
+		if rule.redirect != 0 && rule.proxy {
+			L.ArgError(3, "a rewrite rule can not both redirect and proxy")
+			return 0 // number of results
+		}
+		// Rules that replace the path with an URL redirect to it
+		if rule.redirect == 0 && !rule.proxy && (strings.HasPrefix(rule.replacement, "http://") || strings.HasPrefix(rule.replacement, "https://")) {
+			rule.redirect = http.StatusFound
+		}
+		ac.rewrites.Add(mux, rule)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
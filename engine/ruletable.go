@@ -0,0 +1,109 @@
+package engine
+
+// Tables with the rules from the server configuration, like the CORS rules
+// or the rate limits, for each mux. A new mux is configured when reloading,
+// and the rules for the previous mux are then forgotten.
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ruleTable keeps rules for each mux, in the order they were added
+type ruleTable[R any] struct {
+	mut   sync.RWMutex
+	rules map[*http.ServeMux][]R
+}
+
+// Add adds rules for the given mux
+func (rt *ruleTable[R]) Add(mux *http.ServeMux, rules ...R) {
+	rt.mut.Lock()
+	defer rt.mut.Unlock()
+	if rt.rules == nil {
+		rt.rules = make(map[*http.ServeMux][]R)
+	}
+	rt.rules[mux] = append(rt.rules[mux], rules...)
+}
+
+// Rules returns the rules for the given mux. Rules are only ever appended,
+// so the returned slice can be used without holding the lock.
+func (rt *ruleTable[R]) Rules(mux *http.ServeMux) []R {
+	rt.mut.RLock()
+	defer rt.mut.RUnlock()
+	rules := rt.rules[mux]
+	return rules[:len(rules):len(rules)]
+}
+
+// Empty checks if there are no rules for any mux
+func (rt *ruleTable[R]) Empty() bool {
+	rt.mut.RLock()
+	defer rt.mut.RUnlock()
+	return len(rt.rules) == 0
+}
+
+// Forget removes all the rules for the given mux
+func (rt *ruleTable[R]) Forget(mux *http.ServeMux) {
+	rt.mut.Lock()
+	defer rt.mut.Unlock()
+	delete(rt.rules, mux)
+}
+
+// pathPattern is a path like "/wp-login.php", or a prefix like "/wp-admin/*"
+// for all the paths that start with it
+type pathPattern struct {
+	path   string
+	prefix bool
+}
+
+// newPathPattern parses a path, or a prefix that ends with "*"
+func newPathPattern(pattern string) pathPattern {
+	if strings.HasSuffix(pattern, "*") {
+		return pathPattern{path: strings.TrimSuffix(pattern, "*"), prefix: true}
+	}
+	return pathPattern{path: pattern}
+}
+
+// match checks if the pattern is for the given path. "/wp-admin/*" is also
+// for "/wp-admin".
+func (p pathPattern) match(urlpath string) bool {
+	if p.prefix {
+		return strings.HasPrefix(urlpath, p.path) || urlpath == strings.TrimSuffix(p.path, "/")
+	}
+	return urlpath == p.path
+}
+
+// prefixRule is a rule for the paths that start with a prefix
+type prefixRule interface {
+	pathPrefix() string
+}
+
+// prefixTable keeps rules for path prefixes, for each mux
+type prefixTable[R prefixRule] struct {
+	ruleTable[R]
+}
+
+// Get returns the rule with the longest prefix that matches the path, if
+// any. For rules with the same prefix, the last one that was added is used.
+func (pt *prefixTable[R]) Get(mux *http.ServeMux, urlpath string) (R, bool) {
+	var found R
+	ok := false
+	for _, rule := range pt.Rules(mux) {
+		if strings.HasPrefix(urlpath, rule.pathPrefix()) && (!ok || len(rule.pathPrefix()) >= len(found.pathPrefix())) {
+			found, ok = rule, true
+		}
+	}
+	return found, ok
+}
+
+// Matching returns all the rules where the prefix matches the path, in the
+// order they were added
+func (pt *prefixTable[R]) Matching(mux *http.ServeMux, urlpath string) []R {
+	var matching []R
+	for _, rule := range pt.Rules(mux) {
+		if strings.HasPrefix(urlpath, rule.pathPrefix()) {
+			matching = append(matching, rule)
+		}
+	}
+	return matching
+}
@@ -0,0 +1,25 @@
+package engine
+
+import (
+	"testing"
+)
+
+func TestPathPattern(t *testing.T) {
+	for _, test := range []struct {
+		pattern, urlpath string
+		expected         bool
+	}{
+		{"/wp-login.php", "/wp-login.php", true},
+		{"/wp-login.php", "/wp-login.php/x", false},
+		{"/wp-admin/*", "/wp-admin/index.php", true},
+		{"/wp-admin/*", "/wp-admin/", true},
+		{"/wp-admin/*", "/wp-admin", true},
+		{"/wp-admin/*", "/wp-admins", false},
+		{"/api*", "/apis", true},
+		{"/*", "/anything", true},
+	} {
+		if newPathPattern(test.pattern).match(test.urlpath) != test.expected {
+			t.Errorf("%s, %s: expected %v", test.pattern, test.urlpath, test.expected)
+		}
+	}
+}
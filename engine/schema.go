@@ -0,0 +1,213 @@
+package engine
+
+// A JSON schema of the flags, the server configuration functions and the Lua
+// functions that are available to handlers, generated from the code that
+// registers them, for editor autocompletion and for linters
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xyproto/algernon/memdb"
+	"github.com/xyproto/gopher-lua"
+)
+
+const jsonSchemaDraft = "http://json-schema.org/draft-07/schema#"
+
+// schemaProperty describes a flag
+type schemaProperty struct {
+	Type        string      `json:"type"`
+	Format      string      `json:"format,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+	Description string      `json:"description,omitempty"`
+}
+
+// schemaObject describes the flags
+type schemaObject struct {
+	Type                 string                    `json:"type"`
+	Properties           map[string]schemaProperty `json:"properties"`
+	AdditionalProperties bool                      `json:"additionalProperties"`
+}
+
+// schemaEnum is a list of function names
+type schemaEnum struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description"`
+	Enum        []string `json:"enum"`
+}
+
+// schemaRef refers to a definition
+type schemaRef struct {
+	Ref string `json:"$ref"`
+}
+
+// configSchema is the JSON schema that is printed with --schema
+type configSchema struct {
+	Schema      string                 `json:"$schema"`
+	Title       string                 `json:"title"`
+	Type        string                 `json:"type"`
+	Properties  map[string]schemaRef   `json:"properties"`
+	Definitions map[string]interface{} `json:"definitions"`
+}
+
+// secretFlag checks if the default value of a flag could be a secret from
+// an environment variable, which should not be printed
+func secretFlag(name string) bool {
+	for _, part := range []string{"key", "secret", "password", "token"} {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// flagProperty describes a flag, with the type of the value, the default
+// value and the usage text
+func flagProperty(f *flag.Flag) schemaProperty {
+	property := schemaProperty{Type: "string", Description: f.Usage}
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return property
+	}
+	switch getter.Get().(type) {
+	case bool:
+		property.Type = "boolean"
+		if b, err := strconv.ParseBool(f.DefValue); err == nil && b {
+			property.Default = b
+		}
+	case int, int64, uint, uint64:
+		property.Type = "integer"
+		if n, err := strconv.ParseInt(f.DefValue, 10, 64); err == nil && n != 0 {
+			property.Default = n
+		}
+	case float64:
+		property.Type = "number"
+		if x, err := strconv.ParseFloat(f.DefValue, 64); err == nil && x != 0 {
+			property.Default = x
+		}
+	case time.Duration:
+		property.Format = "duration"
+		if f.DefValue != "0s" {
+			property.Default = f.DefValue
+		}
+	default:
+		if !secretFlag(f.Name) && f.DefValue != "" {
+			property.Default = f.DefValue
+		}
+	}
+	return property
+}
+
+// flagSchema describes the flags that have been registered
+func flagSchema() schemaObject {
+	properties := make(map[string]schemaProperty)
+	flag.VisitAll(func(f *flag.Flag) {
+		properties[f.Name] = flagProperty(f)
+	})
+	return schemaObject{Type: "object", Properties: properties}
+}
+
+// luaNames returns the names and types of the globals that load adds to a
+// new Lua state, and of the functions in the tables it adds, like
+// "moderation.add". The standard Lua globals are left out.
+func luaNames(load func(L *lua.LState)) map[string]lua.LValueType {
+	base := lua.NewState()
+	defer base.Close()
+	L := lua.NewState()
+	defer L.Close()
+	load(L)
+	names := make(map[string]lua.LValueType)
+	L.G.Global.ForEach(func(key, value lua.LValue) {
+		name := key.String()
+		if base.G.Global.RawGetString(name) != lua.LNil {
+			return
+		}
+		names[name] = value.Type()
+		if table, ok := value.(*lua.LTable); ok {
+			table.ForEach(func(field, value lua.LValue) {
+				if value.Type() == lua.LTFunction {
+					names[name+"."+field.String()] = lua.LTFunction
+				}
+			})
+		}
+	})
+	return names
+}
+
+// sortedNames returns the names, sorted
+func sortedNames(names map[string]lua.LValueType) []string {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// exportedLuaNames returns the names and types of the globals that are
+// available to server configuration scripts, and of those that are
+// available to Lua handlers. They are found by loading them into new Lua
+// states, so that they follow the code that registers them.
+func (ac *Config) exportedLuaNames() (configNames, handlerNames map[string]lua.LValueType) {
+	// Some functions are only available if there is a database backend
+	if ac.perm == nil {
+		ac.perm = memdb.NewPermissions(memdb.New())
+		defer func() { ac.perm = nil }()
+	}
+	configNames = luaNames(func(L *lua.LState) {
+		ac.loadConfigurationFunctions(L, filepath.Join(ac.serverDirOrFilename, "serverconf.lua"), http.NewServeMux(), true, nil)
+	})
+	handlerNames = luaNames(func(L *lua.LState) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		ac.LoadCommonFunctions(httptest.NewRecorder(), req, filepath.Join(ac.serverDirOrFilename, "index.lua"), L, nil, nil)
+	})
+	return configNames, handlerNames
+}
+
+// Schema returns a JSON schema of the flags, the functions that are
+// available to server configuration scripts and the functions that are
+// available to Lua handlers
+func (ac *Config) Schema() interface{} {
+	configNames, handlerNames := ac.exportedLuaNames()
+	return configSchema{
+		Schema: jsonSchemaDraft,
+		Title:  ac.versionString,
+		Type:   "object",
+		Properties: map[string]schemaRef{
+			"flags":                  {"#/definitions/flags"},
+			"configurationFunctions": {"#/definitions/configurationFunctions"},
+			"handlerFunctions":       {"#/definitions/handlerFunctions"},
+		},
+		Definitions: map[string]interface{}{
+			"flags": flagSchema(),
+			"configurationFunctions": schemaEnum{
+				Type:        "string",
+				Description: "Functions for server configuration scripts, like serverconf.lua",
+				Enum:        sortedNames(configNames),
+			},
+			"handlerFunctions": schemaEnum{
+				Type:        "string",
+				Description: "Functions for Lua handlers and for index.lua files",
+				Enum:        sortedNames(handlerNames),
+			},
+		},
+	}
+}
+
+// PrintSchema writes the JSON schema of the flags and the Lua functions
+func (ac *Config) PrintSchema(w io.Writer) error {
+	data, err := json.MarshalIndent(ac.Schema(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,114 @@
+package engine
+
+// Security headers, like Content-Security-Policy and X-Frame-Options, that
+// the server configuration can set for all responses, with overrides for
+// path prefixes
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// The security headers that are used in production mode, if the server
+// configuration does not set any. Inline scripts and styles are still
+// allowed, since the themes use them.
+var productionSecurityHeaders = map[string]string{
+	"Content-Security-Policy":    "object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'self'",
+	"Cross-Origin-Opener-Policy": "same-origin",
+	"Referrer-Policy":            "strict-origin-when-cross-origin",
+	"X-Content-Type-Options":     "nosniff",
+	"X-Frame-Options":            "SAMEORIGIN",
+}
+
+// securityHeaderRule sets headers for paths that start with the prefix. An
+// empty value removes the header.
+type securityHeaderRule struct {
+	prefix  string
+	headers map[string]string
+}
+
+// pathPrefix returns the path prefix that the rule is for
+func (rule securityHeaderRule) pathPrefix() string {
+	return rule.prefix
+}
+
+// securityHeaderTable keeps the security header rules for each mux
+type securityHeaderTable struct {
+	prefixTable[securityHeaderRule]
+}
+
+// Get returns the headers for the given path, where the rules with longer
+// prefixes override the ones with shorter prefixes. Returns false if there
+// are no rules for the mux.
+func (st *securityHeaderTable) Get(mux *http.ServeMux, urlpath string) (map[string]string, bool) {
+	if len(st.Rules(mux)) == 0 {
+		return nil, false
+	}
+	matching := st.Matching(mux, urlpath)
+	sort.SliceStable(matching, func(i, j int) bool {
+		return len(matching[i].prefix) < len(matching[j].prefix)
+	})
+	headers := make(map[string]string)
+	for _, rule := range matching {
+		for name, value := range rule.headers {
+			headers[name] = value
+		}
+	}
+	return headers, true
+}
+
+// setSecurityHeaders sets the security headers for the request, before it
+// is handled. The handlers only set their own default headers if they are
+// missing, so that the configured ones are used.
+func (ac *Config) setSecurityHeaders(mux *http.ServeMux, w http.ResponseWriter, req *http.Request) {
+	headers, ok := ac.securityHeaders.Get(mux, req.URL.Path)
+	if !ok {
+		if !ac.productionMode || ac.noHeaders {
+			return
+		}
+		headers = productionSecurityHeaders
+	}
+	header := w.Header()
+	for name, value := range headers {
+		if value == "" {
+			// The header is present but has no values, so that it is
+			// neither set by the handlers nor sent to the client
+			header[http.CanonicalHeaderKey(name)] = []string{}
+			continue
+		}
+		header.Set(name, value)
+	}
+}
+
+// setDefaultHeader sets a header, unless it has already been set or removed
+// by the security headers from the server configuration
+func setDefaultHeader(header http.Header, name, value string) {
+	if _, ok := header[name]; !ok {
+		header.Set(name, value)
+	}
+}
+
+// LoadSecurityHeaderFunctions makes the SecurityHeaders function available
+// to server configuration scripts
+func (ac *Config) LoadSecurityHeaderFunctions(L *lua.LState, mux *http.ServeMux) {
+
+	// Set security headers for all responses, or for the responses for a
+	// path prefix, which overrides the headers for shorter prefixes. Takes a
+	// table with header names and values, where false removes a header, and
+	// an optional prefix. Returns true.
+	L.SetGlobal("SecurityHeaders", L.NewFunction(func(L *lua.LState) int {
+		rule := securityHeaderRule{prefix: L.OptString(2, "/"), headers: make(map[string]string)}
+		L.CheckTable(1).ForEach(func(key, value lua.LValue) {
+			if value == lua.LFalse {
+				rule.headers[key.String()] = ""
+				return
+			}
+			rule.headers[key.String()] = value.String()
+		})
+		ac.securityHeaders.Add(mux, rule)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
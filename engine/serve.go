@@ -8,7 +8,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/lucas-clemente/quic-go/h2quic"
 	log "github.com/sirupsen/logrus"
 	"github.com/tylerb/graceful"
 	"golang.org/x/net/http2"
@@ -31,7 +30,7 @@ func AtShutdown(shutdownFunction func()) {
 // GenerateShutdownFunction generates a function that will run the postponed
 // shutdown functions.  Note that gracefulServer can be nil. It's only used for
 // finding out if the server was interrupted (ctrl-c or killed, SIGINT/SIGTERM)
-func (ac *Config) GenerateShutdownFunction(gracefulServer *graceful.Server, quicServer *h2quic.Server) func() {
+func (ac *Config) GenerateShutdownFunction(gracefulServer *graceful.Server, quicServer *quicServer) func() {
 	return func() {
 		mut.Lock()
 		defer mut.Unlock()
@@ -74,11 +73,11 @@ func (ac *Config) GenerateShutdownFunction(gracefulServer *graceful.Server, quic
 }
 
 // NewGracefulServer creates a new graceful server configuration
-func (ac *Config) NewGracefulServer(mux *http.ServeMux, http2support bool, addr string) *graceful.Server {
+func (ac *Config) NewGracefulServer(handler http.Handler, http2support bool, addr string) *graceful.Server {
 	// Server configuration
 	s := &http.Server{
 		Addr:    addr,
-		Handler: mux,
+		Handler: handler,
 
 		// The timeout values is also the maximum time it can take
 		// for a complete page of Server-Sent Events (SSE).
@@ -87,6 +86,10 @@ func (ac *Config) NewGracefulServer(mux *http.ServeMux, http2support bool, addr
 
 		MaxHeaderBytes: 1 << 20,
 	}
+	if ac.clientTLS != nil {
+		// Verify client certificates
+		s.TLSConfig = ac.clientTLS.Clone()
+	}
 	if http2support {
 		// Enable HTTP/2 support
 		http2.ConfigureServer(s, nil)
@@ -95,8 +98,9 @@ func (ac *Config) NewGracefulServer(mux *http.ServeMux, http2support bool, addr
 		Server:  s,
 		Timeout: ac.shutdownTimeout,
 	}
-	// Handle ctrl-c
-	gracefulServer.ShutdownInitiated = ac.GenerateShutdownFunction(gracefulServer, nil) // for investigating gracefulServer.Interrupted
+	// Handle ctrl-c and SIGTERM by letting the current requests finish first
+	gracefulServer.ShutdownInitiated = ac.beginShutdown
+	ac.listeners.AddServer(gracefulServer)
 	return gracefulServer
 }
 
@@ -112,6 +116,42 @@ func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
 		return nil    // Done
 	}
 
+	// Load the certificate authorities for client certificates, if given
+	clientTLS, err := ac.clientCertTLSConfig()
+	if err != nil {
+		return err
+	}
+	ac.clientTLS = clientTLS
+	if ac.clientTLS != nil && ac.serveJustQUIC {
+		return errClientCertQUIC
+	}
+
+	// Select the TLS versions and cipher suites
+	if err := ac.loadTLSProfile(); err != nil {
+		return err
+	}
+
+	// Find the client addresses behind the trusted reverse proxies
+	if err := ac.loadTrustedProxies(); err != nil {
+		return err
+	}
+
+	// Limit the connections from abusive clients
+	ac.connLimiter = newConnLimiter(ac.maxConns, ac.maxConnsPerIP, ac.connRate, ac.trustedProxies)
+
+	// Serve with the given mux. The mux may be replaced if the server is reloaded.
+	ac.handler.Swap(mux)
+	var handler http.Handler = ac.handler
+	if ac.pprofAddress != "" {
+		handler = profileLabels(handler)
+	}
+	handler = ac.hstsHandler(handler)
+
+	// Take over the listening sockets from the previous process, if
+	// restarting, and pass them on to a new process on SIGUSR2
+	ac.listeners.Inherit()
+	go ac.handleRestarts()
+
 	// Channel to wait and see if we should just serve regular HTTP instead
 	justServeRegularHTTP := make(chan bool)
 
@@ -121,6 +161,10 @@ func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
 	// Goroutine that wait for a message to just serve regular HTTP, if needed
 	go func() {
 		<-justServeRegularHTTP // Wait for a message to just serve regular HTTP
+		if ac.clientTLS != nil {
+			// Client certificates can not be verified without TLS
+			ac.fatalExit(errClientCertHTTP)
+		}
 		if strings.HasPrefix(ac.serverAddr, ":") {
 			log.Info("Serving HTTP on http://localhost" + ac.serverAddr + "/")
 		} else {
@@ -129,7 +173,7 @@ func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
 		mut.Lock()
 		servingHTTP = true
 		mut.Unlock()
-		HTTPserver := ac.NewGracefulServer(mux, false, ac.serverAddr)
+		HTTPserver := ac.NewGracefulServer(handler, false, ac.serverAddr)
 		// Open the URL before the serving has started, in a short delay
 		if ac.openURLAfterServing && ac.luaServerFilename != "" {
 			go func() {
@@ -138,7 +182,7 @@ func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
 			}()
 		}
 		// Start serving. Shut down gracefully at exit.
-		if err := HTTPserver.ListenAndServe(); err != nil {
+		if err := ac.listenAndServe(HTTPserver); err != nil {
 			mut.Lock()
 			servingHTTP = false
 			mut.Unlock()
@@ -147,8 +191,76 @@ func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
 		}
 	}()
 
+	// Serve on the additional addresses, if any
+	ac.serveListenAddresses(handler)
+
+	// Serve SFTP, for publishing files
+	if ac.sftpAddress != "" {
+		go func() {
+			if err := ac.ServeSFTP(); err != nil {
+				log.Error("Could not serve SFTP: ", err)
+			}
+		}()
+	}
+
 	// Decide which protocol to listen to
 	switch {
+	case ac.unixSocket != "": // Serve regular HTTP on a Unix socket, for a reverse proxy
+		if ac.clientTLS != nil {
+			return errClientCertHTTP
+		}
+		mut.Lock()
+		servingHTTP = true
+		mut.Unlock()
+		go func() {
+			HTTPserver := ac.NewGracefulServer(handler, false, ac.unixSocket)
+			if err := ac.listenAndServeUnix(HTTPserver); err != nil {
+				mut.Lock()
+				servingHTTP = false
+				mut.Unlock()
+				ac.fatalExit(err)
+			}
+		}()
+	case ac.autocertDomains != "": // Listen for HTTPS+HTTP/2 and HTTP, with certificates from Let's Encrypt
+		m := ac.NewAutocertManager()
+		if len(ac.serverHost) == 0 {
+			log.Info("Serving HTTP/2 on https://localhost/")
+		} else {
+			log.Info("Serving HTTP/2 on https://" + ac.serverHost + "/")
+		}
+		mut.Lock()
+		servingHTTPS = true
+		mut.Unlock()
+		go func() {
+			// Listen for HTTPS + HTTP/2 requests. Also answers TLS-ALPN-01 challenges.
+			HTTPS2server := ac.NewGracefulServer(handler, true, ac.serverHost+":443")
+			// Start serving. Shut down gracefully at exit.
+			if err := ac.listenAndServeTLSConfig(HTTPS2server, ac.withClientCerts(m.TLSConfig())); err != nil {
+				mut.Lock()
+				servingHTTPS = false
+				mut.Unlock()
+				log.Error(err)
+			}
+		}()
+		if len(ac.serverHost) == 0 {
+			log.Info("Serving HTTP on http://localhost/")
+		} else {
+			log.Info("Serving HTTP on http://" + ac.serverHost + "/")
+		}
+		mut.Lock()
+		servingHTTP = true
+		mut.Unlock()
+		go func() {
+			// Listen for HTTP requests. Also answers HTTP-01 challenges.
+			HTTPserver := ac.NewGracefulServer(m.HTTPHandler(ac.plainHTTPHandler(handler)), false, ac.serverHost+":80")
+			if err := ac.listenAndServe(HTTPserver); err != nil {
+				mut.Lock()
+				servingHTTP = false
+				mut.Unlock()
+				// If we can't serve regular HTTP on port 80, give up
+				ac.fatalExit(err)
+			}
+		}()
 	case ac.serveJustQUIC: // Just serve QUIC, but fallback to HTTP
 		if strings.HasPrefix(ac.serverAddr, ":") {
 			log.Info("Serving QUIC on https://localhost" + ac.serverAddr + "/")
@@ -165,7 +277,7 @@ func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
 			//       https://github.com/lucas-clemente/quic-go/blob/master/h2quic/server.go#L257
 			//
 			// gracefulServer.ShutdownInitiated = ac.GenerateShutdownFunction(nil, quicServer)
-			if err := h2quic.ListenAndServe(ac.serverAddr, ac.serverCert, ac.serverKey, mux); err != nil {
+			if err := listenAndServeQUIC(ac.serverAddr, ac.serverCert, ac.serverKey, handler); err != nil {
 				log.Error("Not serving QUIC after all. Error: ", err)
 				log.Info("Use the -t flag for serving regular HTTP instead")
 				// If QUIC failed (perhaps the key + cert are missing),
@@ -189,9 +301,9 @@ func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
 		go func() {
 			// Start serving. Shut down gracefully at exit.
 			// Listen for HTTPS + HTTP/2 requests
-			HTTPS2server := ac.NewGracefulServer(mux, true, ac.serverHost+":443")
+			HTTPS2server := ac.NewGracefulServer(handler, true, ac.serverHost+":443")
 			// Start serving. Shut down gracefully at exit.
-			if err := HTTPS2server.ListenAndServeTLS(ac.serverCert, ac.serverKey); err != nil {
+			if err := ac.listenAndServeTLS(HTTPS2server, ac.serverCert, ac.serverKey); err != nil {
 				mut.Lock()
 				servingHTTPS = false
 				mut.Unlock()
@@ -207,8 +319,8 @@ func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
 		servingHTTP = true
 		mut.Unlock()
 		go func() {
-			HTTPserver := ac.NewGracefulServer(mux, false, ac.serverHost+":80")
-			if err := HTTPserver.ListenAndServe(); err != nil {
+			HTTPserver := ac.NewGracefulServer(ac.plainHTTPHandler(handler), false, ac.serverHost+":80")
+			if err := ac.listenAndServe(HTTPserver); err != nil {
 				mut.Lock()
 				servingHTTP = false
 				mut.Unlock()
@@ -227,9 +339,9 @@ func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
 		mut.Unlock()
 		go func() {
 			// Listen for HTTP/2 requests
-			HTTP2server := ac.NewGracefulServer(mux, true, ac.serverAddr)
+			HTTP2server := ac.NewGracefulServer(handler, true, ac.serverAddr)
 			// Start serving. Shut down gracefully at exit.
-			if err := HTTP2server.ListenAndServe(); err != nil {
+			if err := ac.listenAndServe(HTTP2server); err != nil {
 				mut.Lock()
 				servingHTTPS = false
 				mut.Unlock()
@@ -247,10 +359,10 @@ func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
 		servingHTTPS = true
 		mut.Unlock()
 		// Listen for HTTPS + HTTP/2 requests
-		HTTPS2server := ac.NewGracefulServer(mux, true, ac.serverAddr)
+		HTTPS2server := ac.NewGracefulServer(handler, true, ac.serverAddr)
 		// Start serving. Shut down gracefully at exit.
 		go func() {
-			if err := HTTPS2server.ListenAndServeTLS(ac.serverCert, ac.serverKey); err != nil {
+			if err := ac.listenAndServeTLS(HTTPS2server, ac.serverCert, ac.serverKey); err != nil {
 				log.Errorf("%s. Not serving HTTP/2.", err)
 				log.Info("Use the -t flag for serving regular HTTP.")
 				mut.Lock()
@@ -271,10 +383,15 @@ func (ac *Config) Serve(mux *http.ServeMux, done, ready chan bool) error {
 	// Wait just a tiny bit
 	time.Sleep(20 * time.Millisecond)
 
+	// Let the previous process shut down, if restarting, and tell systemd
+	// that the server is ready, if running as a service
+	ac.notifyPreviousProcess()
+	ac.notifyReady()
+
 	ready <- true // Send a "ready" message to the REPL
 
-	// Open the URL, if specified
-	if ac.openURLAfterServing {
+	// Open the URL, if specified. There is no URL for a Unix socket.
+	if ac.openURLAfterServing && ac.unixSocket == "" {
 		// Open the https:// URL if both http:// and https:// are being served
 		mut.Lock()
 		if (!servingHTTP) && (!servingHTTPS) {
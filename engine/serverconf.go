@@ -7,9 +7,13 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/algernon/sqlitedb"
 	"github.com/xyproto/algernon/utils"
 	"github.com/xyproto/gopher-lua"
 	bolt "github.com/xyproto/permissionbolt"
@@ -32,6 +36,15 @@ func (ac *Config) Info() string {
 	if !ac.productionMode {
 		sb.WriteString("Server address:\t\t" + ac.serverAddr + "\n")
 	} // else port 80 and 443
+	for _, la := range ac.listenAddresses {
+		sb.WriteString("Also serving:\t\t" + la.String() + "\n")
+	}
+	for _, name := range ac.handler.Hosts().names() {
+		sb.WriteString("Virtual host:\t\t" + name + "\n")
+	}
+	if ac.sftpAddress != "" {
+		sb.WriteString("SFTP address:\t\t" + ac.sftpAddress + "\n")
+	}
 	if ac.dbName == "" {
 		sb.WriteString("Database:\t\tDisabled\n")
 	} else {
@@ -40,6 +53,12 @@ func (ac *Config) Info() string {
 	if ac.luaServerFilename != "" {
 		sb.WriteString("Server filename:\t" + ac.luaServerFilename + "\n")
 	}
+	if ac.bundleInfo != nil {
+		if ac.bundleInfo.Version != "" {
+			sb.WriteString("Bundle version:\t\t" + ac.bundleInfo.Version + "\n")
+		}
+		sb.WriteString("Bundle signed:\t\t" + ac.bundleInfo.Signed.Format(time.RFC3339) + ", with key " + ac.bundleInfo.Fingerprint() + "\n")
+	}
 
 	// Write the status of flags that can be toggled
 	utils.WriteStatus(&sb, "Options", map[string]bool{
@@ -59,9 +78,36 @@ func (ac *Config) Info() string {
 	if ac.serverLogFile != "" {
 		sb.WriteString("Log file:\t\t" + ac.serverLogFile + "\n")
 	}
-	if !(ac.serveJustHTTP2 || ac.serveJustHTTP) {
+	if ac.autocertDomains != "" {
+		sb.WriteString("Let's Encrypt:\t\t" + strings.Join(ac.autocertDomainList(), ", ") + "\n")
+		if ac.autocertDNS != "" {
+			sb.WriteString("DNS provider:\t\t" + strings.SplitN(ac.autocertDNS, ":", 2)[0] + "\n")
+		}
+	} else if !(ac.serveJustHTTP2 || ac.serveJustHTTP) {
 		sb.WriteString("TLS certificate:\t" + ac.serverCert + "\n")
 		sb.WriteString("TLS key:\t\t" + ac.serverKey + "\n")
+		names, dirs := ac.certs.Sources()
+		for _, name := range names {
+			sb.WriteString("TLS certificate:\t" + name + "\n")
+		}
+		for _, dir := range dirs {
+			sb.WriteString("Certificate dir:\t" + dir + "\n")
+		}
+	}
+	if ac.autocertDomains != "" || !(ac.serveJustHTTP2 || ac.serveJustHTTP) {
+		sb.WriteString("TLS profile:\t\t" + ac.tlsProfileName + "\n")
+	}
+	if ac.maxConns > 0 {
+		sb.WriteString("Max connections:\t" + strconv.Itoa(ac.maxConns) + "\n")
+	}
+	if ac.maxConnsPerIP > 0 {
+		sb.WriteString("Max per IP:\t\t" + strconv.Itoa(ac.maxConnsPerIP) + "\n")
+	}
+	if ac.connRate > 0 {
+		sb.WriteString("Connection rate:\t" + strconv.FormatFloat(ac.connRate, 'f', -1, 64) + " per second per IP\n")
+	}
+	if ac.trustedProxiesList != "" {
+		sb.WriteString("Trusted proxies:\t" + ac.trustedProxiesList + "\n")
 	}
 	if ac.autoRefresh {
 		sb.WriteString("Event server:\t\t" + ac.eventAddr + "\n")
@@ -109,9 +155,36 @@ func (ac *Config) LoadServerConfigFunctions(L *lua.LState, filename string) erro
 		return 0 // number of results
 	}))
 
+	// Also serve on the given address, like "https://:8443" or
+	// "redirect://:80". Returns false if the address is not valid.
+	L.SetGlobal("Listen", L.NewFunction(func(L *lua.LState) int {
+		if err := ac.AddListenAddress(L.CheckString(1)); err != nil {
+			log.Error(err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Add a TLS certificate and key, for the hostnames in the certificate.
+	// The filenames are relative to the configuration script.
+	L.SetGlobal("AddCertificate", L.NewFunction(func(L *lua.LState) int {
+		certFile, keyFile := L.CheckString(1), L.CheckString(2)
+		if !filepath.IsAbs(certFile) {
+			certFile = filepath.Join(filepath.Dir(filename), certFile)
+		}
+		if !filepath.IsAbs(keyFile) {
+			keyFile = filepath.Join(filepath.Dir(filename), keyFile)
+		}
+		ac.certs.Add(certFile, keyFile)
+		return 0 // number of results
+	}))
+
 	// Clear the default path prefixes. This makes everything public.
 	L.SetGlobal("ClearPermissions", L.NewFunction(func(L *lua.LState) int {
 		ac.perm.Clear()
+		ac.protections.Add("clear")
 		return 0 // number of results
 	}))
 
@@ -120,6 +193,7 @@ func (ac *Config) LoadServerConfigFunctions(L *lua.LState, filename string) erro
 	L.SetGlobal("AddUserPrefix", L.NewFunction(func(L *lua.LState) int {
 		path := L.ToString(1)
 		ac.perm.AddUserPath(path)
+		ac.protections.Add("user " + path)
 		return 0 // number of results
 	}))
 
@@ -128,6 +202,7 @@ func (ac *Config) LoadServerConfigFunctions(L *lua.LState, filename string) erro
 	L.SetGlobal("AddAdminPrefix", L.NewFunction(func(L *lua.LState) int {
 		path := L.ToString(1)
 		ac.perm.AddAdminPath(path)
+		ac.protections.Add("admin " + path)
 		return 0 // number of results
 	}))
 
@@ -143,16 +218,52 @@ func (ac *Config) LoadServerConfigFunctions(L *lua.LState, filename string) erro
 			// Then run the given Lua function
 			L.Push(luaDenyFunc)
 			if err := L.PCall(0, lua.MultRet, nil); err != nil {
+				if e, ok := httperror.From(err); ok {
+					// An error raised with Error(), meant for the client
+					ac.ErrorPage(w, req, e)
+					return
+				}
 				// Non-fatal error
 				log.Error("Permission denied handler failed:", err)
 				// Use the default permission handler from now on if the lua function fails
-				ac.perm.SetDenyFunction(redis.PermissionDenied)
+				ac.perm.SetDenyFunction(ac.PermissionDenied)
 				ac.perm.DenyFunction()(w, req)
 			}
 		})
 		return 0 // number of results
 	}))
 
+	// Sets how to respond when permission is denied for a path prefix:
+	// "auto", "401", "403" or "login", with an optional login page URL.
+	// Returns false if the way of responding is unknown.
+	L.SetGlobal("DenyPolicy", L.NewFunction(func(L *lua.LState) int {
+		policy := denyPolicy{prefix: L.CheckString(1), mode: L.CheckString(2), loginURL: L.OptString(3, ac.loginURL)}
+		if !validDenyMode(policy.mode) {
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		ac.denyPolicies.Set(policy)
+		ac.protections.Add(strings.TrimSpace("deny " + policy.prefix + " " + policy.mode + " " + policy.loginURL))
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// For checking passwords with an LDAP server or Active Directory
+	ac.LoadLDAPFunctions(L)
+
+	// For checking uploaded files for viruses
+	ac.LoadUploadScanFunctions(L)
+
+	// For configuring how comments and form submissions are checked for spam
+	ac.LoadSpamFilterFunctions(L)
+	ac.LoadNotificationsFunctions(L)
+	ac.LoadWebPushConfigFunctions(L)
+	ac.LoadIPListConfigFunctions(L)
+	ac.LoadLocaleConfigFunctions(L)
+	ac.LoadProtobufConfigFunctions(L, filename)
+	ac.LoadErrorPageFunctions(L, filename)
+	ac.LoadDirListingConfigFunctions(L, filename)
+
 	// Sets a Lua function to be run once the server is done parsing configuration and arguments.
 	L.SetGlobal("OnReady", L.NewFunction(func(L *lua.LState) int {
 		luaReadyFunc := L.ToFunction(1)
@@ -313,6 +424,17 @@ func (ac *Config) DatabaseBackend() (pinterface.IPermissions, error) {
 			ac.dbName = "PostgreSQL"
 		}
 	}
+	if ac.dbName == "" && ac.sqliteFilename != "" {
+		// New permissions middleware, using an SQLite database
+		db, err := sqlitedb.Open(ac.sqliteFilename)
+		if err != nil {
+			log.Errorf("Could not use SQLite as database backend: %s", err)
+		} else if perm, err = sqlitedb.NewPermissions(db); err != nil {
+			log.Errorf("Could not use SQLite as database backend: %s", err)
+		} else {
+			ac.dbName = "SQLite (" + ac.sqliteFilename + ")"
+		}
+	}
 	if ac.dbName == "" && ac.redisAddrSpecified {
 		// New permissions middleware, using a Redis database
 		log.Info("Testing redis connection")
@@ -324,15 +446,27 @@ func (ac *Config) DatabaseBackend() (pinterface.IPermissions, error) {
 			} else {
 				log.Errorf("Could not use Redis as database backend: %s", err)
 			}
+			// Use an in-memory database instead of failing every request
+			perm, err = ac.MemoryBackend()
+			if err != nil {
+				log.Errorf("Could not use the in-memory database backend: %s", err)
+			} else {
+				log.Error("REDIS CAN NOT BE REACHED. USING AN IN-MEMORY DATABASE UNTIL THE SERVER IS RESTARTED.")
+				ac.dbName = "In-memory (Redis can not be reached)"
+			}
 		} else {
 			log.Info("Redis connection worked out")
 			var err error
 			log.Info("Connecting to Redis...")
-			perm, err = redis.NewWithRedisConf2(ac.redisDBindex, ac.redisAddr)
+			redisPerm, err := redis.NewWithRedisConf2(ac.redisDBindex, ac.redisAddr)
 			if err != nil {
 				log.Warnf("Could not use Redis as database backend: %s", err)
 			} else {
 				ac.dbName = "Redis"
+				// Switch to an in-memory database if Redis goes away
+				fp := newFallbackPermissions(redisPerm)
+				go ac.watchRedis(fp)
+				perm = fp
 			}
 		}
 	}
@@ -0,0 +1,312 @@
+package engine
+
+// Session lifetimes, sliding expiration, long-lived "remember me" tokens
+// and logging a user out from every browser at once
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/pinterface"
+)
+
+const (
+	// The name of the cookie that the user state uses for logins
+	userCookieName = "user"
+
+	// The name of the cookie with the "remember me" token
+	rememberCookieName = "remember"
+
+	// Fields that are stored per user. Logins from before the session epoch
+	// are no longer valid. Each "remember me" token has its own field.
+	sessionEpochKey   = "sessionepoch"
+	rememberKeyPrefix = "remember:"
+
+	// For how long the previous "remember me" token is still accepted after
+	// it has been replaced, for the requests a browser sends at the same time
+	rememberGrace = 60
+
+	defaultRememberDays = 30
+)
+
+var errNoSuchUser = errors.New("no such user")
+
+// randomToken returns a random hex string
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// hashToken returns the hash of a token, as it is stored in the database
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// cookieIssued returns when the given secure cookie was set, in seconds
+// since the epoch. The cookie must already be verified.
+func cookieIssued(req *http.Request, name string) (int64, bool) {
+	c, err := req.Cookie(name)
+	if err != nil {
+		return 0, false
+	}
+	parts := strings.SplitN(c.Value, "|", 3)
+	if len(parts) != 3 {
+		return 0, false
+	}
+	issued, err := strconv.ParseInt(parts[1], 0, 64)
+	return issued, err == nil
+}
+
+// withCookies returns a copy of the request where the named cookie is
+// removed, and the given cookies are added
+func withCookies(req *http.Request, remove string, add ...*http.Cookie) *http.Request {
+	r := req.Clone(req.Context())
+	r.Header.Del("Cookie")
+	for _, c := range req.Cookies() {
+		if c.Name != remove {
+			r.AddCookie(c)
+		}
+	}
+	for _, c := range add {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+// responseCookie returns the last cookie with the given name that has been
+// set in the response headers, or nil
+func responseCookie(w http.ResponseWriter, name string) *http.Cookie {
+	var found *http.Cookie
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		if c.Name == name {
+			found = c
+		}
+	}
+	return found
+}
+
+// sessionValid checks if a login that was issued at the given time is still
+// valid, according to the session timeout and the session epoch of the user
+func (ac *Config) sessionValid(state pinterface.IUserState, username string, issued, now int64) bool {
+	if ac.sessionTimeout > 0 && now-issued > ac.sessionTimeout {
+		return false
+	}
+	epoch, err := state.Users().Get(username, sessionEpochKey)
+	if err != nil {
+		return true
+	}
+	since, _ := strconv.ParseInt(epoch, 10, 64)
+	return issued >= since
+}
+
+// checkSession logs out requests where the session has expired, renews the
+// login cookie if sliding expiration is enabled, and logs in requests with a
+// valid "remember me" token. The request that should be served is returned.
+func (ac *Config) checkSession(w http.ResponseWriter, req *http.Request) *http.Request {
+	if ac.perm == nil {
+		return req
+	}
+	state := ac.perm.UserState()
+	now := time.Now().Unix()
+	if username, err := state.UsernameCookie(req); err == nil && username != "" {
+		issued, _ := cookieIssued(req, userCookieName)
+		if ac.sessionValid(state, username, issued, now) {
+			if !ac.trackSession(w, req, state, username, now) {
+				// The session has been ended, so also forget this browser
+				state.ClearCookie(w)
+				ac.Forget(w, req)
+				return withCookies(withCookies(req, userCookieName), rememberCookieName)
+			}
+			ac.mergeVisitor(req, username)
+			if ac.slidingSessions && ac.sessionTimeout > 0 && now-issued > ac.sessionTimeout/2 {
+				state.SetUsernameCookie(w, username)
+			}
+			return req
+		}
+		// The session has expired, or the user has been logged out everywhere
+		state.ClearCookie(w)
+		req = withCookies(req, userCookieName)
+	}
+	return ac.rememberedLogin(w, req, state, now)
+}
+
+// rememberedLogin logs in the user of a valid "remember me" token, and
+// replaces the token with a new one
+func (ac *Config) rememberedLogin(w http.ResponseWriter, req *http.Request, state pinterface.IUserState, now int64) *http.Request {
+	c, err := req.Cookie(rememberCookieName)
+	if err != nil {
+		return req
+	}
+	parts := strings.SplitN(c.Value, ":", 3)
+	if len(parts) != 3 {
+		clearRememberCookie(w)
+		return req
+	}
+	series, validator := parts[0], parts[1]
+	usernameBytes, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		clearRememberCookie(w)
+		return req
+	}
+	username := string(usernameBytes)
+
+	stored, err := state.Users().Get(username, rememberKeyPrefix+series)
+	if err != nil || !state.HasUser(username) {
+		clearRememberCookie(w)
+		return req
+	}
+	// hash|expires|previous hash|when the previous token was replaced
+	fields := strings.Split(stored, "|")
+	if len(fields) != 4 {
+		clearRememberCookie(w)
+		return req
+	}
+	expires, _ := strconv.ParseInt(fields[1], 10, 64)
+	replaced, _ := strconv.ParseInt(fields[3], 10, 64)
+	hash := hashToken(validator)
+	switch {
+	case now > expires:
+		state.Users().DelKey(username, rememberKeyPrefix+series)
+		clearRememberCookie(w)
+		return req
+	case subtle.ConstantTimeCompare([]byte(hash), []byte(fields[0])) == 1:
+		// Replace the token, so that each token can only be used once
+		if err := ac.issueRememberToken(w, req, state, username, series, fields[0], expires, now); err != nil {
+			log.Error("Could not replace the remember me token: ", err)
+			return req
+		}
+	case fields[2] != "" && now-replaced <= rememberGrace && subtle.ConstantTimeCompare([]byte(hash), []byte(fields[2])) == 1:
+		// The token was just replaced, by a request that was sent at the same time
+	default:
+		// A token that has already been replaced is used again, so
+		// it might have been stolen. Forget all the tokens for the user.
+		log.Warnf("A remember me token for %s was used twice. Forgetting all remember me tokens for %s.", username, username)
+		ac.forgetRememberTokens(state, username)
+		clearRememberCookie(w)
+		return req
+	}
+	if err := state.Login(w, username); err != nil {
+		return req
+	}
+	// Let the rest of this request see the new login
+	if login := responseCookie(w, userCookieName); login != nil {
+		return withCookies(req, userCookieName, login)
+	}
+	return req
+}
+
+// issueRememberToken stores a new "remember me" token for the given series
+// and sets it as a cookie
+func (ac *Config) issueRememberToken(w http.ResponseWriter, req *http.Request, state pinterface.IUserState, username, series, previousHash string, expires, now int64) error {
+	validator := randomToken()
+	value := strings.Join([]string{hashToken(validator), strconv.FormatInt(expires, 10), previousHash, strconv.FormatInt(now, 10)}, "|")
+	if err := state.Users().Set(username, rememberKeyPrefix+series, value); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     rememberCookieName,
+		Value:    series + ":" + validator + ":" + base64.RawURLEncoding.EncodeToString([]byte(username)),
+		Path:     "/",
+		Expires:  time.Unix(expires, 0),
+		MaxAge:   int(expires - now),
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// clearRememberCookie removes the "remember me" cookie from the browser
+func clearRememberCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: rememberCookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+}
+
+// forgetRememberTokens removes all the "remember me" tokens for a user
+func (ac *Config) forgetRememberTokens(state pinterface.IUserState, username string) {
+	keys, err := state.Users().Keys(username)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, rememberKeyPrefix) {
+			state.Users().DelKey(username, key)
+		}
+	}
+}
+
+// Remember gives the browser a long-lived token that logs in the given user
+// again when the login cookie is gone. The token is replaced each time it is used.
+func (ac *Config) Remember(w http.ResponseWriter, req *http.Request, username string) error {
+	state := ac.perm.UserState()
+	if !state.HasUser(username) {
+		return errNoSuchUser
+	}
+	days := ac.rememberDays
+	if days <= 0 {
+		days = defaultRememberDays
+	}
+	now := time.Now().Unix()
+	return ac.issueRememberToken(w, req, state, username, randomToken(), "", now+int64(days)*86400, now)
+}
+
+// Forget removes the "remember me" token of the current browser
+func (ac *Config) Forget(w http.ResponseWriter, req *http.Request) {
+	if c, err := req.Cookie(rememberCookieName); err == nil {
+		parts := strings.SplitN(c.Value, ":", 3)
+		if len(parts) == 3 {
+			if username, err := base64.RawURLEncoding.DecodeString(parts[2]); err == nil {
+				ac.perm.UserState().Users().DelKey(string(username), rememberKeyPrefix+parts[0])
+			}
+		}
+	}
+	clearRememberCookie(w)
+}
+
+// LogoutEverywhere logs out the given user from every browser, by making
+// all the current logins and "remember me" tokens for the user invalid
+func (ac *Config) LogoutEverywhere(username string) error {
+	state := ac.perm.UserState()
+	if err := state.Users().Set(username, sessionEpochKey, strconv.FormatInt(time.Now().Unix(), 10)); err != nil {
+		return err
+	}
+	ac.forgetRememberTokens(state, username)
+	ac.endSessions(state, username)
+	state.SetLoggedOut(username)
+	return nil
+}
+
+// LoadSessionFunctions makes functions for "remember me" tokens and for
+// logging out from every browser available to Lua scripts
+func (ac *Config) LoadSessionFunctions(w http.ResponseWriter, req *http.Request, L *lua.LState) {
+	// Give the browser a long-lived "remember me" token for the given user.
+	// Returns true if successful.
+	L.SetGlobal("RememberMe", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		L.Push(lua.LBool(nil == ac.Remember(w, req, username)))
+		return 1 // number of results
+	}))
+	// Remove the "remember me" token of the current browser. Returns nothing.
+	L.SetGlobal("ForgetMe", L.NewFunction(func(L *lua.LState) int {
+		ac.Forget(w, req)
+		return 0 // number of results
+	}))
+	// Log out the given user from every browser, and remove all the
+	// "remember me" tokens for the user. Returns true if successful.
+	L.SetGlobal("LogoutEverywhere", L.NewFunction(func(L *lua.LState) int {
+		username := L.ToString(1)
+		L.Push(lua.LBool(nil == ac.LogoutEverywhere(username)))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,79 @@
+package engine
+
+// Publishing files to the server directory with sftp or scp, with --sftp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/sftpd"
+)
+
+var (
+	errSFTPKeys = errors.New("--sftp requires --sftpkeys, with the public keys that can log in")
+	errSFTPDir  = errors.New("--sftp can only publish to a server directory, not to a single file")
+	errSFTPNone = errors.New("found no supported public keys for --sftp")
+)
+
+// sftpHostKeyFilename returns the host key file given with --sftphostkey,
+// or a file in the user cache directory
+func (ac *Config) sftpHostKeyFilename() string {
+	if ac.sftpHostKey != "" {
+		return ac.sftpHostKey
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	return filepath.Join(cacheDir, "algernon", "ssh_host_ed25519_key")
+}
+
+// sftpChanged is called when a file has been uploaded, removed or renamed
+// over SFTP. The file cache is cleared, so that the new files are served.
+func (ac *Config) sftpChanged(name string) {
+	if ac.verboseMode {
+		log.Info("Published " + name + " over SFTP")
+	}
+	ac.clearCaches()
+}
+
+// ServeSFTP serves SFTP at the address given with --sftp, for publishing
+// files to the server directory. Only the keys in the --sftpkeys file can
+// log in.
+func (ac *Config) ServeSFTP() error {
+	if ac.sftpKeys == "" {
+		return errSFTPKeys
+	}
+	if ac.singleFileMode || !ac.fs.IsDir(ac.serverDirOrFilename) {
+		return errSFTPDir
+	}
+	keys, err := sftpd.ReadAuthorizedKeys(ac.sftpKeys)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errSFTPNone
+	}
+	hostKey, err := sftpd.HostKey(ac.sftpHostKeyFilename())
+	if err != nil {
+		return err
+	}
+	server := &sftpd.Server{
+		Root:           ac.serverDirOrFilename,
+		HostKey:        hostKey,
+		AuthorizedKeys: keys,
+		Changed:        ac.sftpChanged,
+		Logf:           log.Infof,
+	}
+	l, err := ac.listeners.Listen("tcp", ac.sftpAddress)
+	if err != nil {
+		return err
+	}
+	AtShutdown(func() {
+		l.Close()
+	})
+	log.Infof("Serving SFTP on %s, with the host key %s", ac.sftpAddress, sftpd.HostKeyFingerprint(hostKey))
+	return server.Serve(l)
+}
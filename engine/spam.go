@@ -0,0 +1,223 @@
+package engine
+
+// Checking comments and form submissions for spam, and a queue where
+// submissions can wait for moderation
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/spam"
+	"github.com/xyproto/gopher-lua"
+)
+
+const (
+	// The hash map where submissions that wait for moderation are stored
+	moderationHashMap = "moderation"
+
+	// How many submissions each IP address can make per minute, by default
+	defaultSpamRate = 5
+)
+
+// spamFilter keeps the spam checker and how many submissions each IP
+// address has made during the current minute
+type spamFilter struct {
+	mut     sync.Mutex
+	checker *spam.Checker
+	rate    int
+	counts  map[string]int
+	minute  int64
+}
+
+// Set starts using the given checker and rate limit
+func (sf *spamFilter) Set(checker *spam.Checker, rate int) {
+	sf.mut.Lock()
+	defer sf.mut.Unlock()
+	sf.checker = checker
+	sf.rate = rate
+}
+
+// Get returns the checker, which is created if needed
+func (sf *spamFilter) Get() *spam.Checker {
+	sf.mut.Lock()
+	defer sf.mut.Unlock()
+	if sf.checker == nil {
+		sf.checker = spam.NewChecker()
+		sf.rate = defaultSpamRate
+	}
+	return sf.checker
+}
+
+// tooFrequent counts a submission from the given IP address, and checks if
+// there have been too many during the current minute
+func (sf *spamFilter) tooFrequent(ip string) bool {
+	sf.mut.Lock()
+	defer sf.mut.Unlock()
+	if sf.rate <= 0 {
+		return false
+	}
+	minute := time.Now().Unix() / 60
+	if minute != sf.minute || sf.counts == nil {
+		sf.counts = make(map[string]int)
+		sf.minute = minute
+	}
+	sf.counts[ip]++
+	return sf.counts[ip] > sf.rate
+}
+
+// IsSpam checks a submission from the given request. Returns the reasons
+// for the submission being spam, or nothing if it seems to be fine.
+func (ac *Config) IsSpam(req *http.Request, content spam.Content) []string {
+	content.IP = ac.clientIP(req)
+	content.UserAgent = req.UserAgent()
+	content.Referrer = req.Referer()
+	var reasons []string
+	if ac.spam.tooFrequent(content.IP) {
+		reasons = append(reasons, "too many submissions")
+	}
+	found, err := ac.spam.Get().Check(content)
+	if err != nil {
+		// Only use the heuristics if the spam service can not be reached
+		log.Warn("Could not check for spam: ", err)
+	}
+	return append(reasons, found...)
+}
+
+// LoadSpamFunctions makes functions for checking for spam and for the
+// moderation queue available to Lua scripts
+func (ac *Config) LoadSpamFunctions(req *http.Request, L *lua.LState) {
+
+	// Check if a comment or form submission is spam. Takes a table with
+	// author, email, url and content. Returns true and a table with the
+	// reasons if it is spam, or false and an empty table.
+	L.SetGlobal("IsSpam", L.NewFunction(func(L *lua.LState) int {
+		fields := tableToHeaders(L.CheckTable(1))
+		reasons := ac.IsSpam(req, spam.Content{
+			Author: fields["author"],
+			Email:  fields["email"],
+			URL:    fields["url"],
+			Text:   fields["content"],
+		})
+		L.Push(lua.LBool(len(reasons) > 0))
+		L.Push(convert.Strings2table(L, reasons))
+		return 2 // number of results
+	}))
+
+	if ac.perm == nil {
+		return
+	}
+
+	t := L.NewTable()
+
+	// Add a submission to the moderation queue. Takes a table with string
+	// values. Returns an ID, or nil and an error message.
+	L.SetField(t, "add", L.NewFunction(func(L *lua.LState) int {
+		fields := tableToHeaders(L.CheckTable(1))
+		hash, err := ac.perm.UserState().Creator().NewHashMap(moderationHashMap)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		id := randomToken()
+		fields["created"] = strconv.FormatInt(time.Now().Unix(), 10)
+		for key, value := range fields {
+			if err := hash.Set(id, key, value); err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2 // number of results
+			}
+		}
+		L.Push(lua.LString(id))
+		return 1 // number of results
+	}))
+
+	// List the submissions in the moderation queue, the oldest first.
+	// Returns a table with tables, that also have the fields id and created.
+	L.SetField(t, "list", L.NewFunction(func(L *lua.LState) int {
+		list := L.NewTable()
+		hash, err := ac.perm.UserState().Creator().NewHashMap(moderationHashMap)
+		if err != nil {
+			L.Push(list)
+			return 1 // number of results
+		}
+		ids, _ := hash.All()
+		var submissions []map[string]string
+		for _, id := range ids {
+			keys, err := hash.Keys(id)
+			if err != nil || len(keys) == 0 {
+				continue
+			}
+			fields := map[string]string{"id": id}
+			for _, key := range keys {
+				fields[key], _ = hash.Get(id, key)
+			}
+			submissions = append(submissions, fields)
+		}
+		sort.Slice(submissions, func(i, j int) bool {
+			a, _ := strconv.ParseInt(submissions[i]["created"], 10, 64)
+			b, _ := strconv.ParseInt(submissions[j]["created"], 10, 64)
+			return a < b
+		})
+		for _, fields := range submissions {
+			list.Append(convert.Map2table(L, fields))
+		}
+		L.Push(list)
+		return 1 // number of results
+	}))
+
+	// Remove a submission from the moderation queue, after it has been
+	// approved or rejected. Takes an ID. Returns true if successful.
+	L.SetField(t, "remove", L.NewFunction(func(L *lua.LState) int {
+		id := L.CheckString(1)
+		hash, err := ac.perm.UserState().Creator().NewHashMap(moderationHashMap)
+		if err != nil || strings.TrimSpace(id) == "" {
+			L.Push(lua.LFalse)
+			return 1 // number of results
+		}
+		L.Push(lua.LBool(hash.Del(id) == nil))
+		return 1 // number of results
+	}))
+
+	L.SetGlobal("moderation", t)
+}
+
+// LoadSpamFilterFunctions makes the SpamFilter function available to
+// server configuration scripts
+func (ac *Config) LoadSpamFilterFunctions(L *lua.LState) {
+
+	// Configure how IsSpam checks for spam. Takes a table with maxlinks,
+	// blacklist (a list of words, hosts and e-mail addresses), rate (how
+	// many submissions each IP address can make per minute), akismetkey,
+	// akismeturl and site. Returns true.
+	L.SetGlobal("SpamFilter", L.NewFunction(func(L *lua.LState) int {
+		options := L.CheckTable(1)
+		checker := spam.NewChecker()
+		if maxLinks, ok := options.RawGetString("maxlinks").(lua.LNumber); ok {
+			checker.MaxLinks = int(maxLinks)
+		}
+		if blacklist, ok := options.RawGetString("blacklist").(*lua.LTable); ok {
+			blacklist.ForEach(func(_, value lua.LValue) {
+				checker.Blacklist = append(checker.Blacklist, strings.ToLower(value.String()))
+			})
+		}
+		rate := defaultSpamRate
+		if n, ok := options.RawGetString("rate").(lua.LNumber); ok {
+			rate = int(n)
+		}
+		checker.AkismetKey = lua.LVAsString(options.RawGetString("akismetkey"))
+		if akismetURL := lua.LVAsString(options.RawGetString("akismeturl")); akismetURL != "" {
+			checker.AkismetURL = akismetURL
+		}
+		checker.Site = lua.LVAsString(options.RawGetString("site"))
+		ac.spam.Set(checker, rate)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
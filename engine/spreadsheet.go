@@ -0,0 +1,195 @@
+package engine
+
+// Exporting tables as CSV and XLSX files, for reports and admin pages
+
+import (
+	"bytes"
+	"encoding/csv"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xyproto/algernon/xlsx"
+	"github.com/xyproto/gopher-lua"
+)
+
+// The byte order mark that makes spreadsheet applications read CSV files
+// as UTF-8
+const utf8BOM = "\xEF\xBB\xBF"
+
+// luaCell converts a Lua value to a value for a spreadsheet cell
+func luaCell(value lua.LValue) interface{} {
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return nil
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		if f := float64(v); f == float64(int64(f)) {
+			return int64(f)
+		}
+		return float64(v)
+	}
+	return value.String()
+}
+
+// tableRows converts a Lua table with rows to a list of rows of cells. The
+// rows can be lists, or tables with keys, where the sorted keys of the
+// first row are used as a header. Values that are not tables are rows with
+// one cell. Returns true if there is a header.
+func tableRows(t *lua.LTable) ([][]interface{}, bool) {
+	var (
+		rows   [][]interface{}
+		keys   []string
+		header bool
+	)
+	for i := 1; i <= t.Len(); i++ {
+		row, ok := t.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			rows = append(rows, []interface{}{luaCell(t.RawGetInt(i))})
+			continue
+		}
+		if row.Len() > 0 {
+			var cells []interface{}
+			for j := 1; j <= row.Len(); j++ {
+				cells = append(cells, luaCell(row.RawGetInt(j)))
+			}
+			rows = append(rows, cells)
+			continue
+		}
+		if keys == nil {
+			row.ForEach(func(key, _ lua.LValue) {
+				keys = append(keys, key.String())
+			})
+			sort.Strings(keys)
+			cells := make([]interface{}, len(keys))
+			for j, key := range keys {
+				cells[j] = key
+			}
+			rows = append(rows, cells)
+			header = len(rows) == 1
+		}
+		cells := make([]interface{}, len(keys))
+		for j, key := range keys {
+			cells[j] = luaCell(row.RawGetString(key))
+		}
+		rows = append(rows, cells)
+	}
+	return rows, header
+}
+
+// csvText returns the text for a CSV cell. Text that starts like a formula
+// gets a "'" in front, so that spreadsheet applications do not run it.
+func csvText(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		return strings.ToUpper(strconv.FormatBool(v))
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+			return "'" + v
+		}
+		return v
+	}
+	return ""
+}
+
+// makeCSV returns the rows as CSV
+func makeCSV(rows [][]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, value := range row {
+			record[i] = csvText(value)
+		}
+		if err := cw.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	cw.Flush()
+	return buf.Bytes(), cw.Error()
+}
+
+// makeXLSX returns the rows as an XLSX file
+func makeXLSX(rows [][]interface{}, header bool, sheet string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := xlsx.Write(&buf, sheet, rows, header); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// serveAttachment writes a file to the response, so that browsers
+// download it with the given filename
+func serveAttachment(w http.ResponseWriter, contentType, filename string, data []byte) error {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, err := w.Write(data)
+	return err
+}
+
+// pushExport pushes the result of exporting, or nil and an error message
+func pushExport(L *lua.LState, result lua.LValue, err error) int {
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(result)
+	return 1 // number of results
+}
+
+// LoadSpreadsheetFunctions makes functions for exporting tables as CSV and
+// XLSX files available to Lua scripts
+func (ac *Config) LoadSpreadsheetFunctions(w http.ResponseWriter, L *lua.LState) {
+
+	// Convert a table with rows to CSV. The rows can be lists, or tables
+	// with keys, where the keys become the header. Returns the CSV, or nil
+	// and an error message.
+	L.SetGlobal("CSV", L.NewFunction(func(L *lua.LState) int {
+		rows, _ := tableRows(L.CheckTable(1))
+		data, err := makeCSV(rows)
+		return pushExport(L, lua.LString(data), err)
+	}))
+
+	// Write a table with rows to the response, as a CSV file that is
+	// downloaded. Takes the rows and an optional filename. Returns true,
+	// or nil and an error message.
+	L.SetGlobal("ServeCSV", L.NewFunction(func(L *lua.LState) int {
+		rows, _ := tableRows(L.CheckTable(1))
+		data, err := makeCSV(rows)
+		if err == nil {
+			err = serveAttachment(w, "text/csv; charset=utf-8", L.OptString(2, "export.csv"), append([]byte(utf8BOM), data...))
+		}
+		return pushExport(L, lua.LTrue, err)
+	}))
+
+	// Convert a table with rows to an XLSX file. Takes the rows and an
+	// optional sheet name. Returns the file, or nil and an error message.
+	L.SetGlobal("XLSX", L.NewFunction(func(L *lua.LState) int {
+		rows, header := tableRows(L.CheckTable(1))
+		data, err := makeXLSX(rows, header, L.OptString(2, "Sheet1"))
+		return pushExport(L, lua.LString(data), err)
+	}))
+
+	// Write a table with rows to the response, as an XLSX file that is
+	// downloaded. Takes the rows, an optional filename and an optional
+	// sheet name. Returns true, or nil and an error message.
+	L.SetGlobal("ServeXLSX", L.NewFunction(func(L *lua.LState) int {
+		rows, header := tableRows(L.CheckTable(1))
+		data, err := makeXLSX(rows, header, L.OptString(3, "Sheet1"))
+		if err == nil {
+			err = serveAttachment(w, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", L.OptString(2, "export.xlsx"), data)
+		}
+		return pushExport(L, lua.LTrue, err)
+	}))
+}
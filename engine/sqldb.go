@@ -0,0 +1,106 @@
+package engine
+
+// SQL databases that can be used directly from Lua scripts
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sync"
+
+	"github.com/xyproto/algernon/lua/sqldb"
+	"github.com/xyproto/algernon/sqlitedb"
+	"github.com/xyproto/gopher-lua"
+)
+
+// dbTable keeps the open database connections, so that all requests share
+// the same connection pool for the same driver and data source
+type dbTable struct {
+	mut sync.Mutex
+	dbs map[string]*sql.DB
+}
+
+// Open returns an open database connection pool for the given driver and
+// data source name, and opens it if needed
+func (dt *dbTable) Open(driver, dsn string) (*sql.DB, error) {
+	dt.mut.Lock()
+	defer dt.mut.Unlock()
+	if dt.dbs == nil {
+		dt.dbs = make(map[string]*sql.DB)
+	}
+	key := driver + " " + dsn
+	if db, ok := dt.dbs[key]; ok {
+		return db, nil
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	dt.dbs[key] = db
+	return db, nil
+}
+
+// Close closes all database connections
+func (dt *dbTable) Close() {
+	dt.mut.Lock()
+	defer dt.mut.Unlock()
+	for key, db := range dt.dbs {
+		db.Close()
+		delete(dt.dbs, key)
+	}
+}
+
+// LoadSQLFunctions makes the sqlite function and the db table available to
+// Lua scripts. Relative SQLite paths are relative to the given directory.
+func (ac *Config) LoadSQLFunctions(L *lua.LState, scriptdir string) {
+	sqldb.Load(L)
+
+	t := L.NewTable()
+
+	// Open a database connection pool, given a driver name, like "mysql" or
+	// "postgres", and a data source name. The pool is shared between requests.
+	// Returns a database object, or nil and an error message.
+	L.SetField(t, "open", L.NewFunction(func(L *lua.LState) int {
+		db, err := ac.dbs.Open(L.CheckString(1), L.CheckString(2))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(sqldb.NewDB(L, db))
+		return 1 // number of results
+	}))
+
+	// The names of the available database drivers
+	L.SetField(t, "drivers", L.NewFunction(func(L *lua.LState) int {
+		drivers := L.NewTable()
+		for _, name := range sql.Drivers() {
+			drivers.Append(lua.LString(name))
+		}
+		L.Push(drivers)
+		return 1 // number of results
+	}))
+
+	L.SetGlobal("db", t)
+
+	// Open an SQLite database, given a filename.
+	// Returns a database object, or nil and an error message.
+	L.SetGlobal("sqlite", L.NewFunction(func(L *lua.LState) int {
+		filename := L.CheckString(1)
+		if filename != ":memory:" && !filepath.IsAbs(filename) {
+			filename = filepath.Join(scriptdir, filename)
+		}
+		db, err := ac.dbs.Open(sqlitedb.DriverName, filename)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(sqldb.NewDB(L, db))
+		return 1 // number of results
+	}))
+
+}
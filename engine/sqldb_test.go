@@ -0,0 +1,45 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestSQLite(t *testing.T) {
+	ac := &Config{dbs: &dbTable{}}
+	defer ac.dbs.Close()
+
+	L := lua.NewState()
+	defer L.Close()
+	ac.LoadSQLFunctions(L, t.TempDir())
+
+	err := L.DoString(`
+		local conn, err = sqlite("test.db")
+		assert(conn, err)
+		assert(conn:exec("CREATE TABLE fruit (name TEXT, count INTEGER)"))
+
+		local affected, id = conn:exec("INSERT INTO fruit (name, count) VALUES (?, ?)", "apple", 3)
+		assert(affected == 1 and id == 1, "unexpected exec result")
+
+		local stmt = assert(conn:prepare("INSERT INTO fruit (name, count) VALUES (?, ?)"))
+		stmt:exec("banana", 5)
+		stmt:exec("cherry", 7)
+		stmt:close()
+
+		local rows = assert(conn:query("SELECT name, count FROM fruit WHERE count > ? ORDER BY name", 4))
+		assert(#rows == 2, "expected 2 rows, got " .. #rows)
+		assert(rows[1].name == "banana" and rows[1].count == 5, "unexpected first row")
+		assert(rows[2].name == "cherry" and rows[2].count == 7, "unexpected second row")
+
+		local select = assert(conn:prepare("SELECT count FROM fruit WHERE name = ?"))
+		assert(select:query("apple")[1].count == 3, "unexpected prepared query result")
+		select:close()
+
+		local nothing, msg = conn:query("SELECT * FROM missing")
+		assert(nothing == nil and msg ~= nil, "expected an error for a missing table")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
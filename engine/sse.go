@@ -2,10 +2,13 @@ package engine
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/xyproto/algernon/utils"
+	"github.com/xyproto/gopher-lua"
 )
 
 // InsertAutoRefresh inserts JavaScript code to the page that makes the page
@@ -62,3 +65,106 @@ func (ac *Config) InsertAutoRefresh(req *http.Request, htmldata []byte) []byte {
 	// In the unlikely event that no place to insert the JavaScript was found
 	return htmldata
 }
+
+// SSEEvent formats a Server-Sent Event. The event name and the id are
+// optional. Each line in the data is sent as a separate "data:" field.
+func SSEEvent(event, id, data string) string {
+	var sb strings.Builder
+	if event != "" {
+		sb.WriteString("event: " + event + "\n")
+	}
+	if id != "" {
+		sb.WriteString("id: " + id + "\n")
+	}
+	for _, line := range strings.Split(strings.Replace(data, "\r\n", "\n", utils.EveryInstance), "\n") {
+		sb.WriteString("data: " + line + "\n")
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// NewSSETable sets the headers for an event stream and returns a Lua table
+// with functions for sending events to the client
+func (ac *Config) NewSSETable(w http.ResponseWriter, req *http.Request, L *lua.LState, flushFunc func()) *lua.LTable {
+	w.Header().Set("Content-Type", "text/event-stream;charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Ask proxies like nginx to not buffer the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	// Lua handlers that are set up with handle() have no flush function
+	if flushFunc == nil {
+		if flusher, ok := w.(http.Flusher); ok {
+			flushFunc = flusher.Flush
+		}
+	}
+
+	done := req.Context().Done()
+	closed := func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}
+	write := func(s string) bool {
+		if closed() {
+			return false
+		}
+		if _, err := fmt.Fprint(w, s); err != nil {
+			return false
+		}
+		if flushFunc != nil {
+			flushFunc()
+		}
+		return true
+	}
+
+	t := L.NewTable()
+
+	// Send an event, with data and an optional event name and id.
+	// Returns false if the client has disconnected.
+	L.SetField(t, "send", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(write(SSEEvent(L.OptString(2, ""), L.OptString(3, ""), L.ToString(1)))))
+		return 1 // number of results
+	}))
+
+	// Send a comment, for keeping the connection alive.
+	// Returns false if the client has disconnected.
+	L.SetField(t, "comment", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(write(": " + L.ToString(1) + "\n\n")))
+		return 1 // number of results
+	}))
+
+	// Tell the client how many milliseconds to wait before reconnecting
+	L.SetField(t, "retry", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(write(fmt.Sprintf("retry: %d\n\n", L.ToInt(1)))))
+		return 1 // number of results
+	}))
+
+	// Check if the client has disconnected
+	L.SetField(t, "closed", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(closed()))
+		return 1 // number of results
+	}))
+
+	// Wait for the given number of seconds. Returns false if the client
+	// disconnected while waiting.
+	L.SetField(t, "wait", L.NewFunction(func(L *lua.LState) int {
+		timer := time.NewTimer(time.Duration(float64(L.ToNumber(1)) * float64(time.Second)))
+		defer timer.Stop()
+		select {
+		case <-done:
+			L.Push(lua.LFalse)
+		case <-timer.C:
+			L.Push(lua.LTrue)
+		}
+		return 1 // number of results
+	}))
+
+	// Start the stream right away, so that the client knows it is connected
+	write(": connected\n\n")
+
+	return t
+}
@@ -75,6 +75,7 @@ func (ac *Config) ServeStaticFile(filename, colonPort string) error {
 	mux := http.NewServeMux()
 	// 64 MiB cache, use cache compression, no per-file size limit, use best gzip compression, compress for size not for speed
 	ac.cache = datablock.NewFileCache(defaultStaticCacheSize, true, 0, false, 0)
+	ac.files = newFileCache(defaultStaticCacheSize, 0, ac.cacheTTL)
 	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Server", ac.versionString)
 		ac.FilePage(w, req, filename, ac.defaultLuaDataFilename)
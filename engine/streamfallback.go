@@ -0,0 +1,185 @@
+package engine
+
+// When a Lua handler fails after it has started an event stream or accepted
+// a WebSocket connection, an error page can not be sent. Instead, the stream
+// is ended with an "error" event, and the WebSocket connection is closed with
+// a status code and a reason, so that clients can tell a failure from a
+// normal end. This can be changed for each path with StreamFallback.
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/algernon/lua/websocket"
+	"github.com/xyproto/gopher-lua"
+)
+
+// The event that ends an event stream when the handler fails
+const defaultStreamErrorEvent = "error"
+
+// streamFallback is how the streams for a path, or for paths that start
+// with a prefix, are ended when the handler fails
+type streamFallback struct {
+	pathPattern
+	disabled bool   // just close the connection
+	event    string // the name of the SSE event
+	data     string // the data of the SSE event, or "" for the error message
+	retry    int    // milliseconds before the client reconnects, or 0
+	code     int    // the WebSocket close code
+	reason   string // the WebSocket close reason, or "" for the error message
+}
+
+// newStreamFallback creates a fallback with the default event and close
+// code, for a path like "/events", or for paths that start with a prefix,
+// like "/live/*"
+func newStreamFallback(pattern string) streamFallback {
+	return streamFallback{pathPattern: newPathPattern(pattern), event: defaultStreamErrorEvent, code: websocket.InternalError}
+}
+
+// streamFallbackTable keeps the stream fallbacks for each mux
+type streamFallbackTable struct {
+	ruleTable[streamFallback]
+}
+
+// Get returns the last fallback that was added for the path, or the
+// default fallback
+func (st *streamFallbackTable) Get(mux *http.ServeMux, urlpath string) streamFallback {
+	fallbacks := st.Rules(mux)
+	for i := len(fallbacks) - 1; i >= 0; i-- {
+		if fallbacks[i].match(urlpath) {
+			return fallbacks[i]
+		}
+	}
+	return newStreamFallback(urlpath)
+}
+
+// requestMux returns the mux that serves the request
+func (ac *Config) requestMux(req *http.Request) *http.ServeMux {
+	if vh := requestVirtualHost(req); vh != nil {
+		return vh.mux
+	}
+	return ac.handler.Mux()
+}
+
+// streamErrorMessage returns the message for the client, for an error from
+// a streaming handler. Only errors raised with Error() and errors in debug
+// mode are passed on to the client.
+func (ac *Config) streamErrorMessage(err error) string {
+	if e, ok := httperror.From(err); ok {
+		return e.Message
+	}
+	if ac.debugMode {
+		return err.Error()
+	}
+	return http.StatusText(http.StatusInternalServerError)
+}
+
+// endEventStream ends the event stream that a Lua handler has started, when
+// the handler fails, and logs the error. Returns false if no event stream
+// has been started, so that an error page can be served instead.
+func (ac *Config) endEventStream(mux *http.ServeMux, w http.ResponseWriter, req *http.Request, err error) bool {
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		return false
+	}
+	if e, ok := httperror.From(err); ok {
+		log.Error("Event stream for " + req.URL.Path + " failed: " + e.Error())
+	} else {
+		log.Error("Event stream for " + req.URL.Path + " failed: " + err.Error())
+	}
+	fb := ac.streamFallbacks.Get(mux, req.URL.Path)
+	if fb.disabled || req.Context().Err() != nil {
+		return true
+	}
+	data := fb.data
+	if data == "" {
+		data = ac.streamErrorMessage(err)
+	}
+	if fb.retry > 0 {
+		fmt.Fprintf(w, "retry: %d\n", fb.retry)
+	}
+	fmt.Fprint(w, SSEEvent(fb.event, "", data))
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return true
+}
+
+// closeWebSocket closes the WebSocket connection of a Lua handler that
+// failed, with a close code and a reason
+func (ac *Config) closeWebSocket(mux *http.ServeMux, req *http.Request, conn *websocket.Conn, err error) {
+	fb := ac.streamFallbacks.Get(mux, req.URL.Path)
+	if fb.disabled {
+		conn.Close()
+		return
+	}
+	reason := fb.reason
+	if reason == "" {
+		reason = ac.streamErrorMessage(err)
+	}
+	conn.CloseWithStatus(fb.code, reason)
+}
+
+// validCloseCode checks if a WebSocket close code can be sent by a server
+func validCloseCode(code int) bool {
+	switch code {
+	case 1004, 1005, 1006, 1015:
+		// Reserved, or only for reporting that no close frame was received
+		return false
+	}
+	return (code >= 1000 && code <= 1014) || (code >= 3000 && code <= 4999)
+}
+
+// LoadStreamFallbackFunctions makes the StreamFallback function available
+// to server configuration scripts
+func (ac *Config) LoadStreamFallbackFunctions(L *lua.LState, mux *http.ServeMux) {
+
+	// Change how event streams and WebSocket connections for a path, or for
+	// paths that start with a prefix (like "/live/*"), are ended when the
+	// handler fails. Takes a table with the event, data and retry fields for
+	// event streams, and the code and reason fields for WebSockets, or false
+	// for just closing the connection. For example:
+	// StreamFallback("/events", {event = "fatal", retry = 5000})
+	L.SetGlobal("StreamFallback", L.NewFunction(func(L *lua.LState) int {
+		pattern := L.CheckString(1)
+		if !strings.HasPrefix(pattern, "/") {
+			L.ArgError(1, "a path that starts with / expected")
+			return 0 // number of results
+		}
+		fb := newStreamFallback(pattern)
+		switch v := L.Get(2).(type) {
+		case lua.LBool:
+			fb.disabled = !bool(v)
+		case *lua.LTable:
+			if event := L.GetField(v, "event"); event != lua.LNil {
+				fb.event = strings.TrimSpace(event.String())
+			}
+			if data := L.GetField(v, "data"); data != lua.LNil {
+				fb.data = data.String()
+			}
+			if retry, ok := L.GetField(v, "retry").(lua.LNumber); ok {
+				fb.retry = int(retry)
+			}
+			if code, ok := L.GetField(v, "code").(lua.LNumber); ok {
+				if !validCloseCode(int(code)) {
+					log.Errorf("StreamFallback: %d is not a WebSocket close code that can be sent", int(code))
+					L.Push(lua.LFalse)
+					return 1 // number of results
+				}
+				fb.code = int(code)
+			}
+			if reason := L.GetField(v, "reason"); reason != lua.LNil {
+				fb.reason = reason.String()
+			}
+		default:
+			L.ArgError(2, "a table or false expected")
+			return 0 // number of results
+		}
+		ac.streamFallbacks.Add(mux, fb)
+		L.Push(lua.LTrue)
+		return 1 // number of results
+	}))
+
+}
@@ -0,0 +1,221 @@
+package engine
+
+// Annotation stubs for the Lua language server (LuaLS, or EmmyLua), for
+// completion and type hints in editors. The names come from the functions
+// that are registered, and the parameters, return values and descriptions
+// come from the help texts of the REPL.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// helpLine matches function lines in the help texts, like
+// "RateLimit(string, number[, string]) -> bool // Limit requests", where
+// the return values and the comment are optional
+var helpLine = regexp.MustCompile(`^([A-Za-z_]\w*(?:[.:][A-Za-z_]\w*)?)\((.*?)\)\s*(?:->\s*([^/]*?))?\s*(?://\s*(.*))?$`)
+
+// stubParam is a parameter of a Lua function
+type stubParam struct {
+	luaType  string
+	optional bool
+	vararg   bool
+}
+
+// stubFunction is a Lua function, as described by the help texts
+type stubFunction struct {
+	name    string
+	doc     []string
+	params  []stubParam
+	returns []string
+}
+
+// luaTypeName converts a type from the help texts, like "bool" or
+// "string|function", to a LuaLS type
+func luaTypeName(s string) string {
+	var types []string
+	for _, t := range strings.Split(strings.TrimSpace(s), "|") {
+		switch t = strings.TrimSpace(t); t {
+		case "bool":
+			t = "boolean"
+		case "value", "":
+			t = "any"
+		case "filename":
+			t = "string"
+		}
+		types = append(types, t)
+	}
+	return strings.Join(types, "|")
+}
+
+// parseParams parses parameters like "string, number[, string[, bool]]"
+// or "[string, ]string", where the ones in brackets are optional
+func parseParams(s string) []stubParam {
+	var (
+		params []stubParam
+		depth  int
+	)
+	for _, field := range strings.Split(s, ",") {
+		var (
+			name     strings.Builder
+			optional bool
+		)
+		for _, r := range field {
+			switch r {
+			case '[':
+				depth++
+			case ']':
+				depth--
+			case ' ':
+			default:
+				if name.Len() == 0 {
+					optional = depth > 0
+				}
+				name.WriteRune(r)
+			}
+		}
+		switch name.String() {
+		case "":
+		case "...":
+			params = append(params, stubParam{luaType: "any", vararg: true})
+		default:
+			params = append(params, stubParam{luaType: luaTypeName(name.String()), optional: optional})
+		}
+	}
+	return params
+}
+
+// parseHelpText finds the functions in a help text, with the comments
+// above or after them. Comments above a function are also for the functions
+// right below it.
+func parseHelpText(helpText string) map[string]stubFunction {
+	functions := make(map[string]stubFunction)
+	var (
+		comment      []string
+		lastFunction bool
+	)
+	scanner := bufio.NewScanner(strings.NewReader(helpText))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "//") {
+			if lastFunction {
+				comment = nil
+			}
+			comment = append(comment, strings.TrimSpace(line[2:]))
+			lastFunction = false
+			continue
+		}
+		m := helpLine.FindStringSubmatch(line)
+		if m == nil {
+			comment = nil
+			lastFunction = false
+			continue
+		}
+		f := stubFunction{name: m[1], doc: comment, params: parseParams(m[2])}
+		if m[4] != "" {
+			f.doc = append(f.doc, m[4])
+		}
+		for _, r := range strings.Split(m[3], ",") {
+			if r = strings.TrimSpace(r); r != "" {
+				f.returns = append(f.returns, r)
+			}
+		}
+		if _, found := functions[f.name]; !found {
+			functions[f.name] = f
+		}
+		// Functions on the lines below share the comment, if they have none
+		lastFunction = true
+	}
+	return functions
+}
+
+// writeStub writes the annotations and the declaration of a function
+func writeStub(w io.Writer, f stubFunction) {
+	for _, line := range f.doc {
+		fmt.Fprintln(w, "---"+line)
+	}
+	var names []string
+	for i, p := range f.params {
+		if p.vararg {
+			fmt.Fprintln(w, "---@param ... "+p.luaType)
+			names = append(names, "...")
+			continue
+		}
+		name := fmt.Sprintf("arg%d", i+1)
+		if p.optional {
+			fmt.Fprintf(w, "---@param %s? %s\n", name, p.luaType)
+		} else {
+			fmt.Fprintf(w, "---@param %s %s\n", name, p.luaType)
+		}
+		names = append(names, name)
+	}
+	for _, r := range f.returns {
+		if r == "..." {
+			fmt.Fprintln(w, "---@return any ...")
+		} else {
+			fmt.Fprintln(w, "---@return "+luaTypeName(r))
+		}
+	}
+	fmt.Fprintf(w, "function %s(%s) end\n\n", f.name, strings.Join(names, ", "))
+}
+
+// EmitStubs writes LuaLS annotation stubs for the functions that are
+// available to server configuration scripts and to Lua handlers. Functions
+// without help text are declared as taking and returning any values.
+func (ac *Config) EmitStubs(w io.Writer) error {
+	configNames, handlerNames := ac.exportedLuaNames()
+	names := make(map[string]lua.LValueType, len(configNames)+len(handlerNames))
+	for _, exported := range []map[string]lua.LValueType{configNames, handlerNames} {
+		for name, t := range exported {
+			names[name] = t
+		}
+	}
+	help := parseHelpText(generalHelpText + webHelpText + configHelpText)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "---@meta")
+	fmt.Fprintf(bw, "-- The Lua API of %s, from algernon --emit-stubs\n\n", ac.versionString)
+	for _, name := range sortedNames(names) {
+		switch names[name] {
+		case lua.LTTable:
+			fmt.Fprintf(bw, "%s = {}\n\n", name)
+		case lua.LTFunction:
+			f, ok := help[name]
+			if !ok {
+				f = stubFunction{name: name, params: []stubParam{{luaType: "any", vararg: true}}, returns: []string{"..."}}
+			}
+			writeStub(bw, f)
+		default:
+			fmt.Fprintf(bw, "---@type %s\n%s = nil\n\n", names[name], name)
+		}
+	}
+
+	// Methods, like "set:add", are declared for classes like "algernon.set"
+	methods := make(map[string][]stubFunction)
+	for name, f := range help {
+		if fields := strings.SplitN(name, ":", 2); len(fields) == 2 {
+			methods[fields[0]] = append(methods[fields[0]], f)
+		}
+	}
+	receivers := make([]string, 0, len(methods))
+	for receiver := range methods {
+		receivers = append(receivers, receiver)
+	}
+	sort.Strings(receivers)
+	for _, receiver := range receivers {
+		fmt.Fprintf(bw, "---@class algernon.%s\nlocal %s = {}\n\n", receiver, receiver)
+		sort.Slice(methods[receiver], func(i, j int) bool {
+			return methods[receiver][i].name < methods[receiver][j].name
+		})
+		for _, f := range methods[receiver] {
+			writeStub(bw, f)
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,53 @@
+package engine
+
+// Logging to syslog or to the systemd journal, for daemonized deployments
+
+import (
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/sysloghook"
+)
+
+// setupSyslog sends the log to syslog or to the systemd journal, if one of
+// them has been given with a flag. The log is no longer written to stderr,
+// but a log file given with --log is still written to.
+func (ac *Config) setupSyslog() {
+	if ac.syslogAddress == "" && !ac.journald {
+		return
+	}
+	facility, err := sysloghook.ParseFacility(ac.logFacility)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	level, err := log.ParseLevel(ac.logLevel)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	var hook *sysloghook.Hook
+	if ac.journald {
+		hook, err = sysloghook.NewJournal(facility, sysloghook.Tag(), level)
+	} else {
+		address := ac.syslogAddress
+		if address == "local" {
+			address = ""
+		}
+		hook, err = sysloghook.NewSyslog(address, facility, sysloghook.Tag(), level)
+	}
+	if err != nil {
+		log.Errorf("Could not log to syslog or the journal: %s", err)
+		return
+	}
+	log.AddHook(hook)
+	if level > log.GetLevel() {
+		log.SetLevel(level)
+	}
+	if ac.serverLogFile == "" {
+		log.SetOutput(ioutil.Discard)
+	}
+	AtShutdown(func() {
+		hook.Close()
+	})
+}
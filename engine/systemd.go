@@ -0,0 +1,126 @@
+package engine
+
+// Socket activation and readiness and watchdog notifications, for running
+// as a systemd service
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The first file descriptor that is passed on by systemd
+const sdListenFDsStart = 3
+
+// activatedListeners returns the listening sockets that are passed on by
+// systemd with socket activation, by name. Sockets without names are named
+// after the address they listen on.
+func activatedListeners() map[string]net.Listener {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// The sockets are not to be passed on to processes that are started later
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	listeners := make(map[string]net.Listener)
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(sdListenFDsStart+i), "LISTEN_FD_"+strconv.Itoa(sdListenFDsStart+i))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Errorf("Could not use socket %d from systemd: %s", sdListenFDsStart+i, err)
+			continue
+		}
+		name := l.Addr().String()
+		if i < len(names) && names[i] != "" && names[i] != "unknown" {
+			name = names[i]
+		}
+		listeners[name] = l
+	}
+	return listeners
+}
+
+// samePort checks if two addresses have the same port, like ":3000" and
+// "[::]:3000"
+func samePort(a, b string) bool {
+	_, portA, errA := net.SplitHostPort(a)
+	_, portB, errB := net.SplitHostPort(b)
+	return errA == nil && errB == nil && portA == portB
+}
+
+// sdNotify sends a notification to systemd, like "READY=1", if running as a
+// service with Type=notify. Returns false if not.
+func sdNotify(state string) bool {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false
+	}
+	// Abstract sockets start with @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Error("Could not notify systemd: ", err)
+		return false
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Error("Could not notify systemd: ", err)
+		return false
+	}
+	return true
+}
+
+// watchdogInterval returns how often systemd expects a watchdog
+// notification, or 0 if the watchdog is not enabled
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifyReady tells systemd that the server is serving, and starts sending
+// watchdog notifications, if the watchdog is enabled. The notifications are
+// only sent while Lua handlers can be run, so that systemd restarts the
+// server if it hangs.
+func (ac *Config) notifyReady() {
+	if !sdNotify("READY=1\nSTATUS=Serving") {
+		return
+	}
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	go func() {
+		// Notify twice as often as required
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			if ac.ShuttingDown() {
+				return
+			}
+			if err := ac.checkLua(); err != nil {
+				log.Error("Not notifying the systemd watchdog: ", err)
+				continue
+			}
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
@@ -0,0 +1,163 @@
+package engine
+
+// TLS configuration profiles, with --tlsprofile, following the "modern",
+// "intermediate" and "old" configurations from Mozilla
+// (https://wiki.mozilla.org/Security/Server_Side_TLS)
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The profile that is used if --tlsprofile is not given
+const defaultTLSProfile = "intermediate"
+
+var (
+	errTLSVersion = errors.New("the TLS version must be 1.0, 1.1, 1.2 or 1.3")
+	errTLSProfile = errors.New("the TLS profile must be modern, intermediate or old")
+)
+
+// tlsProfile is the lowest TLS version and the cipher suites to use. The
+// cipher suites are only for TLS 1.2 and lower, since the ones for TLS 1.3
+// can not be configured. Nil means the defaults from Go.
+type tlsProfile struct {
+	minVersion   uint16
+	cipherSuites []uint16
+}
+
+// The cipher suites for TLS 1.2, with forward secrecy and authenticated
+// encryption
+var intermediateCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+var tlsProfiles = map[string]tlsProfile{
+	// For clients that support TLS 1.3
+	"modern": {minVersion: tls.VersionTLS13},
+
+	// For almost all clients, and the recommended profile
+	"intermediate": {minVersion: tls.VersionTLS12, cipherSuites: intermediateCipherSuites},
+
+	// For very old clients, like Internet Explorer 8 on Windows XP
+	"old": {minVersion: tls.VersionTLS10, cipherSuites: append(intermediateCipherSuites[:len(intermediateCipherSuites):len(intermediateCipherSuites)],
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	)},
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseCipherSuites parses comma separated cipher suite names, like
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+func parseCipherSuites(names string) ([]uint16, error) {
+	ids := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		ids[suite.Name] = suite.ID
+	}
+	var suites []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		id, ok := ids[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %s", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// loadTLSProfile selects the profile given with --tlsprofile, and changes
+// it with --tlsmin and --ciphers, if given
+func (ac *Config) loadTLSProfile() error {
+	name := strings.ToLower(ac.tlsProfileName)
+	if name == "" {
+		name = defaultTLSProfile
+	}
+	profile, ok := tlsProfiles[name]
+	if !ok {
+		return errTLSProfile
+	}
+	if ac.tlsMinVersion != "" {
+		if profile.minVersion, ok = tlsVersions[ac.tlsMinVersion]; !ok {
+			return errTLSVersion
+		}
+	}
+	if ac.tlsCiphers != "" {
+		suites, err := parseCipherSuites(ac.tlsCiphers)
+		if err != nil {
+			return err
+		}
+		profile.cipherSuites = suites
+	}
+	ac.tlsProfileName = name
+	ac.tls = &profile
+	return nil
+}
+
+// weaknesses returns what is weak about the profile, if anything
+func (p *tlsProfile) weaknesses() []string {
+	var weak []string
+	if p.minVersion < tls.VersionTLS12 {
+		for name, version := range tlsVersions {
+			if version == p.minVersion {
+				weak = append(weak, "TLS "+name)
+			}
+		}
+	}
+	insecure := make(map[uint16]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.ID] = true
+	}
+	for _, id := range p.cipherSuites {
+		name := tls.CipherSuiteName(id)
+		if insecure[id] || strings.HasPrefix(name, "TLS_RSA_") || strings.Contains(name, "_CBC_") {
+			weak = append(weak, name)
+		}
+	}
+	sort.Strings(weak)
+	return weak
+}
+
+// applyTLSProfile sets the lowest TLS version and the cipher suites of the
+// given TLS configuration. A warning is logged the first time, if the
+// settings are weak.
+func (ac *Config) applyTLSProfile(config *tls.Config) {
+	if ac.tls == nil {
+		return
+	}
+	config.MinVersion = ac.tls.minVersion
+	config.CipherSuites = ac.tls.cipherSuites
+	ac.tlsWarning.Do(func() {
+		if weak := ac.tls.weaknesses(); len(weak) > 0 {
+			log.Warnf("The TLS settings allow weak protocols or cipher suites, which should only be used for very old clients: %s", strings.Join(weak, ", "))
+		}
+	})
+}
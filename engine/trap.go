@@ -0,0 +1,264 @@
+package engine
+
+// Trap routes, like "/wp-admin/*", that only scanners request. The IP
+// addresses that request them are banned for a while. The bans are stored in
+// the database backend, if there is one, so that they are shared between
+// servers that use the same database.
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/pinterface"
+)
+
+const (
+	// The key/value where bans are stored
+	banKeyValue = "bans"
+
+	// How long IP addresses are banned, by default
+	defaultBanPeriod = 24 * time.Hour
+
+	// How long a ban, or the lack of one, that was read from the database
+	// backend is used before the database is asked again
+	banCacheTTL = 5 * time.Second
+
+	// How many IP addresses to cache the bans for, before the cache is cleared
+	maxBanCache = 10000
+)
+
+// trapRule bans the IP addresses that request the path, or paths that start
+// with the prefix, for a period
+type trapRule struct {
+	pathPattern
+	period time.Duration
+}
+
+// newTrapRule creates a trap for a path like "/wp-login.php", or for paths
+// that start with a prefix, like "/wp-admin/*"
+func newTrapRule(pattern string, period time.Duration) trapRule {
+	return trapRule{newPathPattern(pattern), period}
+}
+
+// banCacheEntry is a ban that was read from the database backend, or the
+// lack of one
+type banCacheEntry struct {
+	banned  bool
+	expires time.Time
+}
+
+// trapTable keeps the traps for each mux, and the bans
+type trapTable struct {
+	ruleTable[trapRule]
+	mut sync.RWMutex
+
+	// The bans, when there is no database backend
+	bans map[string]time.Time
+
+	// The bans that were read from the database backend, so that the
+	// database is not asked for every request
+	cache map[string]banCacheEntry
+
+	once sync.Once
+	kv   pinterface.IKeyValue
+}
+
+// Get returns the trap for the path, if any
+func (tt *trapTable) Get(mux *http.ServeMux, urlpath string) (trapRule, bool) {
+	for _, rule := range tt.Rules(mux) {
+		if rule.match(urlpath) {
+			return rule, true
+		}
+	}
+	return trapRule{}, false
+}
+
+// Enabled checks if there are any traps, or any bans
+func (tt *trapTable) Enabled() bool {
+	if !tt.ruleTable.Empty() {
+		return true
+	}
+	tt.mut.RLock()
+	defer tt.mut.RUnlock()
+	return len(tt.bans) > 0
+}
+
+// cached returns the cached ban for the IP address, if it has not expired
+func (tt *trapTable) cached(ip string, now time.Time) (bool, bool) {
+	tt.mut.RLock()
+	defer tt.mut.RUnlock()
+	entry, ok := tt.cache[ip]
+	if !ok || now.After(entry.expires) {
+		return false, false
+	}
+	return entry.banned, true
+}
+
+// setCached stores the ban, or the lack of one, for the IP address
+func (tt *trapTable) setCached(ip string, banned bool, now time.Time) {
+	tt.mut.Lock()
+	defer tt.mut.Unlock()
+	if tt.cache == nil || len(tt.cache) >= maxBanCache {
+		tt.cache = make(map[string]banCacheEntry)
+	}
+	tt.cache[ip] = banCacheEntry{banned, now.Add(banCacheTTL)}
+}
+
+// expiringKeyValue is a key/value that can store values that expire, like
+// the one for Redis
+type expiringKeyValue interface {
+	SetExpire(key, value string, expire time.Duration) error
+}
+
+// banStore returns the key/value where the bans are stored, or nil if there
+// is no database backend
+func (ac *Config) banStore() pinterface.IKeyValue {
+	ac.traps.once.Do(func() {
+		if ac.perm == nil {
+			return
+		}
+		kv, err := ac.perm.UserState().Creator().NewKeyValue(banKeyValue)
+		if err != nil {
+			log.Error("Could not store bans in the database: ", err)
+			return
+		}
+		ac.traps.kv = kv
+	})
+	return ac.traps.kv
+}
+
+// Ban bans the IP address for the given period
+func (ac *Config) Ban(ip string, period time.Duration) error {
+	until := time.Now().Add(period)
+	if kv := ac.banStore(); kv != nil {
+		ac.traps.setCached(ip, true, time.Now())
+		value := strconv.FormatInt(until.Unix(), 10)
+		if expiring, ok := kv.(expiringKeyValue); ok {
+			return expiring.SetExpire(ip, value, period)
+		}
+		return kv.Set(ip, value)
+	}
+	ac.traps.mut.Lock()
+	defer ac.traps.mut.Unlock()
+	if ac.traps.bans == nil {
+		ac.traps.bans = make(map[string]time.Time)
+	}
+	ac.traps.bans[ip] = until
+	return nil
+}
+
+// Unban lifts the ban for the IP address, if there is one
+func (ac *Config) Unban(ip string) error {
+	if kv := ac.banStore(); kv != nil {
+		ac.traps.setCached(ip, false, time.Now())
+		return kv.Del(ip)
+	}
+	ac.traps.mut.Lock()
+	defer ac.traps.mut.Unlock()
+	delete(ac.traps.bans, ip)
+	return nil
+}
+
+// Banned checks if the IP address is banned. Bans that have expired are
+// removed. Bans from the database backend are cached for a few seconds, so
+// bans from other servers may take that long to have an effect.
+func (ac *Config) Banned(ip string) bool {
+	now := time.Now()
+	if kv := ac.banStore(); kv != nil {
+		if banned, ok := ac.traps.cached(ip, now); ok {
+			return banned
+		}
+		banned := false
+		if value, err := kv.Get(ip); err == nil && value != "" {
+			until, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || now.Unix() >= until {
+				kv.Del(ip)
+			} else {
+				banned = true
+			}
+		}
+		ac.traps.setCached(ip, banned, now)
+		return banned
+	}
+	ac.traps.mut.Lock()
+	defer ac.traps.mut.Unlock()
+	until, ok := ac.traps.bans[ip]
+	if ok && !now.Before(until) {
+		delete(ac.traps.bans, ip)
+		return false
+	}
+	return ok
+}
+
+// trapped responds with "403 Forbidden" if the IP address is banned, or if
+// the path is a trap, in which case the IP address is also banned. Clients
+// with an unknown address, like over the Unix socket without a trusted
+// proxy, are never banned. Returns true if the request has been rejected.
+func (ac *Config) trapped(mux *http.ServeMux, w http.ResponseWriter, req *http.Request) bool {
+	if !ac.traps.Enabled() {
+		return false
+	}
+	ip := ac.clientIP(req)
+	if ip == "" {
+		return false
+	}
+	if !ac.Banned(ip) {
+		rule, ok := ac.traps.Get(mux, req.URL.Path)
+		if !ok {
+			return false
+		}
+		if err := ac.Ban(ip, rule.period); err != nil {
+			log.Error("Could not ban "+ip+": ", err)
+		} else {
+			log.Warnf("Banned %s for %s, for requesting %s", ip, rule.period, req.URL.Path)
+		}
+	}
+	size := ac.ErrorPage(w, req, httperror.New(http.StatusForbidden, "Access from this address is not allowed."))
+	ac.LogAccess(req, http.StatusForbidden, size)
+	return true
+}
+
+// LoadTrapFunctions makes the Trap and Unban functions available to server
+// configuration scripts
+func (ac *Config) LoadTrapFunctions(L *lua.LState, mux *http.ServeMux) {
+
+	// Ban the IP addresses that request a path, or paths that start with a
+	// prefix, like "/wp-admin/*". Takes a path and an optional period like
+	// "1h" or a number of seconds (24 hours by default). Returns true if
+	// successful.
+	L.SetGlobal("Trap", L.NewFunction(func(L *lua.LState) int {
+		pattern := L.CheckString(1)
+		period := defaultBanPeriod
+		switch p := L.Get(2).(type) {
+		case lua.LNumber:
+			period = time.Duration(float64(p) * float64(time.Second))
+		case lua.LString:
+			d, err := time.ParseDuration(string(p))
+			if err != nil {
+				L.ArgError(2, err.Error())
+				return 0 // number of results
+			}
+			period = d
+		}
+		if !strings.HasPrefix(pattern, "/") || period <= 0 {
+			L.ArgError(1, "a path that starts with / and a period above 0 expected")
+			return 0 // number of results
+		}
+		ac.traps.Add(mux, newTrapRule(pattern, period))
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Lift the ban for an IP address. Takes an IP address. Returns true if
+	// successful.
+	L.SetGlobal("Unban", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(ac.Unban(L.CheckString(1)) == nil))
+		return 1 // number of results
+	}))
+}
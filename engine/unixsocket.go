@@ -0,0 +1,86 @@
+package engine
+
+// Serving HTTP on a Unix domain socket with --unixsocket, for when running
+// behind a reverse proxy like nginx or HAProxy on the same host
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tylerb/graceful"
+)
+
+// The permissions of the Unix socket, if --unixsocketmode is not given.
+// The reverse proxy is usually in the same group as the server.
+const defaultUnixSocketMode = "0660"
+
+var errUnixSocketMode = errors.New("the mode of the Unix socket must be an octal number, like 0660")
+
+// unixSocketOwner looks up the user and group IDs for "USER[:GROUP]". An
+// ID of -1 means that it is not changed.
+func unixSocketOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+	fields := strings.SplitN(owner, ":", 2)
+	if fields[0] != "" {
+		u, err := user.Lookup(fields[0])
+		if err != nil {
+			return uid, gid, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return uid, gid, err
+		}
+	}
+	if len(fields) == 2 && fields[1] != "" {
+		g, err := user.LookupGroup(fields[1])
+		if err != nil {
+			return uid, gid, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return uid, gid, err
+		}
+	}
+	return uid, gid, nil
+}
+
+// listenAndServeUnix serves HTTP with the given server, on the Unix socket
+// given with --unixsocket. The mode and owner of the socket are set, if
+// given, and the socket is removed when shutting down.
+func (ac *Config) listenAndServeUnix(srv *graceful.Server) error {
+	mode, err := strconv.ParseUint(ac.unixSocketMode, 8, 32)
+	if err != nil {
+		return errUnixSocketMode
+	}
+	l, err := ac.listeners.Listen("unix", ac.unixSocket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(ac.unixSocket, os.FileMode(mode)); err != nil {
+		l.Close()
+		return err
+	}
+	if ac.unixSocketOwner != "" {
+		uid, gid, err := unixSocketOwner(ac.unixSocketOwner)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		if err := os.Chown(ac.unixSocket, uid, gid); err != nil {
+			l.Close()
+			return err
+		}
+	}
+	AtShutdown(func() {
+		// The socket is in use by the new process, if restarted
+		if !ac.listeners.HandedOver() {
+			os.Remove(ac.unixSocket)
+		}
+	})
+	log.Info("Serving HTTP on unix:" + ac.unixSocket)
+	ac.servers.Add(1)
+	defer ac.servers.Done()
+	return srv.Serve(l)
+}
@@ -0,0 +1,275 @@
+package engine
+
+// Updating the executable with --update, from a release endpoint, with
+// signature verification and a rollback if the new executable is not healthy.
+// The release endpoint serves a manifest with the version and the SHA-256
+// hash of the executable for each platform, and the signature of the
+// manifest is served from the same URL with .sig added to the path.
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xyproto/algernon/bundle"
+)
+
+const (
+	// How long downloading the release information and the executable can take
+	updateTimeout = 5 * time.Minute
+
+	// How long the new executable can take to respond to the health check
+	updateHealthTimeout = 15 * time.Second
+)
+
+var (
+	errNoUpdateURL    = errors.New("no release endpoint is given, use --updateurl or ALGERNON_UPDATE_URL")
+	errNoUpdateKey    = errors.New("no public key for verifying the release is given, use --updatekey")
+	errNoRelease      = errors.New("there is no release for this platform")
+	errUnhealthy      = errors.New("the new executable did not pass the health check")
+	errDownloadStatus = errors.New("the release endpoint did not respond with 200 OK")
+	errChecksum       = errors.New("the executable does not match the SHA-256 hash in the release manifest")
+)
+
+// releaseFile is an executable for one platform
+type releaseFile struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"` // hex encoded
+}
+
+// release is the signed manifest from the release endpoint, with the
+// executables by platform, like "linux/amd64"
+type release struct {
+	Version string                 `json:"version"`
+	Files   map[string]releaseFile `json:"files"`
+}
+
+// versionNumber returns the version number from a version string, like
+// "1.12.4" from "Algernon 1.12.4"
+func versionNumber(versionString string) string {
+	fields := strings.Fields(versionString)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(fields[len(fields)-1], "v")
+}
+
+// newerVersion checks if version a is newer than version b, like "1.13.0"
+// compared to "1.12.4"
+func newerVersion(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+// download fetches the given URL
+func download(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errDownloadStatus
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// signatureURL returns the URL of the signature of the release manifest,
+// which is the URL of the manifest with .sig added to the path
+func signatureURL(manifestURL string) (string, error) {
+	u, err := url.Parse(manifestURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path += ".sig"
+	return u.String(), nil
+}
+
+// fetchRelease downloads the release manifest and its signature, and returns
+// the release if the manifest is signed with one of the trusted keys
+func fetchRelease(client *http.Client, manifestURL string, trusted []ed25519.PublicKey) (*release, error) {
+	data, err := download(client, manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	sigURL, err := signatureURL(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := download(client, sigURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := bundle.VerifyData(data, string(signature), trusted); err != nil {
+		return nil, err
+	}
+	var r release
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// checkSHA256 checks that the data has the given hex encoded SHA-256 hash
+func checkSHA256(data []byte, expected string) error {
+	sum := sha256.Sum256(data)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), strings.TrimSpace(expected)) {
+		return errChecksum
+	}
+	return nil
+}
+
+// checkExecutable starts the given executable as a server on a free localhost
+// port, and checks that its health endpoint responds with 200 OK
+func checkExecutable(executable string) error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	addr := l.Addr().String()
+	l.Close()
+	dir, err := ioutil.TempDir("", "algernon-update")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	cmd := exec.Command(executable, "--server", "--httponly", "--nodb", "--quiet", "--health", dir, addr)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	client := &http.Client{Timeout: time.Second}
+	deadline := time.Now().Add(updateHealthTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(200 * time.Millisecond)
+		resp, err := client.Get("http://" + addr + defaultHealthPath)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+	}
+	return errUnhealthy
+}
+
+// Update replaces the running executable with the latest release from the
+// release endpoint, if it is newer. The release manifest must be signed with
+// one of the keys given with --updatekey, and the executable must match the
+// hash in the manifest. The previous executable is kept as a .old file, and
+// is put back if the new one does not pass a health check.
+func (ac *Config) Update() error {
+	if ac.updateURL == "" {
+		return errNoUpdateURL
+	}
+	if ac.updateKeyFilename == "" {
+		return errNoUpdateKey
+	}
+	trusted, err := bundle.LoadPublicKeys(ac.updateKeyFilename)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: updateTimeout}
+	r, err := fetchRelease(client, ac.updateURL, trusted)
+	if err != nil {
+		return err
+	}
+	current := versionNumber(ac.versionString)
+	if !newerVersion(r.Version, current) {
+		fmt.Printf("Already up to date (%s)\n", current)
+		return nil
+	}
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	file, ok := r.Files[platform]
+	if !ok {
+		return errNoRelease
+	}
+	fmt.Printf("Downloading %s for %s\n", r.Version, platform)
+	binary, err := download(client, file.URL)
+	if err != nil {
+		return err
+	}
+	if err := checkSHA256(binary, file.SHA256); err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return err
+	}
+	info, err := os.Stat(executable)
+	if err != nil {
+		return err
+	}
+
+	// Write the new executable next to the current one, so that it can be
+	// renamed over it
+	tmp, err := ioutil.TempFile(filepath.Dir(executable), ".algernon-update-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()|0111); err != nil {
+		return err
+	}
+	// Keep the current executable as a hard link, so that there is always
+	// an executable in place while it is being replaced
+	backup := executable + ".old"
+	os.Remove(backup)
+	if err := os.Link(executable, backup); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), executable); err != nil {
+		return err
+	}
+	if err := checkExecutable(executable); err != nil {
+		// Roll back
+		if rollbackErr := os.Rename(backup, executable); rollbackErr != nil {
+			return fmt.Errorf("%s, and could not put back %s: %s", err, backup, rollbackErr)
+		}
+		return fmt.Errorf("%s, kept %s", err, current)
+	}
+	fmt.Printf("Updated from %s to %s. The previous executable is %s.\n", current, r.Version, backup)
+	fmt.Println("Send SIGUSR2 to a running server to restart it with the new executable.")
+	return nil
+}
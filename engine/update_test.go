@@ -0,0 +1,68 @@
+package engine
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xyproto/algernon/bundle"
+)
+
+func TestFetchRelease(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := []ed25519.PublicKey{public}
+	binary := []byte("\x7fELF algernon 1.13.0")
+	sum := sha256.Sum256(binary)
+	manifest := `{"version": "1.13.0", "files": {"linux/amd64": {"url": "/algernon", "sha256": "` + hex.EncodeToString(sum[:]) + `"}}}`
+	files := map[string]string{
+		"/latest.json":     manifest,
+		"/latest.json.sig": bundle.SignData(private, []byte(manifest)),
+		"/altered.json":    `{"version": "1.14.0", "files": {}}`,
+	}
+	files["/altered.json.sig"] = files["/latest.json.sig"]
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, ok := files[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte(data))
+	}))
+	defer server.Close()
+
+	r, err := fetchRelease(server.Client(), server.URL+"/latest.json?channel=stable", trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Version != "1.13.0" {
+		t.Errorf("unexpected version: %s", r.Version)
+	}
+	if err := checkSHA256(binary, r.Files["linux/amd64"].SHA256); err != nil {
+		t.Error(err)
+	}
+	if err := checkSHA256([]byte("\x7fELF algernon 1.12.0"), r.Files["linux/amd64"].SHA256); err != errChecksum {
+		t.Errorf("expected another executable to be refused, got %v", err)
+	}
+	if err := checkSHA256(binary, ""); err != errChecksum {
+		t.Errorf("expected a missing hash to be refused, got %v", err)
+	}
+
+	// A manifest that is not signed with a trusted key is refused
+	if _, err := fetchRelease(server.Client(), server.URL+"/altered.json", trusted); err != bundle.ErrBadSignature {
+		t.Errorf("expected an altered manifest to be refused, got %v", err)
+	}
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetchRelease(server.Client(), server.URL+"/latest.json", []ed25519.PublicKey{other}); err != bundle.ErrBadSignature {
+		t.Errorf("expected a manifest signed with another key to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package engine
+
+// Scanning uploaded files for viruses, with a ClamAV daemon or a Lua
+// function, before they can be saved or stored
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/clamd"
+	"github.com/xyproto/gopher-lua"
+)
+
+var errScanFailed = errors.New("the uploaded file could not be scanned")
+
+// uploadScanner keeps the function that uploaded files are checked with,
+// and the directory where rejected files are kept, if any
+type uploadScanner struct {
+	mut        sync.RWMutex
+	scan       func(filename string, data []byte) (string, error)
+	quarantine string
+}
+
+// Set starts checking uploaded files with the given function, which returns
+// the reason for rejecting a file, or an empty string. Rejected files are
+// kept in the quarantine directory, if it is not empty.
+func (us *uploadScanner) Set(scan func(filename string, data []byte) (string, error), quarantine string) {
+	us.mut.Lock()
+	defer us.mut.Unlock()
+	us.scan = scan
+	us.quarantine = quarantine
+}
+
+// Get returns the scan function and the quarantine directory
+func (us *uploadScanner) Get() (func(filename string, data []byte) (string, error), string) {
+	us.mut.RLock()
+	defer us.mut.RUnlock()
+	return us.scan, us.quarantine
+}
+
+// ScanUpload checks an uploaded file, if ScanUploads has been used in the
+// server configuration. Returns an error if the file is rejected. Files
+// are also rejected if they could not be scanned.
+func (ac *Config) ScanUpload(filename string, data []byte) error {
+	scan, quarantine := ac.uploadScan.Get()
+	if scan == nil {
+		return nil
+	}
+	reason, err := scan(filename, data)
+	if err != nil {
+		log.Error("Could not scan ", filename, ": ", err)
+		return errScanFailed
+	}
+	if reason == "" {
+		return nil
+	}
+	log.Warn("Rejected the uploaded file ", filename, ": ", reason)
+	if quarantine != "" {
+		sum := sha256.Sum256(data)
+		quarantineFilename := filepath.Join(quarantine, hex.EncodeToString(sum[:])+"-"+filepath.Base(filename))
+		if err := os.MkdirAll(quarantine, 0700); err != nil {
+			log.Error(err)
+		} else if err := ioutil.WriteFile(quarantineFilename, data, 0600); err != nil {
+			log.Error(err)
+		}
+	}
+	return fmt.Errorf("the uploaded file was rejected: %s", reason)
+}
+
+// LoadUploadScanFunctions makes the ScanUploads function available to
+// server configuration scripts
+func (ac *Config) LoadUploadScanFunctions(L *lua.LState) {
+
+	scanmutex := &sync.Mutex{}
+
+	// Check uploaded files before they can be saved or stored. Takes the
+	// address of a ClamAV daemon, like "unix:/run/clamav/clamd.ctl" or
+	// "tcp:localhost:3310", or a function that is given the filename and
+	// the data and returns a reason for rejecting the file, or nil. Takes an
+	// optional directory where rejected files are kept. Returns true if
+	// successful.
+	L.SetGlobal("ScanUploads", L.NewFunction(func(L *lua.LState) int {
+		quarantine := L.OptString(2, "")
+		switch check := L.Get(1).(type) {
+		case lua.LString:
+			client := clamd.New(string(check))
+			ac.uploadScan.Set(func(_ string, data []byte) (string, error) {
+				return client.Scan(data)
+			}, quarantine)
+		case *lua.LFunction:
+			ac.uploadScan.Set(func(filename string, data []byte) (string, error) {
+				// Each call gets its own Lua thread
+				scanmutex.Lock()
+				co, cancel := L.NewThread()
+				scanmutex.Unlock()
+				if cancel != nil {
+					defer cancel()
+				}
+				co.Push(check)
+				co.Push(lua.LString(filename))
+				co.Push(lua.LString(data))
+				if err := co.PCall(2, 1, nil); err != nil {
+					return "", err
+				}
+				result := co.Get(-1)
+				co.Pop(1)
+				if result == lua.LNil || result == lua.LFalse {
+					return "", nil
+				}
+				return result.String(), nil
+			}, quarantine)
+		default:
+			L.ArgError(1, "the address of a ClamAV daemon or a function expected")
+			return 0 // number of results
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+}
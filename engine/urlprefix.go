@@ -0,0 +1,100 @@
+package engine
+
+// Serving everything under a base path, like /myapp, for when Algernon is
+// behind a reverse proxy that passes on a sub-path
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/xyproto/algernon/lua/httperror"
+)
+
+// cleanURLPrefix makes sure the URL prefix starts with a slash and does not
+// end with one. "/" and "" give an empty prefix.
+func cleanURLPrefix(prefix string) string {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// PrefixURL adds the URL prefix to an absolute URL path, like "/style.css".
+// Relative paths, full URLs and paths that already have the prefix are returned as they are.
+func (ac *Config) PrefixURL(urlPath string) string {
+	if ac.urlPrefix == "" || !strings.HasPrefix(urlPath, "/") || strings.HasPrefix(urlPath, "//") {
+		return urlPath
+	}
+	if urlPath == ac.urlPrefix || strings.HasPrefix(urlPath, ac.urlPrefix+"/") {
+		return urlPath
+	}
+	return ac.urlPrefix + urlPath
+}
+
+// stripURLPrefix returns a copy of the request without the URL prefix in the
+// path, and false if the path does not start with the URL prefix
+func (ac *Config) stripURLPrefix(req *http.Request) (*http.Request, bool) {
+	p := strings.TrimPrefix(req.URL.Path, ac.urlPrefix)
+	if len(p) == len(req.URL.Path) || !strings.HasPrefix(p, "/") {
+		return req, false
+	}
+	stripped := new(http.Request)
+	*stripped = *req
+	stripped.URL = new(url.URL)
+	*stripped.URL = *req.URL
+	stripped.URL.Path = p
+	stripped.URL.RawPath = strings.TrimPrefix(req.URL.RawPath, ac.urlPrefix)
+	return stripped, true
+}
+
+// serveURLPrefix serves a request under the URL prefix with the given
+// handler. Requests for other paths get a "404 Not Found" page, except for
+// the prefix itself, which is redirected to the prefix with a trailing slash.
+func (ac *Config) serveURLPrefix(w http.ResponseWriter, req *http.Request, handler http.Handler) {
+	if req.URL.Path == ac.urlPrefix {
+		http.Redirect(w, req, ac.urlPrefix+"/", http.StatusMovedPermanently)
+		return
+	}
+	stripped, ok := ac.stripURLPrefix(req)
+	if !ok {
+		size := ac.ErrorPage(w, req, httperror.New(http.StatusNotFound, ""))
+		ac.LogAccess(req, http.StatusNotFound, size)
+		return
+	}
+	handler.ServeHTTP(&prefixWriter{w, ac}, stripped)
+}
+
+// prefixWriter is a ResponseWriter that adds the URL prefix to redirects
+type prefixWriter struct {
+	http.ResponseWriter
+	ac *Config
+}
+
+// WriteHeader adds the URL prefix to the Location header, then writes the header
+func (pw *prefixWriter) WriteHeader(statusCode int) {
+	if location := pw.Header().Get("Location"); location != "" {
+		pw.Header().Set("Location", pw.ac.PrefixURL(location))
+	}
+	pw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Flush flushes the wrapped ResponseWriter, if possible
+func (pw *prefixWriter) Flush() {
+	if flusher, ok := pw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the wrapped ResponseWriter be hijacked, for WebSockets
+func (pw *prefixWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := pw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer can not be hijacked")
+	}
+	return hijacker.Hijack()
+}
@@ -0,0 +1,308 @@
+package engine
+
+// Virtual hosts, for serving different directories or Lua server files
+// depending on the Host header, from a hosts table in the server
+// configuration. Each host has its own pool of Lua states, its own users
+// and optionally its own log file.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/lua/pool"
+	"github.com/xyproto/algernon/utils"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/pinterface"
+)
+
+// The number of Lua states that can be in use at the same time, for each
+// virtual host, if not given with "states" in the hosts table
+const defaultHostStates = 64
+
+var errVirtualHost = errors.New("the values in the hosts table must be a directory, a Lua server file or a table with dir and server")
+
+// virtualHost is a directory to serve, or a Lua server file to run, for
+// one or more hostnames
+type virtualHost struct {
+	names       []string
+	dir         string
+	serverFile  string
+	states      int    // the largest number of Lua states in use at the same time
+	users       string // the prefix for the usernames, or "" for sharing the users
+	sharedUsers bool
+	logFilename string
+
+	// Set up by virtualHostMuxes
+	mux       *http.ServeMux
+	pool      *pool.LStatePool
+	userstate pinterface.IUserState
+	logger    *log.Logger
+}
+
+// sameAs checks if two virtual hosts are configured the same way, apart
+// from the hostnames
+func (vh *virtualHost) sameAs(other *virtualHost) bool {
+	return vh.dir == other.dir && vh.serverFile == other.serverFile && vh.states == other.states &&
+		vh.users == other.users && vh.sharedUsers == other.sharedUsers && vh.logFilename == other.logFilename
+}
+
+// virtualHostKey is the context key for the virtual host that serves a request
+type virtualHostKey struct{}
+
+// withVirtualHost stores the virtual host in the request context
+func withVirtualHost(req *http.Request, vh *virtualHost) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), virtualHostKey{}, vh))
+}
+
+// requestVirtualHost returns the virtual host that serves the request, or
+// nil if it is served by the main handlers
+func requestVirtualHost(req *http.Request) *virtualHost {
+	if req == nil {
+		return nil
+	}
+	vh, _ := req.Context().Value(virtualHostKey{}).(*virtualHost)
+	return vh
+}
+
+// luaPoolFor returns the pool of Lua states to use for the request
+func (ac *Config) luaPoolFor(req *http.Request) *pool.LStatePool {
+	if vh := requestVirtualHost(req); vh != nil && vh.pool != nil {
+		return vh.pool
+	}
+	return ac.luapool
+}
+
+// userStateFor returns the users for the request. Virtual hosts only see
+// their own users, unless they share the users with the main server.
+func (ac *Config) userStateFor(req *http.Request) pinterface.IUserState {
+	if vh := requestVirtualHost(req); vh != nil && vh.userstate != nil {
+		return vh.userstate
+	}
+	return ac.perm.UserState()
+}
+
+// hostLogWriter appends to the log file of a virtual host. The file is
+// opened for each write, like the access logs.
+type hostLogWriter string
+
+func (filename hostLogWriter) Write(p []byte) (int, error) {
+	f, err := os.OpenFile(string(filename), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Write(p)
+}
+
+// logAccess writes a line in the combined log format to the log file of
+// the virtual host, if it has one
+func (vh *virtualHost) logAccess(ac *Config, req *http.Request, statusCode int, byteSize int64) {
+	if vh.logFilename == "" {
+		return
+	}
+	if _, err := io.WriteString(hostLogWriter(vh.logFilename), ac.CombinedLogFormat(req, statusCode, byteSize)+"\n"); err != nil {
+		log.Warnf("Can not write to %s: %s", vh.logFilename, err)
+	}
+}
+
+// hostMuxes are the virtual hosts, by lowercase hostname. Names like
+// "*.example.com" match all the subdomains.
+type hostMuxes map[string]*virtualHost
+
+// lookup returns the virtual host for the host of the request, or nil. An
+// exact match is preferred over the longest matching wildcard.
+func (hm hostMuxes) lookup(req *http.Request) *virtualHost {
+	if len(hm) == 0 {
+		return nil
+	}
+	host := strings.TrimSuffix(strings.ToLower(utils.GetDomain(req)), ".")
+	if vh, ok := hm[host]; ok {
+		return vh
+	}
+	for rest := host; ; {
+		pos := strings.IndexByte(rest, '.')
+		if pos == -1 {
+			return nil
+		}
+		rest = rest[pos+1:]
+		if vh, ok := hm["*."+rest]; ok {
+			return vh
+		}
+	}
+}
+
+// names returns the hostnames, sorted
+func (hm hostMuxes) names() []string {
+	names := make([]string, 0, len(hm))
+	for name := range hm {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// forgetHosts removes the handlers of virtual hosts that are no longer in
+// use, and closes the Lua states that are not borrowed
+func (ac *Config) forgetHosts(hosts hostMuxes) {
+	seen := make(map[*virtualHost]bool)
+	for _, vh := range hosts {
+		if seen[vh] {
+			continue
+		}
+		seen[vh] = true
+		ac.forgetMux(vh.mux)
+		if vh.pool != nil {
+			vh.pool.Shutdown()
+		}
+	}
+}
+
+// addVirtualHosts reads a hosts table from a configuration script, like:
+//
+//	hosts = {
+//	  ["example.com"] = "/srv/example.com",
+//	  ["api.example.com"] = "/srv/api/server.lua",
+//	  ["*.example.org"] = { dir = "/srv/tenants", server = "server.lua" },
+//	  ["shop.example.net"] = { dir = "/srv/shop", states = 16, users = false, log = "shop.log" },
+//	}
+//
+// Relative paths are relative to the configuration script, and the server
+// file in a table is relative to the directory. In a table, "states" is
+// the largest number of Lua states in use at the same time, "users" is the
+// prefix for the usernames (false for sharing the users with the main
+// server) and "log" is a log file for the host.
+func (ac *Config) addVirtualHosts(hosts *lua.LTable, filename string) error {
+	base := filepath.Dir(filename)
+	abs := func(dir, name string) string {
+		if name == "" || filepath.IsAbs(name) {
+			return name
+		}
+		return filepath.Join(dir, name)
+	}
+	var err error
+	hosts.ForEach(func(key, value lua.LValue) {
+		name := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(key.String())), ".")
+		if err != nil || name == "" {
+			return
+		}
+		vh := virtualHost{states: defaultHostStates}
+		switch v := value.(type) {
+		case lua.LString:
+			vh.dir = abs(base, string(v))
+			if strings.HasSuffix(vh.dir, ".lua") && !ac.fs.IsDir(vh.dir) {
+				vh.serverFile, vh.dir = vh.dir, filepath.Dir(vh.dir)
+			}
+		case *lua.LTable:
+			vh.dir = abs(base, lua.LVAsString(v.RawGetString("dir")))
+			vh.serverFile = abs(vh.dir, lua.LVAsString(v.RawGetString("server")))
+			if vh.dir == "" && vh.serverFile != "" {
+				vh.dir = filepath.Dir(vh.serverFile)
+			}
+			if states, ok := v.RawGetString("states").(lua.LNumber); ok && states > 0 {
+				vh.states = int(states)
+			}
+			switch users := v.RawGetString("users").(type) {
+			case lua.LBool:
+				vh.sharedUsers = !bool(users)
+			case lua.LString:
+				vh.users = string(users)
+			}
+			vh.logFilename = abs(base, lua.LVAsString(v.RawGetString("log")))
+		}
+		if vh.dir == "" {
+			err = errVirtualHost
+			return
+		}
+		// Hosts that are configured the same way share the handlers
+		for i := range ac.virtualHosts {
+			if ac.virtualHosts[i].sameAs(&vh) {
+				ac.virtualHosts[i].names = append(ac.virtualHosts[i].names, name)
+				return
+			}
+		}
+		vh.names = []string{name}
+		ac.virtualHosts = append(ac.virtualHosts, vh)
+	})
+	return err
+}
+
+// setup creates the mux, the pool of Lua states, the users and the logger
+// for the virtual host
+func (vh *virtualHost) setup(ac *Config) {
+	vh.mux = http.NewServeMux()
+	vh.pool = pool.NewWithLimit(lua.Options{
+		CallStackSize: ac.luaCallStackSize,
+		RegistrySize:  ac.luaRegistrySize,
+	}, vh.states)
+	if ac.perm != nil && !vh.sharedUsers {
+		prefix := vh.users
+		if prefix == "" {
+			prefix = vh.names[0]
+		}
+		vh.userstate = newHostUserState(ac.perm.UserState(), prefix+"/")
+	}
+	if vh.logFilename != "" {
+		vh.logger = log.New()
+		vh.logger.Out = hostLogWriter(vh.logFilename)
+		vh.logger.Level = log.GetLevel()
+	}
+}
+
+// virtualHostMuxes sets up the handlers for the virtual hosts that have
+// been added by the configuration scripts. The list of virtual hosts is
+// emptied, so that the hosts tables are read again when reloading. If
+// setting up one of the hosts fails, the hosts that were set up are
+// returned together with the error, so that they can be forgotten.
+func (ac *Config) virtualHostMuxes() (hostMuxes, error) {
+	virtualHosts := ac.virtualHosts
+	ac.virtualHosts = nil
+	hosts := make(hostMuxes)
+	for i := range virtualHosts {
+		vh := &virtualHosts[i]
+		vh.setup(ac)
+		for _, name := range vh.names {
+			hosts[name] = vh
+		}
+		if vh.serverFile == "" {
+			ac.RegisterHandlers(vh.mux, "/", vh.dir, false)
+			continue
+		}
+		if err := ac.runConfiguration(vh.serverFile, vh.mux, true, vh); err != nil {
+			return hosts, errors.New(vh.serverFile + ": " + err.Error())
+		}
+	}
+	// The hosts tables are only used in the main configuration
+	if len(ac.virtualHosts) > 0 {
+		log.Warn("Ignoring a hosts table in the server file of a virtual host")
+		ac.virtualHosts = nil
+	}
+	return hosts, nil
+}
+
+// loadLogFunctions lets the log, warn and err functions write to the log
+// file of the virtual host, if it has one
+func (vh *virtualHost) loadLogFunctions(L *lua.LState) {
+	if vh == nil || vh.logger == nil {
+		return
+	}
+	for name, logf := range map[string]func(...interface{}){
+		"log":  vh.logger.Info,
+		"warn": vh.logger.Warn,
+		"err":  vh.logger.Error,
+	} {
+		logf := logf
+		L.SetGlobal(name, L.NewFunction(func(L *lua.LState) int {
+			buf := convert.Arguments2buffer(L, false)
+			logf(buf.String())
+			return 0 // number of results
+		}))
+	}
+}
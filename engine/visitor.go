@@ -0,0 +1,252 @@
+package engine
+
+// An anonymous visitor ID for visitors that are not logged in, for A/B
+// tests, shopping carts and rate limits. Data that is stored for a visitor is
+// merged into the data for the user when the visitor logs in.
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xyproto/algernon/lua/cart"
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/pinterface"
+)
+
+const (
+	// The name of the cookie with the visitor ID
+	visitorCookieName = "visitor"
+
+	// The hash map where visitor data is stored, with the visitor ID or the
+	// username as the owner
+	visitorHashMap   = "visitors"
+	visitorIDPrefix  = "id:"
+	visitorUsrPrefix = "user:"
+
+	// How often a new visitor ID is given, by default
+	defaultVisitorDays = 30
+
+	// How long the visitor cookie lasts
+	visitorCookieAge = 365 * 24 * 60 * 60
+)
+
+var errNoVisitorID = errors.New("the visitor is not logged in and has no visitor ID")
+
+// visitorCookie returns the visitor ID and when it was given, if the
+// browser has a visitor cookie
+func visitorCookie(req *http.Request) (string, int64, bool) {
+	c, err := req.Cookie(visitorCookieName)
+	if err != nil {
+		return "", 0, false
+	}
+	parts := strings.SplitN(c.Value, ".", 2)
+	if len(parts) != 2 || len(parts[0]) != 32 {
+		return "", 0, false
+	}
+	issued, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return parts[0], issued, true
+}
+
+// setVisitorCookie gives the browser the given visitor ID
+func setVisitorCookie(w http.ResponseWriter, req *http.Request, id string, issued int64) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     visitorCookieName,
+		Value:    id + "." + strconv.FormatInt(issued, 10),
+		Path:     "/",
+		MaxAge:   visitorCookieAge,
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// optedOut checks if the browser asks for not being tracked
+func optedOut(req *http.Request) bool {
+	return req.Header.Get("Sec-GPC") == "1" || req.Header.Get("DNT") == "1"
+}
+
+// visitorData returns the hash map with data for visitors, or nil
+func (ac *Config) visitorData() pinterface.IHashMap {
+	if ac.perm == nil {
+		return nil
+	}
+	hash, err := ac.perm.UserState().Creator().NewHashMap(visitorHashMap)
+	if err != nil {
+		return nil
+	}
+	return hash
+}
+
+// moveVisitorData copies the data from one owner to another, where the
+// other owner does not already have a value, then removes the first owner
+func moveVisitorData(hash pinterface.IHashMap, from, to string) {
+	keys, err := hash.Keys(from)
+	if err != nil || len(keys) == 0 {
+		return
+	}
+	for _, key := range keys {
+		if has, err := hash.Has(to, key); err == nil && has {
+			continue
+		}
+		if value, err := hash.Get(from, key); err == nil {
+			hash.Set(to, key, value)
+		}
+	}
+	hash.Del(from)
+}
+
+// mergeVisitor merges the data for the anonymous visitor into the data for
+// the given user, once the visitor has logged in
+func (ac *Config) mergeVisitor(req *http.Request, username string) {
+	id, _, ok := visitorCookie(req)
+	if !ok {
+		return
+	}
+	hash := ac.visitorData()
+	if hash == nil {
+		return
+	}
+	if exists, err := hash.Exists(visitorIDPrefix + id); err == nil && exists {
+		moveVisitorData(hash, visitorIDPrefix+id, visitorUsrPrefix+username)
+	}
+}
+
+// VisitorID returns the ID of the visitor that sent the request, and gives
+// the browser a new ID if it has none, or if the ID is older than
+// --visitordays days. Returns an empty string if the browser asks for not
+// being tracked, or if --visitorconsent is given and the visitor has not
+// agreed to it.
+func (ac *Config) VisitorID(w http.ResponseWriter, req *http.Request) string {
+	if optedOut(req) {
+		return ""
+	}
+	id, issued, ok := visitorCookie(req)
+	if !ok && ac.visitorConsent {
+		return ""
+	}
+	days := ac.visitorDays
+	if days <= 0 {
+		days = defaultVisitorDays
+	}
+	now := time.Now().Unix()
+	if ok && now-issued <= int64(days)*86400 {
+		return id
+	}
+	newID := randomToken()
+	if ok {
+		// Keep the data for the visitor
+		if hash := ac.visitorData(); hash != nil {
+			moveVisitorData(hash, visitorIDPrefix+id, visitorIDPrefix+newID)
+		}
+	}
+	setVisitorCookie(w, req, newID, now)
+	return newID
+}
+
+// SetVisitorConsent gives the browser a visitor ID if the visitor agrees to
+// it, or else removes the visitor ID and the data for it
+func (ac *Config) SetVisitorConsent(w http.ResponseWriter, req *http.Request, consent bool) string {
+	if consent {
+		if id, _, ok := visitorCookie(req); ok {
+			return id
+		}
+		id := randomToken()
+		setVisitorCookie(w, req, id, time.Now().Unix())
+		return id
+	}
+	if id, _, ok := visitorCookie(req); ok {
+		if hash := ac.visitorData(); hash != nil {
+			hash.Del(visitorIDPrefix + id)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: visitorCookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	return ""
+}
+
+// LoadVisitorFunctions makes functions for the anonymous visitor ID, and for
+// storing data for the visitor, available to Lua scripts
+func (ac *Config) LoadVisitorFunctions(w http.ResponseWriter, req *http.Request, L *lua.LState) {
+	// The visitor ID is only given once per request
+	var (
+		id      string
+		checked bool
+	)
+	visitorID := func() string {
+		if !checked {
+			id, checked = ac.VisitorID(w, req), true
+		}
+		return id
+	}
+	// The owner of the visitor data, which is the username if logged in
+	owner := func() string {
+		if ac.perm != nil {
+			if username := ac.perm.UserState().Username(req); username != "" {
+				return visitorUsrPrefix + username
+			}
+		}
+		if id := visitorID(); id != "" {
+			return visitorIDPrefix + id
+		}
+		return ""
+	}
+
+	// The shopping cart is stored with the visitor data, so that it is
+	// merged into the cart of the user when the visitor logs in
+	cart.Load(L, func() (*cart.Cart, error) {
+		hash := ac.visitorData()
+		if hash == nil {
+			return nil, errNoDatabase
+		}
+		o := owner()
+		if o == "" {
+			return nil, errNoVisitorID
+		}
+		return cart.New(hash, o), nil
+	})
+
+	// Get the anonymous ID of the visitor, or an empty string if the visitor
+	// does not want to be tracked. Takes nothing.
+	L.SetGlobal("VisitorID", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(visitorID()))
+		return 1 // number of results
+	}))
+	// Give or remove the visitor ID, when the visitor agrees or disagrees to
+	// it. Takes a bool. Returns the visitor ID, or an empty string.
+	L.SetGlobal("SetVisitorConsent", L.NewFunction(func(L *lua.LState) int {
+		id, checked = ac.SetVisitorConsent(w, req, L.ToBool(1)), true
+		L.Push(lua.LString(id))
+		return 1 // number of results
+	}))
+	// Get a value that is stored for the visitor, or for the user if logged in.
+	// Takes a key. Returns a string, or an empty string.
+	L.SetGlobal("VisitorGet", L.NewFunction(func(L *lua.LState) int {
+		key := L.ToString(1)
+		hash, o := ac.visitorData(), owner()
+		if hash == nil || o == "" {
+			L.Push(lua.LString(""))
+			return 1 // number of results
+		}
+		value, _ := hash.Get(o, key)
+		L.Push(lua.LString(value))
+		return 1 // number of results
+	}))
+	// Store a value for the visitor, or for the user if logged in.
+	// Takes a key and a value. Returns true if successful.
+	L.SetGlobal("VisitorSet", L.NewFunction(func(L *lua.LState) int {
+		key := L.ToString(1)
+		value := L.ToString(2)
+		hash, o := ac.visitorData(), owner()
+		if hash == nil || o == "" {
+			L.Push(lua.LFalse)
+			return 1 // number of results
+		}
+		L.Push(lua.LBool(nil == hash.Set(o, key, value)))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,330 @@
+package engine
+
+// Web Push notifications, with endpoints where browsers can get the public
+// VAPID key and store their push subscriptions, and functions for sending
+// notifications to the subscriptions of a user
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/lua/httperror"
+	"github.com/xyproto/algernon/webpush"
+	"github.com/xyproto/gopher-lua"
+)
+
+const (
+	// The path that the Web Push endpoints are served from
+	pushPath = "/_push/"
+
+	// Where the VAPID private key and the push subscriptions are stored
+	pushKeyValue = "webpush"
+	pushHashMap  = "pushsubscriptions"
+
+	// How many seconds the push services keep notifications, by default
+	defaultPushTTL = 86400
+
+	// The maximum size of a push subscription, in bytes
+	maxSubscriptionSize = 8192
+)
+
+var errNoWebPush = errors.New("Web Push is not enabled, use WebPush in the server configuration")
+
+// webPushConfig keeps the VAPID key pair, once Web Push has been enabled
+type webPushConfig struct {
+	mut    sync.RWMutex
+	vapid  *webpush.VAPID
+	client *http.Client
+}
+
+// Set starts using the given VAPID key pair
+func (wp *webPushConfig) Set(vapid *webpush.VAPID) {
+	wp.mut.Lock()
+	defer wp.mut.Unlock()
+	wp.vapid = vapid
+	wp.client = &http.Client{Timeout: 30 * time.Second}
+}
+
+// Get returns the VAPID key pair and the HTTP client, or nil if Web Push
+// is not enabled
+func (wp *webPushConfig) Get() (*webpush.VAPID, *http.Client) {
+	wp.mut.RLock()
+	defer wp.mut.RUnlock()
+	return wp.vapid, wp.client
+}
+
+// vapidKey returns the VAPID private key that is stored in the database
+// backend, and generates it if needed, so that the subscriptions are
+// still valid after a restart and across servers
+func (ac *Config) vapidKey() (string, error) {
+	kv, err := ac.perm.UserState().Creator().NewKeyValue(pushKeyValue)
+	if err != nil {
+		return "", err
+	}
+	if stored, err := kv.Get("privatekey"); err == nil && stored != "" {
+		return stored, nil
+	}
+	key, err := webpush.GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	return key, kv.Set("privatekey", key)
+}
+
+// StorePushSubscription stores a push subscription, given as JSON, for the
+// given user, which may be empty. Returns the ID of the subscription.
+func (ac *Config) StorePushSubscription(username string, data []byte) (string, error) {
+	sub, err := webpush.ParseSubscription(data)
+	if err != nil {
+		return "", err
+	}
+	hash, err := ac.perm.UserState().Creator().NewHashMap(pushHashMap)
+	if err != nil {
+		return "", err
+	}
+	// The same browser gets the same ID, so that subscribing again replaces
+	// the old subscription
+	id := hashToken(sub.Endpoint)
+	normalized, err := json.Marshal(sub)
+	if err != nil {
+		return "", err
+	}
+	if err := hash.Set(id, "username", username); err != nil {
+		return "", err
+	}
+	return id, hash.Set(id, "subscription", string(normalized))
+}
+
+// RemovePushSubscription removes the push subscription with the given
+// endpoint
+func (ac *Config) RemovePushSubscription(endpoint string) error {
+	hash, err := ac.perm.UserState().Creator().NewHashMap(pushHashMap)
+	if err != nil {
+		return err
+	}
+	return hash.Del(hashToken(endpoint))
+}
+
+// SendPush sends a notification to all the push subscriptions of a user,
+// or to all subscriptions if the username is empty. Subscriptions that are
+// no longer valid are removed. Returns the number of subscriptions that
+// the notification was sent to.
+func (ac *Config) SendPush(username string, payload []byte, ttl int) (int, error) {
+	vapid, client := ac.webPush.Get()
+	if vapid == nil {
+		return 0, errNoWebPush
+	}
+	hash, err := ac.perm.UserState().Creator().NewHashMap(pushHashMap)
+	if err != nil {
+		return 0, err
+	}
+	ids, err := hash.All()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		sent    int
+		lastErr error
+	)
+	for _, id := range ids {
+		if username != "" {
+			if owner, err := hash.Get(id, "username"); err != nil || owner != username {
+				continue
+			}
+		}
+		data, err := hash.Get(id, "subscription")
+		if err != nil {
+			continue
+		}
+		sub, err := webpush.ParseSubscription([]byte(data))
+		if err == nil {
+			err = vapid.Send(client, sub, payload, ttl)
+		}
+		switch err {
+		case nil:
+			sent++
+		case webpush.ErrGone:
+			hash.Del(id)
+		default:
+			log.Warn("Could not send the push notification: ", err)
+			lastErr = err
+		}
+	}
+	if sent == 0 && lastErr != nil {
+		return 0, lastErr
+	}
+	return sent, nil
+}
+
+// serveWebPush handles the Web Push endpoints, if the request is for them
+// and Web Push is enabled. GET key returns the public VAPID key, POST
+// subscribe stores a push subscription for the current user and POST
+// unsubscribe removes it. Returns true if the request has been handled.
+func (ac *Config) serveWebPush(w http.ResponseWriter, req *http.Request) bool {
+	if !strings.HasPrefix(req.URL.Path, pushPath) {
+		return false
+	}
+	vapid, _ := ac.webPush.Get()
+	if vapid == nil {
+		return false
+	}
+	fail := func(code int, message string) bool {
+		size := ac.ErrorPage(w, req, httperror.New(code, message))
+		ac.LogAccess(req, code, size)
+		return true
+	}
+	endpoint := strings.TrimPrefix(req.URL.Path, pushPath)
+	if endpoint == "key" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		n, _ := w.Write([]byte(vapid.PublicKey()))
+		ac.LogAccess(req, http.StatusOK, int64(n))
+		return true
+	}
+	if endpoint != "subscribe" && endpoint != "unsubscribe" {
+		return fail(http.StatusNotFound, "No such endpoint.")
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return fail(http.StatusMethodNotAllowed, "Only POST is allowed.")
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxSubscriptionSize))
+	if err != nil {
+		return fail(http.StatusRequestEntityTooLarge, "The subscription is too large.")
+	}
+	if endpoint == "subscribe" {
+		_, err = ac.StorePushSubscription(ac.perm.UserState().Username(req), data)
+	} else {
+		var sub webpush.Subscription
+		if err = json.Unmarshal(data, &sub); err == nil {
+			err = ac.RemovePushSubscription(sub.Endpoint)
+		}
+	}
+	if err != nil {
+		return fail(http.StatusBadRequest, err.Error())
+	}
+	w.WriteHeader(http.StatusNoContent)
+	ac.LogAccess(req, http.StatusNoContent, 0)
+	return true
+}
+
+// LoadWebPushFunctions makes functions for storing push subscriptions and
+// sending push notifications available to Lua scripts
+func (ac *Config) LoadWebPushFunctions(L *lua.LState) {
+
+	// Get the public VAPID key, for the applicationServerKey option of
+	// pushManager.subscribe() in JavaScript. Returns nil if Web Push is not
+	// enabled.
+	L.SetGlobal("WebPushKey", L.NewFunction(func(L *lua.LState) int {
+		vapid, _ := ac.webPush.Get()
+		if vapid == nil {
+			L.Push(lua.LNil)
+			return 1 // number of results
+		}
+		L.Push(lua.LString(vapid.PublicKey()))
+		return 1 // number of results
+	}))
+
+	// Store a push subscription. Takes the subscription as JSON or as a
+	// table, and an optional username. Returns an ID, or nil and an error
+	// message.
+	L.SetGlobal("PushSubscribe", L.NewFunction(func(L *lua.LState) int {
+		var data []byte
+		if t, ok := L.Get(1).(*lua.LTable); ok {
+			data, _ = json.Marshal(convert.Table2interfaceMap(t))
+		} else {
+			data = []byte(L.CheckString(1))
+		}
+		id, err := ac.StorePushSubscription(L.OptString(2, ""), data)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(id))
+		return 1 // number of results
+	}))
+
+	// Remove a push subscription. Takes the endpoint URL of the
+	// subscription. Returns true if successful.
+	L.SetGlobal("PushUnsubscribe", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(ac.RemovePushSubscription(L.CheckString(1)) == nil))
+		return 1 // number of results
+	}))
+
+	// Send a push notification to all the subscriptions of a user, or to
+	// all subscriptions if the username is nil. Takes a username, a payload
+	// as a string or as a table that is sent as JSON, and an optional number
+	// of seconds that push services keep the notification. Returns the
+	// number of subscriptions it was sent to, or nil and an error message.
+	L.SetGlobal("SendPush", L.NewFunction(func(L *lua.LState) int {
+		username := L.OptString(1, "")
+		var payload []byte
+		if t, ok := L.Get(2).(*lua.LTable); ok {
+			payload, _ = json.Marshal(convert.Table2interfaceMap(t))
+		} else {
+			payload = []byte(L.CheckString(2))
+		}
+		sent, err := ac.SendPush(username, payload, L.OptInt(3, defaultPushTTL))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LNumber(sent))
+		return 1 // number of results
+	}))
+}
+
+// LoadWebPushConfigFunctions makes the WebPush function available to server
+// configuration scripts
+func (ac *Config) LoadWebPushConfigFunctions(L *lua.LState) {
+
+	// Enable Web Push, with the endpoints under /_push/ and the "push"
+	// channel for Notify. Takes a mailto: or https: URL where the server
+	// operator can be contacted, and an optional VAPID private key. The key
+	// is generated and stored in the database if it is not given. Returns
+	// true, or false and an error message.
+	L.SetGlobal("WebPush", L.NewFunction(func(L *lua.LState) int {
+		subject := L.CheckString(1)
+		vapid, err := func() (*webpush.VAPID, error) {
+			if ac.perm == nil {
+				return nil, errNoDatabase
+			}
+			key := L.OptString(2, "")
+			if key == "" {
+				var err error
+				if key, err = ac.vapidKey(); err != nil {
+					return nil, err
+				}
+			}
+			return webpush.NewVAPID(key, subject)
+		}()
+		if err != nil {
+			L.Push(lua.LFalse)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		ac.webPush.Set(vapid)
+		ac.notify.AddChannel("push", func(username, subject, message string) error {
+			if username == "" {
+				// An empty username would send to all subscriptions
+				return errNoUsername
+			}
+			payload, err := json.Marshal(map[string]string{"title": subject, "body": message})
+			if err != nil {
+				return err
+			}
+			_, err = ac.SendPush(username, payload, defaultPushTTL)
+			return err
+		})
+		L.Push(lua.LTrue)
+		return 1 // number of results
+	}))
+}
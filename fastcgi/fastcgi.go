@@ -0,0 +1,315 @@
+// Package fastcgi provides a FastCGI client, for passing requests on to
+// FastCGI servers like php-fpm
+package fastcgi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record types, from the FastCGI specification
+const (
+	typeBeginRequest = 1
+	typeEndRequest   = 3
+	typeParams       = 4
+	typeStdin        = 5
+	typeStdout       = 6
+	typeStderr       = 7
+)
+
+const (
+	version1      = 1
+	roleResponder = 1
+
+	// All requests use the same ID, since there is one request per connection
+	requestID = 1
+
+	// The largest amount of data in a single record
+	maxContent = 65535
+
+	// The default timeout for connecting to the FastCGI server
+	defaultTimeout = 10 * time.Second
+)
+
+var errUnexpectedEOF = errors.New("fastcgi: the connection was closed before the request ended")
+
+// Client connects to a FastCGI server, once per request
+type Client struct {
+	Network string
+	Address string
+	Timeout time.Duration
+
+	// Where to write the error output from the FastCGI server. Can be nil.
+	Stderr io.Writer
+}
+
+// NewClient creates a client for the given address, which is either a
+// path to a unix socket (optionally with a "unix:" prefix), or host:port
+func NewClient(address string) *Client {
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") {
+		network = "unix"
+		address = strings.TrimPrefix(address, "unix:")
+	} else if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	return &Client{Network: network, Address: address, Timeout: defaultTimeout}
+}
+
+// writeRecord writes a single record, with padding
+func writeRecord(w io.Writer, recordType byte, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+	header := []byte{version1, recordType, 0, requestID, 0, 0, byte(padding), 0}
+	binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, padding))
+	return err
+}
+
+// writeStream writes the given data as records of the given type,
+// followed by an empty record that marks the end of the stream
+func writeStream(w io.Writer, recordType byte, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxContent {
+			n = maxContent
+		}
+		if err := writeRecord(w, recordType, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return writeRecord(w, recordType, nil)
+}
+
+// encodeLength encodes the length of a name or a value
+func encodeLength(buf *bytes.Buffer, n int) {
+	if n < 128 {
+		buf.WriteByte(byte(n))
+		return
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(n)|1<<31)
+	buf.Write(b[:])
+}
+
+// encodeParams encodes the CGI environment variables as name-value pairs
+func encodeParams(params map[string]string) []byte {
+	var buf bytes.Buffer
+	for name, value := range params {
+		encodeLength(&buf, len(name))
+		encodeLength(&buf, len(value))
+		buf.WriteString(name)
+		buf.WriteString(value)
+	}
+	return buf.Bytes()
+}
+
+// readRecords reads records until the request has ended, and passes on the
+// output to the given writers
+func readRecords(r io.Reader, stdout, stderr io.Writer) error {
+	br := bufio.NewReader(r)
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			if err == io.EOF {
+				return errUnexpectedEOF
+			}
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		padding := int(header[6])
+		content := make([]byte, length)
+		if _, err := io.ReadFull(br, content); err != nil {
+			return err
+		}
+		if _, err := br.Discard(padding); err != nil {
+			return err
+		}
+		switch header[1] {
+		case typeStdout:
+			if _, err := stdout.Write(content); err != nil {
+				return err
+			}
+		case typeStderr:
+			if stderr != nil {
+				stderr.Write(content)
+			}
+		case typeEndRequest:
+			return nil
+		}
+	}
+}
+
+// responseBody closes the connection when the response body is closed
+type responseBody struct {
+	*io.PipeReader
+	conn net.Conn
+}
+
+// Close closes the response body and the connection
+func (rb *responseBody) Close() error {
+	rb.PipeReader.Close()
+	return rb.conn.Close()
+}
+
+// Do sends a request with the given CGI environment variables and request
+// body to the FastCGI server, and returns the response. The response body
+// must be closed.
+func (c *Client) Do(params map[string]string, body io.Reader) (*http.Response, error) {
+	conn, err := net.DialTimeout(c.Network, c.Address, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// The request body is sent first, so it must be read into memory
+	var stdin []byte
+	if body != nil {
+		stdin, err = ioutil.ReadAll(body)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	w := bufio.NewWriter(conn)
+	begin := []byte{0, roleResponder, 0, 0, 0, 0, 0, 0}
+	if err := writeRecord(w, typeBeginRequest, begin); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := writeStream(w, typeParams, encodeParams(params)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := writeStream(w, typeStdin, stdin); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(readRecords(conn, pw, c.Stderr))
+	}()
+
+	resp, err := parseResponse(pr)
+	if err != nil {
+		pr.Close()
+		conn.Close()
+		return nil, err
+	}
+	resp.Body = &responseBody{pr, conn}
+	return resp, nil
+}
+
+// parseResponse reads the CGI headers from the output of the FastCGI server
+func parseResponse(r io.Reader) (*http.Response, error) {
+	br := bufio.NewReader(r)
+	mimeHeader, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	header := http.Header(mimeHeader)
+	resp := &http.Response{StatusCode: http.StatusOK, Header: header}
+	if status := header.Get("Status"); status != "" {
+		fields := strings.SplitN(status, " ", 2)
+		code, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("fastcgi: invalid status: %s", status)
+		}
+		resp.StatusCode = code
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		resp.StatusCode = http.StatusFound
+	}
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	// Return the rest of the output as the body, including what has been buffered
+	resp.Body = ioutil.NopCloser(br)
+	return resp, nil
+}
+
+// Env returns the CGI environment variables for the given request
+func Env(req *http.Request, documentRoot, scriptFilename, scriptName, pathInfo string) map[string]string {
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+		port = "80"
+		if req.TLS != nil {
+			port = "443"
+		}
+	}
+	remoteAddr, remotePort, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteAddr = req.RemoteAddr
+	}
+	env := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "Algernon",
+		"SERVER_PROTOCOL":   req.Proto,
+		"SERVER_NAME":       host,
+		"SERVER_PORT":       port,
+		"REQUEST_METHOD":    req.Method,
+		"REQUEST_URI":       req.URL.RequestURI(),
+		"QUERY_STRING":      req.URL.RawQuery,
+		"DOCUMENT_ROOT":     documentRoot,
+		"SCRIPT_FILENAME":   scriptFilename,
+		"SCRIPT_NAME":       scriptName,
+		"PATH_INFO":         pathInfo,
+		"REMOTE_ADDR":       remoteAddr,
+		"REMOTE_PORT":       remotePort,
+		"CONTENT_TYPE":      req.Header.Get("Content-Type"),
+		"CONTENT_LENGTH":    req.Header.Get("Content-Length"),
+	}
+	if req.TLS != nil {
+		env["HTTPS"] = "on"
+	}
+	// The request headers, as HTTP_* variables
+	for name, values := range req.Header {
+		key := "HTTP_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+		// Ignore "Proxy", since HTTP_PROXY is often used for configuring proxies
+		if key == "HTTP_PROXY" {
+			continue
+		}
+		env[key] = strings.Join(values, ", ")
+	}
+	return env
+}
+
+// Serve passes the request on to the FastCGI server, with the given CGI
+// environment variables, and writes the response. Returns an error and
+// writes nothing if the FastCGI server could not be reached.
+func (c *Client) Serve(w http.ResponseWriter, req *http.Request, env map[string]string) error {
+	resp, err := c.Do(env, req.Body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -0,0 +1,51 @@
+package fastcgi
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		env := fcgi.ProcessEnv(req)
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("X-Script", env["SCRIPT_FILENAME"])
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte(req.Method + " " + req.URL.Path + " " + string(body)))
+	}))
+
+	c := NewClient(l.Addr().String())
+	req := httptest.NewRequest("POST", "/hello.php?x=1", strings.NewReader("data"))
+	rec := httptest.NewRecorder()
+	if err := c.Serve(rec, req, Env(req, "/srv", "/srv/hello.php", "/hello.php", "")); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusTeapot {
+		t.Errorf("unexpected status code: %d", rec.Code)
+	}
+	if got := rec.Header().Get("X-Script"); got != "/srv/hello.php" {
+		t.Errorf("unexpected script filename: %s", got)
+	}
+	if got := rec.Body.String(); got != "POST /hello.php data" {
+		t.Errorf("unexpected body: %s", got)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	if c := NewClient("unix:/run/php/php-fpm.sock"); c.Network != "unix" || c.Address != "/run/php/php-fpm.sock" {
+		t.Errorf("unexpected client: %v", c)
+	}
+	if c := NewClient("localhost:9000"); c.Network != "tcp" {
+		t.Errorf("unexpected client: %v", c)
+	}
+}
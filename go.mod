@@ -1,32 +1,28 @@
 module github.com/xyproto/algernon
 
+go 1.25
+
+toolchain go1.25.0
+
 require (
+	github.com/andybalholm/brotli v1.1.0
 	github.com/bmizerany/assert v0.0.0-20160611221934-b7ed37b82869
 	github.com/chzyer/readline v0.0.0-20180603132655-2972be24d48e
 	github.com/didip/tollbooth v4.0.0+incompatible
-	github.com/dop251/goja v0.0.0-20190301185519-64be363d126e // indirect
 	github.com/eknkc/amber v0.0.0-20171010120322-cdade1c07385
 	github.com/flosch/pongo2 v0.0.0-20181225140029-79872a7b2769
 	github.com/go-gcfg/gcfg v1.2.3
-	github.com/go-sourcemap/sourcemap v2.1.2+incompatible // indirect
-	github.com/golang/protobuf v1.3.1 // indirect
 	github.com/jvatic/goja-babel v0.0.0-20170714233534-00569a238089
-	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
 	github.com/lucas-clemente/quic-go v0.11.0
-	github.com/mattetti/filebuffer v1.0.0 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db
 	github.com/mitchellh/go-homedir v1.1.0
-	github.com/mitchellh/mapstructure v1.1.2 // indirect
 	github.com/natefinch/pie v0.0.0-20170715172608-9a0d72014007
-	github.com/onsi/ginkgo v1.8.0 // indirect
-	github.com/onsi/gomega v1.5.0 // indirect
-	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
+	github.com/pkg/sftp v1.13.6
 	github.com/russross/blackfriday v2.0.0+incompatible
-	github.com/shopspring/decimal v0.0.0-20180709203117-cd690d0c9e24 // indirect
 	github.com/sirupsen/logrus v1.4.1
-	github.com/stvp/assert v0.0.0-20170616060220-4bc16443988b // indirect
 	github.com/tylerb/graceful v1.2.15
 	github.com/wellington/sass v0.0.0-20160911051022-cab90b3986d6
+	github.com/xyproto/cookie v0.0.0-20181220103240-f4de411f45ff
 	github.com/xyproto/datablock v0.0.0-20180830133147-8c3914e5c4fe
 	github.com/xyproto/gluamapper v0.0.0-20190219142928-9e3518c991d4
 	github.com/xyproto/gopher-lua v0.0.0-20190220202711-e72dfa319174
@@ -41,16 +37,67 @@ require (
 	github.com/xyproto/recwatch v0.0.0-20190124180410-f96d3a80bdf1
 	github.com/xyproto/sheepcounter v1.6.0
 	github.com/xyproto/simplebolt v0.0.0-20190219145457-752add4550da
-	github.com/xyproto/simplehstore v0.0.0-20181004171731-44c8a3a3ce5e // indirect
 	github.com/xyproto/simpleredis v0.0.0-20181004131423-f2c3a2cf62d0
 	github.com/xyproto/splash v0.0.0-20190405073251-f213b9090528
 	github.com/xyproto/term v0.3.0
 	github.com/xyproto/unzip v0.0.0-20150601123358-823950573952
 	github.com/yosssi/gcss v0.1.0
-	golang.org/x/crypto v0.0.0-20190404164418-38d8ce5564a5 // indirect
-	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3
+	golang.org/x/crypto v0.1.0
+	golang.org/x/net v0.1.0
+	modernc.org/sqlite v1.29.10
+)
+
+require (
+	github.com/alecthomas/chroma v0.6.3 // indirect
+	github.com/cheekybits/genny v1.0.0 // indirect
+	github.com/danwakefield/fnmatch v0.0.0-20160403171240-cbb64ac3d964 // indirect
+	github.com/dlclark/regexp2 v1.1.6 // indirect
+	github.com/dop251/goja v0.0.0-20190301185519-64be363d126e // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/etcd-io/bbolt v1.3.2 // indirect
+	github.com/fsnotify/fsnotify v1.4.7 // indirect
+	github.com/gdamore/encoding v1.0.0 // indirect
+	github.com/gdamore/tcell v1.1.1 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.2+incompatible // indirect
+	github.com/go-sql-driver/mysql v1.4.1 // indirect
+	github.com/gomodule/redigo v2.0.0+incompatible // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
+	github.com/juju/errors v0.0.0-20190207033735-e65537c515d7 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/kr/pretty v0.2.1 // indirect
+	github.com/kr/text v0.1.0 // indirect
+	github.com/lib/pq v1.0.0 // indirect
+	github.com/lucasb-eyer/go-colorful v0.0.0-20181028223441-12d3b2882a08 // indirect
+	github.com/marten-seemann/qtls v0.2.3 // indirect
+	github.com/mattetti/filebuffer v1.0.0 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/mattn/go-runewidth v0.0.4 // indirect
+	github.com/mitchellh/mapstructure v1.1.2 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/onsi/ginkgo v1.8.0 // indirect
+	github.com/onsi/gomega v1.5.0 // indirect
+	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	github.com/shopspring/decimal v0.0.0-20180709203117-cd690d0c9e24 // indirect
+	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
+	github.com/stvp/assert v0.0.0-20170616060220-4bc16443988b // indirect
+	github.com/xyproto/randomstring v0.0.0-20181222003104-0f764aabc45a // indirect
+	github.com/xyproto/simplehstore v0.0.0-20181004171731-44c8a3a3ce5e // indirect
+	github.com/xyproto/simplemaria v0.0.0-20181211083039-d325ae02395a // indirect
+	golang.org/x/sys v0.19.0 // indirect
+	golang.org/x/text v0.4.0 // indirect
 	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4 // indirect
 	google.golang.org/appengine v1.5.0 // indirect
 	gopkg.in/gcfg.v1 v1.2.3 // indirect
 	gopkg.in/warnings.v0 v0.1.2 // indirect
+	modernc.org/gc/v3 v3.0.0-20240107210532-573471604cb6 // indirect
+	modernc.org/libc v1.49.3 // indirect
+	modernc.org/mathutil v1.6.0 // indirect
+	modernc.org/memory v1.8.0 // indirect
+	modernc.org/strutil v1.2.0 // indirect
+	modernc.org/token v1.1.0 // indirect
 )
+
+replace github.com/go-check/check => gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
@@ -0,0 +1,174 @@
+package ldap
+
+// Just enough BER encoding and decoding for LDAP messages
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// Tags that are used in LDAP messages
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+	tagSet         = 0x31
+
+	// Tags for the LDAP operations, from RFC 4511
+	tagBindRequest      = 0x60
+	tagBindResponse     = 0x61
+	tagUnbindRequest    = 0x42
+	tagSearchRequest    = 0x63
+	tagSearchEntry      = 0x64
+	tagSearchDone       = 0x65
+	tagSearchReference  = 0x73
+	tagSimpleAuth       = 0x80
+	tagFilterAnd        = 0xa0
+	tagFilterOr         = 0xa1
+	tagFilterNot        = 0xa2
+	tagFilterEquality   = 0xa3
+	tagFilterSubstrings = 0xa4
+	tagFilterGreater    = 0xa5
+	tagFilterLess       = 0xa6
+	tagFilterPresent    = 0x87
+	tagSubInitial       = 0x80
+	tagSubAny           = 0x81
+	tagSubFinal         = 0x82
+)
+
+// The largest message that is read from the server
+const maxMessageSize = 16 << 20
+
+var errMalformed = errors.New("ldap: malformed message from the server")
+
+// element is a decoded BER element. Constructed elements have children.
+type element struct {
+	tag      byte
+	data     []byte
+	children []*element
+}
+
+// encode returns a BER element with the given tag and contents
+func encode(tag byte, contents ...[]byte) []byte {
+	n := 0
+	for _, c := range contents {
+		n += len(c)
+	}
+	b := []byte{tag}
+	if n < 0x80 {
+		b = append(b, byte(n))
+	} else {
+		var length []byte
+		for l := n; l > 0; l >>= 8 {
+			length = append([]byte{byte(l)}, length...)
+		}
+		b = append(b, 0x80|byte(len(length)))
+		b = append(b, length...)
+	}
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// encodeInt returns a BER integer, or an enumerated value if tag is tagEnumerated
+func encodeInt(tag byte, i int) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(i)}, b...)
+		i >>= 8
+		if (i == 0 && b[0]&0x80 == 0) || (i == -1 && b[0]&0x80 != 0) {
+			break
+		}
+	}
+	return encode(tag, b)
+}
+
+// encodeString returns a BER octet string
+func encodeString(s string) []byte {
+	return encode(tagOctetString, []byte(s))
+}
+
+// decodeInt returns the value of an integer or an enumerated element
+func (e *element) decodeInt() int {
+	i := 0
+	for n, b := range e.data {
+		if n == 0 && b&0x80 != 0 {
+			i = -1
+		}
+		i = i<<8 | int(b)
+	}
+	return i
+}
+
+// parse decodes a BER element, and the elements in it if it is constructed
+func parse(data []byte) (*element, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, errMalformed
+	}
+	tag, length := data[0], int(data[1])
+	data = data[2:]
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 || len(data) < n {
+			return nil, nil, errMalformed
+		}
+		length = 0
+		for _, b := range data[:n] {
+			length = length<<8 | int(b)
+		}
+		data = data[n:]
+	}
+	if length > len(data) {
+		return nil, nil, errMalformed
+	}
+	e := &element{tag: tag, data: data[:length]}
+	if tag&0x20 != 0 {
+		rest := e.data
+		for len(rest) > 0 {
+			child, r, err := parse(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			e.children = append(e.children, child)
+			rest = r
+		}
+	}
+	return e, data[length:], nil
+}
+
+// readMessage reads one BER element from the connection
+func readMessage(r *bufio.Reader) (*element, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return nil, errMalformed
+		}
+		lengthBytes := make([]byte, n)
+		if _, err := io.ReadFull(r, lengthBytes); err != nil {
+			return nil, err
+		}
+		header = append(header, lengthBytes...)
+		length = 0
+		for _, b := range lengthBytes {
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxMessageSize {
+		return nil, errMalformed
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	e, _, err := parse(append(header, body...))
+	return e, err
+}
@@ -0,0 +1,162 @@
+package ldap
+
+// Search filters in the string format from RFC 4515, like
+// "(&(objectClass=person)(uid=bob))"
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+var errFilter = errors.New("ldap: invalid search filter")
+
+// EscapeFilter escapes a value, like a username, so that it can be used
+// in a search filter
+func EscapeFilter(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			sb.WriteString("\\" + hex.EncodeToString([]byte{c}))
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// unescapeFilter decodes the \XX escapes in a filter value
+func unescapeFilter(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", errFilter
+		}
+		b, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", errFilter
+		}
+		sb.Write(b)
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+// compileFilter encodes a search filter
+func compileFilter(filter string) ([]byte, error) {
+	encoded, rest, err := parseFilter(strings.TrimSpace(filter))
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, errFilter
+	}
+	return encoded, nil
+}
+
+// parseFilter encodes the first filter in the given string, and returns
+// the rest of the string
+func parseFilter(s string) ([]byte, string, error) {
+	if len(s) < 3 || s[0] != '(' {
+		return nil, "", errFilter
+	}
+	s = s[1:]
+	switch s[0] {
+	case '&', '|':
+		tag := byte(tagFilterAnd)
+		if s[0] == '|' {
+			tag = tagFilterOr
+		}
+		s = s[1:]
+		var children [][]byte
+		for len(s) > 0 && s[0] == '(' {
+			child, rest, err := parseFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			children = append(children, child)
+			s = rest
+		}
+		if len(children) == 0 || len(s) == 0 || s[0] != ')' {
+			return nil, "", errFilter
+		}
+		return encode(tag, children...), s[1:], nil
+	case '!':
+		child, rest, err := parseFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if len(rest) == 0 || rest[0] != ')' {
+			return nil, "", errFilter
+		}
+		return encode(tagFilterNot, child), rest[1:], nil
+	}
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", errFilter
+	}
+	item, rest := s[:end], s[end+1:]
+	encoded, err := parseItem(item)
+	return encoded, rest, err
+}
+
+// parseItem encodes a comparison, like "uid=bob", "cn=*" or "cn=B*b"
+func parseItem(item string) ([]byte, error) {
+	eq := strings.IndexByte(item, '=')
+	if eq < 1 {
+		return nil, errFilter
+	}
+	attr, value := item[:eq], item[eq+1:]
+	switch attr[len(attr)-1] {
+	case '>', '<':
+		tag := byte(tagFilterGreater)
+		if attr[len(attr)-1] == '<' {
+			tag = tagFilterLess
+		}
+		v, err := unescapeFilter(value)
+		if err != nil {
+			return nil, err
+		}
+		return encode(tag, encodeString(attr[:len(attr)-1]), encodeString(v)), nil
+	case '~', ':':
+		// Approximate and extensible matches are not supported
+		return nil, errFilter
+	}
+	if value == "*" {
+		return encode(tagFilterPresent, []byte(attr)), nil
+	}
+	if !strings.Contains(value, "*") {
+		v, err := unescapeFilter(value)
+		if err != nil {
+			return nil, err
+		}
+		return encode(tagFilterEquality, encodeString(attr), encodeString(v)), nil
+	}
+	parts := strings.Split(value, "*")
+	var subs [][]byte
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		v, err := unescapeFilter(part)
+		if err != nil {
+			return nil, err
+		}
+		tag := byte(tagSubAny)
+		if i == 0 {
+			tag = tagSubInitial
+		} else if i == len(parts)-1 {
+			tag = tagSubFinal
+		}
+		subs = append(subs, encode(tag, []byte(v)))
+	}
+	return encode(tagFilterSubstrings, encodeString(attr), encode(tagSequence, subs...)), nil
+}
@@ -0,0 +1,295 @@
+// Package ldap provides a small LDAP client, for checking passwords against
+// an LDAP server or Active Directory
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Result codes, from RFC 4511
+const (
+	resultSuccess            = 0
+	resultInvalidCredentials = 49
+)
+
+// The default timeout for connecting to and waiting for the LDAP server
+const defaultTimeout = 10 * time.Second
+
+var (
+	// ErrInvalidCredentials is returned when the username or password is wrong
+	ErrInvalidCredentials = errors.New("ldap: invalid username or password")
+
+	errNoUser      = errors.New("ldap: no such user, or not in the required group")
+	errManyUsers   = errors.New("ldap: the user filter matches more than one user")
+	errScheme      = errors.New("ldap: the server URL must start with ldap:// or ldaps://")
+	errUnexpected  = errors.New("ldap: unexpected response from the server")
+	errNoPassword  = errors.New("ldap: empty passwords are not accepted")
+	errNoBaseDN    = errors.New("ldap: a base DN is required")
+	errNoUsername  = errors.New("ldap: empty usernames are not accepted")
+	errUserFilter  = errors.New("ldap: the user filter must contain %s")
+	errNotSearched = errors.New("ldap: the search was not completed")
+)
+
+// Config is the configuration for checking passwords against an LDAP server
+type Config struct {
+	// The LDAP server, like ldaps://ldap.example.com or ldap://localhost:389
+	URL string
+
+	// Where users are searched for, like dc=example,dc=com
+	BaseDN string
+
+	// The filter for finding a user, where %s is replaced with the username.
+	// The default is (uid=%s). For Active Directory, use (sAMAccountName=%s).
+	UserFilter string
+
+	// An optional filter that users must also match, like
+	// (memberOf=cn=staff,ou=groups,dc=example,dc=com)
+	GroupFilter string
+
+	// The account that is used for searching, or empty for searching
+	// without logging in
+	BindDN       string
+	BindPassword string
+
+	Timeout   time.Duration
+	TLSConfig *tls.Config
+}
+
+// Entry is an entry in the LDAP directory
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Get returns the first value of the given attribute, or an empty string
+func (e *Entry) Get(attribute string) string {
+	for name, values := range e.Attributes {
+		if strings.EqualFold(name, attribute) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// conn is a connection to an LDAP server
+type conn struct {
+	c         net.Conn
+	r         *bufio.Reader
+	messageID int
+	timeout   time.Duration
+}
+
+// dial connects to the LDAP server in the configuration
+func (cfg *Config) dial() (*conn, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	host := u.Host
+	var c net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		c, err = net.DialTimeout("tcp", host, timeout)
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		tlsConfig := cfg.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{ServerName: u.Hostname()}
+		}
+		c, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", host, tlsConfig)
+	default:
+		return nil, errScheme
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &conn{c: c, r: bufio.NewReader(c), timeout: timeout}, nil
+}
+
+// send writes a message with the given operation, and returns the message ID
+func (lc *conn) send(op []byte) (int, error) {
+	lc.messageID++
+	lc.c.SetDeadline(time.Now().Add(lc.timeout))
+	_, err := lc.c.Write(encode(tagSequence, encodeInt(tagInteger, lc.messageID), op))
+	return lc.messageID, err
+}
+
+// receive reads the operation of the next message with the given message ID
+func (lc *conn) receive(id int) (*element, error) {
+	for {
+		msg, err := readMessage(lc.r)
+		if err != nil {
+			return nil, err
+		}
+		if msg.tag != tagSequence || len(msg.children) < 2 {
+			return nil, errMalformed
+		}
+		if msg.children[0].decodeInt() == id {
+			return msg.children[1], nil
+		}
+	}
+}
+
+// result checks the result code of a response
+func result(op *element) error {
+	if len(op.children) < 3 {
+		return errMalformed
+	}
+	switch code := op.children[0].decodeInt(); code {
+	case resultSuccess:
+		return nil
+	case resultInvalidCredentials:
+		return ErrInvalidCredentials
+	default:
+		if message := string(op.children[2].data); message != "" {
+			return fmt.Errorf("ldap: error %d: %s", code, message)
+		}
+		return fmt.Errorf("ldap: error %d", code)
+	}
+}
+
+// bind logs in with the given DN and password
+func (lc *conn) bind(dn, password string) error {
+	id, err := lc.send(encode(tagBindRequest, encodeInt(tagInteger, 3), encodeString(dn), encode(tagSimpleAuth, []byte(password))))
+	if err != nil {
+		return err
+	}
+	op, err := lc.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != tagBindResponse {
+		return errUnexpected
+	}
+	return result(op)
+}
+
+// search returns the entries below the base DN that match the filter
+func (lc *conn) search(baseDN, filter string, sizeLimit int, attributes []string) ([]*Entry, error) {
+	encodedFilter, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var attrs [][]byte
+	for _, attr := range attributes {
+		attrs = append(attrs, encodeString(attr))
+	}
+	id, err := lc.send(encode(tagSearchRequest,
+		encodeString(baseDN),
+		encodeInt(tagEnumerated, 2), // the whole subtree
+		encodeInt(tagEnumerated, 0), // never dereference aliases
+		encodeInt(tagInteger, sizeLimit),
+		encodeInt(tagInteger, int(lc.timeout/time.Second)),
+		encode(tagBoolean, []byte{0}),
+		encodedFilter,
+		encode(tagSequence, attrs...)))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*Entry
+	for {
+		op, err := lc.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case tagSearchEntry:
+			if len(op.children) < 2 {
+				return nil, errMalformed
+			}
+			entry := &Entry{DN: string(op.children[0].data), Attributes: make(map[string][]string)}
+			for _, attr := range op.children[1].children {
+				if len(attr.children) < 2 {
+					continue
+				}
+				name := string(attr.children[0].data)
+				for _, value := range attr.children[1].children {
+					entry.Attributes[name] = append(entry.Attributes[name], string(value.data))
+				}
+			}
+			entries = append(entries, entry)
+		case tagSearchReference:
+			// Referrals to other servers are not followed
+		case tagSearchDone:
+			if err := result(op); err != nil {
+				return nil, err
+			}
+			return entries, nil
+		default:
+			return nil, errNotSearched
+		}
+	}
+}
+
+// close logs out and closes the connection
+func (lc *conn) close() {
+	lc.send(encode(tagUnbindRequest))
+	lc.c.Close()
+}
+
+// Authenticate finds the user in the directory, and checks the password by
+// logging in as that user. Returns the entry for the user.
+func (cfg *Config) Authenticate(username, password string) (*Entry, error) {
+	// An empty password would be an anonymous login, which always succeeds
+	if password == "" {
+		return nil, errNoPassword
+	}
+	if username == "" {
+		return nil, errNoUsername
+	}
+	if cfg.BaseDN == "" {
+		return nil, errNoBaseDN
+	}
+	userFilter := cfg.UserFilter
+	if userFilter == "" {
+		userFilter = "(uid=%s)"
+	} else if !strings.Contains(userFilter, "%s") {
+		return nil, errUserFilter
+	}
+	filter := strings.Replace(userFilter, "%s", EscapeFilter(username), -1)
+	if cfg.GroupFilter != "" {
+		filter = "(&" + filter + cfg.GroupFilter + ")"
+	}
+
+	lc, err := cfg.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer lc.close()
+	if cfg.BindDN != "" {
+		if err := lc.bind(cfg.BindDN, cfg.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+	entries, err := lc.search(cfg.BaseDN, filter, 2, []string{"mail", "cn", "displayName"})
+	if err != nil {
+		return nil, err
+	}
+	switch len(entries) {
+	case 0:
+		return nil, errNoUser
+	case 1:
+	default:
+		return nil, errManyUsers
+	}
+	if err := lc.bind(entries[0].DN, password); err != nil {
+		return nil, err
+	}
+	return entries[0], nil
+}
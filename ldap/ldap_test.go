@@ -0,0 +1,95 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+// fakeServer accepts one connection, with the user "uid=bob,dc=example,dc=com"
+// and the password "secret"
+func fakeServer(t *testing.T, l net.Listener) {
+	c, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+	reply := func(id int, op []byte) {
+		c.Write(encode(tagSequence, encodeInt(tagInteger, id), op))
+	}
+	ldapResult := func(code int) [][]byte {
+		return [][]byte{encodeInt(tagEnumerated, code), encodeString(""), encodeString("")}
+	}
+	for {
+		msg, err := readMessage(r)
+		if err != nil {
+			return
+		}
+		id, op := msg.children[0].decodeInt(), msg.children[1]
+		switch op.tag {
+		case tagBindRequest:
+			code := resultInvalidCredentials
+			if string(op.children[1].data) == "uid=bob,dc=example,dc=com" && string(op.children[2].data) == "secret" {
+				code = resultSuccess
+			}
+			reply(id, encode(tagBindResponse, ldapResult(code)...))
+		case tagSearchRequest:
+			want, _ := compileFilter("(uid=bob)")
+			if bytes.Equal(encode(op.children[6].tag, op.children[6].data), want) {
+				attrs := encode(tagSequence, encode(tagSequence, encodeString("mail"), encode(tagSet, encodeString("bob@example.com"))))
+				reply(id, encode(tagSearchEntry, encodeString("uid=bob,dc=example,dc=com"), attrs))
+			}
+			reply(id, encode(tagSearchDone, ldapResult(resultSuccess)...))
+		case tagUnbindRequest:
+			return
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	for _, tc := range []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"bob", "secret", true},
+		{"bob", "wrong", false},
+		{"alice", "secret", false},
+		{"bob", "", false},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go fakeServer(t, l)
+		cfg := &Config{URL: "ldap://" + l.Addr().String(), BaseDN: "dc=example,dc=com"}
+		entry, err := cfg.Authenticate(tc.username, tc.password)
+		l.Close()
+		if tc.ok {
+			if err != nil {
+				t.Errorf("%s: %s", tc.username, err)
+			} else if entry.Get("mail") != "bob@example.com" {
+				t.Errorf("unexpected entry: %v", entry)
+			}
+		} else if err == nil {
+			t.Errorf("%s with password %q should not be accepted", tc.username, tc.password)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	for _, filter := range []string{"(uid=bob)", "(&(objectClass=person)(|(uid=b*)(cn=*o*b)))", "(!(mail=*))", "(age>=3)"} {
+		if _, err := compileFilter(filter); err != nil {
+			t.Errorf("%s: %s", filter, err)
+		}
+	}
+	for _, filter := range []string{"", "uid=bob", "(uid=bob", "(&)", "(cn~=bob)", "(uid=\\4)"} {
+		if _, err := compileFilter(filter); err == nil {
+			t.Errorf("%s should not be accepted", filter)
+		}
+	}
+	if got := EscapeFilter("*)(uid=*"); got != "\\2a\\29\\28uid=\\2a" {
+		t.Errorf("unexpected escaped value: %s", got)
+	}
+}
@@ -0,0 +1,312 @@
+// Package locale negotiates the locale of a request from Accept-Language,
+// and formats dates, numbers and amounts of money for that locale
+package locale
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Locale has what is needed for formatting dates, numbers and amounts of
+// money in one locale
+type Locale struct {
+	Tag     string
+	Decimal string // the decimal separator
+	Group   string // the separator between groups of thousands
+	// The pattern for amounts, where ¤ is the currency symbol and # the
+	// number
+	Currency string
+	// The patterns for dates, where d is the day, M the month and y the year.
+	// dd, MM and yy have two digits, MMM is the short name of the month and
+	// MMMM the name. Text within '' is not replaced.
+	Short, Medium, Long string
+	Months              []string
+	ShortMonths         []string
+}
+
+var (
+	englishMonths = []string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"}
+	englishShort  = []string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}
+	numericMonths = []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12"}
+)
+
+// locales are the available locales, by tag
+var locales = map[string]*Locale{
+	"en":    {"en", ".", ",", "¤#", "M/d/yy", "MMM d, yyyy", "MMMM d, yyyy", englishMonths, englishShort},
+	"en-GB": {"en-GB", ".", ",", "¤#", "dd/MM/yyyy", "d MMM yyyy", "d MMMM yyyy", englishMonths, englishShort},
+	"de": {"de", ",", ".", "#\u00a0¤", "dd.MM.yy", "dd.MM.yyyy", "d. MMMM yyyy",
+		[]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		[]string{"Jan.", "Feb.", "März", "Apr.", "Mai", "Juni", "Juli", "Aug.", "Sept.", "Okt.", "Nov.", "Dez."}},
+	"fr": {"fr", ",", "\u202f", "#\u00a0¤", "dd/MM/yyyy", "d MMM yyyy", "d MMMM yyyy",
+		[]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		[]string{"janv.", "févr.", "mars", "avr.", "mai", "juin", "juil.", "août", "sept.", "oct.", "nov.", "déc."}},
+	"es": {"es", ",", ".", "#\u00a0¤", "d/M/yy", "d MMM yyyy", "d 'de' MMMM 'de' yyyy",
+		[]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		[]string{"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sept", "oct", "nov", "dic"}},
+	"it": {"it", ",", ".", "#\u00a0¤", "dd/MM/yy", "d MMM yyyy", "d MMMM yyyy",
+		[]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		[]string{"gen", "feb", "mar", "apr", "mag", "giu", "lug", "ago", "set", "ott", "nov", "dic"}},
+	"nl": {"nl", ",", ".", "¤\u00a0#", "dd-MM-yyyy", "d MMM yyyy", "d MMMM yyyy",
+		[]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		[]string{"jan", "feb", "mrt", "apr", "mei", "jun", "jul", "aug", "sep", "okt", "nov", "dec"}},
+	"nb": {"nb", ",", "\u00a0", "#\u00a0¤", "dd.MM.yyyy", "d. MMM yyyy", "d. MMMM yyyy",
+		[]string{"januar", "februar", "mars", "april", "mai", "juni", "juli", "august", "september", "oktober", "november", "desember"},
+		[]string{"jan.", "feb.", "mar.", "apr.", "mai", "jun.", "jul.", "aug.", "sep.", "okt.", "nov.", "des."}},
+	"sv": {"sv", ",", "\u00a0", "#\u00a0¤", "yyyy-MM-dd", "d MMM yyyy", "d MMMM yyyy",
+		[]string{"januari", "februari", "mars", "april", "maj", "juni", "juli", "augusti", "september", "oktober", "november", "december"},
+		[]string{"jan.", "feb.", "mars", "apr.", "maj", "juni", "juli", "aug.", "sep.", "okt.", "nov.", "dec."}},
+	"da": {"da", ",", ".", "#\u00a0¤", "dd.MM.yyyy", "d. MMM yyyy", "d. MMMM yyyy",
+		[]string{"januar", "februar", "marts", "april", "maj", "juni", "juli", "august", "september", "oktober", "november", "december"},
+		[]string{"jan.", "feb.", "mar.", "apr.", "maj", "jun.", "jul.", "aug.", "sep.", "okt.", "nov.", "dec."}},
+	"pt": {"pt", ",", "\u00a0", "#\u00a0¤", "dd/MM/yyyy", "d 'de' MMM 'de' yyyy", "d 'de' MMMM 'de' yyyy",
+		[]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		[]string{"jan.", "fev.", "mar.", "abr.", "mai.", "jun.", "jul.", "ago.", "set.", "out.", "nov.", "dez."}},
+	"pt-BR": {"pt-BR", ",", ".", "¤\u00a0#", "dd/MM/yyyy", "d 'de' MMM 'de' yyyy", "d 'de' MMMM 'de' yyyy",
+		[]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		[]string{"jan.", "fev.", "mar.", "abr.", "mai.", "jun.", "jul.", "ago.", "set.", "out.", "nov.", "dez."}},
+	// The names of the months are in the genitive case, as they are in dates
+	"pl": {"pl", ",", "\u00a0", "#\u00a0¤", "dd.MM.yyyy", "d MMM yyyy", "d MMMM yyyy",
+		[]string{"stycznia", "lutego", "marca", "kwietnia", "maja", "czerwca", "lipca", "sierpnia", "września", "października", "listopada", "grudnia"},
+		[]string{"sty", "lut", "mar", "kwi", "maj", "cze", "lip", "sie", "wrz", "paź", "lis", "gru"}},
+	"ja": {"ja", ".", ",", "¤#", "yyyy/MM/dd", "yyyy/MM/dd", "yyyy年M月d日", numericMonths, numericMonths},
+	"zh": {"zh", ".", ",", "¤#", "yyyy/M/d", "yyyy年M月d日", "yyyy年M月d日", numericMonths, numericMonths},
+}
+
+// Default is the locale that is used when no other locale matches
+var Default = locales["en"]
+
+// Tags returns the tags of all the available locales, sorted
+func Tags() []string {
+	tags := make([]string, 0, len(locales))
+	for tag := range locales {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// language returns the language of a tag, like "pt" for "pt-BR"
+func language(tag string) string {
+	if pos := strings.IndexAny(tag, "-_"); pos != -1 {
+		return tag[:pos]
+	}
+	return tag
+}
+
+// match returns the first supported tag that is the given tag, or that has
+// the same language, or an empty string
+func match(tag string, supported []string) string {
+	tag = strings.Replace(tag, "_", "-", -1)
+	for _, s := range supported {
+		if strings.EqualFold(s, tag) {
+			return s
+		}
+	}
+	for _, s := range supported {
+		if strings.EqualFold(s, language(tag)) {
+			return s
+		}
+	}
+	for _, s := range supported {
+		if strings.EqualFold(language(s), language(tag)) {
+			return s
+		}
+	}
+	return ""
+}
+
+// Negotiate returns the supported tag that is the best match for the
+// languages in an Accept-Language header, or fallback if none of them
+// match. If supported is empty, all the available locales are supported.
+func Negotiate(acceptLanguage string, supported []string, fallback string) string {
+	if len(supported) == 0 {
+		supported = Tags()
+	}
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var languages []weighted
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > 0 {
+			languages = append(languages, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].q > languages[j].q
+	})
+	for _, l := range languages {
+		if tag := match(l.tag, supported); tag != "" {
+			return tag
+		}
+	}
+	return fallback
+}
+
+// Get returns the locale for a tag, or for the language of the tag, or
+// the default locale
+func Get(tag string) *Locale {
+	if l, ok := locales[match(tag, Tags())]; ok {
+		return l
+	}
+	return Default
+}
+
+// FormatDate formats a date in the "short", "medium" or "long" style
+func (l *Locale) FormatDate(t time.Time, style string) string {
+	pattern := l.Medium
+	switch style {
+	case "short":
+		pattern = l.Short
+	case "long":
+		pattern = l.Long
+	}
+	var sb strings.Builder
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		if r == '\'' {
+			end := i + 1
+			for end < len(runes) && runes[end] != '\'' {
+				end++
+			}
+			sb.WriteString(string(runes[i+1 : end]))
+			i = end + 1
+			continue
+		}
+		if r != 'd' && r != 'M' && r != 'y' {
+			sb.WriteRune(r)
+			i++
+			continue
+		}
+		n := 1
+		for i+n < len(runes) && runes[i+n] == r {
+			n++
+		}
+		i += n
+		switch {
+		case r == 'd' && n == 1:
+			sb.WriteString(strconv.Itoa(t.Day()))
+		case r == 'd':
+			sb.WriteString(t.Format("02"))
+		case r == 'M' && n == 1:
+			sb.WriteString(strconv.Itoa(int(t.Month())))
+		case r == 'M' && n == 2:
+			sb.WriteString(t.Format("01"))
+		case r == 'M' && n == 3:
+			sb.WriteString(l.ShortMonths[t.Month()-1])
+		case r == 'M':
+			sb.WriteString(l.Months[t.Month()-1])
+		case r == 'y' && n == 2:
+			sb.WriteString(t.Format("06"))
+		default:
+			sb.WriteString(strconv.Itoa(t.Year()))
+		}
+	}
+	return sb.String()
+}
+
+// FormatNumber formats a number with the given number of decimals, or
+// with up to three decimals if decimals is negative
+func (l *Locale) FormatNumber(f float64, decimals int) string {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	var s string
+	if decimals < 0 {
+		s = strconv.FormatFloat(f, 'f', 3, 64)
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	} else {
+		s = strconv.FormatFloat(f, 'f', decimals, 64)
+	}
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+		if strings.Trim(s, "0.") == "" {
+			// No "-0"
+			sign = ""
+		}
+	}
+	integer, fraction := s, ""
+	if pos := strings.Index(s, "."); pos != -1 {
+		integer, fraction = s[:pos], s[pos+1:]
+	}
+	var sb strings.Builder
+	sb.WriteString(sign)
+	for i, digit := range integer {
+		if i > 0 && (len(integer)-i)%3 == 0 {
+			sb.WriteString(l.Group)
+		}
+		sb.WriteRune(digit)
+	}
+	if fraction != "" {
+		sb.WriteString(l.Decimal + fraction)
+	}
+	return sb.String()
+}
+
+// currencies are the symbols and number of decimals of some currencies.
+// The symbol is only used in the listed languages, or in all languages if
+// none are listed. The currency code is used otherwise.
+var currencies = map[string]struct {
+	symbol    string
+	decimals  int
+	languages []string
+}{
+	"EUR": {"€", 2, nil},
+	"GBP": {"£", 2, nil},
+	"USD": {"$", 2, []string{"en"}},
+	"JPY": {"¥", 0, []string{"ja", "en"}},
+	"CNY": {"¥", 2, []string{"zh"}},
+	"INR": {"₹", 2, nil},
+	"BRL": {"R$", 2, []string{"pt"}},
+	"PLN": {"zł", 2, []string{"pl"}},
+	"NOK": {"kr", 2, []string{"nb"}},
+	"SEK": {"kr", 2, []string{"sv"}},
+	"DKK": {"kr.", 2, []string{"da"}},
+}
+
+// FormatMoney formats an amount in a currency, given as a code like "EUR"
+func (l *Locale) FormatMoney(amount float64, currency string) string {
+	currency = strings.ToUpper(currency)
+	symbol, decimals := currency, 2
+	if c, ok := currencies[currency]; ok {
+		decimals = c.decimals
+		if len(c.languages) == 0 {
+			symbol = c.symbol
+		}
+		for _, lang := range c.languages {
+			if lang == language(l.Tag) {
+				symbol = c.symbol
+			}
+		}
+	}
+	number := l.FormatNumber(math.Abs(amount), decimals)
+	pattern := l.Currency
+	if symbol == currency && strings.Contains(pattern, "¤#") {
+		// Codes look better with a space, like "USD 5.00"
+		pattern = strings.Replace(pattern, "¤#", "¤\u00a0#", 1)
+	}
+	result := strings.Replace(strings.Replace(pattern, "#", number, 1), "¤", symbol, 1)
+	if amount < 0 && number != l.FormatNumber(0, decimals) {
+		return "-" + result
+	}
+	return result
+}
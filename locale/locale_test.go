@@ -0,0 +1,77 @@
+package locale
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	for header, expected := range map[string]string{
+		"da, en-GB;q=0.8, en;q=0.7": "da",
+		"en-US,en;q=0.9":            "en",
+		"pt-PT;q=0.5, de-CH":        "de",
+		"pt-BR":                     "pt-BR",
+		"xx, *":                     "fallback",
+		"":                          "fallback",
+	} {
+		if got := Negotiate(header, nil, "fallback"); got != expected {
+			t.Errorf("%q: got %s, expected %s", header, got, expected)
+		}
+	}
+	if got := Negotiate("de, fr;q=0.5", []string{"en", "fr"}, "en"); got != "fr" {
+		t.Errorf("got %s, expected fr", got)
+	}
+}
+
+func TestFormatDate(t *testing.T) {
+	d := time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	for _, c := range []struct{ tag, style, expected string }{
+		{"en", "short", "3/5/24"},
+		{"en", "medium", "Mar 5, 2024"},
+		{"en-GB", "long", "5 March 2024"},
+		{"de", "long", "5. März 2024"},
+		{"es", "long", "5 de marzo de 2024"},
+		{"ja", "long", "2024年3月5日"},
+		{"sv", "short", "2024-03-05"},
+	} {
+		if got := Get(c.tag).FormatDate(d, c.style); got != c.expected {
+			t.Errorf("%s %s: got %s, expected %s", c.tag, c.style, got, c.expected)
+		}
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	if got := Get("en").FormatNumber(1234567.891, -1); got != "1,234,567.891" {
+		t.Errorf("got %s", got)
+	}
+	if got := Get("de").FormatNumber(-1234.5, 2); got != "-1.234,50" {
+		t.Errorf("got %s", got)
+	}
+	if got := Get("nb-NO").FormatNumber(1000, 0); got != "1\u00a0000" {
+		t.Errorf("got %q", got)
+	}
+	if got := Get("en").FormatNumber(-0.0001, 2); got != "0.00" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	for _, c := range []struct {
+		tag      string
+		amount   float64
+		currency string
+		expected string
+	}{
+		{"en", 1234.5, "USD", "$1,234.50"},
+		{"en", -5, "eur", "-€5.00"},
+		{"de", 1234.5, "EUR", "1.234,50\u00a0€"},
+		{"de", 10, "USD", "10,00\u00a0USD"},
+		{"ja", 1500, "JPY", "¥1,500"},
+		{"nb", 99.9, "NOK", "99,90\u00a0kr"},
+		{"en", 3, "NOK", "NOK\u00a03.00"},
+	} {
+		if got := Get(c.tag).FormatMoney(c.amount, c.currency); got != c.expected {
+			t.Errorf("%s %v %s: got %q, expected %q", c.tag, c.amount, c.currency, got, c.expected)
+		}
+	}
+}
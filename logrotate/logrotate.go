@@ -0,0 +1,115 @@
+// Package logrotate provides a log file that is rotated when it gets too
+// large or too old, and that only keeps a number of old files
+package logrotate
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The layout of the timestamp that rotated files get as a suffix
+const suffixLayout = "20060102-150405.000"
+
+// File is a log file that is rotated when it gets too large or too old
+type File struct {
+	mut      sync.Mutex
+	filename string
+	maxSize  int64
+	maxAge   time.Duration
+	keep     int
+	f        *os.File
+	size     int64
+	opened   time.Time
+}
+
+// Open opens or creates a log file that is rotated when it is larger than
+// maxSize bytes or older than maxAge, where 0 means no limit. Only the keep
+// newest rotated files are kept, or all of them if keep is 0.
+func Open(filename string, maxSize int64, maxAge time.Duration, keep int) (*File, error) {
+	lf := &File{filename: filename, maxSize: maxSize, maxAge: maxAge, keep: keep}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+// open opens the log file for appending
+func (lf *File) open() error {
+	f, err := os.OpenFile(lf.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lf.f = f
+	lf.size = fi.Size()
+	lf.opened = time.Now()
+	if lf.size > 0 {
+		// The file was created before this process started
+		lf.opened = fi.ModTime()
+	}
+	return nil
+}
+
+// Write writes a log entry, after rotating the file if needed
+func (lf *File) Write(p []byte) (int, error) {
+	lf.mut.Lock()
+	defer lf.mut.Unlock()
+	if lf.size > 0 && ((lf.maxSize > 0 && lf.size+int64(len(p)) > lf.maxSize) || (lf.maxAge > 0 && time.Since(lf.opened) > lf.maxAge)) {
+		if err := lf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := lf.f.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file, opens a new one and removes the oldest
+// rotated files
+func (lf *File) rotate() error {
+	if err := lf.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(lf.filename, lf.filename+"."+time.Now().Format(suffixLayout)); err != nil {
+		return err
+	}
+	if err := lf.open(); err != nil {
+		return err
+	}
+	if lf.keep > 0 {
+		rotated := lf.Rotated()
+		for len(rotated) > lf.keep {
+			os.Remove(rotated[0])
+			rotated = rotated[1:]
+		}
+	}
+	return nil
+}
+
+// Rotated returns the filenames of the rotated files, the oldest first
+func (lf *File) Rotated() []string {
+	matches, _ := filepath.Glob(lf.filename + ".*")
+	var rotated []string
+	for _, match := range matches {
+		if _, err := time.Parse(suffixLayout, strings.TrimPrefix(match, lf.filename+".")); err == nil {
+			rotated = append(rotated, match)
+		}
+	}
+	sort.Strings(rotated)
+	return rotated
+}
+
+// Close closes the log file
+func (lf *File) Close() error {
+	lf.mut.Lock()
+	defer lf.mut.Unlock()
+	return lf.f.Close()
+}
@@ -0,0 +1,37 @@
+package logrotate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logrotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "requests.log")
+
+	lf, err := Open(filename, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	for i := 0; i < 5; i++ {
+		if _, err := lf.Write([]byte("12345678\n")); err != nil {
+			t.Fatal(err)
+		}
+		// The rotated files are named by the time, in milliseconds
+		time.Sleep(2 * time.Millisecond)
+	}
+	if rotated := lf.Rotated(); len(rotated) != 2 {
+		t.Errorf("expected 2 rotated files, got %v", rotated)
+	}
+	if data, _ := ioutil.ReadFile(filename); string(data) != "12345678\n" {
+		t.Errorf("unexpected contents: %q", data)
+	}
+}
@@ -0,0 +1,275 @@
+// Package cart provides a shopping cart for Lua scripts, that is stored in
+// a database backend for each visitor or user
+package cart
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xyproto/gopher-lua"
+	"github.com/xyproto/pinterface"
+)
+
+// Identifier for the Cart class in Lua
+const lCartClass = "CART"
+
+// Each item is stored as a key with this prefix, for the owner of the cart
+const itemPrefix = "cart:"
+
+// Item is a product in a cart. Prices are in the smallest currency unit, like cents.
+type Item struct {
+	SKU      string
+	Quantity int64
+	Price    int64
+}
+
+// Cart is the shopping cart of a visitor or user
+type Cart struct {
+	hash  pinterface.IHashMap
+	owner string
+}
+
+// New returns the cart for the given owner, stored in the given hash map
+func New(hash pinterface.IHashMap, owner string) *Cart {
+	return &Cart{hash, owner}
+}
+
+// Item returns the item with the given SKU. The quantity is 0 if the item
+// is not in the cart.
+func (c *Cart) Item(sku string) Item {
+	item := Item{SKU: sku}
+	value, err := c.hash.Get(c.owner, itemPrefix+sku)
+	if err != nil {
+		return item
+	}
+	fields := strings.SplitN(value, "|", 2)
+	item.Quantity, _ = strconv.ParseInt(fields[0], 10, 64)
+	if len(fields) == 2 {
+		item.Price, _ = strconv.ParseInt(fields[1], 10, 64)
+	}
+	return item
+}
+
+// Set sets the quantity and price of an item. Items with a quantity of 0 or
+// less are removed.
+func (c *Cart) Set(item Item) error {
+	if item.Quantity <= 0 {
+		return c.Remove(item.SKU)
+	}
+	return c.hash.Set(c.owner, itemPrefix+item.SKU, strconv.FormatInt(item.Quantity, 10)+"|"+strconv.FormatInt(item.Price, 10))
+}
+
+// Add adds to the quantity of an item, and returns the new quantity. If the
+// price is negative, the current price is kept.
+func (c *Cart) Add(sku string, quantity, price int64) (int64, error) {
+	item := c.Item(sku)
+	item.Quantity += quantity
+	if price >= 0 {
+		item.Price = price
+	}
+	if item.Quantity < 0 {
+		item.Quantity = 0
+	}
+	return item.Quantity, c.Set(item)
+}
+
+// Remove removes an item from the cart
+func (c *Cart) Remove(sku string) error {
+	return c.hash.DelKey(c.owner, itemPrefix+sku)
+}
+
+// Items returns all the items in the cart, sorted by SKU
+func (c *Cart) Items() ([]Item, error) {
+	keys, err := c.hash.Keys(c.owner)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	var items []Item
+	for _, key := range keys {
+		if strings.HasPrefix(key, itemPrefix) {
+			if item := c.Item(strings.TrimPrefix(key, itemPrefix)); item.Quantity > 0 {
+				items = append(items, item)
+			}
+		}
+	}
+	return items, nil
+}
+
+// Totals returns the total quantity and the total price of all items
+func (c *Cart) Totals() (int64, int64, error) {
+	items, err := c.Items()
+	if err != nil {
+		return 0, 0, err
+	}
+	var count, total int64
+	for _, item := range items {
+		count += item.Quantity
+		total += item.Quantity * item.Price
+	}
+	return count, total, nil
+}
+
+// Clear removes all items from the cart
+func (c *Cart) Clear() error {
+	items, err := c.Items()
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := c.Remove(item.SKU); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the first argument, "self", and cast it from userdata to a cart
+func checkCart(L *lua.LState) *Cart {
+	ud := L.CheckUserData(1)
+	if c, ok := ud.Value.(*Cart); ok {
+		return c
+	}
+	L.ArgError(1, "cart expected")
+	return nil
+}
+
+// itemTable converts an item to a Lua table
+func itemTable(L *lua.LState, item Item) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("sku", lua.LString(item.SKU))
+	t.RawSetString("qty", lua.LNumber(item.Quantity))
+	t.RawSetString("price", lua.LNumber(item.Price))
+	t.RawSetString("subtotal", lua.LNumber(item.Quantity*item.Price))
+	return t
+}
+
+// Add to the quantity of an item, with an optional price. Returns the new quantity.
+// cart:add(string[, number[, number]]) -> number
+func cartAdd(L *lua.LState) int {
+	c := checkCart(L) // arg 1
+	quantity, err := c.Add(L.CheckString(2), int64(L.OptNumber(3, 1)), int64(L.OptNumber(4, -1)))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(lua.LNumber(quantity))
+	return 1 // number of results
+}
+
+// Set the quantity of an item, with an optional price. Returns true if successful.
+// cart:set(string, number[, number]) -> bool
+func cartSet(L *lua.LState) int {
+	c := checkCart(L) // arg 1
+	item := c.Item(L.CheckString(2))
+	item.Quantity = int64(L.CheckNumber(3))
+	if L.GetTop() >= 4 {
+		item.Price = int64(L.CheckNumber(4))
+	}
+	L.Push(lua.LBool(nil == c.Set(item)))
+	return 1 // number of results
+}
+
+// Remove an item. Returns true if successful.
+// cart:remove(string) -> bool
+func cartRemove(L *lua.LState) int {
+	c := checkCart(L) // arg 1
+	L.Push(lua.LBool(nil == c.Remove(L.CheckString(2))))
+	return 1 // number of results
+}
+
+// Get an item, as a table with sku, qty, price and subtotal. The qty is 0
+// if the item is not in the cart.
+// cart:get(string) -> table
+func cartGet(L *lua.LState) int {
+	c := checkCart(L) // arg 1
+	L.Push(itemTable(L, c.Item(L.CheckString(2))))
+	return 1 // number of results
+}
+
+// Get all items, as a list of tables with sku, qty, price and subtotal.
+// cart:items() -> table
+func cartItems(L *lua.LState) int {
+	c := checkCart(L) // arg 1
+	t := L.NewTable()
+	items, err := c.Items()
+	if err == nil {
+		for _, item := range items {
+			t.Append(itemTable(L, item))
+		}
+	}
+	L.Push(t)
+	return 1 // number of results
+}
+
+// Get the total quantity of all items
+// cart:count() -> number
+func cartCount(L *lua.LState) int {
+	c := checkCart(L) // arg 1
+	count, _, _ := c.Totals()
+	L.Push(lua.LNumber(count))
+	return 1 // number of results
+}
+
+// Get the total price of all items
+// cart:total() -> number
+func cartTotal(L *lua.LState) int {
+	c := checkCart(L) // arg 1
+	_, total, _ := c.Totals()
+	L.Push(lua.LNumber(total))
+	return 1 // number of results
+}
+
+// Remove all items. Returns true if successful.
+// cart:clear() -> bool
+func cartClear(L *lua.LState) int {
+	c := checkCart(L) // arg 1
+	L.Push(lua.LBool(nil == c.Clear()))
+	return 1 // number of results
+}
+
+// String representation
+// tostring(cart) -> string
+func cartToString(L *lua.LState) int {
+	L.Push(lua.LString("cart"))
+	return 1 // number of results
+}
+
+// The cart methods that are to be registered
+var cartMethods = map[string]lua.LGFunction{
+	"__tostring": cartToString,
+	"add":        cartAdd,
+	"set":        cartSet,
+	"remove":     cartRemove,
+	"get":        cartGet,
+	"items":      cartItems,
+	"count":      cartCount,
+	"total":      cartTotal,
+	"clear":      cartClear,
+}
+
+// Load makes the Cart function available to Lua scripts. The given function
+// returns the cart for the current visitor or user.
+func Load(L *lua.LState, current func() (*Cart, error)) {
+	// Register the Cart class and the methods that belongs with it.
+	mt := L.NewTypeMetatable(lCartClass)
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, cartMethods)
+
+	// Get the cart of the current visitor or user, or nil and an error message
+	L.SetGlobal("Cart", L.NewFunction(func(L *lua.LState) int {
+		c, err := current()
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		ud := L.NewUserData()
+		ud.Value = c
+		L.SetMetatable(ud, L.GetTypeMetatable(lCartClass))
+		L.Push(ud)
+		return 1 // number of results
+	}))
+}
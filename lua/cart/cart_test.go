@@ -0,0 +1,34 @@
+package cart
+
+import (
+	"testing"
+
+	"github.com/xyproto/algernon/memdb"
+)
+
+func TestCart(t *testing.T) {
+	c := New(memdb.NewHashMap(memdb.New(), "visitors"), "id:abc")
+	if _, err := c.Add("apple", 2, 150); err != nil {
+		t.Fatal(err)
+	}
+	c.Add("apple", 1, -1)
+	c.Add("pear", 1, 200)
+	if n, _ := c.Add("plum", -1, 10); n != 0 {
+		t.Errorf("unexpected quantity: %d", n)
+	}
+	count, total, err := c.Totals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 || total != 650 {
+		t.Errorf("unexpected totals: %d items, %d in total", count, total)
+	}
+	items, _ := c.Items()
+	if len(items) != 2 || items[0].SKU != "apple" || items[0].Quantity != 3 {
+		t.Errorf("unexpected items: %v", items)
+	}
+	c.Clear()
+	if items, _ := c.Items(); len(items) != 0 {
+		t.Errorf("the cart should be empty: %v", items)
+	}
+}
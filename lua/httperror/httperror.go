@@ -0,0 +1,134 @@
+// Package httperror provides a structured error type that can be raised
+// from Lua and turned into an HTTP error response by the server
+package httperror
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/gopher-lua"
+)
+
+// Class is an identifier for the Error class in Lua
+const Class = "Error"
+
+// Error is an error with an HTTP status code, a message and optional details
+type Error struct {
+	Code    int
+	Message string
+	Details map[string]interface{}
+}
+
+// New creates a new Error. If the message is empty, the standard text
+// for the status code is used.
+func New(code int, message string) *Error {
+	if code < 400 || code > 599 {
+		code = http.StatusInternalServerError
+	}
+	if message == "" {
+		message = http.StatusText(code)
+	}
+	return &Error{Code: code, Message: message}
+}
+
+// Title returns the status code and the standard text for it, like "404 Not Found"
+func (e *Error) Title() string {
+	return fmt.Sprintf("%d %s", e.Code, http.StatusText(e.Code))
+}
+
+// Error returns the status code and the message
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d: %s", e.Code, e.Message)
+}
+
+// From checks if the given error, possibly returned from a Lua script,
+// is or contains an Error
+func From(err error) (*Error, bool) {
+	switch v := err.(type) {
+	case *Error:
+		return v, true
+	case *lua.ApiError:
+		if ud, ok := v.Object.(*lua.LUserData); ok {
+			e, ok := ud.Value.(*Error)
+			return e, ok
+		}
+	}
+	return nil, false
+}
+
+// Get the first argument, "self", and cast it from userdata to an Error
+func checkError(L *lua.LState) *Error {
+	ud := L.CheckUserData(1)
+	if e, ok := ud.Value.(*Error); ok {
+		return e
+	}
+	L.ArgError(1, "Error expected")
+	return nil
+}
+
+// Get a field of an Error: code, message or details
+func errorIndex(L *lua.LState) int {
+	e := checkError(L) // arg 1
+	switch L.ToString(2) {
+	case "code":
+		L.Push(lua.LNumber(e.Code))
+	case "message":
+		L.Push(lua.LString(e.Message))
+	case "details":
+		L.Push(detailsTable(L, e.Details))
+	default:
+		L.Push(lua.LNil)
+	}
+	return 1 // number of results
+}
+
+// Convert the details of an Error back to a Lua table
+func detailsTable(L *lua.LState, details map[string]interface{}) *lua.LTable {
+	t := L.NewTable()
+	for k, v := range details {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			L.SetField(t, k, detailsTable(L, v))
+		case int:
+			L.SetField(t, k, lua.LNumber(v))
+		case float64:
+			L.SetField(t, k, lua.LNumber(v))
+		default:
+			L.SetField(t, k, lua.LString(fmt.Sprint(v)))
+		}
+	}
+	return t
+}
+
+// Return the Error as a string
+func errorString(L *lua.LState) int {
+	e := checkError(L) // arg 1
+	L.Push(lua.LString(e.Error()))
+	return 1 // number of results
+}
+
+// Load makes the Error function available to the given Lua state.
+// Error takes a status code, a message (optional) and a table with
+// details (optional), and stops the script with a structured error.
+func Load(L *lua.LState) {
+
+	// Register the Error class and the methods that belongs with it.
+	mt := L.NewTypeMetatable(Class)
+	L.SetField(mt, "__index", L.NewFunction(errorIndex))
+	L.SetField(mt, "__tostring", L.NewFunction(errorString))
+
+	L.SetGlobal("Error", L.NewFunction(func(L *lua.LState) int {
+		e := New(int(L.CheckNumber(1)), L.OptString(2, ""))
+		if details, ok := L.Get(3).(*lua.LTable); ok {
+			e.Details = convert.Table2interfaceMap(details)
+		}
+		ud := L.NewUserData()
+		ud.Value = e
+		L.SetMetatable(ud, L.GetTypeMetatable(Class))
+		// Raise the error. Can be caught with pcall, like any other Lua error.
+		L.Error(ud, 1)
+		return 0 // number of results
+	}))
+
+}
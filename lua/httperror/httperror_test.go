@@ -0,0 +1,37 @@
+package httperror
+
+import (
+	"testing"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestRaise(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	Load(L)
+	err := L.DoString(`Error(404, "no such page", {id = 42, where = {db = "main"}})`)
+	e, ok := From(err)
+	if !ok {
+		t.Fatalf("expected a structured error, got: %v", err)
+	}
+	if e.Code != 404 || e.Message != "no such page" || e.Details["id"] != 42 {
+		t.Errorf("unexpected error: %#v", e)
+	}
+}
+
+func TestCatch(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	Load(L)
+	err := L.DoString(`
+local ok, e = pcall(Error, 403)
+assert(not ok)
+assert(e.code == 403)
+assert(e.message == "Forbidden")
+assert(tostring(e) == "403: Forbidden")
+`)
+	if err != nil {
+		t.Error(err)
+	}
+}
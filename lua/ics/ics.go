@@ -0,0 +1,302 @@
+// Package ics generates iCalendar feeds, as described in RFC 5545, that
+// calendar applications can subscribe to
+package ics
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// Event is an event in a calendar
+type Event struct {
+	UID         string
+	Summary     string
+	Description string
+	Location    string
+	URL         string
+	Start       time.Time
+	End         time.Time
+	AllDay      bool
+	Updated     time.Time
+}
+
+// Calendar is a list of events, with a name and the time zone that the
+// events are shown in, unless they are in UTC
+type Calendar struct {
+	Name     string
+	Location *time.Location
+	Events   []Event
+}
+
+// The layouts that times can be given in, without a time zone
+var timeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+}
+
+var errInvalidTime = errors.New("invalid time")
+
+// ParseTime parses a time like "2024-05-17 18:00" in the given location, or
+// a time with an offset like "2024-05-17T18:00:00+02:00". Returns true if
+// only the date was given.
+func ParseTime(s string, loc *time.Location) (time.Time, bool, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, false, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+		return t, true, nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, false, nil
+		}
+	}
+	return time.Time{}, false, errInvalidTime
+}
+
+// escape escapes a text value
+func escape(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`, "\r", `\n`).Replace(s)
+}
+
+// writeLine writes a content line, folded so that no line is longer than
+// 75 bytes, without splitting UTF-8 sequences
+func writeLine(buf *bytes.Buffer, line string) {
+	limit := 75
+	for len(line) > limit {
+		n := limit
+		for n > 0 && !utf8.RuneStart(line[n]) {
+			n--
+		}
+		buf.WriteString(line[:n])
+		buf.WriteString("\r\n ")
+		line = line[n:]
+		// The space at the start of the next line counts too
+		limit = 74
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+// uid returns the UID of the event, or one that is made from the summary
+// and start time, so that it stays the same every time the feed is made
+func (e *Event) uid() string {
+	if e.UID != "" {
+		return e.UID
+	}
+	sum := sha1.Sum([]byte(e.Summary + "\x00" + e.Start.UTC().Format(time.RFC3339)))
+	return hex.EncodeToString(sum[:]) + "@algernon"
+}
+
+// stamp formats a time as a DATE-TIME in UTC
+func stamp(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// writeTime writes a DTSTART or DTEND property, as a date for all-day
+// events, in the time zone of the calendar, or in UTC
+func (c *Calendar) writeTime(buf *bytes.Buffer, name string, t time.Time, allDay bool) {
+	switch {
+	case allDay:
+		writeLine(buf, name+";VALUE=DATE:"+t.Format("20060102"))
+	case c.Location != nil && c.Location != time.UTC:
+		writeLine(buf, name+";TZID="+c.Location.String()+":"+t.In(c.Location).Format("20060102T150405"))
+	default:
+		writeLine(buf, name+":"+stamp(t))
+	}
+}
+
+// formatOffset formats an UTC offset in seconds, like "+0200"
+func formatOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset/60%60)
+}
+
+// writeTimezone writes a VTIMEZONE component with the UTC offset changes of
+// the location, from the year before the first event to the year after the
+// last event starts
+func (c *Calendar) writeTimezone(buf *bytes.Buffer, from, to time.Time) {
+	writeLine(buf, "BEGIN:VTIMEZONE")
+	writeLine(buf, "TZID:"+c.Location.String())
+	start := time.Date(from.Year()-1, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(to.Year()+2, 1, 1, 0, 0, 0, 0, time.UTC)
+	name, offset := start.In(c.Location).Zone()
+	writeComponent := func(t time.Time, fromOffset, toOffset int, name string) {
+		// The start is given in the local time from before the change
+		kind := "STANDARD"
+		if toOffset > fromOffset {
+			kind = "DAYLIGHT"
+		}
+		writeLine(buf, "BEGIN:"+kind)
+		writeLine(buf, "DTSTART:"+t.In(time.FixedZone("", fromOffset)).Format("20060102T150405"))
+		writeLine(buf, "TZOFFSETFROM:"+formatOffset(fromOffset))
+		writeLine(buf, "TZOFFSETTO:"+formatOffset(toOffset))
+		writeLine(buf, "TZNAME:"+name)
+		writeLine(buf, "END:"+kind)
+	}
+	writeComponent(start, offset, offset, name)
+	// Find the changes by checking every hour, which is plenty for the
+	// few years that are needed
+	for t := start; t.Before(end); t = t.Add(time.Hour) {
+		nextName, nextOffset := t.Add(time.Hour).In(c.Location).Zone()
+		if nextOffset == offset {
+			continue
+		}
+		// Find the exact second of the change
+		low, high := t, t.Add(time.Hour)
+		for high.Sub(low) > time.Second {
+			mid := low.Add(high.Sub(low) / 2)
+			if _, o := mid.In(c.Location).Zone(); o == offset {
+				low = mid
+			} else {
+				high = mid
+			}
+		}
+		writeComponent(high, offset, nextOffset, nextName)
+		offset = nextOffset
+	}
+	writeLine(buf, "END:VTIMEZONE")
+}
+
+// Bytes returns the calendar in the iCalendar format
+func (c *Calendar) Bytes() []byte {
+	var buf bytes.Buffer
+	writeLine(&buf, "BEGIN:VCALENDAR")
+	writeLine(&buf, "VERSION:2.0")
+	writeLine(&buf, "PRODID:-//Algernon//ICSFeed//EN")
+	writeLine(&buf, "CALSCALE:GREGORIAN")
+	writeLine(&buf, "METHOD:PUBLISH")
+	if c.Name != "" {
+		writeLine(&buf, "X-WR-CALNAME:"+escape(c.Name))
+	}
+	events := make([]Event, len(c.Events))
+	copy(events, c.Events)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Start.Before(events[j].Start)
+	})
+	if c.Location != nil && c.Location != time.UTC && len(events) > 0 {
+		writeLine(&buf, "X-WR-TIMEZONE:"+c.Location.String())
+		c.writeTimezone(&buf, events[0].Start, events[len(events)-1].Start)
+	}
+	now := time.Now()
+	for _, e := range events {
+		writeLine(&buf, "BEGIN:VEVENT")
+		writeLine(&buf, "UID:"+escape(e.uid()))
+		updated := e.Updated
+		if updated.IsZero() {
+			updated = now
+		}
+		writeLine(&buf, "DTSTAMP:"+stamp(updated))
+		c.writeTime(&buf, "DTSTART", e.Start, e.AllDay)
+		end := e.End
+		if end.IsZero() || end.Before(e.Start) {
+			if e.AllDay {
+				end = e.Start.AddDate(0, 0, 1)
+			} else {
+				end = e.Start.Add(time.Hour)
+			}
+		}
+		c.writeTime(&buf, "DTEND", end, e.AllDay)
+		writeLine(&buf, "SUMMARY:"+escape(e.Summary))
+		if e.Description != "" {
+			writeLine(&buf, "DESCRIPTION:"+escape(e.Description))
+		}
+		if e.Location != "" {
+			writeLine(&buf, "LOCATION:"+escape(e.Location))
+		}
+		if e.URL != "" {
+			writeLine(&buf, "URL:"+e.URL)
+		}
+		writeLine(&buf, "END:VEVENT")
+	}
+	writeLine(&buf, "END:VCALENDAR")
+	return buf.Bytes()
+}
+
+// checkTime reads a time from a Lua string, or from a number of seconds
+// since 1970
+func checkTime(value lua.LValue, loc *time.Location) (time.Time, bool, error) {
+	switch v := value.(type) {
+	case lua.LNumber:
+		return time.Unix(int64(v), 0), false, nil
+	case lua.LString:
+		return ParseTime(string(v), loc)
+	}
+	return time.Time{}, false, nil
+}
+
+// Load makes the ICSFeed function available to Lua scripts
+func Load(L *lua.LState) {
+	// Make an iCalendar feed. Takes a table with events, that are tables
+	// with summary, start, and optionally end, description, location, url,
+	// uid and updated. Times are strings like "2024-05-17 18:00", dates
+	// like "2024-05-17" for all-day events, or numbers of seconds since
+	// 1970. Takes an optional table with name and timezone (like
+	// "Europe/Oslo", UTC by default). Returns the feed as a string, or nil
+	// and an error message.
+	L.SetGlobal("ICSFeed", L.NewFunction(func(L *lua.LState) int {
+		events := L.CheckTable(1)
+		options := L.OptTable(2, L.NewTable())
+		c := &Calendar{Name: lua.LVAsString(options.RawGetString("name")), Location: time.UTC}
+		if tz := lua.LVAsString(options.RawGetString("timezone")); tz != "" {
+			loc, err := time.LoadLocation(tz)
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2 // number of results
+			}
+			c.Location = loc
+		}
+		var err error
+		events.ForEach(func(_, value lua.LValue) {
+			t, ok := value.(*lua.LTable)
+			if !ok || err != nil {
+				return
+			}
+			e := Event{
+				UID:         lua.LVAsString(t.RawGetString("uid")),
+				Summary:     lua.LVAsString(t.RawGetString("summary")),
+				Description: lua.LVAsString(t.RawGetString("description")),
+				Location:    lua.LVAsString(t.RawGetString("location")),
+				URL:         lua.LVAsString(t.RawGetString("url")),
+			}
+			if e.Start, e.AllDay, err = checkTime(t.RawGetString("start"), c.Location); err != nil || e.Start.IsZero() {
+				err = fmt.Errorf("invalid start time for %q", e.Summary)
+				return
+			}
+			if e.End, _, err = checkTime(t.RawGetString("end"), c.Location); err != nil {
+				err = fmt.Errorf("invalid end time for %q", e.Summary)
+				return
+			}
+			if e.Updated, _, err = checkTime(t.RawGetString("updated"), c.Location); err != nil {
+				err = fmt.Errorf("invalid updated time for %q", e.Summary)
+				return
+			}
+			c.Events = append(c.Events, e)
+		})
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(c.Bytes()))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,47 @@
+package ics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalendar(t *testing.T) {
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Skip(err)
+	}
+	start, allDay, err := ParseTime("2024-05-17 18:00", oslo)
+	if err != nil || allDay {
+		t.Fatal(err)
+	}
+	day, allDay, _ := ParseTime("2024-12-24", oslo)
+	if !allDay {
+		t.Error("a date should be an all-day event")
+	}
+	c := &Calendar{Name: "Events", Location: oslo, Events: []Event{
+		{Summary: "Party; with, \"friends\"", Description: strings.Repeat("æøå ", 40), Start: start},
+		{Summary: "Christmas", Start: day, AllDay: true},
+	}}
+	ics := string(c.Bytes())
+	for _, expected := range []string{
+		"SUMMARY:Party\\; with\\, \"friends\"\r\n",
+		"DTSTART;TZID=Europe/Oslo:20240517T180000\r\n",
+		"DTEND;TZID=Europe/Oslo:20240517T190000\r\n",
+		"DTSTART;VALUE=DATE:20241224\r\n",
+		"DTEND;VALUE=DATE:20241225\r\n",
+		"BEGIN:DAYLIGHT\r\nDTSTART:20240331T020000\r\nTZOFFSETFROM:+0100\r\nTZOFFSETTO:+0200\r\n",
+	} {
+		if !strings.Contains(ics, expected) {
+			t.Errorf("missing %q in:\n%s", expected, ics)
+		}
+	}
+	for _, line := range strings.Split(ics, "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line is too long: %q", line)
+		}
+	}
+	if c.Events[0].uid() != (&Event{Summary: c.Events[0].Summary, Start: start}).uid() {
+		t.Error("the UID should stay the same")
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/lua/upstream"
 	"github.com/xyproto/gopher-lua"
 	"github.com/xyproto/jpath"
 )
@@ -199,6 +200,9 @@ func jnodePOSTToURL(L *lua.LState) int {
 	}
 	req.Header.Add("Content-Type", "application/json; charset=utf-8")
 
+	// Pass on the request ID and trace headers
+	upstream.Apply(L, req)
+
 	// Send request and return result
 	resp, err := client.Do(req)
 	if err != nil {
@@ -252,6 +256,9 @@ func jnodePUTToURL(L *lua.LState) int {
 	}
 	req.Header.Add("Content-Type", "application/json; charset=utf-8")
 
+	// Pass on the request ID and trace headers
+	upstream.Apply(L, req)
+
 	// Send request and return result
 	resp, err := client.Do(req)
 	if err != nil {
@@ -278,8 +285,18 @@ func jnodeGETFromURL(L *lua.LState) int {
 		L.ArgError(2, "URL must start with http or https")
 	}
 
+	// Set up request
+	req, err := http.NewRequest("GET", posturl, nil)
+	if err != nil {
+		log.Error(err)
+		return 0 // number of results
+	}
+
+	// Pass on the request ID and trace headers
+	upstream.Apply(L, req)
+
 	// Send request
-	resp, err := http.Get(posturl)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		log.Error(err.Error())
 		return 0 // number of results
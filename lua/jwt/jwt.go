@@ -0,0 +1,316 @@
+// Package jwt provides Lua functions for creating and validating JSON Web Tokens
+package jwt
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// The supported signing algorithms
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+)
+
+// How deeply tables may be nested, also for catching tables that contain themselves
+const maxDepth = 32
+
+var (
+	errMalformed   = errors.New("malformed token")
+	errAlgorithm   = errors.New("unsupported or unexpected signing algorithm")
+	errSignature   = errors.New("invalid signature")
+	errExpired     = errors.New("the token has expired")
+	errNotYetValid = errors.New("the token is not valid yet")
+	errKey         = errors.New("the key is not a valid RSA key in PEM format")
+	errTooDeep     = errors.New("the claims are nested too deeply")
+	errClaims      = errors.New("the claims must be a table with names and values")
+)
+
+var encoding = base64.RawURLEncoding
+
+// parseRSAPrivateKey parses a PKCS #1 or PKCS #8 private key in PEM format
+func parseRSAPrivateKey(key []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, errKey
+	}
+	if privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return privateKey, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errKey
+	}
+	privateKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errKey
+	}
+	return privateKey, nil
+}
+
+// parseRSAPublicKey parses a public key or a certificate in PEM format.
+// Returns nil if the key is not in PEM format.
+func parseRSAPublicKey(key []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, nil
+	}
+	var parsed interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errKey
+		}
+		parsed = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		publicKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, errKey
+		}
+		parsed = publicKey
+	case "PUBLIC KEY":
+		publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, errKey
+		}
+		parsed = publicKey
+	default:
+		// A private key can also be used for verifying
+		privateKey, err := parseRSAPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		parsed = &privateKey.PublicKey
+	}
+	publicKey, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errKey
+	}
+	return publicKey, nil
+}
+
+// signature returns the signature for the given header and payload
+func signature(signingInput string, key []byte, alg string) ([]byte, error) {
+	switch alg {
+	case HS256:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signingInput))
+		return mac.Sum(nil), nil
+	case RS256:
+		privateKey, err := parseRSAPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.Sum256([]byte(signingInput))
+		return rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hash[:])
+	}
+	return nil, errAlgorithm
+}
+
+// Sign creates a token with the given claims, signed with the given key.
+// For HS256, the key is a shared secret. For RS256, the key is an RSA private key in PEM format.
+func Sign(claims map[string]interface{}, key []byte, alg string) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encoding.EncodeToString(header) + "." + encoding.EncodeToString(payload)
+	sig, err := signature(signingInput, key, alg)
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + encoding.EncodeToString(sig), nil
+}
+
+// Verify checks the signature and the "exp" and "nbf" claims of a token, and
+// returns the claims. If the key is an RSA public key, certificate or private
+// key in PEM format, the token must use RS256, and otherwise HS256.
+func Verify(token string, key []byte, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformed
+	}
+	headerData, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errMalformed
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return nil, errMalformed
+	}
+	sig, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformed
+	}
+
+	// The algorithm is decided by the key, not by the token
+	publicKey, err := parseRSAPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	signingInput := parts[0] + "." + parts[1]
+	if publicKey != nil {
+		if header.Alg != RS256 {
+			return nil, errAlgorithm
+		}
+		hash := sha256.Sum256([]byte(signingInput))
+		if rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], sig) != nil {
+			return nil, errSignature
+		}
+	} else {
+		if header.Alg != HS256 {
+			return nil, errAlgorithm
+		}
+		expected, _ := signature(signingInput, key, HS256)
+		if !hmac.Equal(sig, expected) {
+			return nil, errSignature
+		}
+	}
+
+	payload, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errMalformed
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errMalformed
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.Unix() >= int64(exp) {
+		return nil, errExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Unix() < int64(nbf) {
+		return nil, errNotYetValid
+	}
+	return claims, nil
+}
+
+// fromLua converts a Lua value to a value that can be converted to JSON.
+// Tables with only the keys 1 to n become arrays.
+func fromLua(lv lua.LValue, depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+	switch v := lv.(type) {
+	case lua.LString:
+		return string(v), nil
+	case lua.LNumber:
+		if f := float64(v); f == math.Trunc(f) {
+			return int64(f), nil
+		}
+		return float64(v), nil
+	case lua.LBool:
+		return bool(v), nil
+	case *lua.LTable:
+		if n := v.Len(); n > 0 {
+			array := make([]interface{}, 0, n)
+			count := 0
+			v.ForEach(func(_, _ lua.LValue) { count++ })
+			if count == n {
+				for i := 1; i <= n; i++ {
+					value, err := fromLua(v.RawGetInt(i), depth+1)
+					if err != nil {
+						return nil, err
+					}
+					array = append(array, value)
+				}
+				return array, nil
+			}
+		}
+		m := make(map[string]interface{})
+		var err error
+		v.ForEach(func(key, value lua.LValue) {
+			if err != nil {
+				return
+			}
+			m[key.String()], err = fromLua(value, depth+1)
+		})
+		return m, err
+	}
+	return nil, nil
+}
+
+// toLua converts a value from JSON to a Lua value
+func toLua(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case string:
+		return lua.LString(v)
+	case float64:
+		return lua.LNumber(v)
+	case bool:
+		return lua.LBool(v)
+	case []interface{}:
+		t := L.NewTable()
+		for _, value := range v {
+			t.Append(toLua(L, value))
+		}
+		return t
+	case map[string]interface{}:
+		t := L.NewTable()
+		for key, value := range v {
+			t.RawSetString(key, toLua(L, value))
+		}
+		return t
+	}
+	return lua.LNil
+}
+
+// Load makes the jwt table, with the sign and verify functions, available to Lua scripts
+func Load(L *lua.LState) {
+	t := L.NewTable()
+
+	// Create a token from a table with claims and a key, with "HS256" (the
+	// default) or "RS256". Returns the token, or nil and an error message.
+	L.SetField(t, "sign", L.NewFunction(func(L *lua.LState) int {
+		value, err := fromLua(L.CheckTable(1), 0)
+		claims, ok := value.(map[string]interface{})
+		if err == nil && !ok {
+			err = errClaims
+		}
+		if err == nil {
+			var token string
+			token, err = Sign(claims, []byte(L.CheckString(2)), L.OptString(3, HS256))
+			if err == nil {
+				L.Push(lua.LString(token))
+				return 1 // number of results
+			}
+		}
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}))
+
+	// Check a token with a shared secret or an RSA public key in PEM format.
+	// Returns a table with the claims, or nil and an error message.
+	L.SetField(t, "verify", L.NewFunction(func(L *lua.LState) int {
+		claims, err := Verify(L.CheckString(1), []byte(L.CheckString(2)), time.Now())
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(toLua(L, claims))
+		return 1 // number of results
+	}))
+
+	L.SetGlobal("jwt", t)
+}
@@ -0,0 +1,70 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHS256(t *testing.T) {
+	now := time.Now()
+	token, err := Sign(map[string]interface{}{"sub": "bob", "exp": now.Add(time.Hour).Unix()}, []byte("secret"), HS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := Verify(token, []byte("secret"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "bob" {
+		t.Errorf("expected bob, got %v", claims["sub"])
+	}
+	if _, err := Verify(token, []byte("wrong"), now); err != errSignature {
+		t.Errorf("expected errSignature, got %v", err)
+	}
+	if _, err := Verify(token, []byte("secret"), now.Add(2*time.Hour)); err != errExpired {
+		t.Errorf("expected errExpired, got %v", err)
+	}
+	parts := strings.Split(token, ".")
+	if _, err := Verify(parts[0]+"."+parts[1], []byte("secret"), now); err != errMalformed {
+		t.Errorf("expected errMalformed, got %v", err)
+	}
+}
+
+func TestRS256(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	publicDER, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+
+	token, err := Sign(map[string]interface{}{"sub": "alice"}, privatePEM, RS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := Verify(token, publicPEM, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "alice" {
+		t.Errorf("expected alice, got %v", claims["sub"])
+	}
+
+	// A token signed with the public key as an HMAC secret must not be accepted
+	forged, err := Sign(map[string]interface{}{"sub": "mallory"}, publicPEM, HS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(forged, publicPEM, time.Now()); err != errAlgorithm {
+		t.Errorf("expected errAlgorithm, got %v", err)
+	}
+}
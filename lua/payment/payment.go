@@ -0,0 +1,305 @@
+// Package payment provides Lua functions for a Stripe-compatible payment
+// provider: checkout sessions, webhook events and subscriptions
+package payment
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xyproto/algernon/lua/upstream"
+	"github.com/xyproto/gopher-lua"
+)
+
+// DefaultAPIURL is the API of the payment provider that is used by default
+const DefaultAPIURL = "https://api.stripe.com"
+
+// How old a webhook event can be before it is rejected, by default
+const defaultTolerance = 5 * time.Minute
+
+// How deeply tables may be nested, also for catching tables that contain themselves
+const maxDepth = 32
+
+var (
+	errNoKey           = errors.New("no secret key for the payment provider, use --paymentkey")
+	errNoWebhookSecret = errors.New("no webhook secret for the payment provider, use --paymentwebhooksecret")
+	errSignature       = errors.New("invalid webhook signature")
+	errTooOld          = errors.New("the webhook event is too old")
+	errTooDeep         = errors.New("the parameters are nested too deeply")
+	errNoID            = errors.New("missing ID")
+)
+
+// Client sends requests to the payment provider
+type Client struct {
+	APIURL        string
+	SecretKey     string
+	WebhookSecret string
+	HTTPClient    *http.Client
+}
+
+// NewClient creates a client for the given API URL and secrets
+func NewClient(apiURL, secretKey, webhookSecret string) *Client {
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
+	}
+	return &Client{
+		APIURL:        strings.TrimSuffix(apiURL, "/"),
+		SecretKey:     secretKey,
+		WebhookSecret: webhookSecret,
+		HTTPClient:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Do sends a request to the API, and returns the decoded JSON response.
+// The form values are sent as the body for POST requests, and as the query
+// string otherwise. The request is changed by the given function before it
+// is sent, if it is not nil.
+func (c *Client) Do(method, path string, values url.Values, prepare func(*http.Request)) (map[string]interface{}, error) {
+	if c.SecretKey == "" {
+		return nil, errNoKey
+	}
+	u := c.APIURL + path
+	var body *strings.Reader
+	if method == http.MethodPost {
+		body = strings.NewReader(values.Encode())
+	} else {
+		body = strings.NewReader("")
+		if len(values) > 0 {
+			u += "?" + values.Encode()
+		}
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.SecretKey)
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if prepare != nil {
+		prepare(req)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("unexpected response from the payment provider: %s", resp.Status)
+	}
+	if resp.StatusCode >= 400 {
+		if e, ok := result["error"].(map[string]interface{}); ok {
+			if message, ok := e["message"].(string); ok {
+				return nil, errors.New(message)
+			}
+		}
+		return nil, fmt.Errorf("the payment provider responded with %s", resp.Status)
+	}
+	return result, nil
+}
+
+// VerifyWebhook checks the signature header of a webhook request, on the
+// form "t=TIMESTAMP,v1=SIGNATURE", and returns the decoded event
+func VerifyWebhook(header, body, secret string, tolerance time.Duration, now time.Time) (map[string]interface{}, error) {
+	if secret == "" {
+		return nil, errNoWebhookSecret
+	}
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return nil, errSignature
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	expected := mac.Sum(nil)
+	valid := false
+	for _, signature := range signatures {
+		if got, err := hex.DecodeString(signature); err == nil && hmac.Equal(got, expected) {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, errSignature
+	}
+	if age := now.Sub(time.Unix(t, 0)); age > tolerance || age < -tolerance {
+		return nil, errTooOld
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// formValues adds a Lua value to the form values, with the nested keys of
+// tables in brackets, like line_items[0][price]
+func formValues(values url.Values, prefix string, lv lua.LValue, depth int) error {
+	if depth > maxDepth {
+		return errTooDeep
+	}
+	switch v := lv.(type) {
+	case *lua.LTable:
+		if n := v.Len(); n > 0 {
+			for i := 1; i <= n; i++ {
+				if err := formValues(values, prefix+"["+strconv.Itoa(i-1)+"]", v.RawGetInt(i), depth+1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		var err error
+		v.ForEach(func(key, value lua.LValue) {
+			if err != nil {
+				return
+			}
+			name := key.String()
+			if prefix != "" {
+				name = prefix + "[" + name + "]"
+			}
+			err = formValues(values, name, value, depth+1)
+		})
+		return err
+	case lua.LNumber:
+		if f := float64(v); f == math.Trunc(f) {
+			values.Add(prefix, strconv.FormatInt(int64(f), 10))
+		} else {
+			values.Add(prefix, strconv.FormatFloat(f, 'f', -1, 64))
+		}
+	case lua.LBool, lua.LString:
+		values.Add(prefix, v.String())
+	}
+	return nil
+}
+
+// toLua converts a value from JSON to a Lua value
+func toLua(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case string:
+		return lua.LString(v)
+	case float64:
+		return lua.LNumber(v)
+	case bool:
+		return lua.LBool(v)
+	case []interface{}:
+		t := L.NewTable()
+		for _, value := range v {
+			t.Append(toLua(L, value))
+		}
+		return t
+	case map[string]interface{}:
+		t := L.NewTable()
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			t.RawSetString(key, toLua(L, v[key]))
+		}
+		return t
+	}
+	return lua.LNil
+}
+
+// pushResult pushes the result as a table, or nil and an error message
+func pushResult(L *lua.LState, result map[string]interface{}, err error) int {
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(toLua(L, result))
+	return 1 // number of results
+}
+
+// Load makes the payment functions available to Lua scripts
+func Load(L *lua.LState, c *Client) {
+	// Pass on the request ID when sending requests to the payment provider
+	prepare := func(req *http.Request) {
+		upstream.Apply(L, req)
+	}
+
+	// Create a checkout session. Takes a table with the parameters, like
+	// mode, success_url, cancel_url and line_items. Returns the session as a
+	// table, where url is the page to send the customer to, or nil and an
+	// error message.
+	L.SetGlobal("CreateCheckoutSession", L.NewFunction(func(L *lua.LState) int {
+		values := url.Values{}
+		if err := formValues(values, "", L.CheckTable(1), 0); err != nil {
+			return pushResult(L, nil, err)
+		}
+		result, err := c.Do(http.MethodPost, "/v1/checkout/sessions", values, prepare)
+		return pushResult(L, result, err)
+	}))
+
+	// Check the signature of a webhook request. Takes the value of the
+	// Stripe-Signature header and the request body. Returns the event as a
+	// table, or nil and an error message.
+	L.SetGlobal("VerifyPaymentWebhook", L.NewFunction(func(L *lua.LState) int {
+		event, err := VerifyWebhook(L.CheckString(1), L.CheckString(2), c.WebhookSecret, defaultTolerance, time.Now())
+		return pushResult(L, event, err)
+	}))
+
+	// Get the status of a subscription, like "active", "past_due" or
+	// "canceled". Takes a subscription ID. Returns a string, or nil and an
+	// error message.
+	L.SetGlobal("SubscriptionStatus", L.NewFunction(func(L *lua.LState) int {
+		id := L.CheckString(1)
+		if id == "" || strings.ContainsAny(id, "/?#") {
+			return pushResult(L, nil, errNoID)
+		}
+		result, err := c.Do(http.MethodGet, "/v1/subscriptions/"+url.PathEscape(id), nil, prepare)
+		if err != nil {
+			return pushResult(L, nil, err)
+		}
+		status, _ := result["status"].(string)
+		L.Push(lua.LString(status))
+		return 1 // number of results
+	}))
+
+	// Get the subscriptions of a customer. Takes a customer ID. Returns a
+	// list of subscriptions as tables, or nil and an error message.
+	L.SetGlobal("Subscriptions", L.NewFunction(func(L *lua.LState) int {
+		customer := L.CheckString(1)
+		if customer == "" {
+			return pushResult(L, nil, errNoID)
+		}
+		values := url.Values{"customer": {customer}, "status": {"all"}}
+		result, err := c.Do(http.MethodGet, "/v1/subscriptions", values, prepare)
+		if err != nil {
+			return pushResult(L, nil, err)
+		}
+		data, _ := result["data"].([]interface{})
+		L.Push(toLua(L, data))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,67 @@
+package payment
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestCreateCheckoutSession(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.Header.Get("Authorization") != "Bearer sk_test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": {"message": "Invalid API key"}}`))
+			return
+		}
+		if req.URL.Path != "/v1/checkout/sessions" || req.PostForm.Get("line_items[0][price]") != "price_1" || req.PostForm.Get("line_items[0][quantity]") != "2" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": {"message": "Unexpected request: ` + req.PostForm.Encode() + `"}}`))
+			return
+		}
+		w.Write([]byte(`{"id": "cs_1", "url": "https://checkout.example.com/cs_1"}`))
+	}))
+	defer ts.Close()
+
+	L := lua.NewState()
+	defer L.Close()
+	Load(L, NewClient(ts.URL, "sk_test", ""))
+	script := `
+		local session, err = CreateCheckoutSession{mode = "payment", line_items = {{price = "price_1", quantity = 2}}}
+		assert(session, err)
+		assert(session.id == "cs_1")
+	`
+	if err := L.DoString(script); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	body := `{"type": "checkout.session.completed"}`
+	now := time.Now()
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte("whsec"))
+	mac.Write([]byte(timestamp + "." + body))
+	header := "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+
+	event, err := VerifyWebhook(header, body, "whsec", defaultTolerance, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event["type"] != "checkout.session.completed" {
+		t.Errorf("unexpected event: %v", event)
+	}
+	if _, err := VerifyWebhook(header, body+" ", "whsec", defaultTolerance, now); err == nil {
+		t.Error("a changed body should not be accepted")
+	}
+	if _, err := VerifyWebhook(header, body, "whsec", defaultTolerance, now.Add(time.Hour)); err == nil {
+		t.Error("an old event should not be accepted")
+	}
+}
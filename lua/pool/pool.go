@@ -12,18 +12,37 @@ import (
 
 // LStatePool is a pool of Lua states, with a mutex
 type LStatePool struct {
-	m     sync.Mutex
-	saved []*lua.LState
+	m       sync.Mutex
+	saved   []*lua.LState
+	options lua.Options
+	inUse   chan struct{} // one element per borrowed state, if limited
 }
 
 // New returns a new Lua pool structure
 func New() *LStatePool {
-	return &LStatePool{saved: make([]*lua.LState, 0, 4)}
+	return NewWithOptions(lua.Options{})
+}
+
+// NewWithOptions returns a new Lua pool structure, where the Lua states are
+// created with the given options. Sizes that are not set use the defaults.
+func NewWithOptions(options lua.Options) *LStatePool {
+	return &LStatePool{saved: make([]*lua.LState, 0, 4), options: options}
+}
+
+// NewWithLimit returns a new Lua pool structure, where at most limit Lua
+// states can be borrowed at the same time. Get waits until a state is
+// delivered back, when the limit is reached.
+func NewWithLimit(options lua.Options, limit int) *LStatePool {
+	pl := NewWithOptions(options)
+	if limit > 0 {
+		pl.inUse = make(chan struct{}, limit)
+	}
+	return pl
 }
 
 // New returns a new Lua state
 func (pl *LStatePool) New() *lua.LState {
-	L := lua.NewState()
+	L := lua.NewState(pl.options)
 	// setting the L up here.
 	// load scripts, set global variables, share channels, etc...
 	return L
@@ -31,6 +50,9 @@ func (pl *LStatePool) New() *lua.LState {
 
 // Get borrows an existing Lua state
 func (pl *LStatePool) Get() *lua.LState {
+	if pl.inUse != nil {
+		pl.inUse <- struct{}{}
+	}
 	pl.m.Lock()
 	defer pl.m.Unlock()
 	n := len(pl.saved)
@@ -45,8 +67,23 @@ func (pl *LStatePool) Get() *lua.LState {
 // Put delivers back a borrowed Lua state
 func (pl *LStatePool) Put(L *lua.LState) {
 	pl.m.Lock()
-	defer pl.m.Unlock()
 	pl.saved = append(pl.saved, L)
+	pl.m.Unlock()
+	pl.release()
+}
+
+// release lets another Lua state be borrowed, if the pool is limited
+func (pl *LStatePool) release() {
+	if pl.inUse != nil {
+		<-pl.inUse
+	}
+}
+
+// Discard closes a borrowed Lua state instead of delivering it back,
+// for when it may be in a bad state, for instance after a stack overflow
+func (pl *LStatePool) Discard(L *lua.LState) {
+	L.Close()
+	pl.release()
 }
 
 // Shutdown can be used then the Lua pool is being shut down
@@ -0,0 +1,158 @@
+package protobuf
+
+import (
+	"errors"
+	"math"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+var (
+	errNoRegistry = errors.New("no descriptor sets are loaded, use ProtobufDescriptors in the server configuration")
+	errMessage    = errors.New("the message must be a table with field names and values")
+)
+
+// fromLua converts a Lua value to a Go value that can be encoded. Tables
+// with only the keys 1 to N are lists.
+func fromLua(lv lua.LValue, depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+	switch v := lv.(type) {
+	case lua.LString:
+		return string(v), nil
+	case lua.LNumber:
+		if f := float64(v); f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			return int64(f), nil
+		}
+		return float64(v), nil
+	case lua.LBool:
+		return bool(v), nil
+	case *lua.LTable:
+		if n := v.Len(); n > 0 {
+			count := 0
+			v.ForEach(func(_, _ lua.LValue) { count++ })
+			if count == n {
+				array := make([]interface{}, 0, n)
+				for i := 1; i <= n; i++ {
+					value, err := fromLua(v.RawGetInt(i), depth+1)
+					if err != nil {
+						return nil, err
+					}
+					array = append(array, value)
+				}
+				return array, nil
+			}
+		}
+		m := make(map[string]interface{})
+		var err error
+		v.ForEach(func(key, value lua.LValue) {
+			if err != nil {
+				return
+			}
+			m[key.String()], err = fromLua(value, depth+1)
+		})
+		return m, err
+	}
+	return nil, nil
+}
+
+// toLua converts a decoded Go value to a Lua value
+func toLua(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case string:
+		return lua.LString(v)
+	case int64:
+		return lua.LNumber(v)
+	case uint64:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case bool:
+		return lua.LBool(v)
+	case []interface{}:
+		t := L.NewTable()
+		for _, value := range v {
+			t.Append(toLua(L, value))
+		}
+		return t
+	case map[string]interface{}:
+		t := L.NewTable()
+		for key, value := range v {
+			t.RawSetString(key, toLua(L, value))
+		}
+		return t
+	case map[interface{}]interface{}:
+		t := L.NewTable()
+		for key, value := range v {
+			t.RawSet(toLua(L, key), toLua(L, value))
+		}
+		return t
+	}
+	return lua.LNil
+}
+
+// Load makes the protobuf table, with the encode, decode and types
+// functions, available to Lua scripts. The registry has the types from the
+// descriptor sets that are loaded, and may be nil.
+func Load(L *lua.LState, r *Registry) {
+	t := L.NewTable()
+
+	// Encode a table as a message of the given type, like "shop.Order".
+	// Returns the message as a string, or nil and an error message.
+	L.SetField(t, "encode", L.NewFunction(func(L *lua.LState) int {
+		typeName := L.CheckString(1)
+		value, err := fromLua(L.CheckTable(2), 0)
+		values, ok := value.(map[string]interface{})
+		if err == nil && !ok {
+			err = errMessage
+		}
+		if err == nil && r == nil {
+			err = errNoRegistry
+		}
+		if err == nil {
+			var data []byte
+			if data, err = r.Encode(typeName, values); err == nil {
+				L.Push(lua.LString(string(data)))
+				return 1 // number of results
+			}
+		}
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}))
+
+	// Decode a message of the given type, from a string. Returns a table, or
+	// nil and an error message.
+	L.SetField(t, "decode", L.NewFunction(func(L *lua.LState) int {
+		typeName := L.CheckString(1)
+		data := L.CheckString(2)
+		if r == nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(errNoRegistry.Error()))
+			return 2 // number of results
+		}
+		values, err := r.Decode(typeName, []byte(data))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(toLua(L, values))
+		return 1 // number of results
+	}))
+
+	// Return a list of the message types that can be encoded and decoded
+	L.SetField(t, "types", L.NewFunction(func(L *lua.LState) int {
+		list := L.NewTable()
+		if r != nil {
+			for _, name := range r.Types() {
+				list.Append(lua.LString(name))
+			}
+		}
+		L.Push(list)
+		return 1 // number of results
+	}))
+
+	L.SetGlobal("protobuf", t)
+}
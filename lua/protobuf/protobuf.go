@@ -0,0 +1,872 @@
+// Package protobuf provides Lua functions for encoding and decoding
+// Protocol Buffers messages, given a compiled descriptor set, as created
+// with "protoc --include_imports --descriptor_set_out=FILE"
+package protobuf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Field types, as in FieldDescriptorProto
+const (
+	typeDouble   = 1
+	typeFloat    = 2
+	typeInt64    = 3
+	typeUint64   = 4
+	typeInt32    = 5
+	typeFixed64  = 6
+	typeFixed32  = 7
+	typeBool     = 8
+	typeString   = 9
+	typeGroup    = 10
+	typeMessage  = 11
+	typeBytes    = 12
+	typeUint32   = 13
+	typeEnum     = 14
+	typeSfixed32 = 15
+	typeSfixed64 = 16
+	typeSint32   = 17
+	typeSint64   = 18
+)
+
+// The label of repeated fields, as in FieldDescriptorProto
+const labelRepeated = 3
+
+// How deeply messages may be nested, also for catching tables that contain
+// themselves
+const maxDepth = 64
+
+var (
+	errTruncated   = errors.New("the message is truncated")
+	errWireType    = errors.New("unsupported wire type")
+	errGroup       = errors.New("groups are not supported")
+	errTooDeep     = errors.New("the message is nested too deeply")
+	errUnknownType = errors.New("unknown message type")
+)
+
+// Field is a field in a message
+type Field struct {
+	Name     string
+	JSONName string
+	Number   int
+	Type     int
+	TypeName string // the message or enum type, without the leading dot
+	Repeated bool
+	Packed   bool
+}
+
+// Message is a message type
+type Message struct {
+	Name     string // the full name, like "shop.Order"
+	Fields   []*Field
+	MapEntry bool
+
+	byNumber map[int]*Field
+}
+
+// Enum is an enum type
+type Enum struct {
+	Name    string
+	Names   map[int32]string
+	Numbers map[string]int32
+}
+
+// Registry has the message and enum types from one or more descriptor sets.
+// It can be used concurrently.
+type Registry struct {
+	mut      sync.RWMutex
+	messages map[string]*Message
+	enums    map[string]*Enum
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{messages: make(map[string]*Message), enums: make(map[string]*Enum)}
+}
+
+// AddFile adds the types from a descriptor set file
+func (r *Registry) AddFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return r.Add(data)
+}
+
+// Add adds the types from a serialized FileDescriptorSet
+func (r *Registry) Add(data []byte) error {
+	messages := make(map[string]*Message)
+	enums := make(map[string]*Enum)
+	err := forEachField(data, func(num, wt int, _ uint64, b []byte) error {
+		if num == 1 && wt == wireBytes {
+			return parseFile(b, messages, enums)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	for name, m := range messages {
+		r.messages[name] = m
+	}
+	for name, e := range enums {
+		r.enums[name] = e
+	}
+	return nil
+}
+
+// Message returns the message type with the given full name, like
+// "shop.Order", or nil
+func (r *Registry) Message(name string) *Message {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return r.messages[strings.TrimPrefix(name, ".")]
+}
+
+// Types returns the full names of the message types, sorted
+func (r *Registry) Types() []string {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	names := make([]string, 0, len(r.messages))
+	for name, m := range r.messages {
+		if !m.MapEntry {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// forEachField calls the given function for each field in a serialized
+// message. Varints and fixed values are given as v, and length-delimited
+// values as b.
+func forEachField(data []byte, fn func(num, wt int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		num, wt := int(tag>>3), int(tag&7)
+		var (
+			v uint64
+			b []byte
+		)
+		switch wt {
+		case wireVarint:
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return errTruncated
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errTruncated
+			}
+			v, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errTruncated
+			}
+			v, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errTruncated
+			}
+			b, data = data[n:n+int(length)], data[n+int(length):]
+		default:
+			return errWireType
+		}
+		if err := fn(num, wt, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseFile parses a FileDescriptorProto
+func parseFile(data []byte, messages map[string]*Message, enums map[string]*Enum) error {
+	var (
+		pkg          string
+		proto3       bool
+		messageTypes [][]byte
+		enumTypes    [][]byte
+	)
+	err := forEachField(data, func(num, wt int, _ uint64, b []byte) error {
+		switch num {
+		case 2:
+			pkg = string(b)
+		case 4:
+			messageTypes = append(messageTypes, b)
+		case 5:
+			enumTypes = append(enumTypes, b)
+		case 12:
+			proto3 = string(b) == "proto3"
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, b := range messageTypes {
+		if err := parseMessage(pkg, b, proto3, messages, enums); err != nil {
+			return err
+		}
+	}
+	for _, b := range enumTypes {
+		if err := parseEnum(pkg, b, enums); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// qualify joins a package or message name and a name
+func qualify(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// parseMessage parses a DescriptorProto, and the nested types
+func parseMessage(prefix string, data []byte, proto3 bool, messages map[string]*Message, enums map[string]*Enum) error {
+	m := &Message{byNumber: make(map[int]*Field)}
+	var nestedTypes, enumTypes [][]byte
+	err := forEachField(data, func(num, wt int, _ uint64, b []byte) error {
+		switch num {
+		case 1:
+			m.Name = qualify(prefix, string(b))
+		case 2:
+			f, err := parseField(b, proto3)
+			if err != nil {
+				return err
+			}
+			m.Fields = append(m.Fields, f)
+		case 3:
+			nestedTypes = append(nestedTypes, b)
+		case 4:
+			enumTypes = append(enumTypes, b)
+		case 7:
+			// MessageOptions, where map_entry is field 7
+			return forEachField(b, func(num, wt int, v uint64, _ []byte) error {
+				if num == 7 && wt == wireVarint {
+					m.MapEntry = v != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(m.Fields, func(i, j int) bool { return m.Fields[i].Number < m.Fields[j].Number })
+	for _, f := range m.Fields {
+		m.byNumber[f.Number] = f
+	}
+	messages[m.Name] = m
+	for _, b := range nestedTypes {
+		if err := parseMessage(m.Name, b, proto3, messages, enums); err != nil {
+			return err
+		}
+	}
+	for _, b := range enumTypes {
+		if err := parseEnum(m.Name, b, enums); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseField parses a FieldDescriptorProto. Repeated scalar fields are
+// packed by default in proto3.
+func parseField(data []byte, proto3 bool) (*Field, error) {
+	f := &Field{}
+	packed := proto3
+	err := forEachField(data, func(num, wt int, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			f.Name = string(b)
+		case 3:
+			f.Number = int(v)
+		case 4:
+			f.Repeated = v == labelRepeated
+		case 5:
+			f.Type = int(v)
+		case 6:
+			f.TypeName = strings.TrimPrefix(string(b), ".")
+		case 8:
+			// FieldOptions, where packed is field 2
+			return forEachField(b, func(num, wt int, v uint64, _ []byte) error {
+				if num == 2 && wt == wireVarint {
+					packed = v != 0
+				}
+				return nil
+			})
+		case 10:
+			f.JSONName = string(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.Packed = packed && f.Repeated && packable(f.Type)
+	return f, nil
+}
+
+// parseEnum parses an EnumDescriptorProto
+func parseEnum(prefix string, data []byte, enums map[string]*Enum) error {
+	e := &Enum{Names: make(map[int32]string), Numbers: make(map[string]int32)}
+	err := forEachField(data, func(num, wt int, _ uint64, b []byte) error {
+		switch num {
+		case 1:
+			e.Name = qualify(prefix, string(b))
+		case 2:
+			var (
+				name   string
+				number int32
+			)
+			err := forEachField(b, func(num, wt int, v uint64, b []byte) error {
+				switch num {
+				case 1:
+					name = string(b)
+				case 2:
+					number = int32(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			e.Names[number] = name
+			e.Numbers[name] = number
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	enums[e.Name] = e
+	return nil
+}
+
+// packable checks if fields of the given type can be packed
+func packable(t int) bool {
+	switch t {
+	case typeString, typeBytes, typeMessage, typeGroup:
+		return false
+	}
+	return true
+}
+
+// wireType returns the wire type for a field type
+func wireType(t int) int {
+	switch t {
+	case typeDouble, typeFixed64, typeSfixed64:
+		return wireFixed64
+	case typeFloat, typeFixed32, typeSfixed32:
+		return wireFixed32
+	case typeString, typeBytes, typeMessage:
+		return wireBytes
+	}
+	return wireVarint
+}
+
+// Decode decodes a message of the given type. Fields are by name. Integers
+// are int64 or uint64, strings and bytes are strings, enums are the names
+// of the values, repeated fields are slices and map fields are maps. Fields
+// that are not in the message are not included.
+func (r *Registry) Decode(typeName string, data []byte) (map[string]interface{}, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	m, ok := r.messages[strings.TrimPrefix(typeName, ".")]
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", errUnknownType, typeName)
+	}
+	return r.decode(m, data, 0)
+}
+
+func (r *Registry) decode(m *Message, data []byte, depth int) (map[string]interface{}, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+	result := make(map[string]interface{})
+	err := forEachField(data, func(num, wt int, v uint64, b []byte) error {
+		f, ok := m.byNumber[num]
+		if !ok {
+			// Skip unknown fields
+			return nil
+		}
+		if f.Type == typeGroup {
+			return errGroup
+		}
+		// Packed repeated fields
+		if wt == wireBytes && wireType(f.Type) != wireBytes {
+			values, err := r.decodePacked(f, b)
+			if err != nil {
+				return err
+			}
+			list, _ := result[f.Name].([]interface{})
+			result[f.Name] = append(list, values...)
+			return nil
+		}
+		if wt != wireType(f.Type) {
+			return fmt.Errorf("%s for %s", errWireType, f.Name)
+		}
+		value, err := r.decodeValue(f, v, b, depth)
+		if err != nil {
+			return err
+		}
+		if !f.Repeated {
+			result[f.Name] = value
+			return nil
+		}
+		if entry := r.messages[f.TypeName]; f.Type == typeMessage && entry != nil && entry.MapEntry {
+			// Map fields are repeated messages with a key and a value
+			fields := value.(map[string]interface{})
+			entries, _ := result[f.Name].(map[interface{}]interface{})
+			if entries == nil {
+				entries = make(map[interface{}]interface{})
+				result[f.Name] = entries
+			}
+			if key, ok := fields["key"]; ok {
+				entries[key] = fields["value"]
+			} else if keyField := entry.byNumber[1]; keyField != nil {
+				// The key has the default value
+				entries[zero(keyField.Type)] = fields["value"]
+			}
+			return nil
+		}
+		list, _ := result[f.Name].([]interface{})
+		result[f.Name] = append(list, value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// zero returns the default value for a scalar type
+func zero(t int) interface{} {
+	switch t {
+	case typeString, typeBytes:
+		return ""
+	case typeBool:
+		return false
+	case typeUint32, typeUint64, typeFixed32, typeFixed64:
+		return uint64(0)
+	case typeDouble, typeFloat:
+		return float64(0)
+	}
+	return int64(0)
+}
+
+// decodePacked decodes packed repeated scalar values
+func (r *Registry) decodePacked(f *Field, b []byte) ([]interface{}, error) {
+	var values []interface{}
+	for len(b) > 0 {
+		var v uint64
+		switch wireType(f.Type) {
+		case wireVarint:
+			var n int
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return nil, errTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return nil, errTruncated
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return nil, errTruncated
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		}
+		value, err := r.decodeValue(f, v, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// decodeValue decodes a single value
+func (r *Registry) decodeValue(f *Field, v uint64, b []byte, depth int) (interface{}, error) {
+	switch f.Type {
+	case typeDouble:
+		return math.Float64frombits(v), nil
+	case typeFloat:
+		return float64(math.Float32frombits(uint32(v))), nil
+	case typeInt64, typeSfixed64:
+		return int64(v), nil
+	case typeInt32, typeSfixed32:
+		return int64(int32(v)), nil
+	case typeUint64, typeFixed64:
+		return v, nil
+	case typeUint32, typeFixed32:
+		return uint64(uint32(v)), nil
+	case typeSint32, typeSint64:
+		return int64(v>>1) ^ -int64(v&1), nil
+	case typeBool:
+		return v != 0, nil
+	case typeEnum:
+		if e, ok := r.enums[f.TypeName]; ok {
+			if name, ok := e.Names[int32(v)]; ok {
+				return name, nil
+			}
+		}
+		return int64(int32(v)), nil
+	case typeString, typeBytes:
+		return string(b), nil
+	case typeMessage:
+		m, ok := r.messages[f.TypeName]
+		if !ok {
+			return nil, fmt.Errorf("%s: %s", errUnknownType, f.TypeName)
+		}
+		return r.decode(m, b, depth+1)
+	}
+	return nil, errGroup
+}
+
+// Encode encodes a message of the given type, from values on the same form
+// as returned by Decode. Number fields can also be given as float64 or int,
+// enums as numbers, and repeated fields as maps with the keys 1 to N.
+// Fields can be given by name or by JSON name. Other keys are ignored.
+func (r *Registry) Encode(typeName string, values map[string]interface{}) ([]byte, error) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	m, ok := r.messages[strings.TrimPrefix(typeName, ".")]
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", errUnknownType, typeName)
+	}
+	return r.encode(nil, m, values, 0)
+}
+
+func (r *Registry) encode(buf []byte, m *Message, values map[string]interface{}, depth int) ([]byte, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+	for _, f := range m.Fields {
+		value, ok := values[f.Name]
+		if !ok && f.JSONName != "" {
+			value, ok = values[f.JSONName]
+		}
+		if !ok || value == nil {
+			continue
+		}
+		var err error
+		if buf, err = r.encodeField(buf, f, value, depth); err != nil {
+			return nil, fmt.Errorf("%s: %s", f.Name, err)
+		}
+	}
+	return buf, nil
+}
+
+// list returns the values of a repeated field, from a slice or from a map
+// with the keys 1 to N
+func list(value interface{}) ([]interface{}, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		return v, nil
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return nil, nil
+		}
+	case map[interface{}]interface{}:
+		values := make([]interface{}, 0, len(v))
+		for i := 1; i <= len(v); i++ {
+			element, ok := v[i]
+			if !ok {
+				if element, ok = v[int64(i)]; !ok {
+					if element, ok = v[float64(i)]; !ok {
+						return nil, errors.New("expected a list")
+					}
+				}
+			}
+			values = append(values, element)
+		}
+		return values, nil
+	}
+	return nil, errors.New("expected a list")
+}
+
+// encodeField encodes a field, which may be repeated or a map
+func (r *Registry) encodeField(buf []byte, f *Field, value interface{}, depth int) ([]byte, error) {
+	if !f.Repeated {
+		return r.encodeValue(buf, f, value, depth)
+	}
+	if entry := r.messages[f.TypeName]; f.Type == typeMessage && entry != nil && entry.MapEntry {
+		return r.encodeMap(buf, f, entry, value, depth)
+	}
+	values, err := list(value)
+	if err != nil {
+		return nil, err
+	}
+	if !f.Packed || len(values) == 0 {
+		for _, v := range values {
+			if buf, err = r.encodeValue(buf, f, v, depth); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	var packed []byte
+	for _, v := range values {
+		if packed, err = r.appendScalar(packed, f, v); err != nil {
+			return nil, err
+		}
+	}
+	buf = appendTag(buf, f.Number, wireBytes)
+	buf = appendVarint(buf, uint64(len(packed)))
+	return append(buf, packed...), nil
+}
+
+// encodeMap encodes a map field, as one entry message for each key, sorted
+// by key so that the output is always the same
+func (r *Registry) encodeMap(buf []byte, f *Field, entry *Message, value interface{}, depth int) ([]byte, error) {
+	entries := make(map[string]interface{})
+	keys := make(map[string]interface{})
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, element := range v {
+			entries[key], keys[key] = element, key
+		}
+	case map[interface{}]interface{}:
+		for key, element := range v {
+			s := fmt.Sprint(key)
+			entries[s], keys[s] = element, key
+		}
+	default:
+		return nil, errors.New("expected a map")
+	}
+	keyField, valueField := entry.byNumber[1], entry.byNumber[2]
+	if keyField == nil || valueField == nil {
+		return nil, errors.New("invalid map entry type")
+	}
+	sorted := make([]string, 0, len(entries))
+	for s := range entries {
+		sorted = append(sorted, s)
+	}
+	sort.Strings(sorted)
+	for _, s := range sorted {
+		key := keys[s]
+		if keyField.Type == typeString {
+			key = s
+		}
+		entryBuf, err := r.encodeValue(nil, keyField, key, depth)
+		if err != nil {
+			return nil, err
+		}
+		if entryBuf, err = r.encodeValue(entryBuf, valueField, entries[s], depth); err != nil {
+			return nil, err
+		}
+		buf = appendTag(buf, f.Number, wireBytes)
+		buf = appendVarint(buf, uint64(len(entryBuf)))
+		buf = append(buf, entryBuf...)
+	}
+	return buf, nil
+}
+
+// encodeValue encodes a single value, with a tag
+func (r *Registry) encodeValue(buf []byte, f *Field, value interface{}, depth int) ([]byte, error) {
+	switch f.Type {
+	case typeGroup:
+		return nil, errGroup
+	case typeMessage:
+		m, ok := r.messages[f.TypeName]
+		if !ok {
+			return nil, fmt.Errorf("%s: %s", errUnknownType, f.TypeName)
+		}
+		values, ok := value.(map[string]interface{})
+		if !ok {
+			if values, ok = asMap(value); !ok {
+				return nil, errors.New("expected a message")
+			}
+		}
+		nested, err := r.encode(nil, m, values, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		buf = appendTag(buf, f.Number, wireBytes)
+		buf = appendVarint(buf, uint64(len(nested)))
+		return append(buf, nested...), nil
+	case typeString, typeBytes:
+		var s string
+		switch v := value.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		default:
+			return nil, errors.New("expected a string")
+		}
+		buf = appendTag(buf, f.Number, wireBytes)
+		buf = appendVarint(buf, uint64(len(s)))
+		return append(buf, s...), nil
+	}
+	buf = appendTag(buf, f.Number, wireType(f.Type))
+	return r.appendScalar(buf, f, value)
+}
+
+// asMap returns the values in a map with string keys. Other keys are
+// ignored.
+func asMap(value interface{}) (map[string]interface{}, bool) {
+	m, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, false
+	}
+	values := make(map[string]interface{}, len(m))
+	for key, element := range m {
+		if s, ok := key.(string); ok {
+			values[s] = element
+		}
+	}
+	return values, true
+}
+
+// appendVarint appends a varint
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+// appendFixed64 appends a little endian 64-bit value
+func appendFixed64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+// appendFixed32 appends a little endian 32-bit value
+func appendFixed32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+// appendTag appends the field number and the wire type
+func appendTag(buf []byte, number, wt int) []byte {
+	return appendVarint(buf, uint64(number)<<3|uint64(wt))
+}
+
+// appendScalar appends a number, bool or enum value, without a tag
+func (r *Registry) appendScalar(buf []byte, f *Field, value interface{}) ([]byte, error) {
+	switch f.Type {
+	case typeDouble:
+		x, err := toFloat(value)
+		return appendFixed64(buf, math.Float64bits(x)), err
+	case typeFloat:
+		x, err := toFloat(value)
+		return appendFixed32(buf, math.Float32bits(float32(x))), err
+	case typeFixed64, typeSfixed64:
+		x, err := toInt(value)
+		return appendFixed64(buf, uint64(x)), err
+	case typeFixed32, typeSfixed32:
+		x, err := toInt(value)
+		return appendFixed32(buf, uint32(x)), err
+	case typeSint32, typeSint64:
+		x, err := toInt(value)
+		return appendVarint(buf, uint64(x<<1)^uint64(x>>63)), err
+	case typeInt32:
+		// Negative numbers are sign extended to 64 bits
+		x, err := toInt(value)
+		return appendVarint(buf, uint64(int64(int32(x)))), err
+	case typeUint32:
+		x, err := toInt(value)
+		return appendVarint(buf, uint64(uint32(x))), err
+	case typeBool:
+		b, ok := value.(bool)
+		if !ok {
+			return nil, errors.New("expected a boolean")
+		}
+		if b {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case typeEnum:
+		if name, ok := value.(string); ok {
+			e, ok := r.enums[f.TypeName]
+			if !ok {
+				return nil, fmt.Errorf("%s: %s", errUnknownType, f.TypeName)
+			}
+			number, ok := e.Numbers[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown value %s for %s", name, f.TypeName)
+			}
+			return appendVarint(buf, uint64(int64(number))), nil
+		}
+		x, err := toInt(value)
+		return appendVarint(buf, uint64(int64(int32(x)))), err
+	}
+	// int64 and uint64
+	x, err := toInt(value)
+	return appendVarint(buf, uint64(x)), err
+}
+
+// toInt converts a number to an int64. Large uint64 values keep their bits.
+func toInt(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case uint64:
+		return int64(v), nil
+	case int:
+		return int64(v), nil
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("expected an integer, got %v", v)
+		}
+		return int64(v), nil
+	case string:
+		// Numbers that can not be represented exactly in Lua may be strings
+		if x, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return x, nil
+		}
+		if x, err := strconv.ParseUint(v, 10, 64); err == nil {
+			return int64(x), nil
+		}
+	}
+	return 0, errors.New("expected a number")
+}
+
+// toFloat converts a number to a float64
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	}
+	return 0, errors.New("expected a number")
+}
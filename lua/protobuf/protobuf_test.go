@@ -0,0 +1,188 @@
+package protobuf
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// Helpers for building a descriptor set by hand, since protoc is not
+// available when testing
+
+func bytesField(number int, b []byte) []byte {
+	buf := appendTag(nil, number, wireBytes)
+	buf = appendVarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func varintField(number int, v uint64) []byte {
+	return appendVarint(appendTag(nil, number, wireVarint), v)
+}
+
+func field(name string, number, label, fieldType int, typeName string) []byte {
+	b := bytesField(1, []byte(name))
+	b = append(b, varintField(3, uint64(number))...)
+	b = append(b, varintField(4, uint64(label))...)
+	b = append(b, varintField(5, uint64(fieldType))...)
+	if typeName != "" {
+		b = append(b, bytesField(6, []byte(typeName))...)
+	}
+	return bytesField(2, b)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// testRegistry has this, from shop.proto:
+//
+//	syntax = "proto3";
+//	package shop;
+//	enum Status { UNKNOWN = 0; PAID = 1; }
+//	message Item { string name = 1; }
+//	message Order {
+//	  string id = 1;
+//	  int32 quantity = 2;
+//	  repeated int64 prices = 3;
+//	  Status status = 4;
+//	  map<string, int32> counts = 5;
+//	  Item item = 6;
+//	  sint64 delta = 7;
+//	  double total = 8;
+//	  bool paid = 9;
+//	}
+func testRegistry(t *testing.T) *Registry {
+	const optional, repeated = 1, 3
+	countsEntry := join(
+		bytesField(1, []byte("CountsEntry")),
+		field("key", 1, optional, typeString, ""),
+		field("value", 2, optional, typeInt32, ""),
+		bytesField(7, varintField(7, 1)),
+	)
+	order := join(
+		bytesField(1, []byte("Order")),
+		field("id", 1, optional, typeString, ""),
+		field("quantity", 2, optional, typeInt32, ""),
+		field("prices", 3, repeated, typeInt64, ""),
+		field("status", 4, optional, typeEnum, ".shop.Status"),
+		field("counts", 5, repeated, typeMessage, ".shop.Order.CountsEntry"),
+		field("item", 6, optional, typeMessage, ".shop.Item"),
+		field("delta", 7, optional, typeSint64, ""),
+		field("total", 8, optional, typeDouble, ""),
+		field("paid", 9, optional, typeBool, ""),
+		bytesField(3, countsEntry),
+	)
+	item := join(bytesField(1, []byte("Item")), field("name", 1, optional, typeString, ""))
+	status := join(
+		bytesField(1, []byte("Status")),
+		bytesField(2, join(bytesField(1, []byte("UNKNOWN")), varintField(2, 0))),
+		bytesField(2, join(bytesField(1, []byte("PAID")), varintField(2, 1))),
+	)
+	file := join(
+		bytesField(1, []byte("shop.proto")),
+		bytesField(2, []byte("shop")),
+		bytesField(4, item),
+		bytesField(4, order),
+		bytesField(5, status),
+		bytesField(12, []byte("proto3")),
+	)
+	r := NewRegistry()
+	if err := r.Add(bytesField(1, file)); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestTypes(t *testing.T) {
+	types := testRegistry(t).Types()
+	if len(types) != 2 || types[0] != "shop.Item" || types[1] != "shop.Order" {
+		t.Errorf("unexpected types: %v", types)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	r := testRegistry(t)
+	data, err := r.Encode("shop.Order", map[string]interface{}{"id": "a", "quantity": int64(150)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0x0a, 0x01, 'a', 0x10, 0x96, 0x01}; !bytes.Equal(data, expected) {
+		t.Errorf("expected %x, got %x", expected, data)
+	}
+	// Repeated scalars are packed in proto3
+	data, err = r.Encode("shop.Order", map[string]interface{}{"prices": []interface{}{int64(3), int64(270)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0x1a, 0x03, 0x03, 0x8e, 0x02}; !bytes.Equal(data, expected) {
+		t.Errorf("expected %x, got %x", expected, data)
+	}
+	if _, err := r.Encode("shop.Missing", nil); err == nil {
+		t.Error("expected an error for an unknown type")
+	}
+	if _, err := r.Encode("shop.Order", map[string]interface{}{"status": "LOST"}); err == nil {
+		t.Error("expected an error for an unknown enum value")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	r := testRegistry(t)
+	order := map[string]interface{}{
+		"id":       "order-1",
+		"quantity": int64(-2),
+		"prices":   []interface{}{int64(100), int64(250)},
+		"status":   "PAID",
+		"counts":   map[string]interface{}{"apples": int64(3), "pears": int64(5)},
+		"item":     map[string]interface{}{"name": "basket"},
+		"delta":    int64(-7),
+		"total":    12.5,
+		"paid":     true,
+	}
+	data, err := r.Encode(".shop.Order", order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := r.Decode("shop.Order", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded["id"] != "order-1" || decoded["quantity"] != int64(-2) || decoded["status"] != "PAID" {
+		t.Errorf("unexpected scalars: %v", decoded)
+	}
+	if decoded["delta"] != int64(-7) || decoded["total"] != 12.5 || decoded["paid"] != true {
+		t.Errorf("unexpected scalars: %v", decoded)
+	}
+	prices := decoded["prices"].([]interface{})
+	if len(prices) != 2 || prices[1] != int64(250) {
+		t.Errorf("unexpected prices: %v", prices)
+	}
+	counts := decoded["counts"].(map[interface{}]interface{})
+	if counts["apples"] != int64(3) || counts["pears"] != int64(5) {
+		t.Errorf("unexpected counts: %v", counts)
+	}
+	if item := decoded["item"].(map[string]interface{}); item["name"] != "basket" {
+		t.Errorf("unexpected item: %v", item)
+	}
+	if _, err := r.Decode("shop.Order", data[:len(data)-1]); err != errTruncated {
+		t.Errorf("expected errTruncated, got %v", err)
+	}
+}
+
+func TestLua(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	Load(L, testRegistry(t))
+	err := L.DoString(`
+		local data = protobuf.encode("shop.Order", {id = "x", prices = {1, 2, 3}, counts = {a = 1}})
+		local order = protobuf.decode("shop.Order", data)
+		assert(order.id == "x")
+		assert(#order.prices == 3 and order.prices[3] == 3)
+		assert(order.counts.a == 1)
+		local missing, err = protobuf.decode("shop.Missing", data)
+		assert(missing == nil and err ~= nil)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,353 @@
+// Package sanitize removes everything except for allowed elements and
+// attributes from HTML, for showing content from users, like comments
+package sanitize
+
+import (
+	"html"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// Policy decides which elements and attributes are kept
+type Policy struct {
+	// Elements that are kept, in lowercase
+	Elements map[string]bool
+	// Attributes that are kept, for each element, or for all elements with "*"
+	Attributes map[string]map[string]bool
+	// Add rel="nofollow noopener" to links
+	NoFollow bool
+	// Load images from other sites through this URL, followed by the
+	// escaped image URL, like "https://proxy.example.com/?url="
+	ImageProxy string
+}
+
+// Elements where also the contents are removed
+var dropContent = map[string]bool{
+	"script": true, "style": true, "iframe": true, "object": true, "embed": true,
+	"noscript": true, "template": true, "textarea": true, "title": true,
+	"svg": true, "math": true, "frameset": true, "noembed": true, "xmp": true,
+}
+
+// Attributes that contain URLs, which are only kept for safe URL schemes
+var urlAttributes = map[string]bool{
+	"href": true, "src": true, "cite": true, "action": true, "poster": true,
+	"background": true, "longdesc": true, "srcset": true,
+}
+
+// Elements without closing tags
+var voidElements = map[string]bool{
+	"br": true, "hr": true, "img": true, "wbr": true, "col": true,
+}
+
+// set creates a set from the given strings
+func set(values ...string) map[string]bool {
+	m := make(map[string]bool, len(values))
+	for _, value := range values {
+		m[value] = true
+	}
+	return m
+}
+
+// Strict returns a policy that removes all elements, and only keeps the text
+func Strict() *Policy {
+	return &Policy{Elements: map[string]bool{}, Attributes: map[string]map[string]bool{}}
+}
+
+// UGC returns a policy for user generated content, like comments, that keeps
+// elements for formatting text, links, images and tables
+func UGC() *Policy {
+	return &Policy{
+		Elements: set("a", "abbr", "b", "blockquote", "br", "caption", "cite", "code",
+			"dd", "del", "details", "dfn", "div", "dl", "dt", "em", "figcaption", "figure",
+			"h1", "h2", "h3", "h4", "h5", "h6", "hr", "i", "img", "ins", "kbd", "li", "mark",
+			"ol", "p", "pre", "q", "s", "samp", "small", "span", "strong", "sub", "summary",
+			"sup", "table", "tbody", "td", "tfoot", "th", "thead", "tr", "u", "ul"),
+		Attributes: map[string]map[string]bool{
+			"*":   set("title"),
+			"a":   set("href"),
+			"img": set("src", "alt", "width", "height"),
+			"ol":  set("start"),
+			"td":  set("colspan", "rowspan"),
+			"th":  set("colspan", "rowspan"),
+		},
+		NoFollow: true,
+	}
+}
+
+// safeURL checks that an URL is relative, or uses http, https or mailto
+func safeURL(u string) bool {
+	// Browsers ignore whitespace and control characters in the scheme
+	u = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, strings.ToLower(u))
+	colon := strings.IndexByte(u, ':')
+	if colon < 0 {
+		return true
+	}
+	if end := strings.IndexAny(u, "/?#"); end >= 0 && end < colon {
+		// The colon is not part of a scheme
+		return true
+	}
+	switch u[:colon] {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+// external checks if the URL is an http or https URL for another site
+func external(u string) bool {
+	u = strings.ToLower(strings.TrimSpace(u))
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "//")
+}
+
+// attribute is a parsed attribute, with the value unescaped
+type attribute struct {
+	name  string
+	value string
+}
+
+// tag is a parsed start or end tag
+type tag struct {
+	name    string
+	closing bool
+	attrs   []attribute
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// parseTag parses a tag that starts at s[0] == '<'. Returns the tag and the
+// length of it, or false if it is not a valid tag.
+func parseTag(s string) (tag, int, bool) {
+	var t tag
+	i := 1
+	if i < len(s) && s[i] == '/' {
+		t.closing = true
+		i++
+	}
+	start := i
+	for i < len(s) && (isLetter(s[i]) || (i > start && s[i] >= '0' && s[i] <= '9')) {
+		i++
+	}
+	if i == start {
+		return t, 0, false
+	}
+	t.name = strings.ToLower(s[start:i])
+	for i < len(s) {
+		for i < len(s) && (isSpace(s[i]) || s[i] == '/') {
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+		if s[i] == '>' {
+			return t, i + 1, true
+		}
+		start = i
+		for i < len(s) && !isSpace(s[i]) && s[i] != '=' && s[i] != '>' && s[i] != '/' {
+			i++
+		}
+		a := attribute{name: strings.ToLower(s[start:i])}
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		if i < len(s) && s[i] == '=' {
+			i++
+			for i < len(s) && isSpace(s[i]) {
+				i++
+			}
+			if i < len(s) && (s[i] == '"' || s[i] == '\'') {
+				end := strings.IndexByte(s[i+1:], s[i])
+				if end < 0 {
+					return t, 0, false
+				}
+				a.value = html.UnescapeString(s[i+1 : i+1+end])
+				i += end + 2
+			} else {
+				start = i
+				for i < len(s) && !isSpace(s[i]) && s[i] != '>' {
+					i++
+				}
+				a.value = html.UnescapeString(s[start:i])
+			}
+		}
+		t.attrs = append(t.attrs, a)
+	}
+	// There is no end of the tag
+	return t, 0, false
+}
+
+// allowed checks if the attribute is allowed for the element
+func (p *Policy) allowed(element, name string) bool {
+	return p.Attributes[element][name] || p.Attributes["*"][name]
+}
+
+// write writes an allowed tag, with only the allowed attributes
+func (p *Policy) write(sb *strings.Builder, t tag) {
+	if t.closing {
+		if !voidElements[t.name] {
+			sb.WriteString("</" + t.name + ">")
+		}
+		return
+	}
+	sb.WriteString("<" + t.name)
+	hasHref := false
+	for _, a := range t.attrs {
+		if !p.allowed(t.name, a.name) || (urlAttributes[a.name] && !safeURL(a.value)) {
+			continue
+		}
+		if t.name == "a" && p.NoFollow && a.name == "rel" {
+			continue
+		}
+		if a.name == "href" {
+			hasHref = true
+		}
+		if t.name == "img" && a.name == "src" && p.ImageProxy != "" && external(a.value) {
+			a.value = p.ImageProxy + url.QueryEscape(a.value)
+		}
+		sb.WriteString(" " + a.name + `="` + html.EscapeString(a.value) + `"`)
+	}
+	if t.name == "a" && p.NoFollow && hasHref {
+		sb.WriteString(` rel="nofollow noopener"`)
+	}
+	sb.WriteString(">")
+}
+
+// Sanitize removes the elements and attributes that are not allowed by the
+// policy, and escapes the text, so that it can not contain any other HTML
+func (p *Policy) Sanitize(s string) string {
+	var sb strings.Builder
+	for len(s) > 0 {
+		lt := strings.IndexByte(s, '<')
+		if lt < 0 {
+			sb.WriteString(html.EscapeString(html.UnescapeString(s)))
+			break
+		}
+		if lt > 0 {
+			sb.WriteString(html.EscapeString(html.UnescapeString(s[:lt])))
+			s = s[lt:]
+		}
+		switch {
+		case strings.HasPrefix(s, "<!--"):
+			// Remove comments
+			if end := strings.Index(s[4:], "-->"); end >= 0 {
+				s = s[4+end+3:]
+			} else {
+				s = ""
+			}
+			continue
+		case strings.HasPrefix(s, "<!") || strings.HasPrefix(s, "<?"):
+			// Remove doctypes and processing instructions
+			if end := strings.IndexByte(s, '>'); end >= 0 {
+				s = s[end+1:]
+			} else {
+				s = ""
+			}
+			continue
+		}
+		t, n, ok := parseTag(s)
+		if !ok {
+			sb.WriteString("&lt;")
+			s = s[1:]
+			continue
+		}
+		s = s[n:]
+		if dropContent[t.name] {
+			if !t.closing {
+				// Remove everything until the end tag
+				if end := strings.Index(strings.ToLower(s), "</"+t.name); end >= 0 {
+					s = s[end:]
+					if gt := strings.IndexByte(s, '>'); gt >= 0 {
+						s = s[gt+1:]
+					} else {
+						s = ""
+					}
+				} else {
+					s = ""
+				}
+			}
+			continue
+		}
+		if p.Elements[t.name] {
+			p.write(&sb, t)
+		}
+	}
+	return sb.String()
+}
+
+// strings returns the strings in a Lua table that is a list
+func tableStrings(t *lua.LTable) []string {
+	var values []string
+	t.ForEach(func(_, value lua.LValue) {
+		if s, ok := value.(lua.LString); ok {
+			values = append(values, strings.ToLower(string(s)))
+		}
+	})
+	sort.Strings(values)
+	return values
+}
+
+// FromTable creates a policy from a Lua table with the fields elements (a
+// list), attributes (a table with a list for each element, or for "*"),
+// nofollow (a boolean) and imageproxy (an URL)
+func FromTable(t *lua.LTable) *Policy {
+	p := Strict()
+	if elements, ok := t.RawGetString("elements").(*lua.LTable); ok {
+		p.Elements = set(tableStrings(elements)...)
+	}
+	if attributes, ok := t.RawGetString("attributes").(*lua.LTable); ok {
+		attributes.ForEach(func(key, value lua.LValue) {
+			if names, ok := value.(*lua.LTable); ok {
+				p.Attributes[strings.ToLower(key.String())] = set(tableStrings(names)...)
+			}
+		})
+	}
+	p.NoFollow = lua.LVAsBool(t.RawGetString("nofollow"))
+	if proxy, ok := t.RawGetString("imageproxy").(lua.LString); ok {
+		p.ImageProxy = string(proxy)
+	}
+	return p
+}
+
+// Load makes the SanitizeHTML function available to Lua scripts
+func Load(L *lua.LState) {
+	// Remove elements and attributes that are not allowed from HTML, like
+	// scripts. Takes HTML and an optional policy: "strict" for only keeping
+	// the text, "ugc" (the default) for user generated content like
+	// comments, or a table with allowed elements and attributes.
+	// Returns the sanitized HTML.
+	L.SetGlobal("SanitizeHTML", L.NewFunction(func(L *lua.LState) int {
+		input := L.CheckString(1)
+		var p *Policy
+		switch policy := L.Get(2).(type) {
+		case *lua.LTable:
+			p = FromTable(policy)
+		case lua.LString:
+			switch string(policy) {
+			case "strict":
+				p = Strict()
+			case "ugc":
+				p = UGC()
+			default:
+				L.ArgError(2, "\"strict\", \"ugc\" or a table expected")
+				return 0 // number of results
+			}
+		default:
+			p = UGC()
+		}
+		L.Push(lua.LString(p.Sanitize(input)))
+		return 1 // number of results
+	}))
+}
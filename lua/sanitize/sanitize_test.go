@@ -0,0 +1,55 @@
+package sanitize
+
+import (
+	"testing"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+func TestUGC(t *testing.T) {
+	for input, expected := range map[string]string{
+		`<b>bold</b> text`:                                    `<b>bold</b> text`,
+		`<script>alert(1)</script>hi`:                         `hi`,
+		`<SCRIPT>alert(1)</script >hi`:                        `hi`,
+		`<a href="javascript:alert(1)">x</a>`:                 `<a>x</a>`,
+		`<a href=" jav&#x09;ascript:alert(1)">x</a>`:          `<a>x</a>`,
+		`<a href="/page" rel="me" onclick="x()">x</a>`:        `<a href="/page" rel="nofollow noopener">x</a>`,
+		`<img src="https://example.com/a.png" onerror="x()">`: `<img src="https://example.com/a.png">`,
+		`<p title='a"b'>x</p>`:                                `<p title="a&#34;b">x</p>`,
+		`a < b & c`:                                           `a &lt; b &amp; c`,
+		`<!-- comment -->text`:                                `text`,
+		`<div <script>`:                                       `<div>`,
+		`<iframe src="x">inside</iframe>after`:                `after`,
+	} {
+		if got := UGC().Sanitize(input); got != expected {
+			t.Errorf("%s: expected %s, got %s", input, expected, got)
+		}
+	}
+}
+
+func TestImageProxy(t *testing.T) {
+	p := UGC()
+	p.ImageProxy = "/proxy?url="
+	if got := p.Sanitize(`<img src="https://example.com/a.png"><img src="/b.png">`); got != `<img src="/proxy?url=https%3A%2F%2Fexample.com%2Fa.png"><img src="/b.png">` {
+		t.Errorf("unexpected result: %s", got)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	if got := Strict().Sanitize(`<b>bold</b> &amp; <i>text</i>`); got != `bold &amp; text` {
+		t.Errorf("unexpected result: %s", got)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	Load(L)
+	script := `
+		assert(SanitizeHTML("<b>x</b><i>y</i>", {elements = {"b"}}) == "<b>x</b>y")
+		assert(SanitizeHTML("<b>x</b>", "strict") == "x")
+	`
+	if err := L.DoString(script); err != nil {
+		t.Error(err)
+	}
+}
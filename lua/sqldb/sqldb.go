@@ -0,0 +1,364 @@
+// Package sqldb provides Lua objects for running SQL queries and statements
+package sqldb
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// Identifiers for the classes in Lua
+const (
+	DBClass          = "SQLDB"
+	StatementClass   = "SQLSTATEMENT"
+	TransactionClass = "SQLTRANSACTION"
+)
+
+// querier is what a database connection and a prepared statement have in common,
+// once the SQL is given
+type querier interface {
+	Query(args ...interface{}) (*sql.Rows, error)
+	Exec(args ...interface{}) (sql.Result, error)
+}
+
+// conn is what a database connection and a transaction have in common
+type conn interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// boundQuery is SQL that is given together with a database connection or transaction
+type boundQuery struct {
+	c     conn
+	query string
+}
+
+// Query runs the query with the given parameters
+func (bq boundQuery) Query(args ...interface{}) (*sql.Rows, error) {
+	return bq.c.Query(bq.query, args...)
+}
+
+// Exec runs the statement with the given parameters
+func (bq boundQuery) Exec(args ...interface{}) (sql.Result, error) {
+	return bq.c.Exec(bq.query, args...)
+}
+
+// Get the first argument, "self", and cast it from userdata to a database
+func checkDB(L *lua.LState) *sql.DB {
+	ud := L.CheckUserData(1)
+	if db, ok := ud.Value.(*sql.DB); ok {
+		return db
+	}
+	L.ArgError(1, "database expected")
+	return nil
+}
+
+// Get the first argument, "self", and cast it from userdata to a statement
+func checkStatement(L *lua.LState) *sql.Stmt {
+	ud := L.CheckUserData(1)
+	if stmt, ok := ud.Value.(*sql.Stmt); ok {
+		return stmt
+	}
+	L.ArgError(1, "prepared statement expected")
+	return nil
+}
+
+// Get the first argument, "self", and cast it from userdata to a transaction
+func checkTransaction(L *lua.LState) *sql.Tx {
+	ud := L.CheckUserData(1)
+	if tx, ok := ud.Value.(*sql.Tx); ok {
+		return tx
+	}
+	L.ArgError(1, "transaction expected")
+	return nil
+}
+
+// Arguments returns the Lua arguments from the given position and up,
+// as parameters for a query
+func Arguments(L *lua.LState, from int) []interface{} {
+	var args []interface{}
+	for i := from; i <= L.GetTop(); i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LNumber:
+			if float64(v) == float64(int64(v)) {
+				args = append(args, int64(v))
+			} else {
+				args = append(args, float64(v))
+			}
+		case lua.LString:
+			args = append(args, string(v))
+		case lua.LBool:
+			args = append(args, bool(v))
+		case *lua.LNilType:
+			args = append(args, nil)
+		default:
+			args = append(args, v.String())
+		}
+	}
+	return args
+}
+
+// toLua converts a value from a database row to a Lua value
+func toLua(value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return lua.LNil
+	case int64:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case bool:
+		return lua.LBool(v)
+	case []byte:
+		return lua.LString(string(v))
+	case string:
+		return lua.LString(v)
+	case time.Time:
+		return lua.LString(v.Format(time.RFC3339))
+	}
+	return lua.LNil
+}
+
+// rowsToTable reads all rows into a table with one table per row,
+// where the keys are the column names
+func rowsToTable(L *lua.LState, rows *sql.Rows) (*lua.LTable, error) {
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := L.NewTable()
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		row := L.NewTable()
+		for i, column := range columns {
+			row.RawSetString(column, toLua(values[i]))
+		}
+		result.Append(row)
+	}
+	return result, rows.Err()
+}
+
+// Query runs a query and pushes a table with the rows, or nil and an error message.
+// Returns the number of results.
+func Query(L *lua.LState, q querier, args []interface{}) int {
+	rows, err := q.Query(args...)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	table, err := rowsToTable(L, rows)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(table)
+	return 1 // number of results
+}
+
+// Exec runs a statement and pushes the number of affected rows and the last
+// inserted ID, or nil and an error message. Returns the number of results.
+func Exec(L *lua.LState, q querier, args []interface{}) int {
+	result, err := q.Exec(args...)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	affected, _ := result.RowsAffected()
+	lastID, _ := result.LastInsertId()
+	L.Push(lua.LNumber(affected))
+	L.Push(lua.LNumber(lastID))
+	return 2 // number of results
+}
+
+// Run a query with parameters
+// db:query(string[, ...]) -> table
+func dbQuery(L *lua.LState) int {
+	db := checkDB(L) // arg 1
+	return Query(L, boundQuery{db, L.CheckString(2)}, Arguments(L, 3))
+}
+
+// Run a statement with parameters
+// db:exec(string[, ...]) -> number, number
+func dbExec(L *lua.LState) int {
+	db := checkDB(L) // arg 1
+	return Exec(L, boundQuery{db, L.CheckString(2)}, Arguments(L, 3))
+}
+
+// prepare creates a prepared statement and pushes it, or nil and an error
+// message. Returns the number of results.
+func prepare(L *lua.LState, c conn, query string) int {
+	stmt, err := c.Prepare(query)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(NewStatement(L, stmt))
+	return 1 // number of results
+}
+
+// Create a prepared statement
+// db:prepare(string) -> statement
+func dbPrepare(L *lua.LState) int {
+	db := checkDB(L) // arg 1
+	return prepare(L, db, L.CheckString(2))
+}
+
+// Start a transaction
+// db:begin() -> transaction
+func dbBegin(L *lua.LState) int {
+	db := checkDB(L) // arg 1
+	tx, err := db.Begin()
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(NewTransaction(L, tx))
+	return 1 // number of results
+}
+
+// Run a query with parameters, within a transaction
+// transaction:query(string[, ...]) -> table
+func transactionQuery(L *lua.LState) int {
+	tx := checkTransaction(L) // arg 1
+	return Query(L, boundQuery{tx, L.CheckString(2)}, Arguments(L, 3))
+}
+
+// Run a statement with parameters, within a transaction
+// transaction:exec(string[, ...]) -> number, number
+func transactionExec(L *lua.LState) int {
+	tx := checkTransaction(L) // arg 1
+	return Exec(L, boundQuery{tx, L.CheckString(2)}, Arguments(L, 3))
+}
+
+// Create a prepared statement, within a transaction
+// transaction:prepare(string) -> statement
+func transactionPrepare(L *lua.LState) int {
+	tx := checkTransaction(L) // arg 1
+	return prepare(L, tx, L.CheckString(2))
+}
+
+// finish pushes true, or false and an error message, depending on the
+// result of a commit or rollback. Returns the number of results.
+func finish(L *lua.LState, err error) int {
+	if err != nil {
+		L.Push(lua.LBool(false))
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(lua.LBool(true))
+	return 1 // number of results
+}
+
+// Commit a transaction
+// transaction:commit() -> bool
+func transactionCommit(L *lua.LState) int {
+	tx := checkTransaction(L) // arg 1
+	return finish(L, tx.Commit())
+}
+
+// Roll back a transaction
+// transaction:rollback() -> bool
+func transactionRollback(L *lua.LState) int {
+	tx := checkTransaction(L) // arg 1
+	return finish(L, tx.Rollback())
+}
+
+// Run a prepared statement as a query
+// statement:query([...]) -> table
+func statementQuery(L *lua.LState) int {
+	stmt := checkStatement(L) // arg 1
+	return Query(L, stmt, Arguments(L, 2))
+}
+
+// Run a prepared statement
+// statement:exec([...]) -> number, number
+func statementExec(L *lua.LState) int {
+	stmt := checkStatement(L) // arg 1
+	return Exec(L, stmt, Arguments(L, 2))
+}
+
+// Close a prepared statement
+// statement:close()
+func statementClose(L *lua.LState) int {
+	stmt := checkStatement(L) // arg 1
+	stmt.Close()
+	return 0 // number of results
+}
+
+// The database methods that are to be registered
+var dbMethods = map[string]lua.LGFunction{
+	"query":   dbQuery,
+	"exec":    dbExec,
+	"prepare": dbPrepare,
+	"begin":   dbBegin,
+}
+
+// The transaction methods that are to be registered
+var transactionMethods = map[string]lua.LGFunction{
+	"query":    transactionQuery,
+	"exec":     transactionExec,
+	"prepare":  transactionPrepare,
+	"commit":   transactionCommit,
+	"rollback": transactionRollback,
+}
+
+// The prepared statement methods that are to be registered
+var statementMethods = map[string]lua.LGFunction{
+	"query": statementQuery,
+	"exec":  statementExec,
+	"close": statementClose,
+}
+
+// NewDB creates a Lua object for the given database connection
+func NewDB(L *lua.LState, db *sql.DB) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = db
+	L.SetMetatable(ud, L.GetTypeMetatable(DBClass))
+	return ud
+}
+
+// NewStatement creates a Lua object for the given prepared statement
+func NewStatement(L *lua.LState, stmt *sql.Stmt) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = stmt
+	L.SetMetatable(ud, L.GetTypeMetatable(StatementClass))
+	return ud
+}
+
+// NewTransaction creates a Lua object for the given transaction
+func NewTransaction(L *lua.LState, tx *sql.Tx) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = tx
+	L.SetMetatable(ud, L.GetTypeMetatable(TransactionClass))
+	return ud
+}
+
+// Load registers the database, prepared statement and transaction classes in the given Lua state
+func Load(L *lua.LState) {
+	mt := L.NewTypeMetatable(DBClass)
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, dbMethods)
+
+	mt = L.NewTypeMetatable(StatementClass)
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, statementMethods)
+
+	mt = L.NewTypeMetatable(TransactionClass)
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, transactionMethods)
+}
@@ -100,6 +100,9 @@ func New(req *http.Request, scriptdir, formID string, uploadLimit int64) (*Uploa
 	return &UploadedFile{req, scriptdir, handler.Header, handler.Filename, buf}, nil
 }
 
+// Scanner checks an uploaded file, and returns an error if it is rejected
+type Scanner func(filename string, data []byte) error
+
 // Get the first argument, "self", and cast it from userdata to
 // an UploadedFile, which contains the file data and information.
 func checkUploadedFile(L *lua.LState) *UploadedFile {
@@ -112,12 +115,18 @@ func checkUploadedFile(L *lua.LState) *UploadedFile {
 }
 
 // Create a new Upload file
-func constructUploadedFile(L *lua.LState, req *http.Request, scriptdir, formID string, uploadLimit int64) (*lua.LUserData, error) {
+func constructUploadedFile(L *lua.LState, req *http.Request, scriptdir, formID string, uploadLimit int64, scan Scanner) (*lua.LUserData, error) {
 	// Create a new UploadedFile
 	uploadedfile, err := New(req, scriptdir, formID, uploadLimit)
 	if err != nil {
 		return nil, err
 	}
+	// Reject the file before it can be saved, if the scanner finds a problem
+	if scan != nil {
+		if err := scan(uploadedfile.filename, uploadedfile.Bytes()); err != nil {
+			return nil, err
+		}
+	}
 	// Create a new userdata struct
 	ud := L.NewUserData()
 	ud.Value = uploadedfile
@@ -158,13 +167,18 @@ func uploadedfileMimeType(L *lua.LState) int {
 	return 1 // number of results
 }
 
+// Bytes returns the contents of the uploaded file
+func (ulf *UploadedFile) Bytes() []byte {
+	return ulf.buf.Bytes()
+}
+
 // Write the uploaded file to the given full filename.
 // Does not overwrite files.
 func (ulf *UploadedFile) write(fullFilename string, fperm os.FileMode) error {
 	// Check if the file already exists
 	if _, err := os.Stat(fullFilename); err == nil { // exists
 		log.Error(fullFilename, " already exists")
-		return fmt.Errorf("File exists: " + fullFilename)
+		return fmt.Errorf("File exists: %s", fullFilename)
 	}
 	// Write the uploaded file
 	f, err := os.OpenFile(fullFilename, os.O_WRONLY|os.O_CREATE, fperm)
@@ -245,8 +259,9 @@ var uploadedfileMethods = map[string]lua.LGFunction{
 	"savein":     uploadedfileSaveIn,
 }
 
-// Load makes functions related to saving an uploaded file available
-func Load(L *lua.LState, w http.ResponseWriter, req *http.Request, scriptdir string) {
+// Load makes functions related to saving an uploaded file available.
+// Uploaded files are checked with the given scanner, if it is not nil.
+func Load(L *lua.LState, w http.ResponseWriter, req *http.Request, scriptdir string, scan Scanner) {
 
 	// Register the UploadedFile class and the methods that belongs with it.
 	mt := L.NewTypeMetatable(Class)
@@ -267,7 +282,7 @@ func Load(L *lua.LState, w http.ResponseWriter, req *http.Request, scriptdir str
 			uploadLimit = int64(L.ToInt(2)) * utils.MiB // optional upload limit, in MiB
 		}
 		// Construct a new UploadedFile
-		userdata, err := constructUploadedFile(L, req, scriptdir, formID, uploadLimit)
+		userdata, err := constructUploadedFile(L, req, scriptdir, formID, uploadLimit, scan)
 		if err != nil {
 			// Log the error
 			log.Error(err)
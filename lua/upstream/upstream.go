@@ -0,0 +1,42 @@
+// Package upstream keeps the HTTP headers that should be passed on when a
+// Lua script sends requests to other services, like the request ID
+package upstream
+
+import (
+	"net/http"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// The key for the headers in the Lua registry
+const registryKey = "algernon_upstream_headers"
+
+// SetHeaders stores the headers that should be added to requests that are
+// sent from the given Lua state. nil removes the headers.
+func SetHeaders(L *lua.LState, header http.Header) {
+	if header == nil {
+		L.G.Registry.RawSetString(registryKey, lua.LNil)
+		return
+	}
+	ud := L.NewUserData()
+	ud.Value = header
+	L.G.Registry.RawSetString(registryKey, ud)
+}
+
+// Apply adds the stored headers to the given request, unless the request
+// already has them
+func Apply(L *lua.LState, req *http.Request) {
+	ud, ok := L.G.Registry.RawGetString(registryKey).(*lua.LUserData)
+	if !ok {
+		return
+	}
+	header, ok := ud.Value.(http.Header)
+	if !ok {
+		return
+	}
+	for name, values := range header {
+		if _, exists := req.Header[name]; !exists {
+			req.Header[name] = values
+		}
+	}
+}
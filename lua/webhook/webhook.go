@@ -0,0 +1,61 @@
+// Package webhook provides Lua functions for checking the signatures of
+// webhook requests, like the ones that payment providers send
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/xyproto/gopher-lua"
+)
+
+// Sign returns the HMAC-SHA256 of the body, as a hex string
+func Sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks that the signature is the HMAC-SHA256 of the body, given as
+// a hex or base64 string, with or without a "sha256=" prefix
+func Verify(secret, signature, body string) bool {
+	if secret == "" {
+		return false
+	}
+	signature = strings.TrimPrefix(strings.TrimSpace(signature), "sha256=")
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	expected := mac.Sum(nil)
+	if got, err := hex.DecodeString(signature); err == nil && hmac.Equal(got, expected) {
+		return true
+	}
+	if got, err := base64.StdEncoding.DecodeString(signature); err == nil && hmac.Equal(got, expected) {
+		return true
+	}
+	return false
+}
+
+// Load makes the webhook signature functions available to Lua scripts
+func Load(L *lua.LState) {
+	// Check the signature of a webhook request. Takes a shared secret, the
+	// signature from the request header and the request body. Returns true
+	// if the signature is the HMAC-SHA256 of the body.
+	L.SetGlobal("VerifyWebhook", L.NewFunction(func(L *lua.LState) int {
+		secret := L.CheckString(1)
+		signature := L.CheckString(2)
+		body := L.CheckString(3)
+		L.Push(lua.LBool(Verify(secret, signature, body)))
+		return 1 // number of results
+	}))
+	// Sign a webhook request body, for sending webhooks to other services.
+	// Takes a shared secret and a body. Returns the HMAC-SHA256 as a hex string.
+	L.SetGlobal("SignWebhook", L.NewFunction(func(L *lua.LState) int {
+		secret := L.CheckString(1)
+		body := L.CheckString(2)
+		L.Push(lua.LString(Sign(secret, body)))
+		return 1 // number of results
+	}))
+}
@@ -0,0 +1,21 @@
+package webhook
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	body := `{"event":"paid"}`
+	signature := Sign("secret", body)
+	raw, _ := hex.DecodeString(signature)
+	for _, s := range []string{signature, "sha256=" + signature, base64.StdEncoding.EncodeToString(raw)} {
+		if !Verify("secret", s, body) {
+			t.Errorf("%s should be accepted", s)
+		}
+	}
+	if Verify("other", signature, body) || Verify("secret", signature, body+" ") || Verify("", Sign("", body), body) {
+		t.Error("invalid signatures should not be accepted")
+	}
+}
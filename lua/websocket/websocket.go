@@ -0,0 +1,332 @@
+// Package websocket provides a small WebSocket (RFC 6455) server implementation,
+// and functions for using WebSocket connections from Lua
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xyproto/algernon/utils"
+	"github.com/xyproto/gopher-lua"
+)
+
+// Opcodes for the WebSocket frames
+const (
+	continuationFrame = 0x0
+	TextMessage       = 0x1
+	BinaryMessage     = 0x2
+	closeFrame        = 0x8
+	pingFrame         = 0x9
+	pongFrame         = 0xA
+)
+
+const (
+	// Used when calculating the Sec-WebSocket-Accept header
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// The largest message that will be received
+	maxMessageSize = 4 * utils.MiB
+
+	// How long a close frame or a pong frame may take to write
+	controlWriteTimeout = 5 * time.Second
+
+	// The longest reason that fits in a close frame, after the status code
+	maxCloseReason = 123
+)
+
+// Status codes for closing a connection
+const (
+	NormalClosure = 1000
+	InternalError = 1011
+)
+
+var (
+	errNotWebSocket  = errors.New("not a WebSocket handshake")
+	errBadVersion    = errors.New("unsupported WebSocket version")
+	errNoHijack      = errors.New("the connection does not support WebSockets")
+	errNotMasked     = errors.New("received a frame from the client that was not masked")
+	errTooLarge      = errors.New("received a WebSocket message that was too large")
+	errFragmented    = errors.New("received a fragmented control frame")
+	errUnexpectedCon = errors.New("received an unexpected continuation frame")
+
+	// ErrClosed is returned when reading from or writing to a closed connection
+	ErrClosed = errors.New("the WebSocket connection is closed")
+)
+
+// Conn is a WebSocket connection, on the server side
+type Conn struct {
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+	writeMut sync.Mutex
+	closeMut sync.Mutex
+	closed   bool
+}
+
+// acceptKey calculates the value of the Sec-WebSocket-Accept header
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains checks if a comma separated header contains the given token
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsUpgrade checks if the given request is a WebSocket handshake
+func IsUpgrade(req *http.Request) bool {
+	return req.Method == http.MethodGet &&
+		headerContains(req.Header, "Connection", "upgrade") &&
+		headerContains(req.Header, "Upgrade", "websocket")
+}
+
+// Upgrade performs the WebSocket handshake and takes over the connection
+func Upgrade(w http.ResponseWriter, req *http.Request) (*Conn, error) {
+	if !IsUpgrade(req) {
+		return nil, errNotWebSocket
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, errBadVersion
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errNotWebSocket
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errNoHijack
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// The server timeouts are meant for regular requests, not for long-lived connections
+	conn.SetDeadline(time.Time{})
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, rw: rw}, nil
+}
+
+// writeFrame writes a single, unmasked and unfragmented frame
+func (c *Conn) writeFrame(opcode byte, data []byte) error {
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(data); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(data); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// readFrame reads a single frame, and unmasks the payload
+func (c *Conn) readFrame() (fin bool, opcode byte, data []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.rw, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	if header[1]&0x80 == 0 {
+		err = errNotMasked
+		return
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.rw, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.rw, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxMessageSize {
+		err = errTooLarge
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.rw, mask[:]); err != nil {
+		return
+	}
+	data = make([]byte, length)
+	if _, err = io.ReadFull(c.rw, data); err != nil {
+		return
+	}
+	for i := range data {
+		data[i] ^= mask[i%4]
+	}
+	return
+}
+
+// ReadMessage reads the next text or binary message. Ping frames are
+// answered, and a close frame closes the connection.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	var (
+		messageType int
+		message     []byte
+	)
+	for {
+		fin, opcode, data, err := c.readFrame()
+		if err != nil {
+			c.Close()
+			if err == io.EOF {
+				err = ErrClosed
+			}
+			return 0, nil, err
+		}
+		switch opcode {
+		case pingFrame, pongFrame, closeFrame:
+			if !fin {
+				c.Close()
+				return 0, nil, errFragmented
+			}
+			if opcode == closeFrame {
+				c.Close()
+				return 0, nil, ErrClosed
+			}
+			if opcode == pingFrame {
+				c.conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+				c.writeFrame(pongFrame, data)
+				c.conn.SetWriteDeadline(time.Time{})
+			}
+			continue
+		case continuationFrame:
+			if messageType == 0 {
+				c.Close()
+				return 0, nil, errUnexpectedCon
+			}
+		default:
+			messageType = int(opcode)
+			message = nil
+		}
+		if uint64(len(message)+len(data)) > maxMessageSize {
+			c.Close()
+			return 0, nil, errTooLarge
+		}
+		message = append(message, data...)
+		if fin {
+			return messageType, message, nil
+		}
+	}
+}
+
+// WriteMessage sends a text or binary message
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if c.IsClosed() {
+		return ErrClosed
+	}
+	return c.writeFrame(byte(messageType), data)
+}
+
+// IsClosed checks if the connection has been closed
+func (c *Conn) IsClosed() bool {
+	c.closeMut.Lock()
+	defer c.closeMut.Unlock()
+	return c.closed
+}
+
+// Close sends a close frame, if possible, and closes the connection.
+// It is safe to call Close more than once.
+func (c *Conn) Close() error {
+	return c.CloseWithStatus(NormalClosure, "")
+}
+
+// CloseWithStatus sends a close frame with the given status code and
+// reason, if possible, and closes the connection. The reason is shortened
+// to what fits in a control frame.
+func (c *Conn) CloseWithStatus(code int, reason string) error {
+	c.closeMut.Lock()
+	defer c.closeMut.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if len(reason) > maxCloseReason {
+		// The reason must be valid UTF-8
+		reason = strings.ToValidUTF8(reason[:maxCloseReason], "")
+	}
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	c.conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+	c.writeFrame(closeFrame, payload)
+	return c.conn.Close()
+}
+
+// NewTable creates a Lua table with send, receive and close functions
+// for the given connection. Meant to be passed to Lua WebSocket handlers.
+func NewTable(L *lua.LState, conn *Conn) *lua.LTable {
+	t := L.NewTable()
+
+	// Send a text message. Returns true if the message was sent.
+	L.SetField(t, "send", L.NewFunction(func(L *lua.LState) int {
+		err := conn.WriteMessage(TextMessage, []byte(L.ToString(1)))
+		L.Push(lua.LBool(err == nil))
+		return 1 // number of results
+	}))
+
+	// Wait for the next message. Returns the message, or nil and an error
+	// message if the connection has been closed.
+	L.SetField(t, "receive", L.NewFunction(func(L *lua.LState) int {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LString(string(message)))
+		return 1 // number of results
+	}))
+
+	// Close the connection
+	L.SetField(t, "close", L.NewFunction(func(L *lua.LState) int {
+		conn.Close()
+		return 0 // number of results
+	}))
+
+	return t
+}
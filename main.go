@@ -18,8 +18,9 @@ func main() {
 	// Create a new Algernon server. Also initialize log files etc.
 	algernon, err := engine.New(versionString, description)
 	if err != nil {
-		if err == engine.ErrVersion {
-			// Exit with error code 0 if --version was specified
+		if err == engine.ErrVersion || err == engine.ErrCommand {
+			// Exit with error code 0 if --version was specified,
+			// or if a subcommand was sent to a running instance
 			os.Exit(0)
 		} else {
 			// Exit if there are problems with the fundamental setup
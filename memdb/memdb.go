@@ -0,0 +1,433 @@
+// Package memdb provides in-memory data structures, users and permissions,
+// with the same interfaces as the database backends. The contents can be
+// saved to and loaded from a JSON file. The users and permissions can also
+// be kept in the data structures of other databases.
+package memdb
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/xyproto/pinterface"
+)
+
+var errNotFound = errors.New("no such key")
+
+// contents is everything that is stored in a database
+type contents struct {
+	Lists     map[string][]string                     `json:"lists"`
+	Sets      map[string]map[string]bool              `json:"sets"`
+	HashMaps  map[string]map[string]map[string]string `json:"hashmaps"`
+	KeyValues map[string]map[string]string            `json:"keyvalues"`
+}
+
+// Database is an in-memory database that can be used concurrently
+type Database struct {
+	mut  sync.RWMutex
+	data contents
+}
+
+// New creates a new and empty database
+func New() *Database {
+	return &Database{data: contents{
+		Lists:     make(map[string][]string),
+		Sets:      make(map[string]map[string]bool),
+		HashMaps:  make(map[string]map[string]map[string]string),
+		KeyValues: make(map[string]map[string]string),
+	}}
+}
+
+// Load creates a new database with the contents of the given JSON file.
+// If the file does not exist, the database is empty.
+func Load(filename string) (*Database, error) {
+	db := New()
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return db, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &db.data); err != nil {
+		return nil, err
+	}
+	// Files from older versions, or written by hand, may lack some of the maps
+	loaded := New()
+	if db.data.Lists == nil {
+		db.data.Lists = loaded.data.Lists
+	}
+	if db.data.Sets == nil {
+		db.data.Sets = loaded.data.Sets
+	}
+	if db.data.HashMaps == nil {
+		db.data.HashMaps = loaded.data.HashMaps
+	}
+	if db.data.KeyValues == nil {
+		db.data.KeyValues = loaded.data.KeyValues
+	}
+	return db, nil
+}
+
+// Save writes the contents of the database to the given JSON file.
+// The file is replaced only after all the contents have been written.
+func (db *Database) Save(filename string) error {
+	db.mut.RLock()
+	data, err := json.Marshal(db.data)
+	db.mut.RUnlock()
+	if err != nil {
+		return err
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	return os.Rename(tempFile.Name(), filename)
+}
+
+// Ping always succeeds, since the database is in memory. It helps fulfill the IHost interface.
+func (db *Database) Ping() error {
+	return nil
+}
+
+// Close does nothing, since the database is in memory. It helps fulfill the IHost interface.
+func (db *Database) Close() {}
+
+// List is a list of strings
+type List struct {
+	db *Database
+	id string
+}
+
+// NewList returns the list with the given name
+func NewList(db *Database, id string) *List {
+	return &List{db, id}
+}
+
+// Add a value to the end of the list
+func (l *List) Add(value string) error {
+	l.db.mut.Lock()
+	defer l.db.mut.Unlock()
+	l.db.data.Lists[l.id] = append(l.db.data.Lists[l.id], value)
+	return nil
+}
+
+// All returns all the values in the list
+func (l *List) All() ([]string, error) {
+	l.db.mut.RLock()
+	defer l.db.mut.RUnlock()
+	return append([]string{}, l.db.data.Lists[l.id]...), nil
+}
+
+// Last returns the last value in the list, or an empty string
+func (l *List) Last() (string, error) {
+	l.db.mut.RLock()
+	defer l.db.mut.RUnlock()
+	values := l.db.data.Lists[l.id]
+	if len(values) == 0 {
+		return "", nil
+	}
+	return values[len(values)-1], nil
+}
+
+// LastN returns the last n values in the list
+func (l *List) LastN(n int) ([]string, error) {
+	l.db.mut.RLock()
+	defer l.db.mut.RUnlock()
+	values := l.db.data.Lists[l.id]
+	if n < len(values) {
+		values = values[len(values)-n:]
+	}
+	return append([]string{}, values...), nil
+}
+
+// Remove the list
+func (l *List) Remove() error {
+	l.db.mut.Lock()
+	defer l.db.mut.Unlock()
+	delete(l.db.data.Lists, l.id)
+	return nil
+}
+
+// Clear removes all values from the list
+func (l *List) Clear() error {
+	return l.Remove()
+}
+
+// Set is a set of strings
+type Set struct {
+	db *Database
+	id string
+}
+
+// NewSet returns the set with the given name
+func NewSet(db *Database, id string) *Set {
+	return &Set{db, id}
+}
+
+// Add a value to the set
+func (s *Set) Add(value string) error {
+	s.db.mut.Lock()
+	defer s.db.mut.Unlock()
+	if s.db.data.Sets[s.id] == nil {
+		s.db.data.Sets[s.id] = make(map[string]bool)
+	}
+	s.db.data.Sets[s.id][value] = true
+	return nil
+}
+
+// Has checks if the given value is in the set
+func (s *Set) Has(value string) (bool, error) {
+	s.db.mut.RLock()
+	defer s.db.mut.RUnlock()
+	return s.db.data.Sets[s.id][value], nil
+}
+
+// All returns all the values in the set, sorted
+func (s *Set) All() ([]string, error) {
+	s.db.mut.RLock()
+	defer s.db.mut.RUnlock()
+	values := []string{}
+	for value := range s.db.data.Sets[s.id] {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// Del removes a value from the set
+func (s *Set) Del(value string) error {
+	s.db.mut.Lock()
+	defer s.db.mut.Unlock()
+	delete(s.db.data.Sets[s.id], value)
+	return nil
+}
+
+// Remove the set
+func (s *Set) Remove() error {
+	s.db.mut.Lock()
+	defer s.db.mut.Unlock()
+	delete(s.db.data.Sets, s.id)
+	return nil
+}
+
+// Clear removes all values from the set
+func (s *Set) Clear() error {
+	return s.Remove()
+}
+
+// HashMap is a map from owners, like usernames, to keys and values
+type HashMap struct {
+	db *Database
+	id string
+}
+
+// NewHashMap returns the hash map with the given name
+func NewHashMap(db *Database, id string) *HashMap {
+	return &HashMap{db, id}
+}
+
+// Set a value for an owner and a key
+func (h *HashMap) Set(owner, key, value string) error {
+	h.db.mut.Lock()
+	defer h.db.mut.Unlock()
+	if h.db.data.HashMaps[h.id] == nil {
+		h.db.data.HashMaps[h.id] = make(map[string]map[string]string)
+	}
+	if h.db.data.HashMaps[h.id][owner] == nil {
+		h.db.data.HashMaps[h.id][owner] = make(map[string]string)
+	}
+	h.db.data.HashMaps[h.id][owner][key] = value
+	return nil
+}
+
+// Get a value, given an owner and a key. Returns an error if the value is missing.
+func (h *HashMap) Get(owner, key string) (string, error) {
+	h.db.mut.RLock()
+	defer h.db.mut.RUnlock()
+	value, ok := h.db.data.HashMaps[h.id][owner][key]
+	if !ok {
+		return "", errNotFound
+	}
+	return value, nil
+}
+
+// Has checks if the given owner has the given key
+func (h *HashMap) Has(owner, key string) (bool, error) {
+	h.db.mut.RLock()
+	defer h.db.mut.RUnlock()
+	_, ok := h.db.data.HashMaps[h.id][owner][key]
+	return ok, nil
+}
+
+// Exists checks if the given owner has any keys
+func (h *HashMap) Exists(owner string) (bool, error) {
+	h.db.mut.RLock()
+	defer h.db.mut.RUnlock()
+	_, ok := h.db.data.HashMaps[h.id][owner]
+	return ok, nil
+}
+
+// All returns all the owners, sorted
+func (h *HashMap) All() ([]string, error) {
+	h.db.mut.RLock()
+	defer h.db.mut.RUnlock()
+	owners := []string{}
+	for owner := range h.db.data.HashMaps[h.id] {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	return owners, nil
+}
+
+// Keys returns all the keys for the given owner, sorted
+func (h *HashMap) Keys(owner string) ([]string, error) {
+	h.db.mut.RLock()
+	defer h.db.mut.RUnlock()
+	keys := []string{}
+	for key := range h.db.data.HashMaps[h.id][owner] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// DelKey removes a key for the given owner
+func (h *HashMap) DelKey(owner, key string) error {
+	h.db.mut.Lock()
+	defer h.db.mut.Unlock()
+	delete(h.db.data.HashMaps[h.id][owner], key)
+	return nil
+}
+
+// Del removes an owner and all the keys for it
+func (h *HashMap) Del(owner string) error {
+	h.db.mut.Lock()
+	defer h.db.mut.Unlock()
+	delete(h.db.data.HashMaps[h.id], owner)
+	return nil
+}
+
+// Remove the hash map
+func (h *HashMap) Remove() error {
+	h.db.mut.Lock()
+	defer h.db.mut.Unlock()
+	delete(h.db.data.HashMaps, h.id)
+	return nil
+}
+
+// Clear removes all owners, keys and values from the hash map
+func (h *HashMap) Clear() error {
+	return h.Remove()
+}
+
+// KeyValue is a map from keys to values
+type KeyValue struct {
+	db *Database
+	id string
+}
+
+// NewKeyValue returns the key/value map with the given name
+func NewKeyValue(db *Database, id string) *KeyValue {
+	return &KeyValue{db, id}
+}
+
+// Set a value
+func (kv *KeyValue) Set(key, value string) error {
+	kv.db.mut.Lock()
+	defer kv.db.mut.Unlock()
+	if kv.db.data.KeyValues[kv.id] == nil {
+		kv.db.data.KeyValues[kv.id] = make(map[string]string)
+	}
+	kv.db.data.KeyValues[kv.id][key] = value
+	return nil
+}
+
+// Get a value. Returns an error if the value is missing.
+func (kv *KeyValue) Get(key string) (string, error) {
+	kv.db.mut.RLock()
+	defer kv.db.mut.RUnlock()
+	value, ok := kv.db.data.KeyValues[kv.id][key]
+	if !ok {
+		return "", errNotFound
+	}
+	return value, nil
+}
+
+// Del removes a value
+func (kv *KeyValue) Del(key string) error {
+	kv.db.mut.Lock()
+	defer kv.db.mut.Unlock()
+	delete(kv.db.data.KeyValues[kv.id], key)
+	return nil
+}
+
+// Inc increases the number that is stored for the given key, and returns
+// the new number. Missing values count as 0.
+func (kv *KeyValue) Inc(key string) (string, error) {
+	kv.db.mut.Lock()
+	defer kv.db.mut.Unlock()
+	if kv.db.data.KeyValues[kv.id] == nil {
+		kv.db.data.KeyValues[kv.id] = make(map[string]string)
+	}
+	n, _ := strconv.ParseInt(kv.db.data.KeyValues[kv.id][key], 10, 64)
+	value := strconv.FormatInt(n+1, 10)
+	kv.db.data.KeyValues[kv.id][key] = value
+	return value, nil
+}
+
+// Remove the key/value map
+func (kv *KeyValue) Remove() error {
+	kv.db.mut.Lock()
+	defer kv.db.mut.Unlock()
+	delete(kv.db.data.KeyValues, kv.id)
+	return nil
+}
+
+// Clear removes all keys and values
+func (kv *KeyValue) Clear() error {
+	return kv.Remove()
+}
+
+// Creator is for creating data structures in a database
+type Creator struct {
+	db *Database
+}
+
+// NewCreator returns a Creator for the given database
+func NewCreator(db *Database) *Creator {
+	return &Creator{db}
+}
+
+// NewList returns the list with the given name
+func (c *Creator) NewList(id string) (pinterface.IList, error) {
+	return NewList(c.db, id), nil
+}
+
+// NewSet returns the set with the given name
+func (c *Creator) NewSet(id string) (pinterface.ISet, error) {
+	return NewSet(c.db, id), nil
+}
+
+// NewHashMap returns the hash map with the given name
+func (c *Creator) NewHashMap(id string) (pinterface.IHashMap, error) {
+	return NewHashMap(c.db, id), nil
+}
+
+// NewKeyValue returns the key/value map with the given name
+func (c *Creator) NewKeyValue(id string) (pinterface.IKeyValue, error) {
+	return NewKeyValue(c.db, id), nil
+}
@@ -0,0 +1,80 @@
+package memdb
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/xyproto/pinterface"
+)
+
+// The in-memory types must be usable in place of the database backends
+var (
+	_ pinterface.IPermissions = &Permissions{}
+	_ pinterface.IUserState   = &UserState{}
+	_ pinterface.ICreator     = &Creator{}
+)
+
+func TestSaveLoad(t *testing.T) {
+	db := New()
+	NewList(db, "l").Add("a")
+	NewSet(db, "s").Add("b")
+	NewHashMap(db, "h").Set("bob", "color", "blue")
+	kv := NewKeyValue(db, "kv")
+	kv.Inc("n")
+	if n, _ := kv.Inc("n"); n != "2" {
+		t.Fatalf("expected 2, got %s", n)
+	}
+
+	filename := filepath.Join(t.TempDir(), "memdb.json")
+	if err := db.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last, _ := NewList(loaded, "l").Last(); last != "a" {
+		t.Errorf("expected a, got %q", last)
+	}
+	if has, _ := NewSet(loaded, "s").Has("b"); !has {
+		t.Error("expected the set to contain b")
+	}
+	if color, _ := NewHashMap(loaded, "h").Get("bob", "color"); color != "blue" {
+		t.Errorf("expected blue, got %q", color)
+	}
+	if n, _ := NewKeyValue(loaded, "kv").Get("n"); n != "2" {
+		t.Errorf("expected 2, got %q", n)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	perm := NewPermissions(New())
+	state := perm.UserState()
+	state.AddUser("bob", "hunter2", "bob@example.com")
+	if !state.CorrectPassword("bob", "hunter2") || state.CorrectPassword("bob", "hunter3") {
+		t.Fatal("wrong password check")
+	}
+
+	recorder := httptest.NewRecorder()
+	if err := state.Login(recorder, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/data/x", nil)
+	if !perm.Rejected(recorder, req) {
+		t.Error("expected the request without a cookie to be rejected")
+	}
+	for _, c := range recorder.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	if perm.Rejected(recorder, req) {
+		t.Error("expected the request from a logged in user to be accepted")
+	}
+	req = httptest.NewRequest("GET", "/admin", nil)
+	for _, c := range recorder.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	if !perm.Rejected(recorder, req) {
+		t.Error("expected the admin page to be rejected for a user that is not an admin")
+	}
+}
@@ -0,0 +1,161 @@
+package memdb
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/xyproto/pinterface"
+)
+
+// Permissions keeps track of which path prefixes require user or admin rights
+type Permissions struct {
+	mut                sync.RWMutex
+	state              *UserState
+	adminPathPrefixes  []string
+	userPathPrefixes   []string
+	publicPathPrefixes []string
+	rootIsPublic       bool
+	denied             http.HandlerFunc
+}
+
+// NewPermissions creates a Permissions struct for the given database, with
+// the same default path prefixes as the other database backends
+func NewPermissions(db *Database) *Permissions {
+	return newPermissions(NewUserState(db))
+}
+
+// NewPermissionsWith creates a Permissions struct that keeps the users in
+// the data structures from the given creator, so that other databases can
+// be used
+func NewPermissionsWith(host pinterface.IHost, creator pinterface.ICreator) (*Permissions, error) {
+	state, err := NewUserStateWith(host, creator)
+	if err != nil {
+		return nil, err
+	}
+	return newPermissions(state), nil
+}
+
+// newPermissions creates a Permissions struct for the given UserState, with
+// the default path prefixes
+func newPermissions(state *UserState) *Permissions {
+	return &Permissions{
+		state:             state,
+		adminPathPrefixes: []string{"/admin"},
+		userPathPrefixes:  []string{"/repo", "/data"},
+		publicPathPrefixes: []string{"/", "/login", "/register", "/favicon.ico", "/style", "/img", "/js",
+			"/robots.txt", "/sitemap_index.xml"},
+		rootIsPublic: true,
+		denied:       PermissionDenied,
+	}
+}
+
+// PermissionDenied is the default "permission denied" handler function
+func PermissionDenied(w http.ResponseWriter, req *http.Request) {
+	http.Error(w, "Permission denied.", http.StatusForbidden)
+}
+
+// SetDenyFunction sets the handler for when permission is denied
+func (perm *Permissions) SetDenyFunction(f http.HandlerFunc) {
+	perm.mut.Lock()
+	defer perm.mut.Unlock()
+	perm.denied = f
+}
+
+// DenyFunction returns the handler for when permission is denied
+func (perm *Permissions) DenyFunction() http.HandlerFunc {
+	perm.mut.RLock()
+	defer perm.mut.RUnlock()
+	return perm.denied
+}
+
+// UserState returns the UserState
+func (perm *Permissions) UserState() pinterface.IUserState {
+	return perm.state
+}
+
+// Clear makes every path public
+func (perm *Permissions) Clear() {
+	perm.mut.Lock()
+	defer perm.mut.Unlock()
+	perm.adminPathPrefixes = []string{}
+	perm.userPathPrefixes = []string{}
+}
+
+// AddAdminPath adds a path prefix that requires admin rights
+func (perm *Permissions) AddAdminPath(prefix string) {
+	perm.mut.Lock()
+	defer perm.mut.Unlock()
+	perm.adminPathPrefixes = append(perm.adminPathPrefixes, prefix)
+}
+
+// AddUserPath adds a path prefix that requires user rights
+func (perm *Permissions) AddUserPath(prefix string) {
+	perm.mut.Lock()
+	defer perm.mut.Unlock()
+	perm.userPathPrefixes = append(perm.userPathPrefixes, prefix)
+}
+
+// AddPublicPath adds a path prefix that is public
+func (perm *Permissions) AddPublicPath(prefix string) {
+	perm.mut.Lock()
+	defer perm.mut.Unlock()
+	perm.publicPathPrefixes = append(perm.publicPathPrefixes, prefix)
+}
+
+// SetAdminPath sets the path prefixes that require admin rights
+func (perm *Permissions) SetAdminPath(pathPrefixes []string) {
+	perm.mut.Lock()
+	defer perm.mut.Unlock()
+	perm.adminPathPrefixes = pathPrefixes
+}
+
+// SetUserPath sets the path prefixes that require user rights
+func (perm *Permissions) SetUserPath(pathPrefixes []string) {
+	perm.mut.Lock()
+	defer perm.mut.Unlock()
+	perm.userPathPrefixes = pathPrefixes
+}
+
+// SetPublicPath sets the path prefixes that are public
+func (perm *Permissions) SetPublicPath(pathPrefixes []string) {
+	perm.mut.Lock()
+	defer perm.mut.Unlock()
+	perm.publicPathPrefixes = pathPrefixes
+}
+
+// hasPrefix checks if the path starts with one of the prefixes
+func hasPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rejected checks if the request should be rejected
+func (perm *Permissions) Rejected(w http.ResponseWriter, req *http.Request) bool {
+	perm.mut.RLock()
+	defer perm.mut.RUnlock()
+	path := req.URL.Path
+	if perm.rootIsPublic && path == "/" {
+		return false
+	}
+	if hasPrefix(path, perm.adminPathPrefixes) && !perm.state.AdminRights(req) {
+		return true
+	}
+	if hasPrefix(path, perm.userPathPrefixes) && !perm.state.UserRights(req) {
+		return true
+	}
+	return !hasPrefix(path, perm.publicPathPrefixes)
+}
+
+// ServeHTTP is a middleware handler that rejects requests without the right permissions
+func (perm *Permissions) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	if perm.Rejected(w, req) {
+		perm.DenyFunction()(w, req)
+		return
+	}
+	next(w, req)
+}
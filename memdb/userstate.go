@@ -0,0 +1,403 @@
+package memdb
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/xyproto/cookie"
+	"github.com/xyproto/pinterface"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The minimum length of the generated confirmation codes
+const defaultConfirmationCodeLength = 20
+
+// UserState keeps track of users, login states and confirmation codes
+type UserState struct {
+	host              pinterface.IHost
+	creator           pinterface.ICreator
+	users             pinterface.IHashMap // users and their fields ("loggedin", "confirmed", "email" etc)
+	usernames         pinterface.ISet     // all usernames
+	unconfirmed       pinterface.ISet     // usernames that are not yet confirmed
+	cookieSecret      string              // secret for storing secure cookies
+	cookieTime        int64               // how long a cookie should last, in seconds
+	passwordAlgorithm string              // "bcrypt+", "bcrypt" or "sha256"
+	codeLength        int                 // the minimum length of confirmation codes
+}
+
+// NewUserState creates a new UserState for the given database
+func NewUserState(db *Database) *UserState {
+	state, _ := NewUserStateWith(db, NewCreator(db))
+	return state
+}
+
+// NewUserStateWith creates a new UserState that keeps the users in the data
+// structures from the given creator, so that other databases can be used
+func NewUserStateWith(host pinterface.IHost, creator pinterface.ICreator) (*UserState, error) {
+	users, err := creator.NewHashMap("users")
+	if err != nil {
+		return nil, err
+	}
+	usernames, err := creator.NewSet("usernames")
+	if err != nil {
+		return nil, err
+	}
+	unconfirmed, err := creator.NewSet("unconfirmed")
+	if err != nil {
+		return nil, err
+	}
+	return &UserState{
+		host:              host,
+		creator:           creator,
+		users:             users,
+		usernames:         usernames,
+		unconfirmed:       unconfirmed,
+		cookieSecret:      cookie.RandomCookieFriendlyString(30),
+		cookieTime:        3600 * 24,
+		passwordAlgorithm: "bcrypt+",
+		codeLength:        defaultConfirmationCodeLength,
+	}, nil
+}
+
+// Host returns the underlying database
+func (state *UserState) Host() pinterface.IHost {
+	return state.host
+}
+
+// Users returns a hash map of all the users
+func (state *UserState) Users() pinterface.IHashMap {
+	return state.users
+}
+
+// Creator returns a struct for creating data structures
+func (state *UserState) Creator() pinterface.ICreator {
+	return state.creator
+}
+
+// UserRights checks if the current user is logged in
+func (state *UserState) UserRights(req *http.Request) bool {
+	username, err := state.UsernameCookie(req)
+	return err == nil && state.IsLoggedIn(username)
+}
+
+// AdminRights checks if the current user is logged in and is an administrator
+func (state *UserState) AdminRights(req *http.Request) bool {
+	username, err := state.UsernameCookie(req)
+	return err == nil && state.IsLoggedIn(username) && state.IsAdmin(username)
+}
+
+// HasUser checks if the given user exists
+func (state *UserState) HasUser(username string) bool {
+	has, _ := state.usernames.Has(username)
+	return has
+}
+
+// BooleanField returns a boolean field for the given user. Returns false if
+// the user or field is missing.
+func (state *UserState) BooleanField(username, fieldname string) bool {
+	if !state.HasUser(username) {
+		return false
+	}
+	value, err := state.users.Get(username, fieldname)
+	return err == nil && value == "true"
+}
+
+// SetBooleanField stores a boolean field for the given user
+func (state *UserState) SetBooleanField(username, fieldname string, val bool) {
+	value := "false"
+	if val {
+		value = "true"
+	}
+	state.users.Set(username, fieldname, value)
+}
+
+// IsConfirmed checks if a user is confirmed
+func (state *UserState) IsConfirmed(username string) bool {
+	return state.BooleanField(username, "confirmed")
+}
+
+// IsLoggedIn checks if a user is logged in
+func (state *UserState) IsLoggedIn(username string) bool {
+	return state.BooleanField(username, "loggedin")
+}
+
+// IsAdmin checks if a user is an administrator
+func (state *UserState) IsAdmin(username string) bool {
+	return state.BooleanField(username, "admin")
+}
+
+// UsernameCookie returns the username that is stored in the browser cookie
+func (state *UserState) UsernameCookie(req *http.Request) (string, error) {
+	username, ok := cookie.SecureCookie(req, "user", state.cookieSecret)
+	if ok && username != "" {
+		return username, nil
+	}
+	return "", errors.New("Could not retrieve the username from browser cookie")
+}
+
+// SetUsernameCookie stores the username in a cookie in the browser.
+// The user must exist.
+func (state *UserState) SetUsernameCookie(w http.ResponseWriter, username string) error {
+	if username == "" {
+		return errors.New("Can't set cookie for empty username")
+	}
+	if !state.HasUser(username) {
+		return errors.New("Can't store cookie for non-existing user")
+	}
+	cookie.SetSecureCookiePathWithFlags(w, "user", username, state.cookieTime, "/", state.cookieSecret, false, true)
+	return nil
+}
+
+// AllUsernames returns all the usernames
+func (state *UserState) AllUsernames() ([]string, error) {
+	return state.usernames.All()
+}
+
+// Email returns the e-mail address for the given user
+func (state *UserState) Email(username string) (string, error) {
+	return state.users.Get(username, "email")
+}
+
+// PasswordHash returns the password hash for the given user
+func (state *UserState) PasswordHash(username string) (string, error) {
+	return state.users.Get(username, "password")
+}
+
+// AllUnconfirmedUsernames returns all the users that are not yet confirmed
+func (state *UserState) AllUnconfirmedUsernames() ([]string, error) {
+	return state.unconfirmed.All()
+}
+
+// ConfirmationCode returns the confirmation code for the given user
+func (state *UserState) ConfirmationCode(username string) (string, error) {
+	return state.users.Get(username, "confirmationCode")
+}
+
+// AddUnconfirmed registers a user as not yet confirmed, with the given confirmation code
+func (state *UserState) AddUnconfirmed(username, confirmationCode string) {
+	state.unconfirmed.Add(username)
+	state.users.Set(username, "confirmationCode", confirmationCode)
+}
+
+// RemoveUnconfirmed removes a user from the users that are not yet confirmed
+func (state *UserState) RemoveUnconfirmed(username string) {
+	state.unconfirmed.Del(username)
+	state.users.DelKey(username, "confirmationCode")
+}
+
+// MarkConfirmed marks a user as confirmed
+func (state *UserState) MarkConfirmed(username string) {
+	state.users.Set(username, "confirmed", "true")
+}
+
+// RemoveUser removes a user and all fields for the user
+func (state *UserState) RemoveUser(username string) {
+	state.usernames.Del(username)
+	state.users.Del(username)
+}
+
+// SetAdminStatus marks a user as an administrator
+func (state *UserState) SetAdminStatus(username string) {
+	state.users.Set(username, "admin", "true")
+}
+
+// RemoveAdminStatus removes the administrator status from a user
+func (state *UserState) RemoveAdminStatus(username string) {
+	state.users.Set(username, "admin", "false")
+}
+
+// AddUser creates a user and hashes the password. The given data must be valid.
+func (state *UserState) AddUser(username, password, email string) {
+	passwordHash := state.HashPassword(username, password)
+	state.usernames.Add(username)
+	state.users.Set(username, "password", passwordHash)
+	state.users.Set(username, "email", email)
+	for _, fieldname := range []string{"loggedin", "confirmed", "admin"} {
+		state.users.Set(username, fieldname, "false")
+	}
+}
+
+// SetLoggedIn marks a user as logged in
+func (state *UserState) SetLoggedIn(username string) {
+	state.users.Set(username, "loggedin", "true")
+}
+
+// SetLoggedOut marks a user as logged out
+func (state *UserState) SetLoggedOut(username string) {
+	state.users.Set(username, "loggedin", "false")
+}
+
+// Login marks a user as logged in and stores the username in a cookie
+func (state *UserState) Login(w http.ResponseWriter, username string) error {
+	state.SetLoggedIn(username)
+	return state.SetUsernameCookie(w, username)
+}
+
+// ClearCookie tries to clear the user cookie by setting it to be expired
+func (state *UserState) ClearCookie(w http.ResponseWriter) {
+	cookie.ClearCookie(w, "user", "/")
+}
+
+// Logout marks a user as logged out
+func (state *UserState) Logout(username string) {
+	state.SetLoggedOut(username)
+}
+
+// Username returns the username from the browser cookie, or an empty string
+func (state *UserState) Username(req *http.Request) string {
+	username, _ := state.UsernameCookie(req)
+	return username
+}
+
+// CookieTimeout returns how long a login cookie lasts, in seconds
+func (state *UserState) CookieTimeout(username string) int64 {
+	return state.cookieTime
+}
+
+// SetCookieTimeout sets how long a login cookie lasts, in seconds
+func (state *UserState) SetCookieTimeout(cookieTime int64) {
+	state.cookieTime = cookieTime
+}
+
+// CookieSecret returns the secret for the secure cookies
+func (state *UserState) CookieSecret() string {
+	return state.cookieSecret
+}
+
+// SetCookieSecret sets the secret for the secure cookies
+func (state *UserState) SetCookieSecret(cookieSecret string) {
+	state.cookieSecret = cookieSecret
+}
+
+// PasswordAlgo returns the password hashing algorithm
+func (state *UserState) PasswordAlgo() string {
+	return state.passwordAlgorithm
+}
+
+// SetPasswordAlgo sets the password hashing algorithm: "bcrypt", "sha256"
+// or "bcrypt+", which stores passwords with bcrypt, but also checks sha256.
+func (state *UserState) SetPasswordAlgo(algorithm string) error {
+	switch algorithm {
+	case "sha256", "bcrypt", "bcrypt+":
+		state.passwordAlgorithm = algorithm
+		return nil
+	}
+	return errors.New("Permissions: " + algorithm + " is an unsupported encryption algorithm")
+}
+
+// hashSha256 hashes the password with sha256, salted with the cookie secret and username
+func (state *UserState) hashSha256(username, password string) []byte {
+	hasher := sha256.New()
+	io.WriteString(hasher, password+state.cookieSecret+username)
+	return hasher.Sum(nil)
+}
+
+// HashPassword creates a password hash. Some algorithms use the username as salt.
+func (state *UserState) HashPassword(username, password string) string {
+	switch state.passwordAlgorithm {
+	case "sha256":
+		return string(state.hashSha256(username, password))
+	case "bcrypt", "bcrypt+":
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			panic("Permissions: bcrypt password hashing unsuccessful")
+		}
+		return string(hash)
+	}
+	return ""
+}
+
+// SetPassword hashes and stores the password for a user
+func (state *UserState) SetPassword(username, password string) {
+	state.users.Set(username, "password", state.HashPassword(username, password))
+}
+
+// CorrectPassword checks if a password is correct for the given user
+func (state *UserState) CorrectPassword(username, password string) bool {
+	if !state.HasUser(username) {
+		return false
+	}
+	hashString, err := state.PasswordHash(username)
+	if err != nil || hashString == "" {
+		return false
+	}
+	hash := []byte(hashString)
+	correctSha256 := func() bool {
+		comparisonHash := state.hashSha256(username, password)
+		return len(hash) == len(comparisonHash) && subtle.ConstantTimeCompare(hash, comparisonHash) == 1
+	}
+	correctBcrypt := func() bool {
+		return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	}
+	switch state.passwordAlgorithm {
+	case "sha256":
+		return correctSha256()
+	case "bcrypt":
+		return correctBcrypt()
+	case "bcrypt+":
+		// sha256 hashes are 32 bytes
+		if len(hash) == sha256.Size && correctSha256() {
+			return true
+		}
+		return correctBcrypt()
+	}
+	return false
+}
+
+// AlreadyHasConfirmationCode checks if the confirmation code is used by a user that is not yet confirmed
+func (state *UserState) AlreadyHasConfirmationCode(confirmationCode string) bool {
+	_, err := state.FindUserByConfirmationCode(confirmationCode)
+	return err == nil
+}
+
+// FindUserByConfirmationCode returns the user that is not yet confirmed
+// and that has the given confirmation code
+func (state *UserState) FindUserByConfirmationCode(confirmationCode string) (string, error) {
+	unconfirmedUsernames, _ := state.AllUnconfirmedUsernames()
+	for _, username := range unconfirmedUsernames {
+		code, err := state.ConfirmationCode(username)
+		if err == nil && code == confirmationCode {
+			if !state.HasUser(username) {
+				return username, errors.New("The user that is to be confirmed no longer exists.")
+			}
+			return username, nil
+		}
+	}
+	return "", errors.New("The confirmation code is no longer valid.")
+}
+
+// Confirm marks a user as confirmed and removes the confirmation code
+func (state *UserState) Confirm(username string) {
+	state.RemoveUnconfirmed(username)
+	state.MarkConfirmed(username)
+}
+
+// ConfirmUserByConfirmationCode confirms the user with the given confirmation code
+func (state *UserState) ConfirmUserByConfirmationCode(confirmationCode string) error {
+	username, err := state.FindUserByConfirmationCode(confirmationCode)
+	if err != nil {
+		return err
+	}
+	state.Confirm(username)
+	return nil
+}
+
+// SetMinimumConfirmationCodeLength sets the minimum length of the confirmation codes
+func (state *UserState) SetMinimumConfirmationCodeLength(length int) {
+	state.codeLength = length
+}
+
+// GenerateUniqueConfirmationCode generates a confirmation code that is not already in use
+func (state *UserState) GenerateUniqueConfirmationCode() (string, error) {
+	const maxConfirmationCodeLength = 100
+	for length := state.codeLength; length <= maxConfirmationCodeLength; length++ {
+		confirmationCode := cookie.RandomHumanFriendlyString(length)
+		if !state.AlreadyHasConfirmationCode(confirmationCode) {
+			return confirmationCode, nil
+		}
+	}
+	return "", errors.New("Too many generated confirmation codes are not unique!")
+}
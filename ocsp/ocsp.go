@@ -0,0 +1,317 @@
+// Package ocsp creates OCSP (RFC 6960) requests and checks the responses,
+// so that the responses can be stapled to TLS handshakes
+package ocsp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// The maximum size of an OCSP response
+const maxResponseSize = 1 << 20
+
+// The certificate statuses
+const (
+	Good = iota
+	Revoked
+	Unknown
+)
+
+var (
+	errNoServer    = errors.New("ocsp: the certificate has no OCSP server")
+	errNotBasic    = errors.New("ocsp: the response is not a basic OCSP response")
+	errNoMatch     = errors.New("ocsp: the response is not for this certificate")
+	errNoStatus    = errors.New("ocsp: the response has no certificate status")
+	errResponder   = errors.New("ocsp: the responder certificate is not allowed to sign OCSP responses")
+	errTrailing    = errors.New("ocsp: trailing data after the response")
+	errSignatureID = errors.New("ocsp: unsupported signature algorithm")
+
+	oidSHA1          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidBasicResponse = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+)
+
+// The signature algorithms that responses can be signed with
+var signatureAlgorithms = []struct {
+	oid       asn1.ObjectIdentifier
+	algorithm x509.SignatureAlgorithm
+}{
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}, x509.SHA1WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}, x509.SHA256WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}, x509.SHA384WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}, x509.SHA512WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}, x509.ECDSAWithSHA1},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}, x509.ECDSAWithSHA256},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}, x509.ECDSAWithSHA384},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}, x509.ECDSAWithSHA512},
+	{asn1.ObjectIdentifier{1, 3, 101, 112}, x509.PureEd25519},
+}
+
+// ResponseError is returned when the OCSP server did not return a response,
+// with one of the status codes from RFC 6960, like 3 for "try later"
+type ResponseError struct {
+	Status int
+}
+
+func (e ResponseError) Error() string {
+	return fmt.Sprintf("ocsp: the server returned status %d", e.Status)
+}
+
+type certID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	KeyHash       []byte
+	SerialNumber  *big.Int
+}
+
+type request struct {
+	Cert certID
+}
+
+type tbsRequest struct {
+	Version     int `asn1:"explicit,tag:0,default:0,optional"`
+	RequestList []request
+}
+
+type ocspRequest struct {
+	TBSRequest tbsRequest
+}
+
+type responseASN1 struct {
+	Status   asn1.Enumerated
+	Response responseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type responseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type basicResponse struct {
+	TBSResponseData    responseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type responseData struct {
+	Raw                asn1.RawContent
+	Version            int `asn1:"explicit,tag:0,default:0,optional"`
+	ResponderID        asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []singleResponse
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type singleResponse struct {
+	CertID           certID
+	Good             asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked          revokedInfo      `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type revokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// Response is a checked OCSP response for one certificate
+type Response struct {
+	Raw        []byte // the DER encoded response, for stapling
+	Status     int    // Good, Revoked or Unknown
+	ProducedAt time.Time
+	ThisUpdate time.Time
+	NextUpdate time.Time // may be zero, if newer information is always available
+	RevokedAt  time.Time
+}
+
+// newCertID returns the identifier of a certificate, as used in OCSP
+// requests and responses. SHA-1 is used, since all OCSP servers support it.
+func newCertID(cert, issuer *x509.Certificate) (certID, error) {
+	var spki subjectPublicKeyInfo
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return certID{}, err
+	}
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+	return certID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash[:],
+		KeyHash:       keyHash[:],
+		SerialNumber:  cert.SerialNumber,
+	}, nil
+}
+
+// matches checks if the identifier from a response is for the given
+// certificate and issuer
+func (id certID) matches(cert, issuer *x509.Certificate) bool {
+	if id.SerialNumber == nil || id.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		return false
+	}
+	if !id.HashAlgorithm.Algorithm.Equal(oidSHA1) {
+		// Only the serial number can be compared
+		return true
+	}
+	expected, err := newCertID(cert, issuer)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(id.NameHash, expected.NameHash) && bytes.Equal(id.KeyHash, expected.KeyHash)
+}
+
+// CreateRequest returns a DER encoded OCSP request for the status of a
+// certificate
+func CreateRequest(cert, issuer *x509.Certificate) ([]byte, error) {
+	id, err := newCertID(cert, issuer)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(ocspRequest{tbsRequest{RequestList: []request{{id}}}})
+}
+
+// signatureAlgorithm returns the algorithm for an algorithm identifier
+func signatureAlgorithm(ai pkix.AlgorithmIdentifier) x509.SignatureAlgorithm {
+	for _, sa := range signatureAlgorithms {
+		if ai.Algorithm.Equal(sa.oid) {
+			return sa.algorithm
+		}
+	}
+	return x509.UnknownSignatureAlgorithm
+}
+
+// ParseResponse parses a DER encoded OCSP response for a certificate, and
+// checks that it is signed by the issuer, or by a responder certificate that
+// the issuer has allowed to sign OCSP responses.
+func ParseResponse(der []byte, cert, issuer *x509.Certificate) (*Response, error) {
+	var resp responseASN1
+	rest, err := asn1.Unmarshal(der, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errTrailing
+	}
+	if resp.Status != 0 {
+		return nil, ResponseError{int(resp.Status)}
+	}
+	if !resp.Response.ResponseType.Equal(oidBasicResponse) {
+		return nil, errNotBasic
+	}
+	var basic basicResponse
+	if _, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		return nil, err
+	}
+
+	algorithm := signatureAlgorithm(basic.SignatureAlgorithm)
+	if algorithm == x509.UnknownSignatureAlgorithm {
+		return nil, errSignatureID
+	}
+	signer := issuer
+	if len(basic.Certificates) > 0 {
+		responder, err := x509.ParseCertificate(basic.Certificates[0].FullBytes)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(responder.Raw, issuer.Raw) {
+			if err := responder.CheckSignatureFrom(issuer); err != nil {
+				return nil, err
+			}
+			allowed := false
+			for _, usage := range responder.ExtKeyUsage {
+				if usage == x509.ExtKeyUsageOCSPSigning {
+					allowed = true
+				}
+			}
+			if !allowed {
+				return nil, errResponder
+			}
+			signer = responder
+		}
+	}
+	if err := signer.CheckSignature(algorithm, basic.TBSResponseData.Raw, basic.Signature.RightAlign()); err != nil {
+		return nil, err
+	}
+
+	for _, single := range basic.TBSResponseData.Responses {
+		if !single.CertID.matches(cert, issuer) {
+			continue
+		}
+		r := &Response{
+			Raw:        der,
+			ProducedAt: basic.TBSResponseData.ProducedAt,
+			ThisUpdate: single.ThisUpdate,
+			NextUpdate: single.NextUpdate,
+		}
+		switch {
+		case bool(single.Good):
+			r.Status = Good
+		case bool(single.Unknown):
+			r.Status = Unknown
+		case !single.Revoked.RevocationTime.IsZero():
+			r.Status = Revoked
+			r.RevokedAt = single.Revoked.RevocationTime
+		default:
+			return nil, errNoStatus
+		}
+		return r, nil
+	}
+	return nil, errNoMatch
+}
+
+// Fetch asks the OCSP server of a certificate for the status of the
+// certificate, and checks the response
+func Fetch(ctx context.Context, client *http.Client, cert, issuer *x509.Certificate) (*Response, error) {
+	if len(cert.OCSPServer) == 0 {
+		return nil, errNoServer
+	}
+	data, err := CreateRequest(cert, issuer)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, cert.OCSPServer[0], bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ocsp: %s returned %s", cert.OCSPServer[0], resp.Status)
+	}
+	der, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	return ParseResponse(der, cert, issuer)
+}
+
+// Valid checks if the response can be stapled at the given time, which is
+// when the certificate is good and the response has not expired. An hour
+// of clock skew is allowed for when the response was made.
+func (r *Response) Valid(now time.Time) bool {
+	if r.Status != Good || now.Before(r.ThisUpdate.Add(-time.Hour)) {
+		return false
+	}
+	return r.NextUpdate.IsZero() || now.Before(r.NextUpdate)
+}
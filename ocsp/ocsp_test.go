@@ -0,0 +1,142 @@
+package ocsp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newCert(t *testing.T, template, parent *x509.Certificate, key, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testChain returns an issuer, the key of the issuer and a certificate
+func testChain(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey, *x509.Certificate) {
+	caKey := newKey(t)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	ca := newCert(t, caTemplate, caTemplate, caKey, caKey)
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		OCSPServer:   []string{"http://ocsp.example.com"},
+	}
+	leaf := newCert(t, leafTemplate, ca, newKey(t), caKey)
+	return ca, caKey, leaf
+}
+
+// respond creates a response for a certificate, signed with the given key
+func respond(t *testing.T, cert, issuer *x509.Certificate, key *ecdsa.PrivateKey, single singleResponse) []byte {
+	id, err := newCertID(cert, issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	single.CertID = id
+	keyHash, _ := asn1.Marshal(id.KeyHash)
+	tbs, err := asn1.Marshal(responseData{
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: keyHash},
+		ProducedAt:  single.ThisUpdate,
+		Responses:   []singleResponse{single},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(tbs)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	basic, err := asn1.Marshal(basicResponse{
+		TBSResponseData:    responseData{Raw: tbs},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+		Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(responseASN1{Response: responseBytes{oidBasicResponse, basic}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestCreateRequest(t *testing.T) {
+	ca, _, leaf := testChain(t)
+	der, err := CreateRequest(leaf, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req ocspRequest
+	if _, err := asn1.Unmarshal(der, &req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.TBSRequest.RequestList) != 1 || !req.TBSRequest.RequestList[0].Cert.matches(leaf, ca) {
+		t.Errorf("the request is not for the certificate: %+v", req)
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	ca, caKey, leaf := testChain(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	der := respond(t, leaf, ca, caKey, singleResponse{Good: true, ThisUpdate: now, NextUpdate: now.Add(24 * time.Hour)})
+	r, err := ParseResponse(der, leaf, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != Good || !r.NextUpdate.Equal(now.Add(24*time.Hour)) {
+		t.Errorf("unexpected response: %+v", r)
+	}
+	if !r.Valid(now) || r.Valid(now.Add(25*time.Hour)) {
+		t.Error("the response should only be valid until the next update")
+	}
+
+	revoked := respond(t, leaf, ca, caKey, singleResponse{Revoked: revokedInfo{RevocationTime: now}, ThisUpdate: now})
+	if r, err := ParseResponse(revoked, leaf, ca); err != nil || r.Status != Revoked || r.Valid(now) {
+		t.Errorf("expected a revoked status, got %+v, %v", r, err)
+	}
+
+	// Signed by someone other than the issuer
+	forged := respond(t, leaf, ca, newKey(t), singleResponse{Good: true, ThisUpdate: now})
+	if _, err := ParseResponse(forged, leaf, ca); err == nil {
+		t.Error("expected an error for a response with a bad signature")
+	}
+
+	// An error status, like "try later"
+	if _, err := ParseResponse([]byte{0x30, 0x03, 0x0a, 0x01, 0x03}, leaf, ca); err != (ResponseError{3}) {
+		t.Errorf("expected a ResponseError, got %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+// +build windows plan9
+
+package platformdep
+
+import (
+	"os"
+)
+
+// NotifyRestart does nothing on platforms without SIGUSR2, and returns false
+func NotifyRestart(c chan<- os.Signal) bool {
+	return false
+}
+
+// NotifyReload does nothing on platforms without SIGHUP, and returns false
+func NotifyReload(c chan<- os.Signal) bool {
+	return false
+}
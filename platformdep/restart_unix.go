@@ -0,0 +1,23 @@
+// +build !windows,!plan9
+
+package platformdep
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// NotifyRestart sends SIGUSR2 to the given channel, for restarting without
+// closing the listening sockets
+func NotifyRestart(c chan<- os.Signal) bool {
+	signal.Notify(c, syscall.SIGUSR2)
+	return true
+}
+
+// NotifyReload sends SIGHUP to the given channel, for loading the TLS
+// certificates again
+func NotifyReload(c chan<- os.Signal) bool {
+	signal.Notify(c, syscall.SIGHUP)
+	return true
+}
@@ -0,0 +1,9 @@
+// +build windows plan9
+
+package platformdep
+
+// Umask does nothing on platforms without a file mode creation mask, and
+// returns 0
+func Umask(mask int) int {
+	return 0
+}
@@ -0,0 +1,13 @@
+// +build !windows,!plan9
+
+package platformdep
+
+import (
+	"syscall"
+)
+
+// Umask sets the file mode creation mask of the process, and returns the
+// previous mask
+func Umask(mask int) int {
+	return syscall.Umask(mask)
+}
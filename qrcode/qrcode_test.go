@@ -0,0 +1,60 @@
+package qrcode
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// The data codewords for "HELLO WORLD" as 1-M, and the error correction
+	// codewords from the specification
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	expected := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(10)); !bytes.Equal(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	// The largest number of bytes for some of the versions and levels
+	for _, tc := range []struct {
+		n       int
+		level   Level
+		version int
+	}{
+		{17, Low, 1}, {14, Medium, 1}, {11, Quartile, 1}, {7, High, 1},
+		{15, Medium, 2}, {213, Medium, 10}, {2953, Low, 40},
+	} {
+		c, err := Encode([]byte(strings.Repeat("a", tc.n)), tc.level)
+		if err != nil || c.version != tc.version || c.Size != tc.version*4+17 {
+			t.Errorf("%d bytes at level %d: expected version %d, got %v, %v", tc.n, tc.level, tc.version, c, err)
+		}
+	}
+	if _, err := Encode(make([]byte, 2954), Low); err != errTooLong {
+		t.Error("too much data should not be encoded")
+	}
+}
+
+func TestPNG(t *testing.T) {
+	c, err := Encode([]byte("https://example.com/"), Medium)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The finder pattern at the top left, and the separator next to it
+	if !c.Dark(0, 0) || !c.Dark(6, 6) || c.Dark(7, 7) || c.Dark(1, 1) {
+		t.Error("the finder pattern is missing")
+	}
+	data, err := c.PNG(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width := img.Bounds().Dx(); width > 256 || width%(c.Size+8) != 0 {
+		t.Errorf("unexpected width: %d", width)
+	}
+}
@@ -0,0 +1,245 @@
+package sftpd
+
+// The files below the root directory, for the SFTP requests
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+var (
+	errExists   = errors.New("the file already exists")
+	errNotDir   = errors.New("not a directory")
+	errIsDir    = errors.New("is a directory")
+	errNoAppend = errors.New("appending is not supported")
+)
+
+// files serves the SFTP requests for the files below root. Paths are
+// relative to the root, and the client can not go above the root, also
+// not by following symbolic links.
+type files struct {
+	root    *os.Root
+	changed func(name string)
+}
+
+// newHandlers returns the SFTP request handlers for the files below root
+func newHandlers(root *os.Root, changed func(string)) sftp.Handlers {
+	fs := &files{root, changed}
+	return sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs}
+}
+
+// clean returns the path of a file, relative to the root
+func clean(name string) string {
+	if rel := path.Clean("/" + name)[1:]; rel != "" {
+		return rel
+	}
+	return "."
+}
+
+// notify tells that a file or directory has been changed
+func (fs *files) notify(name string) {
+	if fs.changed != nil {
+		fs.changed(path.Clean("/" + name))
+	}
+}
+
+// writtenFile is a file that is open for writing, and that is reported as
+// changed when it is closed
+type writtenFile struct {
+	*os.File
+	fs   *files
+	name string
+}
+
+// Close closes the file and tells that it has been changed
+func (f *writtenFile) Close() error {
+	err := f.File.Close()
+	f.fs.notify(f.name)
+	return err
+}
+
+// Fileread opens a file for reading
+func (fs *files) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return fs.root.Open(clean(r.Filepath))
+}
+
+// Filewrite opens a file for writing
+func (fs *files) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return fs.OpenFile(r)
+}
+
+// OpenFile opens a file for writing, and possibly also for reading
+func (fs *files) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	pflags := r.Pflags()
+	if pflags.Append {
+		// Files that are opened with O_APPEND can not be written with WriteAt
+		return nil, errNoAppend
+	}
+	flags := os.O_WRONLY
+	if pflags.Read {
+		flags = os.O_RDWR
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	perm := os.FileMode(0644)
+	if r.AttrFlags().Permissions {
+		perm = r.Attributes().FileMode().Perm()
+	}
+	f, err := fs.root.OpenFile(clean(r.Filepath), flags, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &writtenFile{f, fs, r.Filepath}, nil
+}
+
+// setAttrs changes the size, permissions and times of a file
+func (fs *files) setAttrs(r *sftp.Request) error {
+	name := clean(r.Filepath)
+	flags, a := r.AttrFlags(), r.Attributes()
+	if flags.Size {
+		f, err := fs.root.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		err = f.Truncate(int64(a.Size))
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := fs.root.Chmod(name, a.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := fs.root.Chtimes(name, time.Unix(int64(a.Atime), 0), time.Unix(int64(a.Mtime), 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove removes a file, or an empty directory if dir is true
+func (fs *files) remove(name string, dir bool) error {
+	fi, err := fs.root.Lstat(clean(name))
+	if err != nil {
+		return err
+	}
+	if dir && !fi.IsDir() {
+		return errNotDir
+	}
+	if !dir && fi.IsDir() {
+		return errIsDir
+	}
+	return fs.root.Remove(clean(name))
+}
+
+// rename renames a file or directory. Existing files are only replaced if
+// replace is true.
+func (fs *files) rename(r *sftp.Request, replace bool) error {
+	if !replace {
+		if _, err := fs.root.Lstat(clean(r.Target)); err == nil {
+			return errExists
+		}
+	}
+	if err := fs.root.Rename(clean(r.Filepath), clean(r.Target)); err != nil {
+		return err
+	}
+	fs.notify(r.Filepath)
+	fs.notify(r.Target)
+	return nil
+}
+
+// Filecmd handles the requests that change files and directories, except
+// for writing to files
+func (fs *files) Filecmd(r *sftp.Request) error {
+	var err error
+	switch r.Method {
+	case "Setstat":
+		err = fs.setAttrs(r)
+	case "Rename":
+		return fs.rename(r, false)
+	case "Mkdir":
+		err = fs.root.Mkdir(clean(r.Filepath), 0755)
+	case "Rmdir":
+		err = fs.remove(r.Filepath, true)
+	case "Remove":
+		err = fs.remove(r.Filepath, false)
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	if err == nil {
+		fs.notify(r.Filepath)
+	}
+	return err
+}
+
+// PosixRename renames a file or directory, and replaces any existing file
+func (fs *files) PosixRename(r *sftp.Request) error {
+	return fs.rename(r, true)
+}
+
+// fileList is a list of files, for the responses to list and stat requests
+type fileList []os.FileInfo
+
+// ListAt copies the files from the given offset
+func (l fileList) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Filelist lists a directory, or returns the information for a file
+func (fs *files) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		f, err := fs.root.Open(clean(r.Filepath))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		infos, err := f.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(infos, func(i, j int) bool {
+			return infos[i].Name() < infos[j].Name()
+		})
+		return fileList(infos), nil
+	case "Stat":
+		fi, err := fs.root.Stat(clean(r.Filepath))
+		if err != nil {
+			return nil, err
+		}
+		return fileList{fi}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// Lstat returns the information for a file, without following a symbolic link
+func (fs *files) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	fi, err := fs.root.Lstat(clean(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	return fileList{fi}, nil
+}
@@ -0,0 +1,97 @@
+package sftpd
+
+// Host keys and authorized keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The smallest RSA keys that are accepted
+const minRSABits = 2048
+
+// supported checks if a key can be used for logging in. Ed25519, ECDSA and
+// RSA keys of at least minRSABits are supported.
+func supported(key ssh.PublicKey) bool {
+	switch t := key.Type(); {
+	case t == ssh.KeyAlgoED25519, strings.HasPrefix(t, "ecdsa-sha2-"):
+		return true
+	case t == ssh.KeyAlgoRSA:
+		if cryptoKey, ok := key.(ssh.CryptoPublicKey); ok {
+			rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+			return ok && rsaKey.N.BitLen() >= minRSABits
+		}
+	}
+	return false
+}
+
+// ParseAuthorizedKeys parses keys in the format of the OpenSSH
+// authorized_keys files. Empty lines, comments and unsupported key types
+// are skipped. Options before the key type are ignored.
+func ParseAuthorizedKeys(data []byte) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for len(data) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			// There are no more keys that can be parsed
+			break
+		}
+		if supported(key) {
+			keys = append(keys, key)
+		}
+		data = rest
+	}
+	return keys, nil
+}
+
+// ReadAuthorizedKeys reads the keys from an authorized_keys file
+func ReadAuthorizedKeys(filename string) ([]ssh.PublicKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAuthorizedKeys(data)
+}
+
+// HostKey reads a host key from a PEM file, or creates a new Ed25519 host
+// key and writes it to the file, if the file does not exist
+func HostKey(filename string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			return nil, err
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+			return nil, err
+		}
+		return ssh.NewSignerFromKey(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// HostKeyFingerprint returns the SHA-256 fingerprint of the public part of
+// a host key, so that it can be compared with the one the clients show
+func HostKeyFingerprint(key ssh.Signer) string {
+	return ssh.FingerprintSHA256(key.PublicKey())
+}
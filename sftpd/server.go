@@ -0,0 +1,158 @@
+// Package sftpd is an SSH server that only provides the SFTP subsystem, for
+// publishing files to a directory with sftp, scp or anything else that uses
+// SFTP, authenticated by public keys
+package sftpd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// How long the clients have for the key exchange and authentication
+	authTimeout = time.Minute
+
+	// The most authentication attempts for one connection
+	maxAuthAttempts = 10
+
+	// How many channels can be open on one connection
+	maxChannels = 16
+)
+
+var (
+	errNoHostKey     = errors.New("sftpd: no host key")
+	errNoRoot        = errors.New("sftpd: no root directory")
+	errNotAuthorized = errors.New("sftpd: the key is not authorized")
+)
+
+// Server serves SFTP for the files below the Root directory, to the
+// clients that have one of the authorized keys
+type Server struct {
+	Root           string
+	HostKey        ssh.Signer
+	AuthorizedKeys []ssh.PublicKey
+
+	// Called with the path of a file or directory, from the root, when it
+	// has been changed, if not nil
+	Changed func(name string)
+
+	// For logging connections, if not nil
+	Logf func(format string, args ...interface{})
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	}
+}
+
+// checkKey accepts the authorized keys
+func (s *Server) checkKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	blob := key.Marshal()
+	for _, authorized := range s.AuthorizedKeys {
+		if bytes.Equal(authorized.Marshal(), blob) {
+			return &ssh.Permissions{Extensions: map[string]string{"fingerprint": ssh.FingerprintSHA256(key)}}, nil
+		}
+	}
+	return nil, errNotAuthorized
+}
+
+// Serve accepts connections on the listener. Returns nil when the listener
+// is closed.
+func (s *Server) Serve(l net.Listener) error {
+	if s.HostKey == nil {
+		return errNoHostKey
+	}
+	if s.Root == "" {
+		return errNoRoot
+	}
+	root, err := os.OpenRoot(s.Root)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: s.checkKey,
+		MaxAuthTries:      maxAuthAttempts,
+	}
+	config.AddHostKey(s.HostKey)
+	for {
+		c, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := s.serveConn(c, config, root); err != nil {
+				s.logf("SFTP connection from %s: %s", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// serveConn handles one connection, until it is closed
+func (s *Server) serveConn(c net.Conn, config *ssh.ServerConfig, root *os.Root) error {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(authTimeout))
+	conn, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c.SetDeadline(time.Time{})
+	s.logf("SFTP login from %s with the key %s", c.RemoteAddr(), conn.Permissions.Extensions["fingerprint"])
+
+	go ssh.DiscardRequests(reqs)
+	var open int32
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		if atomic.LoadInt32(&open) >= maxChannels {
+			newChannel.Reject(ssh.ResourceShortage, "too many channels")
+			continue
+		}
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			return err
+		}
+		atomic.AddInt32(&open, 1)
+		go func() {
+			defer atomic.AddInt32(&open, -1)
+			s.serveSession(ch, requests, root)
+		}()
+	}
+	return nil
+}
+
+// serveSession handles the requests for a session channel, where only the
+// SFTP subsystem is supported. Shells and commands are refused.
+func (s *Server) serveSession(ch ssh.Channel, requests <-chan *ssh.Request, root *os.Root) {
+	defer ch.Close()
+	for req := range requests {
+		var subsystem struct{ Name string }
+		if req.Type != "subsystem" || ssh.Unmarshal(req.Payload, &subsystem) != nil || subsystem.Name != "sftp" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		go ssh.DiscardRequests(requests)
+		server := sftp.NewRequestServer(ch, newHandlers(root, s.Changed))
+		if err := server.Serve(); err != nil && err != io.EOF {
+			s.logf("SFTP session failed: %s", err)
+		}
+		server.Close()
+		return
+	}
+}
@@ -0,0 +1,174 @@
+package sftpd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// newKey returns a new Ed25519 key, for the client or the host
+func newKey(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	key := newKey(t).PublicKey()
+	line := string(ssh.MarshalAuthorizedKey(key))
+	data := "# admin keys\n\n" +
+		line[:len(line)-1] + " alice@example.com\n" +
+		`no-pty,from="10.0.0.1" ` + line +
+		"ssh-dss AAAAB3NzaC1kc3M= old\n"
+	keys, err := ParseAuthorizedKeys([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, expected 2", len(keys))
+	}
+	if keys[0].Type() != ssh.KeyAlgoED25519 {
+		t.Errorf("unexpected key type: %s", keys[0].Type())
+	}
+}
+
+func TestHostKey(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "keys", "host_key")
+	key, err := HostKey(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := HostKey(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if HostKeyFingerprint(key) != HostKeyFingerprint(again) {
+		t.Error("a different key was read from the file")
+	}
+	if fi, err := os.Stat(filename); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("the host key file should only be readable by the owner: %v", err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	dir := t.TempDir()
+	clientKey := newKey(t)
+	var (
+		mut     sync.Mutex
+		changed []string
+	)
+	server := &Server{
+		Root:           dir,
+		HostKey:        newKey(t),
+		AuthorizedKeys: []ssh.PublicKey{clientKey.PublicKey()},
+		Changed: func(name string) {
+			mut.Lock()
+			changed = append(changed, name)
+			mut.Unlock()
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go server.Serve(l)
+
+	// Keys that are not authorized can not log in
+	config := &ssh.ClientConfig{
+		User:            "deploy",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(newKey(t))},
+		HostKeyCallback: ssh.FixedHostKey(server.HostKey.PublicKey()),
+	}
+	if _, err := ssh.Dial("tcp", l.Addr().String(), config); err == nil {
+		t.Fatal("logged in with a key that is not authorized")
+	}
+
+	config.Auth = []ssh.AuthMethod{ssh.PublicKeys(clientKey)}
+	conn, err := ssh.Dial("tcp", l.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Commands are refused
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Run("ls"); err == nil {
+		t.Error("expected commands to be refused")
+	}
+	session.Close()
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Paths above the root end up in the root
+	f, err := client.Create("../../index.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("# Hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.md"))
+	if err != nil || string(data) != "# Hello" {
+		t.Errorf("unexpected file contents: %q, %v", data, err)
+	}
+
+	if err := client.Mkdir("/blog"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rename("index.md", "blog/index.md"); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := client.ReadDir("/blog")
+	if err != nil || len(infos) != 1 || infos[0].Name() != "index.md" {
+		t.Errorf("unexpected directory listing: %v, %v", infos, err)
+	}
+	if _, err := client.Stat("missing"); !os.IsNotExist(err) {
+		t.Errorf("expected no such file, got %v", err)
+	}
+
+	// Symbolic links can not be followed out of the root
+	if err := os.Symlink(os.TempDir(), filepath.Join(dir, "tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Create("/tmp/escaped"); err == nil {
+		t.Error("wrote a file outside of the root")
+	}
+
+	mut.Lock()
+	defer mut.Unlock()
+	expected := []string{"/index.md", "/blog", "/index.md", "/blog/index.md"}
+	if len(changed) != len(expected) {
+		t.Fatalf("unexpected changes: %v", changed)
+	}
+	for i := range expected {
+		if changed[i] != expected[i] {
+			t.Errorf("unexpected changes: %v", changed)
+			break
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Package spam checks comments and form submissions for spam, with simple
+// heuristics and optionally with an Akismet-compatible service
+package spam
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultAkismetURL is the API endpoint that is used by default. "%s" is
+// replaced with the API key.
+const DefaultAkismetURL = "https://%s.rest.akismet.com/1.1/comment-check"
+
+// Content is a comment or form submission
+type Content struct {
+	Author    string
+	Email     string
+	URL       string
+	Text      string
+	IP        string
+	UserAgent string
+	Referrer  string
+}
+
+// Checker checks content with heuristics, and optionally with Akismet
+type Checker struct {
+	// The maximum number of links in the text, or 0 for no limit
+	MaxLinks int
+	// Words, hosts and e-mail addresses that are not allowed, in lowercase
+	Blacklist []string
+	// For checking with an Akismet-compatible service, if the key is set
+	AkismetKey string
+	AkismetURL string
+	Site       string
+	HTTPClient *http.Client
+}
+
+var linkPattern = regexp.MustCompile(`(?i)https?://|www\.|<a\s|\[url`)
+
+// NewChecker creates a checker that allows a few links and has an empty
+// blacklist
+func NewChecker() *Checker {
+	return &Checker{
+		MaxLinks:   2,
+		AkismetURL: DefaultAkismetURL,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Links returns the number of links in the text
+func Links(text string) int {
+	return len(linkPattern.FindAllStringIndex(text, -1))
+}
+
+// Check returns the reasons for the content being spam, or nothing if the
+// content seems to be fine. An error is returned if the Akismet service
+// could not be reached.
+func (c *Checker) Check(content Content) ([]string, error) {
+	var reasons []string
+	if c.MaxLinks > 0 {
+		if links := Links(content.Text); links > c.MaxLinks {
+			reasons = append(reasons, "too many links")
+		}
+	}
+	all := strings.ToLower(strings.Join([]string{content.Author, content.Email, content.URL, content.Text}, "\n"))
+	for _, word := range c.Blacklist {
+		if word != "" && strings.Contains(all, word) {
+			reasons = append(reasons, "blacklisted: "+word)
+			break
+		}
+	}
+	if len(reasons) > 0 || c.AkismetKey == "" {
+		return reasons, nil
+	}
+	isSpam, err := c.akismet(content)
+	if err != nil {
+		return nil, err
+	}
+	if isSpam {
+		reasons = append(reasons, "akismet")
+	}
+	return reasons, nil
+}
+
+// akismet checks the content with an Akismet-compatible service
+func (c *Checker) akismet(content Content) (bool, error) {
+	endpoint := c.AkismetURL
+	if strings.Contains(endpoint, "%s") {
+		endpoint = strings.Replace(endpoint, "%s", url.PathEscape(c.AkismetKey), 1)
+	}
+	values := url.Values{
+		"api_key":              {c.AkismetKey},
+		"blog":                 {c.Site},
+		"user_ip":              {content.IP},
+		"user_agent":           {content.UserAgent},
+		"referrer":             {content.Referrer},
+		"comment_type":         {"comment"},
+		"comment_author":       {content.Author},
+		"comment_author_email": {content.Email},
+		"comment_author_url":   {content.URL},
+		"comment_content":      {content.Text},
+	}
+	resp, err := c.HTTPClient.PostForm(endpoint, values)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	switch strings.TrimSpace(string(body)) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if message := resp.Header.Get("X-akismet-debug-help"); message != "" {
+		return false, errors.New(message)
+	}
+	return false, errors.New("unexpected response from the spam service: " + resp.Status)
+}
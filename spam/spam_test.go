@@ -0,0 +1,44 @@
+package spam
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHeuristics(t *testing.T) {
+	c := NewChecker()
+	c.Blacklist = []string{"casino"}
+	if reasons, _ := c.Check(Content{Text: "Nice post!"}); len(reasons) != 0 {
+		t.Errorf("unexpected reasons: %v", reasons)
+	}
+	if reasons, _ := c.Check(Content{Text: "http://a.com http://b.com www.c.com"}); len(reasons) != 1 {
+		t.Errorf("too many links should be spam: %v", reasons)
+	}
+	if reasons, _ := c.Check(Content{Author: "Best CASINO"}); len(reasons) != 1 {
+		t.Errorf("blacklisted words should be spam: %v", reasons)
+	}
+}
+
+func TestAkismet(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if strings.Contains(req.PostForm.Get("comment_content"), "viagra") {
+			w.Write([]byte("true"))
+			return
+		}
+		w.Write([]byte("false"))
+	}))
+	defer ts.Close()
+
+	c := NewChecker()
+	c.AkismetKey = "key"
+	c.AkismetURL = ts.URL
+	if reasons, err := c.Check(Content{Text: "buy viagra"}); err != nil || len(reasons) != 1 {
+		t.Errorf("expected spam, got %v, %v", reasons, err)
+	}
+	if reasons, err := c.Check(Content{Text: "hello"}); err != nil || len(reasons) != 0 {
+		t.Errorf("expected no spam, got %v, %v", reasons, err)
+	}
+}
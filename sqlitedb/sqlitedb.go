@@ -0,0 +1,354 @@
+// Package sqlitedb provides data structures, users and permissions that are
+// stored in an SQLite database file, with the same interfaces as the other
+// database backends.
+package sqlitedb
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+
+	"github.com/xyproto/algernon/memdb"
+	"github.com/xyproto/pinterface"
+
+	// The SQLite driver, registered as "sqlite"
+	_ "modernc.org/sqlite"
+)
+
+// DriverName is the name of the SQLite driver for database/sql
+const DriverName = "sqlite"
+
+var errNotFound = errors.New("no such key")
+
+// The tables for the data structures
+const schema = `
+CREATE TABLE IF NOT EXISTS lists (id TEXT NOT NULL, seq INTEGER PRIMARY KEY AUTOINCREMENT, value TEXT NOT NULL);
+CREATE INDEX IF NOT EXISTS lists_id ON lists (id);
+CREATE TABLE IF NOT EXISTS sets (id TEXT NOT NULL, value TEXT NOT NULL, PRIMARY KEY (id, value));
+CREATE TABLE IF NOT EXISTS hashmaps (id TEXT NOT NULL, owner TEXT NOT NULL, key TEXT NOT NULL, value TEXT NOT NULL, PRIMARY KEY (id, owner, key));
+CREATE TABLE IF NOT EXISTS keyvalues (id TEXT NOT NULL, key TEXT NOT NULL, value TEXT NOT NULL, PRIMARY KEY (id, key));
+`
+
+// Database is an SQLite database file
+type Database struct {
+	db *sql.DB
+}
+
+// Open opens or creates the given SQLite database file, and creates the
+// tables for the data structures if needed
+func Open(filename string) (*Database, error) {
+	db, err := sql.Open(DriverName, filename)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer at a time
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Database{db}, nil
+}
+
+// DB returns the underlying database connection pool
+func (db *Database) DB() *sql.DB {
+	return db.db
+}
+
+// Ping checks that the database can be used. It helps fulfill the IHost interface.
+func (db *Database) Ping() error {
+	return db.db.Ping()
+}
+
+// Close closes the database. It helps fulfill the IHost interface.
+func (db *Database) Close() {
+	db.db.Close()
+}
+
+// strings runs a query that returns one column of strings
+func (db *Database) strings(query string, args ...interface{}) ([]string, error) {
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := []string{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// List is a list of strings
+type List struct {
+	db *Database
+	id string
+}
+
+// NewList returns the list with the given name
+func NewList(db *Database, id string) *List {
+	return &List{db, id}
+}
+
+// Add a value to the end of the list
+func (l *List) Add(value string) error {
+	_, err := l.db.db.Exec("INSERT INTO lists (id, value) VALUES (?, ?)", l.id, value)
+	return err
+}
+
+// All returns all the values in the list
+func (l *List) All() ([]string, error) {
+	return l.db.strings("SELECT value FROM lists WHERE id = ? ORDER BY seq", l.id)
+}
+
+// Last returns the last value in the list, or an empty string
+func (l *List) Last() (string, error) {
+	var value string
+	err := l.db.db.QueryRow("SELECT value FROM lists WHERE id = ? ORDER BY seq DESC LIMIT 1", l.id).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// LastN returns the last n values in the list
+func (l *List) LastN(n int) ([]string, error) {
+	return l.db.strings("SELECT value FROM (SELECT seq, value FROM lists WHERE id = ? ORDER BY seq DESC LIMIT ?) ORDER BY seq", l.id, n)
+}
+
+// Remove the list
+func (l *List) Remove() error {
+	_, err := l.db.db.Exec("DELETE FROM lists WHERE id = ?", l.id)
+	return err
+}
+
+// Clear removes all values from the list
+func (l *List) Clear() error {
+	return l.Remove()
+}
+
+// Set is a set of strings
+type Set struct {
+	db *Database
+	id string
+}
+
+// NewSet returns the set with the given name
+func NewSet(db *Database, id string) *Set {
+	return &Set{db, id}
+}
+
+// Add a value to the set
+func (s *Set) Add(value string) error {
+	_, err := s.db.db.Exec("INSERT OR IGNORE INTO sets (id, value) VALUES (?, ?)", s.id, value)
+	return err
+}
+
+// Has checks if the given value is in the set
+func (s *Set) Has(value string) (bool, error) {
+	var n int
+	err := s.db.db.QueryRow("SELECT COUNT(*) FROM sets WHERE id = ? AND value = ?", s.id, value).Scan(&n)
+	return n > 0, err
+}
+
+// All returns all the values in the set, sorted
+func (s *Set) All() ([]string, error) {
+	return s.db.strings("SELECT value FROM sets WHERE id = ? ORDER BY value", s.id)
+}
+
+// Del removes a value from the set
+func (s *Set) Del(value string) error {
+	_, err := s.db.db.Exec("DELETE FROM sets WHERE id = ? AND value = ?", s.id, value)
+	return err
+}
+
+// Remove the set
+func (s *Set) Remove() error {
+	_, err := s.db.db.Exec("DELETE FROM sets WHERE id = ?", s.id)
+	return err
+}
+
+// Clear removes all values from the set
+func (s *Set) Clear() error {
+	return s.Remove()
+}
+
+// HashMap is a map from owners, like usernames, to keys and values
+type HashMap struct {
+	db *Database
+	id string
+}
+
+// NewHashMap returns the hash map with the given name
+func NewHashMap(db *Database, id string) *HashMap {
+	return &HashMap{db, id}
+}
+
+// Set a value for an owner and a key
+func (h *HashMap) Set(owner, key, value string) error {
+	_, err := h.db.db.Exec("INSERT OR REPLACE INTO hashmaps (id, owner, key, value) VALUES (?, ?, ?, ?)", h.id, owner, key, value)
+	return err
+}
+
+// Get a value, given an owner and a key. Returns an error if the value is missing.
+func (h *HashMap) Get(owner, key string) (string, error) {
+	var value string
+	err := h.db.db.QueryRow("SELECT value FROM hashmaps WHERE id = ? AND owner = ? AND key = ?", h.id, owner, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", errNotFound
+	}
+	return value, err
+}
+
+// Has checks if the given owner has the given key
+func (h *HashMap) Has(owner, key string) (bool, error) {
+	var n int
+	err := h.db.db.QueryRow("SELECT COUNT(*) FROM hashmaps WHERE id = ? AND owner = ? AND key = ?", h.id, owner, key).Scan(&n)
+	return n > 0, err
+}
+
+// Exists checks if the given owner has any keys
+func (h *HashMap) Exists(owner string) (bool, error) {
+	var n int
+	err := h.db.db.QueryRow("SELECT COUNT(*) FROM hashmaps WHERE id = ? AND owner = ?", h.id, owner).Scan(&n)
+	return n > 0, err
+}
+
+// All returns all the owners, sorted
+func (h *HashMap) All() ([]string, error) {
+	return h.db.strings("SELECT DISTINCT owner FROM hashmaps WHERE id = ? ORDER BY owner", h.id)
+}
+
+// Keys returns all the keys for the given owner, sorted
+func (h *HashMap) Keys(owner string) ([]string, error) {
+	return h.db.strings("SELECT key FROM hashmaps WHERE id = ? AND owner = ? ORDER BY key", h.id, owner)
+}
+
+// DelKey removes a key for the given owner
+func (h *HashMap) DelKey(owner, key string) error {
+	_, err := h.db.db.Exec("DELETE FROM hashmaps WHERE id = ? AND owner = ? AND key = ?", h.id, owner, key)
+	return err
+}
+
+// Del removes an owner and all the keys for it
+func (h *HashMap) Del(owner string) error {
+	_, err := h.db.db.Exec("DELETE FROM hashmaps WHERE id = ? AND owner = ?", h.id, owner)
+	return err
+}
+
+// Remove the hash map
+func (h *HashMap) Remove() error {
+	_, err := h.db.db.Exec("DELETE FROM hashmaps WHERE id = ?", h.id)
+	return err
+}
+
+// Clear removes all owners, keys and values from the hash map
+func (h *HashMap) Clear() error {
+	return h.Remove()
+}
+
+// KeyValue is a map from keys to values
+type KeyValue struct {
+	db *Database
+	id string
+}
+
+// NewKeyValue returns the key/value map with the given name
+func NewKeyValue(db *Database, id string) *KeyValue {
+	return &KeyValue{db, id}
+}
+
+// Set a value
+func (kv *KeyValue) Set(key, value string) error {
+	_, err := kv.db.db.Exec("INSERT OR REPLACE INTO keyvalues (id, key, value) VALUES (?, ?, ?)", kv.id, key, value)
+	return err
+}
+
+// Get a value. Returns an error if the value is missing.
+func (kv *KeyValue) Get(key string) (string, error) {
+	var value string
+	err := kv.db.db.QueryRow("SELECT value FROM keyvalues WHERE id = ? AND key = ?", kv.id, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", errNotFound
+	}
+	return value, err
+}
+
+// Del removes a value
+func (kv *KeyValue) Del(key string) error {
+	_, err := kv.db.db.Exec("DELETE FROM keyvalues WHERE id = ? AND key = ?", kv.id, key)
+	return err
+}
+
+// Inc increases the number that is stored for the given key, and returns
+// the new number. Missing values count as 0.
+func (kv *KeyValue) Inc(key string) (string, error) {
+	tx, err := kv.db.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var value string
+	err = tx.QueryRow("SELECT value FROM keyvalues WHERE id = ? AND key = ?", kv.id, key).Scan(&value)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	n, _ := strconv.ParseInt(value, 10, 64)
+	value = strconv.FormatInt(n+1, 10)
+	if _, err := tx.Exec("INSERT OR REPLACE INTO keyvalues (id, key, value) VALUES (?, ?, ?)", kv.id, key, value); err != nil {
+		return "", err
+	}
+	return value, tx.Commit()
+}
+
+// Remove the key/value map
+func (kv *KeyValue) Remove() error {
+	_, err := kv.db.db.Exec("DELETE FROM keyvalues WHERE id = ?", kv.id)
+	return err
+}
+
+// Clear removes all keys and values
+func (kv *KeyValue) Clear() error {
+	return kv.Remove()
+}
+
+// Creator is for creating data structures in a database
+type Creator struct {
+	db *Database
+}
+
+// NewCreator returns a Creator for the given database
+func NewCreator(db *Database) *Creator {
+	return &Creator{db}
+}
+
+// NewList returns the list with the given name
+func (c *Creator) NewList(id string) (pinterface.IList, error) {
+	return NewList(c.db, id), nil
+}
+
+// NewSet returns the set with the given name
+func (c *Creator) NewSet(id string) (pinterface.ISet, error) {
+	return NewSet(c.db, id), nil
+}
+
+// NewHashMap returns the hash map with the given name
+func (c *Creator) NewHashMap(id string) (pinterface.IHashMap, error) {
+	return NewHashMap(c.db, id), nil
+}
+
+// NewKeyValue returns the key/value map with the given name
+func (c *Creator) NewKeyValue(id string) (pinterface.IKeyValue, error) {
+	return NewKeyValue(c.db, id), nil
+}
+
+// NewPermissions creates permissions and a user state where the users are
+// stored in the given database, with the same default path prefixes as the
+// other database backends
+func NewPermissions(db *Database) (pinterface.IPermissions, error) {
+	return memdb.NewPermissionsWith(db, NewCreator(db))
+}
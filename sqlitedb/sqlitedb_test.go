@@ -0,0 +1,83 @@
+package sqlitedb
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/xyproto/pinterface"
+)
+
+// The SQLite types must be usable in place of the other database backends
+var (
+	_ pinterface.ICreator = &Creator{}
+	_ pinterface.IHost    = &Database{}
+)
+
+func TestDataStructures(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewList(db, "l")
+	for _, value := range []string{"a", "b", "c"} {
+		l.Add(value)
+	}
+	if last, _ := l.LastN(2); len(last) != 2 || last[0] != "b" || last[1] != "c" {
+		t.Errorf("expected [b c], got %v", last)
+	}
+	NewSet(db, "s").Add("b")
+	NewHashMap(db, "h").Set("bob", "color", "blue")
+	kv := NewKeyValue(db, "kv")
+	kv.Inc("n")
+	if n, _ := kv.Inc("n"); n != "2" {
+		t.Fatalf("expected 2, got %s", n)
+	}
+	db.Close()
+
+	// The contents must still be there when the file is opened again
+	db, err = Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if last, _ := NewList(db, "l").Last(); last != "c" {
+		t.Errorf("expected c, got %q", last)
+	}
+	if has, _ := NewSet(db, "s").Has("b"); !has {
+		t.Error("expected the set to contain b")
+	}
+	if color, _ := NewHashMap(db, "h").Get("bob", "color"); color != "blue" {
+		t.Errorf("expected blue, got %q", color)
+	}
+	if _, err := NewHashMap(db, "h").Get("bob", "size"); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+	if n, _ := NewKeyValue(db, "kv").Get("n"); n != "2" {
+		t.Errorf("expected 2, got %q", n)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	perm, err := NewPermissions(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := perm.UserState()
+	state.AddUser("bob", "hunter2", "bob@example.com")
+	if !state.HasUser("bob") || !state.CorrectPassword("bob", "hunter2") || state.CorrectPassword("bob", "hunter3") {
+		t.Fatal("wrong password check")
+	}
+	if email, _ := state.Email("bob"); email != "bob@example.com" {
+		t.Errorf("expected bob@example.com, got %q", email)
+	}
+	state.RemoveUser("bob")
+	if state.HasUser("bob") {
+		t.Error("expected the user to be removed")
+	}
+}
@@ -0,0 +1,238 @@
+// Package sysloghook provides logrus hooks that send log entries to syslog
+// or to the systemd journal
+package sysloghook
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The sockets of the local syslog daemon and of the systemd journal
+var (
+	syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+	journalSocket = "/run/systemd/journal/socket"
+)
+
+// facilities are the syslog facilities, by name
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// ParseFacility returns the number of a syslog facility, like "daemon" or
+// "local0"
+func ParseFacility(name string) (int, error) {
+	facility, ok := facilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown syslog facility: %s", name)
+	}
+	return facility, nil
+}
+
+// Severity returns the syslog severity for a logrus level
+func Severity(level log.Level) int {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return 2 // critical
+	case log.ErrorLevel:
+		return 3 // error
+	case log.WarnLevel:
+		return 4 // warning
+	case log.InfoLevel:
+		return 6 // informational
+	}
+	return 7 // debug
+}
+
+// levelsUpTo returns the logrus levels that are at least as severe as the
+// given level
+func levelsUpTo(level log.Level) []log.Level {
+	var levels []log.Level
+	for _, l := range log.AllLevels {
+		if l <= level {
+			levels = append(levels, l)
+		}
+	}
+	return levels
+}
+
+// text returns the message of a log entry, followed by the fields
+func text(entry *log.Entry) string {
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	sb.WriteString(entry.Message)
+	for _, key := range keys {
+		fmt.Fprintf(&sb, " %s=%v", key, entry.Data[key])
+	}
+	return sb.String()
+}
+
+// Tag returns the name of the running executable, for tagging log entries
+func Tag() string {
+	return filepath.Base(os.Args[0])
+}
+
+// Hook sends log entries to syslog or to the systemd journal
+type Hook struct {
+	mut      sync.Mutex
+	conn     net.Conn
+	local    bool
+	journal  bool
+	facility int
+	tag      string
+	hostname string
+	levels   []log.Level
+}
+
+// NewSyslog connects to a syslog daemon. The address can be empty for the
+// local syslog daemon, "host:port" for UDP, or "tcp://host:port" or
+// "udp://host:port". Entries are sent with the given facility and tag, if
+// they are at least as severe as the given level.
+func NewSyslog(address string, facility int, tag string, level log.Level) (*Hook, error) {
+	h := &Hook{facility: facility, tag: tag, levels: levelsUpTo(level)}
+	if err := h.dialSyslog(address); err != nil {
+		return nil, err
+	}
+	h.hostname, _ = os.Hostname()
+	return h, nil
+}
+
+// dialSyslog connects to the local syslog daemon, or to the given address
+func (h *Hook) dialSyslog(address string) error {
+	if address == "" {
+		for _, socket := range syslogSockets {
+			for _, network := range []string{"unixgram", "unix"} {
+				if conn, err := net.Dial(network, socket); err == nil {
+					h.conn, h.local = conn, true
+					return nil
+				}
+			}
+		}
+		return errors.New("could not connect to the local syslog daemon")
+	}
+	network := "udp"
+	if pos := strings.Index(address, "://"); pos != -1 {
+		network, address = address[:pos], address[pos+3:]
+	}
+	if network != "udp" && network != "tcp" {
+		return fmt.Errorf("unsupported syslog network: %s", network)
+	}
+	conn, err := net.DialTimeout(network, address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	h.conn = conn
+	return nil
+}
+
+// NewJournal connects to the systemd journal. Entries are sent with the
+// given facility and identifier, if they are at least as severe as the
+// given level.
+func NewJournal(facility int, identifier string, level log.Level) (*Hook, error) {
+	conn, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return nil, err
+	}
+	return &Hook{conn: conn, journal: true, facility: facility, tag: identifier, levels: levelsUpTo(level)}, nil
+}
+
+// Levels returns the logrus levels that are sent
+func (h *Hook) Levels() []log.Level {
+	return h.levels
+}
+
+// Fire sends a log entry
+func (h *Hook) Fire(entry *log.Entry) error {
+	var msg []byte
+	if h.journal {
+		msg = h.journalMessage(entry)
+	} else {
+		msg = h.syslogMessage(entry)
+	}
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	_, err := h.conn.Write(msg)
+	return err
+}
+
+// syslogMessage formats a log entry for syslog, in the same way as the
+// log/syslog package
+func (h *Hook) syslogMessage(entry *log.Entry) []byte {
+	priority := h.facility*8 + Severity(entry.Level)
+	msg := strings.TrimRight(text(entry), "\n")
+	if h.local {
+		return []byte(fmt.Sprintf("<%d>%s %s[%d]: %s\n", priority, entry.Time.Format(time.Stamp), h.tag, os.Getpid(), msg))
+	}
+	return []byte(fmt.Sprintf("<%d>%s %s %s[%d]: %s\n", priority, entry.Time.Format(time.RFC3339), h.hostname, h.tag, os.Getpid(), msg))
+}
+
+// journalField returns a valid journal field name for a logrus field,
+// with only uppercase letters, digits and underscores
+func journalField(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'):
+			return r
+		}
+		return '_'
+	}, key)
+	// Fields that start with an underscore are reserved by the journal
+	return strings.TrimLeft(name, "_0123456789")
+}
+
+// writeJournalField writes a field in the native journal protocol, where
+// values with newlines are written with their length in front
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name + "=" + value + "\n")
+		return
+	}
+	buf.WriteString(name + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+// journalMessage formats a log entry for the native journal protocol, with
+// the logrus fields as journal fields
+func (h *Hook) journalMessage(entry *log.Entry) []byte {
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", entry.Message)
+	writeJournalField(&buf, "PRIORITY", fmt.Sprint(Severity(entry.Level)))
+	writeJournalField(&buf, "SYSLOG_FACILITY", fmt.Sprint(h.facility))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", h.tag)
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if name := journalField(key); name != "" {
+			writeJournalField(&buf, name, fmt.Sprint(entry.Data[key]))
+		}
+	}
+	return buf.Bytes()
+}
+
+// Close closes the connection
+func (h *Hook) Close() error {
+	return h.conn.Close()
+}
@@ -0,0 +1,88 @@
+package sysloghook
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestParseFacility(t *testing.T) {
+	if f, err := ParseFacility("LOCAL3"); err != nil || f != 19 {
+		t.Errorf("got %d and %v, expected 19", f, err)
+	}
+	if _, err := ParseFacility("nope"); err == nil {
+		t.Error("expected an error for an unknown facility")
+	}
+}
+
+func TestSyslog(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	h, err := NewSyslog(pc.LocalAddr().String(), 3, "algernon", log.InfoLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if len(h.Levels()) != 5 {
+		t.Errorf("expected the levels from panic to info, got %v", h.Levels())
+	}
+	entry := &log.Entry{Level: log.WarnLevel, Time: time.Now(), Message: "disk full", Data: log.Fields{"free": 0}}
+	if err := h.Fire(entry); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	// daemon (3) * 8 + warning (4)
+	if !strings.HasPrefix(msg, "<28>") || !strings.HasSuffix(msg, " algernon["+strconv.Itoa(os.Getpid())+"]: disk full free=0\n") {
+		t.Errorf("unexpected message: %q", msg)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	journalSocket = filepath.Join(t.TempDir(), "socket")
+	pc, err := net.ListenPacket("unixgram", journalSocket)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer pc.Close()
+	h, err := NewJournal(3, "algernon", log.DebugLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	entry := &log.Entry{Level: log.ErrorLevel, Message: "line one\nline two", Data: log.Fields{"request-id": "abc"}}
+	if err := h.Fire(entry); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	for _, expected := range []string{
+		"MESSAGE\n\x11\x00\x00\x00\x00\x00\x00\x00line one\nline two\n",
+		"PRIORITY=3\n",
+		"SYSLOG_IDENTIFIER=algernon\n",
+		"REQUEST_ID=abc\n",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("missing %q in %q", expected, msg)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// The largest number of line pairs that are compared with DiffLines,
+// before falling back to comparing the lines one by one
+const maxDiffCells = 4000000
+
+// DiffLines returns the lines that have been removed from a (prefixed with
+// "- ") and added in b (prefixed with "+ "), in order
+func DiffLines(a, b []string) []string {
+	var diff []string
+	if len(a)*len(b) > maxDiffCells {
+		// Too large for finding the longest common subsequence, compare line by line
+		for i := 0; i < len(a) || i < len(b); i++ {
+			switch {
+			case i >= len(a):
+				diff = append(diff, "+ "+b[i])
+			case i >= len(b):
+				diff = append(diff, "- "+a[i])
+			case a[i] != b[i]:
+				diff = append(diff, "- "+a[i], "+ "+b[i])
+			}
+		}
+		return diff
+	}
+	// Find the length of the longest common subsequence, for all suffixes
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, "- "+a[i])
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, "+ "+b[j])
+	}
+	return diff
+}
+
+// DiffJSON compares two decoded JSON documents and returns one line for
+// each value that differs, with a path like "$.users[2].name"
+func DiffJSON(a, b interface{}) []string {
+	return diffJSON("$", a, b)
+}
+
+// jsonString returns a short JSON representation of a value
+func jsonString(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(data)
+}
+
+func diffJSON(path string, a, b interface{}) []string {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		var keys []string
+		for key := range av {
+			keys = append(keys, key)
+		}
+		for key := range bv {
+			if _, found := av[key]; !found {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		var diff []string
+		for _, key := range keys {
+			aValue, inA := av[key]
+			bValue, inB := bv[key]
+			keyPath := path + "." + key
+			switch {
+			case !inA:
+				diff = append(diff, keyPath+": added "+jsonString(bValue))
+			case !inB:
+				diff = append(diff, keyPath+": removed "+jsonString(aValue))
+			default:
+				diff = append(diff, diffJSON(keyPath, aValue, bValue)...)
+			}
+		}
+		return diff
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		var diff []string
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			indexPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(av):
+				diff = append(diff, indexPath+": added "+jsonString(bv[i]))
+			case i >= len(bv):
+				diff = append(diff, indexPath+": removed "+jsonString(av[i]))
+			default:
+				diff = append(diff, diffJSON(indexPath, av[i], bv[i])...)
+			}
+		}
+		return diff
+	}
+	if jsonString(a) != jsonString(b) {
+		return []string{path + ": " + jsonString(a) + " != " + jsonString(b)}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestDiffLines(t *testing.T) {
+	diff := DiffLines([]string{"a", "b", "c"}, []string{"a", "x", "c", "d"})
+	assert.Equal(t, diff, []string{"- b", "+ x", "+ d"})
+	assert.Equal(t, len(DiffLines([]string{"a"}, []string{"a"})), 0)
+}
+
+func TestDiffJSON(t *testing.T) {
+	var a, b interface{}
+	json.Unmarshal([]byte(`{"name": "bob", "tags": [1, 2], "old": true}`), &a)
+	json.Unmarshal([]byte(`{"name": "alice", "tags": [1], "new": null}`), &b)
+	assert.Equal(t, DiffJSON(a, b), []string{
+		`$.name: "bob" != "alice"`,
+		`$.new: added null`,
+		`$.old: removed true`,
+		`$.tags[1]: removed 2`,
+	})
+}
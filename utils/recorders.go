@@ -1,21 +1,29 @@
 package utils
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// WriteRecorder writes to a ResponseWriter from a ResponseRecorder.
-// Also flushes the recorder and returns how many bytes were written.
-func WriteRecorder(w http.ResponseWriter, recorder *httptest.ResponseRecorder) int64 {
+// CopyHeaders sets the HTTP headers from a ResponseRecorder on a ResponseWriter
+func CopyHeaders(w http.ResponseWriter, recorder *httptest.ResponseRecorder) {
 	for key, values := range recorder.HeaderMap {
 		for _, value := range values {
 			w.Header().Set(key, value)
 		}
 	}
+}
+
+// WriteRecorder writes to a ResponseWriter from a ResponseRecorder.
+// Also flushes the recorder and returns how many bytes were written.
+func WriteRecorder(w http.ResponseWriter, recorder *httptest.ResponseRecorder) int64 {
+	CopyHeaders(w, recorder)
 	bytesWritten, err := recorder.Body.WriteTo(w)
 	if err != nil {
 		// Writing failed
@@ -34,3 +42,38 @@ func RecorderToString(recorder *httptest.ResponseRecorder) string {
 	recorder.Flush()
 	return buf.String()
 }
+
+// StatusRecorder is a ResponseWriter that keeps track of the HTTP status code
+type StatusRecorder struct {
+	http.ResponseWriter
+	StatusCode int
+}
+
+// NewStatusRecorder wraps the given ResponseWriter. The status code is
+// http.StatusOK until WriteHeader is called.
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, StatusCode: http.StatusOK}
+}
+
+// WriteHeader records the status code, then writes the header
+func (sr *StatusRecorder) WriteHeader(statusCode int) {
+	sr.StatusCode = statusCode
+	sr.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Flush flushes the wrapped ResponseWriter, if possible
+func (sr *StatusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the wrapped ResponseWriter be hijacked, for WebSockets
+func (sr *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer can not be hijacked")
+	}
+	sr.StatusCode = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
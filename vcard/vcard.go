@@ -0,0 +1,92 @@
+// Package vcard generates contact cards in the vCard 3.0 format, as
+// described in RFC 2426, that phones and address books can import
+package vcard
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+// Card is a contact card
+type Card struct {
+	Name       string // the full name, made from the first and last name if empty
+	FirstName  string
+	LastName   string
+	Org        string
+	Title      string
+	Phone      string
+	Mobile     string
+	Email      string
+	URL        string
+	Street     string
+	City       string
+	Region     string
+	PostalCode string
+	Country    string
+	Birthday   string // like "1990-05-17"
+	Note       string
+}
+
+// escape escapes a text value
+func escape(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`, "\r", `\n`).Replace(s)
+}
+
+// writeLine writes a content line, folded so that no line is longer than
+// 75 bytes, without splitting UTF-8 sequences
+func writeLine(buf *bytes.Buffer, line string) {
+	limit := 75
+	for len(line) > limit {
+		n := limit
+		for n > 0 && !utf8.RuneStart(line[n]) {
+			n--
+		}
+		buf.WriteString(line[:n])
+		buf.WriteString("\r\n ")
+		line = line[n:]
+		// The space at the start of the next line counts too
+		limit = 74
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+// Bytes returns the card in the vCard format
+func (c *Card) Bytes() []byte {
+	var buf bytes.Buffer
+	name := c.Name
+	if name == "" {
+		name = strings.TrimSpace(c.FirstName + " " + c.LastName)
+	}
+	if name == "" {
+		name = c.Org
+	}
+	writeLine(&buf, "BEGIN:VCARD")
+	writeLine(&buf, "VERSION:3.0")
+	writeLine(&buf, "FN:"+escape(name))
+	writeLine(&buf, "N:"+escape(c.LastName)+";"+escape(c.FirstName)+";;;")
+	property := func(name, value string) {
+		if value != "" {
+			writeLine(&buf, name+":"+escape(value))
+		}
+	}
+	property("ORG", c.Org)
+	property("TITLE", c.Title)
+	property("TEL;TYPE=WORK,VOICE", c.Phone)
+	property("TEL;TYPE=CELL,VOICE", c.Mobile)
+	property("EMAIL;TYPE=INTERNET", c.Email)
+	if c.URL != "" {
+		// URLs are not text values, and are not escaped
+		writeLine(&buf, "URL:"+c.URL)
+	}
+	if c.Street != "" || c.City != "" || c.Region != "" || c.PostalCode != "" || c.Country != "" {
+		fields := []string{"", "", escape(c.Street), escape(c.City), escape(c.Region), escape(c.PostalCode), escape(c.Country)}
+		writeLine(&buf, "ADR;TYPE=WORK:"+strings.Join(fields, ";"))
+	}
+	property("BDAY", c.Birthday)
+	property("NOTE", c.Note)
+	writeLine(&buf, "END:VCARD")
+	return buf.Bytes()
+}
@@ -0,0 +1,36 @@
+package vcard
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCard(t *testing.T) {
+	c := &Card{
+		FirstName: "Ada",
+		LastName:  "Lovelace",
+		Org:       "Analytical Engines, Ltd.",
+		Email:     "ada@example.com",
+		City:      "London",
+		Note:      strings.Repeat("Notes; with, punctuation\n", 5),
+	}
+	card := string(c.Bytes())
+	for _, expected := range []string{
+		"BEGIN:VCARD\r\nVERSION:3.0\r\n",
+		"FN:Ada Lovelace\r\n",
+		"N:Lovelace;Ada;;;\r\n",
+		"ORG:Analytical Engines\\, Ltd.\r\n",
+		"ADR;TYPE=WORK:;;;London;;;\r\n",
+		"NOTE:Notes\\; with\\, punctuation\\n",
+		"END:VCARD\r\n",
+	} {
+		if !strings.Contains(card, expected) {
+			t.Errorf("missing %q in:\n%s", expected, card)
+		}
+	}
+	for _, line := range strings.Split(card, "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line is too long: %q", line)
+		}
+	}
+}